@@ -0,0 +1,371 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+    DefaultAdmissionWorkers = 16
+    DefaultAdmissionQueue   = 1024
+    DefaultHandshakeRate    = 5.0 // unknown-key handshakes per second per source
+    DefaultHandshakeBurst   = 20
+    
+    // Sources tracked for handshake rate limiting. Idle ones are forgotten,
+    // a new source beyond this is limited outright until then.
+    maxHandshakeSources = 65536
+    handshakeSourceIdle = time.Minute
+)
+
+var (
+    ErrAdmissionShed    = errors.New("operation shed, gateway overloaded")
+    errAdmissionStopped = errors.New("admission control stopped")
+)
+
+// AdmissionConfig bounds bursty control plane work, such as every client
+// of a restarted gateway handshaking and being provisioned at once
+type AdmissionConfig struct {
+    Workers   int // operations run at once, default DefaultAdmissionWorkers
+    QueueSize int // operations waiting, default DefaultAdmissionQueue
+    
+    // Queue slots only existing peers may take, so onboarding new ones is
+    // shed first. Default a quarter of QueueSize.
+    Reserve   int
+    
+    // Per source IP for handshakes from unknown keys, see AllowHandshake
+    HandshakeRate  float64 // per second, default DefaultHandshakeRate
+    HandshakeBurst int     // default DefaultHandshakeBurst
+}
+
+func (c AdmissionConfig) withDefaults() AdmissionConfig {
+    if c.Workers <= 0 {
+        c.Workers = DefaultAdmissionWorkers
+    }
+    if c.QueueSize <= 0 {
+        c.QueueSize = DefaultAdmissionQueue
+    }
+    if c.Reserve <= 0 || c.Reserve >= c.QueueSize {
+        c.Reserve = c.QueueSize / 4
+    }
+    if c.HandshakeRate <= 0 {
+        c.HandshakeRate = DefaultHandshakeRate
+    }
+    if c.HandshakeBurst <= 0 {
+        c.HandshakeBurst = DefaultHandshakeBurst
+    }
+    return c
+}
+
+// AdmissionClass ranks an operation when the queue fills up
+type AdmissionClass int
+
+const (
+    AdmitExisting   AdmissionClass = iota // for a peer we already have
+    AdmitOnboarding                       // for a new peer, shed first
+)
+
+func (c AdmissionClass) tag() string {
+    if c == AdmitOnboarding {
+        return "class:onboarding"
+    }
+    return "class:existing"
+}
+
+// AdmissionStats counts operations since Start, see Status.Admission
+type AdmissionStats struct {
+    Depth             int // waiting now
+    Queued            uint64
+    Processed         uint64
+    ShedExisting      uint64
+    ShedOnboarding    uint64
+    HandshakesLimited uint64
+}
+
+// Admission runs control plane operations on a fixed pool of workers.
+// Operations for existing peers are always taken first, and new peers can't
+// fill the last Reserve queue slots, so a reconnect storm delays onboarding
+// rather than the peers already up.
+type Admission struct {
+    cfg  AdmissionConfig
+    sink func() MetricSink
+    
+    existing   chan func()
+    onboarding chan func()
+    depth      atomic.Int64
+    
+    queued         atomic.Uint64
+    processed      atomic.Uint64
+    shedExisting   atomic.Uint64
+    shedOnboarding atomic.Uint64
+    limited        atomic.Uint64
+    
+    sourcesMu sync.Mutex
+    sources   map[string]*tokenBucket
+    lastSweep time.Time
+    
+    stop     chan struct{}
+    stopOnce sync.Once
+    workers  sync.WaitGroup
+}
+
+func NewAdmission(cfg AdmissionConfig, sink func() MetricSink) *Admission {
+    cfg = cfg.withDefaults()
+    return &Admission{
+        cfg:        cfg,
+        sink:       sink,
+        existing:   make(chan func(), cfg.QueueSize),
+        onboarding: make(chan func(), cfg.QueueSize),
+        sources:    make(map[string]*tokenBucket),
+        stop:       make(chan struct{}),
+    }
+}
+
+// Start runs the workers until Stop
+func (a *Admission) Start() {
+    for i := 0; i < a.cfg.Workers; i++ {
+        a.workers.Add(1)
+        go a.work()
+    }
+}
+
+// Stop ends the workers after the operations they are running. Waiting
+// operations are dropped and their callers get an error.
+func (a *Admission) Stop() {
+    a.StopContext(context.Background())
+}
+
+// StopContext is Stop waiting for the running operations only until ctx
+// is done, then leaving them to finish on their own
+func (a *Admission) StopContext(ctx context.Context) error {
+    a.stopOnce.Do(func() { close(a.stop) })
+    done := make(chan struct{})
+    go func() {
+        a.workers.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+func (a *Admission) work() {
+    defer a.workers.Done()
+    
+    for {
+        // Existing peers first, whatever is waiting for onboarding
+        var task func()
+        select {
+        case task = <-a.existing:
+        default:
+            select {
+            case task = <-a.existing:
+            case task = <-a.onboarding:
+            case <-a.stop:
+                return
+            }
+        }
+        a.depth.Add(-1)
+        task()
+    }
+}
+
+// Queue fn to report to done once counted, false if it was shed
+func (a *Admission) submit(class AdmissionClass, fn func() error, done chan<- error) bool {
+    limit := int64(a.cfg.QueueSize)
+    queue := a.existing
+    shed := &a.shedExisting
+    if class == AdmitOnboarding {
+        limit -= int64(a.cfg.Reserve)
+        queue = a.onboarding
+        shed = &a.shedOnboarding
+    }
+    
+    if a.depth.Add(1) > limit {
+        a.depth.Add(-1)
+        shed.Add(1)
+        a.sink().Count("admission.shed", 1, class.tag())
+        return false
+    }
+    // Never blocks, depth keeps both queues within their capacity
+    queue <- func() {
+        err := fn()
+        a.processed.Add(1)
+        a.sink().Count("admission.processed", 1, class.tag())
+        done <- err
+    }
+    a.queued.Add(1)
+    a.sink().Count("admission.queued", 1, class.tag())
+    return true
+}
+
+// Do runs fn on a worker and returns its error, or ErrAdmissionShed at once
+// when the queue has no room for class
+func (a *Admission) Do(class AdmissionClass, fn func() error) error {
+    return a.DoContext(context.Background(), class, fn)
+}
+
+// DoContext is Do giving up waiting once ctx is done. fn is dropped if it
+// hadn't reached a worker yet.
+func (a *Admission) DoContext(ctx context.Context, class AdmissionClass, fn func() error) error {
+    select {
+    case <-a.stop:
+        return errAdmissionStopped
+    default:
+    }
+    
+    done := make(chan error, 1)
+    queued := func() error {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        return fn()
+    }
+    if !a.submit(class, queued, done) {
+        return ErrAdmissionShed
+    }
+    select {
+    case err := <-done:
+        return err
+    case <-ctx.Done():
+        return ctx.Err()
+    case <-a.stop:
+        select {
+        case err := <-done:
+            return err
+        default:
+            return errAdmissionStopped
+        }
+    }
+}
+
+// Whether a handshake from an unknown key at src may be processed now,
+// one token of the source's bucket
+func (a *Admission) allowSource(src net.IP, now time.Time) bool {
+    a.sourcesMu.Lock()
+    defer a.sourcesMu.Unlock()
+    
+    if now.Sub(a.lastSweep) > handshakeSourceIdle {
+        a.sweepSourcesLocked(now)
+    }
+    key := src.String()
+    bucket, ok := a.sources[key]
+    if !ok {
+        if len(a.sources) >= maxHandshakeSources {
+            return a.limit()
+        }
+        bucket = &tokenBucket{tokens: float64(a.cfg.HandshakeBurst), last: now}
+        a.sources[key] = bucket
+    }
+    if !bucket.take(now, a.cfg.HandshakeRate, float64(a.cfg.HandshakeBurst)) {
+        return a.limit()
+    }
+    return true
+}
+
+func (a *Admission) limit() bool {
+    a.limited.Add(1)
+    a.sink().Count("handshake.rate_limited", 1)
+    return false
+}
+
+// Forget sources idle long enough for their bucket to have refilled.
+// Caller holds sourcesMu.
+func (a *Admission) sweepSourcesLocked(now time.Time) {
+    a.lastSweep = now
+    for key, bucket := range a.sources {
+        if now.Sub(bucket.last) > handshakeSourceIdle {
+            delete(a.sources, key)
+        }
+    }
+}
+
+func (a *Admission) Stats() AdmissionStats {
+    return AdmissionStats{
+        Depth:             int(a.depth.Load()),
+        Queued:            a.queued.Load(),
+        Processed:         a.processed.Load(),
+        ShedExisting:      a.shedExisting.Load(),
+        ShedOnboarding:    a.shedOnboarding.Load(),
+        HandshakesLimited: a.limited.Load(),
+    }
+}
+
+// Refills at rate tokens per second up to burst
+type tokenBucket struct {
+    tokens float64
+    last   time.Time
+}
+
+func (b *tokenBucket) take(now time.Time, rate, burst float64) bool {
+    b.tokens += now.Sub(b.last).Seconds() * rate
+    if b.tokens > burst {
+        b.tokens = burst
+    }
+    b.last = now
+    if b.tokens < 1 {
+        return false
+    }
+    b.tokens--
+    return true
+}
+
+// Admit runs fn through admission control as an operation for the peer
+// with pubKey, ranked by whether that peer exists yet. Use it for work a
+// reconnect storm multiplies, like provisioning lookups. Before Start fn
+// runs directly.
+func (vpn *UnderTheRadarVPN) Admit(pubKey wgtypes.Key, fn func() error) error {
+    return vpn.AdmitContext(context.Background(), pubKey, fn)
+}
+
+// AdmitContext is Admit giving up waiting for a worker once ctx is done
+func (vpn *UnderTheRadarVPN) AdmitContext(ctx context.Context, pubKey wgtypes.Key, fn func() error) error {
+    vpn.mu.RLock()
+    exists := vpn.peers.get(pubKey) != nil
+    admission := vpn.admission
+    vpn.mu.RUnlock()
+    
+    if admission == nil {
+        return fn()
+    }
+    class := AdmitOnboarding
+    if exists {
+        class = AdmitExisting
+    }
+    return admission.DoContext(ctx, class, fn)
+}
+
+// AdmitPeer is AddPeer through admission control, see Admit
+func (vpn *UnderTheRadarVPN) AdmitPeer(peerConfig PeerConfig) error {
+    return vpn.AdmitPeerContext(context.Background(), peerConfig)
+}
+
+// AdmitPeerContext is AddPeerContext through admission control
+func (vpn *UnderTheRadarVPN) AdmitPeerContext(ctx context.Context, peerConfig PeerConfig) error {
+    return vpn.AdmitContext(ctx, peerConfig.PublicKey, func() error {
+        return vpn.AddPeerContext(ctx, peerConfig)
+    })
+}
+
+// AllowHandshake reports whether to process a handshake from pubKey at
+// src. Known peers always may, unknown keys are rate limited per source so
+// a flood of them can't crowd out the peers we serve.
+func (vpn *UnderTheRadarVPN) AllowHandshake(src net.IP, pubKey wgtypes.Key) bool {
+    vpn.mu.RLock()
+    exists := vpn.peers.get(pubKey) != nil
+    admission := vpn.admission
+    vpn.mu.RUnlock()
+    
+    if exists || admission == nil {
+        return true
+    }
+    return admission.allowSource(src, vpn.clock().Now())
+}
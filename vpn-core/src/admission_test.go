@@ -0,0 +1,182 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestAdmissionShedsOnboardingFirst(t *testing.T) {
+    sink := &captureSink{}
+    a := NewAdmission(AdmissionConfig{Workers: 1, QueueSize: 4, Reserve: 2}, func() MetricSink { return sink })
+    a.Start()
+    defer a.Stop()
+    
+    // Hold the only worker so everything else queues
+    release := make(chan struct{})
+    started := make(chan struct{})
+    go a.Do(AdmitExisting, func() error {
+        close(started)
+        <-release
+        return nil
+    })
+    <-started
+    
+    var mu sync.Mutex
+    var order []AdmissionClass
+    results := make(chan error, 8)
+    submit := func(class AdmissionClass) {
+        go func() {
+            results <- a.Do(class, func() error {
+                mu.Lock()
+                order = append(order, class)
+                mu.Unlock()
+                return nil
+            })
+        }()
+    }
+    waitDepth := func(want int) {
+        t.Helper()
+        deadline := time.Now().Add(time.Second)
+        for a.Stats().Depth != want {
+            if time.Now().After(deadline) {
+                t.Fatalf("depth %d, want %d", a.Stats().Depth, want)
+            }
+            time.Sleep(time.Millisecond)
+        }
+    }
+    
+    // New peers may fill the queue up to the reserve
+    submit(AdmitOnboarding)
+    submit(AdmitOnboarding)
+    waitDepth(2)
+    if err := a.Do(AdmitOnboarding, func() error { return nil }); !errors.Is(err, ErrAdmissionShed) {
+        t.Fatalf("onboarding into the reserve: %v", err)
+    }
+    
+    // Existing peers still get in, until the queue is really full
+    submit(AdmitExisting)
+    submit(AdmitExisting)
+    waitDepth(4)
+    if err := a.Do(AdmitExisting, func() error { return nil }); !errors.Is(err, ErrAdmissionShed) {
+        t.Fatalf("existing into a full queue: %v", err)
+    }
+    
+    close(release)
+    for i := 0; i < 4; i++ {
+        if err := <-results; err != nil {
+            t.Fatal(err)
+        }
+    }
+    
+    // Existing peers were served before the onboarding queued ahead of them
+    want := []AdmissionClass{AdmitExisting, AdmitExisting, AdmitOnboarding, AdmitOnboarding}
+    mu.Lock()
+    defer mu.Unlock()
+    for i := range want {
+        if order[i] != want[i] {
+            t.Fatalf("ran in order %v, want %v", order, want)
+        }
+    }
+    
+    stats := a.Stats()
+    if stats.Queued != 5 || stats.Processed != 5 || stats.ShedExisting != 1 || stats.ShedOnboarding != 1 || stats.Depth != 0 {
+        t.Fatalf("stats = %+v", stats)
+    }
+    for _, metric := range []string{"c admission.shed 1 class:onboarding", "c admission.shed 1 class:existing", "c admission.processed 1 class:onboarding"} {
+        if !sink.has(metric) {
+            t.Errorf("missing %q", metric)
+        }
+    }
+}
+
+func TestAllowHandshakeLimitsUnknownKeysPerSource(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    vpn.admission = NewAdmission(AdmissionConfig{HandshakeRate: 2, HandshakeBurst: 3}, vpn.metricSink)
+    known := &Peer{PublicKey: mustKey(t).PublicKey()}
+    vpn.storePeerLocked(known)
+    flooder, other := net.ParseIP("203.0.113.7"), net.ParseIP("198.51.100.1")
+    
+    for i := 0; i < 3; i++ {
+        if !vpn.AllowHandshake(flooder, mustKey(t).PublicKey()) {
+            t.Fatalf("handshake %d refused within the burst", i)
+        }
+    }
+    if vpn.AllowHandshake(flooder, mustKey(t).PublicKey()) {
+        t.Fatal("unknown key allowed past the burst")
+    }
+    
+    // Neither known peers nor other sources pay for the flood
+    if !vpn.AllowHandshake(flooder, known.PublicKey) {
+        t.Fatal("known peer limited")
+    }
+    if !vpn.AllowHandshake(other, mustKey(t).PublicKey()) {
+        t.Fatal("other source limited")
+    }
+    
+    // The bucket refills at HandshakeRate
+    now := time.Now()
+    if !vpn.admission.allowSource(flooder, now.Add(time.Second)) || vpn.admission.Stats().HandshakesLimited != 1 {
+        t.Fatalf("stats = %+v", vpn.admission.Stats())
+    }
+}
+
+func TestAdmitPeerRunsOnPool(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    vpn.admission = NewAdmission(AdmissionConfig{Workers: 2}, vpn.metricSink)
+    vpn.admission.Start()
+    
+    pc := PeerConfig{PublicKey: mustKey(t).PublicKey(), AllowedIPs: []net.IPNet{mustCIDR(t, "10.4.0.0/24")}}
+    if err := vpn.AdmitPeer(pc); err != nil {
+        t.Fatal(err)
+    }
+    if vpn.peers.get(pc.PublicKey) == nil {
+        t.Fatal("peer not added")
+    }
+    if stats := vpn.admission.Stats(); stats.Processed != 1 {
+        t.Fatalf("stats = %+v", stats)
+    }
+    
+    vpn.admission.Stop()
+    if err := vpn.AdmitPeer(pc); err == nil {
+        t.Fatal("admitted after Stop")
+    }
+}
+
+func TestAdmissionStopContextBoundsTheWait(t *testing.T) {
+    a := NewAdmission(AdmissionConfig{Workers: 1}, func() MetricSink { return &captureSink{} })
+    a.Start()
+    
+    // The worker is stuck in an operation, the queued one gives up waiting
+    release := make(chan struct{})
+    defer close(release)
+    started := make(chan struct{})
+    go a.Do(AdmitExisting, func() error {
+        close(started)
+        <-release
+        return nil
+    })
+    <-started
+    ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+    defer cancel()
+    ran := false
+    if err := a.DoContext(ctx, AdmitExisting, func() error { ran = true; return nil }); !errors.Is(err, context.DeadlineExceeded) {
+        t.Fatalf("queued operation: %v", err)
+    }
+    
+    ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+    defer cancel()
+    start := time.Now()
+    if err := a.StopContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+        t.Fatalf("StopContext = %v, want the deadline", err)
+    }
+    if waited := time.Since(start); waited > time.Second {
+        t.Fatalf("StopContext waited %v for the stuck operation", waited)
+    }
+    if ran {
+        t.Fatal("an operation given up on ran")
+    }
+}
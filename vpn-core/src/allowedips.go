@@ -0,0 +1,205 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net"
+)
+
+var (
+    ErrAllowedIPConflict = errors.New("allowed IP is already routed to another peer")
+    ErrInvalidAllowedIP  = errors.New("invalid allowed IP")
+)
+
+// AllowedIPConflictPolicy decides what AddPeer does when a new peer claims
+// a prefix another peer already has. WireGuard itself silently moves the
+// prefix to whichever peer claimed it last. Under AllowedIPByPriority every
+// claimant keeps its claim and the prefix follows the highest Priority
+// healthy one, moving back when a failed peer recovers.
+type AllowedIPConflictPolicy int
+
+const (
+    AllowedIPReject   AllowedIPConflictPolicy = iota // refuse the new peer
+    AllowedIPReassign                                // move the prefix to the new peer, as the kernel would
+    AllowedIPByPriority                              // give the prefix to the best ranked claimant
+)
+
+// Canonical form of a prefix, host bits cleared the way WireGuard stores it
+func prefixKey(prefix net.IPNet) string {
+    masked := net.IPNet{IP: prefix.IP.Mask(prefix.Mask), Mask: prefix.Mask}
+    return masked.String()
+}
+
+// Prefix in the form WireGuard stores it: IPv4 as 4 bytes with a 32-bit
+// mask, IPv6 with a 128-bit mask, host bits cleared. Masks are shared
+// between prefixes and must not be modified. wgctrl picks the
+// family from the address, so an IPv4-mapped prefix such as
+// ::ffff:10.0.0.0/104 from net.ParseCIDR would otherwise reach the kernel
+// as an IPv4 /104.
+func normalizePrefix(prefix net.IPNet) (net.IPNet, error) {
+    ones, bits := prefix.Mask.Size()
+    if bits == 0 {
+        return prefix, fmt.Errorf("%w: %s has a non-contiguous mask", ErrInvalidAllowedIP, prefix.String())
+    }
+    
+    if ip4 := prefix.IP.To4(); ip4 != nil {
+        if bits == 8*net.IPv6len {
+            if ones < 96 {
+                return prefix, fmt.Errorf("%w: %s mixes IPv4 and IPv6", ErrInvalidAllowedIP, prefix.String())
+            }
+            ones -= 96
+        }
+        mask := ipv4Masks[ones]
+        return net.IPNet{IP: ip4.Mask(mask), Mask: mask}, nil
+    }
+    
+    if len(prefix.IP) != net.IPv6len || bits != 8*net.IPv6len {
+        return prefix, fmt.Errorf("%w: %s: mask does not match the address family", ErrInvalidAllowedIP, prefix.String())
+    }
+    mask := ipv6Masks[ones]
+    return net.IPNet{IP: prefix.IP.Mask(mask), Mask: mask}, nil
+}
+
+func normalizeAllowedIPs(prefixes []net.IPNet) ([]net.IPNet, error) {
+    if prefixes == nil {
+        return nil, nil
+    }
+    normalized := make([]net.IPNet, len(prefixes))
+    for i, prefix := range prefixes {
+        var err error
+        if normalized[i], err = normalizePrefix(prefix); err != nil {
+            return nil, err
+        }
+    }
+    return normalized, nil
+}
+
+// allowedIPClaim is a prefix of a new peer already owned by another one
+type allowedIPClaim struct {
+    prefix string
+    owner  *Peer
+}
+
+// Prefixes of peer that belong to other peers, in peer.AllowedIPs order.
+// Only identical prefixes conflict, overlapping ones of different length
+// coexist under longest-prefix match. Caller holds vpn.mu.
+func (vpn *UnderTheRadarVPN) allowedIPClaimsLocked(peer *Peer) []allowedIPClaim {
+    var claims []allowedIPClaim
+    seen := make(map[string]bool)
+    for _, allowedIP := range peer.AllowedIPs {
+        key := prefixKey(allowedIP)
+        if seen[key] {
+            continue
+        }
+        seen[key] = true
+        
+        owner := vpn.prefixOwnerLocked(key)
+        if owner != nil && owner.PublicKey != peer.PublicKey {
+            claims = append(claims, allowedIPClaim{prefix: key, owner: owner})
+        }
+    }
+    return claims
+}
+
+// Drop prefixes the kernel has moved to another peer from their previous
+// owners. AllowedIPs is replaced rather than edited since readers may hold
+// the old slice. Caller holds vpn.mu.
+func (vpn *UnderTheRadarVPN) reassignAllowedIPsLocked(peer *Peer, claims []allowedIPClaim) {
+    for _, claim := range claims {
+        owner := claim.owner
+        
+        kept := make([]net.IPNet, 0, len(owner.AllowedIPs))
+        for _, allowedIP := range owner.AllowedIPs {
+            if prefixKey(allowedIP) != claim.prefix {
+                kept = append(kept, allowedIP)
+            }
+        }
+        owner.AllowedIPs = kept
+        vpn.unindexPrefixLocked(claim.prefix, owner)
+        vpn.countAllowedIPsLocked(owner, kept)
+        
+        vpn.emitEvent(Event{
+            Type:      EventAllowedIPReassigned,
+            PublicKey: owner.PublicKey,
+            Message:   fmt.Sprintf("%s reassigned to peer %s", claim.prefix, peer.PublicKey),
+        })
+    }
+}
+
+// prefixPeers are the peers claiming one prefix: the owner the kernel
+// routes it to and, under AllowedIPByPriority, claimants on standby
+type prefixPeers struct {
+    prefix net.IPNet
+    peers  []*Peer
+}
+
+// Whether the kernel routes the prefix with key to peer
+func (peer *Peer) owns(key string) bool {
+    for _, allowedIP := range peer.AllowedIPs {
+        if prefixKey(allowedIP) == key {
+            return true
+        }
+    }
+    return false
+}
+
+// Add peer to the claimants of prefix. Caller holds vpn.mu.
+func (vpn *UnderTheRadarVPN) indexPrefixLocked(prefix net.IPNet, peer *Peer) {
+    key := prefixKey(prefix)
+    entry, ok := vpn.peersByIP[key]
+    if !ok {
+        // Normalized prefixes are canonical already, share their memory
+        if masked := prefix.IP.Mask(prefix.Mask); !masked.Equal(prefix.IP) {
+            prefix.IP = masked
+        }
+        entry = &prefixPeers{prefix: prefix}
+        vpn.peersByIP[key] = entry
+    }
+    for _, p := range entry.peers {
+        if p == peer {
+            return
+        }
+    }
+    entry.peers = append(entry.peers, peer)
+}
+
+// Drop peer from the claimants of the prefix with key, leaving any others
+// sharing it. Caller holds vpn.mu.
+func (vpn *UnderTheRadarVPN) unindexPrefixLocked(key string, peer *Peer) {
+    entry, ok := vpn.peersByIP[key]
+    if !ok {
+        return
+    }
+    var kept []*Peer
+    for _, p := range entry.peers {
+        if p != peer {
+            kept = append(kept, p)
+        }
+    }
+    if len(kept) == 0 {
+        delete(vpn.peersByIP, key)
+        return
+    }
+    entry.peers = kept
+}
+
+// The peer the kernel routes the prefix with key to, nil if none. Caller
+// holds vpn.mu.
+func (vpn *UnderTheRadarVPN) prefixOwnerLocked(key string) *Peer {
+    if entry, ok := vpn.peersByIP[key]; ok {
+        for _, peer := range entry.peers {
+            if peer.owns(key) {
+                return peer
+            }
+        }
+    }
+    return nil
+}
+
+// Remove index entries left behind by a peer's previous configuration.
+// Caller holds vpn.mu.
+func (vpn *UnderTheRadarVPN) unindexPeerLocked(peer *Peer) {
+    for _, prefix := range peer.claimedIPs() {
+        vpn.unindexPrefixLocked(prefixKey(prefix), peer)
+    }
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+    "errors"
+    "net"
+    "testing"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Two peers claiming the same /24, the second written with host bits set
+func conflictingPeers(t *testing.T) (PeerConfig, PeerConfig) {
+    first := PeerConfig{
+        PublicKey:  mustKey(t).PublicKey(),
+        AllowedIPs: []net.IPNet{mustCIDR(t, "10.5.0.0/24"), mustCIDR(t, "10.6.0.1/32")},
+    }
+    _, hostBits, _ := net.ParseCIDR("10.5.0.9/24")
+    hostBits.IP = net.ParseIP("10.5.0.9")
+    second := PeerConfig{
+        PublicKey:  mustKey(t).PublicKey(),
+        AllowedIPs: []net.IPNet{*hostBits},
+    }
+    return first, second
+}
+
+func TestAddPeerRejectsClaimedPrefix(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    first, second := conflictingPeers(t)
+    
+    if err := vpn.AddPeer(first); err != nil {
+        t.Fatal(err)
+    }
+    err := vpn.AddPeer(second)
+    if !errors.Is(err, ErrAllowedIPConflict) {
+        t.Fatalf("err = %v, want ErrAllowedIPConflict", err)
+    }
+    
+    // Nothing reached the kernel, ownership is unchanged everywhere
+    if len(wg.configs) != 1 {
+        t.Fatalf("%d device configs, the rejected peer must not be applied", len(wg.configs))
+    }
+    if owner, _ := wg.allowedIPOwner("utr0", "10.5.0.0/24"); owner != first.PublicKey {
+        t.Fatal("kernel moved the prefix to the rejected peer")
+    }
+    if vpn.prefixOwnerLocked("10.5.0.0/24").PublicKey != first.PublicKey || vpn.peers.get(second.PublicKey) != nil {
+        t.Fatal("rejected peer was stored")
+    }
+}
+
+func TestAddPeerReassignsClaimedPrefix(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    vpn.allowedIPConflicts = AllowedIPReassign
+    first, second := conflictingPeers(t)
+    
+    if err := vpn.AddPeer(first); err != nil {
+        t.Fatal(err)
+    }
+    if err := vpn.AddPeer(second); err != nil {
+        t.Fatal(err)
+    }
+    
+    // Our view matches the kernel's: the last claim wins
+    kernelOwner, _ := wg.allowedIPOwner("utr0", "10.5.0.0/24")
+    if kernelOwner != second.PublicKey {
+        t.Fatal("fake kernel did not move the prefix")
+    }
+    if got := vpn.prefixOwnerLocked("10.5.0.0/24"); got == nil || got.PublicKey != kernelOwner {
+        t.Fatal("peersByIP disagrees with the kernel")
+    }
+    
+    old := vpn.peers.get(first.PublicKey)
+    if len(old.AllowedIPs) != 1 || prefixKey(old.AllowedIPs[0]) != "10.6.0.1/32" {
+        t.Fatalf("previous owner still claims %v", old.AllowedIPs)
+    }
+    
+    for _, p := range vpn.peers.list {
+        p.IsAlive.Store(true)
+    }
+    if peer := vpn.routePacket(net.ParseIP("10.5.0.7")); peer == nil || peer.PublicKey != second.PublicKey {
+        t.Fatal("packets for the reassigned prefix should route to the new owner")
+    }
+    
+    select {
+    case ev := <-vpn.Events():
+        if ev.Type != EventAllowedIPReassigned || ev.PublicKey != first.PublicKey {
+            t.Fatalf("event = %+v", ev)
+        }
+    default:
+        t.Fatal("reassignment was not reported")
+    }
+}
+
+func TestAddPeerAllowsOverlappingPrefixes(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    
+    // Different lengths coexist, the kernel uses longest-prefix match
+    for _, cidr := range []string{"10.0.0.0/16", "10.0.1.0/24"} {
+        pc := PeerConfig{PublicKey: mustKey(t).PublicKey(), AllowedIPs: []net.IPNet{mustCIDR(t, cidr)}}
+        if err := vpn.AddPeer(pc); err != nil {
+            t.Fatalf("%s: %v", cidr, err)
+        }
+    }
+}
+
+func TestAddPeerUpdateDropsStaleIndex(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    key := mustKey(t).PublicKey()
+    
+    for _, cidr := range []string{"10.7.0.0/24", "10.8.0.0/24"} {
+        if err := vpn.AddPeer(PeerConfig{PublicKey: key, AllowedIPs: []net.IPNet{mustCIDR(t, cidr)}}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if vpn.peersByIP["10.7.0.0/24"] != nil {
+        t.Fatal("prefix dropped by the update is still indexed")
+    }
+    
+    // The freed prefix can be claimed without a conflict
+    other := PeerConfig{PublicKey: mustKey(t).PublicKey(), AllowedIPs: []net.IPNet{mustCIDR(t, "10.7.0.0/24")}}
+    if err := vpn.AddPeer(other); err != nil {
+        t.Fatal(err)
+    }
+    if got := vpn.prefixOwnerLocked("10.7.0.0/24"); got == nil || got.PublicKey != other.PublicKey {
+        t.Fatal("freed prefix not indexed to its new owner")
+    }
+}
+
+func TestAddPeerIPv6AllowedIPsRoute(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    
+    v4 := PeerConfig{PublicKey: mustKey(t).PublicKey(), AllowedIPs: []net.IPNet{mustCIDR(t, "0.0.0.0/0")}}
+    v6 := PeerConfig{PublicKey: mustKey(t).PublicKey(), AllowedIPs: []net.IPNet{mustCIDR(t, "fd00:1::/64")}}
+    dual := PeerConfig{PublicKey: mustKey(t).PublicKey(), AllowedIPs: []net.IPNet{mustCIDR(t, "10.8.0.0/24"), mustCIDR(t, "::/0")}}
+    for _, pc := range []PeerConfig{v4, v6, dual} {
+        if err := vpn.AddPeer(pc); err != nil {
+            t.Fatal(err)
+        }
+    }
+    for _, p := range vpn.peers.list {
+        p.IsAlive.Store(true)
+    }
+    vpn.peers.get(v4.PublicKey).LoadScore.Store(100)
+    vpn.peers.get(v6.PublicKey).LoadScore.Store(1)
+    vpn.peers.get(dual.PublicKey).LoadScore.Store(50)
+    
+    if owner, _ := wg.allowedIPOwner("utr0", "fd00:1::/64"); owner != v6.PublicKey {
+        t.Fatal("IPv6 prefix not configured on the device")
+    }
+    if vpn.peersByIP["fd00:1::/64"] == nil || vpn.peersByIP["::/0"] == nil {
+        t.Fatalf("IPv6 prefixes missing from the index: %v", vpn.peersByIP)
+    }
+    
+    for _, tt := range []struct {
+        dst  string
+        want wgtypes.Key
+    }{
+        {"fd00:1::42", v6.PublicKey},             // in both, v6 is least loaded
+        {"2001:db8::1", dual.PublicKey},          // only ::/0
+        {"10.8.0.9", dual.PublicKey},             // in both IPv4 prefixes
+        {"192.0.2.1", v4.PublicKey},              // ::/0 must not carry IPv4
+        {"::ffff:192.0.2.1", v4.PublicKey},       // IPv4-mapped is IPv4
+    } {
+        if got := vpn.routePacket(net.ParseIP(tt.dst)); got == nil || got.PublicKey != tt.want {
+            t.Errorf("%s routed to %v", tt.dst, got)
+        }
+    }
+    
+    // Only the IPv6 default route is left for IPv6 outside fd00:1::/64
+    vpn.peers.get(dual.PublicKey).IsAlive.Store(false)
+    if got := vpn.routePacket(net.ParseIP("2001:db8::1")); got != nil {
+        t.Fatal("IPv6 routed to a peer with only IPv4 and unrelated IPv6 prefixes")
+    }
+}
+
+func TestAddPeerIPv6ConflictUsesCanonicalPrefix(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    
+    first := PeerConfig{PublicKey: mustKey(t).PublicKey(), AllowedIPs: []net.IPNet{mustCIDR(t, "fd00:2::/48")}}
+    _, hostBits, _ := net.ParseCIDR("fd00:2::/48")
+    hostBits.IP = net.ParseIP("fd00:2:0:0:0:0:0:7")
+    second := PeerConfig{PublicKey: mustKey(t).PublicKey(), AllowedIPs: []net.IPNet{*hostBits}}
+    
+    if err := vpn.AddPeer(first); err != nil {
+        t.Fatal(err)
+    }
+    if err := vpn.AddPeer(second); !errors.Is(err, ErrAllowedIPConflict) {
+        t.Fatalf("err = %v, want ErrAllowedIPConflict", err)
+    }
+}
+
+func TestNormalizePrefix(t *testing.T) {
+    _, mapped, _ := net.ParseCIDR("::ffff:10.0.0.0/104")
+    
+    tests := []struct {
+        name   string
+        prefix net.IPNet
+        want   string
+        err    bool
+    }{
+        {"ipv4", mustCIDR(t, "10.1.2.0/24"), "10.1.2.0/24", false},
+        {"ipv4 as 16 bytes", net.IPNet{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(24, 32)}, "10.1.2.0/24", false},
+        {"ipv4-mapped", *mapped, "10.0.0.0/8", false},
+        {"ipv6 host bits", net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)}, "fd00::/64", false},
+        {"mixed family", net.IPNet{IP: net.ParseIP("::ffff:10.0.0.0"), Mask: net.CIDRMask(64, 128)}, "", true},
+        {"ipv6 with ipv4 mask", net.IPNet{IP: net.ParseIP("fd00::"), Mask: net.CIDRMask(24, 32)}, "", true},
+        {"no address", net.IPNet{Mask: net.CIDRMask(24, 32)}, "", true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := normalizePrefix(tt.prefix)
+            if tt.err {
+                if !errors.Is(err, ErrInvalidAllowedIP) {
+                    t.Fatalf("err = %v, want ErrInvalidAllowedIP", err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if got.String() != tt.want {
+                t.Fatalf("got %s, want %s", got.String(), tt.want)
+            }
+            if ones, bits := got.Mask.Size(); len(got.IP)*8 != bits || ones > bits {
+                t.Fatalf("%d-byte address with a /%d of %d bits", len(got.IP), ones, bits)
+            }
+        })
+    }
+}
+
+func TestRemovePeerKeepsOtherClaimOnSharedPrefix(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    vpn.allowedIPConflicts = AllowedIPByPriority
+    
+    // Both claim the prefix, the kernel routes it to the higher priority
+    prefix := mustCIDR(t, "10.8.0.0/24")
+    primary := PeerConfig{PublicKey: mustKey(t).PublicKey(), AllowedIPs: []net.IPNet{prefix}, Priority: 10}
+    backup := PeerConfig{PublicKey: mustKey(t).PublicKey(), AllowedIPs: []net.IPNet{prefix, mustCIDR(t, "10.9.0.1/32")}}
+    for _, pc := range []PeerConfig{primary, backup} {
+        if err := vpn.AddPeer(pc); err != nil {
+            t.Fatal(err)
+        }
+    }
+    for _, p := range vpn.peers.list {
+        p.IsAlive.Store(true)
+    }
+    if entry := vpn.peersByIP["10.8.0.0/24"]; entry == nil || len(entry.peers) != 2 {
+        t.Fatalf("both claimants should be indexed: %+v", entry)
+    }
+    
+    // Removing the standby claimant leaves the owner's entry alone
+    if err := vpn.RemovePeer(backup.PublicKey); err != nil {
+        t.Fatal(err)
+    }
+    if owner := vpn.prefixOwnerLocked("10.8.0.0/24"); owner == nil || owner.PublicKey != primary.PublicKey {
+        t.Fatal("owner lost its index entry")
+    }
+    if entry := vpn.peersByIP["10.8.0.0/24"]; len(entry.peers) != 1 || vpn.peersByIP["10.9.0.1/32"] != nil {
+        t.Fatalf("removed peer still indexed: %+v", vpn.peersByIP)
+    }
+    if got := vpn.routePacket(net.ParseIP("10.8.0.5")); got == nil || got.PublicKey != primary.PublicKey {
+        t.Fatal("shared prefix no longer routes")
+    }
+    
+    // Removing the owner hands the prefix to the claimant left
+    if err := vpn.AddPeer(backup); err != nil {
+        t.Fatal(err)
+    }
+    vpn.peers.get(backup.PublicKey).IsAlive.Store(true)
+    if err := vpn.RemovePeer(primary.PublicKey); err != nil {
+        t.Fatal(err)
+    }
+    if owner, _ := wg.allowedIPOwner("utr0", "10.8.0.0/24"); owner != backup.PublicKey {
+        t.Fatal("kernel did not move the prefix to the remaining claimant")
+    }
+    if got := vpn.routePacket(net.ParseIP("10.8.0.5")); got == nil || got.PublicKey != backup.PublicKey {
+        t.Fatal("routePacket ignores the remaining claimant")
+    }
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Counter slots in allowedip_stats, one per prefix owned by a peer.
+// Prefixes beyond this are routed but not counted.
+const maxAllowedIPSlots = 65536
+
+// AllowedIPTraffic is what the tunnel sent through one of a peer's
+// allowed IPs, summed over all CPUs
+type AllowedIPTraffic struct {
+    Prefix  net.IPNet
+    Packets uint64
+    Bytes   uint64
+}
+
+// allowedIPKey mirrors struct allowedip_key, IPv4 mapped into IPv6
+type allowedIPKey struct {
+    Prefixlen uint32
+    Addr      [16]byte
+}
+
+func newAllowedIPKey(prefix net.IPNet) allowedIPKey {
+    ones, _ := prefix.Mask.Size()
+    key := allowedIPKey{Prefixlen: uint32(ones)}
+    if ip4 := prefix.IP.To4(); ip4 != nil {
+        key.Prefixlen += 96
+    }
+    copy(key.Addr[:], prefix.IP.To16())
+    return key
+}
+
+// allowedIPCounters mirrors struct allowedip_counters
+type allowedIPCounters struct {
+    Packets uint64
+    Bytes   uint64
+}
+
+// prefixSlot is the counter slot of a prefix a peer owns
+type prefixSlot struct {
+    prefix net.IPNet
+    slot   uint32
+}
+
+// allowedIPSlots hands out counter slots to the prefixes each peer owns. A
+// slot lives as long as its peer owns the prefix, so a prefix moving to
+// another peer starts over there.
+type allowedIPSlots struct {
+    peers map[wgtypes.Key][]prefixSlot
+    free  []uint32
+    next  uint32
+}
+
+// Give the peer a slot for each of prefixes, keeping the slots of those it
+// had. Returns the slots that are new and those no longer used.
+func (s *allowedIPSlots) assign(key wgtypes.Key, prefixes []net.IPNet) (added, removed []prefixSlot) {
+    current := make(map[string]prefixSlot, len(s.peers[key]))
+    for _, ps := range s.peers[key] {
+        current[prefixKey(ps.prefix)] = ps
+    }
+    
+    var kept []prefixSlot
+    seen := make(map[string]bool, len(prefixes))
+    for _, prefix := range prefixes {
+        pk := prefixKey(prefix)
+        if seen[pk] {
+            continue
+        }
+        seen[pk] = true
+        if ps, ok := current[pk]; ok {
+            kept = append(kept, ps)
+            delete(current, pk)
+            continue
+        }
+        slot, ok := s.allocate()
+        if !ok {
+            continue
+        }
+        ps := prefixSlot{prefix, slot}
+        kept = append(kept, ps)
+        added = append(added, ps)
+    }
+    for _, ps := range s.peers[key] {
+        if _, gone := current[prefixKey(ps.prefix)]; gone {
+            removed = append(removed, ps)
+            s.free = append(s.free, ps.slot)
+        }
+    }
+    
+    if len(kept) == 0 {
+        delete(s.peers, key)
+    } else {
+        if s.peers == nil {
+            s.peers = make(map[wgtypes.Key][]prefixSlot)
+        }
+        s.peers[key] = kept
+    }
+    return added, removed
+}
+
+func (s *allowedIPSlots) allocate() (uint32, bool) {
+    if n := len(s.free); n > 0 {
+        slot := s.free[n-1]
+        s.free = s.free[:n-1]
+        return slot, true
+    }
+    if s.next >= maxAllowedIPSlots {
+        return 0, false
+    }
+    s.next++
+    return s.next - 1, true
+}
+
+// Point the datapath at the counter slots of the prefixes peer owns now.
+// Counting is best effort, a failed map update leaves the prefix uncounted.
+// Caller holds vpn.mu.
+func (vpn *UnderTheRadarVPN) countAllowedIPsLocked(peer *Peer, owned []net.IPNet) {
+    prefixes, ok := vpn.ebpfMaps["allowedip_prefixes"]
+    if !ok {
+        return
+    }
+    stats, ok := vpn.ebpfMaps["allowedip_stats"]
+    if !ok {
+        return
+    }
+    
+    added, removed := vpn.allowedIPSlots.assign(peer.PublicKey, owned)
+    for _, ps := range removed {
+        // Unless the new owner took it over already
+        key := newAllowedIPKey(ps.prefix)
+        var slot uint32
+        if err := prefixes.Lookup(key, &slot); err == nil && slot == ps.slot {
+            prefixes.Delete(key)
+        }
+    }
+    for _, ps := range added {
+        var perCPU []allowedIPCounters
+        if err := stats.Lookup(ps.slot, &perCPU); err == nil {
+            stats.Put(ps.slot, make([]allowedIPCounters, len(perCPU)))
+        }
+        prefixes.Put(newAllowedIPKey(ps.prefix), ps.slot)
+    }
+}
+
+// Assign slots to every peer's prefixes after the maps were (re)created.
+// Caller holds vpn.mu or has the VPN to itself.
+func (vpn *UnderTheRadarVPN) writeAllowedIPSlots() {
+    vpn.allowedIPSlots = allowedIPSlots{}
+    for _, peer := range vpn.peers.list {
+        vpn.countAllowedIPsLocked(peer, peer.AllowedIPs)
+    }
+}
+
+// AllowedIPStats returns the traffic the tunnel sent to each prefix the
+// peer owns, counted since the peer took it over. Nil without the eBPF
+// programs.
+func (vpn *UnderTheRadarVPN) AllowedIPStats(pubKey wgtypes.Key) ([]AllowedIPTraffic, error) {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    peer := vpn.peers.get(pubKey)
+    if peer == nil {
+        return nil, fmt.Errorf("%w: %s", ErrPeerNotFound, pubKey)
+    }
+    return vpn.allowedIPStatsLocked(peer)
+}
+
+// Caller holds vpn.mu
+func (vpn *UnderTheRadarVPN) allowedIPStatsLocked(peer *Peer) ([]AllowedIPTraffic, error) {
+    m, ok := vpn.ebpfMaps["allowedip_stats"]
+    if !ok {
+        return nil, nil
+    }
+    
+    var traffic []AllowedIPTraffic
+    for _, ps := range vpn.allowedIPSlots.peers[peer.PublicKey] {
+        var perCPU []allowedIPCounters
+        if err := m.Lookup(ps.slot, &perCPU); err != nil {
+            return traffic, fmt.Errorf("failed to read allowed IP counters: %w", err)
+        }
+        t := AllowedIPTraffic{Prefix: ps.prefix}
+        for _, c := range perCPU {
+            t.Packets += c.Packets
+            t.Bytes += c.Bytes
+        }
+        traffic = append(traffic, t)
+    }
+    return traffic, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+    "net"
+    "testing"
+)
+
+func TestAllowedIPKeyLayout(t *testing.T) {
+    v4 := newAllowedIPKey(mustCIDR(t, "10.1.0.0/16"))
+    if v4.Prefixlen != 112 || v4.Addr[10] != 0xff || v4.Addr[11] != 0xff || v4.Addr[12] != 10 || v4.Addr[13] != 1 {
+        t.Fatalf("IPv4 key = %+v", v4)
+    }
+    v6 := newAllowedIPKey(mustCIDR(t, "fd00::/8"))
+    if v6.Prefixlen != 8 || v6.Addr[0] != 0xfd {
+        t.Fatalf("IPv6 key = %+v", v6)
+    }
+}
+
+func TestAllowedIPSlotsFollowOwnership(t *testing.T) {
+    var slots allowedIPSlots
+    a, b := mustKey(t).PublicKey(), mustKey(t).PublicKey()
+    lan, office := mustCIDR(t, "10.0.0.0/24"), mustCIDR(t, "10.1.0.0/24")
+    
+    added, _ := slots.assign(a, []net.IPNet{lan, office, lan})
+    if len(added) != 2 || added[0].slot == added[1].slot {
+        t.Fatalf("added = %+v", added)
+    }
+    officeSlot := added[1].slot
+    
+    // Keeping a prefix keeps its counters
+    added, removed := slots.assign(a, []net.IPNet{lan})
+    if len(added) != 0 || len(removed) != 1 || removed[0].slot != officeSlot {
+        t.Fatalf("added %+v, removed %+v", added, removed)
+    }
+    
+    // The freed slot goes to the next prefix
+    added, _ = slots.assign(b, []net.IPNet{office})
+    if len(added) != 1 || added[0].slot != officeSlot {
+        t.Fatalf("added = %+v", added)
+    }
+    
+    _, removed = slots.assign(b, nil)
+    if len(removed) != 1 || len(slots.peers) != 1 {
+        t.Fatalf("removed %+v, %d peers left", removed, len(slots.peers))
+    }
+}
+
+func TestAllowedIPSlotsExhausted(t *testing.T) {
+    slots := allowedIPSlots{next: maxAllowedIPSlots - 1}
+    added, _ := slots.assign(mustKey(t).PublicKey(), []net.IPNet{mustCIDR(t, "10.0.0.0/24"), mustCIDR(t, "10.1.0.0/24")})
+    if len(added) != 1 || added[0].slot != maxAllowedIPSlots-1 {
+        t.Fatalf("added = %+v", added)
+    }
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Most bytes of annotation keys and values one peer may carry
+const maxAnnotationBytes = 4096
+
+var ErrAnnotationsTooLarge = errors.New("peer annotations too large")
+
+// Keys may not hold what selectors split on
+func validAnnotationKey(key string) bool {
+    return key != "" && !strings.ContainsAny(key, "=, \t\n")
+}
+
+func validateAnnotations(annotations map[string]string) error {
+    size := 0
+    for key, value := range annotations {
+        if !validAnnotationKey(key) {
+            return fmt.Errorf("invalid annotation key %q", key)
+        }
+        size += len(key) + len(value)
+    }
+    if size > maxAnnotationBytes {
+        return fmt.Errorf("%w: %d bytes, at most %d", ErrAnnotationsTooLarge, size, maxAnnotationBytes)
+    }
+    return nil
+}
+
+// Annotations are the operator's key/value notes on the peer, such as a
+// customer ID. They never reach the device. The map is replaced, not
+// changed, on updates; don't modify it.
+func (peer *Peer) Annotations() map[string]string {
+    return peer.extras().annotations
+}
+
+func copyAnnotations(annotations map[string]string) map[string]string {
+    if len(annotations) == 0 {
+        return nil
+    }
+    copied := make(map[string]string, len(annotations))
+    for key, value := range annotations {
+        copied[key] = value
+    }
+    return copied
+}
+
+// SetPeerAnnotation sets one annotation of a running peer, leaving the
+// device alone
+func (vpn *UnderTheRadarVPN) SetPeerAnnotation(pubKey wgtypes.Key, key, value string) error {
+    vpn.mu.Lock()
+    defer vpn.mu.Unlock()
+    
+    peer := vpn.peers.get(pubKey)
+    if peer == nil {
+        return fmt.Errorf("%w: %s", ErrPeerNotFound, pubKey)
+    }
+    old, had := peer.Annotations()[key]
+    if had && old == value {
+        return nil
+    }
+    annotations := copyAnnotations(peer.Annotations())
+    if annotations == nil {
+        annotations = make(map[string]string, 1)
+    }
+    annotations[key] = value
+    if err := validateAnnotations(annotations); err != nil {
+        return err
+    }
+    
+    if peer.extra == nil {
+        peer.extra = &peerExtras{}
+    }
+    peer.extra.annotations = annotations
+    message := fmt.Sprintf("%s set to %q", key, value)
+    if had {
+        message = fmt.Sprintf("%s changed from %q to %q", key, old, value)
+    }
+    vpn.emitEvent(Event{Type: EventAnnotationChanged, PublicKey: pubKey, Message: message})
+    return nil
+}
+
+// RemovePeerAnnotation removes one annotation of a running peer, if it has
+// it
+func (vpn *UnderTheRadarVPN) RemovePeerAnnotation(pubKey wgtypes.Key, key string) error {
+    vpn.mu.Lock()
+    defer vpn.mu.Unlock()
+    
+    peer := vpn.peers.get(pubKey)
+    if peer == nil {
+        return fmt.Errorf("%w: %s", ErrPeerNotFound, pubKey)
+    }
+    old, had := peer.Annotations()[key]
+    if !had {
+        return nil
+    }
+    annotations := copyAnnotations(peer.Annotations())
+    delete(annotations, key)
+    if len(annotations) == 0 {
+        annotations = nil
+    }
+    peer.extra.annotations = annotations
+    
+    vpn.emitEvent(Event{
+        Type:      EventAnnotationChanged,
+        PublicKey: pubKey,
+        Message:   fmt.Sprintf("%s removed, was %q", key, old),
+    })
+    return nil
+}
+
+// AnnotationSelector picks peers by annotation. Every term must hold: a
+// "key=value" term wants that value, a bare "key" any value.
+type AnnotationSelector []AnnotationTerm
+
+type AnnotationTerm struct {
+    Key      string
+    Value    string
+    AnyValue bool
+}
+
+// ParseAnnotationSelector reads a comma separated selector such as
+// "customer=acme,ticket". The empty selector matches every peer.
+func ParseAnnotationSelector(s string) (AnnotationSelector, error) {
+    var selector AnnotationSelector
+    for _, term := range strings.Split(s, ",") {
+        term = strings.TrimSpace(term)
+        if term == "" {
+            continue
+        }
+        key, value, hasValue := strings.Cut(term, "=")
+        key = strings.TrimSpace(key)
+        if !validAnnotationKey(key) {
+            return nil, fmt.Errorf("invalid selector term %q", term)
+        }
+        selector = append(selector, AnnotationTerm{Key: key, Value: strings.TrimSpace(value), AnyValue: !hasValue})
+    }
+    return selector, nil
+}
+
+func (s AnnotationSelector) Matches(annotations map[string]string) bool {
+    for _, term := range s {
+        value, ok := annotations[term.Key]
+        if !ok || (!term.AnyValue && value != term.Value) {
+            return false
+        }
+    }
+    return true
+}
+
+func (s AnnotationSelector) String() string {
+    terms := make([]string, len(s))
+    for i, term := range s {
+        terms[i] = term.Key
+        if !term.AnyValue {
+            terms[i] += "=" + term.Value
+        }
+    }
+    return strings.Join(terms, ",")
+}
+
+// ListPeersMatching returns the peers selector matches, ordered by public
+// key
+func (vpn *UnderTheRadarVPN) ListPeersMatching(selector AnnotationSelector) []PeerInfo {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    peers := make([]PeerInfo, 0, vpn.peers.len())
+    for _, peer := range vpn.peers.list {
+        if selector.Matches(peer.Annotations()) {
+            peers = append(peers, vpn.peerInfoLocked(peer))
+        }
+    }
+    sort.Slice(peers, func(i, j int) bool {
+        return peers[i].PublicKey.String() < peers[j].PublicKey.String()
+    })
+    return peers
+}
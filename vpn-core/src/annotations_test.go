@@ -0,0 +1,130 @@
+package main
+
+import (
+    "errors"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestParseAnnotationSelector(t *testing.T) {
+    selector, err := ParseAnnotationSelector(" customer=acme, ticket ,")
+    if err != nil || selector.String() != "customer=acme,ticket" {
+        t.Fatalf("got %v %v", selector, err)
+    }
+    cases := []struct {
+        annotations map[string]string
+        match       bool
+    }{
+        {map[string]string{"customer": "acme", "ticket": ""}, true},
+        {map[string]string{"customer": "acme", "ticket": "OPS-12", "tier": "pro"}, true},
+        {map[string]string{"customer": "acme"}, false},
+        {map[string]string{"customer": "globex", "ticket": "OPS-12"}, false},
+        {nil, false},
+    }
+    for _, c := range cases {
+        if got := selector.Matches(c.annotations); got != c.match {
+            t.Errorf("%v matched %v", c.annotations, got)
+        }
+    }
+    if empty, _ := ParseAnnotationSelector(""); !empty.Matches(nil) {
+        t.Error("empty selector doesn't match everything")
+    }
+    if _, err := ParseAnnotationSelector("=acme"); err == nil {
+        t.Error("term without key accepted")
+    }
+}
+
+func TestPeerAnnotationsAtRuntime(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    acme := mustKey(t).PublicKey()
+    globex := mustKey(t).PublicKey()
+    for _, cfg := range []PeerConfig{
+        {PublicKey: acme, SkipProbe: true, Annotations: map[string]string{"customer": "acme", "tier": "pro"}},
+        {PublicKey: globex, SkipProbe: true},
+    } {
+        if err := vpn.AddPeer(cfg); err != nil {
+            t.Fatal(err)
+        }
+    }
+    configured := len(wg.configs)
+    
+    if err := vpn.SetPeerAnnotation(globex, "customer", "globex"); err != nil {
+        t.Fatal(err)
+    }
+    if err := vpn.SetPeerAnnotation(acme, "tier", "basic"); err != nil {
+        t.Fatal(err)
+    }
+    if err := vpn.RemovePeerAnnotation(acme, "tier"); err != nil {
+        t.Fatal(err)
+    }
+    if len(wg.configs) != configured {
+        t.Fatal("annotations reached the device")
+    }
+    for _, want := range []string{`customer set to "globex"`, `tier changed from "pro" to "basic"`, `tier removed, was "basic"`} {
+        ev := <-vpn.Events()
+        if ev.Type != EventAnnotationChanged || ev.Message != want {
+            t.Fatalf("event %v %q, want %q", ev.Type, ev.Message, want)
+        }
+    }
+    
+    selector, _ := ParseAnnotationSelector("customer=globex")
+    peers := vpn.ListPeersMatching(selector)
+    if len(peers) != 1 || peers[0].PublicKey != globex || peers[0].Annotations["customer"] != "globex" {
+        t.Fatalf("selected %+v", peers)
+    }
+    selector, _ = ParseAnnotationSelector("tier")
+    if peers := vpn.ListPeersMatching(selector); len(peers) != 0 {
+        t.Fatalf("%d peers still have a tier", len(peers))
+    }
+    
+    // Snapshots don't share the peer's map
+    peers[0].Annotations["customer"] = "changed"
+    if vpn.peers.get(globex).Annotations()["customer"] != "globex" {
+        t.Fatal("snapshot aliases the peer's annotations")
+    }
+    if err := vpn.SetPeerAnnotation(mustKey(t).PublicKey(), "customer", "x"); err == nil {
+        t.Fatal("annotated an unknown peer")
+    }
+}
+
+func TestPeerAnnotationsCapped(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    key := mustKey(t).PublicKey()
+    huge := map[string]string{"notes": strings.Repeat("x", maxAnnotationBytes)}
+    if err := vpn.AddPeer(PeerConfig{PublicKey: key, SkipProbe: true, Annotations: huge}); !errors.Is(err, ErrAnnotationsTooLarge) {
+        t.Fatalf("got %v", err)
+    }
+    if err := vpn.AddPeer(PeerConfig{PublicKey: key, SkipProbe: true}); err != nil {
+        t.Fatal(err)
+    }
+    if err := vpn.SetPeerAnnotation(key, "notes", strings.Repeat("x", maxAnnotationBytes)); !errors.Is(err, ErrAnnotationsTooLarge) {
+        t.Fatalf("got %v", err)
+    }
+    if err := vpn.SetPeerAnnotation(key, "a=b", "c"); err == nil {
+        t.Fatal("key with = accepted")
+    }
+    if len(vpn.peers.get(key).Annotations()) != 0 {
+        t.Fatal("rejected annotation kept")
+    }
+}
+
+func TestWebhookReportsAnnotations(t *testing.T) {
+    secret := []byte("shared-secret")
+    receiver := &webhookReceiver{secret: secret}
+    server := httptest.NewServer(receiver)
+    defer server.Close()
+    
+    vpn := newTestVPN(t, newFakeWGClient())
+    peer := addStatsPeer(t, vpn, "", 1)
+    peer.setExtras(PeerConfig{Annotations: map[string]string{"customer": "acme"}})
+    
+    r := NewWebhookReporter(vpn, WebhookConfig{URL: server.URL, Secret: NewSecret(secret)})
+    if err := r.Report(); err != nil {
+        t.Fatal(err)
+    }
+    if got := receiver.reports[0].Peers[0].Annotations; got["customer"] != "acme" {
+        t.Fatalf("report annotations %v", got)
+    }
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+    "math"
+    "sync"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// How often AutoPriority peers are re-ranked
+const autoPriorityInterval = 10 * time.Second
+
+// PriorityWeights turn a peer's performance into its Priority under
+// PeerConfig.AutoPriority:
+//
+//     priority = Base - Latency*latency_ms - Loss*loss_percent + Throughput*available
+//
+// where latency_ms is an EWMA of the measured round trips, each new one
+// weighted Smoothing, and available the fraction of Capacity (bytes/s)
+// the peer's traffic leaves free, 0 without a Capacity. Explicit
+// priorities of other peers compete on the same scale.
+type PriorityWeights struct {
+    Base       float64
+    Latency    float64
+    Loss       float64
+    Throughput float64
+    Capacity   uint64
+    Smoothing  float64
+}
+
+var DefaultPriorityWeights = PriorityWeights{
+    Base:       100,
+    Latency:    0.2, // 100ms costs 20
+    Loss:       5,   // 2% costs 10
+    Throughput: 20,
+    Smoothing:  0.3,
+}
+
+func (w PriorityWeights) priority(latencyMs, lossPercent, available float64) int {
+    p := w.Base - w.Latency*latencyMs - w.Loss*lossPercent + w.Throughput*available
+    return int(math.Round(p))
+}
+
+// SetPriorityWeights changes how AutoPriority peers are ranked
+func (vpn *UnderTheRadarVPN) SetPriorityWeights(w PriorityWeights) {
+    vpn.mu.Lock()
+    vpn.priorityWeights = w
+    vpn.mu.Unlock()
+}
+
+// priorityAdjuster re-ranks AutoPriority peers from their latency, loss
+// and spare throughput. Routing and prefix ownership follow the new
+// priorities; established flows stay pinned, see routeFlow.
+type priorityAdjuster struct {
+    vpn   *UnderTheRadarVPN
+    peers map[wgtypes.Key]*autoPriorityState // only touched by adjust
+    
+    stop     chan struct{}
+    stopOnce sync.Once
+}
+
+type autoPriorityState struct {
+    latencyMs float64 // EWMA
+    bytes     uint64  // rx+tx at the previous adjustment
+    at        time.Time
+}
+
+func newPriorityAdjuster(vpn *UnderTheRadarVPN) *priorityAdjuster {
+    return &priorityAdjuster{
+        vpn:   vpn,
+        peers: make(map[wgtypes.Key]*autoPriorityState),
+        stop:  make(chan struct{}),
+    }
+}
+
+func (a *priorityAdjuster) Start() {
+    ticker := a.vpn.clock().NewTicker(autoPriorityInterval)
+    defer ticker.Stop()
+    
+    for {
+        select {
+        case <-ticker.C():
+            a.adjust()
+        case <-a.stop:
+            return
+        }
+    }
+}
+
+func (a *priorityAdjuster) Stop() {
+    a.stopOnce.Do(func() { close(a.stop) })
+}
+
+// Compute the priority of every AutoPriority peer and hand contested
+// prefixes to whoever outranks their owner now
+func (a *priorityAdjuster) adjust() error {
+    vpn := a.vpn
+    now := vpn.clock().Now()
+    sink := vpn.metricSink()
+    
+    vpn.mu.Lock()
+    defer vpn.mu.Unlock()
+    
+    w := vpn.priorityWeights
+    seen := make(map[wgtypes.Key]bool)
+    changed := false
+    for _, peer := range vpn.peers.list {
+        if !peer.AutoPriority {
+            continue
+        }
+        seen[peer.PublicKey] = true
+        
+        latencyMs := float64(peer.CurrentLatency.Load()) / 1000
+        bytes := peer.RxBytes.Load() + peer.TxBytes.Load()
+        state, ok := a.peers[peer.PublicKey]
+        if !ok {
+            // Explicit Priority stands until there is a rate to go by
+            a.peers[peer.PublicKey] = &autoPriorityState{latencyMs: latencyMs, bytes: bytes, at: now}
+            continue
+        }
+        state.latencyMs += w.Smoothing * (latencyMs - state.latencyMs)
+        
+        available := 0.0
+        if elapsed := now.Sub(state.at).Seconds(); w.Capacity > 0 && elapsed > 0 && bytes >= state.bytes {
+            rate := float64(bytes-state.bytes) / elapsed
+            available = math.Max(0, 1-rate/float64(w.Capacity))
+        }
+        state.bytes, state.at = bytes, now
+        
+        priority := w.priority(state.latencyMs, float64(peer.PacketLoss.Load())/100, available)
+        if priority != peer.Priority {
+            peer.Priority = priority
+            changed = true
+        }
+        sink.Gauge("peer.priority", float64(priority), peer.metricTags()...)
+    }
+    for key := range a.peers {
+        if !seen[key] {
+            delete(a.peers, key)
+        }
+    }
+    
+    if !changed {
+        return nil
+    }
+    return vpn.rebalanceAllowedIPsLocked()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+    "net"
+    "net/netip"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    // Most datagrams one receive syscall returns, recvmmsg's vlen
+    MaxReceiveBatch = 64
+    
+    // Room for a datagram, or with UDP GRO the segments of one coalesced
+    // into it
+    receiveBufferSize = 65535
+    
+    batchSourceQueue = 256 // segments waiting for a source's goroutine
+    maxBatchSources  = 4096
+    batchSourceIdle  = time.Minute
+)
+
+// BatchStats count what a BatchReceiver has read
+type BatchStats struct {
+    Syscalls  uint64 // receive syscalls made, recvmmsg on Linux
+    Datagrams uint64 // as the kernel returned them
+    Segments  uint64 // after splitting GRO datagrams, what was dispatched
+    Dropped   uint64 // segments of a source whose queue was full, or of one too many sources
+    GRO       bool   // the socket coalesces segments
+}
+
+// SegmentsPerSyscall is how many packets each syscall brought in
+func (s BatchStats) SegmentsPerSyscall() float64 {
+    if s.Syscalls == 0 {
+        return 0
+    }
+    return float64(s.Segments) / float64(s.Syscalls)
+}
+
+// A datagram of the current batch
+type receivedDatagram struct {
+    from    *net.UDPAddr
+    data    []byte
+    segment int // GRO segment size, 0 for a single packet
+}
+
+// BatchReceiver reads a UDP socket up to MaxReceiveBatch datagrams per
+// syscall, with UDP GRO on where the kernel has it, and hands each packet
+// to handler on a goroutine of its source address. Packets of one source
+// stay in order; a slow source only holds up its own.
+type BatchReceiver struct {
+    conn    *net.UDPConn
+    handler func(from *net.UDPAddr, packet []byte)
+    clock   Clock
+    reader  *batchReader
+    
+    sources   map[netip.AddrPort]*batchSource // owned by Run
+    lastSweep time.Time
+    workers   sync.WaitGroup
+    
+    syscalls  atomic.Uint64
+    datagrams atomic.Uint64
+    segments  atomic.Uint64
+    dropped   atomic.Uint64
+}
+
+type batchSource struct {
+    packets chan []byte
+    last    time.Time
+}
+
+// NewBatchReceiver reads conn batch datagrams at a time, at most
+// MaxReceiveBatch. Handler may keep the packets it is given.
+func NewBatchReceiver(conn *net.UDPConn, batch int, handler func(from *net.UDPAddr, packet []byte)) *BatchReceiver {
+    if batch <= 0 || batch > MaxReceiveBatch {
+        batch = MaxReceiveBatch
+    }
+    return &BatchReceiver{
+        conn:    conn,
+        handler: handler,
+        clock:   RealClock{},
+        reader:  newBatchReader(conn, batch),
+        sources: make(map[netip.AddrPort]*batchSource),
+    }
+}
+
+// Run receives until the socket is closed, then waits for the handlers of
+// what was read
+func (r *BatchReceiver) Run() error {
+    defer func() {
+        for key, source := range r.sources {
+            close(source.packets)
+            delete(r.sources, key)
+        }
+        r.workers.Wait()
+    }()
+    
+    for {
+        datagrams, err := r.reader.read(&r.syscalls)
+        if err != nil {
+            return err
+        }
+        r.datagrams.Add(uint64(len(datagrams)))
+        now := r.clock.Now()
+        for _, d := range datagrams {
+            for _, segment := range splitSegments(d.data, d.segment) {
+                r.segments.Add(1)
+                r.dispatch(d.from, segment, now)
+            }
+        }
+        r.sweep(now)
+    }
+}
+
+// The batch buffers are read into again, so the handler gets a copy
+func (r *BatchReceiver) dispatch(from *net.UDPAddr, segment []byte, now time.Time) {
+    key := from.AddrPort()
+    source, ok := r.sources[key]
+    if !ok {
+        if len(r.sources) >= maxBatchSources {
+            r.dropped.Add(1)
+            return
+        }
+        source = &batchSource{packets: make(chan []byte, batchSourceQueue)}
+        r.sources[key] = source
+        r.workers.Add(1)
+        go func() {
+            defer r.workers.Done()
+            for packet := range source.packets {
+                r.handler(from, packet)
+            }
+        }()
+    }
+    source.last = now
+    select {
+    case source.packets <- append([]byte(nil), segment...):
+    default:
+        r.dropped.Add(1)
+    }
+}
+
+// End the goroutines of sources gone quiet
+func (r *BatchReceiver) sweep(now time.Time) {
+    if now.Sub(r.lastSweep) < batchSourceIdle {
+        return
+    }
+    r.lastSweep = now
+    for key, source := range r.sources {
+        if now.Sub(source.last) > batchSourceIdle {
+            close(source.packets)
+            delete(r.sources, key)
+        }
+    }
+}
+
+func (r *BatchReceiver) Stats() BatchStats {
+    return BatchStats{
+        Syscalls:  r.syscalls.Load(),
+        Datagrams: r.datagrams.Load(),
+        Segments:  r.segments.Load(),
+        Dropped:   r.dropped.Load(),
+        GRO:       r.reader.gro,
+    }
+}
+
+// The packets a GRO datagram coalesced, every one size bytes but the last
+func splitSegments(data []byte, size int) [][]byte {
+    if size <= 0 || size >= len(data) {
+        return [][]byte{data}
+    }
+    segments := make([][]byte, 0, (len(data)+size-1)/size)
+    for len(data) > size {
+        segments = append(segments, data[:size:size])
+        data = data[size:]
+    }
+    return append(segments, data)
+}
@@ -0,0 +1,133 @@
+//go:build linux
+
+package main
+
+import (
+    "encoding/binary"
+    "net"
+    "sync/atomic"
+    "syscall"
+    "unsafe"
+    
+    "golang.org/x/sys/unix"
+)
+
+// struct mmsghdr; x/sys has no type for it. The compiler pads it to the
+// C layout on 32 and 64 bit.
+type mmsghdr struct {
+    hdr unix.Msghdr
+    len uint32
+}
+
+// batchReader receives with recvmmsg into buffers it keeps
+type batchReader struct {
+    raw       syscall.RawConn
+    err       error
+    gro       bool
+    msgs      []mmsghdr
+    iovs      []unix.Iovec
+    names     []unix.RawSockaddrInet6
+    bufs      [][]byte
+    oobs      [][]byte
+    datagrams []receivedDatagram
+}
+
+// Turn on UDP_GRO where the kernel has it, 5.0 and later; without it
+// datagrams come one per packet as before
+func newBatchReader(conn *net.UDPConn, batch int) *batchReader {
+    r := &batchReader{
+        msgs:  make([]mmsghdr, batch),
+        iovs:  make([]unix.Iovec, batch),
+        names: make([]unix.RawSockaddrInet6, batch),
+        bufs:  make([][]byte, batch),
+        oobs:  make([][]byte, batch),
+    }
+    r.raw, r.err = conn.SyscallConn()
+    if r.err != nil {
+        return r
+    }
+    r.raw.Control(func(fd uintptr) {
+        r.gro = unix.SetsockoptInt(int(fd), unix.SOL_UDP, unix.UDP_GRO, 1) == nil
+    })
+    
+    for i := range r.msgs {
+        r.bufs[i] = make([]byte, receiveBufferSize)
+        r.oobs[i] = make([]byte, unix.CmsgSpace(4))
+        r.iovs[i].Base = &r.bufs[i][0]
+        r.iovs[i].SetLen(receiveBufferSize)
+        r.msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&r.names[i]))
+        r.msgs[i].hdr.Iov = &r.iovs[i]
+        r.msgs[i].hdr.SetIovlen(1)
+        r.msgs[i].hdr.Control = &r.oobs[i][0]
+    }
+    return r
+}
+
+// One recvmmsg, waiting in the runtime poller until a datagram is there.
+// The datagrams are only good until the next read.
+func (r *batchReader) read(syscalls *atomic.Uint64) ([]receivedDatagram, error) {
+    if r.err != nil {
+        return nil, r.err
+    }
+    for i := range r.msgs {
+        r.msgs[i].hdr.Namelen = unix.SizeofSockaddrInet6
+        r.msgs[i].hdr.SetControllen(len(r.oobs[i]))
+        r.msgs[i].len = 0
+    }
+    
+    var n int
+    var errno syscall.Errno
+    err := r.raw.Read(func(fd uintptr) bool {
+        syscalls.Add(1)
+        res, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&r.msgs[0])), uintptr(len(r.msgs)), 0, 0, 0)
+        n, errno = int(res), e
+        return errno != unix.EAGAIN
+    })
+    if err != nil {
+        return nil, err
+    }
+    if errno != 0 {
+        return nil, errno
+    }
+    
+    r.datagrams = r.datagrams[:0]
+    for i := 0; i < n; i++ {
+        msg := &r.msgs[i]
+        r.datagrams = append(r.datagrams, receivedDatagram{
+            from:    sockaddrToUDP(&r.names[i]),
+            data:    r.bufs[i][:msg.len],
+            segment: groSegmentSize(r.oobs[i][:msg.hdr.Controllen]),
+        })
+    }
+    return r.datagrams, nil
+}
+
+// The UDP_GRO control message holds the size the datagram's segments were
+func groSegmentSize(oob []byte) int {
+    msgs, err := unix.ParseSocketControlMessage(oob)
+    if err != nil {
+        return 0
+    }
+    for _, msg := range msgs {
+        if msg.Header.Level == unix.SOL_UDP && msg.Header.Type == unix.UDP_GRO && len(msg.Data) >= 4 {
+            return int(*(*int32)(unsafe.Pointer(&msg.Data[0])))
+        }
+    }
+    return 0
+}
+
+func sockaddrToUDP(sa *unix.RawSockaddrInet6) *net.UDPAddr {
+    // The port is in network order in either family
+    port := int(binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:]))
+    if sa.Family == unix.AF_INET {
+        sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+        return &net.UDPAddr{IP: net.IP(append([]byte(nil), sa4.Addr[:]...)), Port: port}
+    }
+    addr := &net.UDPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...)), Port: port}
+    if sa.Scope_id != 0 {
+        if iface, err := net.InterfaceByIndex(int(sa.Scope_id)); err == nil {
+            addr.Zone = iface.Name
+        }
+    }
+    return addr
+}
@@ -0,0 +1,67 @@
+//go:build linux
+
+package main
+
+import (
+    "bytes"
+    "net"
+    "testing"
+    "time"
+    
+    "golang.org/x/sys/unix"
+)
+
+// A sender with UDP_SEGMENT hands loopback one datagram of several
+// segments, which a GRO socket receives as it was sent
+func TestBatchReceiverSplitsGRODatagrams(t *testing.T) {
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    got := make(chan []byte, 8)
+    receiver := NewBatchReceiver(conn, 4, func(from *net.UDPAddr, packet []byte) { got <- packet })
+    if !receiver.Stats().GRO {
+        t.Skip("no UDP GRO in this kernel")
+    }
+    
+    sender, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sender.Close()
+    raw, err := sender.SyscallConn()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var sockErr error
+    raw.Control(func(fd uintptr) {
+        sockErr = unix.SetsockoptInt(int(fd), unix.SOL_UDP, unix.UDP_SEGMENT, 100)
+    })
+    if sockErr != nil {
+        t.Skipf("no UDP GSO: %v", sockErr)
+    }
+    var payload []byte
+    for i := 0; i < 5; i++ {
+        payload = append(payload, bytes.Repeat([]byte{byte('a' + i)}, 100)...)
+    }
+    if _, err := sender.Write(payload[:450]); err != nil {
+        t.Fatal(err)
+    }
+    
+    go receiver.Run()
+    defer conn.Close()
+    for i := 0; i < 5; i++ {
+        select {
+        case packet := <-got:
+            want := bytes.Repeat([]byte{byte('a' + i)}, 100)[:min(100, 450-i*100)]
+            if !bytes.Equal(packet, want) {
+                t.Fatalf("segment %d: %q", i, packet)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatalf("got %d segments, stats %+v", i, receiver.Stats())
+        }
+    }
+    if stats := receiver.Stats(); stats.Datagrams != 1 || stats.Segments != 5 {
+        t.Fatalf("stats %+v", stats)
+    }
+}
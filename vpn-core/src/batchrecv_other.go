@@ -0,0 +1,30 @@
+//go:build !linux
+
+package main
+
+import (
+    "net"
+    "sync/atomic"
+)
+
+// No recvmmsg or UDP GRO: one datagram per read
+type batchReader struct {
+    conn      *net.UDPConn
+    gro       bool
+    buf       []byte
+    datagrams []receivedDatagram
+}
+
+func newBatchReader(conn *net.UDPConn, batch int) *batchReader {
+    return &batchReader{conn: conn, buf: make([]byte, receiveBufferSize)}
+}
+
+func (r *batchReader) read(syscalls *atomic.Uint64) ([]receivedDatagram, error) {
+    syscalls.Add(1)
+    n, from, err := r.conn.ReadFromUDP(r.buf)
+    if err != nil {
+        return nil, err
+    }
+    r.datagrams = append(r.datagrams[:0], receivedDatagram{from: from, data: r.buf[:n]})
+    return r.datagrams, nil
+}
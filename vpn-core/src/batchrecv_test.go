@@ -0,0 +1,95 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "net"
+    "runtime"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestBatchReceiverDemultiplexesSources(t *testing.T) {
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    const sources, packets = 3, 40
+    var mu sync.Mutex
+    got := make(map[string][]uint32)
+    done := make(chan struct{})
+    received := 0
+    receiver := NewBatchReceiver(conn, MaxReceiveBatch, func(from *net.UDPAddr, packet []byte) {
+        mu.Lock()
+        defer mu.Unlock()
+        got[from.String()] = append(got[from.String()], binary.BigEndian.Uint32(packet))
+        if received++; received == sources*packets {
+            close(done)
+        }
+    })
+    
+    // Queued before the first read, so batches fill up
+    senders := make([]*net.UDPConn, sources)
+    for i := range senders {
+        if senders[i], err = net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr)); err != nil {
+            t.Fatal(err)
+        }
+        defer senders[i].Close()
+    }
+    for seq := 0; seq < packets; seq++ {
+        for i, sender := range senders {
+            packet := binary.BigEndian.AppendUint32(nil, uint32(seq))
+            packet = append(packet, bytes.Repeat([]byte{byte(i)}, 100)...)
+            if _, err := sender.Write(packet); err != nil {
+                t.Fatal(err)
+            }
+        }
+    }
+    
+    ran := make(chan error)
+    go func() { ran <- receiver.Run() }()
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatalf("received %d of %d", received, sources*packets)
+    }
+    conn.Close()
+    <-ran
+    
+    for _, sender := range senders {
+        seqs := got[sender.LocalAddr().String()]
+        if len(seqs) != packets {
+            t.Fatalf("%s: %d packets", sender.LocalAddr(), len(seqs))
+        }
+        for i, seq := range seqs {
+            if seq != uint32(i) {
+                t.Fatalf("%s: packet %d out of order, %v", sender.LocalAddr(), seq, seqs)
+            }
+        }
+    }
+    stats := receiver.Stats()
+    if stats.Segments != sources*packets || stats.Dropped != 0 {
+        t.Fatalf("stats %+v", stats)
+    }
+    if runtime.GOOS == "linux" && stats.SegmentsPerSyscall() < 2 {
+        t.Fatalf("%.1f packets per syscall", stats.SegmentsPerSyscall())
+    }
+}
+
+func TestSplitSegments(t *testing.T) {
+    data := bytes.Repeat([]byte("abcd"), 5)[:18]
+    segments := splitSegments(data, 4)
+    if len(segments) != 5 || len(segments[4]) != 2 || !bytes.Equal(bytes.Join(segments, nil), data) {
+        t.Fatalf("segments %q", segments)
+    }
+    // Appending to one segment must not run into the next
+    _ = append(segments[0], 'x')
+    if segments[1][0] != 'a' {
+        t.Fatal("segments share capacity")
+    }
+    if segments := splitSegments(data, 0); len(segments) != 1 {
+        t.Fatalf("no GRO: %d segments", len(segments))
+    }
+}
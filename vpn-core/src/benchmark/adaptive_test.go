@@ -0,0 +1,88 @@
+package benchmark
+
+import (
+    "context"
+    "fmt"
+    "time"
+    
+    "github.com/montanaflynn/stats"
+)
+
+// AdaptiveDuration sizes a throughput measurement by how steady it is
+// rather than by a fixed Duration: windows of MinDuration are measured
+// until the coefficient of variation of the latest ones falls below
+// TargetCV, or MaxDuration has passed
+type AdaptiveDuration struct {
+    MinDuration time.Duration // one window, default 5s
+    MaxDuration time.Duration // default 10 windows
+    TargetCV    float64       // default 0.02
+}
+
+const (
+    defaultAdaptiveWindow   = 5 * time.Second
+    defaultAdaptiveWindows  = 10
+    defaultAdaptiveTargetCV = 0.02
+    
+    // Windows the CV is taken over, the noise of earlier ones doesn't hold
+    // a phase that has settled
+    adaptiveCVWindows = 3
+)
+
+func (a AdaptiveDuration) withDefaults() AdaptiveDuration {
+    if a.MinDuration <= 0 {
+        a.MinDuration = defaultAdaptiveWindow
+    }
+    if a.MaxDuration <= 0 {
+        a.MaxDuration = defaultAdaptiveWindows * a.MinDuration
+    }
+    if a.MaxDuration < a.MinDuration {
+        a.MaxDuration = a.MinDuration
+    }
+    if a.TargetCV <= 0 {
+        a.TargetCV = defaultAdaptiveTargetCV
+    }
+    return a
+}
+
+func (a AdaptiveDuration) String() string {
+    return fmt.Sprintf("adaptive, %v windows up to %v until CV < %.3f", a.MinDuration, a.MaxDuration, a.TargetCV)
+}
+
+// Sleep windows on clock until the growth of counter per window is steady.
+// Returns the time measured and the rate of every window, per second, or
+// ctx's error once it is done.
+func (a AdaptiveDuration) measure(ctx context.Context, clock Clock, counter func() uint64) (time.Duration, []float64, error) {
+    var elapsed time.Duration
+    var rates []float64
+    last := counter()
+    for elapsed < a.MaxDuration {
+        window := a.MinDuration
+        if rest := a.MaxDuration - elapsed; rest < window {
+            window = rest
+        }
+        select {
+        case <-clock.After(window):
+        case <-ctx.Done():
+            return elapsed, rates, ctx.Err()
+        }
+        elapsed += window
+        
+        now := counter()
+        rates = append(rates, float64(now-last)/window.Seconds())
+        last = now
+        if len(rates) >= adaptiveCVWindows && coefficientOfVariation(rates[len(rates)-adaptiveCVWindows:]) < a.TargetCV {
+            break
+        }
+    }
+    return elapsed, rates, nil
+}
+
+// Standard deviation over mean; windows without traffic count as steady
+func coefficientOfVariation(samples []float64) float64 {
+    mean, _ := stats.Mean(samples)
+    if mean == 0 {
+        return 0
+    }
+    stdDev, _ := stats.StandardDeviation(samples)
+    return stdDev / mean
+}
@@ -0,0 +1,73 @@
+package benchmark
+
+import (
+    "sync"
+    "time"
+)
+
+// Clock times the benchmark phases, see BenchmarkOptions.Clock. The VPN's
+// own Clock satisfies it.
+type Clock interface {
+    Now() time.Time
+    After(d time.Duration) <-chan time.Time
+}
+
+// RealClock is the system clock
+type RealClock struct{}
+
+func (RealClock) Now() time.Time                         { return time.Now() }
+func (RealClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// FakeClock only moves when Advance is called, firing whatever fell due on
+// the way in order
+type FakeClock struct {
+    mu      sync.Mutex
+    now     time.Time
+    waiting []fakeWaiter
+}
+
+type fakeWaiter struct {
+    at time.Time
+    c  chan time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+    return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+    ch := make(chan time.Time, 1)
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    if d <= 0 {
+        ch <- c.now
+        return ch
+    }
+    c.waiting = append(c.waiting, fakeWaiter{at: c.now.Add(d), c: ch})
+    return ch
+}
+
+// Advance moves the clock forward by d
+func (c *FakeClock) Advance(d time.Duration) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    c.now = c.now.Add(d)
+    pending := c.waiting[:0]
+    for _, w := range c.waiting {
+        if w.at.After(c.now) {
+            pending = append(pending, w)
+            continue
+        }
+        w.c <- w.at
+    }
+    c.waiting = pending
+}
@@ -0,0 +1,65 @@
+package benchmark
+
+import (
+    "bytes"
+    "context"
+    "runtime/pprof"
+    "testing"
+    
+    "github.com/google/pprof/profile"
+)
+
+// Profile the CPU while a phase runs into results.CPUProfiles, with its
+// goroutines labelled phase:<name> as the VPN labels its own. Only one
+// CPU profile runs at a time, so under go test -cpuprofile the phase
+// runs unprofiled.
+func (b *VPNBenchmark) profilePhase(results *BenchmarkResults, phase string, run func() error) error {
+    var buf bytes.Buffer
+    profiling := pprof.StartCPUProfile(&buf) == nil
+    
+    var err error
+    pprof.Do(context.Background(), pprof.Labels("phase", phase), func(context.Context) {
+        err = run()
+    })
+    
+    if profiling {
+        pprof.StopCPUProfile()
+        if results.CPUProfiles == nil {
+            results.CPUProfiles = make(map[string][]byte)
+        }
+        results.CPUProfiles[phase] = buf.Bytes()
+    }
+    return err
+}
+
+func TestEncryptionPhaseProfileIsLabelled(t *testing.T) {
+    b := NewVPNBenchmark(nil, BenchmarkOptions{WarmupDuration: -1})
+    results := &BenchmarkResults{}
+    err := b.profilePhase(results, "encryption", func() error {
+        _, err := b.benchmarkEncryption(context.Background())
+        return err
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    data, ok := results.CPUProfiles["encryption"]
+    if !ok {
+        t.Skip("CPU profiling already in use")
+    }
+    prof, err := profile.ParseData(data)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var labelled int64
+    for _, sample := range prof.Sample {
+        for _, phase := range sample.Label["phase"] {
+            if phase == "encryption" {
+                labelled += sample.Value[0]
+            }
+        }
+    }
+    if labelled == 0 {
+        t.Fatalf("no samples labelled phase:encryption among %d", len(prof.Sample))
+    }
+}
@@ -0,0 +1,280 @@
+package benchmark
+
+import (
+    "fmt"
+    "math"
+    "sort"
+    "sync"
+)
+
+// DefaultLatencyBuckets are the reporting bucket upper bounds in ms
+var DefaultLatencyBuckets = []float64{0.5, 1, 2, 5, 10, 20, 50, 100, 200}
+
+// Percentile estimates are within this relative error of the true sample
+const histogramRelativeAccuracy = 0.005
+
+// Samples at or below this are counted as zero, log bins can't hold them
+const histogramMinTrackable = 1e-9
+
+// LatencyBucket counts samples up to UpperMs (inclusive) and above the
+// previous bucket's bound
+type LatencyBucket struct {
+    UpperMs float64 `json:"upper_ms"`
+    Count   uint64  `json:"count"`
+}
+
+// LatencyHistogram records latencies in O(1) without keeping samples.
+// Counts are kept twice: in the configured reporting buckets, and in a
+// log-spaced sketch (DDSketch) that percentiles are estimated from.
+type LatencyHistogram struct {
+    mu         sync.Mutex
+    boundaries []float64
+    counts     []uint64 // one per boundary plus the overflow bucket
+    
+    logGamma float64
+    bins     map[int]uint64
+    zeros    uint64
+    
+    count    uint64
+    sum      float64
+    sumSq    float64
+    min, max float64
+}
+
+// NewLatencyHistogram creates a histogram with the given reporting bucket
+// boundaries, DefaultLatencyBuckets when empty
+func NewLatencyHistogram(boundaries []float64) (*LatencyHistogram, error) {
+    if len(boundaries) == 0 {
+        boundaries = DefaultLatencyBuckets
+    }
+    if err := validateBuckets(boundaries); err != nil {
+        return nil, err
+    }
+    
+    gamma := (1 + histogramRelativeAccuracy) / (1 - histogramRelativeAccuracy)
+    return &LatencyHistogram{
+        boundaries: append([]float64(nil), boundaries...),
+        counts:     make([]uint64, len(boundaries)+1),
+        logGamma:   math.Log(gamma),
+        bins:       make(map[int]uint64),
+    }, nil
+}
+
+func validateBuckets(boundaries []float64) error {
+    for i, b := range boundaries {
+        if b <= 0 || math.IsInf(b, 0) || math.IsNaN(b) {
+            return fmt.Errorf("invalid bucket boundary %v", b)
+        }
+        if i > 0 && b <= boundaries[i-1] {
+            return fmt.Errorf("bucket boundaries must be strictly increasing, %v follows %v", b, boundaries[i-1])
+        }
+    }
+    return nil
+}
+
+// Record adds one latency sample in ms
+func (h *LatencyHistogram) Record(ms float64) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    
+    h.recordLocked(ms)
+}
+
+// RecordAll adds samples in ms under a single lock
+func (h *LatencyHistogram) RecordAll(samples []float64) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    
+    for _, ms := range samples {
+        h.recordLocked(ms)
+    }
+}
+
+func (h *LatencyHistogram) recordLocked(ms float64) {
+    if h.count == 0 || ms < h.min {
+        h.min = ms
+    }
+    if h.count == 0 || ms > h.max {
+        h.max = ms
+    }
+    h.count++
+    h.sum += ms
+    h.sumSq += ms * ms
+    
+    // A handful of boundaries, the search is effectively constant
+    h.counts[sort.SearchFloat64s(h.boundaries, ms)]++
+    
+    if ms <= histogramMinTrackable {
+        h.zeros++
+        return
+    }
+    h.bins[h.binIndex(ms)]++
+}
+
+// Reset discards every sample, keeping the bucket boundaries
+func (h *LatencyHistogram) Reset() {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    
+    for i := range h.counts {
+        h.counts[i] = 0
+    }
+    h.bins = make(map[int]uint64)
+    h.zeros, h.count = 0, 0
+    h.sum, h.sumSq, h.min, h.max = 0, 0, 0, 0
+}
+
+func (h *LatencyHistogram) binIndex(ms float64) int {
+    return int(math.Ceil(math.Log(ms) / h.logGamma))
+}
+
+// Midpoint of a bin in relative terms, at most histogramRelativeAccuracy
+// from any value that falls in it
+func (h *LatencyHistogram) binValue(index int) float64 {
+    gamma := math.Exp(h.logGamma)
+    return 2 * math.Pow(gamma, float64(index)) / (gamma + 1)
+}
+
+// Count returns the number of recorded samples
+func (h *LatencyHistogram) Count() uint64 {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.count
+}
+
+// Percentile estimates the nearest-rank p-th percentile, 0 < p <= 100
+func (h *LatencyHistogram) Percentile(p float64) float64 {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.percentileLocked(p)
+}
+
+func (h *LatencyHistogram) percentileLocked(p float64) float64 {
+    if h.count == 0 {
+        return 0
+    }
+    
+    rank := uint64(math.Ceil(p / 100 * float64(h.count)))
+    if rank < 1 {
+        rank = 1
+    }
+    
+    var seen uint64
+    var value float64
+    h.walk(func(v float64, n uint64) bool {
+        seen += n
+        value = v
+        return seen < rank
+    })
+    
+    // The extremes are known exactly
+    return max(h.min, min(value, h.max))
+}
+
+// Visit bins in ascending order until visit returns false
+func (h *LatencyHistogram) walk(visit func(value float64, count uint64) bool) {
+    if h.zeros > 0 && !visit(0, h.zeros) {
+        return
+    }
+    
+    indexes := make([]int, 0, len(h.bins))
+    for index := range h.bins {
+        indexes = append(indexes, index)
+    }
+    sort.Ints(indexes)
+    
+    for _, index := range indexes {
+        if !visit(h.binValue(index), h.bins[index]) {
+            return
+        }
+    }
+}
+
+// Buckets returns the sample counts per reporting bucket. Samples above
+// the last boundary are in a final bucket bounded by the largest sample.
+func (h *LatencyHistogram) Buckets() []LatencyBucket {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    
+    buckets := make([]LatencyBucket, 0, len(h.counts))
+    for i, bound := range h.boundaries {
+        buckets = append(buckets, LatencyBucket{UpperMs: bound, Count: h.counts[i]})
+    }
+    if overflow := h.counts[len(h.boundaries)]; overflow > 0 {
+        buckets = append(buckets, LatencyBucket{UpperMs: h.max, Count: overflow})
+    }
+    return buckets
+}
+
+// Metrics summarises the histogram. With trim, the average and standard
+// deviation leave out the top and bottom latencyTrimFraction of samples.
+func (h *LatencyHistogram) Metrics(trim bool) LatencyMetrics {
+    h.mu.Lock()
+    if h.count == 0 {
+        h.mu.Unlock()
+        return LatencyMetrics{Trimmed: trim}
+    }
+    
+    metrics := LatencyMetrics{
+        MinMs:    h.min,
+        MaxMs:    h.max,
+        MedianMs: h.percentileLocked(50),
+        P95Ms:    h.percentileLocked(95),
+        P99Ms:    h.percentileLocked(99),
+        Trimmed:  trim,
+    }
+    n := float64(h.count)
+    metrics.AvgMs = h.sum / n
+    metrics.StdDevMs = math.Sqrt(max(0, h.sumSq/n-metrics.AvgMs*metrics.AvgMs))
+    if trim {
+        metrics.AvgMs, metrics.StdDevMs = h.trimmedMoments(latencyTrimFraction)
+    }
+    h.mu.Unlock()
+    
+    metrics.Buckets = h.Buckets()
+    return metrics
+}
+
+// Mean and population standard deviation from the bins, skipping fraction
+// of the samples at each end
+func (h *LatencyHistogram) trimmedMoments(fraction float64) (float64, float64) {
+    drop := uint64(float64(h.count) * fraction)
+    if drop == 0 || 2*drop >= h.count {
+        n := float64(h.count)
+        mean := h.sum / n
+        return mean, math.Sqrt(max(0, h.sumSq/n-mean*mean))
+    }
+    
+    lo, hi := drop, h.count-drop // keep ranks [lo, hi)
+    var rank uint64
+    var kept, sum, sumSq float64
+    h.walk(func(v float64, n uint64) bool {
+        start, end := rank, rank+n
+        rank = end
+        if end <= lo || start >= hi {
+            return start < hi
+        }
+        k := min(float64(end), float64(hi)) - max(float64(start), float64(lo))
+        kept += k
+        sum += k * v
+        sumSq += k * v * v
+        return true
+    })
+    
+    mean := sum / kept
+    return mean, math.Sqrt(max(0, sumSq/kept-mean*mean))
+}
+
+// ConfigureBuckets sets the latency reporting bucket boundaries in ms,
+// strictly increasing. Percentile accuracy does not depend on them.
+func (b *VPNBenchmark) ConfigureBuckets(boundaries []float64) error {
+    if len(boundaries) == 0 {
+        boundaries = DefaultLatencyBuckets
+    }
+    if err := validateBuckets(boundaries); err != nil {
+        return err
+    }
+    
+    b.latencyBuckets = append([]float64(nil), boundaries...)
+    return nil
+}
@@ -0,0 +1,267 @@
+package benchmark
+
+import (
+    "crypto/cipher"
+    "crypto/hmac"
+    "crypto/rand"
+    "encoding/binary"
+    "errors"
+    "hash"
+    "time"
+    
+    "golang.org/x/crypto/blake2s"
+    "golang.org/x/crypto/chacha20poly1305"
+    "golang.org/x/crypto/curve25519"
+)
+
+const (
+    noiseConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+    noiseIdentifier   = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+)
+
+var (
+    errNoiseKeyMismatch = errors.New("handshake sides derived different transport keys")
+    errNoiseUnknownPeer = errors.New("initiation from an unknown static key")
+)
+
+type noiseKey [32]byte
+
+type noiseKeypair struct {
+    private, public noiseKey
+}
+
+func newNoiseKeypair() (noiseKeypair, error) {
+    var kp noiseKeypair
+    if _, err := rand.Read(kp.private[:]); err != nil {
+        return kp, err
+    }
+    curve25519.ScalarBaseMult((*[32]byte)(&kp.public), (*[32]byte)(&kp.private))
+    return kp, nil
+}
+
+func noiseDH(private, public noiseKey) (noiseKey, error) {
+    var shared noiseKey
+    out, err := curve25519.X25519(private[:], public[:])
+    copy(shared[:], out)
+    return shared, err
+}
+
+func noiseHash(parts ...[]byte) noiseKey {
+    h, _ := blake2s.New256(nil)
+    for _, p := range parts {
+        h.Write(p)
+    }
+    var sum noiseKey
+    h.Sum(sum[:0])
+    return sum
+}
+
+func noiseHMAC(key []byte, parts ...[]byte) noiseKey {
+    mac := hmac.New(func() hash.Hash { h, _ := blake2s.New256(nil); return h }, key)
+    for _, p := range parts {
+        mac.Write(p)
+    }
+    var sum noiseKey
+    mac.Sum(sum[:0])
+    return sum
+}
+
+// HKDF with BLAKE2s, n outputs of the chaining key and input
+func noiseKDF(chainKey noiseKey, input []byte, n int) []noiseKey {
+    prk := noiseHMAC(chainKey[:], input)
+    out := make([]noiseKey, n)
+    prev := []byte{}
+    for i := range out {
+        out[i] = noiseHMAC(prk[:], prev, []byte{byte(i + 1)})
+        prev = out[i][:]
+    }
+    return out
+}
+
+// Seal with a handshake key, whose nonce is always zero
+func noiseSeal(key noiseKey, plaintext, ad []byte) []byte {
+    aead, _ := chacha20poly1305.New(key[:])
+    return aead.Seal(nil, make([]byte, aead.NonceSize()), plaintext, ad)
+}
+
+func noiseOpen(key noiseKey, ciphertext, ad []byte) ([]byte, error) {
+    aead, _ := chacha20poly1305.New(key[:])
+    return aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext, ad)
+}
+
+// One side of a WireGuard session
+type noiseTransport struct {
+    send, recv cipher.AEAD
+    counter    uint64
+}
+
+// A WireGuard session between two in-process peers. The static keys and
+// their shared secret stay for the session's life; every handshake, the
+// first as every rekey, brings fresh ephemerals and transport keys.
+type noiseSession struct {
+    initiator, responder noiseKeypair
+    staticShared         noiseKey // DH(initiator, responder), computed once as WireGuard does
+    psk                  noiseKey
+    
+    initSide, respSide noiseTransport
+}
+
+func newNoiseSession() (*noiseSession, error) {
+    s := &noiseSession{}
+    var err error
+    if s.initiator, err = newNoiseKeypair(); err != nil {
+        return nil, err
+    }
+    if s.responder, err = newNoiseKeypair(); err != nil {
+        return nil, err
+    }
+    if _, err := rand.Read(s.psk[:]); err != nil {
+        return nil, err
+    }
+    if s.staticShared, err = noiseDH(s.initiator.private, s.responder.public); err != nil {
+        return nil, err
+    }
+    return s, s.handshake()
+}
+
+// Run the Noise IKpsk2 handshake of WireGuard, both the initiator and the
+// responder side, and install the transport keys it derives
+func (s *noiseSession) handshake() error {
+    chain := noiseHash([]byte(noiseConstruction))
+    h := noiseHash(chain[:], []byte(noiseIdentifier))
+    h = noiseHash(h[:], s.responder.public[:])
+    
+    // Initiation, built by the initiator
+    ephemeral, err := newNoiseKeypair()
+    if err != nil {
+        return err
+    }
+    initChain := noiseKDF(chain, ephemeral.public[:], 1)[0]
+    initHash := noiseHash(h[:], ephemeral.public[:])
+    es, err := noiseDH(ephemeral.private, s.responder.public)
+    if err != nil {
+        return err
+    }
+    k := noiseKDF(initChain, es[:], 2)
+    initChain = k[0]
+    static := noiseSeal(k[1], s.initiator.public[:], initHash[:])
+    initHash = noiseHash(initHash[:], static)
+    k = noiseKDF(initChain, s.staticShared[:], 2)
+    initChain = k[0]
+    timestamp := noiseSeal(k[1], tai64n(time.Now()), initHash[:])
+    initHash = noiseHash(initHash[:], timestamp)
+    
+    // Consumed by the responder
+    respChain := noiseKDF(chain, ephemeral.public[:], 1)[0]
+    respHash := noiseHash(h[:], ephemeral.public[:])
+    se, err := noiseDH(s.responder.private, ephemeral.public)
+    if err != nil {
+        return err
+    }
+    k = noiseKDF(respChain, se[:], 2)
+    respChain = k[0]
+    peer, err := noiseOpen(k[1], static, respHash[:])
+    if err != nil {
+        return err
+    }
+    respHash = noiseHash(respHash[:], static)
+    if noiseKey(peer) != s.initiator.public {
+        return errNoiseUnknownPeer
+    }
+    k = noiseKDF(respChain, s.staticShared[:], 2)
+    respChain = k[0]
+    if _, err := noiseOpen(k[1], timestamp, respHash[:]); err != nil {
+        return err
+    }
+    respHash = noiseHash(respHash[:], timestamp)
+    
+    // Response, built by the responder
+    respEphemeral, err := newNoiseKeypair()
+    if err != nil {
+        return err
+    }
+    respChain = noiseKDF(respChain, respEphemeral.public[:], 1)[0]
+    respHash = noiseHash(respHash[:], respEphemeral.public[:])
+    ee, err := noiseDH(respEphemeral.private, ephemeral.public)
+    if err != nil {
+        return err
+    }
+    respChain = noiseKDF(respChain, ee[:], 1)[0]
+    se, err = noiseDH(respEphemeral.private, s.initiator.public)
+    if err != nil {
+        return err
+    }
+    respChain = noiseKDF(respChain, se[:], 1)[0]
+    k = noiseKDF(respChain, s.psk[:], 3)
+    respChain = k[0]
+    respHash = noiseHash(respHash[:], k[1][:])
+    empty := noiseSeal(k[2], nil, respHash[:])
+    
+    // Consumed by the initiator
+    initChain = noiseKDF(initChain, respEphemeral.public[:], 1)[0]
+    initHash = noiseHash(initHash[:], respEphemeral.public[:])
+    if ee, err = noiseDH(ephemeral.private, respEphemeral.public); err != nil {
+        return err
+    }
+    initChain = noiseKDF(initChain, ee[:], 1)[0]
+    if es, err = noiseDH(s.initiator.private, respEphemeral.public); err != nil {
+        return err
+    }
+    initChain = noiseKDF(initChain, es[:], 1)[0]
+    k = noiseKDF(initChain, s.psk[:], 3)
+    initChain = k[0]
+    initHash = noiseHash(initHash[:], k[1][:])
+    if _, err := noiseOpen(k[2], empty, initHash[:]); err != nil {
+        return err
+    }
+    
+    // Transport keys, the initiator's send key is the responder's receive key
+    initKeys := noiseKDF(initChain, nil, 2)
+    respKeys := noiseKDF(respChain, nil, 2)
+    if initKeys[0] != respKeys[0] || initKeys[1] != respKeys[1] {
+        return errNoiseKeyMismatch
+    }
+    s.initSide = newNoiseTransport(initKeys[0], initKeys[1])
+    s.respSide = newNoiseTransport(respKeys[1], respKeys[0])
+    return nil
+}
+
+func newNoiseTransport(send, recv noiseKey) noiseTransport {
+    sendAEAD, _ := chacha20poly1305.New(send[:])
+    recvAEAD, _ := chacha20poly1305.New(recv[:])
+    return noiseTransport{send: sendAEAD, recv: recvAEAD}
+}
+
+// Rekey the established session as WireGuard does every RekeyAfterTime:
+// a new handshake, then the initiator's keepalive that confirms the new
+// keys to the responder
+func (s *noiseSession) rekey() error {
+    if err := s.handshake(); err != nil {
+        return err
+    }
+    _, err := s.respSide.open(s.initSide.seal(nil))
+    return err
+}
+
+// A transport data payload, counter first as in the message header
+func (t *noiseTransport) seal(plaintext []byte) []byte {
+    nonce := make([]byte, chacha20poly1305.NonceSize)
+    binary.LittleEndian.PutUint64(nonce[4:], t.counter)
+    sealed := t.send.Seal(append([]byte(nil), nonce[4:]...), nonce, plaintext, nil)
+    t.counter++
+    return sealed
+}
+
+func (t *noiseTransport) open(packet []byte) ([]byte, error) {
+    nonce := make([]byte, chacha20poly1305.NonceSize)
+    copy(nonce[4:], packet[:8])
+    return t.recv.Open(nil, nonce, packet[8:], nil)
+}
+
+// TAI64N label of t, as the initiation carries it
+func tai64n(t time.Time) []byte {
+    b := make([]byte, 12)
+    binary.BigEndian.PutUint64(b, uint64(t.Unix())+0x400000000000000a)
+    binary.BigEndian.PutUint32(b[8:], uint32(t.Nanosecond()))
+    return b
+}
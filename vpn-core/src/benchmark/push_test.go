@@ -0,0 +1,111 @@
+package benchmark
+
+import (
+    "fmt"
+    "net/http"
+    "os"
+    
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/push"
+)
+
+// PushOption adjusts how PushMetrics talks to the Pushgateway
+type PushOption func(*pushConfig)
+
+type pushConfig struct {
+    instance string
+    username string
+    password string
+    token    string
+    client   *http.Client
+}
+
+// WithInstance sets the instance label, the hostname by default
+func WithInstance(instance string) PushOption {
+    return func(c *pushConfig) { c.instance = instance }
+}
+
+// WithBasicAuth authenticates to the Pushgateway with a user and password
+func WithBasicAuth(username, password string) PushOption {
+    return func(c *pushConfig) { c.username, c.password = username, password }
+}
+
+// WithBearerToken authenticates with an Authorization: Bearer header
+func WithBearerToken(token string) PushOption {
+    return func(c *pushConfig) { c.token = token }
+}
+
+// WithHTTPClient replaces http.DefaultClient, e.g. for timeouts or TLS
+func WithHTTPClient(client *http.Client) PushOption {
+    return func(c *pushConfig) { c.client = client }
+}
+
+// Adds the bearer token to every request
+type bearerDoer struct {
+    client *http.Client
+    token  string
+}
+
+func (d bearerDoer) Do(req *http.Request) (*http.Response, error) {
+    req.Header.Set("Authorization", "Bearer "+d.token)
+    return d.client.Do(req)
+}
+
+// PushMetrics sends the headline figures as gauges to a Prometheus
+// Pushgateway, replacing what this job and instance pushed before
+func (r *BenchmarkResults) PushMetrics(pushgatewayURL, jobName string, opts ...PushOption) error {
+    cfg := pushConfig{client: http.DefaultClient}
+    for _, opt := range opts {
+        opt(&cfg)
+    }
+    if cfg.instance == "" {
+        host, err := os.Hostname()
+        if err != nil {
+            return fmt.Errorf("failed to determine instance label: %w", err)
+        }
+        cfg.instance = host
+    }
+    
+    pusher := push.New(pushgatewayURL, jobName).Grouping("instance", cfg.instance)
+    for _, g := range r.gauges() {
+        pusher = pusher.Collector(g)
+    }
+    if cfg.username != "" {
+        pusher = pusher.BasicAuth(cfg.username, cfg.password)
+    }
+    if cfg.token != "" {
+        pusher = pusher.Client(bearerDoer{cfg.client, cfg.token})
+    } else {
+        pusher = pusher.Client(cfg.client)
+    }
+    
+    // Non-2xx responses come back as errors naming the status code
+    if err := pusher.Push(); err != nil {
+        return fmt.Errorf("failed to push benchmark metrics to %s: %w", pushgatewayURL, err)
+    }
+    return nil
+}
+
+func (r *BenchmarkResults) gauges() []prometheus.Gauge {
+    gauge := func(name, help string, value float64) prometheus.Gauge {
+        g := prometheus.NewGauge(prometheus.GaugeOpts{
+            Namespace:   "utr",
+            Subsystem:   "benchmark",
+            Name:        name,
+            Help:        help,
+            ConstLabels: prometheus.Labels{"scoring": r.profile().Name},
+        })
+        g.Set(value)
+        return g
+    }
+    return []prometheus.Gauge{
+        gauge("download_mbps", "Download throughput in Mbps.", r.Throughput.Download),
+        gauge("upload_mbps", "Upload throughput in Mbps.", r.Throughput.Upload),
+        gauge("bidirectional_mbps", "Bidirectional throughput in Mbps.", r.Throughput.Bidirectional),
+        gauge("ipv4_mbps", "Bidirectional IPv4 throughput in Mbps.", r.Throughput.IPv4Mbps),
+        gauge("ipv6_mbps", "Bidirectional IPv6 throughput in Mbps.", r.Throughput.IPv6Mbps),
+        gauge("latency_p99_ms", "99th percentile round trip in milliseconds.", r.Latency.P99Ms),
+        gauge("packet_loss_percent", "Packet loss in percent.", r.PacketLoss),
+        gauge("score", "Overall benchmark score out of 100.", r.Score),
+    }
+}
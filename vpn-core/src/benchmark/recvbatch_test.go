@@ -0,0 +1,87 @@
+package benchmark
+
+import (
+    "fmt"
+    "net"
+    "testing"
+    "time"
+    
+    "golang.org/x/net/ipv4"
+)
+
+// Datagrams per receive batch, the receiver's MaxReceiveBatch
+const recvBatchSize = 64
+
+// Packets one receive syscall brings in when reading in batches, over
+// loopback with bursts of size byte packets. ReadBatch is recvmmsg on
+// Linux and a single read elsewhere, where this comes out at 1.
+func measureRecvBatching(size, bursts int) (float64, error) {
+    conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        return 0, err
+    }
+    defer conn.Close()
+    sender, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+    if err != nil {
+        return 0, err
+    }
+    defer sender.Close()
+    
+    pc := ipv4.NewPacketConn(conn)
+    msgs := make([]ipv4.Message, recvBatchSize)
+    for i := range msgs {
+        msgs[i].Buffers = [][]byte{make([]byte, 65535)}
+    }
+    packet := make([]byte, size)
+    packets, syscalls := 0, 0
+    for burst := 0; burst < bursts; burst++ {
+        for i := 0; i < recvBatchSize; i++ {
+            if _, err := sender.Write(packet); err != nil {
+                return 0, err
+            }
+        }
+        // Loopback may drop under memory pressure, the deadline ends the burst
+        conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+        for received := 0; received < recvBatchSize; {
+            n, err := pc.ReadBatch(msgs, 0)
+            if err != nil {
+                break
+            }
+            syscalls++
+            received += n
+            packets += n
+        }
+    }
+    if syscalls == 0 {
+        return 0, fmt.Errorf("no packets came back over loopback")
+    }
+    return float64(packets) / float64(syscalls), nil
+}
+
+// Receive syscalls per second for pps packets, read one per syscall and
+// in batches of perSyscall, and the share batching saves
+func recvSyscalls(pps uint64, perSyscall float64) (single, batched uint64, reduction float64) {
+    if perSyscall < 1 {
+        perSyscall = 1
+    }
+    batched = uint64(float64(pps) / perSyscall)
+    if pps > 0 {
+        reduction = (1 - float64(batched)/float64(pps)) * 100
+    }
+    return pps, batched, reduction
+}
+
+func TestRecvBatchingReadsSeveralPerSyscall(t *testing.T) {
+    perSyscall, err := measureRecvBatching(200, 4)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if perSyscall < 1 || perSyscall > recvBatchSize {
+        t.Fatalf("%.1f packets per syscall", perSyscall)
+    }
+    
+    single, batched, reduction := recvSyscalls(64000, 16)
+    if single != 64000 || batched != 4000 || reduction != 93.75 {
+        t.Fatalf("%d, %d, %.2f%%", single, batched, reduction)
+    }
+}
@@ -0,0 +1,100 @@
+package benchmark
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    
+    "github.com/montanaflynn/stats"
+)
+
+const (
+    defaultRegressionThreshold    = 5.0 // standard deviations
+    defaultRegressionBaselineRuns = 10
+    cusumSlack                    = 0.5 // standard deviations a run may drift for free
+    minRelativeStdDev             = 0.001
+)
+
+var ErrShortHistory = errors.New("not enough benchmark history")
+
+// RegressionSignal is a point where a throughput figure's control chart
+// crossed its threshold
+type RegressionSignal struct {
+    Metric      string  `json:"metric"`
+    Index       int     `json:"index"`        // into the history, where the chart crossed
+    ChangeIndex int     `json:"change_index"` // first run of the shift, estimated
+    Value       float64 `json:"value"`
+    Mean        float64 `json:"mean"`   // of the baseline runs
+    StdDev      float64 `json:"stddev"` // of the baseline runs
+    CUSUM       float64 `json:"cusum"`  // in standard deviations
+}
+
+// Figures watched for regressions, all higher is better
+var regressionMetrics = []comparedMetric{
+    {"Download (Mbps)", true, func(r *BenchmarkResults) float64 { return r.Throughput.Download }},
+    {"Upload (Mbps)", true, func(r *BenchmarkResults) float64 { return r.Throughput.Upload }},
+    {"Bidirectional (Mbps)", true, func(r *BenchmarkResults) float64 { return r.Throughput.Bidirectional }},
+}
+
+// LoadHistory sets the prior results AnalyzeRegression charts, oldest
+// first. Each Run appends its results.
+func (b *VPNBenchmark) LoadHistory(results []BenchmarkResults) {
+    b.history = append([]BenchmarkResults(nil), results...)
+}
+
+// AnalyzeRegression runs a CUSUM control chart over the history of each
+// throughput figure. The first BenchmarkOptions.RegressionBaselineRuns
+// results give the in-control mean and standard deviation; a regression
+// is signalled only once the drops below the mean, summed over runs, pass
+// RegressionThreshold standard deviations. A single noisy run is absorbed,
+// a sustained shift is not.
+func (b *VPNBenchmark) AnalyzeRegression() ([]RegressionSignal, error) {
+    if len(b.history) <= b.regressionBaseline {
+        return nil, fmt.Errorf("%w: %d results, need more than the %d baseline runs", ErrShortHistory, len(b.history), b.regressionBaseline)
+    }
+    
+    var signals []RegressionSignal
+    for _, m := range regressionMetrics {
+        series := make([]float64, len(b.history))
+        for i := range b.history {
+            series[i] = m.get(&b.history[i])
+        }
+        signals = append(signals, cusum(m.name, series, b.regressionBaseline, b.regressionThreshold)...)
+    }
+    return signals, nil
+}
+
+// One-sided lower CUSUM of series against its first baseline values. The
+// sum restarts after each signal so later shifts are reported too.
+func cusum(name string, series []float64, baseline int, threshold float64) []RegressionSignal {
+    mean, _ := stats.Mean(series[:baseline])
+    if mean == 0 {
+        return nil // not measured
+    }
+    stddev, _ := stats.StandardDeviationSample(series[:baseline])
+    // Identical baseline runs would make any change infinitely significant
+    stddev = math.Max(stddev, math.Abs(mean)*minRelativeStdDev)
+    
+    var signals []RegressionSignal
+    sum, start := 0.0, 0
+    for i, v := range series {
+        sum = math.Max(0, sum+(mean-v)/stddev-cusumSlack)
+        if sum == 0 {
+            start = i + 1
+            continue
+        }
+        if sum > threshold {
+            signals = append(signals, RegressionSignal{
+                Metric:      name,
+                Index:       i,
+                ChangeIndex: start,
+                Value:       v,
+                Mean:        mean,
+                StdDev:      stddev,
+                CUSUM:       sum,
+            })
+            sum, start = 0, i+1
+        }
+    }
+    return signals
+}
@@ -0,0 +1,314 @@
+package benchmark
+
+import (
+    "fmt"
+    "html"
+    "html/template"
+    "io"
+    "math"
+    "strings"
+)
+
+// Charts are drawn as inline SVG so the report opens offline with no
+// scripts or external assets
+const (
+    chartWidth  = 480
+    chartHeight = 260
+    chartMargin = 40
+)
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>UnderTheRadar VPN benchmark</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+section { margin-bottom: 2em; }
+svg { background: #fafafa; border: 1px solid #ddd; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.better { color: #1a7f37; }
+.worse { color: #cf222e; }
+</style>
+</head>
+<body>
+<h1>UnderTheRadar VPN benchmark</h1>
+<p>Overall score: <strong>{{printf "%.1f" .Score}}/100</strong> ({{.Grade}}), scored with the {{.Profile}} profile</p>
+<section id="throughput">
+<h2>Throughput</h2>
+{{.Throughput}}
+</section>
+<section id="latency">
+<h2>Latency distribution</h2>
+{{.Latency}}
+</section>
+<section id="stability">
+<h2>Stability</h2>
+{{.Stability}}
+</section>
+<section id="score">
+<h2>Score dimensions</h2>
+{{.Radar}}
+</section>
+{{if .Comparison}}<section id="baseline">
+<h2>Compare to baseline</h2>
+<table>
+<thead><tr><th>Metric</th><th>Baseline</th><th>Current</th><th>Change</th></tr></thead>
+<tbody>
+{{range .Comparison}}<tr><td>{{.Name}}</td><td>{{printf "%.2f" .Baseline}}</td><td>{{printf "%.2f" .Current}}</td><td class="{{.Class}}">{{.Change}}</td></tr>
+{{end}}</tbody>
+</table>
+</section>
+{{end}}</body>
+</html>
+`))
+
+type reportData struct {
+    Score      float64
+    Grade      string
+    Profile    string
+    Throughput template.HTML
+    Latency    template.HTML
+    Stability  template.HTML
+    Radar      template.HTML
+    Comparison []comparisonRow
+}
+
+type comparisonRow struct {
+    Name     string
+    Baseline float64
+    Current  float64
+    Change   string
+    Class    string
+}
+
+// ToHTML writes a self-contained HTML report of the results
+func (r *BenchmarkResults) ToHTML(w io.Writer) error {
+    return r.ToHTMLWithBaseline(w, nil)
+}
+
+// ToHTMLWithBaseline writes the HTML report, adding a comparison against
+// baseline when it is not nil. The baseline must use the same scoring profile.
+func (r *BenchmarkResults) ToHTMLWithBaseline(w io.Writer, baseline *BenchmarkResults) error {
+    score := r.calculateOverallScore()
+    data := reportData{
+        Score:      score,
+        Grade:      r.getGrade(score),
+        Profile:    r.profile().Name,
+        Throughput: throughputChart(r, baseline),
+        Latency:    latencyChart(r, baseline),
+        Stability:  lineChart(r.StabilityMbps, "Mbps"),
+        Radar:      radarChart(r.scoreDimensions()),
+    }
+    if baseline != nil {
+        comparison, err := r.CompareAgainst(baseline)
+        if err != nil {
+            return err
+        }
+        data.Comparison = comparisonRows(comparison)
+    }
+    
+    if err := reportTemplate.Execute(w, data); err != nil {
+        return fmt.Errorf("failed to render report: %w", err)
+    }
+    return nil
+}
+
+func comparisonRows(comparison []MetricComparison) []comparisonRow {
+    rows := make([]comparisonRow, 0, len(comparison))
+    for _, c := range comparison {
+        row := comparisonRow{
+            Name:     c.Name,
+            Baseline: c.Baseline,
+            Current:  c.Current,
+            Change:   "n/a",
+        }
+        if c.ChangePercent != nil {
+            row.Change = fmt.Sprintf("%+.1f%%", *c.ChangePercent)
+        }
+        if c.Current != c.Baseline {
+            row.Class = "worse"
+            if c.Improved {
+                row.Class = "better"
+            }
+        }
+        rows = append(rows, row)
+    }
+    return rows
+}
+
+func svgOpen(b *strings.Builder, label string) {
+    fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" role="img" aria-label="%s">`,
+        chartWidth, chartHeight, chartWidth, chartHeight, html.EscapeString(label))
+}
+
+func svgText(b *strings.Builder, x, y float64, anchor, text string) {
+    fmt.Fprintf(b, `<text x="%.1f" y="%.1f" font-size="11" text-anchor="%s">%s</text>`, x, y, anchor, html.EscapeString(text))
+}
+
+// Maps a value onto the plot's vertical axis, 0 at the bottom
+func scaleY(v, top float64) float64 {
+    plot := float64(chartHeight - 2*chartMargin)
+    if top <= 0 {
+        return float64(chartHeight - chartMargin)
+    }
+    return float64(chartHeight-chartMargin) - v/top*plot
+}
+
+// Upper axis bound with some headroom, never zero
+func axisTop(values ...float64) float64 {
+    top := 0.0
+    for _, v := range values {
+        top = max(top, v)
+    }
+    if top == 0 {
+        return 1
+    }
+    return top * 1.1
+}
+
+func svgAxes(b *strings.Builder, top float64, unit string) {
+    bottom := float64(chartHeight - chartMargin)
+    fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%.1f" stroke="#333"/>`, chartMargin, chartMargin, chartMargin, bottom)
+    fmt.Fprintf(b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#333"/>`, chartMargin, bottom, chartWidth-chartMargin, bottom)
+    svgText(b, chartMargin-4, float64(chartMargin), "end", fmt.Sprintf("%.0f", top))
+    svgText(b, chartMargin-4, bottom, "end", "0")
+    svgText(b, chartMargin, float64(chartMargin)-10, "start", unit)
+}
+
+func throughputChart(r, baseline *BenchmarkResults) template.HTML {
+    labels := []string{"Download", "Upload", "Bidirectional"}
+    current := []float64{r.Throughput.Download, r.Throughput.Upload, r.Throughput.Bidirectional}
+    var base []float64
+    if baseline != nil {
+        base = []float64{baseline.Throughput.Download, baseline.Throughput.Upload, baseline.Throughput.Bidirectional}
+    }
+    top := axisTop(append(append([]float64(nil), current...), base...)...)
+    
+    var b strings.Builder
+    svgOpen(&b, "Throughput bar chart")
+    svgAxes(&b, top, "Mbps")
+    
+    slot := float64(chartWidth-2*chartMargin) / float64(len(labels))
+    barWidth := slot / 3
+    bottom := float64(chartHeight - chartMargin)
+    for i, label := range labels {
+        x := float64(chartMargin) + float64(i)*slot + slot/6
+        if base != nil {
+            y := scaleY(base[i], top)
+            fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="#bbb"><title>baseline %.1f Mbps</title></rect>`,
+                x, y, barWidth, bottom-y, base[i])
+            x += barWidth
+        }
+        y := scaleY(current[i], top)
+        fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="#3b82f6"><title>%.1f Mbps</title></rect>`,
+            x, y, barWidth, bottom-y, current[i])
+        svgText(&b, float64(chartMargin)+float64(i)*slot+slot/2, bottom+16, "middle", label)
+    }
+    b.WriteString(`</svg>`)
+    return template.HTML(b.String())
+}
+
+// Whiskers span min to max, the box spans median to P95 with the average
+// drawn across it and P99 marked on the upper whisker
+func latencyChart(r, baseline *BenchmarkResults) template.HTML {
+    series := []*BenchmarkResults{r}
+    names := []string{"Current"}
+    if baseline != nil {
+        series = []*BenchmarkResults{baseline, r}
+        names = []string{"Baseline", "Current"}
+    }
+    
+    var highs []float64
+    for _, s := range series {
+        highs = append(highs, s.Latency.MaxMs)
+    }
+    top := axisTop(highs...)
+    
+    var b strings.Builder
+    svgOpen(&b, "Latency box plot")
+    svgAxes(&b, top, "ms")
+    
+    slot := float64(chartWidth-2*chartMargin) / float64(len(series))
+    for i, s := range series {
+        l := s.Latency
+        mid := float64(chartMargin) + float64(i)*slot + slot/2
+        half := slot / 6
+        fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#333"/>`, mid, scaleY(l.MinMs, top), mid, scaleY(l.MaxMs, top))
+        for _, v := range []float64{l.MinMs, l.MaxMs} {
+            fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#333"/>`, mid-half/2, scaleY(v, top), mid+half/2, scaleY(v, top))
+        }
+        boxTop := scaleY(l.P95Ms, top)
+        fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="#93c5fd" stroke="#333"/>`,
+            mid-half, boxTop, 2*half, scaleY(l.MedianMs, top)-boxTop)
+        fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#cf222e" stroke-width="2"><title>avg %.2f ms</title></line>`,
+            mid-half, scaleY(l.AvgMs, top), mid+half, scaleY(l.AvgMs, top), l.AvgMs)
+        fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="3" fill="#333"><title>P99 %.2f ms</title></circle>`, mid, scaleY(l.P99Ms, top), l.P99Ms)
+        svgText(&b, mid, float64(chartHeight-chartMargin)+16, "middle",
+            fmt.Sprintf("%s (min %.1f / avg %.1f / P95 %.1f / P99 %.1f / max %.1f)", names[i], l.MinMs, l.AvgMs, l.P95Ms, l.P99Ms, l.MaxMs))
+    }
+    b.WriteString(`</svg>`)
+    return template.HTML(b.String())
+}
+
+func lineChart(samples []float64, unit string) template.HTML {
+    top := axisTop(samples...)
+    
+    var b strings.Builder
+    svgOpen(&b, "Stability line chart")
+    svgAxes(&b, top, unit)
+    if len(samples) == 0 {
+        svgText(&b, chartWidth/2, chartHeight/2, "middle", "no measurements")
+    }
+    
+    step := float64(chartWidth - 2*chartMargin)
+    if len(samples) > 1 {
+        step /= float64(len(samples) - 1)
+    }
+    points := make([]string, 0, len(samples))
+    for i, v := range samples {
+        points = append(points, fmt.Sprintf("%.1f,%.1f", float64(chartMargin)+float64(i)*step, scaleY(v, top)))
+    }
+    if len(points) > 0 {
+        fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="#3b82f6" stroke-width="2"/>`, strings.Join(points, " "))
+    }
+    svgText(&b, chartWidth/2, chartHeight-chartMargin+16, "middle", "seconds")
+    b.WriteString(`</svg>`)
+    return template.HTML(b.String())
+}
+
+// Each axis is one score dimension as a fraction of its maximum points
+func radarChart(dims []scoreDimension) template.HTML {
+    cx, cy := float64(chartWidth)/2, float64(chartHeight)/2
+    radius := float64(chartHeight)/2 - chartMargin
+    
+    point := func(i int, frac float64) (float64, float64) {
+        angle := 2*math.Pi*float64(i)/float64(len(dims)) - math.Pi/2
+        return cx + radius*frac*math.Cos(angle), cy + radius*frac*math.Sin(angle)
+    }
+    
+    var b strings.Builder
+    svgOpen(&b, "Score radar chart")
+    
+    var grid, shape []string
+    for i, d := range dims {
+        gx, gy := point(i, 1)
+        grid = append(grid, fmt.Sprintf("%.1f,%.1f", gx, gy))
+        fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#ccc"/>`, cx, cy, gx, gy)
+        lx, ly := point(i, 1.15)
+        svgText(&b, lx, ly, "middle", fmt.Sprintf("%s %.1f/%.0f", d.Name, d.Points, d.Max))
+        
+        frac := 0.0
+        if d.Max > 0 {
+            frac = max(0, min(d.Points/d.Max, 1))
+        }
+        sx, sy := point(i, frac)
+        shape = append(shape, fmt.Sprintf("%.1f,%.1f", sx, sy))
+    }
+    fmt.Fprintf(&b, `<polygon points="%s" fill="none" stroke="#ccc"/>`, strings.Join(grid, " "))
+    fmt.Fprintf(&b, `<polygon points="%s" fill="#3b82f6" fill-opacity="0.3" stroke="#3b82f6"/>`, strings.Join(shape, " "))
+    b.WriteString(`</svg>`)
+    return template.HTML(b.String())
+}
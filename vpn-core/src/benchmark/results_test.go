@@ -0,0 +1,1074 @@
+package benchmark
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "io"
+    "math"
+    mrand "math/rand"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+    
+    "golang.org/x/net/html"
+)
+
+func TestTrimmedLatencyDropsExtremes(t *testing.T) {
+    h, err := NewLatencyHistogram(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 198; i++ {
+        h.Record(10)
+    }
+    h.Record(0.01)
+    h.Record(5000)
+    
+    m := h.Metrics(true)
+    if math.Abs(m.AvgMs-10) > 10*histogramRelativeAccuracy || m.StdDevMs > 0.01 {
+        t.Fatalf("trimmed avg %.3f / stddev %.3f, outliers survived trimming", m.AvgMs, m.StdDevMs)
+    }
+    if m.MinMs != 0.01 || m.MaxMs != 5000 {
+        t.Fatalf("min/max = %v/%v, trimming should not affect them", m.MinMs, m.MaxMs)
+    }
+    if untrimmed := h.Metrics(false); untrimmed.AvgMs < 30 {
+        t.Fatalf("untrimmed avg %.2f should include the outlier", untrimmed.AvgMs)
+    }
+}
+
+func TestLatencyHistogramPercentileAccuracy(t *testing.T) {
+    rng := mrand.New(mrand.NewSource(1))
+    h, err := NewLatencyHistogram(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    // Long-tailed, spanning several decades
+    samples := make([]float64, 100000)
+    for i := range samples {
+        samples[i] = 0.2 + rng.ExpFloat64()*4 + math.Pow(rng.Float64(), 20)*500
+        h.Record(samples[i])
+    }
+    sort.Float64s(samples)
+    
+    for _, p := range []float64{1, 25, 50, 90, 95, 99, 99.9, 100} {
+        exact := samples[int(math.Ceil(p/100*float64(len(samples))))-1]
+        got := h.Percentile(p)
+        if math.Abs(got-exact)/exact > 0.01 {
+            t.Errorf("P%v = %.4f, exact %.4f", p, got, exact)
+        }
+    }
+}
+
+func TestLatencyHistogramBuckets(t *testing.T) {
+    h, err := NewLatencyHistogram([]float64{1, 10})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, ms := range []float64{0.5, 1, 5, 10, 10.1, 300} {
+        h.Record(ms)
+    }
+    
+    want := []LatencyBucket{{1, 2}, {10, 2}, {300, 2}}
+    got := h.Buckets()
+    if len(got) != len(want) {
+        t.Fatalf("buckets = %+v, want %+v", got, want)
+    }
+    for i := range want {
+        if got[i] != want[i] {
+            t.Fatalf("buckets = %+v, want %+v", got, want)
+        }
+    }
+}
+
+func TestLatencySamplesMatchSharedHistogram(t *testing.T) {
+    var epoch atomic.Uint64
+    shared, _ := NewLatencyHistogram(nil)
+    merged, _ := NewLatencyHistogram(nil)
+    
+    probes := make([]*latencySamples, latencyProbes)
+    var wg sync.WaitGroup
+    for i := range probes {
+        probes[i] = newLatencySamples(&epoch, 1000)
+        wg.Add(1)
+        go func(id int, samples *latencySamples) {
+            defer wg.Done()
+            for j := 0; j < 1000; j++ {
+                ms := float64(1 + (id*1000+j)%97)
+                samples.add(ms)
+                shared.Record(ms)
+            }
+        }(i, probes[i])
+    }
+    wg.Wait()
+    for _, samples := range probes {
+        if cap(samples.ms) != 1000 {
+            t.Fatalf("buffer grew to %d, it was sized for the run", cap(samples.ms))
+        }
+        merged.RecordAll(samples.ms)
+    }
+    
+    got, want := merged.Metrics(false), shared.Metrics(false)
+    if got.MinMs != want.MinMs || got.MaxMs != want.MaxMs || got.P99Ms != want.P99Ms || math.Abs(got.AvgMs-want.AvgMs) > 1e-9 {
+        t.Fatalf("merged %+v, shared %+v", got, want)
+    }
+    
+    // Warm-up samples go once the epoch moves on
+    samples := probes[0]
+    epoch.Add(1)
+    samples.add(42)
+    if len(samples.ms) != 1 || samples.ms[0] != 42 {
+        t.Fatalf("samples after warm-up %v", samples.ms)
+    }
+}
+
+// Recording from every probe into one histogram against per-probe buffers,
+// as benchmarkLatency does. Only what happens while probing is timed, the
+// buffers are merged once probing stopped.
+func benchmarkLatencyCollection(b *testing.B, perProbe bool) {
+    var epoch atomic.Uint64
+    shared, _ := NewLatencyHistogram(nil)
+    b.SetParallelism(latencyProbes)
+    b.RunParallel(func(pb *testing.PB) {
+        samples := newLatencySamples(&epoch, 1024)
+        ms := 1.0
+        for pb.Next() {
+            ms = ms*1.01 + 0.1
+            if ms > 200 {
+                ms = 1
+            }
+            if !perProbe {
+                shared.Record(ms)
+                continue
+            }
+            if samples.add(ms); len(samples.ms) == cap(samples.ms) {
+                samples.ms = samples.ms[:0]
+            }
+        }
+    })
+}
+
+func BenchmarkLatencyCollectionShared(b *testing.B)   { benchmarkLatencyCollection(b, false) }
+func BenchmarkLatencyCollectionPerProbe(b *testing.B) { benchmarkLatencyCollection(b, true) }
+
+func TestLatencyCollectionAvoidsContention(t *testing.T) {
+    if testing.Short() {
+        t.Skip("runs benchmarks")
+    }
+    shared := testing.Benchmark(BenchmarkLatencyCollectionShared)
+    perProbe := testing.Benchmark(BenchmarkLatencyCollectionPerProbe)
+    t.Logf("shared %d ns/sample, per probe %d ns/sample", shared.NsPerOp(), perProbe.NsPerOp())
+    if perProbe.NsPerOp()*2 > shared.NsPerOp() {
+        t.Fatalf("per-probe collection not cheaper: %v against %v", perProbe, shared)
+    }
+}
+
+func TestConfigureBucketsValidates(t *testing.T) {
+    b := NewVPNBenchmark(nil, BenchmarkOptions{})
+    if err := b.ConfigureBuckets([]float64{1, 5, 5}); err == nil {
+        t.Fatal("repeated boundary accepted")
+    }
+    if err := b.ConfigureBuckets([]float64{-1, 5}); err == nil {
+        t.Fatal("negative boundary accepted")
+    }
+    if err := b.ConfigureBuckets([]float64{0.1, 0.25, 1}); err != nil {
+        t.Fatal(err)
+    }
+    if len(b.latencyBuckets) != 3 {
+        t.Fatalf("boundaries = %v", b.latencyBuckets)
+    }
+}
+
+func TestAggregateThroughputUsesMedian(t *testing.T) {
+    runs := []ThroughputMetrics{
+        {Download: 900, PacketsPerSec: 100},
+        {Download: 100, PacketsPerSec: 300},
+        {Download: 950, PacketsPerSec: 200},
+    }
+    spread := make(map[string]IterationStats)
+    
+    agg := aggregateThroughput(runs, spread)
+    if agg.Download != 900 || agg.PacketsPerSec != 200 {
+        t.Fatalf("aggregate = %+v, want medians 900 Mbps / 200 pps", agg)
+    }
+    
+    st := spread["throughput.download_mbps"]
+    if st.Min != 100 || st.Max != 950 || len(st.Runs) != 3 {
+        t.Fatalf("spread = %+v", st)
+    }
+}
+
+func TestInterfaceMetricsAreRunDeltas(t *testing.T) {
+    before := InterfaceStats{RxPackets: 1000, TxPackets: 1000, RxErrors: 4, TxDropped: 10, CarrierChanges: 2}
+    after := InterfaceStats{RxPackets: 1600, TxPackets: 1380, RxErrors: 6, TxDropped: 30, CarrierChanges: 2}
+    
+    m := interfaceMetrics(before, after)
+    if !m.Supported || m.RxErrors != 2 || m.TxDropped != 20 || m.CarrierChanges != 0 || m.DropPercent != 2 {
+        t.Fatalf("metrics %+v", m)
+    }
+}
+
+func TestRTTProbeFallsBackToSoftwareTimestamps(t *testing.T) {
+    target, stop, err := startEchoResponder(func() time.Duration { return 2 * time.Millisecond })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer stop()
+    
+    // Loopback has no NIC to stamp packets
+    probe, err := newRTTProbe(target, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer probe.Close()
+    
+    for i := 0; i < 3; i++ {
+        rtt, source, err := probe.RoundTrip(time.Second)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if source != TimestampSoftware || rtt < 2*time.Millisecond {
+            t.Fatalf("rtt %v from %s, want at least 2ms from software", rtt, source)
+        }
+    }
+}
+
+func TestAggregateLatencyTimestampSource(t *testing.T) {
+    spread := make(map[string]IterationStats)
+    hw := []LatencyMetrics{{TimestampSource: TimestampHardware}, {TimestampSource: TimestampHardware}}
+    if got := aggregateLatency(hw, spread).TimestampSource; got != TimestampHardware {
+        t.Fatalf("source = %q, want hardware", got)
+    }
+    mixed := append(hw, LatencyMetrics{TimestampSource: TimestampSoftware})
+    if got := aggregateLatency(mixed, spread).TimestampSource; got != TimestampSoftware {
+        t.Fatalf("source = %q, a software run should taint the aggregate", got)
+    }
+}
+
+func TestWriteJSONIncludesIterations(t *testing.T) {
+    results := &BenchmarkResults{}
+    results.Iterations.Spread = make(map[string]IterationStats)
+    results.Iterations.Throughput = []ThroughputMetrics{{Download: 1}, {Download: 3}}
+    results.Throughput = aggregateThroughput(results.Iterations.Throughput, results.Iterations.Spread)
+    
+    var buf bytes.Buffer
+    if err := results.WriteJSON(&buf); err != nil {
+        t.Fatal(err)
+    }
+    
+    var decoded struct {
+        Throughput struct {
+            Download float64 `json:"download_mbps"`
+        } `json:"throughput"`
+        Iterations struct {
+            Throughput []json.RawMessage          `json:"throughput"`
+            Spread     map[string]IterationStats `json:"spread"`
+        } `json:"iterations"`
+    }
+    if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+        t.Fatal(err)
+    }
+    if decoded.Throughput.Download != 2 || len(decoded.Iterations.Throughput) != 2 {
+        t.Fatalf("unexpected export: %s", buf.String())
+    }
+    if _, ok := decoded.Iterations.Spread["throughput.download_mbps"]; !ok {
+        t.Fatal("spread missing from export")
+    }
+}
+
+func sampleResults() *BenchmarkResults {
+    return &BenchmarkResults{
+        Throughput:     ThroughputMetrics{Download: 800, Upload: 600, Bidirectional: 700},
+        Latency:        LatencyMetrics{MinMs: 1, AvgMs: 4, MedianMs: 3, P95Ms: 9, P99Ms: 15, MaxMs: 30},
+        PacketLoss:     0.1,
+        StabilityScore: 0.9,
+        StabilityMbps:  []float64{700, 710, 690, 705},
+        Scalability:    ScalabilityMetrics{LinearScalability: 0.8},
+    }
+}
+
+// Parse the report and index its elements by tag name
+func parseReport(t *testing.T, report string) map[string][]*html.Node {
+    t.Helper()
+    
+    tokens := html.NewTokenizer(strings.NewReader(report))
+    if tokens.Next() != html.DoctypeToken || !strings.EqualFold(string(tokens.Text()), "html") {
+        t.Fatalf("report does not start with the HTML5 doctype")
+    }
+    
+    doc, err := html.Parse(strings.NewReader(report))
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    elements := make(map[string][]*html.Node)
+    var walk func(*html.Node)
+    walk = func(n *html.Node) {
+        if n.Type == html.ElementNode {
+            elements[n.Data] = append(elements[n.Data], n)
+            for _, attr := range n.Attr {
+                if (attr.Key == "src" || attr.Key == "href") && strings.Contains(attr.Val, "//") {
+                    t.Errorf("<%s> references external resource %s", n.Data, attr.Val)
+                }
+            }
+        }
+        for c := n.FirstChild; c != nil; c = c.NextSibling {
+            walk(c)
+        }
+    }
+    walk(doc)
+    return elements
+}
+
+func TestToHTMLIsSelfContained(t *testing.T) {
+    var buf bytes.Buffer
+    if err := sampleResults().ToHTML(&buf); err != nil {
+        t.Fatal(err)
+    }
+    
+    elements := parseReport(t, buf.String())
+    if got := len(elements["svg"]); got != 4 {
+        t.Fatalf("found %d charts, want 4", got)
+    }
+    if len(elements["script"]) != 0 || len(elements["link"]) != 0 {
+        t.Fatal("report should not load scripts or stylesheets")
+    }
+    if len(elements["polyline"]) != 1 {
+        t.Fatal("stability line chart missing")
+    }
+    if strings.Contains(buf.String(), `id="baseline"`) {
+        t.Fatal("baseline section rendered without a baseline")
+    }
+}
+
+func TestToHTMLComparesToBaseline(t *testing.T) {
+    current := sampleResults()
+    baseline := sampleResults()
+    baseline.Throughput.Download = 400
+    baseline.Latency.AvgMs = 2
+    
+    var buf bytes.Buffer
+    if err := current.ToHTMLWithBaseline(&buf, baseline); err != nil {
+        t.Fatal(err)
+    }
+    
+    elements := parseReport(t, buf.String())
+    rows := make(map[string]*html.Node)
+    for _, tr := range elements["tr"] {
+        if td := tr.FirstChild; td != nil && td.Data == "td" {
+            rows[td.FirstChild.Data] = tr
+        }
+    }
+    
+    change := func(name string) (string, string) {
+        tr, ok := rows[name]
+        if !ok {
+            t.Fatalf("no comparison row for %s", name)
+        }
+        td := tr.LastChild
+        for td != nil && td.Type != html.ElementNode {
+            td = td.PrevSibling
+        }
+        var class string
+        for _, attr := range td.Attr {
+            if attr.Key == "class" {
+                class = attr.Val
+            }
+        }
+        return td.FirstChild.Data, class
+    }
+    
+    // Doubled throughput is an improvement, doubled latency a regression
+    if text, class := change("Download (Mbps)"); text != "+100.0%" || class != "better" {
+        t.Fatalf("download change = %q (%s)", text, class)
+    }
+    if text, class := change("Avg latency (ms)"); text != "+100.0%" || class != "worse" {
+        t.Fatalf("latency change = %q (%s)", text, class)
+    }
+}
+
+func TestDefaultProfileMatchesFixedWeights(t *testing.T) {
+    r := sampleResults()
+    
+    // The weights and thresholds used before scoring was configurable
+    want := min(r.Throughput.Bidirectional/1000, 1.0)*30 +
+        max(0, (50-r.Latency.AvgMs)/50)*25 +
+        r.StabilityScore*20 +
+        r.Scalability.LinearScalability*15 +
+        max(0, (1-r.PacketLoss/100))*10
+    if got := r.calculateOverallScore(); math.Abs(got-want) > 1e-9 {
+        t.Fatalf("score = %v, want %v", got, want)
+    }
+}
+
+func TestScoringProfilesWeighDifferently(t *testing.T) {
+    // Slow but steady: a good mobile link, a poor datacenter one
+    r := sampleResults()
+    r.Throughput.Bidirectional = 60
+    r.StabilityScore = 1
+    r.Encryption.HandshakesPerSec = 1000
+    
+    r.Scoring = DatacenterProfile()
+    datacenter := r.calculateOverallScore()
+    r.Scoring = MobileProfile()
+    mobile := r.calculateOverallScore()
+    
+    if mobile <= datacenter {
+        t.Fatalf("mobile score %.1f should beat datacenter score %.1f", mobile, datacenter)
+    }
+    if mobile > 100 {
+        t.Fatalf("score %.1f exceeds 100", mobile)
+    }
+}
+
+func TestGradeComesFromProfile(t *testing.T) {
+    r := sampleResults()
+    r.Scoring = DatacenterProfile()
+    r.Scoring.Grades = []GradeBand{{50, "pass"}, {0, "fail"}}
+    
+    if got := r.getGrade(r.calculateOverallScore()); got != "pass" {
+        t.Fatalf("grade = %q, want pass", got)
+    }
+    if got := r.getGrade(10); got != "fail" {
+        t.Fatalf("grade = %q, want fail", got)
+    }
+}
+
+func TestScoringProfileValidate(t *testing.T) {
+    for _, p := range []ScoringProfile{DatacenterProfile(), MobileProfile(), StreamingProfile()} {
+        if err := p.Validate(); err != nil {
+            t.Fatalf("preset %s: %v", p.Name, err)
+        }
+    }
+    
+    bad := DatacenterProfile()
+    bad.Metrics[0].Metric = "connect_time_ms"
+    if err := bad.Validate(); err == nil {
+        t.Fatal("unknown metric accepted")
+    }
+}
+
+func TestCompareAgainstRefusesDifferentProfiles(t *testing.T) {
+    current := sampleResults()
+    current.Scoring = MobileProfile()
+    baseline := sampleResults()
+    baseline.Scoring = StreamingProfile()
+    
+    if _, err := current.CompareAgainst(baseline); !errors.Is(err, ErrProfileMismatch) {
+        t.Fatalf("err = %v, want ErrProfileMismatch", err)
+    }
+    if err := current.ToHTMLWithBaseline(&bytes.Buffer{}, baseline); !errors.Is(err, ErrProfileMismatch) {
+        t.Fatalf("report err = %v, want ErrProfileMismatch", err)
+    }
+    
+    // A tweaked weight is a different rubric even under the same name
+    baseline.Scoring = MobileProfile()
+    baseline.Scoring.Metrics[0].Weight++
+    if _, err := current.CompareAgainst(baseline); !errors.Is(err, ErrProfileMismatch) {
+        t.Fatalf("err = %v, want ErrProfileMismatch", err)
+    }
+    
+    baseline.Scoring = MobileProfile()
+    comparison, err := current.CompareAgainst(baseline)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(comparison) == 0 {
+        t.Fatal("empty comparison")
+    }
+}
+
+func TestWriteJSONIncludesScoringProfile(t *testing.T) {
+    r := sampleResults()
+    r.Scoring = StreamingProfile()
+    
+    var buf bytes.Buffer
+    if err := r.WriteJSON(&buf); err != nil {
+        t.Fatal(err)
+    }
+    
+    var decoded BenchmarkResults
+    if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+        t.Fatal(err)
+    }
+    if decoded.Scoring.Name != "streaming" || len(decoded.Scoring.Metrics) != len(r.Scoring.Metrics) {
+        t.Fatalf("scoring profile lost in export: %+v", decoded.Scoring)
+    }
+    if _, err := decoded.CompareAgainst(r); err != nil {
+        t.Fatalf("round-tripped profile no longer matches: %v", err)
+    }
+}
+
+func TestDatapathMetricsDropPercent(t *testing.T) {
+    m := datapathMetrics(QueueStats{Depth: 1024, HighWatermark: 1088, Enqueued: 900, DroppedBulk: 100})
+    if m.DropPercent != 10 || m.QueueDepth != 1024 || m.HighWatermark != 1088 {
+        t.Fatalf("metrics = %+v", m)
+    }
+    if m := datapathMetrics(QueueStats{}); m.DropPercent != 0 {
+        t.Fatalf("idle queue reports %.1f%% drops", m.DropPercent)
+    }
+}
+
+func TestSizeSamplerMatchesDistribution(t *testing.T) {
+    mix := IMIXDistribution()
+    if err := mix.Validate(); err != nil {
+        t.Fatal(err)
+    }
+    sampler := newSizeSampler(mix)
+    
+    const draws = 200000
+    counts := make(map[int]int)
+    for i := 0; i < draws; i++ {
+        counts[sampler.draw()]++
+    }
+    for _, w := range mix.Sizes {
+        want := w.Weight / 12
+        got := float64(counts[w.Size]) / draws
+        if math.Abs(got-want) > 0.01 {
+            t.Errorf("size %d drawn %.3f of the time, want %.3f", w.Size, got, want)
+        }
+    }
+    if len(counts) != len(mix.Sizes) {
+        t.Errorf("drew sizes outside the distribution: %v", counts)
+    }
+}
+
+func TestGeneratedTrafficFollowsSizeMix(t *testing.T) {
+    b := NewVPNBenchmark(nil, BenchmarkOptions{PacketSizes: IMIXDistribution()})
+    stopCh := make(chan struct{})
+    done := make(chan struct{})
+    go func() {
+        b.generateTraffic(0, "upload", stopCh)
+        close(done)
+    }()
+    for deadline := time.Now().Add(5 * time.Second); b.txPackets.Load() < 2000 && time.Now().Before(deadline); {
+        time.Sleep(10 * time.Millisecond)
+    }
+    close(stopCh)
+    <-done
+    
+    packets := b.txPackets.Load()
+    if packets < 2000 {
+        t.Fatalf("only %d packets generated", packets)
+    }
+    avg := float64(b.txBytes.Load()) / float64(packets)
+    if want := IMIXDistribution().MeanSize(); math.Abs(avg-want)/want > 0.15 {
+        t.Fatalf("average packet %.0f bytes, want about %.0f", avg, want)
+    }
+}
+
+func TestGeneratedTrafficSplitsAddressFamilies(t *testing.T) {
+    b := NewVPNBenchmark(nil, BenchmarkOptions{})
+    stopCh := make(chan struct{})
+    done := make(chan struct{})
+    for client := 0; client < 2; client++ {
+        go func(id int) {
+            b.generateTraffic(id, "download", stopCh)
+            done <- struct{}{}
+        }(client)
+    }
+    for deadline := time.Now().Add(5 * time.Second); b.txPackets.Load() < 1000 && time.Now().Before(deadline); {
+        time.Sleep(10 * time.Millisecond)
+    }
+    close(stopCh)
+    <-done
+    <-done
+    
+    v4, v6 := b.ipv4Bytes.Load(), b.ipv6Bytes.Load()
+    if v4 == 0 || v6 == 0 {
+        t.Fatalf("IPv4 %d bytes, IPv6 %d bytes, want both families", v4, v6)
+    }
+    if total := b.txBytes.Load() + b.rxBytes.Load(); v4+v6 != total {
+        t.Fatalf("families add up to %d bytes of %d", v4+v6, total)
+    }
+}
+
+func TestTestPeersAreDualStack(t *testing.T) {
+    _, ula, _ := net.ParseCIDR("fd00::/8")
+    seen := make(map[string]bool)
+    for n := 0; n < 2000; n++ {
+        endpoint := generateTestEndpoint(n)
+        if (endpoint.IP.To4() == nil) != isIPv6Client(n) {
+            t.Fatalf("peer %d endpoint %s has the wrong family", n, endpoint)
+        }
+        
+        prefix := generateTestIPv4Prefix(n)
+        if isIPv6Client(n) {
+            prefix = generateTestIPv6Prefix()
+            if ones, bits := prefix.Mask.Size(); ones != 64 || bits != 128 || !ula.Contains(prefix.IP) {
+                t.Fatalf("IPv6 prefix %s", prefix.String())
+            }
+        } else if ones, bits := prefix.Mask.Size(); ones != 24 || bits != 32 || len(prefix.IP) != net.IPv4len {
+            t.Fatalf("IPv4 prefix %s", prefix.String())
+        }
+        if seen[prefix.String()] {
+            t.Fatalf("prefix %s generated twice", prefix.String())
+        }
+        seen[prefix.String()] = true
+    }
+}
+
+func TestPacketSizeDistributionValidate(t *testing.T) {
+    for _, bad := range []PacketSizeDistribution{
+        {},
+        {Sizes: []PacketSizeWeight{{Size: 0, Weight: 1}}},
+        {Sizes: []PacketSizeWeight{{Size: 64, Weight: 0}}},
+    } {
+        if err := bad.Validate(); !errors.Is(err, ErrBadSizeDistribution) {
+            t.Errorf("Validate(%+v) = %v", bad, err)
+        }
+    }
+    if got := FixedPacketSize(1420).MeanSize(); got != 1420 {
+        t.Errorf("fixed mean = %v", got)
+    }
+}
+
+func TestPushMetricsToPushgateway(t *testing.T) {
+    var method, path, auth, body string
+    gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        method, path, auth = req.Method, req.URL.Path, req.Header.Get("Authorization")
+        b, _ := io.ReadAll(req.Body)
+        body = string(b)
+        w.WriteHeader(http.StatusOK)
+    }))
+    defer gateway.Close()
+    
+    r := sampleResults()
+    r.Score = 87.5
+    if err := r.PushMetrics(gateway.URL, "ci-bench", WithInstance("runner-1"), WithBearerToken("s3cret")); err != nil {
+        t.Fatal(err)
+    }
+    if method != http.MethodPut || path != "/metrics/job/ci-bench/instance/runner-1" {
+        t.Fatalf("%s %s", method, path)
+    }
+    if auth != "Bearer s3cret" {
+        t.Fatalf("Authorization = %q", auth)
+    }
+    for _, want := range []string{
+        "utr_benchmark_download_mbps", "utr_benchmark_upload_mbps", "utr_benchmark_bidirectional_mbps",
+        "utr_benchmark_latency_p99_ms", "utr_benchmark_packet_loss_percent", "utr_benchmark_score",
+    } {
+        if !strings.Contains(body, want) {
+            t.Errorf("pushed body lacks %s", want)
+        }
+    }
+    
+    if err := r.PushMetrics(gateway.URL, "ci-bench", WithInstance("runner-1"), WithBasicAuth("ci", "pw")); err != nil {
+        t.Fatal(err)
+    }
+    if user, pass, ok := (&http.Request{Header: http.Header{"Authorization": {auth}}}).BasicAuth(); !ok || user != "ci" || pass != "pw" {
+        t.Fatalf("Authorization = %q", auth)
+    }
+}
+
+func TestPushMetricsReportsGatewayErrors(t *testing.T) {
+    gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        http.Error(w, "denied", http.StatusUnauthorized)
+    }))
+    defer gateway.Close()
+    
+    err := sampleResults().PushMetrics(gateway.URL, "ci-bench", WithInstance("runner-1"))
+    if err == nil || !strings.Contains(err.Error(), "401") {
+        t.Fatalf("err = %v, want the 401 reported", err)
+    }
+}
+
+// Run phase while advancing clock by step, so its waits pass at once
+func runOnClock(clock *FakeClock, step time.Duration, phase func()) {
+    done := make(chan struct{})
+    go func() {
+        phase()
+        close(done)
+    }()
+    for {
+        select {
+        case <-done:
+            return
+        case <-time.After(time.Millisecond):
+            clock.Advance(step)
+        }
+    }
+}
+
+func TestStabilitySamplesEverySecondOfClock(t *testing.T) {
+    clock := NewFakeClock(time.Now())
+    b := NewVPNBenchmark(nil, BenchmarkOptions{Duration: time.Minute, Clock: clock})
+    
+    start := time.Now()
+    var samples []float64
+    var err error
+    runOnClock(clock, time.Second, func() { _, samples, err = b.benchmarkStability(context.Background()) })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(samples) != 60 {
+        t.Fatalf("%d samples over a minute, want 60", len(samples))
+    }
+    if took := time.Since(start); took > 10*time.Second {
+        t.Fatalf("stability phase took %v of real time", took)
+    }
+}
+
+type fakeEBPF struct {
+    calls     []string
+    attachErr error
+}
+
+func (f *fakeEBPF) DetachEBPF() { f.calls = append(f.calls, "detach") }
+
+func (f *fakeEBPF) AttachEBPF() error {
+    f.calls = append(f.calls, "attach")
+    return f.attachErr
+}
+
+func TestBaselineRunsWithEBPFDetached(t *testing.T) {
+    control := &fakeEBPF{}
+    clock := NewFakeClock(time.Now())
+    b := NewVPNBenchmark(nil, BenchmarkOptions{EBPF: control, Duration: time.Minute, WarmupDuration: -1, Iterations: 1, Clients: 2, Clock: clock})
+    
+    var throughput ThroughputMetrics
+    var err error
+    runOnClock(clock, time.Minute, func() { throughput, _, err = b.benchmarkBaseline(context.Background()) })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(control.calls) != 2 || control.calls[0] != "detach" || control.calls[1] != "attach" {
+        t.Fatalf("calls = %v, want detach then attach", control.calls)
+    }
+    if throughput.Bidirectional == 0 {
+        t.Fatal("no baseline throughput measured")
+    }
+    
+    control.calls, control.attachErr = nil, errors.New("link busy")
+    runOnClock(clock, time.Minute, func() { _, _, err = b.benchmarkBaseline(context.Background()) })
+    if err == nil || !errors.Is(err, control.attachErr) {
+        t.Fatalf("err = %v, want the attach failure", err)
+    }
+}
+
+func TestEBPFOverheadFormula(t *testing.T) {
+    b := NewVPNBenchmark(nil, BenchmarkOptions{})
+    base := ThroughputMetrics{Bidirectional: 1000}
+    baseLatency := LatencyMetrics{AvgMs: 2.0}
+    
+    got := b.ebpfOverhead(base, baseLatency, ThroughputMetrics{Bidirectional: 970}, LatencyMetrics{AvgMs: 2.05})
+    if math.Abs(got.ThroughputPenaltyPercent-3) > 1e-9 || math.Abs(got.LatencyAddedMs-0.05) > 1e-9 {
+        t.Fatalf("overhead = %+v", got)
+    }
+    if got.Exceeded || got.BaselineMbps != 1000 || got.BaselineLatencyMs != 2.0 {
+        t.Fatalf("overhead = %+v, want within the defaults", got)
+    }
+    
+    // Either figure past its threshold is enough
+    if got := b.ebpfOverhead(base, baseLatency, ThroughputMetrics{Bidirectional: 940}, baseLatency); !got.Exceeded {
+        t.Fatalf("6%% penalty not flagged: %+v", got)
+    }
+    if got := b.ebpfOverhead(base, baseLatency, base, LatencyMetrics{AvgMs: 2.2}); !got.Exceeded {
+        t.Fatalf("0.2 ms added not flagged: %+v", got)
+    }
+    
+    strict := NewVPNBenchmark(nil, BenchmarkOptions{MaxEBPFThroughputPenalty: 1})
+    if got := strict.ebpfOverhead(base, baseLatency, ThroughputMetrics{Bidirectional: 970}, baseLatency); !got.Exceeded {
+        t.Fatalf("custom threshold ignored: %+v", got)
+    }
+}
+
+// Throughput alternating 101/99 Mbps, one noisy run at index 11 and a
+// sustained drop to 98 from index 21
+func throughputSeries() []BenchmarkResults {
+    history := make([]BenchmarkResults, 27)
+    for i := range history {
+        mbps := 101.0
+        if i%2 == 1 {
+            mbps = 99
+        }
+        switch {
+        case i == 11:
+            mbps = 95
+        case i >= 21:
+            mbps = 98
+        }
+        history[i].Throughput = ThroughputMetrics{Download: 800, Upload: 600, Bidirectional: mbps}
+    }
+    return history
+}
+
+func TestCUSUMDetectsThroughputStepChange(t *testing.T) {
+    b := NewVPNBenchmark(nil, BenchmarkOptions{})
+    b.LoadHistory(throughputSeries())
+    signals, err := b.AnalyzeRegression()
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    // The 2σ drop takes four runs to add up past 5σ, the 4σ outlier never does
+    if len(signals) != 1 {
+        t.Fatalf("signals = %+v", signals)
+    }
+    s := signals[0]
+    if s.Metric != "Bidirectional (Mbps)" || s.Index != 24 || s.ChangeIndex != 21 {
+        t.Fatalf("signal %+v, want Bidirectional at 24 from 21", s)
+    }
+    if s.Mean != 100 || s.Value != 98 || s.CUSUM <= defaultRegressionThreshold {
+        t.Fatalf("signal %+v", s)
+    }
+    
+    // A tighter chart catches the outlier too
+    b = NewVPNBenchmark(nil, BenchmarkOptions{RegressionThreshold: 4})
+    b.LoadHistory(throughputSeries())
+    signals, err = b.AnalyzeRegression()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(signals) == 0 || signals[0].Index != 11 || signals[0].ChangeIndex != 11 {
+        t.Fatalf("threshold 4: %+v", signals)
+    }
+}
+
+func TestAnalyzeRegressionNeedsHistory(t *testing.T) {
+    b := NewVPNBenchmark(nil, BenchmarkOptions{})
+    b.LoadHistory(throughputSeries()[:defaultRegressionBaselineRuns])
+    if _, err := b.AnalyzeRegression(); !errors.Is(err, ErrShortHistory) {
+        t.Fatalf("err = %v, want ErrShortHistory", err)
+    }
+}
+
+func TestRekeyReplacesTransportKeys(t *testing.T) {
+    session, err := newNoiseSession()
+    if err != nil {
+        t.Fatal(err)
+    }
+    stale := session.initSide.seal([]byte("before"))
+    if got, err := session.respSide.open(stale); err != nil || string(got) != "before" {
+        t.Fatalf("opened %q, %v", got, err)
+    }
+    
+    if err := session.rekey(); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := session.respSide.open(stale); err == nil {
+        t.Fatal("packet of the old keys opened after rekey")
+    }
+    reply := session.respSide.seal([]byte("after"))
+    if got, err := session.initSide.open(reply); err != nil || string(got) != "after" {
+        t.Fatalf("opened %q, %v", got, err)
+    }
+    
+    if avg, err := benchmarkRekey(context.Background(), 10); err != nil || avg <= 0 {
+        t.Fatalf("rekey took %v, %v", avg, err)
+    }
+}
+
+// Counter growing by steps, one per adaptive window
+func windowCounter(steps []uint64) func() uint64 {
+    var total uint64
+    calls := 0
+    return func() uint64 {
+        if calls > 0 && calls <= len(steps) {
+            total += steps[calls-1]
+        }
+        calls++
+        return total
+    }
+}
+
+func TestAdaptiveDurationStopsOnceSteady(t *testing.T) {
+    clock := NewFakeClock(time.Now())
+    a := AdaptiveDuration{MinDuration: time.Second, MaxDuration: time.Minute}.withDefaults()
+    // Noisy for four windows, then within a percent
+    counter := windowCounter([]uint64{100, 300, 50, 250, 200, 201, 199, 200, 200, 200})
+    
+    var elapsed time.Duration
+    var rates []float64
+    var err error
+    runOnClock(clock, time.Second, func() { elapsed, rates, err = a.measure(context.Background(), clock, counter) })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if elapsed != 7*time.Second || len(rates) != 7 {
+        t.Fatalf("measured %v over %d windows, want 7s", elapsed, len(rates))
+    }
+    if rates[6] != 199 {
+        t.Fatalf("rates %v", rates)
+    }
+}
+
+func TestAdaptiveDurationGivesUpAtMax(t *testing.T) {
+    clock := NewFakeClock(time.Now())
+    a := AdaptiveDuration{MinDuration: 3 * time.Second, MaxDuration: 10 * time.Second, TargetCV: 0.02}
+    counter := windowCounter([]uint64{300, 900, 300, 100})
+    
+    var elapsed time.Duration
+    var rates []float64
+    var err error
+    runOnClock(clock, time.Second, func() { elapsed, rates, err = a.measure(context.Background(), clock, counter) })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if elapsed != 10*time.Second || len(rates) != 4 {
+        t.Fatalf("measured %v over %d windows, want the 10s maximum", elapsed, len(rates))
+    }
+    // The last window is cut to what's left
+    if rates[3] != 100 {
+        t.Fatalf("last window rate %v, want 100/s", rates[3])
+    }
+}
+
+func TestCancelInterruptsAdaptiveMeasure(t *testing.T) {
+    // The clock never moves, only cancelling ends the measurement
+    clock := NewFakeClock(time.Now())
+    a := AdaptiveDuration{MinDuration: time.Second, MaxDuration: time.Minute}.withDefaults()
+    
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan error, 1)
+    go func() {
+        _, _, err := a.measure(ctx, clock, func() uint64 { return 0 })
+        done <- err
+    }()
+    
+    cancel()
+    select {
+    case err := <-done:
+        if !errors.Is(err, context.Canceled) {
+            t.Fatalf("err = %v, want context.Canceled", err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("measure still running after cancel")
+    }
+}
+
+func TestAdaptiveThroughputRecordsActualDuration(t *testing.T) {
+    clock := NewFakeClock(time.Now())
+    b := NewVPNBenchmark(nil, BenchmarkOptions{
+        Duration:            time.Minute,
+        WarmupDuration:      -1,
+        Clients:             2,
+        Clock:               clock,
+        UseAdaptiveDuration: true,
+        AdaptiveConfig:      AdaptiveDuration{MinDuration: time.Second, MaxDuration: 5 * time.Second},
+    })
+    if b.adaptiveConfig.TargetCV != defaultAdaptiveTargetCV {
+        t.Fatalf("target CV %v, want the default", b.adaptiveConfig.TargetCV)
+    }
+    
+    var throughput ThroughputMetrics
+    var err error
+    runOnClock(clock, time.Second, func() { throughput, err = b.benchmarkThroughput(context.Background()) })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if throughput.Bidirectional == 0 {
+        t.Fatal("no throughput measured")
+    }
+    if b.measuredPhases != 3 || b.measuredTime < 3*3*time.Second || b.measuredTime > 3*5*time.Second {
+        t.Fatalf("%d phases measured for %v, want 3 of 3s to 5s", b.measuredPhases, b.measuredTime)
+    }
+}
+
+// XORs packets, padding them to padTo bytes and holding them up to
+// maxDelay when either is set
+type fakeShapingCodec struct {
+    padTo    int
+    maxDelay time.Duration
+    payload  int
+    padding  int
+}
+
+func (c *fakeShapingCodec) ObfuscatePacket(data []byte) []byte {
+    size := len(data)
+    if c.padTo > size {
+        size = c.padTo
+    }
+    out := make([]byte, 2+size)
+    out[0], out[1] = byte(len(data)>>8), byte(len(data))
+    for i, v := range data {
+        out[2+i] = v ^ 0x5a
+    }
+    c.payload += len(data)
+    c.padding += len(out) - len(data)
+    return out
+}
+
+func (c *fakeShapingCodec) DeobfuscatePacket(data []byte) ([]byte, error) {
+    if len(data) < 2 {
+        return nil, errors.New("short packet")
+    }
+    n := int(data[0])<<8 | int(data[1])
+    if n > len(data)-2 {
+        return nil, errors.New("bad length")
+    }
+    out := make([]byte, n)
+    for i := range out {
+        out[i] = data[2+i] ^ 0x5a
+    }
+    return out, nil
+}
+
+func (c *fakeShapingCodec) ShapingDelay(packet []byte) time.Duration {
+    if c.maxDelay <= 0 {
+        return 0
+    }
+    return time.Duration(mrand.Int63n(int64(c.maxDelay)))
+}
+
+func (c *fakeShapingCodec) OverheadPercent() float64 {
+    if c.payload == 0 {
+        return 0
+    }
+    return float64(c.padding) / float64(c.payload) * 100
+}
+
+func TestShapingPhaseMeasuresCost(t *testing.T) {
+    b := NewVPNBenchmark(nil, BenchmarkOptions{Shaping: &ShapingCodecs{
+        Plain:  &fakeShapingCodec{},
+        Shaped: &fakeShapingCodec{padTo: 1500, maxDelay: 10 * time.Millisecond},
+    }})
+    metrics, err := b.benchmarkShaping(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if metrics.AvgDelayMs <= 0 || metrics.AvgDelayMs > 10 {
+        t.Fatalf("average delay %v ms, want within the 10 ms bound", metrics.AvgDelayMs)
+    }
+    if metrics.OverheadPercent <= 0 || metrics.LatencyAddedMs < metrics.AvgDelayMs-0.1 {
+        t.Fatalf("metrics %+v", metrics)
+    }
+}
+
+func TestCancelInterruptsThroughputPhase(t *testing.T) {
+    // The clock never moves, only cancelling ends the phase
+    clock := NewFakeClock(time.Now())
+    b := NewVPNBenchmark(nil, BenchmarkOptions{Duration: time.Hour, WarmupDuration: -1, Clients: 2, Clock: clock})
+    
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan error, 1)
+    go func() {
+        _, err := b.benchmarkThroughput(ctx)
+        done <- err
+    }()
+    
+    time.Sleep(50 * time.Millisecond)
+    if b.txBytes.Load() == 0 {
+        t.Fatal("no upload traffic while measuring")
+    }
+    cancel()
+    select {
+    case err := <-done:
+        if !errors.Is(err, context.Canceled) {
+            t.Fatalf("err = %v, want context.Canceled", err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("throughput phase still running after cancel")
+    }
+    if b.measuredPhases != 0 {
+        t.Fatalf("%d phases recorded as measured", b.measuredPhases)
+    }
+}
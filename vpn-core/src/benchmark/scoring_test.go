@@ -0,0 +1,275 @@
+package benchmark
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "reflect"
+)
+
+// Metric names a ScoreMetric can refer to
+const (
+    MetricThroughput  = "throughput_mbps"     // bidirectional
+    MetricLatencyAvg  = "latency_avg_ms"
+    MetricLatencyP99  = "latency_p99_ms"
+    MetricJitter      = "jitter_ms"           // latency standard deviation
+    MetricStability   = "stability"           // 0.0 - 1.0
+    MetricScalability = "scalability"         // 0.0 - 1.0
+    MetricPacketLoss  = "packet_loss_percent"
+    MetricHandshakes  = "handshakes_per_sec"  // connect time
+)
+
+var metricValues = map[string]func(*BenchmarkResults) float64{
+    MetricThroughput:  func(r *BenchmarkResults) float64 { return r.Throughput.Bidirectional },
+    MetricLatencyAvg:  func(r *BenchmarkResults) float64 { return r.Latency.AvgMs },
+    MetricLatencyP99:  func(r *BenchmarkResults) float64 { return r.Latency.P99Ms },
+    MetricJitter:      func(r *BenchmarkResults) float64 { return r.Latency.StdDevMs },
+    MetricStability:   func(r *BenchmarkResults) float64 { return r.StabilityScore },
+    MetricScalability: func(r *BenchmarkResults) float64 { return r.Scalability.LinearScalability },
+    MetricPacketLoss:  func(r *BenchmarkResults) float64 { return r.PacketLoss },
+    MetricHandshakes:  func(r *BenchmarkResults) float64 { return r.Encryption.HandshakesPerSec },
+}
+
+var ErrProfileMismatch = errors.New("results were scored with different profiles")
+
+// ScoringProfile is the rubric turning measurements into a 0-100 score
+// and a grade
+type ScoringProfile struct {
+    Name    string        `json:"name"`
+    Metrics []ScoreMetric `json:"metrics"`
+    Grades  []GradeBand   `json:"grades"` // highest threshold first
+}
+
+// ScoreMetric awards up to Weight points for one measurement
+type ScoreMetric struct {
+    Metric string     `json:"metric"`
+    Label  string     `json:"label"`
+    Weight float64    `json:"weight"`
+    Curve  ScoreCurve `json:"curve"`
+}
+
+// ScoreCurve maps a measurement onto 0..1. Values at Zero or beyond score
+// nothing, values at Full or beyond score full marks; Full may be below
+// Zero for metrics where lower is better. Exponent shapes the curve in
+// between, 1 (or 0) is linear.
+type ScoreCurve struct {
+    Zero     float64 `json:"zero"`
+    Full     float64 `json:"full"`
+    Exponent float64 `json:"exponent,omitempty"`
+}
+
+// GradeBand assigns Grade to scores of at least Min
+type GradeBand struct {
+    Min   float64 `json:"min"`
+    Grade string  `json:"grade"`
+}
+
+func (c ScoreCurve) fraction(v float64) float64 {
+    frac := (v - c.Zero) / (c.Full - c.Zero)
+    frac = max(0, min(frac, 1))
+    if c.Exponent > 0 && c.Exponent != 1 {
+        frac = math.Pow(frac, c.Exponent)
+    }
+    return frac
+}
+
+func defaultGrades() []GradeBand {
+    return []GradeBand{
+        {95, "A+ (World-class)"},
+        {90, "A (Excellent)"},
+        {85, "A- (Very Good)"},
+        {80, "B+ (Good)"},
+        {75, "B (Above Average)"},
+        {70, "B- (Average)"},
+        {65, "C+ (Below Average)"},
+        {60, "C (Poor)"},
+        {0, "F (Unacceptable)"},
+    }
+}
+
+// DatacenterProfile favours raw throughput and scalability. It is the
+// default and matches the original fixed weights.
+func DatacenterProfile() ScoringProfile {
+    return ScoringProfile{
+        Name: "datacenter",
+        Metrics: []ScoreMetric{
+            {MetricThroughput, "Throughput", 30, ScoreCurve{Zero: 0, Full: 1000}},
+            {MetricLatencyAvg, "Latency", 25, ScoreCurve{Zero: 50, Full: 0}},
+            {MetricStability, "Stability", 20, ScoreCurve{Zero: 0, Full: 1}},
+            {MetricScalability, "Scalability", 15, ScoreCurve{Zero: 0, Full: 1}},
+            {MetricPacketLoss, "Packet loss", 10, ScoreCurve{Zero: 100, Full: 0}},
+        },
+        Grades: defaultGrades(),
+    }
+}
+
+// MobileProfile favours connect time and stability over raw throughput
+func MobileProfile() ScoringProfile {
+    return ScoringProfile{
+        Name: "mobile",
+        Metrics: []ScoreMetric{
+            {MetricStability, "Stability", 30, ScoreCurve{Zero: 0, Full: 1, Exponent: 2}},
+            {MetricHandshakes, "Connect time", 25, ScoreCurve{Zero: 0, Full: 500}},
+            {MetricLatencyP99, "P99 latency", 20, ScoreCurve{Zero: 300, Full: 30}},
+            {MetricPacketLoss, "Packet loss", 15, ScoreCurve{Zero: 5, Full: 0}},
+            {MetricThroughput, "Throughput", 10, ScoreCurve{Zero: 0, Full: 50}},
+        },
+        Grades: defaultGrades(),
+    }
+}
+
+// StreamingProfile favours sustained throughput and smooth delivery
+func StreamingProfile() ScoringProfile {
+    return ScoringProfile{
+        Name: "streaming",
+        Metrics: []ScoreMetric{
+            {MetricThroughput, "Throughput", 30, ScoreCurve{Zero: 0, Full: 100}},
+            {MetricStability, "Stability", 25, ScoreCurve{Zero: 0, Full: 1}},
+            {MetricJitter, "Jitter", 20, ScoreCurve{Zero: 30, Full: 0}},
+            {MetricPacketLoss, "Packet loss", 15, ScoreCurve{Zero: 2, Full: 0}},
+            {MetricLatencyAvg, "Latency", 10, ScoreCurve{Zero: 200, Full: 0}},
+        },
+        Grades: defaultGrades(),
+    }
+}
+
+// Validate checks the profile can produce a score
+func (p ScoringProfile) Validate() error {
+    if len(p.Metrics) == 0 {
+        return fmt.Errorf("scoring profile %q has no metrics", p.Name)
+    }
+    for _, m := range p.Metrics {
+        if _, ok := metricValues[m.Metric]; !ok {
+            return fmt.Errorf("scoring profile %q: unknown metric %q", p.Name, m.Metric)
+        }
+        if m.Weight <= 0 {
+            return fmt.Errorf("scoring profile %q: metric %s needs a positive weight", p.Name, m.Metric)
+        }
+        if m.Curve.Zero == m.Curve.Full {
+            return fmt.Errorf("scoring profile %q: metric %s has a flat curve", p.Name, m.Metric)
+        }
+    }
+    if len(p.Grades) == 0 {
+        return fmt.Errorf("scoring profile %q has no grades", p.Name)
+    }
+    return nil
+}
+
+func (p ScoringProfile) isZero() bool {
+    return p.Name == "" && len(p.Metrics) == 0 && len(p.Grades) == 0
+}
+
+// Results built by hand or decoded from older exports carry no profile
+func (r *BenchmarkResults) profile() ScoringProfile {
+    if r.Scoring.isZero() {
+        return DatacenterProfile()
+    }
+    return r.Scoring
+}
+
+// scoreDimension is one component of the overall score
+type scoreDimension struct {
+    Name   string
+    Points float64
+    Max    float64
+}
+
+func (r *BenchmarkResults) scoreDimensions() []scoreDimension {
+    profile := r.profile()
+    dims := make([]scoreDimension, 0, len(profile.Metrics))
+    for _, m := range profile.Metrics {
+        value, ok := metricValues[m.Metric]
+        if !ok {
+            continue
+        }
+        label := m.Label
+        if label == "" {
+            label = m.Metric
+        }
+        dims = append(dims, scoreDimension{label, m.Curve.fraction(value(r)) * m.Weight, m.Weight})
+    }
+    return dims
+}
+
+// Points earned as a share of the points available, 0-100
+func (r *BenchmarkResults) calculateOverallScore() float64 {
+    var points, total float64
+    for _, d := range r.scoreDimensions() {
+        points += d.Points
+        total += d.Max
+    }
+    if total == 0 {
+        return 0
+    }
+    return points / total * 100
+}
+
+func (r *BenchmarkResults) getGrade(score float64) string {
+    grades := r.profile().Grades
+    for _, band := range grades {
+        if score >= band.Min {
+            return band.Grade
+        }
+    }
+    if len(grades) == 0 {
+        return ""
+    }
+    return grades[len(grades)-1].Grade
+}
+
+// MetricComparison is one figure of a results comparison
+type MetricComparison struct {
+    Name          string   `json:"name"`
+    Baseline      float64  `json:"baseline"`
+    Current       float64  `json:"current"`
+    ChangePercent *float64 `json:"change_percent,omitempty"` // nil when the baseline is zero
+    Improved      bool     `json:"improved"`
+}
+
+// One entry per compared figure; higherBetter decides whether a change is
+// an improvement
+type comparedMetric struct {
+    name         string
+    higherBetter bool
+    get          func(*BenchmarkResults) float64
+}
+
+var comparedMetrics = []comparedMetric{
+    {"Download (Mbps)", true, func(r *BenchmarkResults) float64 { return r.Throughput.Download }},
+    {"Upload (Mbps)", true, func(r *BenchmarkResults) float64 { return r.Throughput.Upload }},
+    {"Bidirectional (Mbps)", true, func(r *BenchmarkResults) float64 { return r.Throughput.Bidirectional }},
+    {"IPv4 (Mbps)", true, func(r *BenchmarkResults) float64 { return r.Throughput.IPv4Mbps }},
+    {"IPv6 (Mbps)", true, func(r *BenchmarkResults) float64 { return r.Throughput.IPv6Mbps }},
+    {"Avg latency (ms)", false, func(r *BenchmarkResults) float64 { return r.Latency.AvgMs }},
+    {"P99 latency (ms)", false, func(r *BenchmarkResults) float64 { return r.Latency.P99Ms }},
+    {"Packet loss (%)", false, func(r *BenchmarkResults) float64 { return r.PacketLoss }},
+    {"Handshakes/sec", true, func(r *BenchmarkResults) float64 { return r.Encryption.HandshakesPerSec }},
+    {"Stability", true, func(r *BenchmarkResults) float64 { return r.StabilityScore }},
+    {"Overall score", true, func(r *BenchmarkResults) float64 { return r.calculateOverallScore() }},
+}
+
+// CompareAgainst compares the results with a baseline. Scores are only
+// comparable under the same rubric, so results scored with different
+// profiles are refused.
+func (r *BenchmarkResults) CompareAgainst(baseline *BenchmarkResults) ([]MetricComparison, error) {
+    current, base := r.profile(), baseline.profile()
+    if !reflect.DeepEqual(current, base) {
+        return nil, fmt.Errorf("%w: %q vs baseline %q", ErrProfileMismatch, current.Name, base.Name)
+    }
+    
+    comparison := make([]MetricComparison, 0, len(comparedMetrics))
+    for _, m := range comparedMetrics {
+        c := MetricComparison{
+            Name:     m.name,
+            Baseline: m.get(baseline),
+            Current:  m.get(r),
+        }
+        if c.Baseline != 0 {
+            change := (c.Current - c.Baseline) / math.Abs(c.Baseline) * 100
+            c.ChangePercent = &change
+        }
+        c.Improved = c.Current != c.Baseline && (c.Current > c.Baseline) == m.higherBetter
+        comparison = append(comparison, c)
+    }
+    return comparison, nil
+}
@@ -0,0 +1,116 @@
+package benchmark
+
+import (
+    "errors"
+    "fmt"
+    mrand "math/rand/v2"
+    "sort"
+)
+
+var ErrBadSizeDistribution = errors.New("invalid packet size distribution")
+
+// PacketSizeWeight is one bar of a packet size distribution
+type PacketSizeWeight struct {
+    Size   int     `json:"size"`   // bytes
+    Weight float64 `json:"weight"` // relative, need not sum to 1
+}
+
+// PacketSizeDistribution is the mix of packet sizes the traffic generators
+// send, drawn independently per packet
+type PacketSizeDistribution struct {
+    Name  string             `json:"name"`
+    Sizes []PacketSizeWeight `json:"sizes"`
+}
+
+// FixedPacketSize sends every packet at size, the old behaviour
+func FixedPacketSize(size int) PacketSizeDistribution {
+    return PacketSizeDistribution{
+        Name:  fmt.Sprintf("fixed-%d", size),
+        Sizes: []PacketSizeWeight{{Size: size, Weight: 1}},
+    }
+}
+
+// IMIXDistribution is the classic simple IMIX, 7:4:1 small, medium and
+// full-size packets, with the large ones capped at WireGuard's MTU
+func IMIXDistribution() PacketSizeDistribution {
+    return PacketSizeDistribution{
+        Name: "imix",
+        Sizes: []PacketSizeWeight{
+            {Size: 64, Weight: 7},
+            {Size: 576, Weight: 4},
+            {Size: 1420, Weight: 1},
+        },
+    }
+}
+
+func (d PacketSizeDistribution) Validate() error {
+    if len(d.Sizes) == 0 {
+        return fmt.Errorf("%w: no sizes", ErrBadSizeDistribution)
+    }
+    for _, s := range d.Sizes {
+        if s.Size <= 0 || s.Size > 65535 {
+            return fmt.Errorf("%w: size %d", ErrBadSizeDistribution, s.Size)
+        }
+        if s.Weight <= 0 {
+            return fmt.Errorf("%w: weight %g for size %d", ErrBadSizeDistribution, s.Weight, s.Size)
+        }
+    }
+    return nil
+}
+
+// MeanSize is the expected bytes per packet
+func (d PacketSizeDistribution) MeanSize() float64 {
+    var sum, weights float64
+    for _, s := range d.Sizes {
+        sum += float64(s.Size) * s.Weight
+        weights += s.Weight
+    }
+    if weights == 0 {
+        return 0
+    }
+    return sum / weights
+}
+
+func (d PacketSizeDistribution) maxSize() int {
+    largest := 0
+    for _, s := range d.Sizes {
+        if s.Size > largest {
+            largest = s.Size
+        }
+    }
+    return largest
+}
+
+func (d PacketSizeDistribution) isZero() bool {
+    return len(d.Sizes) == 0
+}
+
+// sizeSampler draws sizes from a validated distribution
+type sizeSampler struct {
+    sizes      []int
+    cumulative []float64 // running weight totals, normalised to end at 1
+}
+
+func newSizeSampler(d PacketSizeDistribution) *sizeSampler {
+    s := &sizeSampler{}
+    var total float64
+    for _, w := range d.Sizes {
+        total += w.Weight
+    }
+    var running float64
+    for _, w := range d.Sizes {
+        running += w.Weight
+        s.sizes = append(s.sizes, w.Size)
+        s.cumulative = append(s.cumulative, running/total)
+    }
+    return s
+}
+
+func (s *sizeSampler) draw() int {
+    u := mrand.Float64()
+    i := sort.SearchFloat64s(s.cumulative, u)
+    if i == len(s.sizes) {
+        i-- // rounding left the last total a hair under 1
+    }
+    return s.sizes[i]
+}
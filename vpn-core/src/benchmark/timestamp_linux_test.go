@@ -0,0 +1,107 @@
+//go:build linux
+
+package benchmark
+
+import (
+    "errors"
+    "net"
+    "testing"
+    "time"
+    "unsafe"
+    
+    "golang.org/x/sys/unix"
+)
+
+// Ask for NIC timestamps on both directions, reported as raw hardware time
+func enableHWTimestamps(conn *net.UDPConn) error {
+    raw, err := conn.SyscallConn()
+    if err != nil {
+        return err
+    }
+    var sockErr error
+    err = raw.Control(func(fd uintptr) {
+        flags := unix.SOF_TIMESTAMPING_TX_HARDWARE | unix.SOF_TIMESTAMPING_RX_HARDWARE |
+            unix.SOF_TIMESTAMPING_RAW_HARDWARE | unix.SOF_TIMESTAMPING_OPT_TSONLY
+        sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TIMESTAMPING, flags)
+    })
+    if err != nil {
+        return err
+    }
+    if errors.Is(sockErr, unix.ENOPROTOOPT) {
+        return errHWTimestampsUnsupported
+    }
+    return sockErr
+}
+
+// The raw hardware stamp from an SCM_TIMESTAMPING control message. Its
+// three timespecs are software, legacy and raw hardware; zero means the
+// NIC didn't stamp the packet.
+func rxHWTimestamp(oob []byte) (time.Time, bool) {
+    msgs, err := unix.ParseSocketControlMessage(oob)
+    if err != nil {
+        return time.Time{}, false
+    }
+    for _, msg := range msgs {
+        if msg.Header.Level != unix.SOL_SOCKET || msg.Header.Type != unix.SO_TIMESTAMPING {
+            continue
+        }
+        var ts [3]unix.Timespec
+        if len(msg.Data) < int(unsafe.Sizeof(ts)) {
+            continue
+        }
+        copy(unsafe.Slice((*byte)(unsafe.Pointer(&ts)), unsafe.Sizeof(ts)), msg.Data)
+        if ts[2].Sec == 0 && ts[2].Nsec == 0 {
+            return time.Time{}, false
+        }
+        return time.Unix(ts[2].Unix()), true
+    }
+    return time.Time{}, false
+}
+
+// The transmit stamp is looped back on the socket's error queue
+func txHWTimestamp(conn *net.UDPConn) (time.Time, bool) {
+    raw, err := conn.SyscallConn()
+    if err != nil {
+        return time.Time{}, false
+    }
+    oob := make([]byte, 512)
+    var oobn int
+    var readErr error
+    
+    // The stamp can trail the send slightly, don't wait on the error queue
+    deadline := time.Now().Add(time.Millisecond)
+    for time.Now().Before(deadline) {
+        raw.Control(func(fd uintptr) {
+            _, oobn, _, _, readErr = unix.Recvmsg(int(fd), nil, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+        })
+        if readErr != unix.EAGAIN {
+            break
+        }
+    }
+    if readErr != nil {
+        return time.Time{}, false
+    }
+    return rxHWTimestamp(oob[:oobn])
+}
+
+func TestRxHWTimestampParsesRawHardwareStamp(t *testing.T) {
+    ts := [3]unix.Timespec{{Sec: 1, Nsec: 2}, {}, {Sec: 1700000000, Nsec: 123456789}}
+    size := int(unsafe.Sizeof(ts))
+    oob := make([]byte, unix.CmsgSpace(size))
+    h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+    h.Level, h.Type = unix.SOL_SOCKET, unix.SO_TIMESTAMPING
+    h.SetLen(unix.CmsgLen(size))
+    copy(oob[unix.CmsgLen(0):], unsafe.Slice((*byte)(unsafe.Pointer(&ts)), size))
+    
+    got, ok := rxHWTimestamp(oob)
+    if !ok || !got.Equal(time.Unix(1700000000, 123456789)) {
+        t.Fatalf("stamp = %v, %v", got, ok)
+    }
+    
+    // Only a software stamp: the NIC didn't stamp this packet
+    ts[2] = unix.Timespec{}
+    copy(oob[unix.CmsgLen(0):], unsafe.Slice((*byte)(unsafe.Pointer(&ts)), size))
+    if _, ok := rxHWTimestamp(oob); ok {
+        t.Fatal("software-only stamp reported as hardware")
+    }
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package benchmark
+
+import (
+    "net"
+    "time"
+)
+
+// SO_TIMESTAMPING is Linux only
+func enableHWTimestamps(conn *net.UDPConn) error {
+    return errHWTimestampsUnsupported
+}
+
+func rxHWTimestamp(oob []byte) (time.Time, bool) {
+    return time.Time{}, false
+}
+
+func txHWTimestamp(conn *net.UDPConn) (time.Time, bool) {
+    return time.Time{}, false
+}
@@ -0,0 +1,121 @@
+package benchmark
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "net"
+    "time"
+)
+
+// Where an RTT came from, see LatencyMetrics.TimestampSource
+const (
+    TimestampSoftware = "software"
+    TimestampHardware = "hardware"
+)
+
+// The kernel or NIC can't timestamp, time.Now() has to do
+var errHWTimestampsUnsupported = errors.New("hardware timestamping not supported")
+
+// rttProbe measures round trips to a UDP echo responder. Software
+// timestamps carry tens of microseconds of scheduling jitter; with hardware
+// timestamping the NIC stamps the probe as it leaves and the reply as it
+// arrives.
+type rttProbe struct {
+    conn *net.UDPConn
+    hw   bool // SO_TIMESTAMPING is enabled on conn
+    seq  uint64
+}
+
+// newRTTProbe falls back to software timestamps when useHW is set but the
+// kernel or NIC lacks support
+func newRTTProbe(target *net.UDPAddr, useHW bool) (*rttProbe, error) {
+    conn, err := net.DialUDP("udp", nil, target)
+    if err != nil {
+        return nil, fmt.Errorf("failed to dial %s: %w", target, err)
+    }
+    p := &rttProbe{conn: conn}
+    
+    if useHW {
+        err := enableHWTimestamps(conn)
+        switch {
+        case err == nil:
+            p.hw = true
+        case errors.Is(err, errHWTimestampsUnsupported):
+        default:
+            conn.Close()
+            return nil, err
+        }
+    }
+    return p, nil
+}
+
+// RoundTrip sends one probe and waits for its echo. Without both hardware
+// stamps, e.g. on an interface whose NIC doesn't stamp, the software
+// figure is returned and the source says so.
+func (p *rttProbe) RoundTrip(timeout time.Duration) (time.Duration, string, error) {
+    p.seq++
+    probe := make([]byte, 8)
+    binary.BigEndian.PutUint64(probe, p.seq)
+    p.conn.SetDeadline(time.Now().Add(timeout))
+    
+    start := time.Now()
+    if _, err := p.conn.Write(probe); err != nil {
+        return 0, "", fmt.Errorf("failed to send probe: %w", err)
+    }
+    
+    buf := make([]byte, 64)
+    oob := make([]byte, 512)
+    for {
+        n, oobn, _, _, err := p.conn.ReadMsgUDP(buf, oob)
+        if err != nil {
+            return 0, "", fmt.Errorf("failed to read echo: %w", err)
+        }
+        if n != len(probe) || binary.BigEndian.Uint64(buf) != p.seq {
+            continue // late echo of an earlier probe
+        }
+        rtt := time.Since(start)
+        
+        if p.hw {
+            if tx, ok := txHWTimestamp(p.conn); ok {
+                if rx, ok := rxHWTimestamp(oob[:oobn]); ok && rx.After(tx) {
+                    return rx.Sub(tx), TimestampHardware, nil
+                }
+            }
+        }
+        return rtt, TimestampSoftware, nil
+    }
+}
+
+func (p *rttProbe) Close() error {
+    return p.conn.Close()
+}
+
+// Echo every datagram back after delay(), standing in for the far end of
+// the tunnel
+func startEchoResponder(delay func() time.Duration) (*net.UDPAddr, func(), error) {
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to start echo responder: %w", err)
+    }
+    
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        buf := make([]byte, 64)
+        for {
+            n, from, err := conn.ReadFromUDP(buf)
+            if err != nil {
+                return
+            }
+            time.Sleep(delay())
+            conn.WriteToUDP(buf[:n], from)
+        }
+    }()
+    
+    stop := func() {
+        conn.Close()
+        <-done
+    }
+    return conn.LocalAddr().(*net.UDPAddr), stop, nil
+}
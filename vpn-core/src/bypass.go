@@ -0,0 +1,275 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    
+    "github.com/cilium/ebpf"
+    "github.com/cilium/ebpf/link"
+)
+
+// Object built from ebpf/lsm_bypass.c, see the build notes there
+var lsmObjectPath = "ebpf/lsm_bypass.o"
+
+// cgroup v2 hierarchy the socket program is attached to, every process is
+// below it. Tests replace it.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// Longest name the kernel keeps in task->comm, without the NUL
+const maxProcessNameLen = 15
+
+// Mark on the sockets of listed processes, with 0x55 in the second byte
+// like the split tunnel's, and the priority of the rule routing it to the
+// main table, after the split tunnel's
+const (
+    processBypassMark     = 0x5550
+    processBypassPriority = splitRulePriority + 2
+)
+
+var ErrBypassNotLoaded = errors.New("process bypass is not enabled")
+
+// bypassMap is the part of *ebpf.Map the bypass list uses
+type bypassMap interface {
+    Put(key, value interface{}) error
+    Delete(key interface{}) error
+}
+
+// bypassConfig mirrors struct bypass_config
+type bypassConfig struct {
+    Enforce       uint32
+    TunnelIfindex uint32
+    BypassMark    uint32
+    DaemonTgid    uint32
+}
+
+// ProcessBypass lets named processes leave the tunnel while the kill switch
+// is on. A program on the root cgroup marks the sockets they create with
+// processBypassMark, which is routed to the main table and accepted by the
+// kill switch. The kill switch also accepts root, so without it any
+// privileged process could bind to the uplink or set a routing mark and go
+// around the tunnel; an LSM program on socket_connect refuses that with
+// EPERM unless the process is listed or is this daemon, whose own sockets
+// carry FirewallMark or are bound to BindInterface. Names are matched
+// against task->comm, which is truncated to 15 bytes.
+type ProcessBypass struct {
+    mu        sync.Mutex
+    processes bypassMap // bypass_processes, comm to 1
+    coll      *ebpf.Collection
+    link      link.Link // LSM
+    sockLink  link.Link // cgroup socket creation
+    routing   []string  // ip rules for processBypassMark
+}
+
+// Load the programs, enforce them for sockets not bound to tunnel and
+// allow the given processes
+func loadProcessBypass(tunnel string, processes []string) (*ProcessBypass, error) {
+    iface, err := net.InterfaceByName(tunnel)
+    if err != nil {
+        return nil, fmt.Errorf("failed to look up %s: %w", tunnel, err)
+    }
+    
+    spec, err := ebpf.LoadCollectionSpec(lsmObjectPath)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load LSM object: %w", err)
+    }
+    coll, err := ebpf.NewCollection(spec)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create LSM collection: %w", err)
+    }
+    
+    pb := &ProcessBypass{coll: coll}
+    for _, name := range []string{"bypass_processes", "bypass_config"} {
+        if _, ok := coll.Maps[name]; !ok {
+            pb.Close()
+            return nil, fmt.Errorf("eBPF map %s missing from %s", name, lsmObjectPath)
+        }
+    }
+    pb.processes = coll.Maps["bypass_processes"]
+    
+    for _, name := range processes {
+        if err := pb.Update(name, true); err != nil {
+            pb.Close()
+            return nil, err
+        }
+    }
+    
+    cfg := bypassConfig{
+        Enforce:       1,
+        TunnelIfindex: uint32(iface.Index),
+        BypassMark:    processBypassMark,
+        DaemonTgid:    uint32(os.Getpid()),
+    }
+    if err := coll.Maps["bypass_config"].Put(uint32(0), cfg); err != nil {
+        pb.Close()
+        return nil, fmt.Errorf("failed to update bypass config: %w", err)
+    }
+    
+    for _, name := range []string{"lsm_vpn_bypass", "sock_vpn_bypass"} {
+        if _, ok := coll.Programs[name]; !ok {
+            pb.Close()
+            return nil, fmt.Errorf("eBPF program %s missing from %s", name, lsmObjectPath)
+        }
+    }
+    if pb.link, err = link.AttachLSM(link.LSMOptions{Program: coll.Programs["lsm_vpn_bypass"]}); err != nil {
+        pb.Close()
+        return nil, fmt.Errorf("failed to attach LSM program, is the kernel booted with lsm=bpf? %w", err)
+    }
+    pb.sockLink, err = link.AttachCgroup(link.CgroupOptions{
+        Path:    cgroupRoot,
+        Attach:  ebpf.AttachCGroupInetSockCreate,
+        Program: coll.Programs["sock_vpn_bypass"],
+    })
+    if err != nil {
+        pb.Close()
+        return nil, fmt.Errorf("failed to attach socket program to %s: %w", cgroupRoot, err)
+    }
+    return pb, nil
+}
+
+// Key for bypass_processes, the name NUL padded like task->comm
+func processKey(name string) ([16]byte, error) {
+    var key [16]byte
+    if name == "" || len(name) > maxProcessNameLen || strings.IndexByte(name, 0) >= 0 {
+        return key, fmt.Errorf("invalid process name %q, want 1 to %d bytes as in /proc/<pid>/comm", name, maxProcessNameLen)
+    }
+    copy(key[:], name)
+    return key, nil
+}
+
+// Update allows or stops allowing a process to leave the tunnel
+func (pb *ProcessBypass) Update(name string, bypass bool) error {
+    key, err := processKey(name)
+    if err != nil {
+        return err
+    }
+    
+    pb.mu.Lock()
+    defer pb.mu.Unlock()
+    
+    if bypass {
+        if err := pb.processes.Put(key, uint8(1)); err != nil {
+            return fmt.Errorf("failed to allow bypass for %s: %w", name, err)
+        }
+        return nil
+    }
+    if err := pb.processes.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+        return fmt.Errorf("failed to remove bypass for %s: %w", name, err)
+    }
+    return nil
+}
+
+// Close detaches the programs: listed processes are no longer marked, and
+// every process may bind or mark its way out again
+func (pb *ProcessBypass) Close() {
+    if pb.sockLink != nil {
+        pb.sockLink.Close()
+        pb.sockLink = nil
+    }
+    if pb.link != nil {
+        pb.link.Close()
+        pb.link = nil
+    }
+    if pb.coll != nil {
+        pb.coll.Close()
+        pb.coll = nil
+    }
+}
+
+// UpdateBypassProcess allows or stops allowing a process, by its name in
+// /proc/<pid>/comm, to leave the tunnel while the kill switch is on. Needs
+// VPNConfig.BypassProcesses so the LSM program is loaded.
+func (vpn *UnderTheRadarVPN) UpdateBypassProcess(name string, bypass bool) error {
+    vpn.mu.RLock()
+    pb := vpn.bypass
+    vpn.mu.RUnlock()
+    
+    if pb == nil {
+        return ErrBypassNotLoaded
+    }
+    return pb.Update(name, bypass)
+}
+
+func (vpn *UnderTheRadarVPN) startProcessBypass(processes []string) error {
+    if vpn.planning != nil {
+        vpn.planning.note(ChangeDevice, "load the eBPF LSM process bypass for %s", strings.Join(processes, ", "))
+        vpn.planning.note(ChangeRoute, "route fwmark 0x%x to the main table", processBypassMark)
+        return nil
+    }
+    pb, err := loadProcessBypass(vpn.deviceName, processes)
+    if err != nil {
+        return err
+    }
+    if err := vpn.routeProcessBypass(pb); err != nil {
+        pb.Close()
+        return err
+    }
+    vpn.mu.Lock()
+    vpn.bypass = pb
+    vpn.mu.Unlock()
+    return nil
+}
+
+func (vpn *UnderTheRadarVPN) stopProcessBypass() {
+    vpn.mu.Lock()
+    pb := vpn.bypass
+    vpn.bypass = nil
+    vpn.mu.Unlock()
+    
+    if pb != nil {
+        pb.Close()
+        vpn.commands.removeRoutes(pb.routing)
+    }
+}
+
+// Route the marked sockets of listed processes to the main table, ahead of
+// the tunnel, as the split tunnel routes its bypass mark
+func (vpn *UnderTheRadarVPN) routeProcessBypass(pb *ProcessBypass) error {
+    var done []string
+    for _, ip := range []string{"ip", "ip -6"} {
+        cmd := fmt.Sprintf("%s rule add fwmark 0x%x lookup main priority %d", ip, processBypassMark, processBypassPriority)
+        if err := vpn.commands.Run(cmd); err != nil {
+            vpn.commands.removeRoutes(done)
+            return fmt.Errorf("failed to route bypassed processes: %w", err)
+        }
+        done = append(done, cmd)
+    }
+    pb.routing = done
+    return nil
+}
+
+// Load, unload or update the bypass for a changed config. A loaded program
+// stays attached and has its list updated, so allowed processes are never
+// cut off on the way.
+func (vpn *UnderTheRadarVPN) reloadProcessBypass(current, next VPNConfig) error {
+    if !next.KillSwitch || len(next.BypassProcesses) == 0 {
+        vpn.stopProcessBypass()
+        return nil
+    }
+    vpn.mu.RLock()
+    pb := vpn.bypass
+    vpn.mu.RUnlock()
+    if pb == nil {
+        return vpn.startProcessBypass(next.BypassProcesses)
+    }
+    
+    listed := make(map[string]bool)
+    for _, name := range next.BypassProcesses {
+        if err := pb.Update(name, true); err != nil {
+            return err
+        }
+        listed[name] = true
+    }
+    for _, name := range current.BypassProcesses {
+        if listed[name] {
+            continue
+        }
+        if err := pb.Update(name, false); err != nil {
+            return err
+        }
+    }
+    return nil
+}
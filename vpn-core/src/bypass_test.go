@@ -0,0 +1,147 @@
+package main
+
+import (
+    "errors"
+    "os"
+    "strings"
+    "testing"
+    
+    "github.com/cilium/ebpf"
+)
+
+// fakeBypassMap stands in for bypass_processes
+type fakeBypassMap map[[16]byte]uint8
+
+func (m fakeBypassMap) Put(key, value interface{}) error {
+    m[key.([16]byte)] = value.(uint8)
+    return nil
+}
+
+func (m fakeBypassMap) Delete(key interface{}) error {
+    k := key.([16]byte)
+    if _, ok := m[k]; !ok {
+        return ebpf.ErrKeyNotExist
+    }
+    delete(m, k)
+    return nil
+}
+
+func commKey(name string) [16]byte {
+    var key [16]byte
+    copy(key[:], name)
+    return key
+}
+
+func TestUpdateBypassProcess(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    if err := vpn.UpdateBypassProcess("restic", true); !errors.Is(err, ErrBypassNotLoaded) {
+        t.Fatalf("without the LSM program: %v", err)
+    }
+    
+    entries := fakeBypassMap{}
+    vpn.bypass = &ProcessBypass{processes: entries}
+    for _, name := range []string{"restic", "node_exporter", "restic"} {
+        if err := vpn.UpdateBypassProcess(name, true); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if len(entries) != 2 || entries[commKey("restic")] != 1 || entries[commKey("node_exporter")] != 1 {
+        t.Fatalf("map entries %v", entries)
+    }
+    
+    // Removing twice is fine, the process just isn't allowed any more
+    for i := 0; i < 2; i++ {
+        if err := vpn.UpdateBypassProcess("restic", false); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if _, ok := entries[commKey("restic")]; ok || len(entries) != 1 {
+        t.Fatalf("map entries after removal %v", entries)
+    }
+}
+
+func TestUpdateBypassProcessRejectsNamesTheKernelCantMatch(t *testing.T) {
+    entries := fakeBypassMap{}
+    pb := &ProcessBypass{processes: entries}
+    
+    // task->comm keeps 15 bytes, a longer name would never match
+    for _, name := range []string{"", "prometheus-node-exporter", "a\x00b"} {
+        if err := pb.Update(name, true); err == nil {
+            t.Errorf("%q accepted", name)
+        }
+    }
+    if err := pb.Update("fifteen-bytes!!", true); err != nil {
+        t.Fatal(err)
+    }
+    if len(entries) != 1 {
+        t.Fatalf("map entries %v", entries)
+    }
+}
+
+func TestProcessBypassRoutesAroundKillSwitch(t *testing.T) {
+    commands := recordSystemCommands(t)
+    ks := NewKillSwitch("utr0")
+    ks.AllowBypassProcesses = true
+    if err := ks.Enable(); err != nil {
+        t.Fatal(err)
+    }
+    for _, ipt := range []string{"iptables", "ip6tables"} {
+        accept := indexOf(*commands, ipt+" -A OUTPUT -m mark --mark 0x5550 -j ACCEPT")
+        drop := indexOf(*commands, ipt+" -A OUTPUT -j DROP")
+        if accept < 0 || accept > drop {
+            t.Fatalf("%s: bypass mark not accepted ahead of the drop in %v", ipt, *commands)
+        }
+    }
+    
+    // The marked sockets take the main table, the tunnel's default route
+    // is elsewhere
+    vpn := newTestVPN(t, newFakeWGClient())
+    pb := &ProcessBypass{processes: fakeBypassMap{}}
+    *commands = nil
+    if err := vpn.routeProcessBypass(pb); err != nil {
+        t.Fatal(err)
+    }
+    vpn.bypass = pb
+    vpn.stopProcessBypass()
+    want := []string{
+        "ip rule add fwmark 0x5550 lookup main priority 10002",
+        "ip -6 rule add fwmark 0x5550 lookup main priority 10002",
+        "ip -6 rule del fwmark 0x5550 lookup main priority 10002",
+        "ip rule del fwmark 0x5550 lookup main priority 10002",
+    }
+    if strings.Join(*commands, "\n") != strings.Join(want, "\n") {
+        t.Fatalf("commands %v, want %v", *commands, want)
+    }
+}
+
+func TestBypassKeysMatchKernelMap(t *testing.T) {
+    if os.Geteuid() != 0 {
+        t.Skip("creating eBPF maps requires root")
+    }
+    
+    // Same layout as bypass_processes in ebpf/lsm_bypass.c
+    m, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Hash, KeySize: 16, ValueSize: 1, MaxEntries: 16})
+    if err != nil {
+        t.Skipf("eBPF maps unavailable: %v", err)
+    }
+    defer m.Close()
+    
+    pb := &ProcessBypass{processes: m}
+    if err := pb.Update("borgbackup", true); err != nil {
+        t.Fatal(err)
+    }
+    var allowed uint8
+    if err := m.Lookup(commKey("borgbackup"), &allowed); err != nil || allowed != 1 {
+        t.Fatalf("lookup = %d, %v", allowed, err)
+    }
+    
+    if err := pb.Update("borgbackup", false); err != nil {
+        t.Fatal(err)
+    }
+    if err := pb.Update("never-added", false); err != nil {
+        t.Fatal(err)
+    }
+    if err := m.Lookup(commKey("borgbackup"), &allowed); !errors.Is(err, ebpf.ErrKeyNotExist) {
+        t.Fatalf("entry still present: %v", err)
+    }
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+    "crypto/rand"
+    "errors"
+    "fmt"
+    "io"
+    "time"
+    
+    "golang.org/x/crypto/curve25519"
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Capability extension messages ride next to the WireGuard handshake.
+// They use message types outside WireGuard's 1-4 range so a stock peer
+// simply drops them.
+const (
+    capabilityOfferType  = 0xC1
+    capabilityReplyType  = 0xC2
+    capabilityHeaderSize = 7 // type + 3 reserved + flags + max hops + mode count
+    
+    capFlagFEC         = 1 << 0
+    capFlagCompression = 1 << 1
+    capFlagKeyNonce    = 1 << 2 // a nonce for the obfuscation key follows the modes
+    capFlagShaping     = 1 << 3 // understands shaped frames, see TrafficShaping
+    
+    obfuscationNonceSize = 32
+    obfuscationKeyLabel  = "undertheradar obfuscation key v1"
+)
+
+var ErrBadCapabilityMessage = errors.New("malformed capability message")
+
+// PeerCapabilities describes the optional features a peer supports
+type PeerCapabilities struct {
+    SupportsFEC         bool
+    SupportsCompression bool
+    SupportsShaping     bool
+    ObfuscationModes    []ObfuscationMode // in order of preference
+    MaxHops             int
+}
+
+// Capabilities advertised by this build unless overridden
+func defaultCapabilities() PeerCapabilities {
+    return PeerCapabilities{
+        ObfuscationModes: []ObfuscationMode{ObfuscationTLS, ObfuscationHTTP, ObfuscationXOR},
+        MaxHops:          5,
+    }
+}
+
+// Intersect returns the capabilities both sides support. Obfuscation modes
+// keep the receiver's order of preference.
+func (c PeerCapabilities) Intersect(other PeerCapabilities) PeerCapabilities {
+    result := PeerCapabilities{
+        SupportsFEC:         c.SupportsFEC && other.SupportsFEC,
+        SupportsCompression: c.SupportsCompression && other.SupportsCompression,
+        SupportsShaping:     c.SupportsShaping && other.SupportsShaping,
+        MaxHops:             c.MaxHops,
+    }
+    if other.MaxHops < result.MaxHops {
+        result.MaxHops = other.MaxHops
+    }
+    
+    for _, mode := range c.ObfuscationModes {
+        for _, theirs := range other.ObfuscationModes {
+            if mode == theirs {
+                result.ObfuscationModes = append(result.ObfuscationModes, mode)
+                break
+            }
+        }
+    }
+    
+    return result
+}
+
+// A nil nonce leaves the message as peers without key negotiation expect it
+func (c PeerCapabilities) marshal(msgType byte, nonce []byte) []byte {
+    buf := make([]byte, capabilityHeaderSize, capabilityHeaderSize+len(c.ObfuscationModes)+len(nonce))
+    buf[0] = msgType
+    if c.SupportsFEC {
+        buf[4] |= capFlagFEC
+    }
+    if c.SupportsCompression {
+        buf[4] |= capFlagCompression
+    }
+    if c.SupportsShaping {
+        buf[4] |= capFlagShaping
+    }
+    buf[5] = byte(clampByte(c.MaxHops))
+    buf[6] = byte(len(c.ObfuscationModes))
+    
+    for _, mode := range c.ObfuscationModes {
+        buf = append(buf, byte(mode))
+    }
+    if nonce != nil {
+        buf[4] |= capFlagKeyNonce
+        buf = append(buf, nonce...)
+    }
+    
+    return buf
+}
+
+// Capabilities and the sender's key nonce, nil if it sent none
+func unmarshalCapabilities(data []byte, msgType byte) (PeerCapabilities, []byte, error) {
+    var caps PeerCapabilities
+    
+    if len(data) < capabilityHeaderSize || data[0] != msgType {
+        return caps, nil, ErrBadCapabilityMessage
+    }
+    count := int(data[6])
+    nonceSize := 0
+    if data[4]&capFlagKeyNonce != 0 {
+        nonceSize = obfuscationNonceSize
+    }
+    if len(data) != capabilityHeaderSize+count+nonceSize {
+        return caps, nil, ErrBadCapabilityMessage
+    }
+    
+    caps.SupportsFEC = data[4]&capFlagFEC != 0
+    caps.SupportsCompression = data[4]&capFlagCompression != 0
+    caps.SupportsShaping = data[4]&capFlagShaping != 0
+    caps.MaxHops = int(data[5])
+    for _, b := range data[capabilityHeaderSize : capabilityHeaderSize+count] {
+        caps.ObfuscationModes = append(caps.ObfuscationModes, ObfuscationMode(b))
+    }
+    
+    var nonce []byte
+    if nonceSize > 0 {
+        nonce = append([]byte(nil), data[capabilityHeaderSize+count:]...)
+    }
+    return caps, nonce, nil
+}
+
+func clampByte(v int) int {
+    if v < 0 {
+        return 0
+    }
+    if v > 255 {
+        return 255
+    }
+    return v
+}
+
+type deadlineSetter interface {
+    SetDeadline(t time.Time) error
+}
+
+// InitiateCapabilities sends our capabilities over a datagram connection
+// (typically a connected UDP socket) and returns the intersection chosen
+// by the responder
+func InitiateCapabilities(conn io.ReadWriter, local PeerCapabilities) (PeerCapabilities, error) {
+    agreed, _, err := initiateCapabilities(conn, local, nil)
+    return agreed, err
+}
+
+// Offer nonce with our capabilities, returning the responder's nonce too
+func initiateCapabilities(conn io.ReadWriter, local PeerCapabilities, nonce []byte) (PeerCapabilities, []byte, error) {
+    if d, ok := conn.(deadlineSetter); ok {
+        d.SetDeadline(time.Now().Add(HandshakeTimeout))
+        defer d.SetDeadline(time.Time{})
+    }
+    
+    if _, err := conn.Write(local.marshal(capabilityOfferType, nonce)); err != nil {
+        return PeerCapabilities{}, nil, fmt.Errorf("failed to send capability offer: %w", err)
+    }
+    
+    buf := make([]byte, capabilityHeaderSize+255+obfuscationNonceSize)
+    n, err := conn.Read(buf)
+    if err != nil {
+        return PeerCapabilities{}, nil, fmt.Errorf("failed to read capability reply: %w", err)
+    }
+    
+    agreed, theirs, err := unmarshalCapabilities(buf[:n], capabilityReplyType)
+    if err != nil {
+        return PeerCapabilities{}, nil, err
+    }
+    if nonce == nil {
+        theirs = nil
+    }
+    
+    // Never trust the responder to grant more than we offered
+    return local.Intersect(agreed), theirs, nil
+}
+
+// RespondCapabilities reads an offer and replies with the intersection
+func RespondCapabilities(conn io.ReadWriter, local PeerCapabilities) (PeerCapabilities, error) {
+    agreed, _, err := respondCapabilities(conn, local, nil)
+    return agreed, err
+}
+
+// Reply with nonce if the initiator offered one, returning the initiator's
+func respondCapabilities(conn io.ReadWriter, local PeerCapabilities, nonce []byte) (PeerCapabilities, []byte, error) {
+    if d, ok := conn.(deadlineSetter); ok {
+        d.SetDeadline(time.Now().Add(HandshakeTimeout))
+        defer d.SetDeadline(time.Time{})
+    }
+    
+    buf := make([]byte, capabilityHeaderSize+255+obfuscationNonceSize)
+    n, err := conn.Read(buf)
+    if err != nil {
+        return PeerCapabilities{}, nil, fmt.Errorf("failed to read capability offer: %w", err)
+    }
+    
+    offered, theirs, err := unmarshalCapabilities(buf[:n], capabilityOfferType)
+    if err != nil {
+        return PeerCapabilities{}, nil, err
+    }
+    if theirs == nil || nonce == nil {
+        theirs, nonce = nil, nil
+    }
+    
+    // Initiator's preference order wins
+    agreed := offered.Intersect(local)
+    if _, err := conn.Write(agreed.marshal(capabilityReplyType, nonce)); err != nil {
+        return PeerCapabilities{}, nil, fmt.Errorf("failed to send capability reply: %w", err)
+    }
+    
+    return agreed, theirs, nil
+}
+
+// NegotiateCapabilities runs the capability exchange with a peer and
+// records the agreed set in Peer.ActiveCapabilities. With
+// VPNConfig.ObfuscationKeyExchange on both ends the exchange also carries a
+// nonce each way and the peer gets an obfuscation XOR key of its own,
+// derived from them, see deriveObfuscationKey and PeerObfuscator. Other
+// peers keep theirs. VPNConfig.TrafficShaping is turned on for the peer,
+// on its own obfuscator too, only if it understands shaped packets.
+func (vpn *UnderTheRadarVPN) NegotiateCapabilities(pubKey wgtypes.Key, conn io.ReadWriter, initiator bool) error {
+    vpn.mu.RLock()
+    peer := vpn.peers.get(pubKey)
+    local := vpn.capabilities
+    exchange := vpn.config.ObfuscationKeyExchange
+    shaping := vpn.config.TrafficShaping
+    vpn.mu.RUnlock()
+    local.SupportsShaping = shaping != nil
+    
+    if peer == nil {
+        return fmt.Errorf("%w: %s", ErrPeerNotFound, pubKey)
+    }
+    
+    var nonce []byte
+    if exchange {
+        nonce = make([]byte, obfuscationNonceSize)
+        if _, err := rand.Read(nonce); err != nil {
+            return fmt.Errorf("failed to generate key nonce: %w", err)
+        }
+    }
+    
+    var agreed PeerCapabilities
+    var theirs []byte
+    var err error
+    if initiator {
+        agreed, theirs, err = initiateCapabilities(conn, local, nonce)
+    } else {
+        agreed, theirs, err = respondCapabilities(conn, local, nonce)
+    }
+    if err != nil {
+        return err
+    }
+    
+    // Installed before anything is obfuscated with the agreed settings
+    if theirs != nil {
+        initiatorNonce, responderNonce := nonce, theirs
+        if !initiator {
+            initiatorNonce, responderNonce = theirs, nonce
+        }
+        key, err := deriveObfuscationKey(vpn.privateKey(), peer.PublicKey, peer.PresharedKey, initiatorNonce, responderNonce)
+        if err != nil {
+            return err
+        }
+        vpn.ownObfuscator(peer).SetXORKey(key)
+        wipe(key)
+    }
+    if shaping != nil && agreed.SupportsShaping {
+        if err := vpn.ownObfuscator(peer).SetShaping(shaping); err != nil {
+            return err
+        }
+    } else if ob := vpn.negotiatedObfuscator(peer); ob != nil {
+        ob.SetShaping(nil) // agreed before, not any more
+    }
+    
+    vpn.mu.Lock()
+    peer.ActiveCapabilities = agreed
+    vpn.mu.Unlock()
+    
+    return nil
+}
+
+// The obfuscation XOR key both ends of an exchange arrive at: HKDF over
+// the two nonces and the static-static Diffie-Hellman secret, the same one
+// the WireGuard handshake mixes in, plus the preshared key when there is
+// one. The nonces make it fresh each exchange, the secret keeps it from
+// anyone who only saw them.
+func deriveObfuscationKey(static *Secret, peer wgtypes.Key, psk *Secret, initiatorNonce, responderNonce []byte) ([]byte, error) {
+    if static == nil {
+        return nil, fmt.Errorf("no private key to derive the obfuscation key")
+    }
+    staticKey := static.Key()
+    defer wipe(staticKey[:])
+    ss, err := curve25519.X25519(staticKey[:], peer[:])
+    if err != nil {
+        return nil, fmt.Errorf("failed to derive the obfuscation key: %w", err)
+    }
+    defer wipe(ss)
+    
+    input := make([]byte, 0, 2*obfuscationNonceSize+len(ss)+wgtypes.KeyLen)
+    input = append(append(append(input, initiatorNonce...), responderNonce...), ss...)
+    if psk != nil {
+        input = append(input, psk.Bytes()...)
+    }
+    defer wipe(input)
+    
+    chainKey := blakeHash([]byte(obfuscationKeyLabel))
+    next, key := noiseKDF2(chainKey[:], input)
+    wipe(next[:])
+    return key[:], nil
+}
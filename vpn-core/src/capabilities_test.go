@@ -0,0 +1,253 @@
+package main
+
+import (
+    "bytes"
+    "net"
+    "reflect"
+    "testing"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestCapabilityNegotiationIntersection(t *testing.T) {
+    full := PeerCapabilities{
+        SupportsFEC:         true,
+        SupportsCompression: true,
+        ObfuscationModes:    []ObfuscationMode{ObfuscationTLS, ObfuscationHTTP, ObfuscationXOR},
+        MaxHops:             5,
+    }
+    limited := PeerCapabilities{
+        SupportsCompression: true,
+        ObfuscationModes:    []ObfuscationMode{ObfuscationXOR, ObfuscationTLS},
+        MaxHops:             2,
+    }
+    want := PeerCapabilities{
+        SupportsCompression: true,
+        ObfuscationModes:    []ObfuscationMode{ObfuscationTLS, ObfuscationXOR},
+        MaxHops:             2,
+    }
+    
+    initConn, respConn := net.Pipe()
+    defer initConn.Close()
+    defer respConn.Close()
+    
+    type result struct {
+        caps PeerCapabilities
+        err  error
+    }
+    respCh := make(chan result, 1)
+    go func() {
+        caps, err := RespondCapabilities(respConn, limited)
+        respCh <- result{caps, err}
+    }()
+    
+    got, err := InitiateCapabilities(initConn, full)
+    if err != nil {
+        t.Fatalf("initiator: %v", err)
+    }
+    resp := <-respCh
+    if resp.err != nil {
+        t.Fatalf("responder: %v", resp.err)
+    }
+    
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("initiator agreed %+v, want %+v", got, want)
+    }
+    if !reflect.DeepEqual(resp.caps, want) {
+        t.Fatalf("responder agreed %+v, want %+v", resp.caps, want)
+    }
+}
+
+func TestNegotiateCapabilitiesSetsActiveCapabilities(t *testing.T) {
+    key, _ := wgtypes.GeneratePrivateKey()
+    peer := &Peer{PublicKey: key.PublicKey()}
+    vpn := &UnderTheRadarVPN{capabilities: defaultCapabilities()}
+    vpn.peers.put(peer)
+    
+    remote := PeerCapabilities{ObfuscationModes: []ObfuscationMode{ObfuscationHTTP}, MaxHops: 1}
+    
+    local, other := net.Pipe()
+    defer local.Close()
+    defer other.Close()
+    go RespondCapabilities(other, remote)
+    
+    if err := vpn.NegotiateCapabilities(peer.PublicKey, local, true); err != nil {
+        t.Fatalf("NegotiateCapabilities: %v", err)
+    }
+    
+    want := PeerCapabilities{ObfuscationModes: []ObfuscationMode{ObfuscationHTTP}, MaxHops: 1}
+    if !reflect.DeepEqual(peer.ActiveCapabilities, want) {
+        t.Fatalf("ActiveCapabilities = %+v, want %+v", peer.ActiveCapabilities, want)
+    }
+}
+
+func TestUnmarshalCapabilitiesRejectsTruncated(t *testing.T) {
+    msg := defaultCapabilities().marshal(capabilityOfferType, nil)
+    if _, _, err := unmarshalCapabilities(msg[:len(msg)-1], capabilityOfferType); err != ErrBadCapabilityMessage {
+        t.Fatalf("expected ErrBadCapabilityMessage, got %v", err)
+    }
+}
+
+// Two ends that know each other's public key, ready to negotiate
+func keyExchangePair(t *testing.T, exchange bool) (a, b *UnderTheRadarVPN, aKey, bKey wgtypes.Key) {
+    t.Helper()
+    
+    psk := NewSecret(bytes.Repeat([]byte{7}, wgtypes.KeyLen))
+    privA, privB := mustKey(t), mustKey(t)
+    a, b = newTestVPN(t, newFakeWGClient()), newTestVPN(t, newFakeWGClient())
+    for _, side := range []struct {
+        vpn  *UnderTheRadarVPN
+        priv wgtypes.Key
+        peer wgtypes.Key
+    }{{a, privA, privB.PublicKey()}, {b, privB, privA.PublicKey()}} {
+        side.vpn.keys.Put(deviceKeyName, SecretFromKey(side.priv))
+        side.vpn.peers.put(&Peer{PublicKey: side.peer, PresharedKey: psk})
+        side.vpn.obfuscator = NewObfuscator()
+        side.vpn.config.ObfuscationKeyExchange = exchange
+    }
+    return a, b, privB.PublicKey(), privA.PublicKey()
+}
+
+// Run the exchange between a and b, a initiating
+func negotiatePair(t *testing.T, a, b *UnderTheRadarVPN, aPeer, bPeer wgtypes.Key) {
+    t.Helper()
+    
+    local, other := net.Pipe()
+    defer local.Close()
+    defer other.Close()
+    errCh := make(chan error, 1)
+    go func() { errCh <- b.NegotiateCapabilities(bPeer, other, false) }()
+    if err := a.NegotiateCapabilities(aPeer, local, true); err != nil {
+        t.Fatal(err)
+    }
+    if err := <-errCh; err != nil {
+        t.Fatal(err)
+    }
+}
+
+func peerObfuscator(t *testing.T, vpn *UnderTheRadarVPN, key wgtypes.Key) *Obfuscator {
+    t.Helper()
+    
+    ob, err := vpn.PeerObfuscator(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return ob
+}
+
+// Another VPN that knows hub and is known by it, with the keys each calls
+// the other by
+func addSpoke(t *testing.T, hub *UnderTheRadarVPN, exchange bool) (spoke *UnderTheRadarVPN, hubPeer, spokePeer wgtypes.Key) {
+    t.Helper()
+    
+    priv := mustKey(t)
+    spoke = newTestVPN(t, newFakeWGClient())
+    spoke.keys.Put(deviceKeyName, SecretFromKey(priv))
+    spoke.obfuscator = NewObfuscator()
+    spoke.config.ObfuscationKeyExchange = exchange
+    spoke.peers.put(&Peer{PublicKey: hub.privateKey().PublicKey()})
+    hub.peers.put(&Peer{PublicKey: priv.PublicKey()})
+    return spoke, priv.PublicKey(), hub.privateKey().PublicKey()
+}
+
+func TestNegotiateCapabilitiesDerivesObfuscationKey(t *testing.T) {
+    a, b, aPeer, bPeer := keyExchangePair(t, true)
+    before := append([]byte(nil), a.obfuscator.xorKey.Bytes()...)
+    negotiatePair(t, a, b, aPeer, bPeer)
+    
+    obA, obB := peerObfuscator(t, a, aPeer), peerObfuscator(t, b, bPeer)
+    keyA, keyB := obA.xorKey.Bytes(), obB.xorKey.Bytes()
+    if !bytes.Equal(keyA, keyB) {
+        t.Fatal("the two ends derived different keys")
+    }
+    if bytes.Equal(keyA, before) || len(keyA) != xorKeySize {
+        t.Fatalf("key not replaced: %x", keyA)
+    }
+    if !bytes.Equal(a.obfuscator.xorKey.Bytes(), before) {
+        t.Fatal("the VPN-wide key was replaced")
+    }
+    
+    // Each side decodes the other's packets
+    packet := []byte("hello through the tunnel")
+    obA.Configure(ObfuscationXOR, nil)
+    obB.Configure(ObfuscationXOR, nil)
+    if got, err := obB.DeobfuscatePacket(obA.ObfuscatePacket(packet)); err != nil || !bytes.Equal(got, packet) {
+        t.Fatalf("got %q, %v", got, err)
+    }
+}
+
+func TestNegotiateCapabilitiesKeysEachPeer(t *testing.T) {
+    hub, b, hubPeerB, bPeer := keyExchangePair(t, true)
+    
+    c, hubPeerC, cPeer := addSpoke(t, hub, true)
+    negotiatePair(t, hub, b, hubPeerB, bPeer)
+    negotiatePair(t, hub, c, hubPeerC, cPeer)
+    
+    toB, toC := peerObfuscator(t, hub, hubPeerB), peerObfuscator(t, hub, hubPeerC)
+    if toB == toC || bytes.Equal(toB.xorKey.Bytes(), toC.xorKey.Bytes()) {
+        t.Fatal("both peers share one key")
+    }
+    
+    // Negotiating with c left the key agreed with b in place
+    packet := []byte("hello through the tunnel")
+    for _, ob := range []*Obfuscator{toB, toC, peerObfuscator(t, b, bPeer), peerObfuscator(t, c, cPeer)} {
+        ob.Configure(ObfuscationXOR, nil)
+    }
+    if got, err := peerObfuscator(t, b, bPeer).DeobfuscatePacket(toB.ObfuscatePacket(packet)); err != nil || !bytes.Equal(got, packet) {
+        t.Fatalf("b got %q, %v", got, err)
+    }
+    if got, err := peerObfuscator(t, c, cPeer).DeobfuscatePacket(toC.ObfuscatePacket(packet)); err != nil || !bytes.Equal(got, packet) {
+        t.Fatalf("c got %q, %v", got, err)
+    }
+    if got, _ := peerObfuscator(t, c, cPeer).DeobfuscatePacket(toB.ObfuscatePacket(packet)); bytes.Equal(got, packet) {
+        t.Fatal("c decoded a packet meant for b")
+    }
+}
+
+func TestDeriveObfuscationKeyInputs(t *testing.T) {
+    privA, privB := mustKey(t), mustKey(t)
+    nonceI, nonceR := bytes.Repeat([]byte{1}, obfuscationNonceSize), bytes.Repeat([]byte{2}, obfuscationNonceSize)
+    
+    derive := func(priv, peer wgtypes.Key, psk *Secret, i, r []byte) []byte {
+        t.Helper()
+        key, err := deriveObfuscationKey(SecretFromKey(priv), peer, psk, i, r)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return key
+    }
+    
+    // Same inputs from either end give the same key
+    key := derive(privA, privB.PublicKey(), nil, nonceI, nonceR)
+    if !bytes.Equal(key, derive(privB, privA.PublicKey(), nil, nonceI, nonceR)) {
+        t.Fatal("ends disagree")
+    }
+    
+    // Every input matters, including which nonce came from whom
+    for name, other := range map[string][]byte{
+        "swapped nonces": derive(privA, privB.PublicKey(), nil, nonceR, nonceI),
+        "other peer":     derive(privA, mustKey(t).PublicKey(), nil, nonceI, nonceR),
+        "preshared key":  derive(privA, privB.PublicKey(), NewSecret(nonceI), nonceI, nonceR),
+    } {
+        if bytes.Equal(key, other) {
+            t.Errorf("%s gave the same key", name)
+        }
+    }
+}
+
+func TestNegotiateCapabilitiesKeepsKeyWithoutExchange(t *testing.T) {
+    a, b, aPeer, bPeer := keyExchangePair(t, true)
+    b.config.ObfuscationKeyExchange = false
+    before := append([]byte(nil), a.obfuscator.xorKey.Bytes()...)
+    
+    local, other := net.Pipe()
+    defer local.Close()
+    defer other.Close()
+    go b.NegotiateCapabilities(bPeer, other, false)
+    if err := a.NegotiateCapabilities(aPeer, local, true); err != nil {
+        t.Fatal(err)
+    }
+    if ob := peerObfuscator(t, a, aPeer); ob != a.obfuscator || !bytes.Equal(ob.xorKey.Bytes(), before) {
+        t.Fatal("key replaced though the responder did not take part")
+    }
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    DefaultPortalProbeURL = "http://connectivitycheck.gstatic.com/generate_204"
+    DefaultPortalWindow   = 5 * time.Minute
+    DefaultPortalCheck    = 10 * time.Second
+)
+
+// Tests replace these
+var (
+    currentNetwork = defaultRouteNetwork
+    localResolvers = resolvConfServers
+    resolvePortal  = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+        return net.DefaultResolver.LookupIPAddr(ctx, host)
+    }
+)
+
+// CaptivePortalConfig lets a hotel or airport captive portal through the
+// kill switch. It relaxes protection, so it is off unless Enabled is set.
+type CaptivePortalConfig struct {
+    Enabled       bool
+    ProbeURL      string        // must answer 204 when online, default DefaultPortalProbeURL
+    Window        time.Duration // longest portal mode lasts, default DefaultPortalWindow
+    CheckInterval time.Duration // default DefaultPortalCheck
+    DNSServers    []string      // resolvers on the local network, default from /etc/resolv.conf
+}
+
+func (c CaptivePortalConfig) withDefaults() CaptivePortalConfig {
+    if c.ProbeURL == "" {
+        c.ProbeURL = DefaultPortalProbeURL
+    }
+    if c.Window <= 0 {
+        c.Window = DefaultPortalWindow
+    }
+    if c.CheckInterval <= 0 {
+        c.CheckInterval = DefaultPortalCheck
+    }
+    return c
+}
+
+// CaptivePortalStatus is reported in Status
+type CaptivePortalStatus struct {
+    Open   bool // portal mode, the kill switch has exceptions
+    Portal string
+    Until  time.Time
+}
+
+// CaptivePortalGuard watches for a captive portal when no peer completes a
+// handshake on a network we haven't connected from yet. If the probe URL is
+// intercepted, portal mode accepts HTTP and HTTPS to the portal's addresses
+// and DNS to the local resolvers until the probe gets through or Window
+// passes; then the exceptions are removed and WireGuard resumes handshaking.
+type CaptivePortalGuard struct {
+    vpn    *UnderTheRadarVPN
+    cfg    CaptivePortalConfig
+    client *http.Client
+    
+    mu      sync.Mutex
+    checked string   // network already probed or connected from
+    portal  string
+    rules   []string // kill switch exceptions while in portal mode
+    until   time.Time
+    
+    stop     chan struct{}
+    stopOnce sync.Once
+    done     chan struct{}
+}
+
+func NewCaptivePortalGuard(vpn *UnderTheRadarVPN, cfg CaptivePortalConfig) *CaptivePortalGuard {
+    return &CaptivePortalGuard{
+        vpn: vpn,
+        cfg: cfg.withDefaults(),
+        client: &http.Client{
+            Timeout: 5 * time.Second,
+            // The redirect is the answer, don't follow it
+            CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+        },
+        stop: make(chan struct{}),
+        done: make(chan struct{}),
+    }
+}
+
+func (g *CaptivePortalGuard) Start() {
+    defer close(g.done)
+    
+    ticker := g.vpn.clock().NewTicker(g.cfg.CheckInterval)
+    defer ticker.Stop()
+    
+    for {
+        select {
+        case now := <-ticker.C():
+            g.check(now)
+        case <-g.stop:
+            return
+        }
+    }
+}
+
+// Stop ends watching and leaves portal mode
+func (g *CaptivePortalGuard) Stop() {
+    g.stopOnce.Do(func() { close(g.stop) })
+    <-g.done
+    g.close("stopped")
+}
+
+func (g *CaptivePortalGuard) Status() CaptivePortalStatus {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    
+    return CaptivePortalStatus{
+        Open:   g.rules != nil,
+        Portal: g.portal,
+        Until:  g.until,
+    }
+}
+
+func (g *CaptivePortalGuard) check(now time.Time) {
+    g.mu.Lock()
+    open, until := g.rules != nil, g.until
+    g.mu.Unlock()
+    
+    if open {
+        if now.After(until) {
+            g.close("window expired")
+            return
+        }
+        if portal, err := detectCaptivePortal(g.client, g.cfg.ProbeURL); err == nil && portal == "" {
+            g.close("connectivity confirmed")
+        }
+        return
+    }
+    
+    network, err := currentNetwork()
+    if err != nil {
+        return
+    }
+    if g.handshaking() {
+        g.mu.Lock()
+        g.checked = network
+        g.mu.Unlock()
+        return
+    }
+    
+    // Handshakes fail on a fresh network, probe it once
+    g.mu.Lock()
+    fresh := network != g.checked
+    g.checked = network
+    g.mu.Unlock()
+    if !fresh {
+        return
+    }
+    
+    portal, err := detectCaptivePortal(g.client, g.cfg.ProbeURL)
+    if err != nil || portal == "" {
+        return
+    }
+    g.vpn.emitEvent(Event{Type: EventCaptivePortal, Message: fmt.Sprintf("captive portal detected on %s at %s", network, portal)})
+    if err := g.open(portal, now); err != nil {
+        g.vpn.emitEvent(Event{Type: EventCaptivePortal, Message: err.Error()})
+    }
+}
+
+// Whether any peer completed a handshake recently. A device without peers
+// has nothing to judge, so it counts as handshaking.
+func (g *CaptivePortalGuard) handshaking() bool {
+    device, err := g.vpn.wgClient.Device(g.vpn.deviceName)
+    if err != nil {
+        return true
+    }
+    if len(device.Peers) == 0 {
+        return true
+    }
+    now := g.vpn.clock().Now()
+    for _, peer := range device.Peers {
+        if now.Sub(peer.LastHandshakeTime) < RejectAfterTime {
+            return true
+        }
+    }
+    return false
+}
+
+// Enter portal mode. Without the kill switch nothing blocks the portal and
+// only the event is raised.
+func (g *CaptivePortalGuard) open(portal string, now time.Time) error {
+    if !g.vpn.killSwitch.enabled.Load() {
+        return nil
+    }
+    
+    uplink, err := uplinkInterface()
+    if err != nil {
+        return fmt.Errorf("failed to find uplink interface: %w", err)
+    }
+    resolvers := g.cfg.DNSServers
+    if len(resolvers) == 0 {
+        if resolvers, err = localResolvers(); err != nil {
+            return fmt.Errorf("failed to find local resolvers: %w", err)
+        }
+    }
+    
+    // DNS first so the portal's name resolves
+    var added []string
+    for _, server := range resolvers {
+        ip := net.ParseIP(server)
+        if ip == nil {
+            continue
+        }
+        for _, proto := range []string{"udp", "tcp"} {
+            rule := fmt.Sprintf("%s -I OUTPUT -o %s -d %s -p %s --dport 53 -j ACCEPT", iptablesFor(ip), uplink, ip, proto)
+            if added, err = g.apply(added, rule); err != nil {
+                return err
+            }
+        }
+    }
+    
+    addrs, err := portalAddrs(portal)
+    if err != nil {
+        g.vpn.commands.removeIPTablesRules(added)
+        return err
+    }
+    for _, ip := range addrs {
+        rule := fmt.Sprintf("%s -I OUTPUT -o %s -d %s -p tcp -m multiport --dports 80,443 -j ACCEPT", iptablesFor(ip), uplink, ip)
+        if added, err = g.apply(added, rule); err != nil {
+            return err
+        }
+    }
+    
+    g.mu.Lock()
+    g.rules = added
+    g.portal = portal
+    g.until = now.Add(g.cfg.Window)
+    until := g.until
+    g.mu.Unlock()
+    
+    g.vpn.emitEvent(Event{Type: EventCaptivePortal, Message: fmt.Sprintf("portal mode: HTTP/HTTPS to %v allowed on %s until %s", addrs, uplink, until.Format(time.TimeOnly))})
+    return nil
+}
+
+// Add rule to those already added, removing all of them on failure
+func (g *CaptivePortalGuard) apply(added []string, rule string) ([]string, error) {
+    if err := g.vpn.commands.Run(rule); err != nil {
+        g.vpn.commands.removeIPTablesRules(added)
+        return nil, fmt.Errorf("failed to add rule %s: %w", rule, err)
+    }
+    return append(added, rule), nil
+}
+
+// Leave portal mode, the kill switch is whole again
+func (g *CaptivePortalGuard) close(reason string) {
+    g.mu.Lock()
+    rules := g.rules
+    g.rules = nil
+    g.portal = ""
+    g.until = time.Time{}
+    g.mu.Unlock()
+    
+    if rules == nil {
+        return
+    }
+    message := "portal mode ended, " + reason
+    if err := g.vpn.commands.removeIPTablesRules(rules); err != nil {
+        message += ": " + err.Error()
+    }
+    g.vpn.emitEvent(Event{Type: EventCaptivePortal, Message: message})
+}
+
+// Fetch probeURL without following redirects. An empty portal means we are
+// online; a redirect names the portal, any other answer means the probe
+// itself was intercepted.
+func detectCaptivePortal(client *http.Client, probeURL string) (portal string, err error) {
+    resp, err := client.Get(probeURL)
+    if err != nil {
+        return "", fmt.Errorf("failed to probe %s: %w", probeURL, err)
+    }
+    resp.Body.Close()
+    
+    if resp.StatusCode == http.StatusNoContent {
+        return "", nil
+    }
+    if location, err := resp.Location(); err == nil {
+        return location.String(), nil
+    }
+    return probeURL, nil
+}
+
+// Addresses the portal URL's host resolves to
+func portalAddrs(portal string) ([]net.IP, error) {
+    u, err := url.Parse(portal)
+    if err != nil {
+        return nil, fmt.Errorf("invalid portal URL %s: %w", portal, err)
+    }
+    if ip := net.ParseIP(u.Hostname()); ip != nil {
+        return []net.IP{ip}, nil
+    }
+    
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    addrs, err := resolvePortal(ctx, u.Hostname())
+    if err != nil {
+        return nil, fmt.Errorf("failed to resolve portal %s: %w", u.Hostname(), err)
+    }
+    ips := make([]net.IP, len(addrs))
+    for i, addr := range addrs {
+        ips[i] = addr.IP
+    }
+    return ips, nil
+}
+
+func iptablesFor(ip net.IP) string {
+    if ip.To4() != nil {
+        return "iptables"
+    }
+    return "ip6tables"
+}
+
+// Nameservers from /etc/resolv.conf, or from the original while we have
+// replaced it. Loopback stubs are skipped, the kill switch already lets lo
+// through.
+func resolvConfServers() ([]string, error) {
+    data, err := os.ReadFile(resolvConfPath)
+    if err != nil {
+        return nil, err
+    }
+    if backup, err := os.ReadFile(resolvConfBackupPath()); err == nil && bytes.HasPrefix(data, []byte(resolvConfMarker)) {
+        var original resolvConfBackup
+        if json.Unmarshal(backup, &original) == nil && original.Link == "" {
+            data = original.Content
+        }
+    }
+    
+    var servers []string
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) < 2 || fields[0] != "nameserver" {
+            continue
+        }
+        if ip := net.ParseIP(fields[1]); ip != nil && !ip.IsLoopback() {
+            servers = append(servers, fields[1])
+        }
+    }
+    return servers, scanner.Err()
+}
+
+func (vpn *UnderTheRadarVPN) startCaptivePortal(cfg CaptivePortalConfig) {
+    g := NewCaptivePortalGuard(vpn, cfg)
+    vpn.mu.Lock()
+    vpn.captivePortal = g
+    vpn.mu.Unlock()
+    go g.Start()
+}
+
+func (vpn *UnderTheRadarVPN) stopCaptivePortal() {
+    vpn.mu.Lock()
+    g := vpn.captivePortal
+    vpn.captivePortal = nil
+    vpn.mu.Unlock()
+    
+    if g != nil {
+        g.Stop()
+    }
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+    "context"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// A network behind a portal: the probe is redirected until online is set
+func newFakePortal(t *testing.T) (*httptest.Server, *atomic.Bool, *atomic.Int32) {
+    t.Helper()
+    
+    var online atomic.Bool
+    var probes atomic.Int32
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        probes.Add(1)
+        if online.Load() {
+            w.WriteHeader(http.StatusNoContent)
+            return
+        }
+        http.Redirect(w, r, "http://portal.hotel.example/login", http.StatusFound)
+    }))
+    t.Cleanup(server.Close)
+    return server, &online, &probes
+}
+
+func installFakeNetwork(t *testing.T, network string) {
+    t.Helper()
+    
+    origNetwork, origResolvers, origResolve, origUplink := currentNetwork, localResolvers, resolvePortal, uplinkInterface
+    currentNetwork = func() (string, error) { return network, nil }
+    localResolvers = func() ([]string, error) { return []string{"192.168.1.1"}, nil }
+    resolvePortal = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+        return []net.IPAddr{{IP: net.ParseIP("10.9.8.7")}}, nil
+    }
+    uplinkInterface = func() (string, error) { return "wlan0", nil }
+    t.Cleanup(func() {
+        currentNetwork, localResolvers, resolvePortal, uplinkInterface = origNetwork, origResolvers, origResolve, origUplink
+    })
+}
+
+// VPN with the kill switch on and one peer that never completed a handshake
+func newPortalVPN(t *testing.T) *UnderTheRadarVPN {
+    t.Helper()
+    
+    wg := newFakeWGClient()
+    wg.setPeer("utr0", wgtypes.Peer{PublicKey: mustKey(t).PublicKey()})
+    vpn := newTestVPN(t, wg)
+    vpn.killSwitch = NewKillSwitch("utr0")
+    if err := vpn.killSwitch.Enable(); err != nil {
+        t.Fatal(err)
+    }
+    return vpn
+}
+
+func portalRules(host *fakeHost) []string {
+    host.mu.Lock()
+    defer host.mu.Unlock()
+    
+    var rules []string
+    for rule := range host.rules {
+        if strings.Contains(rule, "wlan0") {
+            rules = append(rules, rule)
+        }
+    }
+    return rules
+}
+
+func TestCaptivePortalModeUntilOnline(t *testing.T) {
+    host := installFakeHost(t, "")
+    installFakeNetwork(t, "wlan0 via 192.168.1.1")
+    server, online, _ := newFakePortal(t)
+    
+    vpn := newPortalVPN(t)
+    g := NewCaptivePortalGuard(vpn, CaptivePortalConfig{Enabled: true, ProbeURL: server.URL})
+    
+    g.check(time.Now())
+    status := g.Status()
+    if !status.Open || status.Portal != "http://portal.hotel.example/login" {
+        t.Fatalf("status %+v, want portal mode", status)
+    }
+    
+    // DNS to the local resolver and web to the portal, nothing else
+    want := map[string]bool{
+        "iptables OUTPUT -o wlan0 -d 192.168.1.1 -p udp --dport 53 -j ACCEPT":                  true,
+        "iptables OUTPUT -o wlan0 -d 192.168.1.1 -p tcp --dport 53 -j ACCEPT":                  true,
+        "iptables OUTPUT -o wlan0 -d 10.9.8.7 -p tcp -m multiport --dports 80,443 -j ACCEPT": true,
+    }
+    rules := portalRules(host)
+    if len(rules) != len(want) {
+        t.Fatalf("portal rules %v", rules)
+    }
+    for _, rule := range rules {
+        if !want[rule] {
+            t.Fatalf("unexpected rule %q", rule)
+        }
+    }
+    
+    // Still behind the portal
+    g.check(time.Now())
+    if !g.Status().Open {
+        t.Fatal("portal mode ended before connectivity")
+    }
+    
+    online.Store(true)
+    g.check(time.Now())
+    if g.Status().Open || len(portalRules(host)) != 0 {
+        t.Fatalf("portal mode still open, rules %v", portalRules(host))
+    }
+    if !vpn.killSwitch.enabled.Load() || host.rules["iptables OUTPUT -j DROP"] != 1 {
+        t.Fatal("kill switch not intact after portal mode")
+    }
+    
+    var messages []string
+    for len(vpn.events) > 0 {
+        ev := <-vpn.events
+        if ev.Type != EventCaptivePortal {
+            t.Fatalf("unexpected event %v", ev.Type)
+        }
+        messages = append(messages, ev.Message)
+    }
+    if len(messages) != 3 || !strings.Contains(messages[2], "connectivity confirmed") {
+        t.Fatalf("events %q, want detected, opened, ended", messages)
+    }
+}
+
+func TestCaptivePortalWindowExpires(t *testing.T) {
+    host := installFakeHost(t, "")
+    installFakeNetwork(t, "wlan0 via 192.168.1.1")
+    server, _, probes := newFakePortal(t)
+    
+    vpn := newPortalVPN(t)
+    g := NewCaptivePortalGuard(vpn, CaptivePortalConfig{Enabled: true, ProbeURL: server.URL, Window: time.Minute})
+    
+    now := time.Now()
+    g.check(now)
+    if !g.Status().Open {
+        t.Fatal("portal mode not entered")
+    }
+    g.check(now.Add(2 * time.Minute))
+    if g.Status().Open || len(portalRules(host)) != 0 {
+        t.Fatal("portal mode outlived its window")
+    }
+    
+    // The same network is not probed again
+    before := probes.Load()
+    g.check(now.Add(3 * time.Minute))
+    if probes.Load() != before || g.Status().Open {
+        t.Fatal("network re-probed after the window expired")
+    }
+}
+
+func TestCaptivePortalSkippedWhileHandshaking(t *testing.T) {
+    installFakeHost(t, "")
+    installFakeNetwork(t, "wlan0 via 192.168.1.1")
+    server, _, probes := newFakePortal(t)
+    
+    wg := newFakeWGClient()
+    wg.setPeer("utr0", wgtypes.Peer{PublicKey: mustKey(t).PublicKey(), LastHandshakeTime: time.Now()})
+    vpn := newTestVPN(t, wg)
+    vpn.killSwitch = NewKillSwitch("utr0")
+    if err := vpn.killSwitch.Enable(); err != nil {
+        t.Fatal(err)
+    }
+    
+    g := NewCaptivePortalGuard(vpn, CaptivePortalConfig{Enabled: true, ProbeURL: server.URL})
+    g.check(time.Now())
+    if probes.Load() != 0 || g.Status().Open {
+        t.Fatal("probed although the tunnel is up")
+    }
+}
+
+func TestCaptivePortalRollbackOnRuleFailure(t *testing.T) {
+    host := installFakeHost(t, "--dports 80,443")
+    installFakeNetwork(t, "wlan0 via 192.168.1.1")
+    server, _, _ := newFakePortal(t)
+    
+    vpn := newPortalVPN(t)
+    g := NewCaptivePortalGuard(vpn, CaptivePortalConfig{Enabled: true, ProbeURL: server.URL})
+    g.check(time.Now())
+    if g.Status().Open || len(portalRules(host)) != 0 {
+        t.Fatalf("partial portal rules left behind: %v", portalRules(host))
+    }
+}
+
+func TestDetectCaptivePortal(t *testing.T) {
+    tests := []struct {
+        name    string
+        handler http.HandlerFunc
+        portal  bool
+    }{
+        {"online", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }, false},
+        {"redirect", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/login", http.StatusFound) }, true},
+        {"rewritten", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("<html>sign in</html>")) }, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            server := httptest.NewServer(tt.handler)
+            defer server.Close()
+            
+            g := NewCaptivePortalGuard(nil, CaptivePortalConfig{})
+            portal, err := detectCaptivePortal(g.client, server.URL)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if (portal != "") != tt.portal {
+                t.Fatalf("portal %q, want detected=%v", portal, tt.portal)
+            }
+        })
+    }
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "sync"
+    "sync/atomic"
+    
+    "github.com/cilium/ebpf"
+)
+
+// Rules the kernel classifier holds, SPLIT_MAX_RULES
+const maxSplitRules = 32
+
+var (
+    ErrClassifierExists   = errors.New("a classifier with this name exists")
+    ErrClassifierNotFound = errors.New("no classifier with this name")
+)
+
+// Decision is what a Classifier does with a flow. The values are shared
+// with the kernel rules.
+type Decision uint8
+
+const (
+    DecisionNone   Decision = iota // no opinion, the next classifier decides
+    DecisionTunnel                 // through the tunnel even if other rules bypass it
+    DecisionBypass                 // around the tunnel
+)
+
+// PacketMeta is what a classifier sees of the first packet of a flow
+type PacketMeta struct {
+    Flow   Flow
+    DSCP   uint8
+    Length int // IP packet, headers included
+}
+
+// Classifier picks the path of a flow from its first packet, the decision
+// then holds for the whole flow. Classifiers are consulted in the order
+// they were added until one decides.
+//
+// PortRangeClassifier and DSCPClassifier also run in the kernel when the
+// eBPF programs are loaded. Every other classifier, SizeClassifier and
+// custom ones included, only applies to flows routed in userspace.
+type Classifier interface {
+    Match(pkt PacketMeta) Decision
+}
+
+// PortRangeClassifier matches destination ports, e.g. a game's UDP range
+// or a VoIP port
+type PortRangeClassifier struct {
+    Protocol uint8 // IP protocol, 0 matches TCP and UDP
+    Min, Max uint16
+    Decision Decision
+}
+
+func (c PortRangeClassifier) Match(pkt PacketMeta) Decision {
+    proto := pkt.Flow.Proto
+    if proto != 6 && proto != 17 || c.Protocol != 0 && c.Protocol != proto {
+        return DecisionNone
+    }
+    if pkt.Flow.DstPort < c.Min || pkt.Flow.DstPort > c.Max {
+        return DecisionNone
+    }
+    return c.Decision
+}
+
+// DSCPClassifier matches packets the application marked with one of the
+// DSCP values
+type DSCPClassifier struct {
+    Values   []uint8
+    Decision Decision
+}
+
+func (c DSCPClassifier) Match(pkt PacketMeta) Decision {
+    for _, v := range c.Values {
+        if pkt.DSCP == v {
+            return c.Decision
+        }
+    }
+    return DecisionNone
+}
+
+// SizeClassifier matches flows starting with a small packet, the shape of
+// game state updates and voice frames. Userspace only.
+type SizeClassifier struct {
+    Protocol  uint8 // IP protocol, 0 matches any
+    MaxLength int
+    Decision  Decision
+}
+
+func (c SizeClassifier) Match(pkt PacketMeta) Decision {
+    if c.Protocol != 0 && c.Protocol != pkt.Flow.Proto || pkt.Length > c.MaxLength {
+        return DecisionNone
+    }
+    return c.Decision
+}
+
+// splitRuleEntry mirrors struct split_rule
+type splitRuleEntry struct {
+    Kind     uint8
+    Protocol uint8
+    DSCP     uint8
+    Decision uint8
+    PortMin  uint16
+    PortMax  uint16
+}
+
+const (
+    splitMatchPorts uint8 = iota + 1
+    splitMatchDSCP
+)
+
+// Kernel rules equivalent to a classifier, false if it can't run there
+func kernelSplitRules(c Classifier) ([]splitRuleEntry, bool) {
+    switch c := c.(type) {
+    case PortRangeClassifier:
+        protocols := []uint8{c.Protocol}
+        if c.Protocol == 0 {
+            protocols = []uint8{6, 17}
+        }
+        var rules []splitRuleEntry
+        for _, proto := range protocols {
+            rules = append(rules, splitRuleEntry{Kind: splitMatchPorts, Protocol: proto, Decision: uint8(c.Decision), PortMin: c.Min, PortMax: c.Max})
+        }
+        return rules, true
+    case DSCPClassifier:
+        var rules []splitRuleEntry
+        for _, v := range c.Values {
+            rules = append(rules, splitRuleEntry{Kind: splitMatchDSCP, DSCP: v, Decision: uint8(c.Decision)})
+        }
+        return rules, true
+    }
+    return nil, false
+}
+
+type namedClassifier struct {
+    name    string
+    c       Classifier
+    kernel  bool
+    matched atomic.Uint64 // flows decided in userspace
+}
+
+// classifierSet holds the classifiers in the order they are consulted
+type classifierSet struct {
+    mu   sync.RWMutex
+    list []*namedClassifier
+    
+    kernelNames []string // classifier of each kernel rule
+}
+
+func (cs *classifierSet) match(pkt PacketMeta) Decision {
+    cs.mu.RLock()
+    defer cs.mu.RUnlock()
+    
+    for _, nc := range cs.list {
+        if d := nc.c.Match(pkt); d != DecisionNone {
+            nc.matched.Add(1)
+            return d
+        }
+    }
+    return DecisionNone
+}
+
+// ClassifierStats counts the flows a classifier decided
+type ClassifierStats struct {
+    Matched  uint64 // in userspace and, for InKernel, in the kernel
+    InKernel bool   // compiled to eBPF rules
+}
+
+// AddClassifier consults c after the classifiers already added. Port range
+// and DSCP classifiers are compiled to kernel rules as well, see Classifier.
+func (vpn *UnderTheRadarVPN) AddClassifier(name string, c Classifier) error {
+    rules, kernel := kernelSplitRules(c)
+    for _, r := range rules {
+        if r.Decision != uint8(DecisionTunnel) && r.Decision != uint8(DecisionBypass) {
+            return fmt.Errorf("classifier %s: kernel rules must tunnel or bypass", name)
+        }
+    }
+    
+    vpn.classifiers.mu.Lock()
+    for _, nc := range vpn.classifiers.list {
+        if nc.name == name {
+            vpn.classifiers.mu.Unlock()
+            return fmt.Errorf("%w: %s", ErrClassifierExists, name)
+        }
+    }
+    if kernel && len(vpn.classifiers.kernelNames)+len(rules) > maxSplitRules {
+        vpn.classifiers.mu.Unlock()
+        return fmt.Errorf("classifier %s needs %d kernel rules, %d of %d are left", name,
+            len(rules), maxSplitRules-len(vpn.classifiers.kernelNames), maxSplitRules)
+    }
+    vpn.classifiers.list = append(vpn.classifiers.list, &namedClassifier{name: name, c: c, kernel: kernel})
+    vpn.classifiers.mu.Unlock()
+    
+    if !kernel {
+        return nil
+    }
+    vpn.mu.Lock()
+    defer vpn.mu.Unlock()
+    if err := vpn.writeSplitRules(); err != nil {
+        return err
+    }
+    return vpn.attachSplitClassifier()
+}
+
+// RemoveClassifier stops consulting the classifier. Flows it decided keep
+// their path until they go idle.
+func (vpn *UnderTheRadarVPN) RemoveClassifier(name string) error {
+    vpn.classifiers.mu.Lock()
+    found := false
+    for i, nc := range vpn.classifiers.list {
+        if nc.name == name {
+            vpn.classifiers.list = append(vpn.classifiers.list[:i], vpn.classifiers.list[i+1:]...)
+            found = true
+            break
+        }
+    }
+    vpn.classifiers.mu.Unlock()
+    if !found {
+        return fmt.Errorf("%w: %s", ErrClassifierNotFound, name)
+    }
+    
+    vpn.mu.Lock()
+    defer vpn.mu.Unlock()
+    return vpn.writeSplitRules()
+}
+
+// ClassifierStats returns the counters of every classifier by name, to
+// check rules are matching
+func (vpn *UnderTheRadarVPN) ClassifierStats() (map[string]ClassifierStats, error) {
+    vpn.classifiers.mu.RLock()
+    defer vpn.classifiers.mu.RUnlock()
+    
+    stats := make(map[string]ClassifierStats)
+    for _, nc := range vpn.classifiers.list {
+        stats[nc.name] = ClassifierStats{Matched: nc.matched.Load(), InKernel: nc.kernel}
+    }
+    
+    m, ok := vpn.ebpfMaps["split_stats"]
+    if !ok {
+        return stats, nil
+    }
+    for i, name := range vpn.classifiers.kernelNames {
+        var perCPU []uint64
+        if err := m.Lookup(uint32(i), &perCPU); err != nil {
+            return stats, fmt.Errorf("failed to read classifier counters: %w", err)
+        }
+        s := stats[name]
+        for _, n := range perCPU {
+            s.Matched += n
+        }
+        stats[name] = s
+    }
+    return stats, nil
+}
+
+// Compile the kernel-capable classifiers into split_rules. Counters of the
+// rules restart as their indexes change.
+func (vpn *UnderTheRadarVPN) writeSplitRules() error {
+    vpn.classifiers.mu.Lock()
+    defer vpn.classifiers.mu.Unlock()
+    
+    var rules []splitRuleEntry
+    var names []string
+    for _, nc := range vpn.classifiers.list {
+        compiled, _ := kernelSplitRules(nc.c)
+        for _, r := range compiled {
+            rules = append(rules, r)
+            names = append(names, nc.name)
+        }
+    }
+    vpn.classifiers.kernelNames = names
+    
+    rulesMap, ok := vpn.ebpfMaps["split_rules"]
+    if !ok {
+        return nil
+    }
+    configMap, ok := vpn.ebpfMaps["split_config"]
+    if !ok {
+        return nil
+    }
+    for i, r := range rules {
+        if err := rulesMap.Put(uint32(i), r); err != nil {
+            return fmt.Errorf("failed to update split rules: %w", err)
+        }
+    }
+    if err := configMap.Put(uint32(0), uint32(len(rules))); err != nil {
+        return fmt.Errorf("failed to update split config: %w", err)
+    }
+    if statsMap, ok := vpn.ebpfMaps["split_stats"]; ok {
+        for i := uint32(0); i < maxSplitRules; i++ {
+            var perCPU []uint64
+            if err := statsMap.Lookup(i, &perCPU); err != nil {
+                return fmt.Errorf("failed to read classifier counters: %w", err)
+            }
+            if err := statsMap.Put(i, make([]uint64, len(perCPU))); err != nil {
+                return fmt.Errorf("failed to reset classifier counters: %w", err)
+            }
+        }
+    }
+    return nil
+}
+
+// Hook the split programs into the firewall once the eBPF programs are
+// attached and there is a kernel rule for them to run
+func (vpn *UnderTheRadarVPN) attachSplitClassifier() error {
+    if vpn.splitBypassProg == nil || vpn.ebpfInterface == "" || vpn.splitTunnel == nil || vpn.splitTunnel.classifying() {
+        return nil
+    }
+    vpn.classifiers.mu.RLock()
+    rules := len(vpn.classifiers.kernelNames)
+    vpn.classifiers.mu.RUnlock()
+    if rules == 0 {
+        return nil
+    }
+    
+    pinDir := filepath.Join(bpffsRoot, vpn.deviceName)
+    var pins []string
+    for _, p := range []struct {
+        name string
+        prog *ebpf.Program
+    }{
+        {"split_bypass", vpn.splitBypassProg},
+        {"split_tunnel", vpn.splitTunnelProg},
+    } {
+        pinPath := filepath.Join(pinDir, p.name)
+        os.Remove(pinPath)
+        if err := p.prog.Pin(pinPath); err != nil {
+            return fmt.Errorf("failed to pin %s program: %w", p.name, err)
+        }
+        pins = append(pins, pinPath)
+    }
+    return vpn.splitTunnel.attachClassifier(pins[0], pins[1])
+}
+
+// steerFlow is routeFlow for a packet the classifiers see first. A flow
+// they bypass gets no peer. The decision is kept with the flow, so its
+// later packets don't go through the classifiers again.
+func (vpn *UnderTheRadarVPN) steerFlow(pkt PacketMeta) (*Peer, *net.UDPAddr, bool) {
+    now := vpn.clock().Now()
+    decision, ok := vpn.flowPins.decision(pkt.Flow, now)
+    if !ok {
+        decision = vpn.classifiers.match(pkt)
+        vpn.flowPins.decide(pkt.Flow, decision, now)
+    }
+    if decision == DecisionBypass {
+        return nil, nil, true
+    }
+    peer, endpoint := vpn.routeFlow(pkt.Flow)
+    return peer, endpoint, false
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+    "errors"
+    "net"
+    "strings"
+    "testing"
+)
+
+func TestBuiltinClassifiers(t *testing.T) {
+    game := Flow{SrcIP: net.IPv4(10, 0, 0, 2), DstIP: net.IPv4(203, 0, 113, 5), Proto: 17, SrcPort: 50000, DstPort: 27015}
+    web := Flow{SrcIP: net.IPv4(10, 0, 0, 2), DstIP: net.IPv4(203, 0, 113, 5), Proto: 6, SrcPort: 50001, DstPort: 443}
+    
+    for _, tt := range []struct {
+        name string
+        c    Classifier
+        pkt  PacketMeta
+        want Decision
+    }{
+        {"port in range", PortRangeClassifier{Protocol: 17, Min: 27000, Max: 27100, Decision: DecisionBypass}, PacketMeta{Flow: game}, DecisionBypass},
+        {"other protocol", PortRangeClassifier{Protocol: 6, Min: 27000, Max: 27100, Decision: DecisionBypass}, PacketMeta{Flow: game}, DecisionNone},
+        {"port outside range", PortRangeClassifier{Min: 27000, Max: 27100, Decision: DecisionBypass}, PacketMeta{Flow: web}, DecisionNone},
+        {"dscp", DSCPClassifier{Values: []uint8{46, 34}, Decision: DecisionBypass}, PacketMeta{Flow: web, DSCP: 34}, DecisionBypass},
+        {"other dscp", DSCPClassifier{Values: []uint8{46}, Decision: DecisionBypass}, PacketMeta{Flow: web, DSCP: 0}, DecisionNone},
+        {"small packet", SizeClassifier{Protocol: 17, MaxLength: 200, Decision: DecisionBypass}, PacketMeta{Flow: game, Length: 120}, DecisionBypass},
+        {"large packet", SizeClassifier{Protocol: 17, MaxLength: 200, Decision: DecisionBypass}, PacketMeta{Flow: game, Length: 1400}, DecisionNone},
+    } {
+        if got := tt.c.Match(tt.pkt); got != tt.want {
+            t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestSteerFlowCachesDecisions(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    clock := NewFakeClock(vpn.clock().Now())
+    vpn.timeSource = clock
+    tunnel := PeerConfig{PublicKey: mustKey(t).PublicKey(), AllowedIPs: []net.IPNet{mustCIDR(t, "0.0.0.0/0")}}
+    if err := vpn.AddPeer(tunnel); err != nil {
+        t.Fatal(err)
+    }
+    vpn.peers.get(tunnel.PublicKey).IsAlive.Store(true)
+    
+    // The VoIP range goes through the tunnel even though small UDP bypasses it
+    for _, c := range []struct {
+        name string
+        c    Classifier
+    }{
+        {"voip", PortRangeClassifier{Protocol: 17, Min: 5060, Max: 5061, Decision: DecisionTunnel}},
+        {"games", PortRangeClassifier{Protocol: 17, Min: 27000, Max: 27100, Decision: DecisionBypass}},
+        {"small-udp", SizeClassifier{Protocol: 17, MaxLength: 200, Decision: DecisionBypass}},
+    } {
+        if err := vpn.AddClassifier(c.name, c.c); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := vpn.AddClassifier("games", DSCPClassifier{}); !errors.Is(err, ErrClassifierExists) {
+        t.Fatalf("duplicate name: %v", err)
+    }
+    
+    flow := func(port uint16) Flow {
+        return Flow{SrcIP: net.IPv4(10, 0, 0, 2), DstIP: net.IPv4(203, 0, 113, 5), Proto: 17, SrcPort: 40000 + port%1000, DstPort: port}
+    }
+    steer := func(pkt PacketMeta) bool {
+        t.Helper()
+        peer, _, bypass := vpn.steerFlow(pkt)
+        if !bypass && (peer == nil || peer.PublicKey != tunnel.PublicKey) {
+            t.Fatalf("tunneled flow to port %d not routed", pkt.Flow.DstPort)
+        }
+        return bypass
+    }
+    
+    if !steer(PacketMeta{Flow: flow(27015), Length: 1200}) {
+        t.Fatal("game flow should bypass")
+    }
+    if steer(PacketMeta{Flow: flow(5060), Length: 100}) {
+        t.Fatal("VoIP flow should stay in the tunnel")
+    }
+    if !steer(PacketMeta{Flow: flow(3478), Length: 100}) {
+        t.Fatal("small UDP flow should bypass")
+    }
+    if steer(PacketMeta{Flow: flow(443), Length: 1200}) {
+        t.Fatal("undecided flow should use the tunnel")
+    }
+    
+    // Later packets reuse the decision, even of a classifier removed since
+    if err := vpn.RemoveClassifier("games"); err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 3; i++ {
+        if !steer(PacketMeta{Flow: flow(27015), Length: 1200}) {
+            t.Fatal("established game flow moved into the tunnel")
+        }
+    }
+    if steer(PacketMeta{Flow: flow(27016), Length: 1200}) {
+        t.Fatal("new game flow should follow the removal")
+    }
+    clock.Advance(2 * flowPinIdle)
+    if steer(PacketMeta{Flow: flow(27015), Length: 1200}) {
+        t.Fatal("idle flow should be classified afresh")
+    }
+    
+    stats, err := vpn.ClassifierStats()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stats["voip"].Matched != 1 || stats["small-udp"].Matched != 1 || !stats["voip"].InKernel || stats["small-udp"].InKernel {
+        t.Fatalf("stats %+v", stats)
+    }
+    if _, ok := stats["games"]; ok {
+        t.Fatal("removed classifier still reported")
+    }
+    if err := vpn.RemoveClassifier("games"); !errors.Is(err, ErrClassifierNotFound) {
+        t.Fatalf("removing twice: %v", err)
+    }
+}
+
+func TestKernelSplitRules(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    if err := vpn.AddClassifier("dscp", DSCPClassifier{Values: []uint8{46, 34}, Decision: DecisionBypass}); err != nil {
+        t.Fatal(err)
+    }
+    if err := vpn.AddClassifier("voip", PortRangeClassifier{Min: 5060, Max: 5061, Decision: DecisionTunnel}); err != nil {
+        t.Fatal(err)
+    }
+    if err := vpn.AddClassifier("small", SizeClassifier{MaxLength: 100, Decision: DecisionBypass}); err != nil {
+        t.Fatal(err)
+    }
+    
+    // One rule per DSCP value and per protocol of a port range
+    want := []string{"dscp", "dscp", "voip", "voip"}
+    if strings.Join(vpn.classifiers.kernelNames, ",") != strings.Join(want, ",") {
+        t.Fatalf("kernel rules of %v", vpn.classifiers.kernelNames)
+    }
+    rules, _ := kernelSplitRules(PortRangeClassifier{Min: 5060, Max: 5061, Decision: DecisionTunnel})
+    if rules[0] != (splitRuleEntry{Kind: splitMatchPorts, Protocol: 6, Decision: 1, PortMin: 5060, PortMax: 5061}) || rules[1].Protocol != 17 {
+        t.Fatalf("port rules %+v", rules)
+    }
+    
+    if err := vpn.AddClassifier("none", PortRangeClassifier{Min: 1, Max: 2}); err == nil {
+        t.Fatal("kernel classifier without a decision accepted")
+    }
+    many := make([]uint8, maxSplitRules)
+    if err := vpn.AddClassifier("many", DSCPClassifier{Values: many, Decision: DecisionBypass}); err == nil {
+        t.Fatal("more kernel rules than the map holds accepted")
+    }
+}
+
+func TestSplitClassifierRules(t *testing.T) {
+    host := installFakeHost(t, "")
+    st := NewSplitTunnel("utr0")
+    
+    if err := st.attachClassifier("/sys/fs/bpf/undertheradar/utr0/split_bypass", "/sys/fs/bpf/undertheradar/utr0/split_tunnel"); err != nil {
+        t.Fatal(err)
+    }
+    if len(host.rules) != 6 || !st.classifying() {
+        t.Fatalf("rules %v", host.rules)
+    }
+    for rule := range host.rules {
+        if !strings.Contains(rule, "--set-mark") && !strings.Contains(rule, "--restore-mark") {
+            t.Errorf("unexpected rule %s", rule)
+        }
+    }
+    
+    // App policies come after the classifier and are removed on their own
+    if err := st.UpdatePolicy([]AppPolicy{{AppName: "steam", UID: 1002, Via: ViaBypass}}, nil); err != nil {
+        t.Fatal(err)
+    }
+    st.detachClassifier()
+    if len(host.rules) != 2 || st.classifying() {
+        t.Fatalf("rules after detach %v", host.rules)
+    }
+    st.Disable()
+    if len(host.rules) != 0 {
+        t.Fatalf("rules after Disable %v", host.rules)
+    }
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+    "sync"
+    "time"
+)
+
+// Clock is the time source of the background loops, see VPNOptions.Clock.
+// FakeClock stands in for it in tests.
+type Clock interface {
+    Now() time.Time
+    Sleep(d time.Duration)
+    After(d time.Duration) <-chan time.Time
+    NewTicker(d time.Duration) Ticker
+    AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Ticker is a time.Ticker from a Clock
+type Ticker interface {
+    C() <-chan time.Time
+    Stop()
+}
+
+// Timer is a time.Timer from Clock.AfterFunc
+type Timer interface {
+    Stop() bool
+    Reset(d time.Duration) bool
+}
+
+// RealClock is the system clock
+type RealClock struct{}
+
+func (RealClock) Now() time.Time                         { return time.Now() }
+func (RealClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (RealClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (RealClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+func (RealClock) AfterFunc(d time.Duration, f func()) Timer {
+    return time.AfterFunc(d, f)
+}
+
+type realTicker struct{ t *time.Ticker }
+
+func (r realTicker) C() <-chan time.Time { return r.t.C }
+func (r realTicker) Stop()               { r.t.Stop() }
+
+// Components assembled without a constructor run on the system clock
+func orRealClock(c Clock) Clock {
+    if c == nil {
+        return RealClock{}
+    }
+    return c
+}
+
+// FakeClock only moves when Advance is called, firing whatever fell due on
+// the way in order. Ticks nobody received are dropped as with time.Ticker.
+type FakeClock struct {
+    mu      sync.Mutex
+    now     time.Time
+    waiting []*fakeTimer
+}
+
+type fakeTimer struct {
+    clock  *FakeClock
+    at     time.Time
+    period time.Duration // tickers only
+    c      chan time.Time
+    fn     func() // AfterFunc only
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+    return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    return c.now
+}
+
+// Sleep blocks until the clock is advanced past d
+func (c *FakeClock) Sleep(d time.Duration) {
+    <-c.After(d)
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+    return c.schedule(d, 0, nil).c
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+    if d <= 0 {
+        panic("non-positive interval for NewTicker")
+    }
+    return c.schedule(d, d, nil)
+}
+
+// AfterFunc runs f on the goroutine calling Advance
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+    return fakeFuncTimer{c.schedule(d, 0, f)}
+}
+
+func (c *FakeClock) schedule(d, period time.Duration, fn func()) *fakeTimer {
+    t := &fakeTimer{clock: c, period: period, c: make(chan time.Time, 1), fn: fn}
+    c.mu.Lock()
+    t.at = c.now.Add(d)
+    c.waiting = append(c.waiting, t)
+    c.mu.Unlock()
+    
+    // Already due
+    if d <= 0 {
+        c.Advance(0)
+    }
+    return t
+}
+
+// Advance moves the clock forward by d
+func (c *FakeClock) Advance(d time.Duration) {
+    c.mu.Lock()
+    end := c.now.Add(d)
+    for {
+        next := c.nextDueLocked(end)
+        if next == nil {
+            break
+        }
+        at := next.at
+        if at.After(c.now) {
+            c.now = at
+        }
+        if next.period > 0 {
+            next.at = at.Add(next.period)
+        } else {
+            c.removeLocked(next)
+        }
+        
+        // Unlocked so the receiver may use the clock
+        c.mu.Unlock()
+        next.fire(at)
+        c.mu.Lock()
+    }
+    if end.After(c.now) {
+        c.now = end
+    }
+    c.mu.Unlock()
+}
+
+// Earliest timer due by end. Caller holds c.mu.
+func (c *FakeClock) nextDueLocked(end time.Time) *fakeTimer {
+    var next *fakeTimer
+    for _, t := range c.waiting {
+        if !t.at.After(end) && (next == nil || t.at.Before(next.at)) {
+            next = t
+        }
+    }
+    return next
+}
+
+// Whether t was waiting. Caller holds c.mu.
+func (c *FakeClock) removeLocked(t *fakeTimer) bool {
+    for i, w := range c.waiting {
+        if w == t {
+            c.waiting = append(c.waiting[:i], c.waiting[i+1:]...)
+            return true
+        }
+    }
+    return false
+}
+
+func (t *fakeTimer) fire(at time.Time) {
+    if t.fn != nil {
+        t.fn()
+        return
+    }
+    select {
+    case t.c <- at:
+    default:
+    }
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+// Stop for tickers
+func (t *fakeTimer) Stop() {
+    t.stop()
+}
+
+func (t *fakeTimer) stop() bool {
+    t.clock.mu.Lock()
+    defer t.clock.mu.Unlock()
+    
+    return t.clock.removeLocked(t)
+}
+
+// Timer returned by AfterFunc
+type fakeFuncTimer struct{ *fakeTimer }
+
+func (t fakeFuncTimer) Stop() bool { return t.stop() }
+
+func (t fakeFuncTimer) Reset(d time.Duration) bool {
+    c := t.clock
+    c.mu.Lock()
+    active := c.removeLocked(t.fakeTimer)
+    t.at = c.now.Add(d)
+    c.waiting = append(c.waiting, t.fakeTimer)
+    c.mu.Unlock()
+    
+    if d <= 0 {
+        c.Advance(0)
+    }
+    return active
+}
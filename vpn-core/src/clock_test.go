@@ -0,0 +1,85 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestFakeClockFiresInOrder(t *testing.T) {
+    start := time.Unix(1700000000, 0)
+    clock := NewFakeClock(start)
+    
+    var fired []string
+    clock.AfterFunc(3*time.Second, func() { fired = append(fired, "func") })
+    after := clock.After(time.Second)
+    ticker := clock.NewTicker(2 * time.Second)
+    defer ticker.Stop()
+    
+    clock.Advance(time.Second)
+    if at := <-after; !at.Equal(start.Add(time.Second)) {
+        t.Fatalf("After fired at %v", at)
+    }
+    select {
+    case <-ticker.C():
+        t.Fatal("ticker fired early")
+    default:
+    }
+    
+    // Missed ticks are dropped, as with time.Ticker
+    clock.Advance(4 * time.Second)
+    if at := <-ticker.C(); !at.Equal(start.Add(2 * time.Second)) {
+        t.Fatalf("first tick at %v", at)
+    }
+    select {
+    case at := <-ticker.C():
+        t.Fatalf("extra tick at %v", at)
+    default:
+    }
+    if len(fired) != 1 || !clock.Now().Equal(start.Add(5*time.Second)) {
+        t.Fatalf("fired %v, now %v", fired, clock.Now())
+    }
+}
+
+func TestFakeClockTimerStopAndReset(t *testing.T) {
+    clock := NewFakeClock(time.Now())
+    var runs int
+    timer := clock.AfterFunc(time.Minute, func() { runs++ })
+    
+    if !timer.Stop() || timer.Stop() {
+        t.Fatal("Stop should report only the pending timer")
+    }
+    clock.Advance(time.Hour)
+    if runs != 0 {
+        t.Fatal("stopped timer ran")
+    }
+    
+    if timer.Reset(time.Minute) {
+        t.Fatal("Reset of a stopped timer reported it active")
+    }
+    clock.Advance(59 * time.Second)
+    if runs != 0 {
+        t.Fatal("ran before the reset duration")
+    }
+    clock.Advance(time.Second)
+    if runs != 1 {
+        t.Fatalf("%d runs after reset", runs)
+    }
+}
+
+func TestFakeClockSleep(t *testing.T) {
+    clock := NewFakeClock(time.Now())
+    woke := make(chan struct{})
+    go func() {
+        clock.Sleep(time.Hour)
+        close(woke)
+    }()
+    
+    advanceUntil(t, clock, 10*time.Minute, func() bool {
+        select {
+        case <-woke:
+            return true
+        default:
+            return false
+        }
+    })
+}
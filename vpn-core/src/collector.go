@@ -0,0 +1,256 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "sync"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+    DefaultMetricsInterval = 5 * time.Second
+    DefaultFullSyncEvery   = 10
+    DefaultActiveWindow    = 2 * time.Minute
+    DefaultLargeDevice     = 1000
+    
+    // A device missing this long is taken to be gone rather than being
+    // reconfigured, see EventDeviceLost
+    DeviceGoneAfter = 30 * time.Second
+    
+    // Poll interval while the device can't be read, at most Interval
+    deviceRetryInterval = time.Second
+)
+
+// MetricsCollection tunes how peer counters are polled. A full device dump
+// costs every peer's state on every poll, which adds up to megabytes of
+// netlink traffic per interval with thousands of peers.
+//
+// Between full syncs only the peers that were active at the last one are
+// queried, when the WireGuard client can look up peers individually (see
+// peerQuerier). Kernel WireGuard can't, so with wgctrl every poll is a full
+// dump and the interval is stretched instead once the device has more than
+// LargeDevice peers.
+//
+// Either way the numbers can lag: a peer that turns busy between full syncs
+// isn't polled until the next one, and on large devices every peer's load
+// score is up to the stretched interval old.
+type MetricsCollection struct {
+    Interval      time.Duration // default DefaultMetricsInterval
+    FullSyncEvery int           // full dump every Nth poll, default DefaultFullSyncEvery, 1 always dumps
+    ActiveWindow  time.Duration // a handshake this recent counts as active even without traffic
+    LargeDevice   int           // peers per Interval before it is stretched
+}
+
+func (c MetricsCollection) withDefaults() MetricsCollection {
+    if c.Interval <= 0 {
+        c.Interval = DefaultMetricsInterval
+    }
+    if c.FullSyncEvery <= 0 {
+        c.FullSyncEvery = DefaultFullSyncEvery
+    }
+    if c.ActiveWindow <= 0 {
+        c.ActiveWindow = DefaultActiveWindow
+    }
+    if c.LargeDevice <= 0 {
+        c.LargeDevice = DefaultLargeDevice
+    }
+    return c
+}
+
+// peerQuerier is implemented by WireGuard clients that can fetch some peers
+// without dumping the whole device, e.g. a userspace implementation passed
+// in VPNOptions.WGClient
+type peerQuerier interface {
+    Peers(device string, keys []wgtypes.Key) ([]wgtypes.Peer, error)
+}
+
+// CollectionStats shows what polling peer counters costs
+type CollectionStats struct {
+    Interval     time.Duration // current, after stretching for large devices
+    LastDuration time.Duration // of the last poll
+    LastFull     bool          // whether the last poll dumped the device
+    FullSyncs    uint64
+    PartialSyncs uint64
+    ActivePeers  int // polled between full syncs
+}
+
+// MetricsCollector keeps peer counters and load scores current
+type MetricsCollector struct {
+    vpn *UnderTheRadarVPN
+    
+    mu     sync.Mutex
+    cfg    MetricsCollection
+    polls  int
+    active []wgtypes.Key // as of the last full sync
+    stats  CollectionStats
+    
+    stop     chan struct{}
+    stopOnce sync.Once
+}
+
+func NewMetricsCollector(vpn *UnderTheRadarVPN) *MetricsCollector {
+    return &MetricsCollector{
+        vpn:  vpn,
+        cfg:  MetricsCollection{}.withDefaults(),
+        stop: make(chan struct{}),
+    }
+}
+
+func (mc *MetricsCollector) configure(cfg MetricsCollection) {
+    mc.mu.Lock()
+    mc.cfg = cfg.withDefaults()
+    mc.mu.Unlock()
+}
+
+func (mc *MetricsCollector) Start() {
+    clock := mc.vpn.clock()
+    for {
+        select {
+        case <-clock.After(mc.interval()):
+            mc.collect()
+        case <-mc.stop:
+            return
+        }
+    }
+}
+
+func (mc *MetricsCollector) Stop() {
+    mc.stopOnce.Do(func() { close(mc.stop) })
+}
+
+// DevicePollStatus tells whether the metrics polls can read the device.
+// A failed poll is retried after a second; a device missing for
+// DeviceGoneAfter is Gone. Supervisor doesn't wait that long, it rebuilds
+// the tunnel at the first check that misses the device.
+type DevicePollStatus struct {
+    Failures     int       // failed polls in a row, 0 while polls succeed
+    FailingSince time.Time // first of them
+    LastError    string
+    Gone         bool
+}
+
+// Tracks polls of the device, zero value ready
+type devicePoll struct {
+    mu     sync.Mutex
+    status DevicePollStatus
+}
+
+// Device reads the device for a poll and records how it went
+func (vpn *UnderTheRadarVPN) pollDevice() (*wgtypes.Device, error) {
+    device, err := vpn.wgClient.Device(vpn.deviceName)
+    now := vpn.clock().Now()
+    
+    p := &vpn.devicePoll
+    p.mu.Lock()
+    if err == nil {
+        p.status = DevicePollStatus{}
+        p.mu.Unlock()
+        return device, nil
+    }
+    if p.status.Failures == 0 {
+        p.status.FailingSince = now
+    }
+    p.status.Failures++
+    p.status.LastError = err.Error()
+    // Only a missing device counts, other errors say nothing of it
+    lost := !p.status.Gone && errors.Is(err, os.ErrNotExist) && now.Sub(p.status.FailingSince) >= DeviceGoneAfter
+    if lost {
+        p.status.Gone = true
+    }
+    since := p.status.FailingSince
+    p.mu.Unlock()
+    
+    vpn.metricSink().Count("device.poll_failed", 1)
+    if lost {
+        vpn.emitEvent(Event{
+            Type:    EventDeviceLost,
+            Message: fmt.Sprintf("device %s missing since %s: %v", vpn.deviceName, since.Format(time.TimeOnly), err),
+        })
+    }
+    return nil, fmt.Errorf("failed to read device %s: %w", vpn.deviceName, err)
+}
+
+func (vpn *UnderTheRadarVPN) devicePollStatus() DevicePollStatus {
+    vpn.devicePoll.mu.Lock()
+    defer vpn.devicePoll.mu.Unlock()
+    return vpn.devicePoll.status
+}
+
+// Poll once, dumping the device every FullSyncEvery polls or when the
+// client can't query peers individually
+func (mc *MetricsCollector) collect() {
+    // Not held while polling, GetStatus takes vpn.mu before mc.mu
+    mc.mu.Lock()
+    cfg, active := mc.cfg, mc.active
+    querier, targeted := mc.vpn.wgClient.(peerQuerier)
+    full := !targeted || mc.polls%cfg.FullSyncEvery == 0
+    mc.polls++
+    mc.mu.Unlock()
+    
+    start := time.Now()
+    if full {
+        device, err := mc.vpn.pollDevice()
+        if err != nil {
+            // Again at the next poll, which comes sooner while this lasts
+            mc.mu.Lock()
+            mc.polls = 0
+            mc.mu.Unlock()
+            return
+        }
+        active = mc.vpn.applyPeerStats(device.Peers, cfg.ActiveWindow)
+    } else if len(active) > 0 {
+        // Only the peers active at the last full sync
+        peers, err := querier.Peers(mc.vpn.deviceName, active)
+        if err != nil {
+            return
+        }
+        mc.vpn.applyPeerStats(peers, 0)
+    }
+    took := time.Since(start)
+    mc.vpn.collectLinkStats()
+    mc.vpn.reportDeviceMetrics()
+    
+    mc.mu.Lock()
+    defer mc.mu.Unlock()
+    
+    mc.active = active
+    if full {
+        mc.stats.FullSyncs++
+    } else {
+        mc.stats.PartialSyncs++
+    }
+    mc.stats.LastDuration = took
+    mc.stats.LastFull = full
+    mc.stats.ActivePeers = len(active)
+}
+
+// Interval until the next poll. Without targeted queries every poll is a
+// full dump, so it grows with the peer count past LargeDevice.
+func (mc *MetricsCollector) interval() time.Duration {
+    mc.vpn.mu.RLock()
+    peers := mc.vpn.peers.len()
+    mc.vpn.mu.RUnlock()
+    
+    mc.mu.Lock()
+    defer mc.mu.Unlock()
+    
+    interval := mc.cfg.Interval
+    if _, targeted := mc.vpn.wgClient.(peerQuerier); !targeted && peers > mc.cfg.LargeDevice {
+        interval *= time.Duration((peers + mc.cfg.LargeDevice - 1) / mc.cfg.LargeDevice)
+    }
+    if mc.vpn.devicePollStatus().Failures > 0 && interval > deviceRetryInterval {
+        interval = deviceRetryInterval
+    }
+    mc.stats.Interval = interval
+    return interval
+}
+
+// Stats about recent polls
+func (mc *MetricsCollector) Stats() CollectionStats {
+    mc.mu.Lock()
+    defer mc.mu.Unlock()
+    return mc.stats
+}
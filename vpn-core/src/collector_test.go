@@ -0,0 +1,190 @@
+package main
+
+import (
+    "errors"
+    "testing"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// queryingWGClient can fetch single peers, like a userspace implementation
+type queryingWGClient struct {
+    *fakeWGClient
+    dumps   int
+    queried [][]wgtypes.Key
+}
+
+func (q *queryingWGClient) Device(name string) (*wgtypes.Device, error) {
+    q.dumps++
+    return q.fakeWGClient.Device(name)
+}
+
+func (q *queryingWGClient) Peers(device string, keys []wgtypes.Key) ([]wgtypes.Peer, error) {
+    q.queried = append(q.queried, keys)
+    dev, err := q.fakeWGClient.Device(device)
+    if err != nil {
+        return nil, err
+    }
+    var peers []wgtypes.Peer
+    for _, p := range dev.Peers {
+        for _, key := range keys {
+            if p.PublicKey == key {
+                peers = append(peers, p)
+            }
+        }
+    }
+    return peers, nil
+}
+
+func TestMetricsCollectorPollsActivePeersBetweenFullSyncs(t *testing.T) {
+    wg := &queryingWGClient{fakeWGClient: newFakeWGClient()}
+    vpn := newTestVPN(t, wg.fakeWGClient)
+    vpn.wgClient = wg
+    
+    busy := &Peer{PublicKey: mustKey(t).PublicKey()}
+    idle := &Peer{PublicKey: mustKey(t).PublicKey()}
+    vpn.peers.put(busy)
+    vpn.peers.put(idle)
+    wg.setPeer("utr0", wgtypes.Peer{PublicKey: busy.PublicKey, ReceiveBytes: 1000})
+    wg.setPeer("utr0", wgtypes.Peer{PublicKey: idle.PublicKey})
+    
+    mc := NewMetricsCollector(vpn)
+    mc.configure(MetricsCollection{FullSyncEvery: 3})
+    
+    mc.collect()
+    if stats := mc.Stats(); !stats.LastFull || stats.ActivePeers != 1 {
+        t.Fatalf("first poll %+v, want a full sync with one active peer", stats)
+    }
+    
+    // Only the busy peer is followed until the next full sync
+    wg.setPeer("utr0", wgtypes.Peer{PublicKey: busy.PublicKey, ReceiveBytes: 5000})
+    wg.setPeer("utr0", wgtypes.Peer{PublicKey: idle.PublicKey, ReceiveBytes: 700})
+    mc.collect()
+    mc.collect()
+    if wg.dumps != 1 || len(wg.queried) != 2 || len(wg.queried[0]) != 1 || wg.queried[0][0] != busy.PublicKey {
+        t.Fatalf("%d dumps, queried %v", wg.dumps, wg.queried)
+    }
+    if busy.RxBytes.Load() != 5000 || idle.RxBytes.Load() != 0 {
+        t.Fatalf("rx busy %d idle %d", busy.RxBytes.Load(), idle.RxBytes.Load())
+    }
+    
+    mc.collect()
+    stats := mc.Stats()
+    if wg.dumps != 2 || !stats.LastFull || stats.FullSyncs != 2 || stats.PartialSyncs != 2 {
+        t.Fatalf("%d dumps, stats %+v", wg.dumps, stats)
+    }
+    if idle.RxBytes.Load() != 700 || stats.ActivePeers != 1 {
+        t.Fatalf("full sync missed the idle peer waking up: rx %d, stats %+v", idle.RxBytes.Load(), stats)
+    }
+}
+
+func TestMetricsCollectorStretchesIntervalWithoutQueries(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    for i := 0; i < 25; i++ {
+        peer := &Peer{PublicKey: mustKey(t).PublicKey()}
+        vpn.peers.put(peer)
+    }
+    
+    mc := NewMetricsCollector(vpn)
+    mc.configure(MetricsCollection{Interval: time.Second, LargeDevice: 10})
+    if got := mc.interval(); got != 3*time.Second {
+        t.Fatalf("interval = %v, want 3s for 25 peers at 10 per interval", got)
+    }
+    
+    // Every poll has to dump the device
+    wg.setPeer("utr0", wgtypes.Peer{PublicKey: mustKey(t).PublicKey()})
+    mc.collect()
+    mc.collect()
+    if stats := mc.Stats(); stats.FullSyncs != 2 || stats.PartialSyncs != 0 || stats.Interval != 3*time.Second {
+        t.Fatalf("stats %+v", stats)
+    }
+    
+    vpn.metrics = mc
+    if got := vpn.GetStatus().Collection; got != mc.Stats() {
+        t.Fatalf("status %+v", got)
+    }
+}
+
+// flakyWGClient fails the next failures device reads
+type flakyWGClient struct {
+    *fakeWGClient
+    failures int
+}
+
+func (f *flakyWGClient) Device(name string) (*wgtypes.Device, error) {
+    if f.failures > 0 {
+        f.failures--
+        return nil, errors.New("netlink receive: resource temporarily unavailable")
+    }
+    return f.fakeWGClient.Device(name)
+}
+
+func TestMetricsCollectorRecoversFromFailedPoll(t *testing.T) {
+    wg := &flakyWGClient{fakeWGClient: newFakeWGClient(), failures: 1}
+    vpn := newTestVPN(t, wg.fakeWGClient)
+    vpn.wgClient = wg
+    sink := &captureSink{}
+    vpn.SetMetricSink(sink)
+    peer := &Peer{PublicKey: mustKey(t).PublicKey()}
+    vpn.peers.put(peer)
+    wg.setPeer("utr0", wgtypes.Peer{PublicKey: peer.PublicKey, ReceiveBytes: 1000})
+    
+    mc := NewMetricsCollector(vpn)
+    mc.collect()
+    status := vpn.GetStatus().DevicePoll
+    if status.Failures != 1 || status.LastError == "" || status.Gone || !sink.has("c device.poll_failed 1 ") {
+        t.Fatalf("after a failed poll %+v", status)
+    }
+    if got := mc.interval(); got != deviceRetryInterval {
+        t.Fatalf("retrying after %v", got)
+    }
+    
+    mc.collect()
+    if peer.RxBytes.Load() != 1000 || vpn.GetStatus().DevicePoll != (DevicePollStatus{}) {
+        t.Fatalf("rx %d, status %+v", peer.RxBytes.Load(), vpn.GetStatus().DevicePoll)
+    }
+    if got := mc.interval(); got != DefaultMetricsInterval {
+        t.Fatalf("interval %v after recovering", got)
+    }
+}
+
+func TestMetricsCollectorReportsDeviceGone(t *testing.T) {
+    clock := NewFakeClock(time.Unix(1700000000, 0))
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    vpn.timeSource = clock
+    mc := NewMetricsCollector(vpn)
+    
+    // Missing, but not yet for long enough to be gone
+    for i := 0; i < 2; i++ {
+        mc.collect()
+        clock.Advance(DeviceGoneAfter / 2)
+    }
+    if status := vpn.GetStatus().DevicePoll; status.Gone || status.Failures != 2 {
+        t.Fatalf("gone early, %+v", status)
+    }
+    mc.collect()
+    mc.collect()
+    status := vpn.GetStatus().DevicePoll
+    if !status.Gone || status.Failures != 4 {
+        t.Fatalf("status %+v", status)
+    }
+    lost := 0
+    for len(vpn.events) > 0 {
+        if ev := <-vpn.events; ev.Type == EventDeviceLost {
+            lost++
+        }
+    }
+    if lost != 1 {
+        t.Fatalf("%d device lost events", lost)
+    }
+    
+    // Back again, e.g. recreated by a reload
+    wg.setPeer("utr0", wgtypes.Peer{PublicKey: mustKey(t).PublicKey()})
+    mc.collect()
+    if status := vpn.GetStatus().DevicePoll; status.Gone || status.Failures != 0 {
+        t.Fatalf("status after recovery %+v", status)
+    }
+}
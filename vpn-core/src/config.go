@@ -0,0 +1,182 @@
+package main
+
+import (
+    "net"
+    "os"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// VPNConfig holds everything Start needs to bring the tunnel up
+type VPNConfig struct {
+    // Start only records what it would change on the host, see PlanStart
+    DryRun          bool
+    
+    PrivateKey      *Secret // generated when nil
+    ListenPort      int
+    Addresses       []net.IPNet // assigned to a device we create, adopted devices keep theirs
+    Peers           []PeerConfig
+    
+    // Security features
+    KillSwitch      bool
+    KillSwitchVRF   string // limit the kill switch to this VRF
+    KillSwitchContainers bool     // also in Docker containers' network namespaces
+    ContainerExclusions  []string // sandbox keys of containers to leave alone
+    BypassProcesses []string // with KillSwitch, process names allowed around the tunnel, see ProcessBypass
+    KillSwitchAllowEstablished bool // let connections open before the kill switch drain, see KillSwitch.AllowEstablished
+    KillSwitchFailClosed bool // a failed Start leaves the kill switch up, blocking traffic until Stop
+    KillSwitchLAN   []net.IPNet // with KillSwitch, local networks reached outside the tunnel
+    
+    // Put the kill switch, DNS protection and split tunnel marks in one
+    // nftables table replaced atomically, instead of iptables rules each
+    // feature adds on its own. ExitNAT needs it. See NFTPolicy.
+    FirewallBackend FirewallBackend
+    ExitNAT         bool // masquerade traffic clients send through this host as their exit
+    
+    // Insert an input accept rule for the listen port, for hosts with a
+    // default-deny input policy. Off so externally managed firewalls are
+    // left alone.
+    ManageInputPinhole bool
+    
+    // Clamp the MSS of TCP forwarded through the tunnel to what its MTU
+    // carries, for gateways and exit nodes whose clients would otherwise
+    // hang on PMTU black holes. MSS overrides the value derived from the
+    // device MTU, for both IPv4 and IPv6.
+    ClampMSS        bool
+    MSS             int
+    
+    // Let a captive portal through the kill switch while handshakes fail
+    // on a new network; relaxes protection, so opt-in
+    CaptivePortal   CaptivePortalConfig
+    HopPorts        []int // extra ports redirected to ListenPort, for clients using PortHopping; needs a fixed ListenPort
+    
+    // More ports the device receives on, for servers where one port caps
+    // the packet rate because the NIC hashes a few busy clients onto few
+    // RX queues. Clients are spread over the ports; XDP moves their IPv4
+    // packets to ListenPort after RSS and replies leave from the port the
+    // client used. Needs a fixed ListenPort.
+    ListenPorts     []int
+    DNSProtection   bool
+    DNSServers      []string
+    DoHProviders    []string      // DoH URLs in priority order, default from DNSServers
+    BootstrapIPs    map[string]net.IP // DoH provider hostname -> address, dialed without resolving
+    DNSQueryTimeout time.Duration // total per query across providers
+    DNSProxyOnly    bool          // only run the local DoH proxy, no firewall rules
+    DNSListenAddr   string        // DoH proxy address, default 127.0.0.1:53
+    DNSSearchDomains []string     // set on the tunnel interface with the servers
+    DNSSplit        bool          // only resolve DNSSearchDomains through the tunnel, needs systemd-resolved
+    DNSResolver     ResolverMode  // how the system is pointed at DNSServers, default detected
+    SplitTunnelApps []string
+    Proxy           ProxyConfig // SOCKS5/HTTP CONNECT into the tunnel, off when empty
+    UAPI            bool        // serve the wg UAPI on /var/run/wireguard/<device>.sock
+    
+    // Rotate the obfuscation XOR key this often once
+    // StartObfuscationKeyRotation runs, accepting the previous key for
+    // ObfuscationKeyGrace (default 30s) so packets in flight still decode
+    ObfuscationKeyRotation time.Duration
+    ObfuscationKeyGrace    time.Duration
+    
+    // Agree on a fresh obfuscation XOR key in NegotiateCapabilities instead
+    // of distributing one out of band. Both ends need it on, a peer without
+    // it rejects the longer capability offer.
+    ObfuscationKeyExchange bool
+    
+    // Pad, delay and cover obfuscated datagrams against traffic analysis,
+    // for each peer NegotiateCapabilities finds supports it, nil for none
+    TrafficShaping *TrafficShaping
+    
+    // Redirect established flows between the tunnel and the uplink at TC,
+    // bypassing netfilter and routing. Flows that depend on NAT or other
+    // netfilter rules never match the eBPF conntrack and keep the kernel path.
+    FastPathEnabled bool
+    
+    // Glob patterns, such as "eth*", of interfaces besides the uplink to
+    // run the XDP and TC programs on. Matching interfaces are attached as
+    // they come up, a USB tether or a new NIC, and detached when they go
+    // down or away, see InterfaceWatcher.
+    EBPFInterfaces []string
+    
+    // Send the device's packets out of BindInterface with FirewallMark, so
+    // policy routing works alongside other tunnels. The kernel device gets
+    // the mark and a routing table through BindInterface, which therefore
+    // needs the mark. UDPSocket is the socket of a userspace device the
+    // embedding application created; it gets both options, stays open and
+    // must be bound to the listen port. The kill switch lets the marked
+    // packets or, without a mark, the socket's out of BindInterface.
+    BindInterface   string
+    FirewallMark    uint32
+    UDPSocket       *os.File
+    
+    // Take over a device created by wg-quick or NetworkManager instead of
+    // failing because the interface already exists
+    AdoptExisting   bool
+    AdoptConflicts  AdoptConflictPolicy
+    
+    // Take over a device locked by another running instance, adopting it
+    // as with AdoptExisting. The other instance is not stopped.
+    Force           bool
+    
+    // What AddPeer does when two peers claim the same prefix
+    AllowedIPConflicts AllowedIPConflictPolicy
+    
+    // How often peer counters are polled, see MetricsCollection
+    Metrics         MetricsCollection
+    
+    // Span PeerInfo.UptimePercent covers, default DefaultUptimeWindow
+    UptimeWindow    time.Duration
+    
+    // Post peer statistics to monitoring, off without a Secret
+    Webhook         WebhookConfig
+    
+    // Push the metrics to a collector, off without a URL
+    RemoteWrite     RemoteWriteConfig
+    
+    // Publish load and capabilities for clients choosing a server, off
+    // without a ListenAddr
+    ServerStatus    ServerStatusConfig
+    
+    // Worker pool and limits for AdmitPeer, Admit and AllowHandshake
+    Admission       AdmissionConfig
+    
+    // Key and interval SyncPeers fetches the peer list with
+    Coordination    CoordinationConfig
+}
+
+// PeerConfig describes a peer to add to the device
+type PeerConfig struct {
+    PublicKey          wgtypes.Key
+    PresharedKey       *Secret // optional
+    Endpoint           *net.UDPAddr
+    EndpointHost       string // "host:port", overrides Endpoint and follows the DNS record, see endpointResolver
+    AllowedIPs         []net.IPNet
+    Priority           int  // with AutoPriority only the initial value
+    AutoPriority       bool // adjust Priority to latency, loss and spare throughput, see PriorityWeights
+    AlternateEndpoints []net.UDPAddr
+    Group              string // selects the health strategy, see SetHealthStrategy
+    PortHopping        PortHopping
+    PersistentKeepalive time.Duration // 0 disables
+    SkipProbe          bool          // add without a handshake probe, e.g. for roaming mobile peers
+    TURNConfig         *TURNConfig   // relay to Endpoint through a TURN server, see TURNTransport
+    Metadata           PeerMetadata  // for exit selection, see SelectExit
+    Annotations        map[string]string // operator notes such as a customer ID, never sent to the device; see SetPeerAnnotation
+    
+    // Split flows across Endpoint and AlternateEndpoints by 5-tuple hash,
+    // each flow staying on one path; see routeFlow. The kernel device only
+    // ever uses the current Endpoint.
+    FlowSplitting      bool
+    
+    // Where this peer's statistics are posted, see WebhookConfig. Empty
+    // uses WebhookConfig.URL.
+    StatsWebhook       string
+}
+
+// AdoptConflictPolicy decides what happens to peers found on an adopted
+// device that are not part of our configuration
+type AdoptConflictPolicy int
+
+const (
+    AdoptKeepUnknown   AdoptConflictPolicy = iota // import them and keep managing them
+    AdoptRemoveUnknown                            // remove them, our config becomes the peer set
+    AdoptRejectUnknown                            // refuse to adopt the device
+)
@@ -1,19 +1,18 @@
 package main
 
 import (
-    "crypto/rand"
-    "encoding/base64"
+    "context"
+    "errors"
     "fmt"
+    "io"
     "net"
+    "strings"
     "sync"
     "sync/atomic"
     "time"
     
     "github.com/cilium/ebpf"
     "github.com/cilium/ebpf/link"
-    "github.com/cilium/ebpf/rlimit"
-    "golang.org/x/crypto/chacha20poly1305"
-    "golang.org/x/crypto/curve25519"
     "golang.zx2c4.com/wireguard/wgctrl"
     "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -29,16 +28,35 @@ const (
 // High-performance VPN control plane with advanced features
 type UnderTheRadarVPN struct {
     mu sync.RWMutex
+    reloadMu sync.Mutex // serializes Reload
+    config   VPNConfig  // as last applied by Start or Reload
+    plan     *ChangePlan // last made by PlanStart
+    planning *changeRecorder // set on the copy PlanStart runs Start's steps on
     
     // Core WireGuard control
-    wgClient     *wgctrl.Client
+    wgClient     wgController
+    commands     CommandRunner
+    ebpfLoader   EBPFLoader
+    timeSource   Clock // see clock
     deviceName   string
-    privateKey   wgtypes.Key
+    keys         *keyStore
     listenPort   int
+    listenPorts  []int // see VPNConfig.ListenPorts
+    ownsDevice   bool // created by us rather than adopted
+    bindInterface string   // see VPNConfig.BindInterface
+    firewallMark  uint32
+    socketRouting []string // ip rules and routes for bindInterface
+    probeTimeout time.Duration // AddPeer's handshake probe, default HandshakeTimeout
+    lockDir      string        // empty skips the instance lock
+    instance     *instanceLock // held from Start to Stop
     
     // Peer management
-    peers        map[string]*Peer
-    peersByIP    map[string]*Peer
+    peers        peerTable
+    peersByIP    map[string]*prefixPeers // by canonical prefix, every peer claiming it
+    allowedIPSlots allowedIPSlots // counters of owned prefixes, see AllowedIPStats
+    allowedIPConflicts AllowedIPConflictPolicy
+    flowPins     flowPins
+    classifiers  classifierSet // split tunneling by protocol, see AddClassifier
     
     // Performance metrics
     rxBytes      atomic.Uint64
@@ -50,24 +68,75 @@ type UnderTheRadarVPN struct {
     killSwitch   *KillSwitch
     dnsProtector *DNSProtector
     splitTunnel  *SplitTunnel
+    nft          *NFTPolicy // with VPNConfig.FirewallBackend FirewallNFTables
     multiHop     *MultiHop
     obfuscator   *Obfuscator
+    pinhole      *InputPinhole
+    mssClamp     *MSSClamp
+    hopRedirect  *PortHopRedirect
+    proxy        *ProxyServer
+    uapi         *UAPIServer
+    bypass       *ProcessBypass
+    webhook      *WebhookReporter
+    serverStatus *ServerStatusPublisher // from Start to Stop with VPNConfig.ServerStatus
+    remoteWrite  *RemoteWriter // from Start to Stop with VPNConfig.RemoteWrite
+    captivePortal *CaptivePortalGuard
+    capabilities PeerCapabilities
+    loadWeights  LoadWeights
+    priorityWeights PriorityWeights // for AutoPriority peers
+    autoPriority *priorityAdjuster // from Start to Stop
+    endpoints    *endpointResolver // from Start to Stop
     
     // eBPF programs for packet processing
-    xdpProgram   *ebpf.Program
-    tcProgram    *ebpf.Program
+    xdpProgram        *ebpf.Program
+    tcProgram         *ebpf.Program
+    tcIngressProgram  *ebpf.Program
+    tcFastPathProgram *ebpf.Program
+    tcClassifyProgram *ebpf.Program
+    splitBypassProg   *ebpf.Program
+    splitTunnelProg   *ebpf.Program
+    ebpfMaps          map[string]*ebpf.Map
+    xdpLink           link.Link
+    ebpfInterface     string
+    conntrack         ConntrackConfig
+    fastPath          bool   // redirect established flows at TC, see VPNConfig.FastPathEnabled
+    fastPathDevice    string // tunnel the fast path redirects for
+    classifyDevice    string // tunnel the DSCP classifier and flow counting are attached to
+    interfaceLinks    map[string]link.Link // XDP on interfaces besides the uplink, see InterfaceWatcher
+    ifaceWatcher      *InterfaceWatcher    // from Start to Stop with EBPFInterfaces
+    dscpRules         []DSCPRule
     
     // Connection stability
     failoverMgr  *FailoverManager
+    stopFailover context.CancelFunc // from Start to Stop, ends its sweep in progress
     healthCheck  *HealthChecker
+    metrics      *MetricsCollector
+    linkStats    linkStatsTracker // the device's kernel counters, see InterfaceStats
+    devicePoll   devicePoll       // whether metrics polls can read the device
+    peerSync     peerSyncState    // peers as the coordination server listed them, see SyncPeers
+    sink         MetricSink // nil until SetMetricSink, see metricSink
+    admission    *Admission // from Start to Stop, see Admit
+    eventStream  atomic.Pointer[EventStreamServer] // nil until NewEventStreamServer
+    speedTests   speedTestGate
+    
+    // Event notifications for embedding applications
+    events       chan Event
+}
+
+// wgController is the subset of wgctrl.Client used by the control plane
+type wgController interface {
+    Device(name string) (*wgtypes.Device, error)
+    ConfigureDevice(name string, cfg wgtypes.Config) error
+    Close() error
 }
 
 // Peer represents a VPN peer with advanced capabilities
 type Peer struct {
     PublicKey       wgtypes.Key
-    PresharedKey    *wgtypes.Key
+    PresharedKey    *Secret
     Endpoint        *net.UDPAddr
     AllowedIPs      []net.IPNet
+    PersistentKeepalive time.Duration
     
     // Performance tracking
     LastHandshake   time.Time
@@ -77,106 +146,310 @@ type Peer struct {
     PacketLoss      atomic.Uint32  // percentage * 100
     
     // Advanced routing
-    Priority        int
+    Priority        int  // under vpn.mu, see AutoPriority
+    AutoPriority    bool // Priority follows performance, see PriorityWeights
     LoadScore       atomic.Uint64
-    AlternateEndpoints []net.UDPAddr
+    Group           string
+    PortHops        atomic.Uint64
+    FlowSplitting   bool
+    standbyIPs      []net.IPNet // claimed but owned by another peer, see AllowedIPByPriority
+    flows           *flowSplitter // nil unless FlowSplitting with several endpoints
+    extra           *peerExtras   // nil unless one of its fields is set, see AlternateEndpoints
+    
+    // Features agreed with this peer during capability negotiation
+    ActiveCapabilities PeerCapabilities
     
     // Connection state
     HandshakeRetries atomic.Uint32
     IsAlive         atomic.Bool
+    failing         atomic.Bool // failed and not yet confirmed recovered, ranks last
+    draining        atomic.Bool // takes no new flows and is removed once idle, see DrainPeer
+    drainDeadline   time.Time   // under vpn.mu, when a drain removes it regardless
+    history         peerHistory // recent handshakes and state changes, see PeerInfo.History
+    
+    // Raw kernel counters, used to detect resets between polls
+    rxCounter       counterTracker
+    txCounter       counterTracker
+}
+
+// VPNOptions replaces the parts of the VPN that touch the host, so it can
+// run without root against in-memory fakes. Nil fields use the real ones.
+type VPNOptions struct {
+    DeviceName string
+    WGClient   wgController  // default wgctrl
+    Commands   CommandRunner // default runs ip, iptables and tc on the host
+    EBPF       EBPFLoader    // default loads ebpfObjectPath, NoEBPF skips it
+    LockDir    string        // instance lock files, default /run/undertheradar
+    MetricSink MetricSink    // default NopSink, see SetMetricSink
+    Clock      Clock         // drives the background loops, default RealClock
 }
 
 // Initialize high-performance VPN with eBPF acceleration
 func NewUnderTheRadarVPN(deviceName string) (*UnderTheRadarVPN, error) {
-    // Remove memory limit for eBPF
-    if err := rlimit.RemoveMemlock(); err != nil {
-        return nil, fmt.Errorf("failed to remove memlock: %w", err)
-    }
+    return NewUnderTheRadarVPNWithOptions(VPNOptions{DeviceName: deviceName})
+}
+
+// NewUnderTheRadarVPNWithOptions creates a VPN with the host facing parts
+// replaced as given in opts
+func NewUnderTheRadarVPNWithOptions(opts VPNOptions) (*UnderTheRadarVPN, error) {
+    deviceName := opts.DeviceName
     
-    wgClient, err := wgctrl.New()
-    if err != nil {
-        return nil, fmt.Errorf("failed to create WireGuard client: %w", err)
+    if opts.EBPF == nil {
+        opts.EBPF = kernelEBPF{}
+    }
+    if opts.LockDir == "" {
+        opts.LockDir = defaultLockDir
+    }
+    if opts.WGClient == nil {
+        wgClient, err := wgctrl.New()
+        if err != nil {
+            return nil, fmt.Errorf("failed to create WireGuard client: %w", err)
+        }
+        opts.WGClient = wgClient
     }
     
     vpn := &UnderTheRadarVPN{
-        wgClient:   wgClient,
-        deviceName: deviceName,
-        peers:      make(map[string]*Peer),
-        peersByIP:  make(map[string]*Peer),
+        wgClient:     opts.WGClient,
+        commands:     opts.Commands,
+        ebpfLoader:   opts.EBPF,
+        deviceName:   deviceName,
+        lockDir:      opts.LockDir,
+        peersByIP:    make(map[string]*prefixPeers),
+        keys:         newKeyStore(),
+        loadWeights:  DefaultLoadWeights,
+        priorityWeights: DefaultPriorityWeights,
+        events:       make(chan Event, eventBufferSize),
+        capabilities: defaultCapabilities(),
+        conntrack:    defaultConntrackConfig(),
+        sink:         opts.MetricSink,
+        timeSource:   opts.Clock,
     }
     
     // Initialize advanced features
     vpn.killSwitch = NewKillSwitch(deviceName)
     vpn.dnsProtector = NewDNSProtector()
-    vpn.splitTunnel = NewSplitTunnel()
+    vpn.splitTunnel = NewSplitTunnel(deviceName)
+    vpn.nft = NewNFTPolicy(deviceName)
     vpn.multiHop = NewMultiHop()
     vpn.obfuscator = NewObfuscator()
+    vpn.pinhole = NewInputPinhole()
+    vpn.mssClamp = NewMSSClamp()
+    vpn.hopRedirect = NewPortHopRedirect()
     vpn.failoverMgr = NewFailoverManager(vpn)
     vpn.healthCheck = NewHealthChecker(vpn)
+    vpn.metrics = NewMetricsCollector(vpn)
+    
+    vpn.killSwitch.commands = opts.Commands
+    vpn.dnsProtector.commands = opts.Commands
+    vpn.pinhole.commands = opts.Commands
+    vpn.mssClamp.commands = opts.Commands
+    vpn.splitTunnel.commands = opts.Commands
+    vpn.nft.commands = opts.Commands
+    vpn.hopRedirect.commands = opts.Commands
+    vpn.obfuscator.clock = vpn.clock()
+    vpn.dnsProtector.dohClient.clock = vpn.clock()
     
     // Load eBPF programs for packet acceleration
-    if err := vpn.loadEBPFPrograms(); err != nil {
+    if err := vpn.ebpfLoader.Load(vpn); err != nil {
+        vpn.wgClient.Close()
         return nil, fmt.Errorf("failed to load eBPF programs: %w", err)
     }
     
     return vpn, nil
 }
 
-// Load eBPF programs for XDP and TC acceleration
-func (vpn *UnderTheRadarVPN) loadEBPFPrograms() error {
-    // XDP program for fast packet filtering
-    xdpSpec, err := loadXDPProgram()
-    if err != nil {
+// Start VPN with all advanced features
+func (vpn *UnderTheRadarVPN) Start(config VPNConfig) error {
+    return vpn.StartContext(context.Background(), config)
+}
+
+// StartContext is Start giving up when ctx is done, with what it set up
+// undone. ctx only bounds starting: the VPN runs until Stop.
+func (vpn *UnderTheRadarVPN) StartContext(ctx context.Context, config VPNConfig) (err error) {
+    // Refuse a broken config before touching the host
+    if err := vpn.validateConfig(&config); err != nil {
         return err
     }
     
-    xdpProg, err := ebpf.NewProgram(xdpSpec)
-    if err != nil {
-        return fmt.Errorf("failed to create XDP program: %w", err)
+    if config.DryRun {
+        _, err := vpn.PlanStart(config)
+        return err
     }
-    vpn.xdpProgram = xdpProg
     
-    // TC program for advanced packet manipulation
-    tcSpec, err := loadTCProgram()
-    if err != nil {
+    // Undo completed steps in reverse if a later one fails, so a failed
+    // start leaves the host as it found it, see StartError
+    var undo rollback
+    defer func() {
+        if err != nil {
+            err = undo.unwind(err)
+        }
+    }()
+    
+    // One instance per device, so two don't fight over it and the firewall
+    undo.pushQuiet("instance lock", vpn.unlockInstance)
+    if err := vpn.lockInstance(config.Force); err != nil {
         return err
     }
     
-    tcProg, err := ebpf.NewProgram(tcSpec)
-    if err != nil {
-        return fmt.Errorf("failed to create TC program: %w", err)
+    if err := vpn.setupHost(ctx, config, &undo); err != nil {
+        return err
+    }
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    
+    vpn.mu.Lock()
+    vpn.config = config
+    vpn.mu.Unlock()
+    
+    // Queue bursty work so a reconnect storm can't swamp the control plane
+    admission := NewAdmission(config.Admission, vpn.metricSink)
+    admission.Start()
+    vpn.mu.Lock()
+    vpn.admission = admission
+    vpn.mu.Unlock()
+    
+    // Start health monitoring
+    go vpn.healthCheck.Start()
+    
+    // Start failover manager
+    failoverCtx, stopFailover := context.WithCancel(context.Background())
+    vpn.mu.Lock()
+    vpn.stopFailover = stopFailover
+    vpn.mu.Unlock()
+    go vpn.failoverMgr.Start(failoverCtx)
+    
+    // Re-rank AutoPriority peers as their performance changes
+    autoPriority := newPriorityAdjuster(vpn)
+    vpn.mu.Lock()
+    vpn.autoPriority = autoPriority
+    vpn.mu.Unlock()
+    go autoPriority.Start()
+    
+    // Follow the DNS records of EndpointHost peers
+    endpoints := newEndpointResolver(vpn)
+    vpn.mu.Lock()
+    vpn.endpoints = endpoints
+    vpn.mu.Unlock()
+    go endpoints.Start()
+    
+    // Keep load scores current for routePacket
+    vpn.metrics.configure(config.Metrics)
+    go vpn.metrics.Start()
+    
+    // Watch for a captive portal while handshakes fail
+    if config.CaptivePortal.Enabled {
+        vpn.startCaptivePortal(config.CaptivePortal)
+    }
+    
+    // Report peer statistics to monitoring
+    if config.Webhook.enabled() {
+        vpn.startWebhook(config.Webhook)
+    }
+    
+    // Push metrics for fleets too large to scrape
+    if config.RemoteWrite.enabled() {
+        vpn.startRemoteWrite(config.RemoteWrite)
     }
-    vpn.tcProgram = tcProg
     
     return nil
 }
 
-// Start VPN with all advanced features
-func (vpn *UnderTheRadarVPN) Start(config VPNConfig) error {
+// The steps of Start that change the host: device, firewall, routes, DNS
+// and the local servers. Each pushes its undo before it runs. PlanStart
+// runs them against a recorder.
+func (vpn *UnderTheRadarVPN) setupHost(ctx context.Context, config VPNConfig, undo *rollback) error {
     // Generate or load private key
     if err := vpn.setupKeys(config); err != nil {
         return err
     }
     
     // Create WireGuard device
-    if err := vpn.createDevice(config); err != nil {
+    undo.push("device", vpn.removeDevice)
+    undo.push("socket routing", vpn.removeSocketRouting)
+    if err := vpn.createDevice(ctx, config); err != nil {
         return err
     }
     
     // Attach eBPF programs
-    if err := vpn.attachEBPF(); err != nil {
+    undo.pushQuiet("eBPF programs", func() { vpn.loader().Detach(vpn) })
+    if err := vpn.loader().Attach(vpn); err != nil {
+        return err
+    }
+    if err := vpn.watchInterfaces(config, undo); err != nil {
         return err
     }
     
+    // Let WireGuard through a default-deny input firewall
+    if config.ManageInputPinhole {
+        undo.push("input pinhole", vpn.pinhole.Close)
+        if err := vpn.openPinhole(); err != nil {
+            return fmt.Errorf("failed to open input pinhole: %w", err)
+        }
+    }
+    
+    // Keep forwarded TCP under the tunnel MTU
+    if config.ClampMSS {
+        undo.push("MSS clamp", vpn.mssClamp.Disable)
+        if err := vpn.clampMSS(config); err != nil {
+            return fmt.Errorf("failed to clamp MSS: %w", err)
+        }
+    }
+    
+    // Accept hopping clients and the extra listen ports
+    if ports := redirectedPorts(config); len(ports) > 0 {
+        undo.push("hop ports", vpn.hopRedirect.Close)
+        if err := vpn.openHopPorts(ports); err != nil {
+            return fmt.Errorf("failed to open hop ports: %w", err)
+        }
+    }
+    
+    // The firewall features register with one table instead
+    if config.FirewallBackend == FirewallNFTables {
+        vpn.killSwitch.nft = vpn.nft
+        vpn.dnsProtector.nft = vpn.nft
+        vpn.splitTunnel.nft = vpn.nft
+    }
+    
     // Enable kill switch if configured
     if config.KillSwitch {
+        vpn.killSwitch.VRFName = config.KillSwitchVRF
+        vpn.killSwitch.ProtectNamespaces = config.KillSwitchContainers
+        vpn.killSwitch.NamespaceExclusions = config.ContainerExclusions
+        vpn.killSwitch.AllowEstablished = config.KillSwitchAllowEstablished
+        vpn.killSwitch.AllowLAN = config.KillSwitchLAN
+        vpn.killSwitch.AllowBypassProcesses = len(config.BypassProcesses) > 0
+        vpn.killSwitch.setEncap(config, vpn.listenPort)
+        undo.push("kill switch", func() error {
+            if config.KillSwitchFailClosed && vpn.killSwitch.enabled.Load() {
+                return nil // held until Stop
+            }
+            return vpn.killSwitch.Disable()
+        })
         if err := vpn.killSwitch.Enable(); err != nil {
-            return fmt.Errorf("failed to enable kill switch: %w", err)
+            return fmt.Errorf("%w: %w", ErrKillSwitchFailed, err)
+        }
+    }
+    
+    // Only listed processes may go around the kill switch
+    if config.KillSwitch && len(config.BypassProcesses) > 0 {
+        undo.pushQuiet("process bypass", vpn.stopProcessBypass)
+        if err := vpn.startProcessBypass(config.BypassProcesses); err != nil {
+            return fmt.Errorf("failed to enable process bypass: %w", err)
         }
     }
     
     // Enable DNS protection
     if config.DNSProtection {
+        vpn.dnsProtector.ProxyOnly = config.DNSProxyOnly
+        vpn.dnsProtector.ListenAddr = config.DNSListenAddr
+        vpn.dnsProtector.BootstrapIPs = config.BootstrapIPs
+        vpn.dnsProtector.Interface = vpn.deviceName
+        vpn.dnsProtector.Resolver = config.DNSResolver
+        vpn.dnsProtector.SearchDomains = config.DNSSearchDomains
+        vpn.dnsProtector.SplitDNS = config.DNSSplit
+        vpn.dnsProtector.SetProviders(config.DoHProviders, config.DNSQueryTimeout)
+        undo.push("DNS protection", vpn.dnsProtector.Disable)
         if err := vpn.dnsProtector.Enable(config.DNSServers); err != nil {
             return fmt.Errorf("failed to enable DNS protection: %w", err)
         }
@@ -184,113 +457,354 @@ func (vpn *UnderTheRadarVPN) Start(config VPNConfig) error {
     
     // Configure split tunneling
     if len(config.SplitTunnelApps) > 0 {
+        undo.push("split tunnel", vpn.splitTunnel.Disable)
         if err := vpn.splitTunnel.Configure(config.SplitTunnelApps); err != nil {
             return fmt.Errorf("failed to configure split tunnel: %w", err)
         }
     }
     
-    // Start health monitoring
-    go vpn.healthCheck.Start()
+    // Clients using this host as their exit leave with its address
+    if config.ExitNAT {
+        undo.push("exit NAT", func() error { return vpn.nft.remove(nftFeatureExitNAT) })
+        if err := vpn.nft.set(nftFeatureExitNAT, exitNATRules(vpn.deviceName)); err != nil {
+            return fmt.Errorf("failed to enable exit NAT: %w", err)
+        }
+    }
     
-    // Start failover manager
-    go vpn.failoverMgr.Start()
+    // Let clients pick servers by load
+    if config.ServerStatus.ListenAddr != "" {
+        undo.push("server status", vpn.stopServerStatus)
+        if err := vpn.startServerStatus(config.ServerStatus); err != nil {
+            return fmt.Errorf("failed to publish server status: %w", err)
+        }
+    }
+    
+    // Share the tunnel with apps that can't be routed through it
+    if config.Proxy.enabled() {
+        undo.push("proxy", vpn.stopProxy)
+        if err := vpn.startProxy(config.Proxy); err != nil {
+            return fmt.Errorf("failed to start proxy: %w", err)
+        }
+    }
     
+    // Keep wg show and UAPI tooling working
+    if config.UAPI {
+        undo.push("UAPI server", vpn.stopUAPI)
+        if err := vpn.startUAPI(); err != nil {
+            return fmt.Errorf("failed to start UAPI server: %w", err)
+        }
+    }
     return nil
 }
 
-// Add peer with advanced features
+// Add peer with advanced features. A prefix already owned by another peer
+// is rejected or reassigned according to VPNConfig.AllowedIPConflicts.
 func (vpn *UnderTheRadarVPN) AddPeer(peerConfig PeerConfig) error {
+    return vpn.AddPeerContext(context.Background(), peerConfig)
+}
+
+// AddPeerContext is AddPeer with ctx bounding the endpoint lookup, the
+// handshake probe and the TURN allocation. The device is left alone once
+// ctx is done.
+func (vpn *UnderTheRadarVPN) AddPeerContext(ctx context.Context, peerConfig PeerConfig) error {
+    if err := peerConfig.PortHopping.validate(); err != nil {
+        return err
+    }
+    if err := validateAnnotations(peerConfig.Annotations); err != nil {
+        return err
+    }
+    if peerConfig.PublicKey == (wgtypes.Key{}) {
+        return fmt.Errorf("%w: peer has no public key", ErrKeyInvalid)
+    }
+    if psk := peerConfig.PresharedKey; psk != nil && len(psk.Bytes()) != wgtypes.KeyLen {
+        return fmt.Errorf("%w: preshared key of %d bytes", ErrKeyInvalid, len(psk.Bytes()))
+    }
+    allowedIPs, err := normalizeAllowedIPs(peerConfig.AllowedIPs)
+    if err != nil {
+        return err
+    }
+    
+    // A hostname is looked up now and again as its record expires
+    var endpointTTL time.Duration
+    if peerConfig.EndpointHost != "" {
+        lookupCtx, cancel := context.WithTimeout(ctx, endpointResolveTimeout)
+        peerConfig.Endpoint, endpointTTL, err = resolveEndpointHost(lookupCtx, peerConfig.EndpointHost, peerConfig.Endpoint)
+        cancel()
+        if err != nil {
+            return err
+        }
+        if endpointTTL == 0 {
+            peerConfig.EndpointHost = "" // a literal address
+        }
+    }
+    
+    // Don't leave a stale peer for routePacket to weigh. Outside the lock,
+    // the probe can take the whole timeout. A relayed peer is only
+    // reachable through its relay.
+    if peerConfig.Endpoint != nil && !peerConfig.SkipProbe && peerConfig.TURNConfig == nil {
+        if vpn.planning != nil {
+            defer vpn.planning.assume(fmt.Sprintf("%s answers the handshake probe", peerConfig.Endpoint))()
+        } else if err := vpn.ProbeEndpointContext(ctx, peerConfig.Endpoint, peerConfig.PublicKey, vpn.handshakeProbeTimeout()); err != nil {
+            return err
+        }
+    }
+    
+    // The device sends to a loopback socket the relay forwards from
+    var turn *TURNTransport
+    deviceEndpoint := peerConfig.Endpoint
+    if peerConfig.TURNConfig != nil {
+        if peerConfig.Endpoint == nil {
+            return fmt.Errorf("peer %s: TURN needs the peer's Endpoint", peerConfig.PublicKey)
+        }
+        if vpn.planning != nil {
+            vpn.planning.note(ChangeService, "relay peer %s through TURN server %s", peerConfig.PublicKey, peerConfig.TURNConfig.Server)
+        } else if turn, err = vpn.dialTURN(ctx, peerConfig.PublicKey, *peerConfig.TURNConfig, peerConfig.Endpoint); err != nil {
+            return err
+        } else {
+            deviceEndpoint = turn.LocalAddr()
+        }
+    }
+    
     vpn.mu.Lock()
     defer vpn.mu.Unlock()
     
     peer := &Peer{
         PublicKey:     peerConfig.PublicKey,
         Endpoint:      peerConfig.Endpoint,
-        AllowedIPs:    peerConfig.AllowedIPs,
+        AllowedIPs:    allowedIPs,
         Priority:      peerConfig.Priority,
-        AlternateEndpoints: peerConfig.AlternateEndpoints,
+        AutoPriority:  peerConfig.AutoPriority,
+        Group:         peerConfig.Group,
+        PersistentKeepalive: peerConfig.PersistentKeepalive,
+        FlowSplitting: peerConfig.FlowSplitting,
+    }
+    peer.setExtras(peerConfig)
+    if peerConfig.EndpointHost != "" {
+        peer.extra.endpointExpires = vpn.clock().Now().Add(endpointTTL)
+    }
+    if turn != nil {
+        peer.extra.turn = turn
+    }
+    if peerConfig.FlowSplitting {
+        peer.flows = newFlowSplitter(peerConfig.Endpoint, peerConfig.AlternateEndpoints)
     }
     
-    if peerConfig.PresharedKey != "" {
-        key, err := wgtypes.ParseKey(peerConfig.PresharedKey)
-        if err != nil {
-            return err
-        }
-        peer.PresharedKey = &key
+    if peerConfig.PresharedKey != nil {
+        peer.PresharedKey = peerConfig.PresharedKey
+    }
+    
+    // Check before the kernel silently moves the prefix
+    claims := vpn.allowedIPClaimsLocked(peer)
+    switch {
+    case len(claims) > 0 && vpn.allowedIPConflicts == AllowedIPReject:
+        peer.closeTURN()
+        return fmt.Errorf("%w: %s belongs to peer %s", ErrAllowedIPConflict, claims[0].prefix, claims[0].owner.PublicKey)
+    case vpn.allowedIPConflicts == AllowedIPByPriority:
+        // Contested prefixes wait on standby until the peer outranks their owner
+        peer.AllowedIPs, peer.standbyIPs = splitClaims(peer.AllowedIPs, claims)
+        claims = nil
     }
     
     // Configure WireGuard peer
     wgPeer := wgtypes.PeerConfig{
         PublicKey:    peer.PublicKey,
-        PresharedKey: peer.PresharedKey,
-        Endpoint:     peer.Endpoint,
+        Endpoint:     deviceEndpoint,
         AllowedIPs:   peer.AllowedIPs,
         ReplaceAllowedIPs: true,
     }
+    if peer.PersistentKeepalive > 0 {
+        wgPeer.PersistentKeepaliveInterval = &peer.PersistentKeepalive
+    }
+    if peer.PresharedKey != nil {
+        psk := peer.PresharedKey.Key()
+        defer wipe(psk[:])
+        wgPeer.PresharedKey = &psk
+    }
     
     cfg := wgtypes.Config{
         Peers: []wgtypes.PeerConfig{wgPeer},
     }
     
+    // wgctrl takes no context, the last chance to back out
+    if err := ctx.Err(); err != nil {
+        peer.closeTURN()
+        return err
+    }
     if err := vpn.wgClient.ConfigureDevice(vpn.deviceName, cfg); err != nil {
+        peer.closeTURN()
         return fmt.Errorf("failed to configure peer: %w", err)
     }
     
-    // Store peer
-    vpn.peers[peer.PublicKey.String()] = peer
-    
-    // Index by allowed IPs for fast lookup
-    for _, allowedIP := range peer.AllowedIPs {
-        vpn.peersByIP[allowedIP.String()] = peer
+    if old := vpn.peers.get(peer.PublicKey); old != nil {
+        old.closeTURN()
+        old.closeObfuscator()
     }
+    vpn.reassignAllowedIPsLocked(peer, claims)
+    vpn.storePeerLocked(peer)
+    vpn.resumeDrainLocked(peer)
     
-    return nil
+    return vpn.rebalanceAllowedIPsLocked()
 }
 
-// High-performance packet routing with load balancing
-func (vpn *UnderTheRadarVPN) routePacket(dstIP net.IP) *Peer {
-    vpn.mu.RLock()
-    defer vpn.mu.RUnlock()
+// Store peer and index it by allowed IPs for fast lookup. Caller holds vpn.mu.
+func (vpn *UnderTheRadarVPN) storePeerLocked(peer *Peer) {
+    if old := vpn.peers.get(peer.PublicKey); old != nil {
+        vpn.unindexPeerLocked(old)
+    }
+    vpn.peers.put(peer)
+    vpn.countAllowedIPsLocked(peer, peer.AllowedIPs)
+    if peer.PresharedKey != nil {
+        vpn.keys.Put(pskName(peer.PublicKey), peer.PresharedKey)
+    }
     
-    var candidates []*Peer
+    for _, prefix := range peer.claimedIPs() {
+        vpn.indexPrefixLocked(prefix, peer)
+    }
+}
+
+// ErrPeerNotFound is wrapped by calls naming a peer the VPN doesn't have,
+// cleanup can ignore it
+var ErrPeerNotFound = errors.New("peer not found")
+
+// RemovePeer deletes a peer from the device and forgets it
+func (vpn *UnderTheRadarVPN) RemovePeer(pubKey wgtypes.Key) error {
+    vpn.mu.Lock()
+    defer vpn.mu.Unlock()
     
-    // Find all peers that can route to this IP
-    for _, peer := range vpn.peers {
-        for _, allowedIP := range peer.AllowedIPs {
-            if allowedIP.Contains(dstIP) {
-                candidates = append(candidates, peer)
-            }
-        }
+    peer := vpn.peers.get(pubKey)
+    if peer == nil {
+        return fmt.Errorf("%w: %s", ErrPeerNotFound, pubKey)
     }
     
-    if len(candidates) == 0 {
-        return nil
+    cfg := wgtypes.Config{
+        Peers: []wgtypes.PeerConfig{{PublicKey: pubKey, Remove: true}},
+    }
+    if err := vpn.wgClient.ConfigureDevice(vpn.deviceName, cfg); err != nil {
+        return fmt.Errorf("failed to remove peer: %w", err)
     }
     
-    // Select peer with lowest load score
-    var bestPeer *Peer
-    var lowestScore uint64 = ^uint64(0)
+    vpn.unindexPeerLocked(peer)
+    vpn.countAllowedIPsLocked(peer, nil)
+    vpn.peers.remove(pubKey)
+    peer.closeTURN()
+    peer.closeObfuscator()
+    vpn.keys.Remove(pskName(pubKey))
     
-    for _, peer := range candidates {
-        if !peer.IsAlive.Load() {
+    // Its prefixes go to the best peer on standby
+    return vpn.rebalanceAllowedIPsLocked()
+}
+
+// High-performance packet routing with load balancing. Of the live peers
+// owning a prefix that covers this IP, see preferPeer for which one wins.
+// Draining peers take no new traffic.
+func (vpn *UnderTheRadarVPN) routePacket(dstIP net.IP) *Peer {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    return vpn.routePacketLocked(dstIP)
+}
+
+// Caller holds vpn.mu
+func (vpn *UnderTheRadarVPN) routePacketLocked(dstIP net.IP) *Peer {
+    var bestPeer *Peer
+    for key, entry := range vpn.peersByIP {
+        if !entry.prefix.Contains(dstIP) {
             continue
         }
-        
-        score := peer.LoadScore.Load()
-        if score < lowestScore {
-            lowestScore = score
-            bestPeer = peer
+        for _, peer := range entry.peers {
+            if !peer.IsAlive.Load() || peer.draining.Load() || !peer.owns(key) {
+                continue
+            }
+            if bestPeer == nil || preferPeer(peer, bestPeer) {
+                bestPeer = peer
+            }
         }
     }
-    
     return bestPeer
 }
 
+// ErrKillSwitchFailed is wrapped when the kill switch rules couldn't be
+// put in place, traffic may leak outside the tunnel
+var ErrKillSwitchFailed = errors.New("failed to enable kill switch")
+
 // Kill switch implementation using netfilter
 type KillSwitch struct {
     deviceName string
     enabled    atomic.Bool
     rules      []string
+    commands   CommandRunner
+    plan       *changeRecorder // see PlanStart
+    nft        *NFTPolicy      // registers there instead of adding rules, see FirewallNFTables
+    
+    // Confine the kill switch to one VRF so other tenants are untouched
+    VRFName    string
+    
+    // Apply the rules in every Docker container's network namespace too,
+    // whose traffic is forwarded and never passes the host's OUTPUT chain.
+    // NamespaceExclusions names namespaces to leave alone, see
+    // containerNamespaces.
+    ProtectNamespaces   bool
+    NamespaceExclusions []string
+    nsRules             map[string][]string // by namespace path
+    
+    // The tunnel's own packets, let out of EncapInterface when set: those
+    // carrying EncapMark, or without a mark those from EncapPort
+    EncapInterface string
+    EncapMark      uint32
+    EncapPort      int
+    
+    // Accept packets of connections conntrack already tracks, so they can
+    // drain instead of breaking the moment the kill switch engages. They
+    // keep leaving outside the tunnel until they close; off drops them.
+    AllowEstablished bool
+    
+    // Local networks, such as the printer's, reached outside the tunnel
+    AllowLAN []net.IPNet
+    
+    // Accept the sockets ProcessBypass marks for listed processes
+    AllowBypassProcesses bool
+    
+    tag string // comment on every rule, see Reconfigure
+}
+
+// Comment of every other kill switch rule set, see Reconfigure
+const killSwitchTag = "utr-killswitch"
+
+func (ks *KillSwitch) setEncap(config VPNConfig, listenPort int) {
+    ks.EncapInterface = config.BindInterface
+    ks.EncapMark = config.FirewallMark
+    ks.EncapPort = listenPort
+}
+
+// Accept rule in chain for the tunnel's own packets, empty unless bound
+func (ks *KillSwitch) encapRule(ipt, chain string) string {
+    switch {
+    case ks.EncapMark != 0 && ks.EncapInterface != "":
+        return fmt.Sprintf("%s -A %s -o %s -m mark --mark 0x%x -j ACCEPT", ipt, chain, ks.EncapInterface, ks.EncapMark)
+    case ks.EncapMark != 0:
+        return fmt.Sprintf("%s -A %s -m mark --mark 0x%x -j ACCEPT", ipt, chain, ks.EncapMark)
+    case ks.EncapInterface != "":
+        return fmt.Sprintf("%s -A %s -o %s -p udp --sport %d -j ACCEPT", ipt, chain, ks.EncapInterface, ks.EncapPort)
+    }
+    return ""
+}
+
+// Accept rule in chain for bypassed processes, empty unless allowed
+func (ks *KillSwitch) bypassRule(ipt, chain string) string {
+    if !ks.AllowBypassProcesses {
+        return ""
+    }
+    return fmt.Sprintf("%s -A %s -m mark --mark 0x%x -j ACCEPT", ipt, chain, processBypassMark)
+}
+
+// Accept rule in chain for established connections, empty when strict.
+// Goes after the tunnel device's accept, which most packets match first,
+// and right before the DROP.
+func (ks *KillSwitch) establishedRule(ipt, chain string) string {
+    if !ks.AllowEstablished {
+        return ""
+    }
+    return fmt.Sprintf("%s -A %s -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT", ipt, chain)
 }
 
 func NewKillSwitch(deviceName string) *KillSwitch {
@@ -304,36 +818,196 @@ func (ks *KillSwitch) Enable() error {
         return nil
     }
     
+    if ks.nft != nil {
+        if ks.VRFName != "" || ks.ProtectNamespaces {
+            return fmt.Errorf("VRF and container kill switches need the iptables backend")
+        }
+        if err := ks.nft.set(nftFeatureKillSwitch, ks.nftRules()); err != nil {
+            return err
+        }
+        ks.enabled.Store(true)
+        return nil
+    }
+    
+    if ks.VRFName != "" {
+        rules, err := ks.vrfRules()
+        if err != nil {
+            return err
+        }
+        return ks.apply(rules)
+    }
+    
     // Drop all traffic not going through VPN
-    rules := []string{
-        fmt.Sprintf("iptables -A OUTPUT -o %s -j ACCEPT", ks.deviceName),
-        "iptables -A OUTPUT -o lo -j ACCEPT",
-        "iptables -A OUTPUT -m owner --uid-owner 0 -j ACCEPT", // Allow root
-        "iptables -A OUTPUT -j DROP",
-        
-        // IPv6 rules
-        fmt.Sprintf("ip6tables -A OUTPUT -o %s -j ACCEPT", ks.deviceName),
-        "ip6tables -A OUTPUT -o lo -j ACCEPT",
-        "ip6tables -A OUTPUT -j DROP",
+    var rules []string
+    for _, ipt := range []string{"iptables", "ip6tables"} {
+        rules = append(rules,
+            fmt.Sprintf("%s -A OUTPUT -o %s -j ACCEPT", ipt, ks.deviceName),
+            fmt.Sprintf("%s -A OUTPUT -o lo -j ACCEPT", ipt))
+        if ipt == "iptables" {
+            rules = append(rules, "iptables -A OUTPUT -m owner --uid-owner 0 -j ACCEPT") // Allow root
+        }
+        for _, lan := range ks.AllowLAN {
+            if (lan.IP.To4() != nil) == (ipt == "iptables") {
+                rules = append(rules, fmt.Sprintf("%s -A OUTPUT -d %s -j ACCEPT", ipt, lan.String()))
+            }
+        }
+        if rule := ks.encapRule(ipt, "OUTPUT"); rule != "" {
+            rules = append(rules, rule)
+        }
+        if rule := ks.bypassRule(ipt, "OUTPUT"); rule != "" {
+            rules = append(rules, rule)
+        }
+        if rule := ks.establishedRule(ipt, "OUTPUT"); rule != "" {
+            rules = append(rules, rule)
+        }
+        rules = append(rules, fmt.Sprintf("%s -A OUTPUT -j DROP", ipt))
     }
     
+    return ks.apply(rules)
+}
+
+func (ks *KillSwitch) apply(rules []string) error {
     for _, rule := range rules {
-        if err := executeIPTablesRule(rule); err != nil {
+        rule = ks.tagRule(rule)
+        if err := ks.commands.Run(rule); err != nil {
             ks.Disable() // Rollback on error
             return fmt.Errorf("failed to add rule %s: %w", rule, err)
         }
         ks.rules = append(ks.rules, rule)
     }
+    if err := ks.protectNamespaces(); err != nil {
+        ks.Disable()
+        return err
+    }
     
     ks.enabled.Store(true)
     return nil
 }
 
+// Remove every rule added by Enable, including a partially applied set
+func (ks *KillSwitch) Disable() error {
+    if ks.nft != nil {
+        err := ks.nft.remove(nftFeatureKillSwitch)
+        ks.enabled.Store(false)
+        return err
+    }
+    
+    nsErr := ks.unprotectNamespaces()
+    err := ks.commands.removeIPTablesRules(ks.rules)
+    if err == nil {
+        err = nsErr
+    }
+    ks.rules = nil
+    ks.enabled.Store(false)
+    return err
+}
+
+// Reconfigure moves an enabled kill switch to the settings configure makes
+// on a copy of it, without a moment unprotected. nftables swaps the table
+// whole. With iptables the new rules go in behind the old ones, which keep
+// dropping everything until they are removed once the new set is complete;
+// every other set carries a comment tag, so removing one set never deletes
+// a rule of the other. A VRF chain can't exist twice, so a kill switch
+// staying in the same VRF is taken down and put back, and restored as it
+// was if that fails. On error the old settings stay in force.
+func (ks *KillSwitch) Reconfigure(configure func(next *KillSwitch)) error {
+    next := &KillSwitch{
+        deviceName:           ks.deviceName,
+        commands:             ks.commands,
+        plan:                 ks.plan,
+        nft:                  ks.nft,
+        VRFName:              ks.VRFName,
+        ProtectNamespaces:    ks.ProtectNamespaces,
+        NamespaceExclusions:  ks.NamespaceExclusions,
+        EncapInterface:       ks.EncapInterface,
+        EncapMark:            ks.EncapMark,
+        EncapPort:            ks.EncapPort,
+        AllowEstablished:     ks.AllowEstablished,
+        AllowLAN:             ks.AllowLAN,
+        AllowBypassProcesses: ks.AllowBypassProcesses,
+    }
+    configure(next)
+    if ks.tag == "" {
+        next.tag = killSwitchTag
+    }
+    
+    switch {
+    case ks.nft != nil:
+        if err := next.Enable(); err != nil {
+            return err
+        }
+    case ks.VRFName != "" && ks.VRFName == next.VRFName:
+        if err := ks.Disable(); err != nil {
+            return err
+        }
+        if err := next.Enable(); err != nil {
+            if restoreErr := ks.Enable(); restoreErr != nil {
+                return fmt.Errorf("%w, and restoring the previous rules failed: %w", err, restoreErr)
+            }
+            return err
+        }
+    default:
+        if err := next.Enable(); err != nil {
+            return err
+        }
+        // The new rules are in force either way
+        if err := ks.Disable(); err != nil {
+            ks.adopt(next)
+            return fmt.Errorf("failed to remove the previous rules: %w", err)
+        }
+    }
+    ks.adopt(next)
+    return nil
+}
+
+// Take over the settings and rules of next, which replaced ks's
+func (ks *KillSwitch) adopt(next *KillSwitch) {
+    ks.VRFName = next.VRFName
+    ks.ProtectNamespaces, ks.NamespaceExclusions = next.ProtectNamespaces, next.NamespaceExclusions
+    ks.EncapInterface, ks.EncapMark, ks.EncapPort = next.EncapInterface, next.EncapMark, next.EncapPort
+    ks.AllowEstablished, ks.AllowLAN = next.AllowEstablished, next.AllowLAN
+    ks.AllowBypassProcesses = next.AllowBypassProcesses
+    ks.rules, ks.nsRules, ks.tag = next.rules, next.nsRules, next.tag
+    ks.enabled.Store(true)
+}
+
+// Comment the rule with the kill switch's tag, if it has one, so it differs
+// from the same rule of the set it replaced
+func (ks *KillSwitch) tagRule(rule string) string {
+    i := strings.LastIndex(rule, " -j ")
+    if ks.tag == "" || i < 0 {
+        return rule
+    }
+    return rule[:i] + " -m comment --comment " + ks.tag + rule[i:]
+}
+
 // DNS leak protection with DNS-over-HTTPS
 type DNSProtector struct {
     enabled     atomic.Bool
     dnsServers  []string
     dohClient   *DOHClient
+    rules       []string
+    commands    CommandRunner
+    plan        *changeRecorder // see PlanStart
+    nft         *NFTPolicy      // registers there instead of adding rules, see FirewallNFTables
+    
+    // Only run the local DoH proxy and leave the firewall alone, for
+    // containers that can't change it. Applications have to be pointed at
+    // ProxyAddr themselves.
+    ProxyOnly   bool
+    ListenAddr  string // proxy address, default 127.0.0.1:53; port 0 picks one
+    BootstrapIPs map[string]net.IP // DoH provider hostname -> address, see DOHClient.SetBootstrapIPs
+    
+    // Point the system resolver at the servers for Interface, see
+    // applyResolver. ProxyOnly leaves it alone.
+    Interface     string
+    Resolver      ResolverMode
+    SearchDomains []string
+    SplitDNS      bool // only SearchDomains are resolved through the tunnel, systemd-resolved only
+    
+    mu          sync.Mutex
+    proxyAddr   net.Addr
+    resolver    ResolverStatus
 }
 
 func NewDNSProtector() *DNSProtector {
@@ -343,21 +1017,53 @@ func NewDNSProtector() *DNSProtector {
 }
 
 func (dp *DNSProtector) Enable(servers []string) error {
-    // Force all DNS through VPN
-    rules := []string{
-        // Block all DNS except through VPN
-        "iptables -A OUTPUT -p udp --dport 53 -j DROP",
-        "iptables -A OUTPUT -p tcp --dport 53 -j DROP",
+    for host, ip := range dp.BootstrapIPs {
+        if ip == nil {
+            return fmt.Errorf("no bootstrap address for DoH provider %s", host)
+        }
+    }
+    dp.dohClient.SetBootstrapIPs(dp.BootstrapIPs)
+    if dp.ListenAddr != "" {
+        dp.dohClient.mu.Lock()
+        dp.dohClient.listenAddr = dp.ListenAddr
+        dp.dohClient.mu.Unlock()
+    }
+    
+    if dp.ProxyOnly && dp.plan != nil {
+        dp.plan.note(ChangeService, "start the DoH proxy on %s", dp.dohClient.listenAddr)
+        return nil
+    }
+    if dp.ProxyOnly {
+        addr, err := dp.dohClient.Listen(servers)
+        if err != nil {
+            return fmt.Errorf("failed to start DNS proxy: %w", err)
+        }
+        dp.mu.Lock()
+        dp.proxyAddr = addr
+        dp.mu.Unlock()
         
-        // Allow DNS to our servers only
-        fmt.Sprintf("iptables -I OUTPUT -p udp --dport 53 -d %s -j ACCEPT", servers[0]),
-        fmt.Sprintf("iptables -I OUTPUT -p tcp --dport 53 -d %s -j ACCEPT", servers[0]),
+        dp.dnsServers = servers
+        dp.enabled.Store(true)
+        return nil
     }
     
-    for _, rule := range rules {
-        if err := executeIPTablesRule(rule); err != nil {
+    if dp.nft != nil {
+        if err := dp.nft.set(nftFeatureDNS, dnsNFTRules(servers, dp.bootstrapTargets())); err != nil {
             return err
         }
+    } else if err := dp.addRules(servers); err != nil {
+        return err
+    }
+    
+    if dp.plan != nil {
+        dp.planResolver(servers)
+        dp.plan.note(ChangeService, "start the DoH proxy on %s", dp.dohClient.listenAddr)
+        return nil
+    }
+    
+    if err := dp.applyResolver(servers); err != nil {
+        dp.Disable()
+        return err
     }
     
     dp.dnsServers = servers
@@ -369,9 +1075,56 @@ func (dp *DNSProtector) Enable(servers []string) error {
     return nil
 }
 
+// Force all DNS through VPN
+func (dp *DNSProtector) addRules(servers []string) error {
+    rules := []string{
+        // Block all DNS except through VPN
+        "iptables -A OUTPUT -p udp --dport 53 -j DROP",
+        "iptables -A OUTPUT -p tcp --dport 53 -j DROP",
+    
+    }
+    
+    // Allow DNS to our servers only
+    rules = append(rules, dnsAcceptRules(servers)...)
+    rules = append(rules, bootstrapAcceptRules(dp.bootstrapTargets())...)
+    
+    for _, rule := range rules {
+        if err := dp.commands.Run(rule); err != nil {
+            dp.Disable() // Rollback on error
+            return fmt.Errorf("failed to add rule %s: %w", rule, err)
+        }
+        dp.rules = append(dp.rules, rule)
+    }
+    return nil
+}
+
+// Remove the DNS rules and stop the DoH proxy
+func (dp *DNSProtector) Disable() error {
+    if dp.enabled.Load() {
+        dp.dohClient.Stop()
+    }
+    dp.mu.Lock()
+    dp.proxyAddr = nil
+    dp.mu.Unlock()
+    
+    resolverErr := dp.restoreResolver()
+    err := dp.commands.removeIPTablesRules(dp.rules)
+    if dp.nft != nil {
+        err = dp.nft.remove(nftFeatureDNS)
+    }
+    dp.rules = nil
+    dp.enabled.Store(false)
+    if err == nil {
+        err = resolverErr
+    }
+    return err
+}
+
 // Multi-hop VPN implementation
 type MultiHop struct {
     hops    []*HopNode
+    devices []string // layer devices we created
+    session *Secret  // hop layer keys derive from it, see HopKey
     mu      sync.RWMutex
 }
 
@@ -379,15 +1132,33 @@ type HopNode struct {
     PublicKey wgtypes.Key
     Endpoint  *net.UDPAddr
     TunnelIP  net.IP
+    
+    // Crypto material for this layer of nesting
+    PrivateKey   *Secret // local key, generated when nil
+    PresharedKey *Secret // optional
 }
 
 func (mh *MultiHop) AddHop(hop *HopNode) error {
     mh.mu.Lock()
     defer mh.mu.Unlock()
     
+    if hop.Endpoint == nil {
+        return fmt.Errorf("hop %s has no endpoint", hop.PublicKey)
+    }
+    if hop.PrivateKey == nil {
+        key, err := GenerateSecret()
+        if err != nil {
+            return fmt.Errorf("failed to generate hop key: %w", err)
+        }
+        hop.PrivateKey = key
+    }
+    
     // Create nested tunnel through previous hop
     if len(mh.hops) > 0 {
         prevHop := mh.hops[len(mh.hops)-1]
+        if prevHop.TunnelIP == nil {
+            return fmt.Errorf("hop %s has no tunnel IP to nest through", prevHop.PublicKey)
+        }
         // Route this hop through the previous one
         hop.Endpoint = &net.UDPAddr{
             IP:   prevHop.TunnelIP,
@@ -403,7 +1174,31 @@ func (mh *MultiHop) AddHop(hop *HopNode) error {
 type Obfuscator struct {
     enabled    atomic.Bool
     mode       ObfuscationMode
-    xorKey     []byte
+    
+    // XOR keys, see RotateKey. Packets name the key they were made with.
+    keyMu      sync.RWMutex
+    xorKey     *Secret
+    keyID      uint8
+    prevKey    *Secret // still accepted until prevUntil
+    prevKeyID  uint8
+    prevUntil  time.Time
+    grace      time.Duration
+    clock      Clock // key grace and rotation
+    
+    rotation     chan struct{} // closed by StopRotation
+    rotationDone chan struct{}
+    rotationTo   io.Writer     // where StartRotation sends announcements
+    
+    padder atomic.Pointer[AdaptivePadder] // see SetPadding
+    shaper atomic.Pointer[trafficShaper]  // see SetShaping, replaces padder
+    
+    cover     chan struct{} // closed by StopCover, under keyMu
+    coverDone chan struct{}
+    
+    // Queues of WrapQueued connections, closed ones live on in the totals
+    queueMu       sync.Mutex
+    queues        map[*PacketQueue]struct{}
+    retiredQueues QueueStats
 }
 
 type ObfuscationMode int
@@ -419,7 +1214,16 @@ func (ob *Obfuscator) ObfuscatePacket(data []byte) []byte {
     if !ob.enabled.Load() {
         return data
     }
-    
+    if shaper := ob.shaper.Load(); shaper != nil {
+        data = shaper.shape(data)
+    } else if padder := ob.padder.Load(); padder != nil {
+        data = padder.Pad(data)
+    }
+    return ob.encode(data)
+}
+
+// Wrap a datagram in the current mode
+func (ob *Obfuscator) encode(data []byte) []byte {
     switch ob.mode {
     case ObfuscationXOR:
         return ob.xorObfuscate(data)
@@ -432,10 +1236,16 @@ func (ob *Obfuscator) ObfuscatePacket(data []byte) []byte {
     }
 }
 
+// Key ID byte followed by the payload XORed with that key
 func (ob *Obfuscator) xorObfuscate(data []byte) []byte {
-    result := make([]byte, len(data))
+    ob.keyMu.RLock()
+    defer ob.keyMu.RUnlock()
+    
+    key := ob.xorKey.Bytes()
+    result := make([]byte, 1+len(data))
+    result[0] = ob.keyID
     for i := range data {
-        result[i] = data[i] ^ ob.xorKey[i%len(ob.xorKey)]
+        result[1+i] = data[i] ^ key[i%len(key)]
     }
     return result
 }
@@ -454,47 +1264,89 @@ type FailoverManager struct {
     vpn           *UnderTheRadarVPN
     checkInterval time.Duration
     failureThreshold int
+    settleTime    time.Duration // wait for a handshake after switching endpoint
+    
+    // Failure events are debounced so a flapping link doesn't flood the
+    // event stream; recovery is only reported once the peer has passed
+    // recoveryChecks checks in a row.
+    events         *Debouncer
+    recoveryChecks int
+    failed         map[wgtypes.Key]int // healthy checks since the last failure
 }
 
-func (fm *FailoverManager) Start() {
-    ticker := time.NewTicker(fm.checkInterval)
+// Consecutive healthy checks before a failed peer counts as recovered
+const DefaultRecoveryChecks = 3
+
+func NewFailoverManager(vpn *UnderTheRadarVPN) *FailoverManager {
+    return &FailoverManager{
+        vpn:           vpn,
+        checkInterval: DefaultHealthInterval,
+        failureThreshold: 3,
+        settleTime:    HandshakeTimeout,
+        events:        newDebouncer(DefaultEventDebounceWindow, vpn.emitEvent, vpn.clock()),
+        recoveryChecks: DefaultRecoveryChecks,
+        failed:        make(map[wgtypes.Key]int),
+    }
+}
+
+// Start checks the peers every checkInterval until ctx is done
+func (fm *FailoverManager) Start(ctx context.Context) {
+    ticker := fm.vpn.clock().NewTicker(fm.checkInterval)
     defer ticker.Stop()
     
-    for range ticker.C {
-        fm.checkPeers()
+    for {
+        select {
+        case <-ticker.C():
+            fm.checkPeers(ctx)
+        case <-ctx.Done():
+            return
+        }
     }
 }
 
-func (fm *FailoverManager) checkPeers() {
-    for _, peer := range fm.vpn.peers {
+func (fm *FailoverManager) checkPeers(ctx context.Context) {
+    for _, peer := range fm.vpn.peers.list {
+        if ctx.Err() != nil {
+            return
+        }
         if !fm.isPeerHealthy(peer) {
-            fm.handlePeerFailure(peer)
+            fm.handlePeerFailure(ctx, peer)
+        } else {
+            fm.confirmRecovery(peer)
         }
     }
+    
+    // Prefixes held back by pinned flows, and moves that failed last time
+    fm.rebalance()
 }
 
-func (fm *FailoverManager) isPeerHealthy(peer *Peer) bool {
-    // Check last handshake time
-    if time.Since(peer.LastHandshake) > HandshakeTimeout {
-        return false
-    }
-    
-    // Check packet loss
-    if peer.PacketLoss.Load() > 500 { // 5%
-        return false
-    }
-    
-    // Check latency
-    if peer.CurrentLatency.Load() > 200000 { // 200ms
-        return false
-    }
+// Re-evaluate prefix ownership after a peer's standing changed. A move that
+// fails is retried on the next check.
+func (fm *FailoverManager) rebalance() {
+    fm.vpn.mu.Lock()
+    defer fm.vpn.mu.Unlock()
     
-    return true
+    fm.vpn.rebalanceAllowedIPsLocked()
+}
+
+// The health checker's strategy owns the definition of healthy
+func (fm *FailoverManager) isPeerHealthy(peer *Peer) bool {
+    return fm.vpn.healthCheck.IsHealthy(peer)
 }
 
-func (fm *FailoverManager) handlePeerFailure(peer *Peer) {
+// Sweep the peer's alternate endpoints for one that works. Once ctx is
+// done the sweep ends without a verdict: the peer is not marked dead.
+func (fm *FailoverManager) handlePeerFailure(ctx context.Context, peer *Peer) {
+    fm.failed[peer.PublicKey] = 0
+    peer.failing.Store(true)
+    defer fm.rebalance()
+    reason := dominantDropReason(fm.vpn.GetDropReasons(peer.PublicKey))
+    
     // Try alternate endpoints
-    for _, endpoint := range peer.AlternateEndpoints {
+    for _, endpoint := range peer.AlternateEndpoints() {
+        if ctx.Err() != nil {
+            return
+        }
         peer.Endpoint = &endpoint
         
         // Reconfigure peer with new endpoint
@@ -508,63 +1360,234 @@ func (fm *FailoverManager) handlePeerFailure(peer *Peer) {
         
         if err := fm.vpn.wgClient.ConfigureDevice(fm.vpn.deviceName, cfg); err == nil {
             // Test new endpoint
-            if fm.testEndpoint(peer) {
+            if fm.testEndpoint(ctx, peer) {
+                fm.vpn.metricSink().Count("peer.failover", 1, append(peer.metricTags(), "result:alternate")...)
+                fm.events.Emit(Event{
+                    Type:      EventPeerFailed,
+                    PublicKey: peer.PublicKey,
+                    Message:   fmt.Sprintf("peer unhealthy, failed over to %s", endpoint.String()),
+                    DegradationReason: reason,
+                    FailedOver: true,
+                })
                 return // Success
             }
         }
     }
     
     // Mark peer as dead if all endpoints fail
-    peer.IsAlive.Store(false)
+    if ctx.Err() != nil {
+        return
+    }
+    peer.setAlive(false, fm.vpn.clock().Now())
+    fm.vpn.metricSink().Count("peer.failover", 1, append(peer.metricTags(), "result:dead")...)
+    fm.events.Emit(Event{
+        Type:      EventPeerFailed,
+        PublicKey: peer.PublicKey,
+        Message:   "peer unhealthy on all endpoints",
+        DegradationReason: reason,
+    })
+}
+
+// Report a failed peer as recovered once it has stayed healthy
+func (fm *FailoverManager) confirmRecovery(peer *Peer) {
+    healthy, failed := fm.failed[peer.PublicKey]
+    if !failed {
+        return
+    }
+    if healthy++; healthy < fm.recoveryChecks {
+        fm.failed[peer.PublicKey] = healthy
+        return
+    }
+    delete(fm.failed, peer.PublicKey)
+    peer.failing.Store(false)
+    fm.vpn.metricSink().Count("peer.recovered", 1, peer.metricTags()...)
+    fm.vpn.emitEvent(Event{
+        Type:      EventPeerRecovered,
+        PublicKey: peer.PublicKey,
+        Message:   fmt.Sprintf("peer healthy for %d checks", healthy),
+    })
+    
+    // Fail back to it if it outranks the peers that took over
+    fm.rebalance()
+}
+
+// Give the new endpoint time to handshake, then re-run the health strategy
+func (fm *FailoverManager) testEndpoint(ctx context.Context, peer *Peer) bool {
+    select {
+    case <-fm.vpn.clock().After(fm.settleTime):
+    case <-ctx.Done():
+        return false
+    }
+    return fm.vpn.healthCheck.CheckPeer(peer)
 }
 
-// Performance monitoring and optimization
+// Performance monitoring and optimization, from a full device dump
 func (vpn *UnderTheRadarVPN) collectMetrics() {
-    device, err := vpn.wgClient.Device(vpn.deviceName)
+    device, err := vpn.pollDevice()
     if err != nil {
         return
     }
+    vpn.applyPeerStats(device.Peers, 0)
+    vpn.collectLinkStats()
+}
+
+// Update peers from kernel samples and return those that had traffic or a
+// handshake within active. Peers missing from samples are left as they are.
+func (vpn *UnderTheRadarVPN) applyPeerStats(samples []wgtypes.Peer, active time.Duration) []wgtypes.Key {
+    vpn.mu.RLock()
+    weights := vpn.loadWeights
+    vpn.mu.RUnlock()
+    sink := vpn.metricSink()
+    now := vpn.clock().Now()
     
-    for _, wgPeer := range device.Peers {
-        peer, exists := vpn.peers[wgPeer.PublicKey.String()]
-        if !exists {
+    var busy []wgtypes.Key
+    for _, wgPeer := range samples {
+        vpn.mu.RLock()
+        peer := vpn.peers.get(wgPeer.PublicKey)
+        vpn.mu.RUnlock()
+        if peer == nil {
             continue
         }
         
-        // Update metrics
+        // Update metrics, rebasing if the kernel counters were reset
+        beforeRx, beforeTx := peer.RxBytes.Load(), peer.TxBytes.Load()
+        before := beforeRx + beforeTx
         peer.LastHandshake = wgPeer.LastHandshakeTime
-        peer.RxBytes.Store(uint64(wgPeer.ReceiveBytes))
-        peer.TxBytes.Store(uint64(wgPeer.TransmitBytes))
+        peer.history.handshake(wgPeer.LastHandshakeTime)
+        rx, rxReset := peer.rxCounter.update(uint64(wgPeer.ReceiveBytes))
+        tx, txReset := peer.txCounter.update(uint64(wgPeer.TransmitBytes))
+        peer.RxBytes.Store(rx)
+        peer.TxBytes.Store(tx)
         
-        // Calculate load score
-        load := peer.RxBytes.Load() + peer.TxBytes.Load()
-        latency := uint64(peer.CurrentLatency.Load())
-        packetLoss := uint64(peer.PacketLoss.Load())
+        if rxReset || txReset {
+            vpn.emitEvent(Event{
+                Type:      EventCounterReset,
+                PublicKey: peer.PublicKey,
+                Message:   "transfer counters reset, device was likely recreated",
+            })
+        }
         
-        // Weighted score: bandwidth + (latency * 1000) + (packet_loss * 10000)
-        score := load + (latency * 1000) + (packetLoss * 10000)
+        // Calculate load score, see LoadWeights for the formula
+        load := rx + tx
+        score := weights.score(load, peer.CurrentLatency.Load(), peer.PacketLoss.Load())
         peer.LoadScore.Store(score)
+        vpn.reportPeerMetrics(sink, peer, rx-beforeRx, tx-beforeTx, now)
+        
+        // Throttled flows show up here first
+        vpn.hopPortIfDue(peer, now)
+        
+        if peer.flows != nil {
+            peer.flows.rebalance()
+        }
+        
+        if load != before || now.Sub(wgPeer.LastHandshakeTime) < active {
+            busy = append(busy, wgPeer.PublicKey)
+        }
     }
+    return busy
 }
 
 // Graceful shutdown
 func (vpn *UnderTheRadarVPN) Stop() error {
+    return vpn.StopContext(context.Background())
+}
+
+// StopContext is Stop with ctx bounding the graceful part: the operations
+// admission control is running, the last metrics push and the webhook
+// report in flight. Once ctx is done they are abandoned and the rest is
+// torn down regardless; ctx's error is returned with any other.
+func (vpn *UnderTheRadarVPN) StopContext(ctx context.Context) error {
     // Disable kill switch first to restore connectivity
     if vpn.killSwitch.enabled.Load() {
         vpn.killSwitch.Disable()
     }
+    vpn.stopProcessBypass()
+    vpn.stopCaptivePortal()
+    vpn.splitTunnel.Disable()
     
-    // Stop health checks
-    vpn.healthCheck.Stop()
+    if vpn.dnsProtector.enabled.Load() {
+        vpn.dnsProtector.Disable()
+    }
+    vpn.nft.Close()
     
-    // Detach eBPF programs
-    if vpn.xdpProgram != nil {
-        vpn.xdpProgram.Close()
+    vpn.pinhole.Close()
+    vpn.mssClamp.Disable()
+    vpn.hopRedirect.Close()
+    
+    // Drop proxied connections before the tunnel goes away
+    vpn.stopProxy()
+    vpn.stopUAPI()
+    vpn.stopServerStatus()
+    
+    vpn.mu.Lock()
+    admission := vpn.admission
+    vpn.admission = nil
+    vpn.mu.Unlock()
+    if admission != nil {
+        admission.StopContext(ctx)
+    }
+    
+    // A failover sweep ends without waiting out its settle time
+    vpn.mu.Lock()
+    stopFailover := vpn.stopFailover
+    vpn.stopFailover = nil
+    vpn.mu.Unlock()
+    if stopFailover != nil {
+        stopFailover()
+    }
+    
+    // Stop health checks and metrics collection
+    vpn.healthCheck.Stop()
+    vpn.metrics.Stop()
+    vpn.mu.Lock()
+    autoPriority := vpn.autoPriority
+    vpn.autoPriority = nil
+    vpn.mu.Unlock()
+    if autoPriority != nil {
+        autoPriority.Stop()
     }
-    if vpn.tcProgram != nil {
-        vpn.tcProgram.Close()
+    vpn.mu.Lock()
+    endpoints := vpn.endpoints
+    vpn.endpoints = nil
+    vpn.mu.Unlock()
+    if endpoints != nil {
+        endpoints.Stop()
+    }
+    vpn.stopWebhook()
+    vpn.stopRemoteWrite(ctx)
+    vpn.failoverMgr.events.Stop()
+    
+    // Give TURN allocations back
+    vpn.mu.Lock()
+    for _, peer := range vpn.peers.list {
+        peer.closeTURN()
+        peer.closeObfuscator()
     }
+    vpn.mu.Unlock()
+    
+    // Tear down nested hop devices
+    vpn.removeMultiHop()
+    
+    // Detach eBPF programs
+    vpn.stopInterfaceWatcher()
+    vpn.loader().Detach(vpn)
+    vpn.loader().Close(vpn)
+    vpn.removeSocketRouting()
     
     // Close WireGuard client
-    return vpn.wgClient.Close()
+    err := vpn.wgClient.Close()
+    
+    // Wipe key material
+    vpn.keys.Zeroize()
+    vpn.obfuscator.StopRotation()
+    vpn.obfuscator.StopCover()
+    vpn.obfuscator.Zeroize()
+    
+    // Let the next instance in
+    vpn.unlockInstance()
+    
+    if ctx.Err() != nil {
+        return errors.Join(err, fmt.Errorf("teardown forced: %w", ctx.Err()))
+    }
+    return err
 }
\ No newline at end of file
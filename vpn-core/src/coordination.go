@@ -0,0 +1,366 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/ed25519"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "reflect"
+    "sort"
+    "sync"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+    // Base64 Ed25519 signature of the body by CoordinationConfig.SigningKey
+    PeerListSignatureHeader = "X-UTR-Peers-Signature"
+    
+    DefaultCoordinationInterval = time.Minute
+    
+    maxPeerListSize = 4 << 20
+)
+
+var (
+    ErrPeerListSignature = errors.New("peer list signature invalid")
+    ErrPeerListStale     = errors.New("peer list older than the one applied")
+)
+
+var errNoSigningKey = fmt.Errorf("%w: no coordination signing key configured", ErrPeerListSignature)
+
+// CoordinationConfig is what SyncPeers trusts and how often it asks
+type CoordinationConfig struct {
+    SigningKey ed25519.PublicKey // the coordination server's, lists it didn't sign are refused
+    Interval   time.Duration     // between syncs, default DefaultCoordinationInterval
+}
+
+func (c CoordinationConfig) withDefaults() CoordinationConfig {
+    if c.Interval <= 0 {
+        c.Interval = DefaultCoordinationInterval
+    }
+    return c
+}
+
+func (c CoordinationConfig) equal(other CoordinationConfig) bool {
+    return c.SigningKey.Equal(other.SigningKey) && c.Interval == other.Interval
+}
+
+// As last applied, Reload may change it while SyncPeers runs
+func (vpn *UnderTheRadarVPN) coordinationConfig() CoordinationConfig {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    return vpn.config.Coordination.withDefaults()
+}
+
+// PeerList is the JSON document a coordination server serves, signed in
+// PeerListSignatureHeader. It is the whole peer set.
+type PeerList struct {
+    GeneratedAt time.Time    `json:"generated_at"` // lists older than the last applied are refused
+    Peers       []ListedPeer `json:"peers"`
+}
+
+// ListedPeer is one peer of a PeerList
+type ListedPeer struct {
+    PublicKey           string   `json:"public_key"`
+    Endpoint            string   `json:"endpoint,omitempty"` // host:port, a hostname is followed as EndpointHost
+    AllowedIPs          []string `json:"allowed_ips"`
+    PersistentKeepalive int      `json:"persistent_keepalive,omitempty"` // seconds
+    Priority            int      `json:"priority,omitempty"`
+    Group               string   `json:"group,omitempty"`
+    SkipProbe           bool     `json:"skip_probe,omitempty"`
+}
+
+func (p ListedPeer) peerConfig() (PeerConfig, error) {
+    key, err := wgtypes.ParseKey(p.PublicKey)
+    if err != nil {
+        return PeerConfig{}, fmt.Errorf("%w: %q", ErrKeyInvalid, p.PublicKey)
+    }
+    pc := PeerConfig{
+        PublicKey:           key,
+        EndpointHost:        p.Endpoint,
+        Priority:            p.Priority,
+        Group:               p.Group,
+        PersistentKeepalive: time.Duration(p.PersistentKeepalive) * time.Second,
+        SkipProbe:           p.SkipProbe,
+    }
+    if p.PersistentKeepalive < 0 {
+        return PeerConfig{}, fmt.Errorf("peer %s: negative persistent keepalive", key)
+    }
+    for _, s := range p.AllowedIPs {
+        _, prefix, err := net.ParseCIDR(s)
+        if err != nil {
+            return PeerConfig{}, fmt.Errorf("peer %s: invalid allowed IP %q", key, s)
+        }
+        pc.AllowedIPs = append(pc.AllowedIPs, *prefix)
+    }
+    return pc, nil
+}
+
+// PeerSyncStatus tells how syncing with the coordination server goes
+type PeerSyncStatus struct {
+    URL       string
+    LastSync  time.Time // last list applied
+    Peers     int       // in that list
+    Failures  int       // failed syncs in a row, the last known peers stay meanwhile
+    LastError string
+}
+
+// State of SyncPeers, zero value ready
+type peerSyncState struct {
+    mu          sync.Mutex
+    running     bool
+    applied     map[wgtypes.Key]ListedPeer // as last applied
+    generatedAt time.Time
+    status      PeerSyncStatus
+}
+
+// SyncPeers makes the peers those of the coordination server at coordURL:
+// it GETs the signed PeerList with authToken as bearer token, adds the
+// peers that are new, updates those that changed and removes the ones not
+// listed, then does it again every CoordinationConfig.Interval until ctx
+// is done. The key and interval Reload changes take effect from the next
+// sync. A list that fails to fetch or verify changes nothing, the last
+// known peers stay until the server answers again; the failure is counted
+// in Status.PeerSync and reported as EventPeerSync.
+func (vpn *UnderTheRadarVPN) SyncPeers(ctx context.Context, coordURL string, authToken string) error {
+    cfg := vpn.coordinationConfig()
+    if len(cfg.SigningKey) != ed25519.PublicKeySize {
+        return errNoSigningKey
+    }
+    
+    s := &vpn.peerSync
+    s.mu.Lock()
+    if s.running {
+        s.mu.Unlock()
+        return errors.New("peer sync already running")
+    }
+    s.running = true
+    s.status.URL = coordURL
+    s.mu.Unlock()
+    defer func() {
+        s.mu.Lock()
+        s.running = false
+        s.mu.Unlock()
+    }()
+    
+    client := &http.Client{Timeout: 10 * time.Second}
+    interval := cfg.Interval
+    ticker := vpn.clock().NewTicker(interval)
+    defer func() { ticker.Stop() }()
+    for {
+        err := vpn.syncPeersOnce(ctx, client, coordURL, authToken)
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+        vpn.recordPeerSync(err)
+        
+        select {
+        case <-ticker.C():
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+        if next := vpn.coordinationConfig().Interval; next != interval {
+            ticker.Stop()
+            interval = next
+            ticker = vpn.clock().NewTicker(interval)
+        }
+    }
+}
+
+func (vpn *UnderTheRadarVPN) recordPeerSync(err error) {
+    s := &vpn.peerSync
+    s.mu.Lock()
+    if err == nil {
+        s.status.LastSync = vpn.clock().Now()
+        s.status.Peers = len(s.applied)
+        s.status.Failures = 0
+        s.status.LastError = ""
+    } else {
+        s.status.Failures++
+        s.status.LastError = err.Error()
+    }
+    s.mu.Unlock()
+    
+    if err == nil {
+        vpn.metricSink().Count("peers.synced", 1, "result:ok")
+        return
+    }
+    vpn.metricSink().Count("peers.synced", 1, "result:failed")
+    vpn.emitEvent(Event{Type: EventPeerSync, Message: err.Error()})
+}
+
+func (vpn *UnderTheRadarVPN) peerSyncStatus() PeerSyncStatus {
+    vpn.peerSync.mu.Lock()
+    defer vpn.peerSync.mu.Unlock()
+    return vpn.peerSync.status
+}
+
+// Fetch, verify and apply the list once
+func (vpn *UnderTheRadarVPN) syncPeersOnce(ctx context.Context, client *http.Client, coordURL, authToken string) error {
+    key := vpn.coordinationConfig().SigningKey
+    if len(key) != ed25519.PublicKeySize {
+        return errNoSigningKey // ed25519.Verify panics on it
+    }
+    
+    list, err := fetchPeerList(ctx, client, coordURL, authToken, key)
+    if err != nil {
+        return err
+    }
+    s := &vpn.peerSync
+    s.mu.Lock()
+    last := s.generatedAt
+    s.mu.Unlock()
+    if list.GeneratedAt.Before(last) {
+        // A replayed list would bring back removed peers
+        return fmt.Errorf("%w: generated %s, applied %s", ErrPeerListStale, list.GeneratedAt.Format(time.RFC3339), last.Format(time.RFC3339))
+    }
+    
+    // A broken entry is the server's bug, nothing is applied
+    configs := make(map[wgtypes.Key]PeerConfig, len(list.Peers))
+    listed := make(map[wgtypes.Key]ListedPeer, len(list.Peers))
+    for _, p := range list.Peers {
+        pc, err := p.peerConfig()
+        if err != nil {
+            return fmt.Errorf("invalid peer list from %s: %w", coordURL, err)
+        }
+        if _, dup := configs[pc.PublicKey]; dup {
+            return fmt.Errorf("invalid peer list from %s: peer %s listed twice", coordURL, pc.PublicKey)
+        }
+        configs[pc.PublicKey], listed[pc.PublicKey] = pc, p
+    }
+    
+    err = vpn.applyPeerList(ctx, configs, listed)
+    s.mu.Lock()
+    s.generatedAt = list.GeneratedAt
+    s.mu.Unlock()
+    return err
+}
+
+// Bring the peers in line with the list. A peer that fails is left out of
+// the applied list, so the next sync tries it again.
+func (vpn *UnderTheRadarVPN) applyPeerList(ctx context.Context, configs map[wgtypes.Key]PeerConfig, listed map[wgtypes.Key]ListedPeer) error {
+    vpn.mu.RLock()
+    current := make(map[wgtypes.Key]bool, vpn.peers.len())
+    for _, peer := range vpn.peers.list {
+        current[peer.PublicKey] = true
+    }
+    vpn.mu.RUnlock()
+    
+    s := &vpn.peerSync
+    s.mu.Lock()
+    applied := make(map[wgtypes.Key]ListedPeer, len(s.applied))
+    for key, p := range s.applied {
+        applied[key] = p
+    }
+    s.mu.Unlock()
+    
+    var errs []error
+    var added, updated, removed int
+    for key := range current {
+        if _, ok := configs[key]; ok {
+            continue
+        }
+        if err := vpn.RemovePeer(key); err != nil && !errors.Is(err, ErrPeerNotFound) {
+            errs = append(errs, err)
+            continue
+        }
+        delete(applied, key)
+        removed++
+    }
+    
+    // In key order, so prefix conflicts resolve the same way every time
+    keys := make([]wgtypes.Key, 0, len(configs))
+    for key := range configs {
+        keys = append(keys, key)
+    }
+    sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+    for _, key := range keys {
+        if ctx.Err() != nil {
+            errs = append(errs, ctx.Err())
+            break
+        }
+        next := listed[key]
+        prev, known := applied[key]
+        switch {
+        case current[key] && known && reflect.DeepEqual(prev, next):
+            continue
+        case current[key] && known && onlyPriorityChanged(prev, next):
+            if err := vpn.UpdatePeer(key, PeerUpdate{Priority: &next.Priority}); err != nil {
+                errs = append(errs, err)
+                continue
+            }
+            updated++
+        default:
+            // Replaces the peer when it exists
+            if err := vpn.AddPeerContext(ctx, configs[key]); err != nil {
+                delete(applied, key)
+                errs = append(errs, fmt.Errorf("peer %s: %w", key, err))
+                continue
+            }
+            if current[key] {
+                updated++
+            } else {
+                added++
+            }
+        }
+        applied[key] = next
+    }
+    
+    s.mu.Lock()
+    s.applied = applied
+    s.mu.Unlock()
+    if added+updated+removed > 0 {
+        vpn.emitEvent(Event{
+            Type:    EventPeerSync,
+            Message: fmt.Sprintf("%d peers added, %d updated, %d removed", added, updated, removed),
+        })
+    }
+    return errors.Join(errs...)
+}
+
+// Whether only the priority differs, which UpdatePeer changes in place
+func onlyPriorityChanged(prev, next ListedPeer) bool {
+    prev.Priority = next.Priority
+    return reflect.DeepEqual(prev, next)
+}
+
+// GET the list and check its signature before decoding it
+func fetchPeerList(ctx context.Context, client *http.Client, coordURL, authToken string, key ed25519.PublicKey) (PeerList, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, coordURL, nil)
+    if err != nil {
+        return PeerList{}, fmt.Errorf("invalid coordination URL %q: %w", coordURL, err)
+    }
+    if authToken != "" {
+        req.Header.Set("Authorization", "Bearer "+authToken)
+    }
+    
+    resp, err := client.Do(req)
+    if err != nil {
+        return PeerList{}, fmt.Errorf("failed to fetch peer list from %s: %w", coordURL, err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return PeerList{}, fmt.Errorf("failed to fetch peer list from %s: %s", coordURL, resp.Status)
+    }
+    body, err := io.ReadAll(io.LimitReader(resp.Body, maxPeerListSize))
+    if err != nil {
+        return PeerList{}, fmt.Errorf("failed to read peer list from %s: %w", coordURL, err)
+    }
+    
+    sig, err := base64.StdEncoding.DecodeString(resp.Header.Get(PeerListSignatureHeader))
+    if err != nil || !ed25519.Verify(key, body, sig) {
+        return PeerList{}, fmt.Errorf("%w: %s", ErrPeerListSignature, coordURL)
+    }
+    var list PeerList
+    if err := json.Unmarshal(body, &list); err != nil {
+        return PeerList{}, fmt.Errorf("failed to decode peer list from %s: %w", coordURL, err)
+    }
+    return list, nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+    "context"
+    "crypto/ed25519"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// A coordination server serving whatever list the test sets, signed
+type coordServer struct {
+    mu      sync.Mutex
+    key     ed25519.PrivateKey
+    list    PeerList
+    down    bool
+    badSig  bool
+    tokens  []string
+}
+
+func (c *coordServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.tokens = append(c.tokens, r.Header.Get("Authorization"))
+    if c.down {
+        http.Error(w, "maintenance", http.StatusServiceUnavailable)
+        return
+    }
+    body, _ := json.Marshal(c.list)
+    sig := ed25519.Sign(c.key, body)
+    if c.badSig {
+        sig[0] ^= 1
+    }
+    w.Header().Set(PeerListSignatureHeader, base64.StdEncoding.EncodeToString(sig))
+    w.Write(body)
+}
+
+func (c *coordServer) set(update func(c *coordServer)) {
+    c.mu.Lock()
+    update(c)
+    c.mu.Unlock()
+}
+
+// A VPN syncing from a mock coordination server until the test ends
+func startPeerSync(t *testing.T, clock *FakeClock) (*UnderTheRadarVPN, *coordServer, <-chan error) {
+    t.Helper()
+    vpn := newTestVPN(t, newFakeWGClient())
+    vpn.timeSource = clock
+    coord, done := syncPeersFromMock(t, clock, vpn)
+    return vpn, coord, done
+}
+
+// Start vpn syncing from a mock coordination server until the test ends
+func syncPeersFromMock(t *testing.T, clock *FakeClock, vpn *UnderTheRadarVPN) (*coordServer, <-chan error) {
+    t.Helper()
+    pub, priv, err := ed25519.GenerateKey(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    coord := &coordServer{key: priv, list: PeerList{GeneratedAt: clock.Now()}}
+    server := httptest.NewServer(coord)
+    t.Cleanup(server.Close)
+    
+    vpn.mu.Lock()
+    vpn.config.Coordination = CoordinationConfig{SigningKey: pub, Interval: time.Minute}
+    vpn.mu.Unlock()
+    
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan error, 1)
+    go func() { done <- vpn.SyncPeers(ctx, server.URL+"/peers", "s3cret") }()
+    t.Cleanup(func() {
+        cancel()
+        <-done
+    })
+    advanceUntil(t, clock, 0, func() bool { return !vpn.peerSyncStatus().LastSync.IsZero() })
+    return coord, done
+}
+
+// Move the clock from sync to sync until done holds
+func syncUntil(t *testing.T, clock *FakeClock, vpn *UnderTheRadarVPN, done func(PeerSyncStatus) bool) PeerSyncStatus {
+    t.Helper()
+    var status PeerSyncStatus
+    advanceUntil(t, clock, time.Minute, func() bool {
+        status = vpn.peerSyncStatus()
+        return done(status)
+    })
+    return status
+}
+
+func listedPeer(key wgtypes.Key, priority int, allowedIPs ...string) ListedPeer {
+    return ListedPeer{PublicKey: key.String(), AllowedIPs: allowedIPs, Priority: priority, SkipProbe: true}
+}
+
+func peerKeys(vpn *UnderTheRadarVPN) map[wgtypes.Key]*Peer {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    peers := make(map[wgtypes.Key]*Peer)
+    for _, peer := range vpn.peers.list {
+        peers[peer.PublicKey] = peer
+    }
+    return peers
+}
+
+// Whether the peers are exactly keys
+func havePeers(vpn *UnderTheRadarVPN, keys ...wgtypes.Key) bool {
+    peers := peerKeys(vpn)
+    for _, key := range keys {
+        if peers[key] == nil {
+            return false
+        }
+    }
+    return len(peers) == len(keys)
+}
+
+func TestSyncPeersAppliesTheList(t *testing.T) {
+    clock := NewFakeClock(time.Unix(1700000000, 0))
+    a, b, d := mustKey(t).PublicKey(), mustKey(t).PublicKey(), mustKey(t).PublicKey()
+    vpn, coord, _ := startPeerSync(t, clock)
+    sink := &captureSink{}
+    vpn.SetMetricSink(sink)
+    
+    // A peer the server doesn't know about goes on the first sync
+    manual := mustKey(t).PublicKey()
+    if err := vpn.AddPeer(PeerConfig{PublicKey: manual, SkipProbe: true}); err != nil {
+        t.Fatal(err)
+    }
+    coord.set(func(c *coordServer) {
+        c.list.Peers = []ListedPeer{listedPeer(a, 10, "10.1.0.0/24"), listedPeer(b, 10, "10.2.0.0/24")}
+    })
+    status := syncUntil(t, clock, vpn, func(s PeerSyncStatus) bool { return s.Peers == 2 && havePeers(vpn, a, b) })
+    peers := peerKeys(vpn)
+    if status.Peers != 2 || status.Failures != 0 || !strings.HasSuffix(status.URL, "/peers") {
+        t.Fatalf("status %+v", status)
+    }
+    coord.set(func(c *coordServer) {
+        if c.tokens[0] != "Bearer s3cret" {
+            t.Errorf("sent authorization %q", c.tokens[0])
+        }
+    })
+    
+    // A new priority is changed in place, new prefixes replace the peer
+    before := peers
+    coord.set(func(c *coordServer) {
+        c.list.GeneratedAt = clock.Now()
+        c.list.Peers = []ListedPeer{
+            listedPeer(a, 30, "10.1.0.0/24"),
+            listedPeer(b, 10, "10.2.0.0/24", "10.3.0.0/24"),
+            listedPeer(d, 10, "10.4.0.0/24"),
+        }
+    })
+    syncUntil(t, clock, vpn, func(PeerSyncStatus) bool {
+        peers = peerKeys(vpn)
+        return havePeers(vpn, a, b, d) && peers[b] != before[b] && peers[a].Priority == 30
+    })
+    if peers[a] != before[a] {
+        t.Fatal("priority change should update the peer in place")
+    }
+    if len(peers[b].AllowedIPs) != 2 {
+        t.Fatalf("peers after the second sync: %v", peers)
+    }
+    
+    // Unchanged peers are left alone, unlisted ones removed
+    before = peers
+    coord.set(func(c *coordServer) {
+        c.list.GeneratedAt = clock.Now()
+        c.list.Peers = c.list.Peers[:2]
+    })
+    syncUntil(t, clock, vpn, func(PeerSyncStatus) bool { return havePeers(vpn, a, b) })
+    peers = peerKeys(vpn)
+    if peers[a] != before[a] || peers[b] != before[b] {
+        t.Fatalf("peers after the third sync: %v", peers)
+    }
+    if !sink.has("c peers.synced 1 result:ok") {
+        t.Fatalf("no sync metric in %v", sink.metrics)
+    }
+    
+    
+    // One event per sync that changed peers
+    var synced int
+    advanceUntil(t, clock, 0, func() bool {
+        for len(vpn.events) > 0 {
+            if ev := <-vpn.events; ev.Type == EventPeerSync {
+                synced++
+            }
+        }
+        return synced >= 3
+    })
+    if synced != 3 {
+        t.Fatalf("%d peer-sync events", synced)
+    }
+}
+
+func TestSyncPeersKeepsPeersWhileServerUnreachable(t *testing.T) {
+    clock := NewFakeClock(time.Unix(1700000000, 0))
+    a, b := mustKey(t).PublicKey(), mustKey(t).PublicKey()
+    vpn, coord, _ := startPeerSync(t, clock)
+    coord.set(func(c *coordServer) {
+        c.list.Peers = []ListedPeer{listedPeer(a, 10, "10.1.0.0/24")}
+    })
+    syncUntil(t, clock, vpn, func(PeerSyncStatus) bool { return havePeers(vpn, a) })
+    
+    coord.set(func(c *coordServer) {
+        c.down = true
+        c.list.GeneratedAt = clock.Now()
+        c.list.Peers = []ListedPeer{listedPeer(b, 10, "10.2.0.0/24")}
+    })
+    syncUntil(t, clock, vpn, func(s PeerSyncStatus) bool { return strings.Contains(s.LastError, "503") })
+    if !havePeers(vpn, a) {
+        t.Fatalf("last known peers should stay, have %v", peerKeys(vpn))
+    }
+    
+    // Back up, the list it has now applies
+    coord.set(func(c *coordServer) { c.down = false })
+    status := syncUntil(t, clock, vpn, func(s PeerSyncStatus) bool { return s.Failures == 0 })
+    if status.LastError != "" || !havePeers(vpn, b) {
+        t.Fatalf("status %+v, peers %v", status, peerKeys(vpn))
+    }
+}
+
+func TestSyncPeersRefusesUntrustedLists(t *testing.T) {
+    clock := NewFakeClock(time.Unix(1700000000, 0))
+    a, b := mustKey(t).PublicKey(), mustKey(t).PublicKey()
+    vpn, coord, _ := startPeerSync(t, clock)
+    coord.set(func(c *coordServer) {
+        c.list.GeneratedAt = clock.Now()
+        c.list.Peers = []ListedPeer{listedPeer(a, 10, "10.1.0.0/24")}
+    })
+    syncUntil(t, clock, vpn, func(PeerSyncStatus) bool { return havePeers(vpn, a) })
+    
+    for _, tc := range []struct {
+        name   string
+        update func(c *coordServer)
+        want   string
+    }{
+        {"bad signature", func(c *coordServer) {
+            c.badSig = true
+            c.list.GeneratedAt = clock.Now()
+        }, ErrPeerListSignature.Error()},
+        {"replayed", func(c *coordServer) {
+            c.badSig = false
+            c.list.GeneratedAt = time.Unix(1600000000, 0)
+        }, ErrPeerListStale.Error()},
+        {"invalid entry", func(c *coordServer) {
+            c.list.GeneratedAt = clock.Now()
+            c.list.Peers = append(c.list.Peers, ListedPeer{PublicKey: "nope"})
+        }, ErrKeyInvalid.Error()},
+    } {
+        coord.set(func(c *coordServer) {
+            tc.update(c)
+            c.list.Peers = append(c.list.Peers, listedPeer(b, 10, "10.2.0.0/24"))
+        })
+        syncUntil(t, clock, vpn, func(s PeerSyncStatus) bool { return strings.Contains(s.LastError, tc.want) })
+        if !havePeers(vpn, a) {
+            t.Errorf("%s: peers changed to %v", tc.name, peerKeys(vpn))
+        }
+        coord.set(func(c *coordServer) { c.list.Peers = c.list.Peers[:1] })
+    }
+}
+
+func TestSyncPeersNeedsSigningKey(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    err := vpn.SyncPeers(context.Background(), "http://127.0.0.1:1/peers", "")
+    if !errors.Is(err, ErrPeerListSignature) {
+        t.Fatalf("sync without a key: %v", err)
+    }
+    
+    clock := NewFakeClock(time.Unix(1700000000, 0))
+    vpn, _, done := startPeerSync(t, clock)
+    if err := vpn.SyncPeers(context.Background(), "http://127.0.0.1:1/peers", ""); err == nil {
+        t.Fatal("second sync should be refused while one runs")
+    }
+    select {
+    case err := <-done:
+        t.Fatalf("sync ended: %v", err)
+    default:
+    }
+}
+
+func TestReloadChangesPeerSyncKeyAndInterval(t *testing.T) {
+    clock := NewFakeClock(time.Unix(1700000000, 0))
+    vpn, err := NewUnderTheRadarVPNWithOptions(VPNOptions{
+        DeviceName: "utr0",
+        WGClient:   newFakeWGClient(),
+        Commands:   newFakeHost("").run,
+        EBPF:       NoEBPF{},
+        LockDir:    t.TempDir(),
+        Clock:      clock,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := vpn.Start(VPNConfig{ListenPort: 51820}); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { vpn.Stop() })
+    coord, _ := syncPeersFromMock(t, clock, vpn)
+    
+    tickers := func(period time.Duration) int {
+        clock.mu.Lock()
+        defer clock.mu.Unlock()
+        n := 0
+        for _, w := range clock.waiting {
+            if w.period == period {
+                n++
+            }
+        }
+        return n
+    }
+    minutely, hourly := tickers(time.Minute), tickers(time.Hour)
+    
+    // The server moves to a new key, lists signed with it are refused
+    pub, priv, err := ed25519.GenerateKey(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    coord.set(func(c *coordServer) { c.key = priv })
+    syncUntil(t, clock, vpn, func(s PeerSyncStatus) bool { return s.Failures > 0 })
+    
+    vpn.mu.RLock()
+    config := vpn.config
+    vpn.mu.RUnlock()
+    config.Coordination = CoordinationConfig{SigningKey: pub[:16], Interval: time.Hour}
+    if err := vpn.Reload(config); !errors.Is(err, ErrKeyInvalid) {
+        t.Fatalf("truncated key: %v", err)
+    }
+    config.Coordination.SigningKey = pub
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    syncUntil(t, clock, vpn, func(s PeerSyncStatus) bool { return s.Failures == 0 })
+    
+    // Syncs go on every hour
+    advanceUntil(t, clock, 0, func() bool { return tickers(time.Hour) == hourly+1 })
+    if n := tickers(time.Minute); n != minutely-1 {
+        t.Fatalf("%d tickers at a minute, want %d", n, minutely-1)
+    }
+}
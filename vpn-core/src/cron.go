@@ -0,0 +1,118 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// cronSpec is a parsed crontab expression of five fields: minute, hour,
+// day of month, month and day of week. Fields take *, values, a-b ranges,
+// comma separated lists and /n steps; Sunday is 0 or 7.
+type cronSpec struct {
+    minute, hour, dom, month, dow uint64 // bit n set when n matches
+    
+    // As in cron, when both day fields are restricted either may match
+    domAny, dowAny bool
+}
+
+var cronFields = [5]struct {
+    name     string
+    min, max int
+}{
+    {"minute", 0, 59},
+    {"hour", 0, 23},
+    {"day of month", 1, 31},
+    {"month", 1, 12},
+    {"day of week", 0, 7},
+}
+
+func parseCron(expr string) (cronSpec, error) {
+    fields := strings.Fields(expr)
+    if len(fields) != len(cronFields) {
+        return cronSpec{}, fmt.Errorf("cron expression %q: want %d fields, got %d", expr, len(cronFields), len(fields))
+    }
+    
+    var sets [5]uint64
+    for i, field := range fields {
+        set, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+        if err != nil {
+            return cronSpec{}, fmt.Errorf("cron expression %q: %s: %w", expr, cronFields[i].name, err)
+        }
+        sets[i] = set
+    }
+    
+    spec := cronSpec{
+        minute: sets[0],
+        hour:   sets[1],
+        dom:    sets[2],
+        month:  sets[3],
+        dow:    sets[4],
+        domAny: strings.HasPrefix(fields[2], "*"),
+        dowAny: strings.HasPrefix(fields[4], "*"),
+    }
+    if spec.dow&(1<<7) != 0 {
+        spec.dow = spec.dow&^(1<<7) | 1
+    }
+    return spec, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+    var set uint64
+    for _, part := range strings.Split(field, ",") {
+        span, step := part, 1
+        i := strings.IndexByte(part, '/')
+        if i >= 0 {
+            n, err := strconv.Atoi(part[i+1:])
+            if err != nil || n <= 0 {
+                return 0, fmt.Errorf("bad step in %q", part)
+            }
+            span, step = part[:i], n
+        }
+        
+        lo, hi := min, max
+        if span != "*" {
+            first, last, isRange := strings.Cut(span, "-")
+            var err error
+            if lo, err = strconv.Atoi(first); err != nil {
+                return 0, fmt.Errorf("bad value in %q", part)
+            }
+            // a/n runs from a to the end of the range
+            switch {
+            case isRange:
+                if hi, err = strconv.Atoi(last); err != nil {
+                    return 0, fmt.Errorf("bad value in %q", part)
+                }
+            case i < 0:
+                hi = lo
+            }
+        }
+        if lo < min || hi > max || lo > hi {
+            return 0, fmt.Errorf("%q outside %d-%d", part, min, max)
+        }
+        
+        for v := lo; v <= hi; v += step {
+            set |= 1 << v
+        }
+    }
+    return set, nil
+}
+
+func (c cronSpec) matches(t time.Time) bool {
+    if c.minute&(1<<t.Minute()) == 0 || c.hour&(1<<t.Hour()) == 0 || c.month&(1<<int(t.Month())) == 0 {
+        return false
+    }
+    
+    dom := c.dom&(1<<t.Day()) != 0
+    dow := c.dow&(1<<int(t.Weekday())) != 0
+    switch {
+    case c.domAny && c.dowAny:
+        return true
+    case c.domAny:
+        return dow
+    case c.dowAny:
+        return dom
+    }
+    return dom || dow
+}
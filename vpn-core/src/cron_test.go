@@ -0,0 +1,41 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestCronMatches(t *testing.T) {
+    friday := time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC)
+    for _, tt := range []struct {
+        expr string
+        at   time.Time
+        want bool
+    }{
+        {"* * * * *", friday, true},
+        {"30 9 * * *", friday, true},
+        {"*/15 9-17 * * 1-5", friday, true},
+        {"*/20 9-17 * * 1-5", friday, false},
+        {"30 9 * * 0,6", friday, false},
+        {"30 9 * * 7", friday.AddDate(0, 0, 2), true}, // Sunday as 7
+        {"30 9 1 * *", friday, false},
+        {"30 9 1 * 5", friday, true}, // either day field
+        {"30 9 16 10 *", friday, true},
+        {"30 9 16 11 *", friday, false},
+        {"30 22/1 * * *", friday.Add(14 * time.Hour), true},
+    } {
+        spec, err := parseCron(tt.expr)
+        if err != nil {
+            t.Fatalf("%q: %v", tt.expr, err)
+        }
+        if got := spec.matches(tt.at); got != tt.want {
+            t.Errorf("%q at %v: %v, want %v", tt.expr, tt.at, got, tt.want)
+        }
+    }
+    
+    for _, bad := range []string{"* * * *", "60 * * * *", "* 5-2 * * *", "*/0 * * * *", "* * 0 * *", "mon * * * *"} {
+        if _, err := parseCron(bad); err == nil {
+            t.Errorf("%q accepted", bad)
+        }
+    }
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "sync"
+    
+    "github.com/godbus/dbus/v5"
+    "github.com/godbus/dbus/v5/introspect"
+)
+
+// Where NetworkManager looks for a VPN plugin, and our bus name
+const (
+    DefaultDBusName = "org.freedesktop.NetworkManager.undertheradar"
+    
+    dbusPluginPath      = dbus.ObjectPath("/org/freedesktop/NetworkManager/VPN/Plugin")
+    dbusPluginIface     = "org.freedesktop.NetworkManager.VPN.Plugin"
+    dbusConnectionIface = "org.freedesktop.NetworkManager.VPN.Connection"
+    dbusStatsIface      = "org.freedesktop.NetworkManager.undertheradar.Statistics"
+    dbusErrorPrefix     = "org.freedesktop.NetworkManager.VPN.Error."
+)
+
+// NMVPNState is NetworkManager's NMVpnServiceState, the state a VPN plugin
+// reports in its StateChanged and VpnStateChanged signals
+type NMVPNState uint32
+
+const (
+    NMVPNStateUnknown NMVPNState = iota
+    NMVPNStateInit
+    NMVPNStateShutdown
+    NMVPNStateStarting
+    NMVPNStateStarted
+    NMVPNStateStopping
+    NMVPNStateStopped
+)
+
+func (s NMVPNState) String() string {
+    switch s {
+    case NMVPNStateInit:
+        return "init"
+    case NMVPNStateShutdown:
+        return "shutdown"
+    case NMVPNStateStarting:
+        return "starting"
+    case NMVPNStateStarted:
+        return "started"
+    case NMVPNStateStopping:
+        return "stopping"
+    case NMVPNStateStopped:
+        return "stopped"
+    default:
+        return "unknown"
+    }
+}
+
+// NMVpnConnectionStateReason values sent along with VpnStateChanged
+const (
+    nmReasonNone               uint32 = 1
+    nmReasonUserDisconnected   uint32 = 2
+    nmReasonServiceStartFailed uint32 = 8
+)
+
+// NM_VPN_PLUGIN_FAILURE_CONNECT_FAILED, the argument of the Failure signal
+const nmFailureConnectFailed uint32 = 1
+
+var ErrDBusNameTaken = errors.New("D-Bus name already owned")
+
+// The part of *dbus.Conn the adapter uses, so tests can stand in for the
+// session bus
+type dbusConn interface {
+    Export(v interface{}, path dbus.ObjectPath, iface string) error
+    RequestName(name string, flags dbus.RequestNameFlags) (dbus.RequestNameReply, error)
+    Emit(path dbus.ObjectPath, name string, values ...interface{}) error
+    Close() error
+}
+
+// Tests replace this
+var connectSessionBus = func() (dbusConn, error) {
+    return dbus.ConnectSessionBus()
+}
+
+// DBusAdapter lets NetworkManager drive the VPN as one of its VPN plugins.
+// It serves org.freedesktop.NetworkManager.VPN.Plugin on the session bus,
+// where Connect starts the VPN with the adapter's config and Disconnect
+// stops it, and reports every state change with VpnStateChanged. The
+// connection settings NetworkManager passes to Connect are ignored.
+//
+// A stopped VPN can't be started again, so an adapter serves a single
+// connection; NetworkManager starts a fresh plugin for the next one.
+type DBusAdapter struct {
+    vpn    *UnderTheRadarVPN
+    config VPNConfig
+    name   string
+    
+    mu    sync.Mutex // serializes Connect and Disconnect
+    conn  dbusConn
+    state NMVPNState
+}
+
+// NewDBusAdapter makes vpn available under name, DefaultDBusName when
+// empty, once Start is called
+func NewDBusAdapter(vpn *UnderTheRadarVPN, config VPNConfig, name string) *DBusAdapter {
+    if name == "" {
+        name = DefaultDBusName
+    }
+    return &DBusAdapter{vpn: vpn, config: config, name: name, state: NMVPNStateInit}
+}
+
+// Start connects to the session bus, exports the plugin and takes the bus
+// name
+func (a *DBusAdapter) Start() error {
+    conn, err := connectSessionBus()
+    if err != nil {
+        return fmt.Errorf("failed to connect to session bus: %w", err)
+    }
+    
+    plugin := &dbusPlugin{a}
+    stats := &dbusStats{a}
+    node := &introspect.Node{
+        Name: string(dbusPluginPath),
+        Interfaces: []introspect.Interface{
+            introspect.IntrospectData,
+            {
+                Name:    dbusPluginIface,
+                Methods: introspect.Methods(plugin),
+                Signals: []introspect.Signal{
+                    {Name: "StateChanged", Args: []introspect.Arg{{Name: "state", Type: "u"}}},
+                    {Name: "Failure", Args: []introspect.Arg{{Name: "reason", Type: "u"}}},
+                },
+            },
+            {
+                Name: dbusConnectionIface,
+                Signals: []introspect.Signal{{
+                    Name: "VpnStateChanged",
+                    Args: []introspect.Arg{{Name: "state", Type: "u"}, {Name: "reason", Type: "u"}},
+                }},
+            },
+            {Name: dbusStatsIface, Methods: introspect.Methods(stats)},
+        },
+    }
+    exports := []struct {
+        v     interface{}
+        iface string
+    }{
+        {plugin, dbusPluginIface},
+        {stats, dbusStatsIface},
+        {introspect.NewIntrospectable(node), "org.freedesktop.DBus.Introspectable"},
+    }
+    for _, export := range exports {
+        if err := conn.Export(export.v, dbusPluginPath, export.iface); err != nil {
+            conn.Close()
+            return fmt.Errorf("failed to export %s: %w", export.iface, err)
+        }
+    }
+    
+    reply, err := conn.RequestName(a.name, dbus.NameFlagDoNotQueue)
+    if err != nil {
+        conn.Close()
+        return fmt.Errorf("failed to request %s: %w", a.name, err)
+    }
+    if reply != dbus.RequestNameReplyPrimaryOwner {
+        conn.Close()
+        return fmt.Errorf("%w: %s", ErrDBusNameTaken, a.name)
+    }
+    
+    a.mu.Lock()
+    a.conn = conn
+    a.mu.Unlock()
+    return nil
+}
+
+// Close leaves the bus. A connected VPN keeps running.
+func (a *DBusAdapter) Close() error {
+    a.mu.Lock()
+    conn := a.conn
+    a.conn = nil
+    a.mu.Unlock()
+    
+    if conn == nil {
+        return nil
+    }
+    return conn.Close()
+}
+
+// State is the state last reported to NetworkManager
+func (a *DBusAdapter) State() NMVPNState {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    
+    return a.state
+}
+
+// Record and announce state, with a.mu held
+func (a *DBusAdapter) setState(state NMVPNState, reason uint32) {
+    a.state = state
+    if a.conn == nil {
+        return
+    }
+    a.conn.Emit(dbusPluginPath, dbusPluginIface+".StateChanged", uint32(state))
+    a.conn.Emit(dbusPluginPath, dbusConnectionIface+".VpnStateChanged", uint32(state), reason)
+}
+
+func (a *DBusAdapter) connect() *dbus.Error {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    
+    // Starting and Stopping are only seen under a.mu
+    switch a.state {
+    case NMVPNStateStarted:
+        return dbusError("AlreadyStarted", "already connected")
+    case NMVPNStateInit:
+    default:
+        return dbusError("WrongState", "the VPN was %s, start a new plugin", a.state)
+    }
+    
+    a.setState(NMVPNStateStarting, nmReasonNone)
+    if err := a.vpn.Start(a.config); err != nil {
+        if a.conn != nil {
+            a.conn.Emit(dbusPluginPath, dbusPluginIface+".Failure", nmFailureConnectFailed)
+        }
+        a.setState(NMVPNStateStopped, nmReasonServiceStartFailed)
+        return dbusError("LaunchFailed", "%v", err)
+    }
+    a.setState(NMVPNStateStarted, nmReasonNone)
+    return nil
+}
+
+func (a *DBusAdapter) disconnect() *dbus.Error {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    
+    if a.state != NMVPNStateStarted {
+        return dbusError("AlreadyStopped", "not connected")
+    }
+    
+    a.setState(NMVPNStateStopping, nmReasonUserDisconnected)
+    err := a.vpn.Stop()
+    a.setState(NMVPNStateStopped, nmReasonUserDisconnected)
+    if err != nil {
+        return dbusError("WrongState", "failed to stop: %v", err)
+    }
+    return nil
+}
+
+func dbusError(name, format string, args ...any) *dbus.Error {
+    return dbus.NewError(dbusErrorPrefix+name, []interface{}{fmt.Sprintf(format, args...)})
+}
+
+// dbusPlugin holds the methods of the Plugin interface, the adapter's own
+// exported methods would be exported with them
+type dbusPlugin struct {
+    a *DBusAdapter
+}
+
+// Connect(a{sa{sv}} connection)
+func (p *dbusPlugin) Connect(connection map[string]map[string]dbus.Variant) *dbus.Error {
+    return p.a.connect()
+}
+
+func (p *dbusPlugin) Disconnect() *dbus.Error {
+    return p.a.disconnect()
+}
+
+// dbusStats serves the interface counters to NetworkManager applets
+type dbusStats struct {
+    a *DBusAdapter
+}
+
+// GetStatistics() -> a{st}: peers, alive_peers, rx_bytes and tx_bytes
+// summed over the peers
+func (s *dbusStats) GetStatistics() (map[string]uint64, *dbus.Error) {
+    vpn := s.a.vpn
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    stats := map[string]uint64{
+        "peers":       uint64(vpn.peers.len()),
+        "alive_peers": 0,
+        "rx_bytes":    0,
+        "tx_bytes":    0,
+    }
+    for _, peer := range vpn.peers.list {
+        if peer.IsAlive.Load() {
+            stats["alive_peers"]++
+        }
+        stats["rx_bytes"] += peer.RxBytes.Load()
+        stats["tx_bytes"] += peer.TxBytes.Load()
+    }
+    return stats, nil
+}
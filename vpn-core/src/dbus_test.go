@@ -0,0 +1,162 @@
+package main
+
+import (
+    "strings"
+    "sync"
+    "testing"
+    
+    "github.com/godbus/dbus/v5"
+)
+
+// Session bus recording exports and signals
+type fakeDBusConn struct {
+    mu      sync.Mutex
+    exports map[string]interface{} // by interface
+    owner   bool                   // RequestName wins
+    signals []*dbus.Signal
+    closed  bool
+}
+
+func installFakeDBus(t *testing.T) *fakeDBusConn {
+    conn := &fakeDBusConn{exports: make(map[string]interface{}), owner: true}
+    orig := connectSessionBus
+    connectSessionBus = func() (dbusConn, error) { return conn, nil }
+    t.Cleanup(func() { connectSessionBus = orig })
+    return conn
+}
+
+func (c *fakeDBusConn) Export(v interface{}, path dbus.ObjectPath, iface string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.exports[iface] = v
+    return nil
+}
+
+func (c *fakeDBusConn) RequestName(name string, flags dbus.RequestNameFlags) (dbus.RequestNameReply, error) {
+    if !c.owner {
+        return dbus.RequestNameReplyExists, nil
+    }
+    return dbus.RequestNameReplyPrimaryOwner, nil
+}
+
+func (c *fakeDBusConn) Emit(path dbus.ObjectPath, name string, values ...interface{}) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.signals = append(c.signals, &dbus.Signal{Path: path, Name: name, Body: values})
+    return nil
+}
+
+func (c *fakeDBusConn) Close() error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.closed = true
+    return nil
+}
+
+// States announced with VpnStateChanged so far
+func (c *fakeDBusConn) states() []NMVPNState {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    var states []NMVPNState
+    for _, sig := range c.signals {
+        if sig.Name == dbusConnectionIface+".VpnStateChanged" {
+            states = append(states, NMVPNState(sig.Body[0].(uint32)))
+        }
+    }
+    return states
+}
+
+type nmPlugin interface {
+    Connect(map[string]map[string]dbus.Variant) *dbus.Error
+    Disconnect() *dbus.Error
+}
+
+func statesEqual(got []NMVPNState, want ...NMVPNState) bool {
+    if len(got) != len(want) {
+        return false
+    }
+    for i := range got {
+        if got[i] != want[i] {
+            return false
+        }
+    }
+    return true
+}
+
+func TestDBusAdapterConnectsAndDisconnects(t *testing.T) {
+    conn := installFakeDBus(t)
+    vpn, host := newHostTestVPN(t, newFakeWGClient())
+    adapter := NewDBusAdapter(vpn, VPNConfig{ListenPort: 51820, KillSwitch: true}, "")
+    if err := adapter.Start(); err != nil {
+        t.Fatal(err)
+    }
+    plugin := conn.exports[dbusPluginIface].(nmPlugin)
+    
+    if err := plugin.Connect(nil); err != nil {
+        t.Fatal(err)
+    }
+    if got := conn.states(); !statesEqual(got, NMVPNStateStarting, NMVPNStateStarted) {
+        t.Fatalf("states %v after Connect", got)
+    }
+    if !host.links["utr0"] {
+        t.Fatal("Connect didn't start the VPN")
+    }
+    if err := plugin.Connect(nil); err == nil || !strings.HasSuffix(err.Name, "AlreadyStarted") {
+        t.Fatalf("second Connect gave %v", err)
+    }
+    
+    stats, _ := conn.exports[dbusStatsIface].(*dbusStats).GetStatistics()
+    if stats["peers"] != 0 || len(stats) != 4 {
+        t.Fatalf("statistics %v", stats)
+    }
+    
+    if err := plugin.Disconnect(); err != nil {
+        t.Fatal(err)
+    }
+    if got := conn.states(); !statesEqual(got, NMVPNStateStarting, NMVPNStateStarted, NMVPNStateStopping, NMVPNStateStopped) {
+        t.Fatalf("states %v after Disconnect", got)
+    }
+    if len(host.rules) != 0 {
+        t.Fatalf("left rules %v", host.rules)
+    }
+    if err := plugin.Connect(nil); err == nil {
+        t.Fatal("stopped VPN connected again")
+    }
+    
+    adapter.Close()
+    if !conn.closed {
+        t.Fatal("bus connection left open")
+    }
+}
+
+func TestDBusAdapterReportsFailedStart(t *testing.T) {
+    conn := installFakeDBus(t)
+    vpn, host := newHostTestVPN(t, newFakeWGClient())
+    host.failOn = "ip link add"
+    adapter := NewDBusAdapter(vpn, VPNConfig{ListenPort: 51820}, "")
+    if err := adapter.Start(); err != nil {
+        t.Fatal(err)
+    }
+    
+    err := conn.exports[dbusPluginIface].(nmPlugin).Connect(nil)
+    if err == nil || err.Name != dbusErrorPrefix+"LaunchFailed" {
+        t.Fatalf("got %v", err)
+    }
+    if got := conn.states(); !statesEqual(got, NMVPNStateStarting, NMVPNStateStopped) {
+        t.Fatalf("states %v", got)
+    }
+    // Failure comes before the plugin stops
+    if failure := conn.signals[2]; failure.Name != dbusPluginIface+".Failure" || failure.Body[0] != nmFailureConnectFailed {
+        t.Fatalf("signal %s%v, not Failure", failure.Name, failure.Body)
+    }
+}
+
+func TestDBusAdapterNameTaken(t *testing.T) {
+    conn := installFakeDBus(t)
+    conn.owner = false
+    vpn, _ := newHostTestVPN(t, newFakeWGClient())
+    
+    if err := NewDBusAdapter(vpn, VPNConfig{}, "").Start(); err == nil || !conn.closed {
+        t.Fatalf("got %v, closed %v", err, conn.closed)
+    }
+}
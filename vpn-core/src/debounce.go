@@ -0,0 +1,120 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// How long repeats of an event are folded together, see Debouncer
+const DefaultEventDebounceWindow = 30 * time.Second
+
+// Debouncer coalesces repeats of an event, same type and peer, within a
+// window. The first is delivered at once; repeats are counted and delivered
+// as one event with Count set when the window closes, so a flapping link
+// produces at most one event per peer and window. deliver can be
+// vpn.emitEvent or anything writing a log line.
+type Debouncer struct {
+    window  time.Duration
+    deliver func(Event)
+    clock   Clock
+    
+    mu      sync.Mutex
+    pending map[debounceKey]*debounced
+}
+
+type debounceKey struct {
+    typ  EventType
+    peer wgtypes.Key
+}
+
+type debounced struct {
+    last  Event // repeats are reported with the latest message
+    count int   // repeats since the last delivery
+    timer Timer
+}
+
+func NewDebouncer(window time.Duration, deliver func(Event)) *Debouncer {
+    return newDebouncer(window, deliver, RealClock{})
+}
+
+func newDebouncer(window time.Duration, deliver func(Event), clock Clock) *Debouncer {
+    return &Debouncer{
+        window:  window,
+        deliver: deliver,
+        clock:   clock,
+        pending: make(map[debounceKey]*debounced),
+    }
+}
+
+// Emit delivers ev unless an event like it went out within the window
+func (d *Debouncer) Emit(ev Event) {
+    if ev.Time.IsZero() {
+        ev.Time = d.clock.Now()
+    }
+    key := debounceKey{ev.Type, ev.PublicKey}
+    
+    d.mu.Lock()
+    if entry, exists := d.pending[key]; exists {
+        entry.last = ev
+        entry.count++
+        d.mu.Unlock()
+        return
+    }
+    d.pending[key] = &debounced{timer: d.clock.AfterFunc(d.window, func() { d.flush(key) })}
+    d.mu.Unlock()
+    
+    ev.Count = 1
+    d.deliver(ev)
+}
+
+// Close the window: deliver the repeats, if any, and open a new window so
+// continued flapping stays rate limited
+func (d *Debouncer) flush(key debounceKey) {
+    d.mu.Lock()
+    entry, exists := d.pending[key]
+    if !exists {
+        d.mu.Unlock()
+        return
+    }
+    if entry.count == 0 {
+        delete(d.pending, key)
+        d.mu.Unlock()
+        return
+    }
+    ev := d.coalesce(entry)
+    entry.timer.Reset(d.window)
+    d.mu.Unlock()
+    
+    d.deliver(ev)
+}
+
+// Reset the repeat count and describe the repeats as one event. Caller
+// holds d.mu.
+func (d *Debouncer) coalesce(entry *debounced) Event {
+    ev := entry.last
+    ev.Count = entry.count
+    ev.Message = fmt.Sprintf("%s (%d times in %s)", ev.Message, entry.count, d.window)
+    entry.count = 0
+    return ev
+}
+
+// Stop delivers pending repeats and stops all windows
+func (d *Debouncer) Stop() {
+    d.mu.Lock()
+    var flushed []Event
+    for key, entry := range d.pending {
+        entry.timer.Stop()
+        if entry.count > 0 {
+            flushed = append(flushed, d.coalesce(entry))
+        }
+        delete(d.pending, key)
+    }
+    d.mu.Unlock()
+    
+    for _, ev := range flushed {
+        d.deliver(ev)
+    }
+}
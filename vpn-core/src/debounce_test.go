@@ -0,0 +1,98 @@
+package main
+
+import (
+    "context"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Verdict set by the test, so a link can flap on demand
+type flappingHealth struct{ healthy atomic.Bool }
+
+func (f *flappingHealth) Healthy(*Peer, wgtypes.Peer) bool { return f.healthy.Load() }
+
+// Events of one type already queued
+func collectEvents(vpn *UnderTheRadarVPN, typ EventType) []Event {
+    var got []Event
+    for {
+        select {
+        case ev := <-vpn.Events():
+            if ev.Type == typ {
+                got = append(got, ev)
+            }
+        default:
+            return got
+        }
+    }
+}
+
+func TestFailoverDebouncesFlappingPeer(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    vpn.healthCheck = NewHealthChecker(vpn)
+    link := &flappingHealth{}
+    vpn.healthCheck.SetStrategy("", link)
+    fm := NewFailoverManager(vpn)
+    clock := NewFakeClock(time.Now())
+    fm.events = newDebouncer(time.Minute, vpn.emitEvent, clock)
+    defer fm.events.Stop()
+    
+    peer := &Peer{PublicKey: mustKey(t).PublicKey()}
+    vpn.peers.put(peer)
+    wg.setPeer("utr0", wgtypes.Peer{PublicKey: peer.PublicKey, LastHandshakeTime: time.Now()})
+    check := func(healthy bool) {
+        link.healthy.Store(healthy)
+        vpn.healthCheck.checkAll()
+        fm.checkPeers(context.Background())
+    }
+    
+    // Ten rapid flaps, never stable long enough to count as recovered
+    for i := 0; i < 10; i++ {
+        check(false)
+        check(true)
+    }
+    if got := collectEvents(vpn, EventPeerFailed); len(got) != 1 || got[0].Count != 1 {
+        t.Fatalf("first failure should go out alone, got %+v", got)
+    }
+    
+    // The window closes with one event for the other nine
+    clock.Advance(time.Minute)
+    got := collectEvents(vpn, EventPeerFailed)
+    if len(got) != 1 || got[0].Count != 9 || !strings.Contains(got[0].Message, "9 times") {
+        t.Fatalf("repeats not coalesced: %+v", got)
+    }
+    
+    // Recovery is reported once, after enough healthy checks in a row
+    for i := 0; i < DefaultRecoveryChecks+2; i++ {
+        check(true)
+    }
+    recovered := collectEvents(vpn, EventPeerRecovered)
+    if len(recovered) != 1 || recovered[0].PublicKey != peer.PublicKey {
+        t.Fatalf("recovery events: %+v", recovered)
+    }
+}
+
+func TestDebouncerStopFlushesRepeats(t *testing.T) {
+    var delivered []Event
+    d := NewDebouncer(time.Hour, func(ev Event) { delivered = append(delivered, ev) })
+    a, b := mustKey(t).PublicKey(), mustKey(t).PublicKey()
+    
+    for i := 0; i < 3; i++ {
+        d.Emit(Event{Type: EventPeerFailed, PublicKey: a, Message: "down"})
+    }
+    // Other peers and types have windows of their own
+    d.Emit(Event{Type: EventPeerFailed, PublicKey: b})
+    d.Emit(Event{Type: EventPortHop, PublicKey: a})
+    if len(delivered) != 3 {
+        t.Fatalf("%d events delivered at once, want 3", len(delivered))
+    }
+    
+    d.Stop()
+    if len(delivered) != 4 || delivered[3].PublicKey != a || delivered[3].Count != 2 {
+        t.Fatalf("Stop delivered %+v", delivered[3:])
+    }
+}
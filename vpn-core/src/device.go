@@ -0,0 +1,195 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var ErrAdoptConflict = errors.New("existing device has peers not in our configuration")
+
+// ErrDeviceExists is wrapped when Start finds the device already there and
+// may not take it over
+var ErrDeviceExists = errors.New("device already exists")
+
+// Load the configured private key or generate a fresh one
+func (vpn *UnderTheRadarVPN) setupKeys(config VPNConfig) error {
+    key := config.PrivateKey
+    if key == nil {
+        var err error
+        if key, err = GenerateSecret(); err != nil {
+            return fmt.Errorf("failed to generate private key: %w", err)
+        }
+    } else if len(key.Bytes()) != wgtypes.KeyLen {
+        return fmt.Errorf("%w: private key of %d bytes", ErrKeyInvalid, len(key.Bytes()))
+    }
+    
+    vpn.keys.Put(deviceKeyName, key)
+    return nil
+}
+
+// The device private key, nil before setupKeys or adoption
+func (vpn *UnderTheRadarVPN) privateKey() *Secret {
+    return vpn.keys.Get(deviceKeyName)
+}
+
+// Create the WireGuard device, or adopt an existing one when configured to
+func (vpn *UnderTheRadarVPN) createDevice(ctx context.Context, config VPNConfig) error {
+    vpn.mu.Lock()
+    vpn.allowedIPConflicts = config.AllowedIPConflicts
+    vpn.fastPath = config.FastPathEnabled
+    vpn.listenPorts = config.ListenPorts
+    vpn.mu.Unlock()
+    
+    if err := validateSocketConfig(config); err != nil {
+        return err
+    }
+    if err := validateListenPorts(config); err != nil {
+        return err
+    }
+    
+    device, err := vpn.wgClient.Device(vpn.deviceName)
+    if err == nil {
+        // Unlocked, so left by a crashed instance or another tool
+        if !config.AdoptExisting && !config.Force {
+            return fmt.Errorf("%w: %s, but no instance holds it, set AdoptExisting or Force to take it over", ErrDeviceExists, vpn.deviceName)
+        }
+        if err := vpn.adoptDevice(device, config); err != nil {
+            return fmt.Errorf("failed to adopt device %s: %w", vpn.deviceName, err)
+        }
+    } else {
+        // We only create kernel devices
+        device = nil
+        if config.UDPSocket != nil {
+            return fmt.Errorf("%w: %s would be created in the kernel", ErrSocketNeedsUserspace, vpn.deviceName)
+        }
+        if err := vpn.commands.Run(fmt.Sprintf("ip link add dev %s type wireguard", vpn.deviceName)); err != nil {
+            return fmt.Errorf("failed to create device: %w", err)
+        }
+        vpn.ownsDevice = true
+        
+        listenPort := config.ListenPort
+        privateKey := vpn.privateKey().Key()
+        cfg := wgtypes.Config{
+            PrivateKey:   &privateKey,
+            ListenPort:   &listenPort,
+            ReplacePeers: true,
+        }
+        err := vpn.wgClient.ConfigureDevice(vpn.deviceName, cfg)
+        wipe(privateKey[:])
+        if err != nil {
+            return fmt.Errorf("failed to configure device: %w", err)
+        }
+        vpn.listenPort = listenPort
+        
+        for _, addr := range config.Addresses {
+            if err := vpn.commands.Run(fmt.Sprintf("ip addr add %s dev %s", addr.String(), vpn.deviceName)); err != nil {
+                return fmt.Errorf("failed to add address %s: %w", addr.String(), err)
+            }
+        }
+        
+        if err := vpn.commands.Run(fmt.Sprintf("ip link set up dev %s", vpn.deviceName)); err != nil {
+            return fmt.Errorf("failed to bring device up: %w", err)
+        }
+    }
+    
+    // Before the peers, so their probes already leave the chosen way
+    if err := vpn.setupSocket(config, device); err != nil {
+        return err
+    }
+    
+    // Our configured peers always win over whatever the device had
+    for _, peerConfig := range config.Peers {
+        if err := vpn.AddPeerContext(ctx, peerConfig); err != nil {
+            return err
+        }
+    }
+    
+    return nil
+}
+
+// Delete the device if we created it; adopted devices are left in place
+func (vpn *UnderTheRadarVPN) removeDevice() error {
+    if !vpn.ownsDevice {
+        return nil
+    }
+    if err := vpn.commands.Run(fmt.Sprintf("ip link del dev %s", vpn.deviceName)); err != nil {
+        return fmt.Errorf("failed to delete %s: %w", vpn.deviceName, err)
+    }
+    vpn.ownsDevice = false
+    return nil
+}
+
+// Import an existing device's key, port and peers into our structures
+func (vpn *UnderTheRadarVPN) adoptDevice(device *wgtypes.Device, config VPNConfig) error {
+    configured := make(map[wgtypes.Key]bool, len(config.Peers))
+    for _, peerConfig := range config.Peers {
+        configured[peerConfig.PublicKey] = true
+    }
+    
+    var imported []*Peer
+    var unknown []wgtypes.PeerConfig
+    
+    for _, wgPeer := range device.Peers {
+        if configured[wgPeer.PublicKey] {
+            continue // reconfigured from our config afterwards
+        }
+        
+        switch config.AdoptConflicts {
+        case AdoptRejectUnknown:
+            return fmt.Errorf("%w: %s", ErrAdoptConflict, wgPeer.PublicKey)
+        case AdoptRemoveUnknown:
+            unknown = append(unknown, wgtypes.PeerConfig{
+                PublicKey: wgPeer.PublicKey,
+                Remove:    true,
+            })
+        default:
+            imported = append(imported, peerFromDevice(wgPeer))
+        }
+    }
+    
+    if len(unknown) > 0 {
+        cfg := wgtypes.Config{Peers: unknown}
+        if err := vpn.wgClient.ConfigureDevice(vpn.deviceName, cfg); err != nil {
+            return fmt.Errorf("failed to remove unknown peers: %w", err)
+        }
+    }
+    
+    vpn.mu.Lock()
+    defer vpn.mu.Unlock()
+    
+    vpn.keys.Put(deviceKeyName, SecretFromKey(device.PrivateKey))
+    wipe(device.PrivateKey[:])
+    vpn.listenPort = device.ListenPort
+    for _, peer := range imported {
+        vpn.storePeerLocked(peer)
+    }
+    
+    return nil
+}
+
+// Build a Peer with default values for the fields WireGuard doesn't track
+func peerFromDevice(wgPeer wgtypes.Peer) *Peer {
+    peer := &Peer{
+        PublicKey:     wgPeer.PublicKey,
+        Endpoint:      wgPeer.Endpoint,
+        AllowedIPs:    wgPeer.AllowedIPs,
+        LastHandshake: wgPeer.LastHandshakeTime,
+        PersistentKeepalive: wgPeer.PersistentKeepaliveInterval,
+    }
+    
+    var zero wgtypes.Key
+    if wgPeer.PresharedKey != zero {
+        peer.PresharedKey = SecretFromKey(wgPeer.PresharedKey)
+    }
+    
+    // Start counter tracking from the device's current values
+    rx, _ := peer.rxCounter.update(uint64(wgPeer.ReceiveBytes))
+    tx, _ := peer.txCounter.update(uint64(wgPeer.TransmitBytes))
+    peer.RxBytes.Store(rx)
+    peer.TxBytes.Store(tx)
+    
+    return peer
+}
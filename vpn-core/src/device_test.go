@@ -0,0 +1,118 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net"
+    "testing"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Fake controller holding a device as wg-quick would have left it
+func preexistingDevice(t *testing.T) (*fakeWGClient, wgtypes.Key, []wgtypes.Key) {
+    wg := newFakeWGClient()
+    devKey := mustKey(t)
+    peerA := mustKey(t).PublicKey()
+    peerB := mustKey(t).PublicKey()
+    
+    wg.devices["utr0"] = &wgtypes.Device{
+        Name:       "utr0",
+        PrivateKey: devKey,
+        PublicKey:  devKey.PublicKey(),
+        ListenPort: 51820,
+        Peers: []wgtypes.Peer{
+            {
+                PublicKey:    peerA,
+                Endpoint:     &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 51820},
+                AllowedIPs:   []net.IPNet{mustCIDR(t, "10.1.0.0/24")},
+                ReceiveBytes: 4096,
+            },
+            {
+                PublicKey:  peerB,
+                AllowedIPs: []net.IPNet{mustCIDR(t, "10.2.0.0/24")},
+            },
+        },
+    }
+    
+    return wg, devKey, []wgtypes.Key{peerA, peerB}
+}
+
+func TestCreateDeviceRefusesExistingWithoutAdopt(t *testing.T) {
+    wg, _, _ := preexistingDevice(t)
+    vpn := newTestVPN(t, wg)
+    
+    if err := vpn.createDevice(context.Background(), VPNConfig{}); err == nil {
+        t.Fatal("expected an error for an existing device")
+    }
+}
+
+func TestAdoptExistingImportsDevice(t *testing.T) {
+    wg, devKey, peers := preexistingDevice(t)
+    vpn := newTestVPN(t, wg)
+    commands := recordSystemCommands(t)
+    
+    if err := vpn.createDevice(context.Background(), VPNConfig{AdoptExisting: true}); err != nil {
+        t.Fatalf("createDevice: %v", err)
+    }
+    
+    if vpn.privateKey().Key() != devKey || vpn.listenPort != 51820 {
+        t.Fatal("device key and listen port were not imported")
+    }
+    if vpn.peers.len() != 2 {
+        t.Fatalf("imported %d peers, want 2", vpn.peers.len())
+    }
+    peer := vpn.peers.get(peers[0])
+    if peer == nil || peer.RxBytes.Load() != 4096 || peer.Endpoint == nil {
+        t.Fatalf("peer A not imported correctly: %+v", peer)
+    }
+    if vpn.peersByIP["10.2.0.0/24"] == nil {
+        t.Fatal("imported peer was not indexed by allowed IP")
+    }
+    if len(*commands) != 0 {
+        t.Fatalf("adoption should not create a device, ran %v", *commands)
+    }
+}
+
+func TestAdoptExistingRemovesUnknownPeers(t *testing.T) {
+    wg, _, peers := preexistingDevice(t)
+    vpn := newTestVPN(t, wg)
+    
+    config := VPNConfig{
+        AdoptExisting:  true,
+        AdoptConflicts: AdoptRemoveUnknown,
+        Peers: []PeerConfig{{
+            PublicKey:  peers[0],
+            AllowedIPs: []net.IPNet{mustCIDR(t, "10.9.0.0/24")},
+        }},
+    }
+    if err := vpn.createDevice(context.Background(), config); err != nil {
+        t.Fatalf("createDevice: %v", err)
+    }
+    
+    onDevice := wg.peerKeys("utr0")
+    if !onDevice[peers[0]] || onDevice[peers[1]] {
+        t.Fatalf("device peers = %v, want only the configured peer", onDevice)
+    }
+    if vpn.peers.len() != 1 || vpn.peersByIP["10.9.0.0/24"] == nil {
+        t.Fatal("configured peer should replace the imported one")
+    }
+}
+
+func TestAdoptExistingRejectsUnknownPeers(t *testing.T) {
+    wg, _, peers := preexistingDevice(t)
+    vpn := newTestVPN(t, wg)
+    
+    config := VPNConfig{
+        AdoptExisting:  true,
+        AdoptConflicts: AdoptRejectUnknown,
+        Peers:          []PeerConfig{{PublicKey: peers[0]}},
+    }
+    err := vpn.createDevice(context.Background(), config)
+    if !errors.Is(err, ErrAdoptConflict) {
+        t.Fatalf("expected ErrAdoptConflict, got %v", err)
+    }
+    if len(wg.peerKeys("utr0")) != 2 {
+        t.Fatal("rejected adoption must leave the device untouched")
+    }
+}
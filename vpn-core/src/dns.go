@@ -0,0 +1,473 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    DefaultDNSQueryTimeout = 5 * time.Second
+    dohListenAddr          = "127.0.0.1:53"
+    dohDefaultPort         = 443
+    dohMaxMessageSize      = 65535
+    
+    // A provider failing this many queries in a row is skipped for a while
+    providerFailureLimit = 5
+    providerQuarantine   = 60 * time.Second
+)
+
+var errNoProviders = errors.New("no DNS-over-HTTPS providers configured")
+
+// DOHClient forwards DNS queries over HTTPS, falling back through a
+// priority-ordered list of providers
+type DOHClient struct {
+    mu        sync.Mutex
+    providers []*dohProvider
+    derived   bool          // providers came from the DNS servers, not SetProviders
+    timeout   time.Duration // total budget for one query across providers
+    bootstrap map[string]net.IP // provider hostname -> address dialed instead of resolving it
+    
+    httpClient *http.Client
+    listenAddr string
+    conn       net.PacketConn
+    clock      Clock
+}
+
+type dohProvider struct {
+    url              string
+    failures         int // consecutive
+    quarantinedUntil time.Time
+}
+
+func NewDOHClient() *DOHClient {
+    c := &DOHClient{
+        timeout:    DefaultDNSQueryTimeout,
+        listenAddr: dohListenAddr,
+        clock:      RealClock{},
+    }
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.DialContext = c.dialContext
+    c.httpClient = &http.Client{Transport: transport}
+    return c
+}
+
+// SetBootstrapIPs sets the addresses of providers given by hostname. Once
+// DNS is locked down the hostnames can't be resolved, so these are dialed
+// directly; the hostname is still used for SNI, the Host header and
+// certificate validation.
+func (c *DOHClient) SetBootstrapIPs(ips map[string]net.IP) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    c.bootstrap = make(map[string]net.IP, len(ips))
+    for host, ip := range ips {
+        c.bootstrap[strings.ToLower(host)] = ip
+    }
+}
+
+// Dial a provider at its bootstrap address if it has one. Providers given
+// by IP are dialed as they are, without resolution.
+func (c *DOHClient) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+    host, port, err := net.SplitHostPort(addr)
+    if err != nil {
+        return nil, err
+    }
+    c.mu.Lock()
+    ip := c.bootstrap[strings.ToLower(host)]
+    c.mu.Unlock()
+    if ip != nil {
+        addr = net.JoinHostPort(ip.String(), port)
+    }
+    
+    var dialer net.Dialer
+    return dialer.DialContext(ctx, network, addr)
+}
+
+// SetProviders replaces the provider list, highest priority first
+func (c *DOHClient) SetProviders(urls []string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    c.providers = c.providers[:0]
+    for _, url := range urls {
+        c.providers = append(c.providers, &dohProvider{url: url})
+    }
+    c.derived = false
+}
+
+// Use the servers' own DoH endpoints unless providers were set explicitly.
+// Caller holds c.mu.
+func (c *DOHClient) deriveProvidersLocked(servers []string) {
+    if len(c.providers) > 0 && !c.derived {
+        return
+    }
+    c.providers = c.providers[:0]
+    for _, server := range servers {
+        c.providers = append(c.providers, &dohProvider{url: fmt.Sprintf("https://%s/dns-query", server)})
+    }
+    c.derived = true
+}
+
+// SetTimeout sets the total time a query may spend across all providers
+func (c *DOHClient) SetTimeout(timeout time.Duration) {
+    if timeout <= 0 {
+        timeout = DefaultDNSQueryTimeout
+    }
+    
+    c.mu.Lock()
+    c.timeout = timeout
+    c.mu.Unlock()
+}
+
+// PrimaryProvider returns the URL of the provider queries currently go to
+func (c *DOHClient) PrimaryProvider() string {
+    candidates := c.candidates()
+    if len(candidates) == 0 {
+        return ""
+    }
+    return candidates[0].url
+}
+
+// Providers not in quarantine, in priority order. When every provider is
+// quarantined all of them are returned, trying is better than failing.
+func (c *DOHClient) candidates() []*dohProvider {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    now := c.clock.Now()
+    var available []*dohProvider
+    for _, p := range c.providers {
+        if now.After(p.quarantinedUntil) {
+            available = append(available, p)
+        }
+    }
+    if len(available) == 0 {
+        return append([]*dohProvider(nil), c.providers...)
+    }
+    return available
+}
+
+func (c *DOHClient) recordResult(p *dohProvider, failed bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    if !failed {
+        p.failures = 0
+        return
+    }
+    
+    p.failures++
+    if p.failures >= providerFailureLimit {
+        p.quarantinedUntil = c.clock.Now().Add(providerQuarantine)
+        p.failures = 0
+    }
+}
+
+// Query resolves a wire-format DNS message, moving on to the next provider
+// when one times out or returns a server error
+func (c *DOHClient) Query(msg []byte) ([]byte, error) {
+    c.mu.Lock()
+    timeout := c.timeout
+    c.mu.Unlock()
+    
+    deadline := time.Now().Add(timeout)
+    candidates := c.candidates()
+    
+    lastErr := errNoProviders
+    for i, p := range candidates {
+        remaining := time.Until(deadline)
+        if remaining <= 0 {
+            break
+        }
+        // An even share of what's left, so a provider that hangs can't
+        // spend the time the next one would have answered in
+        ctx, cancel := context.WithTimeout(context.Background(), remaining/time.Duration(len(candidates)-i))
+        resp, retry, err := c.queryProvider(ctx, p.url, msg)
+        cancel()
+        c.recordResult(p, retry)
+        if err == nil {
+            return resp, nil
+        }
+        if !retry {
+            return nil, fmt.Errorf("DNS query via %s failed: %w", p.url, err)
+        }
+        lastErr = fmt.Errorf("DNS query via %s failed: %w", p.url, err)
+    }
+    return nil, lastErr
+}
+
+// RFC 8484 POST. retry reports whether the failure was the provider's fault.
+func (c *DOHClient) queryProvider(ctx context.Context, url string, msg []byte) (resp []byte, retry bool, err error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(msg))
+    if err != nil {
+        return nil, false, err
+    }
+    req.Header.Set("Content-Type", "application/dns-message")
+    req.Header.Set("Accept", "application/dns-message")
+    
+    httpResp, err := c.httpClient.Do(req)
+    if err != nil {
+        return nil, true, err
+    }
+    defer httpResp.Body.Close()
+    
+    if httpResp.StatusCode >= 500 {
+        return nil, true, fmt.Errorf("server error: %s", httpResp.Status)
+    }
+    if httpResp.StatusCode != http.StatusOK {
+        return nil, false, fmt.Errorf("unexpected status: %s", httpResp.Status)
+    }
+    
+    body, err := io.ReadAll(io.LimitReader(httpResp.Body, dohMaxMessageSize))
+    if err != nil {
+        return nil, true, err
+    }
+    return body, false, nil
+}
+
+// Start serves plain DNS on the local proxy address until Stop. Without
+// explicit providers, the DNS servers' own DoH endpoints are used.
+func (c *DOHClient) Start(servers []string) error {
+    conn, err := c.listen(servers)
+    if err != nil {
+        return err
+    }
+    c.serve(conn)
+    return nil
+}
+
+// Listen is Start in the background, returning the address it bound
+func (c *DOHClient) Listen(servers []string) (net.Addr, error) {
+    conn, err := c.listen(servers)
+    if err != nil {
+        return nil, err
+    }
+    go c.serve(conn)
+    return conn.LocalAddr(), nil
+}
+
+func (c *DOHClient) listen(servers []string) (net.PacketConn, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    c.deriveProvidersLocked(servers)
+    conn, err := net.ListenPacket("udp", c.listenAddr)
+    if err != nil {
+        return nil, fmt.Errorf("failed to listen on %s: %w", c.listenAddr, err)
+    }
+    c.conn = conn
+    return conn, nil
+}
+
+func (c *DOHClient) serve(conn net.PacketConn) {
+    buf := make([]byte, dohMaxMessageSize)
+    for {
+        n, addr, err := conn.ReadFrom(buf)
+        if err != nil {
+            return // closed by Stop
+        }
+        
+        query := append([]byte(nil), buf[:n]...)
+        go func() {
+            if resp, err := c.Query(query); err == nil {
+                conn.WriteTo(resp, addr)
+            }
+        }()
+    }
+}
+
+func (c *DOHClient) Stop() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    if c.conn != nil {
+        c.conn.Close()
+        c.conn = nil
+    }
+}
+
+// SetProviders sets the DoH providers in priority order and the total time
+// a query may take while falling back through them
+func (dp *DNSProtector) SetProviders(urls []string, timeout time.Duration) {
+    dp.dohClient.SetProviders(urls)
+    dp.dohClient.SetTimeout(timeout)
+}
+
+// Output rules letting DNS reach the first server
+func dnsAcceptRules(servers []string) []string {
+    return []string{
+        fmt.Sprintf("iptables -I OUTPUT -p udp --dport 53 -d %s -j ACCEPT", servers[0]),
+        fmt.Sprintf("iptables -I OUTPUT -p tcp --dport 53 -d %s -j ACCEPT", servers[0]),
+    }
+}
+
+// A bootstrap address and a port a DoH provider is reached on there
+type bootstrapTarget struct {
+    ip   net.IP
+    port int
+}
+
+// Bootstrap addresses with the port of every provider URL naming their
+// host, 443 where none names one, each once in a stable order. Both
+// firewall backends accept TCP to exactly these.
+func bootstrapTargets(ips map[string]net.IP, providers []string) []bootstrapTarget {
+    ports := make(map[string][]int)
+    for _, provider := range providers {
+        u, err := url.Parse(provider)
+        if err != nil {
+            continue
+        }
+        port := dohDefaultPort
+        if p, err := strconv.Atoi(u.Port()); err == nil {
+            port = p
+        }
+        host := strings.ToLower(u.Hostname())
+        ports[host] = append(ports[host], port)
+    }
+    
+    hosts := make([]string, 0, len(ips))
+    for host := range ips {
+        hosts = append(hosts, host)
+    }
+    sort.Strings(hosts)
+    
+    var targets []bootstrapTarget
+    seen := make(map[string]bool)
+    for _, host := range hosts {
+        ip := ips[host]
+        hostPorts := ports[strings.ToLower(host)]
+        if len(hostPorts) == 0 {
+            hostPorts = []int{dohDefaultPort}
+        }
+        for _, port := range hostPorts {
+            key := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+            if seen[key] {
+                continue
+            }
+            seen[key] = true
+            targets = append(targets, bootstrapTarget{ip: ip, port: port})
+        }
+    }
+    return targets
+}
+
+// Output rules letting the DoH client reach the bootstrap addresses
+func bootstrapAcceptRules(targets []bootstrapTarget) []string {
+    var rules []string
+    for _, target := range targets {
+        rules = append(rules, fmt.Sprintf("%s -I OUTPUT -p tcp -d %s --dport %d -j ACCEPT", iptablesFor(target.ip), target.ip, target.port))
+    }
+    return rules
+}
+
+// Provider URLs as configured or derived, for bootstrapTargets
+func (c *DOHClient) providerURLs() []string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    urls := make([]string, len(c.providers))
+    for i, p := range c.providers {
+        urls[i] = p.url
+    }
+    return urls
+}
+
+func (dp *DNSProtector) bootstrapTargets() []bootstrapTarget {
+    return bootstrapTargets(dp.BootstrapIPs, dp.dohClient.providerURLs())
+}
+
+// SetServers switches DNS to new servers without lifting the block on
+// other resolvers: the new accept rules go in before the old ones are
+// removed. DoH providers derived from the servers follow them.
+func (dp *DNSProtector) SetServers(servers []string) error {
+    if len(servers) == 0 {
+        return fmt.Errorf("no DNS servers")
+    }
+    if !dp.enabled.Load() || dp.ProxyOnly {
+        dp.dnsServers = servers
+        dp.dohClient.mu.Lock()
+        dp.dohClient.deriveProvidersLocked(servers)
+        dp.dohClient.mu.Unlock()
+        return nil
+    }
+    
+    if dp.nft != nil {
+        // The table is swapped whole, there is no window to close
+        if err := dp.nft.set(nftFeatureDNS, dnsNFTRules(servers, dp.bootstrapTargets())); err != nil {
+            return err
+        }
+        dp.dnsServers = servers
+        if err := dp.applyResolver(servers); err != nil {
+            return err
+        }
+        dp.dohClient.mu.Lock()
+        dp.dohClient.deriveProvidersLocked(servers)
+        dp.dohClient.mu.Unlock()
+        return nil
+    }
+    
+    added := dnsAcceptRules(servers)
+    for i, rule := range added {
+        if err := dp.commands.Run(rule); err != nil {
+            dp.commands.removeIPTablesRules(added[:i])
+            return fmt.Errorf("failed to add rule %s: %w", rule, err)
+        }
+    }
+    
+    old := make(map[string]bool)
+    for _, rule := range dnsAcceptRules(dp.dnsServers) {
+        old[rule] = true
+    }
+    var kept, stale []string
+    for _, rule := range dp.rules {
+        if old[rule] {
+            stale = append(stale, rule)
+        } else {
+            kept = append(kept, rule)
+        }
+    }
+    dp.rules = append(kept, added...)
+    dp.dnsServers = servers
+    
+    if err := dp.applyResolver(servers); err != nil {
+        return err
+    }
+    
+    dp.dohClient.mu.Lock()
+    dp.dohClient.deriveProvidersLocked(servers)
+    dp.dohClient.mu.Unlock()
+    
+    if err := dp.commands.removeIPTablesRules(stale); err != nil {
+        return fmt.Errorf("failed to remove old DNS rules: %w", err)
+    }
+    return nil
+}
+
+// ProxyAddr is where the DoH proxy listens, nil while disabled. With
+// ProxyOnly this is the resolver to point applications at.
+func (dp *DNSProtector) ProxyAddr() net.Addr {
+    dp.mu.Lock()
+    defer dp.mu.Unlock()
+    return dp.proxyAddr
+}
+
+// DNSProxyAddr is the local DoH proxy address while DNS protection is on
+func (vpn *UnderTheRadarVPN) DNSProxyAddr() net.Addr {
+    return vpn.dnsProtector.ProxyAddr()
+}
+
+// PrimaryProvider returns the DoH provider currently answering queries
+func (dp *DNSProtector) PrimaryProvider() string {
+    return dp.dohClient.PrimaryProvider()
+}
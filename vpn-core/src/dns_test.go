@@ -0,0 +1,269 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestDOHClientFallsBackOnServerError(t *testing.T) {
+    var primaryHits atomic.Int32
+    primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        primaryHits.Add(1)
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }))
+    defer primary.Close()
+    
+    answer := []byte{0x12, 0x34, 0x81, 0x80}
+    secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("Content-Type") != "application/dns-message" {
+            w.WriteHeader(http.StatusUnsupportedMediaType)
+            return
+        }
+        io.Copy(io.Discard, r.Body)
+        w.Write(answer)
+    }))
+    defer secondary.Close()
+    
+    clock := NewFakeClock(time.Now())
+    c := NewDOHClient()
+    c.clock = clock
+    c.SetProviders([]string{primary.URL, secondary.URL})
+    
+    for i := 0; i < providerFailureLimit; i++ {
+        if c.PrimaryProvider() != primary.URL {
+            t.Fatalf("query %d: primary quarantined too early", i)
+        }
+        resp, err := c.Query([]byte{0x12, 0x34, 0x01, 0x00})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !bytes.Equal(resp, answer) {
+            t.Fatalf("resp = %x, want %x", resp, answer)
+        }
+    }
+    
+    // Quarantined after the fifth consecutive failure
+    if got := c.PrimaryProvider(); got != secondary.URL {
+        t.Fatalf("PrimaryProvider() = %s, want secondary", got)
+    }
+    if _, err := c.Query([]byte{0x00}); err != nil {
+        t.Fatal(err)
+    }
+    if got := primaryHits.Load(); got != providerFailureLimit {
+        t.Fatalf("primary queried %d times, want %d", got, providerFailureLimit)
+    }
+    
+    // Back in rotation once the quarantine expires
+    clock.Advance(providerQuarantine + time.Second)
+    if got := c.PrimaryProvider(); got != primary.URL {
+        t.Fatalf("PrimaryProvider() = %s, want primary after quarantine", got)
+    }
+}
+
+func TestDOHClientTotalTimeout(t *testing.T) {
+    release := make(chan struct{})
+    slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        select {
+        case <-release:
+        case <-r.Context().Done():
+        }
+    }))
+    defer slow.Close()
+    defer close(release) // unblock handlers before Close waits for them
+    
+    c := NewDOHClient()
+    c.SetProviders([]string{slow.URL, slow.URL})
+    c.SetTimeout(50 * time.Millisecond)
+    
+    start := time.Now()
+    if _, err := c.Query([]byte{0x00}); err == nil {
+        t.Fatal("expected timeout")
+    }
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Fatalf("query took %v despite 50ms budget", elapsed)
+    }
+}
+
+func TestDOHClientHungProviderFailsOver(t *testing.T) {
+    release := make(chan struct{})
+    hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        select {
+        case <-release:
+        case <-r.Context().Done():
+        }
+    }))
+    defer hung.Close()
+    defer close(release)
+    
+    answer := []byte{0x12, 0x34, 0x81, 0x80}
+    secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write(answer)
+    }))
+    defer secondary.Close()
+    
+    c := NewDOHClient()
+    c.SetProviders([]string{hung.URL, secondary.URL})
+    c.SetTimeout(200 * time.Millisecond)
+    
+    resp, err := c.Query([]byte{0x12, 0x34, 0x01, 0x00})
+    if err != nil {
+        t.Fatalf("secondary should answer once the primary's share runs out: %v", err)
+    }
+    if !bytes.Equal(resp, answer) {
+        t.Fatalf("resp = %x, want %x", resp, answer)
+    }
+}
+
+func TestDOHClientClientErrorDoesNotFailOver(t *testing.T) {
+    var secondaryHits atomic.Int32
+    primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusBadRequest)
+    }))
+    defer primary.Close()
+    secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        secondaryHits.Add(1)
+    }))
+    defer secondary.Close()
+    
+    c := NewDOHClient()
+    c.SetProviders([]string{primary.URL, secondary.URL})
+    
+    if _, err := c.Query([]byte{0x00}); err == nil {
+        t.Fatal("expected error for malformed query")
+    }
+    if secondaryHits.Load() != 0 {
+        t.Fatal("a rejected query should not be retried elsewhere")
+    }
+}
+
+func TestDNSProtectorProxyOnlyResolves(t *testing.T) {
+    answer := []byte{0xab, 0xcd, 0x81, 0x80, 0, 1, 0, 1}
+    doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        query, _ := io.ReadAll(r.Body)
+        if !bytes.Equal(query[:2], answer[:2]) {
+            w.WriteHeader(http.StatusBadRequest)
+            return
+        }
+        w.Write(answer)
+    }))
+    defer doh.Close()
+    
+    var commands []string
+    dp := NewDNSProtector()
+    dp.commands = func(cmdline string) error {
+        commands = append(commands, cmdline)
+        return nil
+    }
+    dp.ProxyOnly = true
+    dp.ListenAddr = "127.0.0.1:0"
+    dp.SetProviders([]string{doh.URL}, time.Second)
+    
+    if err := dp.Enable([]string{"1.1.1.1"}); err != nil {
+        t.Fatal(err)
+    }
+    defer dp.Disable()
+    if len(commands) != 0 {
+        t.Fatalf("proxy-only mode touched the firewall: %q", commands)
+    }
+    
+    addr := dp.ProxyAddr()
+    if addr == nil || addr.(*net.UDPAddr).Port == 0 {
+        t.Fatalf("ProxyAddr() = %v", addr)
+    }
+    conn, err := net.Dial("udp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    
+    if _, err := conn.Write([]byte{0xab, 0xcd, 0x01, 0x00, 0, 1, 0, 0}); err != nil {
+        t.Fatal(err)
+    }
+    buf := make([]byte, 512)
+    n, err := conn.Read(buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(buf[:n], answer) {
+        t.Fatalf("answer %x, want %x", buf[:n], answer)
+    }
+    
+    // Changing servers in proxy-only mode adds no rules either
+    if err := dp.SetServers([]string{"9.9.9.9"}); err != nil || len(commands) != 0 {
+        t.Fatalf("SetServers: %v, commands %q", err, commands)
+    }
+    
+    if err := dp.Disable(); err != nil || dp.ProxyAddr() != nil {
+        t.Fatalf("Disable: %v, ProxyAddr %v", err, dp.ProxyAddr())
+    }
+}
+
+func TestDOHClientDialsBootstrapIP(t *testing.T) {
+    answer := []byte{0x12, 0x34, 0x81, 0x80}
+    var serverName, host atomic.Value
+    doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        serverName.Store(r.TLS.ServerName)
+        host.Store(r.Host)
+        w.Write(answer)
+    }))
+    defer doh.Close()
+    port := doh.Listener.Addr().(*net.TCPAddr).Port
+    
+    // The test certificate is issued to example.com, which isn't resolvable
+    // here: only the bootstrap address gets us to the server
+    c := NewDOHClient()
+    c.httpClient.Transport.(*http.Transport).TLSClientConfig = doh.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+    c.SetBootstrapIPs(map[string]net.IP{"Example.com": net.IPv4(127, 0, 0, 1)})
+    c.SetProviders([]string{fmt.Sprintf("https://example.com:%d/dns-query", port)})
+    
+    resp, err := c.Query([]byte{0x12, 0x34, 0x01, 0x00})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(resp, answer) {
+        t.Fatalf("resp = %x, want %x", resp, answer)
+    }
+    if serverName.Load() != "example.com" || host.Load() != fmt.Sprintf("example.com:%d", port) {
+        t.Fatalf("SNI %v, Host %v, want the provider's hostname", serverName.Load(), host.Load())
+    }
+    
+    // Providers given by IP are dialed as they are
+    c.SetProviders([]string{fmt.Sprintf("https://127.0.0.1:%d/dns-query", port)})
+    if _, err := c.Query([]byte{0x12, 0x34, 0x01, 0x00}); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestDNSProtectorAcceptsBootstrapIPs(t *testing.T) {
+    host := installFakeHost(t, "")
+    dp := NewDNSProtector()
+    dp.commands = host.run
+    dp.ListenAddr = "127.0.0.1:0"
+    dp.BootstrapIPs = map[string]net.IP{
+        "dns.quad9.net":   net.ParseIP("9.9.9.9"),
+        "dns10.quad9.net": net.ParseIP("9.9.9.9"),
+        "cloudflare-dns.com": net.ParseIP("2606:4700:4700::1111"),
+    }
+    
+    if err := dp.Enable([]string{"1.1.1.1"}); err != nil {
+        t.Fatal(err)
+    }
+    if host.rules["iptables OUTPUT -p tcp -d 9.9.9.9 --dport 443 -j ACCEPT"] != 1 || host.rules["ip6tables OUTPUT -p tcp -d 2606:4700:4700::1111 --dport 443 -j ACCEPT"] != 1 {
+        t.Fatalf("no accept rules for the bootstrap addresses: %v", host.rules)
+    }
+    
+    if err := dp.Disable(); err != nil {
+        t.Fatal(err)
+    }
+    if len(host.rules) != 0 {
+        t.Fatalf("residual rules %v", host.rules)
+    }
+}
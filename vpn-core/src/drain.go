@@ -0,0 +1,177 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// How often a drain looks whether the peer's flows have gone idle
+const drainCheckInterval = time.Second
+
+// Where drains in progress are recorded, so a restarted control plane
+// finishes them. Tests replace it.
+var drainStateDir = defaultLockDir
+
+// DrainPeer removes a peer without breaking the flows it carries: new
+// flows go elsewhere from now on, see routeFlow, while those pinned to it
+// stay until they go idle or timeout passes. The peer is never a failover
+// target meanwhile. Returns how many flows were still active when the
+// timeout forced the removal, 0 if they all ended.
+//
+// The drain is recorded, so when the control plane restarts before it
+// finishes, adding the peer again resumes it until the same deadline.
+func (vpn *UnderTheRadarVPN) DrainPeer(pubKey wgtypes.Key, timeout time.Duration) (int, error) {
+    return vpn.DrainPeerContext(context.Background(), pubKey, timeout)
+}
+
+// DrainPeerContext is DrainPeer waiting only until ctx is done. The drain
+// carries on without the caller then, who gets ctx's error and the flows
+// active at that point.
+func (vpn *UnderTheRadarVPN) DrainPeerContext(ctx context.Context, pubKey wgtypes.Key, timeout time.Duration) (int, error) {
+    vpn.mu.Lock()
+    peer := vpn.peers.get(pubKey)
+    if peer == nil {
+        vpn.mu.Unlock()
+        return 0, fmt.Errorf("%w: %s", ErrPeerNotFound, pubKey)
+    }
+    deadline := vpn.clock().Now().Add(timeout)
+    if peer.draining.Load() && peer.drainDeadline.Before(deadline) {
+        deadline = peer.drainDeadline
+    }
+    if err := updateDrainState(vpn.deviceName, func(drains map[string]time.Time) {
+        drains[pubKey.String()] = deadline
+    }); err != nil {
+        vpn.mu.Unlock()
+        return 0, err
+    }
+    peer.drainDeadline = deadline
+    peer.draining.Store(true)
+    
+    // Its idle prefixes go to the claimants on standby
+    vpn.rebalanceAllowedIPsLocked()
+    vpn.mu.Unlock()
+    
+    return vpn.waitDrain(ctx, peer, deadline)
+}
+
+// Resume the drain of a peer added back after a restart. Caller holds
+// vpn.mu.
+func (vpn *UnderTheRadarVPN) resumeDrainLocked(peer *Peer) {
+    drains, err := loadDrainState(vpn.deviceName)
+    if err != nil {
+        return
+    }
+    deadline, ok := drains[peer.PublicKey.String()]
+    if !ok {
+        return
+    }
+    peer.drainDeadline = deadline
+    peer.draining.Store(true)
+    go vpn.waitDrain(context.Background(), peer, deadline)
+}
+
+// Wait for the peer's flows to go idle or the deadline, then remove it.
+// When ctx is done first, the wait goes on in the background.
+func (vpn *UnderTheRadarVPN) waitDrain(ctx context.Context, peer *Peer, deadline time.Time) (int, error) {
+    clock := vpn.clock()
+    ticker := clock.NewTicker(drainCheckInterval)
+    defer ticker.Stop()
+    
+    for {
+        now := clock.Now()
+        active := vpn.flowPins.active(peer.PublicKey, now)
+        if active == 0 || !now.Before(deadline) {
+            return active, vpn.finishDrain(peer, active)
+        }
+        select {
+        case <-ticker.C():
+        case <-ctx.Done():
+            go vpn.waitDrain(context.Background(), peer, deadline)
+            return active, ctx.Err()
+        }
+    }
+}
+
+func (vpn *UnderTheRadarVPN) finishDrain(peer *Peer, active int) error {
+    // Replaced meanwhile, the new peer's drain takes over if it resumed one
+    vpn.mu.RLock()
+    current := vpn.peers.get(peer.PublicKey)
+    vpn.mu.RUnlock()
+    if current != nil && current != peer {
+        return nil
+    }
+    if current != nil {
+        if err := vpn.RemovePeer(peer.PublicKey); err != nil && !errors.Is(err, ErrPeerNotFound) {
+            return err
+        }
+    }
+    vpn.flowPins.forget(peer.PublicKey)
+    
+    result := "result:idle"
+    if active > 0 {
+        result = "result:forced"
+    }
+    vpn.metricSink().Count("peer.drained", 1, append(peer.metricTags(), result)...)
+    
+    vpn.mu.Lock()
+    defer vpn.mu.Unlock()
+    return updateDrainState(vpn.deviceName, func(drains map[string]time.Time) {
+        delete(drains, peer.PublicKey.String())
+    })
+}
+
+func drainStatePath(device string) string {
+    return filepath.Join(drainStateDir, device+".drain")
+}
+
+// Drains in progress, deadlines by public key
+func loadDrainState(device string) (map[string]time.Time, error) {
+    drains := make(map[string]time.Time)
+    data, err := os.ReadFile(drainStatePath(device))
+    if errors.Is(err, fs.ErrNotExist) {
+        return drains, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(data, &drains); err != nil {
+        return nil, fmt.Errorf("invalid drain state %s: %w", drainStatePath(device), err)
+    }
+    return drains, nil
+}
+
+// Change the record, removing it once no drain is left. Callers hold
+// vpn.mu so updates don't interleave.
+func updateDrainState(device string, update func(map[string]time.Time)) error {
+    drains, err := loadDrainState(device)
+    if err != nil {
+        return err
+    }
+    update(drains)
+    if len(drains) == 0 {
+        if err := os.Remove(drainStatePath(device)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+            return err
+        }
+        return nil
+    }
+    
+    data, err := json.Marshal(drains)
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(drainStateDir, 0o755); err != nil {
+        return fmt.Errorf("failed to create %s: %w", drainStateDir, err)
+    }
+    if err := os.WriteFile(drainStatePath(device), data, 0o600); err != nil {
+        return fmt.Errorf("failed to save drain state: %w", err)
+    }
+    return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net"
+    "os"
+    "testing"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Two live peers under AllowedIPByPriority claiming 10.9.0.0/24, the
+// higher priority one owning it. The other also routes 10.0.0.0/8, so it
+// can take new flows while the prefix stays.
+func newDrainVPN(t *testing.T, clock *FakeClock) (vpn *UnderTheRadarVPN, wg *fakeWGClient, high, low wgtypes.Key) {
+    t.Helper()
+    
+    wg = newFakeWGClient()
+    vpn = newTestVPN(t, wg)
+    vpn.allowedIPConflicts = AllowedIPByPriority
+    vpn.timeSource = clock
+    high, low = mustKey(t).PublicKey(), mustKey(t).PublicKey()
+    shared := mustCIDR(t, "10.9.0.0/24")
+    for _, pc := range []PeerConfig{
+        {PublicKey: low, AllowedIPs: []net.IPNet{mustCIDR(t, "10.0.0.0/8"), shared}, Priority: 10},
+        {PublicKey: high, AllowedIPs: []net.IPNet{shared}, Priority: 20},
+    } {
+        if err := vpn.AddPeer(pc); err != nil {
+            t.Fatal(err)
+        }
+        vpn.peers.get(pc.PublicKey).IsAlive.Store(true)
+    }
+    return vpn, wg, high, low
+}
+
+type drainResult struct {
+    active int
+    err    error
+}
+
+func startDrain(vpn *UnderTheRadarVPN, key wgtypes.Key, timeout time.Duration) <-chan drainResult {
+    done := make(chan drainResult, 1)
+    go func() {
+        active, err := vpn.DrainPeer(key, timeout)
+        done <- drainResult{active, err}
+    }()
+    return done
+}
+
+func peerDraining(vpn *UnderTheRadarVPN, key wgtypes.Key) bool {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    peer := vpn.peers.get(key)
+    return peer != nil && peer.draining.Load()
+}
+
+func TestDrainPeerWaitsForFlows(t *testing.T) {
+    clock := NewFakeClock(time.Unix(1700000000, 0))
+    vpn, wg, high, low := newDrainVPN(t, clock)
+    sink := &captureSink{}
+    vpn.SetMetricSink(sink)
+    
+    flow := Flow{SrcIP: net.IPv4(10, 100, 0, 2), DstIP: net.IPv4(10, 9, 0, 1), Proto: 6, SrcPort: 40000, DstPort: 443}
+    if peer, _ := vpn.routeFlow(flow); peer == nil || peer.PublicKey != high {
+        t.Fatal("flow should start on the higher priority peer")
+    }
+    
+    done := startDrain(vpn, high, 10*time.Minute)
+    advanceUntil(t, clock, 0, func() bool { return peerDraining(vpn, high) })
+    
+    var info PeerInfo
+    for _, p := range vpn.ListPeers() {
+        if p.PublicKey == high {
+            info = p
+        }
+    }
+    if !info.Draining || !info.DrainDeadline.Equal(clock.Now().Add(10*time.Minute)) {
+        t.Fatalf("peer info shows draining %v until %v", info.Draining, info.DrainDeadline)
+    }
+    if _, err := os.Stat(drainStatePath("utr0")); err != nil {
+        t.Fatalf("drain not recorded: %v", err)
+    }
+    
+    // The established flow stays, new ones go elsewhere, and the prefix
+    // waits for the flow
+    if peer, _ := vpn.routeFlow(flow); peer == nil || peer.PublicKey != high {
+        t.Fatal("established flow moved off the draining peer")
+    }
+    fresh := flow
+    fresh.SrcPort = 40001
+    if peer, _ := vpn.routeFlow(fresh); peer == nil || peer.PublicKey != low {
+        t.Fatal("new flow should avoid the draining peer")
+    }
+    if owner, _ := wg.allowedIPOwner("utr0", "10.9.0.0/24"); owner != high {
+        t.Fatal("prefix moved under an active flow")
+    }
+    
+    // Removed once the flow goes idle, well before the deadline
+    var result drainResult
+    advanceUntil(t, clock, 30*time.Second, func() bool {
+        select {
+        case result = <-done:
+            return true
+        default:
+            return false
+        }
+    })
+    if result.err != nil || result.active != 0 {
+        t.Fatalf("drain returned %d active flows, %v", result.active, result.err)
+    }
+    if vpn.peers.get(high) != nil {
+        t.Fatal("drained peer is still there")
+    }
+    if owner, _ := wg.allowedIPOwner("utr0", "10.9.0.0/24"); owner != low {
+        t.Fatal("prefix should go to the remaining claimant")
+    }
+    if !sink.has("c peer.drained 1 peer:" + high.String() + ",result:idle") {
+        t.Fatalf("no drain metric in %v", sink.metrics)
+    }
+    if _, err := os.Stat(drainStatePath("utr0")); !errors.Is(err, os.ErrNotExist) {
+        t.Fatalf("drain record left behind: %v", err)
+    }
+    
+    if _, err := vpn.DrainPeer(high, time.Minute); !errors.Is(err, ErrPeerNotFound) {
+        t.Fatalf("draining a removed peer: %v", err)
+    }
+}
+
+func TestDrainPeerForcedByTimeout(t *testing.T) {
+    clock := NewFakeClock(time.Unix(1700000000, 0))
+    vpn, _, high, _ := newDrainVPN(t, clock)
+    sink := &captureSink{}
+    vpn.SetMetricSink(sink)
+    
+    flows := []Flow{
+        {SrcIP: net.IPv4(10, 100, 0, 2), DstIP: net.IPv4(10, 9, 0, 1), Proto: 6, SrcPort: 40000, DstPort: 443},
+        {SrcIP: net.IPv4(10, 100, 0, 2), DstIP: net.IPv4(10, 9, 0, 2), Proto: 17, SrcPort: 40000, DstPort: 53},
+    }
+    for _, f := range flows {
+        vpn.routeFlow(f)
+    }
+    
+    // The flows keep carrying traffic
+    done := startDrain(vpn, high, 5*time.Second)
+    var result drainResult
+    advanceUntil(t, clock, time.Second, func() bool {
+        for _, f := range flows {
+            vpn.routeFlow(f)
+        }
+        select {
+        case result = <-done:
+            return true
+        default:
+            return false
+        }
+    })
+    if result.err != nil || result.active != len(flows) {
+        t.Fatalf("drain returned %d active flows, %v, want %d", result.active, result.err, len(flows))
+    }
+    if vpn.peers.get(high) != nil {
+        t.Fatal("peer should be removed at the deadline")
+    }
+    if !sink.has("c peer.drained 1 peer:" + high.String() + ",result:forced") {
+        t.Fatalf("no forced drain metric in %v", sink.metrics)
+    }
+}
+
+func TestDrainingPeerNeverTakesOver(t *testing.T) {
+    clock := NewFakeClock(time.Unix(1700000000, 0))
+    vpn, wg, high, low := newDrainVPN(t, clock)
+    vpn.healthCheck = NewHealthChecker(vpn)
+    fm := NewFailoverManager(vpn)
+    defer fm.events.Stop()
+    
+    // The lower priority peer drains behind an active flow
+    flow := Flow{SrcIP: net.IPv4(10, 100, 0, 2), DstIP: net.IPv4(10, 9, 0, 1), Proto: 6, SrcPort: 40000, DstPort: 443}
+    vpn.mu.Lock()
+    vpn.flowPins.pin(flow, vpn.peers.get(low), clock.Now())
+    vpn.mu.Unlock()
+    done := startDrain(vpn, low, time.Hour)
+    advanceUntil(t, clock, 0, func() bool { return peerDraining(vpn, low) })
+    
+    // The owner fails; its prefix stays rather than move to the draining peer
+    link := &flappingHealth{}
+    vpn.healthCheck.SetStrategy("", link)
+    fm.handlePeerFailure(context.Background(), vpn.peers.get(high))
+    if owner, _ := wg.allowedIPOwner("utr0", "10.9.0.0/24"); owner != high {
+        t.Fatal("prefix failed over to a draining peer")
+    }
+    if peer := vpn.routePacket(net.ParseIP("10.9.0.9")); peer != nil {
+        t.Fatalf("routePacket chose %s", peer.PublicKey)
+    }
+    
+    advanceUntil(t, clock, time.Minute, func() bool {
+        select {
+        case <-done:
+            return true
+        default:
+            return false
+        }
+    })
+}
+
+func TestDrainResumesAfterRestart(t *testing.T) {
+    clock := NewFakeClock(time.Unix(1700000000, 0))
+    vpn, _, high, _ := newDrainVPN(t, clock)
+    flow := Flow{SrcIP: net.IPv4(10, 100, 0, 2), DstIP: net.IPv4(10, 9, 0, 1), Proto: 6, SrcPort: 40000, DstPort: 443}
+    vpn.routeFlow(flow)
+    done := startDrain(vpn, high, 10*time.Minute)
+    advanceUntil(t, clock, 0, func() bool { return peerDraining(vpn, high) })
+    
+    // A new control plane gets the peer back from its config. Its flows
+    // are unknown to it, so the drain finishes right away.
+    restarted := newTestVPN(t, newFakeWGClient())
+    restarted.timeSource = NewFakeClock(clock.Now())
+    if err := restarted.AddPeer(PeerConfig{PublicKey: high, AllowedIPs: []net.IPNet{mustCIDR(t, "10.9.0.0/24")}}); err != nil {
+        t.Fatal(err)
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        restarted.mu.RLock()
+        gone := restarted.peers.get(high) == nil
+        restarted.mu.RUnlock()
+        if gone {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("resumed drain did not remove the peer")
+        }
+        time.Sleep(time.Millisecond)
+    }
+    
+    advanceUntil(t, clock, time.Minute, func() bool {
+        select {
+        case <-done:
+            return true
+        default:
+            return false
+        }
+    })
+    if _, err := os.Stat(drainStatePath("utr0")); !errors.Is(err, os.ErrNotExist) {
+        t.Fatalf("drain record left behind: %v", err)
+    }
+}
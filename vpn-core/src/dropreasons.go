@@ -0,0 +1,127 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DropReason says why the eBPF programs dropped a packet
+type DropReason uint32
+
+const (
+    DropMTUExceeded      DropReason = iota + 1 // too big for the device the fast path redirects to
+    DropRateLimited                            // endpoint over the XDP packet rate
+    DropNoRoute                                // fast path found no route to the destination
+    DropReplayWindow                           // WireGuard counter behind the replay window
+    DropConntrackInvalid                       // inbound packet of no tracked flow, or in the wrong state
+)
+
+func (r DropReason) String() string {
+    switch r {
+    case 0:
+        return "none"
+    case DropMTUExceeded:
+        return "mtu-exceeded"
+    case DropRateLimited:
+        return "rate-limited"
+    case DropNoRoute:
+        return "no-route"
+    case DropReplayWindow:
+        return "replay-window"
+    case DropConntrackInvalid:
+        return "conntrack-invalid"
+    default:
+        return "unknown"
+    }
+}
+
+// dropKey mirrors struct drop_key, the address stays in network byte order
+type dropKey struct {
+    Ifindex uint32
+    PeerIP  [4]byte
+    Reason  DropReason
+}
+
+// GetDropReasons returns how many of a peer's packets the eBPF programs
+// dropped for each reason, summed over CPUs and devices since the programs
+// were loaded or ClearDropReasons. Nil when the peer is unknown or the
+// programs aren't loaded.
+func (vpn *UnderTheRadarVPN) GetDropReasons(pubKey wgtypes.Key) map[DropReason]uint64 {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    peer := vpn.peers.get(pubKey)
+    if peer == nil {
+        return nil
+    }
+    m, ok := vpn.ebpfMaps["drop_reasons"]
+    if !ok {
+        return nil
+    }
+    
+    reasons := make(map[DropReason]uint64)
+    var key dropKey
+    var perCPU []uint64
+    for iter := m.Iterate(); iter.Next(&key, &perCPU); {
+        if !peer.ownsAddress(net.IP(key.PeerIP[:])) {
+            continue
+        }
+        for _, n := range perCPU {
+            reasons[key.Reason] += n
+        }
+    }
+    return reasons
+}
+
+// ClearDropReasons resets the drop counters of all peers
+func (vpn *UnderTheRadarVPN) ClearDropReasons() error {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    m, ok := vpn.ebpfMaps["drop_reasons"]
+    if !ok {
+        return nil
+    }
+    
+    var keys []dropKey
+    var key dropKey
+    var perCPU []uint64
+    for iter := m.Iterate(); iter.Next(&key, &perCPU); {
+        keys = append(keys, key)
+    }
+    for _, key := range keys {
+        if err := m.Delete(key); err != nil {
+            return fmt.Errorf("failed to clear drop counters: %w", err)
+        }
+    }
+    return nil
+}
+
+// Whether the programs count drops at ip against the peer: the outer
+// address of its endpoint, or an inner address it is allowed
+func (peer *Peer) ownsAddress(ip net.IP) bool {
+    if peer.Endpoint != nil && peer.Endpoint.IP.Equal(ip) {
+        return true
+    }
+    for _, allowed := range peer.AllowedIPs {
+        if allowed.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// The reason most packets were dropped for, 0 without drops. Ties go to
+// the lower reason so alerts are stable.
+func dominantDropReason(reasons map[DropReason]uint64) DropReason {
+    var top DropReason
+    var most uint64
+    for reason, n := range reasons {
+        if n > most || n == most && n > 0 && reason < top {
+            top, most = reason, n
+        }
+    }
+    return top
+}
@@ -0,0 +1,148 @@
+//go:build linux
+
+package main
+
+import (
+    "encoding/binary"
+    "net"
+    "runtime"
+    "testing"
+    
+    "github.com/vishvananda/netns"
+    "golang.org/x/sys/unix"
+)
+
+// WireGuard data message from src with the given counter
+func wireGuardData(src, dst net.IP, receiver uint32, counter uint64) []byte {
+    pkt := udpPacket(src, dst, 51820, 51820)
+    wg := pkt[42:]
+    wg[0] = 4
+    binary.LittleEndian.PutUint32(wg[4:8], receiver)
+    binary.LittleEndian.PutUint64(wg[8:16], counter)
+    return pkt
+}
+
+// UDP packet with size bytes of payload
+func largeUDPPacket(src, dst net.IP, sport, dport uint16, size int) []byte {
+    pkt := udpPacket(src, dst, sport, dport)
+    pkt = append(pkt[:42], make([]byte, size)...)
+    binary.BigEndian.PutUint16(pkt[16:18], uint16(len(pkt)-14))
+    binary.BigEndian.PutUint16(pkt[38:40], uint16(len(pkt)-34))
+    return pkt
+}
+
+// Run fn on a thread in a new network namespace, where BPF_PROG_TEST_RUN
+// sees only a loopback device that is down and has no routes
+func inNewNamespace(t *testing.T, fn func()) {
+    t.Helper()
+    
+    runtime.LockOSThread()
+    defer runtime.UnlockOSThread()
+    
+    origin, err := netns.Get()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer origin.Close()
+    ns, err := netns.New()
+    if err != nil {
+        t.Skipf("can't create a network namespace: %v", err)
+    }
+    defer ns.Close()
+    defer netns.Set(origin)
+    fn()
+}
+
+func setLoopbackMTU(t *testing.T, mtu uint32) {
+    t.Helper()
+    
+    fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer unix.Close(fd)
+    ifr, err := unix.NewIfreq("lo")
+    if err != nil {
+        t.Fatal(err)
+    }
+    ifr.SetUint32(mtu)
+    if err := unix.IoctlIfreq(fd, unix.SIOCSIFMTU, ifr); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestDropReasonsCountEachReason(t *testing.T) {
+    vpn := loadFastPath(t)
+    vpn.conntrack.Enforce = true
+    if err := vpn.writeConntrackConfig(); err != nil {
+        t.Fatal(err)
+    }
+    
+    const xdpDrop, tcActShot = 1, 2
+    local, remote := net.ParseIP("10.0.0.2"), net.ParseIP("198.51.100.7")
+    peer := &Peer{
+        PublicKey:  mustKey(t),
+        Endpoint:   &net.UDPAddr{IP: remote, Port: 51820},
+        AllowedIPs: []net.IPNet{{IP: local.To4(), Mask: net.CIDRMask(32, 32)}},
+    }
+    vpn.peers.put(peer)
+    
+    // Inbound packet of no flow
+    if ret, _, err := vpn.tcIngressProgram.Test(udpPacket(remote, local, 53, 40000)); err != nil || ret != tcActShot {
+        t.Fatalf("unsolicited inbound returned %d (%v), want TC_ACT_SHOT", ret, err)
+    }
+    
+    // A counter far behind the highest seen is a replay
+    if _, _, err := vpn.xdpProgram.Test(wireGuardData(remote, local, 7, 100000)); err != nil {
+        t.Fatal(err)
+    }
+    if ret, _, _ := vpn.xdpProgram.Test(wireGuardData(remote, local, 7, 1)); ret != xdpDrop {
+        t.Fatalf("replayed counter returned %d, want XDP_DROP", ret)
+    }
+    
+    // Well past the burst of the endpoint's token bucket
+    if _, _, err := vpn.xdpProgram.Benchmark(wireGuardData(remote, local, 7, 100001), 5000, nil); err != nil {
+        t.Fatal(err)
+    }
+    
+    if _, _, err := vpn.tcProgram.Test(udpPacket(local, remote, 40000, 53)); err != nil {
+        t.Fatal(err)
+    }
+    inNewNamespace(t, func() {
+        // The reply doesn't fit the device the fast path redirects to
+        setLoopbackMTU(t, 1280)
+        if ret, _, _ := vpn.tcIngressProgram.Test(largeUDPPacket(remote, local, 53, 40000, 1400)); ret != tcActShot {
+            t.Fatalf("oversized packet returned %d, want TC_ACT_SHOT", ret)
+        }
+        
+        // Toward an uplink without routes
+        lo, err := net.InterfaceByName("lo")
+        if err != nil {
+            t.Fatal(err)
+        }
+        target := fastPathTarget{Ifindex: uint32(lo.Index), Direction: fastPathToUplink}
+        if err := vpn.ebpfMaps["fastpath_redirect"].Put(uint32(lo.Index), target); err != nil {
+            t.Fatal(err)
+        }
+        if ret, _, _ := vpn.tcIngressProgram.Test(udpPacket(remote, local, 53, 40000)); ret != tcActShot {
+            t.Fatalf("unroutable packet returned %d, want TC_ACT_SHOT", ret)
+        }
+    })
+    
+    reasons := vpn.GetDropReasons(peer.PublicKey)
+    for _, reason := range []DropReason{DropMTUExceeded, DropNoRoute, DropReplayWindow, DropConntrackInvalid} {
+        if reasons[reason] != 1 {
+            t.Errorf("%v drops = %d, want 1", reason, reasons[reason])
+        }
+    }
+    if reasons[DropRateLimited] < 1000 {
+        t.Errorf("%v drops = %d, want the packets past the burst", DropRateLimited, reasons[DropRateLimited])
+    }
+    
+    if err := vpn.ClearDropReasons(); err != nil {
+        t.Fatal(err)
+    }
+    if reasons := vpn.GetDropReasons(peer.PublicKey); len(reasons) != 0 {
+        t.Fatalf("drop counters after clearing = %v", reasons)
+    }
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "net"
+    "testing"
+)
+
+func TestDropKeyLayout(t *testing.T) {
+    key := dropKey{Ifindex: 3, PeerIP: [4]byte{198, 51, 100, 7}, Reason: DropReplayWindow}
+    
+    var buf bytes.Buffer
+    if err := binary.Write(&buf, binary.LittleEndian, key); err != nil {
+        t.Fatal(err)
+    }
+    want := []byte{3, 0, 0, 0, 198, 51, 100, 7, 4, 0, 0, 0}
+    if !bytes.Equal(buf.Bytes(), want) {
+        t.Fatalf("key = %x, want %x", buf.Bytes(), want)
+    }
+}
+
+func TestPeerOwnsDropAddresses(t *testing.T) {
+    _, inner, _ := net.ParseCIDR("10.8.0.0/24")
+    peer := &Peer{
+        Endpoint:   &net.UDPAddr{IP: net.ParseIP("198.51.100.7"), Port: 51820},
+        AllowedIPs: []net.IPNet{*inner},
+    }
+    
+    for ip, want := range map[string]bool{
+        "198.51.100.7": true,  // packets from its endpoint
+        "10.8.0.42":    true,  // packets it exchanges through the tunnel
+        "198.51.100.8": false,
+        "10.8.1.1":     false,
+    } {
+        if got := peer.ownsAddress(net.ParseIP(ip).To4()); got != want {
+            t.Errorf("ownsAddress(%s) = %v, want %v", ip, got, want)
+        }
+    }
+}
+
+func TestDominantDropReason(t *testing.T) {
+    for _, tc := range []struct {
+        reasons map[DropReason]uint64
+        want    DropReason
+    }{
+        {nil, 0},
+        {map[DropReason]uint64{DropRateLimited: 0}, 0},
+        {map[DropReason]uint64{DropRateLimited: 3, DropMTUExceeded: 40, DropNoRoute: 1}, DropMTUExceeded},
+        {map[DropReason]uint64{DropConntrackInvalid: 5, DropReplayWindow: 5}, DropReplayWindow},
+    } {
+        if got := dominantDropReason(tc.reasons); got != tc.want {
+            t.Errorf("dominantDropReason(%v) = %v, want %v", tc.reasons, got, tc.want)
+        }
+    }
+}
@@ -0,0 +1,187 @@
+package main
+
+import "fmt"
+
+const (
+    // Rules the classifier holds, DSCP_MAX_RULES
+    maxDSCPRules = 32
+    
+    // Outer DSCP that keeps the inner value, DSCP_COPY_INNER
+    dscpCopyInner = 0xff
+    
+    maxDSCP = 63
+)
+
+// DSCPRule classifies tunneled packets by their inner header and sets the
+// DSCP of the encrypted packet carrying them. Criteria left zero match any
+// packet; the first matching rule wins.
+type DSCPRule struct {
+    Class     string // counters are kept per class, rules may share one
+    InnerDSCP *uint8 // nil matches any
+    Protocol  uint8  // IP protocol, 0 matches any
+    PortMin   uint16 // inner destination port range, 0 matches any
+    PortMax   uint16 // 0 matches PortMin only
+    OuterDSCP uint8
+    CopyInner bool // the outer header takes the inner DSCP, OuterDSCP is ignored
+}
+
+// dscpRuleEntry mirrors struct dscp_rule
+type dscpRuleEntry struct {
+    MatchDSCP uint8
+    InnerDSCP uint8
+    Protocol  uint8
+    OuterDSCP uint8
+    PortMin   uint16
+    PortMax   uint16
+}
+
+// dscpSettings mirrors struct dscp_config
+type dscpSettings struct {
+    RuleCount uint32
+}
+
+// DSCPCounters mirrors struct dscp_counters
+type DSCPCounters struct {
+    Packets uint64
+    Bytes   uint64
+}
+
+// DSCPStats counts classified packets, summed over all CPUs. Counters
+// restart when the policy changes.
+type DSCPStats struct {
+    Classes      map[string]DSCPCounters
+    Unclassified DSCPCounters
+}
+
+func (r DSCPRule) validate() error {
+    if r.Class == "" {
+        return fmt.Errorf("DSCP rule without a class")
+    }
+    if r.InnerDSCP != nil && *r.InnerDSCP > maxDSCP {
+        return fmt.Errorf("class %s: inner DSCP %d out of range", r.Class, *r.InnerDSCP)
+    }
+    if !r.CopyInner && r.OuterDSCP > maxDSCP {
+        return fmt.Errorf("class %s: outer DSCP %d out of range", r.Class, r.OuterDSCP)
+    }
+    if r.PortMin == 0 && r.PortMax != 0 || r.PortMax != 0 && r.PortMax < r.PortMin {
+        return fmt.Errorf("class %s: invalid port range %d-%d", r.Class, r.PortMin, r.PortMax)
+    }
+    if r.PortMin != 0 && r.Protocol != 0 && r.Protocol != 6 && r.Protocol != 17 {
+        return fmt.Errorf("class %s: ports only match TCP and UDP", r.Class)
+    }
+    return nil
+}
+
+func (r DSCPRule) entry() dscpRuleEntry {
+    e := dscpRuleEntry{Protocol: r.Protocol, OuterDSCP: r.OuterDSCP, PortMin: r.PortMin, PortMax: r.PortMax}
+    if r.InnerDSCP != nil {
+        e.MatchDSCP, e.InnerDSCP = 1, *r.InnerDSCP
+    }
+    if r.CopyInner {
+        e.OuterDSCP = dscpCopyInner
+    }
+    // A single port is a range of one
+    if e.PortMin != 0 && e.PortMax == 0 {
+        e.PortMax = e.PortMin
+    }
+    return e
+}
+
+// SetDSCPPolicy replaces the rules classifying tunneled traffic for DSCP
+// marking, so real-time traffic keeps its priority on the network between
+// the peers. Packets no rule matches keep the marking of the uplink egress
+// program.
+func (vpn *UnderTheRadarVPN) SetDSCPPolicy(rules []DSCPRule) error {
+    if len(rules) > maxDSCPRules {
+        return fmt.Errorf("%d DSCP rules, at most %d are supported", len(rules), maxDSCPRules)
+    }
+    for _, r := range rules {
+        if err := r.validate(); err != nil {
+            return err
+        }
+    }
+    
+    vpn.mu.Lock()
+    defer vpn.mu.Unlock()
+    
+    vpn.dscpRules = append([]DSCPRule(nil), rules...)
+    return vpn.writeDSCPPolicy()
+}
+
+// Push the rules into the classifier maps and restart the counters, whose
+// indexes now belong to other classes
+func (vpn *UnderTheRadarVPN) writeDSCPPolicy() error {
+    rulesMap, ok := vpn.ebpfMaps["dscp_rules"]
+    if !ok {
+        return nil
+    }
+    configMap, ok := vpn.ebpfMaps["dscp_config"]
+    if !ok {
+        return nil
+    }
+    
+    // Rules beyond the count are ignored, so rewriting the ones in use is
+    // safe while the classifier runs
+    for i, r := range vpn.dscpRules {
+        if err := rulesMap.Put(uint32(i), r.entry()); err != nil {
+            return fmt.Errorf("failed to update DSCP rules: %w", err)
+        }
+    }
+    if err := configMap.Put(uint32(0), dscpSettings{RuleCount: uint32(len(vpn.dscpRules))}); err != nil {
+        return fmt.Errorf("failed to update DSCP config: %w", err)
+    }
+    
+    if statsMap, ok := vpn.ebpfMaps["dscp_stats"]; ok {
+        for i := uint32(0); i <= maxDSCPRules; i++ {
+            var perCPU []DSCPCounters
+            if err := statsMap.Lookup(i, &perCPU); err != nil {
+                return fmt.Errorf("failed to read DSCP counters: %w", err)
+            }
+            if err := statsMap.Put(i, make([]DSCPCounters, len(perCPU))); err != nil {
+                return fmt.Errorf("failed to reset DSCP counters: %w", err)
+            }
+        }
+    }
+    return nil
+}
+
+// DSCPStats returns the packets each class of the DSCP policy matched
+func (vpn *UnderTheRadarVPN) DSCPStats() (DSCPStats, error) {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    stats := DSCPStats{Classes: make(map[string]DSCPCounters)}
+    for _, r := range vpn.dscpRules {
+        stats.Classes[r.Class] = DSCPCounters{}
+    }
+    m, ok := vpn.ebpfMaps["dscp_stats"]
+    if !ok {
+        return stats, nil
+    }
+    
+    for i := 0; i <= len(vpn.dscpRules); i++ {
+        // The last index counts what no rule matched
+        index := uint32(i)
+        if i == len(vpn.dscpRules) {
+            index = maxDSCPRules
+        }
+        var perCPU []DSCPCounters
+        if err := m.Lookup(index, &perCPU); err != nil {
+            return stats, fmt.Errorf("failed to read DSCP counters: %w", err)
+        }
+        var sum DSCPCounters
+        for _, c := range perCPU {
+            sum.Packets += c.Packets
+            sum.Bytes += c.Bytes
+        }
+        if i == len(vpn.dscpRules) {
+            stats.Unclassified = sum
+            continue
+        }
+        class := stats.Classes[vpn.dscpRules[i].Class]
+        class.Packets += sum.Packets
+        class.Bytes += sum.Bytes
+        stats.Classes[vpn.dscpRules[i].Class] = class
+    }
+    return stats, nil
+}
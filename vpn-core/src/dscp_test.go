@@ -0,0 +1,77 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "strings"
+    "testing"
+)
+
+func TestDSCPRuleLayout(t *testing.T) {
+    ef := uint8(46)
+    rules := []DSCPRule{
+        {Class: "voip", Protocol: 17, PortMin: 5060, PortMax: 5061, OuterDSCP: ef},
+        {Class: "marked", InnerDSCP: &ef, CopyInner: true},
+        {Class: "dns", Protocol: 17, PortMin: 53},
+    }
+    want := [][]byte{
+        {0, 0, 17, 46, 0xc4, 0x13, 0xc5, 0x13},
+        {1, 46, 0, 0xff, 0, 0, 0, 0},
+        {0, 0, 17, 0, 53, 0, 53, 0},
+    }
+    for i, r := range rules {
+        if err := r.validate(); err != nil {
+            t.Fatal(err)
+        }
+        var buf bytes.Buffer
+        if err := binary.Write(&buf, binary.LittleEndian, r.entry()); err != nil {
+            t.Fatal(err)
+        }
+        if !bytes.Equal(buf.Bytes(), want[i]) {
+            t.Errorf("%s = %x, want %x", r.Class, buf.Bytes(), want[i])
+        }
+    }
+}
+
+func TestSetDSCPPolicyValidates(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    tooHigh := uint8(64)
+    for _, tc := range []struct {
+        rule DSCPRule
+        want string
+    }{
+        {DSCPRule{OuterDSCP: 46}, "without a class"},
+        {DSCPRule{Class: "a", InnerDSCP: &tooHigh}, "inner DSCP"},
+        {DSCPRule{Class: "a", OuterDSCP: 64}, "outer DSCP"},
+        {DSCPRule{Class: "a", PortMin: 100, PortMax: 99}, "port range"},
+        {DSCPRule{Class: "a", PortMax: 99}, "port range"},
+        {DSCPRule{Class: "a", Protocol: 1, PortMin: 7}, "TCP and UDP"},
+    } {
+        if err := vpn.SetDSCPPolicy([]DSCPRule{tc.rule}); err == nil || !strings.Contains(err.Error(), tc.want) {
+            t.Errorf("%+v: %v, want %q", tc.rule, err, tc.want)
+        }
+    }
+    if err := vpn.SetDSCPPolicy(make([]DSCPRule, maxDSCPRules+1)); err == nil {
+        t.Error("more rules than the classifier holds accepted")
+    }
+    if len(vpn.dscpRules) != 0 {
+        t.Fatalf("rejected policy stored: %v", vpn.dscpRules)
+    }
+    
+    // Copying the inner DSCP ignores OuterDSCP
+    rules := []DSCPRule{
+        {Class: "voip", Protocol: 17, PortMin: 5060, PortMax: 5061, OuterDSCP: 46},
+        {Class: "voip", Protocol: 6, PortMin: 5061, OuterDSCP: 46},
+        {Class: "rest", OuterDSCP: 255, CopyInner: true},
+    }
+    if err := vpn.SetDSCPPolicy(rules); err != nil {
+        t.Fatal(err)
+    }
+    stats, err := vpn.DSCPStats()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(stats.Classes) != 2 {
+        t.Fatalf("classes %v", stats.Classes)
+    }
+}
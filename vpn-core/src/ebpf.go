@@ -0,0 +1,612 @@
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "time"
+    
+    "github.com/cilium/ebpf"
+    "github.com/cilium/ebpf/link"
+    "github.com/cilium/ebpf/rlimit"
+)
+
+// Object built from ebpf/xdp_accelerator.c:
+//   clang -O2 -g -target bpf -c ebpf/xdp_accelerator.c -o ebpf/xdp_accelerator.o
+var ebpfObjectPath = "ebpf/xdp_accelerator.o"
+
+// TC programs are attached with tc(8), which needs them pinned to bpffs
+const bpffsRoot = "/sys/fs/bpf/undertheradar"
+
+const (
+    defaultConntrackCapacity = 65536
+    defaultConntrackTimeout  = 5 * time.Minute
+)
+
+// ConntrackConfig tunes the stateful filter in the TC ingress program
+type ConntrackConfig struct {
+    MaxEntries uint32        // LRU capacity, least recently used flows are evicted first
+    Timeout    time.Duration // idle flows older than this no longer admit inbound packets
+    Enforce    bool          // drop inbound packets that don't belong to a tracked flow
+}
+
+// Connection states stored in the conntrack map
+type ConntrackState uint8
+
+const (
+    ConntrackNew ConntrackState = iota + 1
+    ConntrackEstablished
+    ConntrackFinWait
+)
+
+// conntrackKey mirrors struct ct_key, ports stay in network byte order
+type conntrackKey struct {
+    SrcIP    net.IP
+    DstIP    net.IP
+    SrcPort  uint16
+    DstPort  uint16
+    Protocol uint8
+}
+
+func (k conntrackKey) MarshalBinary() ([]byte, error) {
+    src, dst := k.SrcIP.To4(), k.DstIP.To4()
+    if src == nil || dst == nil {
+        return nil, fmt.Errorf("conntrack only tracks IPv4 flows")
+    }
+    
+    buf := make([]byte, 13)
+    copy(buf[0:4], src)
+    copy(buf[4:8], dst)
+    binary.BigEndian.PutUint16(buf[8:10], k.SrcPort)
+    binary.BigEndian.PutUint16(buf[10:12], k.DstPort)
+    buf[12] = k.Protocol
+    return buf, nil
+}
+
+func (k *conntrackKey) UnmarshalBinary(buf []byte) error {
+    if len(buf) != 13 {
+        return fmt.Errorf("conntrack key of %d bytes, want 13", len(buf))
+    }
+    k.SrcIP = net.IP(append([]byte(nil), buf[0:4]...))
+    k.DstIP = net.IP(append([]byte(nil), buf[4:8]...))
+    k.SrcPort = binary.BigEndian.Uint16(buf[8:10])
+    k.DstPort = binary.BigEndian.Uint16(buf[10:12])
+    k.Protocol = buf[12]
+    return nil
+}
+
+// conntrackEntry mirrors struct ct_entry
+type conntrackEntry struct {
+    LastSeen uint64
+    State    ConntrackState
+    _        [7]byte
+}
+
+// conntrackSettings mirrors struct ct_config
+type conntrackSettings struct {
+    TimeoutNs  uint64
+    Enforce    uint32
+    ListenPort uint16
+    _          uint16
+}
+
+// Fast path directions, indexes into fastpath_stats
+const (
+    fastPathToUplink uint32 = iota
+    fastPathToTunnel
+)
+
+// fastPathTarget mirrors struct fastpath_target
+type fastPathTarget struct {
+    Ifindex   uint32
+    Direction uint32
+}
+
+// fastPathCounters mirrors struct fastpath_counters
+type fastPathCounters struct {
+    Packets uint64
+    Bytes   uint64
+    Passed  uint64
+}
+
+// FastPathDirection counts packets of one fast path direction
+type FastPathDirection struct {
+    Packets uint64 // redirected at TC
+    Bytes   uint64
+    Passed  uint64 // not established, left to the kernel path
+}
+
+// FastPathStats are the TC redirect counters summed over all CPUs
+type FastPathStats struct {
+    Enabled        bool
+    TunnelToUplink FastPathDirection
+    UplinkToTunnel FastPathDirection
+}
+
+func defaultConntrackConfig() ConntrackConfig {
+    return ConntrackConfig{
+        MaxEntries: defaultConntrackCapacity,
+        Timeout:    defaultConntrackTimeout,
+    }
+}
+
+// ErrEBPFUnsupported is wrapped when the kernel or our privileges don't
+// allow the acceleration programs; NoEBPF runs without them
+var ErrEBPFUnsupported = errors.New("eBPF acceleration not supported")
+
+// Wrap err in ErrEBPFUnsupported if the kernel refused for lack of support
+// or privileges rather than a fault of ours
+func ebpfUnsupported(err error) error {
+    if errors.Is(err, ebpf.ErrNotSupported) || errors.Is(err, os.ErrPermission) {
+        return fmt.Errorf("%w: %w", ErrEBPFUnsupported, err)
+    }
+    return err
+}
+
+// EBPFLoader loads the packet acceleration programs and attaches them to
+// the uplink, see VPNOptions
+type EBPFLoader interface {
+    Load(vpn *UnderTheRadarVPN) error
+    Attach(vpn *UnderTheRadarVPN) error
+    Detach(vpn *UnderTheRadarVPN)
+    Close(vpn *UnderTheRadarVPN)
+}
+
+// kernelEBPF loads ebpfObjectPath into the kernel
+type kernelEBPF struct{}
+
+func (kernelEBPF) Load(vpn *UnderTheRadarVPN) error {
+    // Remove memory limit for eBPF
+    if err := rlimit.RemoveMemlock(); err != nil {
+        return ebpfUnsupported(fmt.Errorf("failed to remove memlock: %w", err))
+    }
+    return vpn.loadEBPFPrograms()
+}
+
+func (kernelEBPF) Attach(vpn *UnderTheRadarVPN) error { return vpn.attachEBPF() }
+func (kernelEBPF) Detach(vpn *UnderTheRadarVPN)       { vpn.detachEBPF() }
+func (kernelEBPF) Close(vpn *UnderTheRadarVPN)        { vpn.closeEBPF() }
+
+func (kernelEBPF) AttachInterface(vpn *UnderTheRadarVPN, name string) error {
+    return vpn.attachInterfaceEBPF(name)
+}
+
+func (kernelEBPF) DetachInterface(vpn *UnderTheRadarVPN, name string) {
+    vpn.detachInterfaceEBPF(name)
+}
+
+// NoEBPF runs without acceleration, packets take the regular kernel path
+type NoEBPF struct{}
+
+func (NoEBPF) Load(*UnderTheRadarVPN) error   { return nil }
+func (NoEBPF) Attach(*UnderTheRadarVPN) error { return nil }
+func (NoEBPF) Detach(*UnderTheRadarVPN)       {}
+func (NoEBPF) Close(*UnderTheRadarVPN)        {}
+
+// VPNs assembled without a constructor run on the system clock
+func (vpn *UnderTheRadarVPN) clock() Clock {
+    return orRealClock(vpn.timeSource)
+}
+
+// VPNs assembled without a constructor use the kernel loader
+func (vpn *UnderTheRadarVPN) loader() EBPFLoader {
+    if vpn.ebpfLoader == nil {
+        return kernelEBPF{}
+    }
+    return vpn.ebpfLoader
+}
+
+// DetachEBPF takes the acceleration programs off the uplink while running,
+// so packets take the regular kernel path until AttachEBPF. Used to measure
+// what the programs cost.
+func (vpn *UnderTheRadarVPN) DetachEBPF() {
+    vpn.loader().Detach(vpn)
+}
+
+// AttachEBPF puts programs removed by DetachEBPF back on the uplink
+func (vpn *UnderTheRadarVPN) AttachEBPF() error {
+    return vpn.loader().Attach(vpn)
+}
+
+// Load eBPF programs for XDP and TC acceleration
+func (vpn *UnderTheRadarVPN) loadEBPFPrograms() error {
+    spec, err := ebpf.LoadCollectionSpec(ebpfObjectPath)
+    if err != nil {
+        return fmt.Errorf("failed to load eBPF object: %w", err)
+    }
+    
+    // Map sizes chosen by the control plane
+    if ctSpec, ok := spec.Maps["conntrack_map"]; ok {
+        ctSpec.MaxEntries = vpn.conntrack.MaxEntries
+    }
+    
+    coll, err := ebpf.NewCollection(spec)
+    if err != nil {
+        return ebpfUnsupported(fmt.Errorf("failed to create eBPF collection: %w", err))
+    }
+    
+    programs := map[string]**ebpf.Program{
+        "xdp_vpn_filter":  &vpn.xdpProgram,
+        "tc_vpn_egress":   &vpn.tcProgram,
+        "tc_vpn_ingress":  &vpn.tcIngressProgram,
+        "tc_vpn_fastpath": &vpn.tcFastPathProgram,
+        "tc_vpn_classify": &vpn.tcClassifyProgram,
+        "split_bypass":    &vpn.splitBypassProg,
+        "split_tunnel":    &vpn.splitTunnelProg,
+    }
+    for name, dst := range programs {
+        prog, ok := coll.Programs[name]
+        if !ok {
+            coll.Close()
+            return fmt.Errorf("eBPF program %s missing from %s", name, ebpfObjectPath)
+        }
+        *dst = prog
+    }
+    vpn.ebpfMaps = coll.Maps
+    
+    if err := vpn.writeDSCPPolicy(); err != nil {
+        return err
+    }
+    if err := vpn.writeSplitRules(); err != nil {
+        return err
+    }
+    vpn.writeAllowedIPSlots()
+    return vpn.writeConntrackConfig()
+}
+
+// Release programs and maps
+func (vpn *UnderTheRadarVPN) closeEBPF() {
+    for _, prog := range []*ebpf.Program{vpn.xdpProgram, vpn.tcProgram, vpn.tcIngressProgram, vpn.tcFastPathProgram, vpn.tcClassifyProgram, vpn.splitBypassProg, vpn.splitTunnelProg} {
+        if prog != nil {
+            prog.Close()
+        }
+    }
+    for _, m := range vpn.ebpfMaps {
+        m.Close()
+    }
+    
+    vpn.xdpProgram, vpn.tcProgram, vpn.tcIngressProgram, vpn.tcFastPathProgram, vpn.tcClassifyProgram = nil, nil, nil, nil, nil
+    vpn.splitBypassProg, vpn.splitTunnelProg = nil, nil
+    vpn.ebpfMaps = nil
+    vpn.allowedIPSlots = allowedIPSlots{}
+}
+
+// Attach XDP and TC programs to the uplink carrying tunnel traffic
+func (vpn *UnderTheRadarVPN) attachEBPF() error {
+    if vpn.xdpProgram == nil {
+        return nil // eBPF acceleration not loaded
+    }
+    
+    // Listen port is only known once the device exists
+    if err := vpn.writeConntrackConfig(); err != nil {
+        return err
+    }
+    if err := vpn.writeListenPorts(); err != nil {
+        return err
+    }
+    
+    ifaceName, err := defaultRouteInterface()
+    if err != nil {
+        return fmt.Errorf("failed to find uplink interface: %w", err)
+    }
+    iface, err := net.InterfaceByName(ifaceName)
+    if err != nil {
+        return fmt.Errorf("failed to look up %s: %w", ifaceName, err)
+    }
+    
+    xdpLink, err := link.AttachXDP(link.XDPOptions{
+        Program:   vpn.xdpProgram,
+        Interface: iface.Index,
+    })
+    if err != nil {
+        return ebpfUnsupported(fmt.Errorf("failed to attach XDP program: %w", err))
+    }
+    vpn.xdpLink = xdpLink
+    vpn.ebpfInterface = ifaceName
+    
+    pinDir := filepath.Join(bpffsRoot, vpn.deviceName)
+    if err := os.MkdirAll(pinDir, 0700); err != nil {
+        vpn.detachEBPF()
+        return fmt.Errorf("failed to create bpffs directory: %w", err)
+    }
+    
+    tcPrograms := []struct {
+        direction string
+        prog      *ebpf.Program
+    }{
+        {"egress", vpn.tcProgram},
+        {"ingress", vpn.tcIngressProgram},
+    }
+    
+    commands := []string{fmt.Sprintf("tc qdisc replace dev %s clsact", ifaceName)}
+    for _, tc := range tcPrograms {
+        pinPath := filepath.Join(pinDir, "tc_"+tc.direction)
+        os.Remove(pinPath)
+        if err := tc.prog.Pin(pinPath); err != nil {
+            vpn.detachEBPF()
+            return fmt.Errorf("failed to pin TC %s program: %w", tc.direction, err)
+        }
+        commands = append(commands, fmt.Sprintf("tc filter replace dev %s %s bpf direct-action pinned %s",
+            ifaceName, tc.direction, pinPath))
+    }
+    
+    for _, cmd := range commands {
+        if err := vpn.commands.Run(cmd); err != nil {
+            vpn.detachEBPF()
+            return fmt.Errorf("failed to attach TC programs: %w", err)
+        }
+    }
+    
+    if err := vpn.attachClassifier(pinDir); err != nil {
+        vpn.detachEBPF()
+        return err
+    }
+    
+    if vpn.fastPath {
+        if err := vpn.attachFastPath(iface); err != nil {
+            vpn.detachEBPF()
+            return err
+        }
+    }
+    
+    if err := vpn.attachSplitClassifier(); err != nil {
+        vpn.detachEBPF()
+        return err
+    }
+    
+    return nil
+}
+
+// Attach XDP and the TC egress and ingress programs to an interface other
+// than the uplink, see InterfaceWatcher. The fast path stays the uplink's.
+func (vpn *UnderTheRadarVPN) attachInterfaceEBPF(name string) error {
+    if vpn.xdpProgram == nil || name == vpn.ebpfInterface {
+        return nil // not loaded, or attached as the uplink
+    }
+    iface, err := net.InterfaceByName(name)
+    if err != nil {
+        return fmt.Errorf("failed to look up %s: %w", name, err)
+    }
+    
+    xdpLink, err := link.AttachXDP(link.XDPOptions{
+        Program:   vpn.xdpProgram,
+        Interface: iface.Index,
+    })
+    if err != nil {
+        return ebpfUnsupported(fmt.Errorf("failed to attach XDP program to %s: %w", name, err))
+    }
+    
+    // The uplink's pins, unless it has none yet
+    pinDir := filepath.Join(bpffsRoot, vpn.deviceName)
+    commands := []string{fmt.Sprintf("tc qdisc replace dev %s clsact", name)}
+    tcPrograms := []struct {
+        direction string
+        prog      *ebpf.Program
+    }{
+        {"egress", vpn.tcProgram},
+        {"ingress", vpn.tcIngressProgram},
+    }
+    for _, tc := range tcPrograms {
+        pinPath := filepath.Join(pinDir, "tc_"+tc.direction)
+        if _, err := os.Stat(pinPath); err != nil {
+            if err := os.MkdirAll(pinDir, 0700); err != nil {
+                xdpLink.Close()
+                return fmt.Errorf("failed to create bpffs directory: %w", err)
+            }
+            if err := tc.prog.Pin(pinPath); err != nil {
+                xdpLink.Close()
+                return fmt.Errorf("failed to pin TC %s program: %w", tc.direction, err)
+            }
+        }
+        commands = append(commands, fmt.Sprintf("tc filter replace dev %s %s bpf direct-action pinned %s",
+            name, tc.direction, pinPath))
+    }
+    for _, cmd := range commands {
+        if err := vpn.commands.Run(cmd); err != nil {
+            xdpLink.Close()
+            vpn.commands.Run(fmt.Sprintf("tc filter del dev %s egress", name))
+            vpn.commands.Run(fmt.Sprintf("tc filter del dev %s ingress", name))
+            return fmt.Errorf("failed to attach TC programs to %s: %w", name, err)
+        }
+    }
+    
+    if vpn.interfaceLinks == nil {
+        vpn.interfaceLinks = make(map[string]link.Link)
+    }
+    vpn.interfaceLinks[name] = xdpLink
+    return nil
+}
+
+// Take the programs off an interface attachInterfaceEBPF attached them to.
+// An interface that went away took its programs along.
+func (vpn *UnderTheRadarVPN) detachInterfaceEBPF(name string) {
+    xdpLink, ok := vpn.interfaceLinks[name]
+    if !ok {
+        return
+    }
+    xdpLink.Close()
+    delete(vpn.interfaceLinks, name)
+    if _, err := net.InterfaceByName(name); err == nil {
+        vpn.commands.Run(fmt.Sprintf("tc filter del dev %s egress", name))
+        vpn.commands.Run(fmt.Sprintf("tc filter del dev %s ingress", name))
+    }
+}
+
+// Attach the DSCP classifier to the tunnel's egress and the fast path
+// program to its ingress, both counting flows. The uplink egress program
+// marks what is classified, the fast path only redirects once
+// attachFastPath paired the devices.
+func (vpn *UnderTheRadarVPN) attachClassifier(pinDir string) error {
+    classifyPin := filepath.Join(pinDir, "tc_classify")
+    os.Remove(classifyPin)
+    if err := vpn.tcClassifyProgram.Pin(classifyPin); err != nil {
+        return fmt.Errorf("failed to pin TC classifier: %w", err)
+    }
+    fastPathPin := filepath.Join(pinDir, "tc_fastpath")
+    os.Remove(fastPathPin)
+    if err := vpn.tcFastPathProgram.Pin(fastPathPin); err != nil {
+        return fmt.Errorf("failed to pin TC fast path program: %w", err)
+    }
+    
+    commands := []string{
+        fmt.Sprintf("tc qdisc replace dev %s clsact", vpn.deviceName),
+        fmt.Sprintf("tc filter replace dev %s egress bpf direct-action pinned %s", vpn.deviceName, classifyPin),
+        fmt.Sprintf("tc filter replace dev %s ingress bpf direct-action pinned %s", vpn.deviceName, fastPathPin),
+    }
+    for _, cmd := range commands {
+        if err := vpn.commands.Run(cmd); err != nil {
+            return fmt.Errorf("failed to attach TC classifier: %w", err)
+        }
+    }
+    vpn.classifyDevice = vpn.deviceName
+    return nil
+}
+
+// Pair the tunnel with the uplink in the redirect map. The programs on
+// both sides are attached already.
+func (vpn *UnderTheRadarVPN) attachFastPath(uplink *net.Interface) error {
+    m, ok := vpn.ebpfMaps["fastpath_redirect"]
+    if !ok {
+        return fmt.Errorf("eBPF map fastpath_redirect missing from %s", ebpfObjectPath)
+    }
+    tunnel, err := net.InterfaceByName(vpn.deviceName)
+    if err != nil {
+        return fmt.Errorf("failed to look up %s: %w", vpn.deviceName, err)
+    }
+    
+    // The tunnel entry is what detachEBPF looks for, add it last
+    pairs := []struct {
+        from uint32
+        to   fastPathTarget
+    }{
+        {uint32(uplink.Index), fastPathTarget{Ifindex: uint32(tunnel.Index), Direction: fastPathToTunnel}},
+        {uint32(tunnel.Index), fastPathTarget{Ifindex: uint32(uplink.Index), Direction: fastPathToUplink}},
+    }
+    for _, p := range pairs {
+        if err := m.Put(p.from, p.to); err != nil {
+            return fmt.Errorf("failed to update fast path redirect map: %w", err)
+        }
+    }
+    vpn.fastPathDevice = vpn.deviceName
+    return nil
+}
+
+// FastPathStats returns the TC redirect counters
+func (vpn *UnderTheRadarVPN) FastPathStats() (FastPathStats, error) {
+    stats := FastPathStats{Enabled: vpn.fastPathDevice != ""}
+    m, ok := vpn.ebpfMaps["fastpath_stats"]
+    if !ok {
+        return stats, nil
+    }
+    
+    for direction, dst := range map[uint32]*FastPathDirection{
+        fastPathToUplink: &stats.TunnelToUplink,
+        fastPathToTunnel: &stats.UplinkToTunnel,
+    } {
+        var perCPU []fastPathCounters
+        if err := m.Lookup(direction, &perCPU); err != nil {
+            return stats, fmt.Errorf("failed to read fast path counters: %w", err)
+        }
+        for _, c := range perCPU {
+            dst.Packets += c.Packets
+            dst.Bytes += c.Bytes
+            dst.Passed += c.Passed
+        }
+    }
+    return stats, nil
+}
+
+// Detach programs from the uplink, leaving them loaded
+func (vpn *UnderTheRadarVPN) detachEBPF() {
+    if vpn.xdpLink != nil {
+        vpn.xdpLink.Close()
+        vpn.xdpLink = nil
+    }
+    
+    if vpn.ebpfInterface != "" {
+        vpn.commands.Run(fmt.Sprintf("tc filter del dev %s egress", vpn.ebpfInterface))
+        vpn.commands.Run(fmt.Sprintf("tc filter del dev %s ingress", vpn.ebpfInterface))
+        vpn.ebpfInterface = ""
+    }
+    
+    if vpn.splitTunnel != nil {
+        vpn.splitTunnel.detachClassifier()
+    }
+    
+    // Stop redirecting before the filters go, packets fall back to the
+    // kernel path
+    if vpn.fastPathDevice != "" {
+        if m, ok := vpn.ebpfMaps["fastpath_redirect"]; ok {
+            var keys []uint32
+            var from uint32
+            var to fastPathTarget
+            for iter := m.Iterate(); iter.Next(&from, &to); {
+                keys = append(keys, from)
+            }
+            for _, key := range keys {
+                m.Delete(key)
+            }
+        }
+        vpn.fastPathDevice = ""
+    }
+    
+    if vpn.classifyDevice != "" {
+        vpn.commands.Run(fmt.Sprintf("tc filter del dev %s egress", vpn.classifyDevice))
+        vpn.commands.Run(fmt.Sprintf("tc filter del dev %s ingress", vpn.classifyDevice))
+        vpn.classifyDevice = ""
+    }
+    
+    os.RemoveAll(filepath.Join(bpffsRoot, vpn.deviceName))
+}
+
+// ConfigureConntrack changes the TC conntrack settings. The timeout and
+// enforcement apply immediately; a different capacity reloads the eBPF
+// programs and is therefore only possible before Start.
+func (vpn *UnderTheRadarVPN) ConfigureConntrack(cfg ConntrackConfig) error {
+    if cfg.MaxEntries == 0 {
+        cfg.MaxEntries = defaultConntrackCapacity
+    }
+    if cfg.Timeout <= 0 {
+        cfg.Timeout = defaultConntrackTimeout
+    }
+    
+    vpn.mu.Lock()
+    defer vpn.mu.Unlock()
+    
+    resize := cfg.MaxEntries != vpn.conntrack.MaxEntries
+    vpn.conntrack = cfg
+    
+    if !resize || vpn.xdpProgram == nil {
+        return vpn.writeConntrackConfig()
+    }
+    if vpn.xdpLink != nil {
+        return fmt.Errorf("conntrack capacity can only be changed before Start")
+    }
+    
+    vpn.loader().Close(vpn)
+    return vpn.loader().Load(vpn)
+}
+
+// Push the conntrack settings into the shared config map
+func (vpn *UnderTheRadarVPN) writeConntrackConfig() error {
+    m, ok := vpn.ebpfMaps["conntrack_config"]
+    if !ok {
+        return nil
+    }
+    
+    settings := conntrackSettings{
+        TimeoutNs:  uint64(vpn.conntrack.Timeout.Nanoseconds()),
+        ListenPort: uint16(vpn.listenPort),
+    }
+    if vpn.conntrack.Enforce {
+        settings.Enforce = 1
+    }
+    
+    if err := m.Put(uint32(0), settings); err != nil {
+        return fmt.Errorf("failed to update conntrack config: %w", err)
+    }
+    return nil
+}
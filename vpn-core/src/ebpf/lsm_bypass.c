@@ -0,0 +1,113 @@
+/* SPDX-License-Identifier: GPL-2.0 */
+/* Per-process control over leaving the tunnel while the kill switch is on.
+ *
+ * sock_vpn_bypass, on the root cgroup, marks every socket a process named in
+ * bypass_processes creates with bypass_mark; the daemon routes that mark to
+ * the main table ahead of the tunnel and the kill switch accepts it, so
+ * listed processes (backups, monitoring agents) go direct.
+ *
+ * The kill switch also lets root through, so other privileged processes
+ * could escape the tunnel by binding their socket to the uplink or marking
+ * it themselves. lsm_vpn_bypass refuses such connects with -EPERM unless the
+ * process is listed or is the daemon, whose probes, DoH and TURN sockets
+ * carry its FirewallMark or are bound to BindInterface on purpose.
+ *
+ * Needs a kernel booted with lsm=...,bpf and BTF, build with
+ *   bpftool btf dump file /sys/kernel/btf/vmlinux format c > ebpf/vmlinux.h
+ *   clang -O2 -g -target bpf -c ebpf/lsm_bypass.c -o ebpf/lsm_bypass.o
+ * The socket program needs cgroup v2 and bpf_get_current_comm for cgroup
+ * programs, Linux 6.1 or later.
+ */
+#include "vmlinux.h"
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include <bpf/bpf_core_read.h>
+
+#define EPERM 1
+#define AF_INET 2
+#define AF_INET6 10
+#define TASK_COMM_LEN 16
+#define MAX_BYPASS_PROCESSES 1024
+
+/* Keyed on task->comm, NUL padded */
+struct bypass_key {
+    char comm[TASK_COMM_LEN];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_BYPASS_PROCESSES);
+    __type(key, struct bypass_key);
+    __type(value, __u8);
+} bypass_processes SEC(".maps");
+
+struct bypass_config {
+    __u32 enforce;         /* 0 = allow every connect, set while the kill switch is on */
+    __u32 tunnel_ifindex;  /* sockets bound here stay in the tunnel */
+    __u32 bypass_mark;     /* set on the sockets of listed processes */
+    __u32 daemon_tgid;     /* the daemon, in the root pid namespace */
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct bypass_config);
+} bypass_config SEC(".maps");
+
+static __always_inline int listed(void)
+{
+    struct bypass_key key = {};
+    bpf_get_current_comm(&key.comm, sizeof(key.comm));
+    return bpf_map_lookup_elem(&bypass_processes, &key) != NULL;
+}
+
+SEC("cgroup/sock_create")
+int sock_vpn_bypass(struct bpf_sock *ctx)
+{
+    __u32 zero = 0;
+    struct bypass_config *cfg = bpf_map_lookup_elem(&bypass_config, &zero);
+    if (!cfg || !cfg->enforce)
+        return 1;
+
+    if (ctx->family != AF_INET && ctx->family != AF_INET6)
+        return 1;
+
+    /* Routed around the tunnel from the first packet on */
+    if (listed())
+        ctx->mark = cfg->bypass_mark;
+    return 1;
+}
+
+SEC("lsm/socket_connect")
+int BPF_PROG(lsm_vpn_bypass, struct socket *sock, struct sockaddr *address, int addrlen, int ret)
+{
+    /* Another LSM already refused */
+    if (ret != 0)
+        return ret;
+
+    __u32 zero = 0;
+    struct bypass_config *cfg = bpf_map_lookup_elem(&bypass_config, &zero);
+    if (!cfg || !cfg->enforce)
+        return 0;
+
+    __u16 family = BPF_CORE_READ(address, sa_family);
+    if (family != AF_INET && family != AF_INET6)
+        return 0;
+
+    /* Unbound and unmarked sockets follow the routing table into the tunnel */
+    struct sock *sk = BPF_CORE_READ(sock, sk);
+    int bound = BPF_CORE_READ(sk, __sk_common.skc_bound_dev_if);
+    __u32 mark = BPF_CORE_READ(sk, sk_mark);
+    if ((bound == 0 || bound == cfg->tunnel_ifindex) && mark == 0)
+        return 0;
+
+    if (bpf_get_current_pid_tgid() >> 32 == cfg->daemon_tgid)
+        return 0;
+    if (listed())
+        return 0;
+
+    return -EPERM;
+}
+
+char _license[] SEC("license") = "GPL";
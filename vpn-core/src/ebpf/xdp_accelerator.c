@@ -1,4 +1,5 @@
 /* SPDX-License-Identifier: GPL-2.0 */
+#include <stddef.h>
 #include <linux/bpf.h>
 #include <linux/if_ether.h>
 #include <linux/ip.h>
@@ -97,6 +98,460 @@ struct rate_limit {
     __u64 last_update;
 };
 
+/* Reasons the programs drop a packet for, counted per device and peer in
+ * drop_reasons instead of dropping silently. The peer is identified by the
+ * outer source address for packets from its endpoint, and by the address on
+ * the tunnel side for the packets it exchanges, see GetDropReasons.
+ */
+#define DROP_MTU_EXCEEDED 1
+#define DROP_RATE_LIMITED 2
+#define DROP_NO_ROUTE 3
+#define DROP_REPLAY_WINDOW 4
+#define DROP_CONNTRACK_INVALID 5
+
+struct drop_key {
+    __u32 ifindex;       /* device the packet was dropped on */
+    __be32 peer_ip;
+    __u32 reason;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_HASH);
+    __uint(max_entries, 16384);
+    __type(key, struct drop_key);
+    __type(value, __u64);
+} drop_reasons SEC(".maps");
+
+/* Highest WireGuard counter seen per receiver index. Data packets older
+ * than the window are replays WireGuard would reject after decrypting.
+ */
+#define REPLAY_WINDOW_SIZE 8128  /* COUNTER_WINDOW_SIZE of 64 bit kernels */
+
+struct replay_key {
+    __be32 peer_ip;
+    __u32 receiver;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, MAX_PEERS);
+    __type(key, struct replay_key);
+    __type(value, __u64);
+} replay_window SEC(".maps");
+
+static __always_inline void count_drop(__u32 ifindex, __be32 peer_ip, __u32 reason)
+{
+    struct drop_key key = {
+        .ifindex = ifindex,
+        .peer_ip = peer_ip,
+        .reason = reason,
+    };
+    __u64 one = 1, *count;
+    
+    count = bpf_map_lookup_elem(&drop_reasons, &key);
+    if (count) {
+        (*count)++;
+        return;
+    }
+    bpf_map_update_elem(&drop_reasons, &key, &one, BPF_NOEXIST);
+}
+
+/* Whether a data packet's counter is still inside the replay window */
+static __always_inline bool check_replay(__be32 peer_ip, struct wireguard_header *wg)
+{
+    struct replay_key key = {
+        .peer_ip = peer_ip,
+        .receiver = wg->sender,
+    };
+    __u64 counter = wg->counter;  /* little endian on the wire, as bpfel */
+    __u64 *highest;
+    
+    highest = bpf_map_lookup_elem(&replay_window, &key);
+    if (!highest) {
+        bpf_map_update_elem(&replay_window, &key, &counter, BPF_ANY);
+        return true;
+    }
+    if (counter + REPLAY_WINDOW_SIZE < *highest)
+        return false;
+    if (counter > *highest)
+        *highest = counter;
+    return true;
+}
+
+/* Stateful connection tracking for the TC programs.
+ * Egress records outbound flows, ingress only admits packets that belong
+ * to a tracked flow. Capacity and timeout are set from the control plane.
+ */
+#define CT_STATE_NEW 1
+#define CT_STATE_ESTABLISHED 2
+#define CT_STATE_FIN_WAIT 3
+
+#define CT_TCP_SYN 0x01
+#define CT_TCP_ACK 0x02
+#define CT_TCP_FIN 0x04
+#define CT_TCP_RST 0x08
+
+/* Keyed in the outbound direction: local address is always src */
+struct ct_key {
+    __be32 src_ip;
+    __be32 dst_ip;
+    __be16 src_port;
+    __be16 dst_port;
+    __u8 protocol;
+} __attribute__((packed));
+
+struct ct_entry {
+    __u64 last_seen;
+    __u8 state;
+    __u8 pad[7];
+};
+
+struct ct_config {
+    __u64 timeout_ns;
+    __u32 enforce;       /* 0 = track only, 1 = drop unsolicited inbound */
+    __u16 listen_port;   /* WireGuard port, always admitted */
+    __u16 pad;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 65536);  /* Overridden at load time */
+    __type(key, struct ct_key);
+    __type(value, struct ct_entry);
+} conntrack_map SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct ct_config);
+} conntrack_config SEC(".maps");
+
+/* Traffic of each IPv4 flow through the tunnel, for TopFlows. Keyed like
+ * the fast path conntrack with the far side of the tunnel as source, so
+ * both directions of a flow share one entry.
+ */
+#define FLOW_STATS_MAX 65536
+
+struct flow_counters {
+    __u64 rx_bytes;      /* received from the tunnel */
+    __u64 tx_bytes;      /* sent into the tunnel */
+    __u64 packets;
+    __u64 last_seen_ns;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, FLOW_STATS_MAX);
+    __type(key, struct ct_key);
+    __type(value, struct flow_counters);
+} flow_stats SEC(".maps");
+
+static __always_inline void count_flow(struct ct_key *key, __u32 len, bool rx)
+{
+    struct flow_counters *fc = bpf_map_lookup_elem(&flow_stats, key);
+    
+    if (!fc) {
+        struct flow_counters fresh = {};
+        bpf_map_update_elem(&flow_stats, key, &fresh, BPF_NOEXIST);
+        fc = bpf_map_lookup_elem(&flow_stats, key);
+        if (!fc)
+            return;
+    }
+    
+    if (rx)
+        __sync_fetch_and_add(&fc->rx_bytes, len);
+    else
+        __sync_fetch_and_add(&fc->tx_bytes, len);
+    __sync_fetch_and_add(&fc->packets, 1);
+    fc->last_seen_ns = bpf_ktime_get_ns();
+}
+
+/* TC fast path between the WireGuard device and the uplink.
+ * Established flows arriving on one side are redirected straight to the
+ * other, skipping netfilter and the routing lookup. bpf_redirect_map() is
+ * XDP-only, so TC looks the pair up here and uses bpf_redirect*().
+ */
+#define FASTPATH_TO_UPLINK 0
+#define FASTPATH_TO_TUNNEL 1
+
+struct fastpath_target {
+    __u32 ifindex;       /* device to redirect to */
+    __u32 direction;     /* FASTPATH_TO_UPLINK or FASTPATH_TO_TUNNEL */
+};
+
+struct fastpath_counters {
+    __u64 packets;       /* redirected */
+    __u64 bytes;
+    __u64 passed;        /* left to the kernel path */
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 16);
+    __type(key, __u32);  /* ingress ifindex */
+    __type(value, struct fastpath_target);
+} fastpath_redirect SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 2);
+    __type(key, __u32);  /* direction */
+    __type(value, struct fastpath_counters);
+} fastpath_stats SEC(".maps");
+
+/* DSCP classification of tunneled traffic.
+ * The classifier on the tunnel's egress matches the plaintext packet
+ * against dscp_rules, first match wins, and leaves the outer DSCP in
+ * skb->priority, which survives encryption. The uplink egress program
+ * writes it into the header of the encrypted packet.
+ */
+#define DSCP_MAX_RULES 32
+#define DSCP_UNCLASSIFIED DSCP_MAX_RULES  /* counters of unmatched packets */
+#define DSCP_COPY_INNER 0xff
+#define DSCP_PRIO_MAGIC 0x55440000        /* skb->priority major carrying a DSCP */
+#define DSCP_PRIO_MASK 0xffff0000
+
+struct dscp_rule {
+    __u8 match_dscp;     /* 1 = inner_dscp must match */
+    __u8 inner_dscp;
+    __u8 protocol;       /* 0 = any */
+    __u8 outer_dscp;     /* DSCP_COPY_INNER keeps the inner value */
+    __u16 port_min;      /* inner destination ports, host order, 0 = any */
+    __u16 port_max;
+};
+
+struct dscp_config {
+    __u32 rule_count;
+};
+
+struct dscp_counters {
+    __u64 packets;
+    __u64 bytes;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, DSCP_MAX_RULES);
+    __type(key, __u32);
+    __type(value, struct dscp_rule);
+} dscp_rules SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct dscp_config);
+} dscp_config SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, DSCP_MAX_RULES + 1);
+    __type(key, __u32);  /* rule index, DSCP_UNCLASSIFIED */
+    __type(value, struct dscp_counters);
+} dscp_stats SEC(".maps");
+
+/* Traffic per allowed IP, for attributing what each peer's prefixes
+ * carried. The classifier looks the plaintext destination up in
+ * allowedip_prefixes, IPv4 mapped into IPv6, and counts into the slot the
+ * control plane assigned to the prefix and the peer owning it.
+ */
+#define ALLOWEDIP_MAX_SLOTS 65536
+
+struct allowedip_key {
+    __u32 prefixlen;     /* of the mapped address, IPv4 lengths + 96 */
+    __u8 addr[16];
+};
+
+struct allowedip_counters {
+    __u64 packets;
+    __u64 bytes;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __uint(max_entries, ALLOWEDIP_MAX_SLOTS);
+    __type(key, struct allowedip_key);
+    __type(value, __u32);  /* slot */
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+} allowedip_prefixes SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, ALLOWEDIP_MAX_SLOTS);
+    __type(key, __u32);  /* slot */
+    __type(value, struct allowedip_counters);
+} allowedip_stats SEC(".maps");
+
+static __always_inline void count_allowed_ip(struct allowedip_key *key, __u32 len)
+{
+    struct allowedip_counters *counters;
+    __u32 *slot;
+    
+    slot = bpf_map_lookup_elem(&allowedip_prefixes, key);
+    if (!slot)
+        return;
+    counters = bpf_map_lookup_elem(&allowedip_stats, slot);
+    if (counters) {
+        counters->packets++;
+        counters->bytes += len;
+    }
+}
+
+/* Split tunneling by protocol.
+ * Socket filter programs matched from iptables (-m bpf) against the first
+ * packet of each connection. The mark the matching rule sets is saved in
+ * the connection and restored for its other packets, so the rules run once
+ * per flow. Only port range and DSCP classifiers are compiled to rules,
+ * see classifier.go.
+ */
+#define SPLIT_MAX_RULES 32
+#define SPLIT_TUNNEL 1
+#define SPLIT_BYPASS 2
+#define SPLIT_MATCH_PORTS 1
+#define SPLIT_MATCH_DSCP 2
+
+struct split_rule {
+    __u8 kind;           /* SPLIT_MATCH_PORTS or SPLIT_MATCH_DSCP */
+    __u8 protocol;       /* 0 = any */
+    __u8 dscp;
+    __u8 decision;       /* SPLIT_TUNNEL or SPLIT_BYPASS */
+    __u16 port_min;      /* destination ports, host order */
+    __u16 port_max;
+};
+
+struct split_config {
+    __u32 rule_count;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, SPLIT_MAX_RULES);
+    __type(key, __u32);
+    __type(value, struct split_rule);
+} split_rules SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct split_config);
+} split_config SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, SPLIT_MAX_RULES);
+    __type(key, __u32);  /* rule index */
+    __type(value, __u64); /* flows matched */
+} split_stats SEC(".maps");
+
+/* Extra listen ports, see VPNConfig.ListenPorts. XDP moves IPv4 packets
+ * arriving on one to the device's port after RSS spread them over the RX
+ * queues by port, and the uplink egress program sends the replies from the
+ * port the client used, so it keeps using it.
+ */
+#define LISTEN_PORTS_MAX 64
+#define PORT_STEER_MAX 65536
+
+struct steer_key {
+    __be32 addr;
+    __be16 port;
+    __u16 pad;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, LISTEN_PORTS_MAX);
+    __type(key, __be16);
+    __type(value, __u8);
+} listen_ports SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, PORT_STEER_MAX);
+    __type(key, struct steer_key);  /* client */
+    __type(value, __be16);          /* listen port it sent to */
+} port_steer SEC(".maps");
+
+/* Incremental checksum update for one 16 bit word, RFC 1624 */
+static __always_inline __sum16 csum_replace2(__sum16 check, __be16 from, __be16 to)
+{
+    __u32 sum = (__u16)~check + (__u16)~from + (__u16)to;
+    
+    sum = (sum & 0xffff) + (sum >> 16);
+    sum = (sum & 0xffff) + (sum >> 16);
+    return (__sum16)~sum;
+}
+
+static __always_inline void steer_listen_port(struct iphdr *ip, struct udphdr *udp)
+{
+    struct ct_config *cfg;
+    __u32 cfg_key = 0;
+    __be16 to;
+    
+    if (!bpf_map_lookup_elem(&listen_ports, &udp->dest))
+        return;
+    cfg = bpf_map_lookup_elem(&conntrack_config, &cfg_key);
+    if (!cfg || !cfg->listen_port)
+        return;
+    
+    struct steer_key key = { .addr = ip->saddr, .port = udp->source };
+    bpf_map_update_elem(&port_steer, &key, &udp->dest, BPF_ANY);
+    
+    to = bpf_htons(cfg->listen_port);
+    if (udp->check)  /* zero means no checksum over IPv4 */
+        udp->check = csum_replace2(udp->check, udp->dest, to);
+    udp->dest = to;
+}
+
+/* Reply from the port the client sent to. The helpers that rewrite the
+ * packet invalidate ip and udp, so everything needed from the headers is
+ * read before the first call; the caller must reload packet pointers after.
+ */
+static __always_inline void unsteer_listen_port(struct __sk_buff *skb, struct iphdr *ip,
+                                                struct udphdr *udp)
+{
+    struct ct_config *cfg;
+    __u32 cfg_key = 0;
+    __u32 l4_off = ETH_HLEN + ip->ihl * 4;
+    __be16 *from, old_port = udp->source, new_port;
+    struct steer_key key = { .addr = ip->daddr, .port = udp->dest };
+    
+    cfg = bpf_map_lookup_elem(&conntrack_config, &cfg_key);
+    if (!cfg || old_port != bpf_htons(cfg->listen_port))
+        return;
+    
+    from = bpf_map_lookup_elem(&port_steer, &key);
+    if (!from)
+        return;
+    
+    new_port = *from;
+    bpf_l4_csum_replace(skb, l4_off + offsetof(struct udphdr, check),
+                        old_port, new_port, BPF_F_MARK_MANGLED_0 | 2);
+    bpf_skb_store_bytes(skb, l4_off + offsetof(struct udphdr, source),
+                        &new_port, sizeof(new_port), 0);
+}
+
+/* Packet pointers must be reloaded after */
+static __always_inline void unsteer_reply(struct __sk_buff *skb)
+{
+    void *data = (void *)(long)skb->data;
+    void *data_end = (void *)(long)skb->data_end;
+    struct ethhdr *eth = data;
+    struct iphdr *ip;
+    struct udphdr *udp;
+    
+    if ((void *)(eth + 1) > data_end || eth->h_proto != bpf_htons(ETH_P_IP))
+        return;
+    ip = (struct iphdr *)(eth + 1);
+    if ((void *)(ip + 1) > data_end || ip->protocol != IPPROTO_UDP)
+        return;
+    udp = (struct udphdr *)((void *)ip + ip->ihl * 4);
+    if ((void *)(udp + 1) > data_end)
+        return;
+    unsteer_listen_port(skb, ip, udp);
+}
+
 /* XDP program for ultra-fast packet filtering and acceleration */
 SEC("xdp/undertheradar_vpn")
 int xdp_vpn_filter(struct xdp_md *ctx)
@@ -135,6 +590,8 @@ int xdp_vpn_filter(struct xdp_md *ctx)
         if ((void *)(udp + 1) > data_end)
             return XDP_DROP;
         
+        steer_listen_port(ip, udp);
+        
         /* Check if it's WireGuard traffic */
         if (udp->dest == bpf_htons(WIREGUARD_PORT)) {
             wg = (struct wireguard_header *)(udp + 1);
@@ -145,11 +602,19 @@ int xdp_vpn_filter(struct xdp_md *ctx)
             if (!check_rate_limit(ip->saddr)) {
                 if (stats)
                     __sync_fetch_and_add(&stats->dropped_packets, 1);
+                count_drop(ctx->ingress_ifindex, ip->saddr, DROP_RATE_LIMITED);
                 return XDP_DROP;
             }
             
             /* Fast path for data packets */
             if (wg->type == WIREGUARD_MESSAGE_DATA) {
+                if (!check_replay(ip->saddr, wg)) {
+                    if (stats)
+                        __sync_fetch_and_add(&stats->dropped_packets, 1);
+                    count_drop(ctx->ingress_ifindex, ip->saddr, DROP_REPLAY_WINDOW);
+                    return XDP_DROP;
+                }
+                
                 /* Validate sender and update flow state */
                 struct flow_key flow = {
                     .src_ip = ip->saddr,
@@ -250,14 +715,252 @@ static __always_inline bool is_ddos_pattern(struct iphdr *ip, void *data_end)
     return false;
 }
 
+/* Extract the flow key of an IPv4 TCP/UDP packet. With reverse set the key
+ * is built from the receiver's point of view so inbound packets match the
+ * entry created by the outbound direction.
+ */
+static __always_inline int ct_parse_ip(struct iphdr *ip, void *data_end, bool reverse,
+                                       struct ct_key *key, __u8 *flags)
+{
+    __be16 sport, dport;
+    
+    *flags = 0;
+    
+    if ((void *)(ip + 1) > data_end)
+        return -1;
+    if (ip->version != 4)
+        return -1;
+    
+    if (ip->protocol == IPPROTO_TCP) {
+        struct tcphdr *tcp = (struct tcphdr *)((void *)ip + ip->ihl * 4);
+        if ((void *)(tcp + 1) > data_end)
+            return -1;
+        sport = tcp->source;
+        dport = tcp->dest;
+        if (tcp->syn)
+            *flags |= CT_TCP_SYN;
+        if (tcp->ack)
+            *flags |= CT_TCP_ACK;
+        if (tcp->fin)
+            *flags |= CT_TCP_FIN;
+        if (tcp->rst)
+            *flags |= CT_TCP_RST;
+    } else if (ip->protocol == IPPROTO_UDP) {
+        struct udphdr *udp = (struct udphdr *)((void *)ip + ip->ihl * 4);
+        if ((void *)(udp + 1) > data_end)
+            return -1;
+        sport = udp->source;
+        dport = udp->dest;
+    } else {
+        return -1;
+    }
+    
+    key->protocol = ip->protocol;
+    if (reverse) {
+        key->src_ip = ip->daddr;
+        key->dst_ip = ip->saddr;
+        key->src_port = dport;
+        key->dst_port = sport;
+    } else {
+        key->src_ip = ip->saddr;
+        key->dst_ip = ip->daddr;
+        key->src_port = sport;
+        key->dst_port = dport;
+    }
+    
+    return 0;
+}
+
+static __always_inline int ct_parse(void *data, void *data_end, bool reverse,
+                                    struct ct_key *key, __u8 *flags)
+{
+    struct ethhdr *eth = data;
+    
+    if ((void *)(eth + 1) > data_end)
+        return -1;
+    if (eth->h_proto != bpf_htons(ETH_P_IP))
+        return -1;
+    
+    return ct_parse_ip((struct iphdr *)(eth + 1), data_end, reverse, key, flags);
+}
+
+/* Record an outbound packet in the conntrack map */
+static __always_inline void ct_track_outbound(struct ct_key *key, __u8 flags)
+{
+    __u64 now = bpf_ktime_get_ns();
+    struct ct_entry *ct = bpf_map_lookup_elem(&conntrack_map, key);
+    
+    if (!ct) {
+        struct ct_entry entry = {
+            .last_seen = now,
+            .state = CT_STATE_ESTABLISHED,
+        };
+        
+        /* TCP flows wait for the SYN-ACK before becoming established */
+        if (key->protocol == IPPROTO_TCP &&
+            (flags & CT_TCP_SYN) && !(flags & CT_TCP_ACK))
+            entry.state = CT_STATE_NEW;
+        
+        bpf_map_update_elem(&conntrack_map, key, &entry, BPF_ANY);
+        return;
+    }
+    
+    ct->last_seen = now;
+    if (flags & (CT_TCP_FIN | CT_TCP_RST))
+        ct->state = CT_STATE_FIN_WAIT;
+}
+
+#ifndef AF_INET
+#define AF_INET 2
+#endif
+
+/* Reason the paired device would drop a redirected packet for, 0 if it
+ * takes it. The kernel drops those after the redirect without a trace.
+ */
+static __always_inline __u32 fastpath_check(struct __sk_buff *skb, struct fastpath_target *target,
+                                            struct ct_key *key)
+{
+    struct bpf_fib_lookup fib = {};
+    __u32 mtu = 0;
+    __s32 len_diff = 0;
+    
+    /* Redirecting to the tunnel drops the MAC header */
+    if (target->direction == FASTPATH_TO_TUNNEL)
+        len_diff = -ETH_HLEN;
+    if (bpf_check_mtu(skb, target->ifindex, &mtu, len_diff, 0) != BPF_MTU_CHK_RET_SUCCESS)
+        return DROP_MTU_EXCEEDED;
+    
+    if (target->direction != FASTPATH_TO_UPLINK)
+        return 0;
+    
+    /* Packets from the tunnel are keyed as sent, dst is the destination */
+    fib.family = AF_INET;
+    fib.ifindex = target->ifindex;
+    fib.ipv4_dst = key->dst_ip;
+    switch (bpf_fib_lookup(skb, &fib, sizeof(fib), BPF_FIB_LOOKUP_OUTPUT)) {
+    case BPF_FIB_LKUP_RET_BLACKHOLE:
+    case BPF_FIB_LKUP_RET_UNREACHABLE:
+    case BPF_FIB_LKUP_RET_PROHIBIT:
+    case BPF_FIB_LKUP_RET_NOT_FWDED:
+        return DROP_NO_ROUTE;
+    case BPF_FIB_LKUP_RET_FRAG_NEEDED:
+        return DROP_MTU_EXCEEDED;
+    }
+    return 0;
+}
+
+/* Redirect an established flow to the paired device, or leave it to the
+ * kernel. key is in the outbound direction like the conntrack map, so its
+ * source is the tunnel side the drops are counted for.
+ */
+static __always_inline int fastpath_forward(struct __sk_buff *skb, struct ct_key *key,
+                                            __u16 listen_port)
+{
+    struct fastpath_target *target;
+    struct fastpath_counters *counters;
+    struct ct_entry *ct;
+    __u32 ifindex = skb->ifindex;
+    __u32 reason;
+    
+    target = bpf_map_lookup_elem(&fastpath_redirect, &ifindex);
+    if (!target)
+        return TC_ACT_OK;
+    
+    counters = bpf_map_lookup_elem(&fastpath_stats, &target->direction);
+    if (!counters)
+        return TC_ACT_OK;
+    
+    /* WireGuard's own packets must reach the device to be decrypted */
+    ct = bpf_map_lookup_elem(&conntrack_map, key);
+    if (!ct || ct->state != CT_STATE_ESTABLISHED ||
+        (key->protocol == IPPROTO_UDP && bpf_ntohs(key->src_port) == listen_port)) {
+        counters->passed++;
+        return TC_ACT_OK;
+    }
+    
+    reason = fastpath_check(skb, target, key);
+    if (reason) {
+        count_drop(ifindex, key->src_ip, reason);
+        return TC_ACT_SHOT;
+    }
+    
+    counters->packets++;
+    counters->bytes += skb->len;
+    
+    /* The tunnel has no link layer, the uplink needs one from the
+     * neighbour table. Redirecting to the tunnel drops the MAC header. */
+    if (target->direction == FASTPATH_TO_UPLINK)
+        return bpf_redirect_neigh(target->ifindex, NULL, 0, 0);
+    return bpf_redirect(target->ifindex, 0);
+}
+
+/* Write the DSCP chosen by tc_vpn_classify into the outer header. Returns
+ * 1 when the packet was marked, packet pointers must be reloaded after.
+ */
+static __always_inline int dscp_mark_outer(struct __sk_buff *skb)
+{
+    void *data = (void *)(long)skb->data;
+    void *data_end = (void *)(long)skb->data_end;
+    struct ethhdr *eth = data;
+    __u8 dscp;
+    
+    if ((skb->priority & DSCP_PRIO_MASK) != DSCP_PRIO_MAGIC)
+        return 0;
+    dscp = skb->priority & 0x3f;
+    skb->priority = 0;
+    
+    if ((void *)(eth + 1) > data_end)
+        return 0;
+    
+    if (eth->h_proto == bpf_htons(ETH_P_IP)) {
+        struct iphdr *ip = (struct iphdr *)(eth + 1);
+        __be16 old_word, new_word;
+        
+        if ((void *)(ip + 1) > data_end)
+            return 0;
+        
+        /* ECN bits stay as the kernel set them */
+        old_word = *(__be16 *)ip;
+        ip->tos = (dscp << 2) | (ip->tos & 0x03);
+        new_word = *(__be16 *)ip;
+        bpf_l3_csum_replace(skb, ETH_HLEN + offsetof(struct iphdr, check),
+                            old_word, new_word, 2);
+        return 1;
+    }
+    
+    if (eth->h_proto == bpf_htons(ETH_P_IPV6)) {
+        __be32 *first = (__be32 *)(eth + 1);
+        __u32 word;
+        
+        if ((void *)(first + 1) > data_end)
+            return 0;
+        
+        /* Traffic class sits between version and flow label, no checksum */
+        word = bpf_ntohl(*first);
+        word = (word & ~(0xfcU << 20)) | ((__u32)dscp << 22);
+        *first = bpf_htonl(word);
+        return 1;
+    }
+    
+    return 0;
+}
+
 /* TC egress program for packet manipulation and QoS */
 SEC("tc/undertheradar_egress")
 int tc_vpn_egress(struct __sk_buff *skb)
 {
     void *data = (void *)(long)skb->data;
     void *data_end = (void *)(long)skb->data_end;
-    struct ethhdr *eth = data;
+    struct ethhdr *eth;
     struct iphdr *ip;
+    int classified;
+    
+    /* Tunnel packets carry the DSCP of their inner class */
+    classified = dscp_mark_outer(skb);
+    unsteer_reply(skb);
+    data = (void *)(long)skb->data;
+    data_end = (void *)(long)skb->data_end;
+    eth = data;
     
     if ((void *)(eth + 1) > data_end)
         return TC_ACT_OK;
@@ -270,7 +973,7 @@ int tc_vpn_egress(struct __sk_buff *skb)
         return TC_ACT_OK;
     
     /* Apply DSCP marking for QoS */
-    if (ip->protocol == IPPROTO_UDP) {
+    if (!classified && ip->protocol == IPPROTO_UDP) {
         struct udphdr *udp = (struct udphdr *)((void *)ip + ip->ihl * 4);
         if ((void *)(udp + 1) <= data_end) {
             /* VoIP traffic gets highest priority */
@@ -288,6 +991,12 @@ int tc_vpn_egress(struct __sk_buff *skb)
         }
     }
     
+    /* Track outbound flows so their replies are admitted on ingress */
+    struct ct_key ct = {};
+    __u8 ct_flags;
+    if (ct_parse(data, data_end, false, &ct, &ct_flags) == 0)
+        ct_track_outbound(&ct, ct_flags);
+    
     /* Implement packet pacing for better throughput */
     __u64 now = bpf_ktime_get_ns();
     __u64 delay = calculate_pacing_delay(skb->len);
@@ -298,6 +1007,276 @@ int tc_vpn_egress(struct __sk_buff *skb)
     return TC_ACT_OK;
 }
 
+/* TC ingress program: stateful filter admitting only tracked flows */
+SEC("tc/undertheradar_ingress")
+int tc_vpn_ingress(struct __sk_buff *skb)
+{
+    void *data = (void *)(long)skb->data;
+    void *data_end = (void *)(long)skb->data_end;
+    struct ct_config *cfg;
+    struct ct_entry *ct;
+    struct ct_key key = {};
+    __u32 cfg_key = 0;
+    __u8 flags;
+    __u64 now;
+    
+    /* Non-TCP/UDP and IPv6 are left to the kernel firewall */
+    if (ct_parse(data, data_end, true, &key, &flags) < 0)
+        return TC_ACT_OK;
+    
+    cfg = bpf_map_lookup_elem(&conntrack_config, &cfg_key);
+    if (!cfg)
+        return TC_ACT_OK;
+    
+    /* WireGuard itself must stay reachable for handshakes */
+    if (key.protocol == IPPROTO_UDP && bpf_ntohs(key.src_port) == cfg->listen_port)
+        return TC_ACT_OK;
+    
+    if (!cfg->enforce)
+        return fastpath_forward(skb, &key, cfg->listen_port);
+    
+    ct = bpf_map_lookup_elem(&conntrack_map, &key);
+    if (!ct)
+        goto invalid;  /* Unsolicited */
+    
+    now = bpf_ktime_get_ns();
+    if (now - ct->last_seen > cfg->timeout_ns) {
+        bpf_map_delete_elem(&conntrack_map, &key);
+        goto invalid;
+    }
+    
+    switch (ct->state) {
+    case CT_STATE_NEW:
+        /* Only the SYN-ACK answering our SYN completes the handshake */
+        if ((flags & (CT_TCP_SYN | CT_TCP_ACK)) != (CT_TCP_SYN | CT_TCP_ACK))
+            goto invalid;
+        ct->state = CT_STATE_ESTABLISHED;
+        break;
+    case CT_STATE_ESTABLISHED:
+        if (flags & (CT_TCP_FIN | CT_TCP_RST))
+            ct->state = CT_STATE_FIN_WAIT;
+        break;
+    case CT_STATE_FIN_WAIT:
+        break;
+    default:
+        goto invalid;
+    }
+    
+    ct->last_seen = now;
+    return fastpath_forward(skb, &key, cfg->listen_port);
+    
+invalid:
+    count_drop(skb->ifindex, key.src_ip, DROP_CONNTRACK_INVALID);
+    return TC_ACT_SHOT;
+}
+
+/* TC ingress program for the WireGuard device: count decrypted packets
+ * against their flow and, with the fast path on, send those of established
+ * flows straight to the uplink. The device has no link layer, so data
+ * starts at the IP header.
+ */
+SEC("tc/undertheradar_fastpath")
+int tc_vpn_fastpath(struct __sk_buff *skb)
+{
+    void *data = (void *)(long)skb->data;
+    void *data_end = (void *)(long)skb->data_end;
+    struct ct_config *cfg;
+    struct ct_key key = {};
+    __u32 cfg_key = 0;
+    __u8 flags;
+    
+    if (skb->protocol != bpf_htons(ETH_P_IP))
+        return TC_ACT_OK;
+    if (ct_parse_ip(data, data_end, false, &key, &flags) < 0)
+        return TC_ACT_OK;
+    count_flow(&key, skb->len, true);
+    
+    cfg = bpf_map_lookup_elem(&conntrack_config, &cfg_key);
+    if (!cfg)
+        return TC_ACT_OK;
+    
+    /* Flows change state in the kernel, not here */
+    if (flags & (CT_TCP_SYN | CT_TCP_FIN | CT_TCP_RST))
+        return TC_ACT_OK;
+    
+    return fastpath_forward(skb, &key, cfg->listen_port);
+}
+
+/* TC egress program for the WireGuard device: classify the plaintext
+ * packet for DSCP marking of its encrypted form and count it against its
+ * flow and the allowed IP it is routed by. The device has no link layer, so data starts
+ * at the IP header.
+ */
+SEC("tc/undertheradar_classify")
+int tc_vpn_classify(struct __sk_buff *skb)
+{
+    void *data = (void *)(long)skb->data;
+    void *data_end = (void *)(long)skb->data_end;
+    struct dscp_config *cfg;
+    struct dscp_counters *counters;
+    struct dscp_rule *rule = NULL;
+    struct allowedip_key allowed = { .prefixlen = 128 };
+    struct ct_key flow = {};
+    __u32 cfg_key = 0, class = DSCP_UNCLASSIFIED;
+    __u16 dport = 0;
+    __u8 dscp, protocol, flags;
+    void *l4;
+    
+    if (skb->protocol == bpf_htons(ETH_P_IP)) {
+        struct iphdr *ip = data;
+        if ((void *)(ip + 1) > data_end)
+            return TC_ACT_OK;
+        dscp = ip->tos >> 2;
+        protocol = ip->protocol;
+        l4 = (void *)ip + ip->ihl * 4;
+        allowed.addr[10] = 0xff;
+        allowed.addr[11] = 0xff;
+        __builtin_memcpy(&allowed.addr[12], &ip->daddr, 4);
+        
+        /* Reversed, the destination is the far side */
+        if (ct_parse_ip(ip, data_end, true, &flow, &flags) == 0)
+            count_flow(&flow, skb->len, false);
+    } else if (skb->protocol == bpf_htons(ETH_P_IPV6)) {
+        struct ipv6hdr *ip6 = data;
+        if ((void *)(ip6 + 1) > data_end)
+            return TC_ACT_OK;
+        dscp = (bpf_ntohl(*(__be32 *)ip6) >> 22) & 0x3f;
+        protocol = ip6->nexthdr;  /* extension headers are not followed */
+        l4 = ip6 + 1;
+        __builtin_memcpy(allowed.addr, &ip6->daddr, 16);
+    } else {
+        return TC_ACT_OK;
+    }
+    
+    /* Destination port, at the same offset for TCP and UDP */
+    if (protocol == IPPROTO_TCP || protocol == IPPROTO_UDP) {
+        struct udphdr *udp = l4;
+        if ((void *)(udp + 1) <= data_end)
+            dport = bpf_ntohs(udp->dest);
+    }
+    
+    /* Tunnel egress sees every packet for a peer, classified or not */
+    count_allowed_ip(&allowed, skb->len);
+    
+    cfg = bpf_map_lookup_elem(&dscp_config, &cfg_key);
+    if (!cfg || cfg->rule_count == 0)
+        return TC_ACT_OK;
+    
+    for (__u32 i = 0; i < DSCP_MAX_RULES; i++) {
+        struct dscp_rule *r;
+        
+        if (i >= cfg->rule_count)
+            break;
+        r = bpf_map_lookup_elem(&dscp_rules, &i);
+        if (!r)
+            break;
+        if (r->match_dscp && r->inner_dscp != dscp)
+            continue;
+        if (r->protocol && r->protocol != protocol)
+            continue;
+        if (r->port_min && (dport < r->port_min || dport > r->port_max))
+            continue;
+        rule = r;
+        class = i;
+        break;
+    }
+    
+    counters = bpf_map_lookup_elem(&dscp_stats, &class);
+    if (counters) {
+        counters->packets++;
+        counters->bytes += skb->len;
+    }
+    
+    if (rule)
+        skb->priority = DSCP_PRIO_MAGIC |
+            (rule->outer_dscp == DSCP_COPY_INNER ? dscp : rule->outer_dscp);
+    return TC_ACT_OK;
+}
+
+/* Decision of the first split rule matching the packet, 0 if none does.
+ * iptables hands socket filters the packet from the IP header on, and
+ * they have no direct packet access.
+ */
+static __always_inline __u8 split_decide(struct __sk_buff *skb, __u32 *index)
+{
+    struct split_config *cfg;
+    __u32 cfg_key = 0, l4;
+    __u8 first[2], protocol, dscp;
+    __be16 port;
+    __u16 dport = 0;
+    
+    if (bpf_skb_load_bytes(skb, 0, first, sizeof(first)) < 0)
+        return 0;
+    
+    if (first[0] >> 4 == 4) {
+        dscp = first[1] >> 2;
+        l4 = (first[0] & 0x0f) * 4;
+        if (bpf_skb_load_bytes(skb, offsetof(struct iphdr, protocol), &protocol, 1) < 0)
+            return 0;
+    } else if (first[0] >> 4 == 6) {
+        dscp = ((first[0] & 0x0f) << 2) | (first[1] >> 6);
+        l4 = sizeof(struct ipv6hdr);  /* extension headers are not followed */
+        if (bpf_skb_load_bytes(skb, offsetof(struct ipv6hdr, nexthdr), &protocol, 1) < 0)
+            return 0;
+    } else {
+        return 0;
+    }
+    
+    /* Destination port, at the same offset for TCP and UDP */
+    if ((protocol == IPPROTO_TCP || protocol == IPPROTO_UDP) &&
+        bpf_skb_load_bytes(skb, l4 + offsetof(struct udphdr, dest), &port, sizeof(port)) == 0)
+        dport = bpf_ntohs(port);
+    
+    cfg = bpf_map_lookup_elem(&split_config, &cfg_key);
+    if (!cfg)
+        return 0;
+    
+    for (__u32 i = 0; i < SPLIT_MAX_RULES; i++) {
+        struct split_rule *r;
+        
+        if (i >= cfg->rule_count)
+            break;
+        r = bpf_map_lookup_elem(&split_rules, &i);
+        if (!r)
+            break;
+        if (r->protocol && r->protocol != protocol)
+            continue;
+        if (r->kind == SPLIT_MATCH_PORTS && (dport < r->port_min || dport > r->port_max))
+            continue;
+        if (r->kind == SPLIT_MATCH_DSCP && r->dscp != dscp)
+            continue;
+        *index = i;
+        return r->decision;
+    }
+    return 0;
+}
+
+/* Match the packet if its rule decides as given, counting the match */
+static __always_inline int split_match(struct __sk_buff *skb, __u8 decision)
+{
+    __u32 index;
+    __u64 *matched;
+    
+    if (split_decide(skb, &index) != decision)
+        return 0;
+    matched = bpf_map_lookup_elem(&split_stats, &index);
+    if (matched)
+        (*matched)++;
+    return 1;
+}
+
+SEC("socket/undertheradar_split_bypass")
+int split_bypass(struct __sk_buff *skb)
+{
+    return split_match(skb, SPLIT_BYPASS);
+}
+
+SEC("socket/undertheradar_split_tunnel")
+int split_tunnel(struct __sk_buff *skb)
+{
+    return split_match(skb, SPLIT_TUNNEL);
+}
+
 /* Calculate pacing delay to smooth traffic */
 static __always_inline __u64 calculate_pacing_delay(__u32 pkt_len)
 {
@@ -0,0 +1,234 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "net"
+    "os"
+    "testing"
+)
+
+func TestConntrackKeyLayout(t *testing.T) {
+    key := conntrackKey{
+        SrcIP:    net.ParseIP("10.0.0.2"),
+        DstIP:    net.ParseIP("93.184.216.34"),
+        SrcPort:  40000,
+        DstPort:  443,
+        Protocol: 6,
+    }
+    
+    got, err := key.MarshalBinary()
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := []byte{10, 0, 0, 2, 93, 184, 216, 34, 0x9c, 0x40, 0x01, 0xbb, 6}
+    if !bytes.Equal(got, want) {
+        t.Fatalf("key = %x, want %x", got, want)
+    }
+    
+    if _, err := (conntrackKey{SrcIP: net.ParseIP("::1"), DstIP: net.ParseIP("::2")}).MarshalBinary(); err == nil {
+        t.Fatal("IPv6 keys must be rejected")
+    }
+}
+
+// Ethernet + IPv4 + UDP packet as seen on ingress
+func udpPacket(src, dst net.IP, sport, dport uint16) []byte {
+    pkt := make([]byte, 14+20+8+32)
+    binary.BigEndian.PutUint16(pkt[12:14], 0x0800)
+    
+    ip := pkt[14:34]
+    ip[0] = 0x45
+    binary.BigEndian.PutUint16(ip[2:4], uint16(len(pkt)-14))
+    ip[8] = 64
+    ip[9] = 17
+    copy(ip[12:16], src.To4())
+    copy(ip[16:20], dst.To4())
+    
+    udp := pkt[34:42]
+    binary.BigEndian.PutUint16(udp[0:2], sport)
+    binary.BigEndian.PutUint16(udp[2:4], dport)
+    binary.BigEndian.PutUint16(udp[4:6], uint16(len(pkt)-34))
+    return pkt
+}
+
+func TestConntrackDropsUnsolicitedInbound(t *testing.T) {
+    if os.Geteuid() != 0 {
+        t.Skip("loading eBPF programs requires root")
+    }
+    if _, err := os.Stat(ebpfObjectPath); err != nil {
+        t.Skip("eBPF object not built")
+    }
+    
+    vpn := &UnderTheRadarVPN{listenPort: 51820, conntrack: defaultConntrackConfig()}
+    vpn.conntrack.Enforce = true
+    if err := vpn.loadEBPFPrograms(); err != nil {
+        t.Fatal(err)
+    }
+    defer vpn.closeEBPF()
+    
+    const tcActOK, tcActShot = 0, 2
+    local, remote := net.ParseIP("10.0.0.2"), net.ParseIP("198.51.100.7")
+    inbound := udpPacket(remote, local, 53, 40000)
+    
+    ret, _, err := vpn.tcIngressProgram.Test(inbound)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if ret != tcActShot {
+        t.Fatalf("unsolicited inbound returned %d, want TC_ACT_SHOT", ret)
+    }
+    
+    // Outbound query creates the flow, the reply is then admitted
+    if _, _, err := vpn.tcProgram.Test(udpPacket(local, remote, 40000, 53)); err != nil {
+        t.Fatal(err)
+    }
+    if ret, _, _ = vpn.tcIngressProgram.Test(inbound); ret != tcActOK {
+        t.Fatalf("reply to tracked flow returned %d, want TC_ACT_OK", ret)
+    }
+    
+    // WireGuard's own port is always reachable
+    handshake := udpPacket(remote, local, 51820, 51820)
+    if ret, _, _ = vpn.tcIngressProgram.Test(handshake); ret != tcActOK {
+        t.Fatalf("WireGuard handshake returned %d, want TC_ACT_OK", ret)
+    }
+}
+
+// Loading runs the verifier over unsteer_listen_port, which rewrites the
+// reply after the checksum helper has invalidated the packet pointers
+func TestListenPortRepliesLeaveFromClientPort(t *testing.T) {
+    if os.Geteuid() != 0 {
+        t.Skip("loading eBPF programs requires root")
+    }
+    if _, err := os.Stat(ebpfObjectPath); err != nil {
+        t.Skip("eBPF object not built")
+    }
+    
+    vpn := &UnderTheRadarVPN{listenPort: 51820, listenPorts: []int{51821}, conntrack: defaultConntrackConfig()}
+    if err := vpn.loadEBPFPrograms(); err != nil {
+        t.Fatal(err)
+    }
+    defer vpn.closeEBPF()
+    if err := vpn.writeListenPorts(); err != nil {
+        t.Fatal(err)
+    }
+    
+    local, client := net.ParseIP("10.0.0.2"), net.ParseIP("198.51.100.7")
+    _, steered, err := vpn.xdpProgram.Test(udpPacket(client, local, 40000, 51821))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if port := binary.BigEndian.Uint16(steered[36:38]); port != 51820 {
+        t.Fatalf("inbound steered to %d, want 51820", port)
+    }
+    
+    reply := udpPacket(local, client, 51820, 40000)
+    binary.BigEndian.PutUint16(reply[40:42], 0x1234)
+    _, out, err := vpn.tcProgram.Test(reply)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if port := binary.BigEndian.Uint16(out[34:36]); port != 51821 {
+        t.Fatalf("reply left from %d, want 51821", port)
+    }
+    
+    // RFC 1624 incremental update for the changed port
+    sum := uint32(^uint16(0x1234)) + uint32(^uint16(51820)) + 51821
+    sum = (sum & 0xffff) + sum>>16
+    sum = (sum & 0xffff) + sum>>16
+    if check := binary.BigEndian.Uint16(out[40:42]); check != ^uint16(sum) {
+        t.Fatalf("checksum %#04x, want %#04x", check, ^uint16(sum))
+    }
+}
+
+// Load the programs with the fast path redirecting loopback, the device
+// BPF_PROG_TEST_RUN packets arrive on
+func loadFastPath(t testing.TB) *UnderTheRadarVPN {
+    t.Helper()
+    if os.Geteuid() != 0 {
+        t.Skip("loading eBPF programs requires root")
+    }
+    if _, err := os.Stat(ebpfObjectPath); err != nil {
+        t.Skip("eBPF object not built")
+    }
+    
+    vpn := &UnderTheRadarVPN{listenPort: 51820, conntrack: defaultConntrackConfig()}
+    if err := vpn.loadEBPFPrograms(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(vpn.closeEBPF)
+    
+    lo, err := net.InterfaceByName("lo")
+    if err != nil {
+        t.Fatal(err)
+    }
+    target := fastPathTarget{Ifindex: uint32(lo.Index), Direction: fastPathToTunnel}
+    if err := vpn.ebpfMaps["fastpath_redirect"].Put(uint32(lo.Index), target); err != nil {
+        t.Fatal(err)
+    }
+    return vpn
+}
+
+func TestFastPathRedirectsEstablishedFlows(t *testing.T) {
+    vpn := loadFastPath(t)
+    
+    const tcActOK, tcActRedirect = 0, 7
+    local, remote := net.ParseIP("10.0.0.2"), net.ParseIP("198.51.100.7")
+    reply := udpPacket(remote, local, 53, 40000)
+    unrelated := udpPacket(remote, local, 53, 40001)
+    
+    // Nothing is tracked yet, the kernel path handles it
+    if ret, _, err := vpn.tcIngressProgram.Test(reply); err != nil || ret != tcActOK {
+        t.Fatalf("untracked flow returned %d (%v), want TC_ACT_OK", ret, err)
+    }
+    
+    if _, _, err := vpn.tcProgram.Test(udpPacket(local, remote, 40000, 53)); err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 3; i++ {
+        if ret, _, _ := vpn.tcIngressProgram.Test(reply); ret != tcActRedirect {
+            t.Fatalf("established flow returned %d, want TC_ACT_REDIRECT", ret)
+        }
+    }
+    if ret, _, _ := vpn.tcIngressProgram.Test(unrelated); ret != tcActOK {
+        t.Fatalf("untracked flow returned %d, want TC_ACT_OK", ret)
+    }
+    
+    stats, err := vpn.FastPathStats()
+    if err != nil {
+        t.Fatal(err)
+    }
+    got := stats.UplinkToTunnel
+    if got.Packets != 3 || got.Passed != 2 || got.Bytes != 3*uint64(len(reply)) {
+        t.Fatalf("uplink to tunnel counters = %+v, want 3 redirected, 2 passed", got)
+    }
+    if stats.TunnelToUplink != (FastPathDirection{}) {
+        t.Fatalf("tunnel to uplink counters = %+v, want none", stats.TunnelToUplink)
+    }
+}
+
+// Per-packet cost of the ingress program with and without a redirect. The
+// end-to-end comparison against kernel routing needs two hosts, run the
+// benchmark package with FastPathEnabled on and off for that.
+func BenchmarkFastPathIngress(b *testing.B) {
+    vpn := loadFastPath(b)
+    local, remote := net.ParseIP("10.0.0.2"), net.ParseIP("198.51.100.7")
+    if _, _, err := vpn.tcProgram.Test(udpPacket(local, remote, 40000, 53)); err != nil {
+        b.Fatal(err)
+    }
+    
+    for _, bench := range []struct {
+        name   string
+        packet []byte
+    }{
+        {"redirect", udpPacket(remote, local, 53, 40000)},
+        {"kernel", udpPacket(remote, local, 53, 40001)},
+    } {
+        b.Run(bench.name, func(b *testing.B) {
+            _, perRun, err := vpn.tcIngressProgram.Benchmark(bench.packet, b.N, nil)
+            if err != nil {
+                b.Fatal(err)
+            }
+            b.ReportMetric(float64(perRun.Nanoseconds()), "ns/pkt")
+        })
+    }
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    mrand "math/rand/v2"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    
+    "golang.org/x/net/dns/dnsmessage"
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DNS TTLs of endpoint hostnames are clamped to these, so a TTL of 0
+// doesn't turn into a query loop and a day-long one still notices a move
+// within the hour
+const (
+    minEndpointTTL         = 30 * time.Second
+    maxEndpointTTL         = time.Hour
+    defaultEndpointTTL     = 5 * time.Minute // the resolver didn't tell
+    endpointResolveTick    = 10 * time.Second
+    endpointResolveTimeout = 5 * time.Second
+)
+
+// Tests replace this. A zero TTL means the lookup couldn't tell.
+var lookupEndpointHost = func(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+    if ips, ttl, err := lookupHostTTL(ctx, host); err == nil {
+        return ips, ttl, nil
+    }
+    // The stdlib resolver knows more places to look, but no TTLs
+    addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+    if err != nil {
+        return nil, 0, err
+    }
+    ips := make([]net.IP, len(addrs))
+    for i, addr := range addrs {
+        ips[i] = addr.IP
+    }
+    return ips, 0, nil
+}
+
+// Split a PeerConfig.EndpointHost into host and port
+func splitEndpointHost(hostport string) (string, int, error) {
+    host, portStr, err := net.SplitHostPort(hostport)
+    if err != nil {
+        return "", 0, fmt.Errorf("invalid endpoint %q: %w", hostport, err)
+    }
+    port, err := strconv.Atoi(portStr)
+    if err != nil || port <= 0 || port > 65535 || host == "" {
+        return "", 0, fmt.Errorf("invalid endpoint %q", hostport)
+    }
+    return host, port, nil
+}
+
+// Resolve hostport to an endpoint and how long to trust it. The current
+// endpoint is kept while the name still resolves to it, so round-robin
+// records don't move the peer on every lookup. A literal address comes
+// back with a zero TTL, it never needs resolving again.
+func resolveEndpointHost(ctx context.Context, hostport string, current *net.UDPAddr) (*net.UDPAddr, time.Duration, error) {
+    host, port, err := splitEndpointHost(hostport)
+    if err != nil {
+        return nil, 0, err
+    }
+    if ip := net.ParseIP(host); ip != nil {
+        return &net.UDPAddr{IP: ip, Port: port}, 0, nil
+    }
+    
+    ips, ttl, err := lookupEndpointHost(ctx, host)
+    if err != nil {
+        return nil, 0, fmt.Errorf("failed to resolve endpoint %s: %w", host, err)
+    }
+    if len(ips) == 0 {
+        return nil, 0, fmt.Errorf("failed to resolve endpoint %s: no addresses", host)
+    }
+    switch {
+    case ttl == 0:
+        ttl = defaultEndpointTTL
+    case ttl < minEndpointTTL:
+        ttl = minEndpointTTL
+    case ttl > maxEndpointTTL:
+        ttl = maxEndpointTTL
+    }
+    
+    if current != nil && current.Port == port {
+        for _, ip := range ips {
+            if ip.Equal(current.IP) {
+                return current, ttl, nil
+            }
+        }
+    }
+    return &net.UDPAddr{IP: ips[0], Port: port}, ttl, nil
+}
+
+// Look host up at the nameservers of /etc/resolv.conf for A and AAAA
+// records, with the lowest TTL of the answers
+func lookupHostTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+    name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+    if err != nil {
+        return nil, 0, err
+    }
+    servers, err := systemNameservers()
+    if err != nil {
+        return nil, 0, err
+    }
+    
+    lastErr := errors.New("no nameservers")
+    for _, server := range servers {
+        var ips []net.IP
+        var ttl uint32
+        answered := false
+        for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+            records, err := queryNameserver(ctx, server, name, qtype)
+            if err != nil {
+                lastErr = err
+                continue
+            }
+            answered = true
+            for _, rr := range records {
+                if len(ips) == 0 || rr.Header.TTL < ttl {
+                    ttl = rr.Header.TTL
+                }
+                switch body := rr.Body.(type) {
+                case *dnsmessage.AResource:
+                    ips = append(ips, net.IP(body.A[:]))
+                case *dnsmessage.AAAAResource:
+                    ips = append(ips, net.IP(body.AAAA[:]))
+                }
+            }
+        }
+        if answered {
+            return ips, time.Duration(ttl) * time.Second, nil
+        }
+    }
+    return nil, 0, lastErr
+}
+
+// Address records for name from one nameserver over UDP
+func queryNameserver(ctx context.Context, server string, name dnsmessage.Name, qtype dnsmessage.Type) ([]dnsmessage.Resource, error) {
+    id := uint16(mrand.Uint32())
+    query, err := (&dnsmessage.Message{
+        Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+        Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+    }).Pack()
+    if err != nil {
+        return nil, err
+    }
+    
+    var d net.Dialer
+    conn, err := d.DialContext(ctx, "udp", net.JoinHostPort(server, "53"))
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+    if deadline, ok := ctx.Deadline(); ok {
+        conn.SetDeadline(deadline)
+    }
+    if _, err := conn.Write(query); err != nil {
+        return nil, err
+    }
+    
+    buf := make([]byte, 1232)
+    for {
+        n, err := conn.Read(buf)
+        if err != nil {
+            return nil, err
+        }
+        var msg dnsmessage.Message
+        if msg.Unpack(buf[:n]) != nil || msg.ID != id {
+            continue // not our answer
+        }
+        switch {
+        case msg.Truncated:
+            return nil, fmt.Errorf("truncated answer from %s", server)
+        case msg.RCode == dnsmessage.RCodeNameError:
+            return nil, nil
+        case msg.RCode != dnsmessage.RCodeSuccess:
+            return nil, fmt.Errorf("%s answered %s", server, msg.RCode)
+        }
+        
+        var records []dnsmessage.Resource
+        for _, rr := range msg.Answers {
+            if rr.Header.Type == qtype {
+                records = append(records, rr)
+            }
+        }
+        return records, nil
+    }
+}
+
+// Nameservers the system resolver uses, loopback stubs included
+func systemNameservers() ([]string, error) {
+    data, err := os.ReadFile(resolvConfPath)
+    if err != nil {
+        return nil, err
+    }
+    var servers []string
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+            servers = append(servers, fields[1])
+        }
+    }
+    if len(servers) == 0 {
+        return nil, fmt.Errorf("no nameservers in %s", resolvConfPath)
+    }
+    return servers, nil
+}
+
+// EndpointHost is the hostname the peer's Endpoint is resolved from, empty
+// for a fixed address
+func (peer *Peer) EndpointHost() string {
+    return peer.extras().endpointHost
+}
+
+// endpointResolver re-resolves the EndpointHost of peers as their DNS
+// records expire and moves the peer when the address changed, so servers
+// behind dynamic DNS keep working
+type endpointResolver struct {
+    vpn *UnderTheRadarVPN
+    
+    stop     chan struct{}
+    stopOnce sync.Once
+}
+
+func newEndpointResolver(vpn *UnderTheRadarVPN) *endpointResolver {
+    return &endpointResolver{vpn: vpn, stop: make(chan struct{})}
+}
+
+func (r *endpointResolver) Start() {
+    ticker := r.vpn.clock().NewTicker(endpointResolveTick)
+    defer ticker.Stop()
+    
+    for {
+        select {
+        case <-ticker.C():
+            r.refresh()
+        case <-r.stop:
+            return
+        }
+    }
+}
+
+func (r *endpointResolver) Stop() {
+    r.stopOnce.Do(func() { close(r.stop) })
+}
+
+// Resolve every peer whose record has expired
+func (r *endpointResolver) refresh() {
+    vpn := r.vpn
+    now := vpn.clock().Now()
+    
+    vpn.mu.RLock()
+    var due []*Peer
+    for _, peer := range vpn.peers.list {
+        if extra := peer.extras(); extra.endpointHost != "" && !now.Before(extra.endpointExpires) {
+            due = append(due, peer)
+        }
+    }
+    vpn.mu.RUnlock()
+    
+    for _, peer := range due {
+        vpn.refreshEndpoint(peer)
+    }
+}
+
+// Look the peer's EndpointHost up again and point the device at the new
+// address if it moved. A failed lookup keeps the old address and tries
+// again after minEndpointTTL.
+func (vpn *UnderTheRadarVPN) refreshEndpoint(peer *Peer) error {
+    vpn.mu.RLock()
+    hostport, current := peer.EndpointHost(), peer.Endpoint
+    vpn.mu.RUnlock()
+    
+    // Outside the lock, a slow nameserver must not stall the data path
+    ctx, cancel := context.WithTimeout(context.Background(), endpointResolveTimeout)
+    endpoint, ttl, err := resolveEndpointHost(ctx, hostport, current)
+    cancel()
+    sink := vpn.metricSink()
+    
+    vpn.mu.Lock()
+    defer vpn.mu.Unlock()
+    
+    // Removed or re-added meanwhile, AddPeer has resolved it afresh
+    if vpn.peers.get(peer.PublicKey) != peer || peer.EndpointHost() != hostport {
+        return nil
+    }
+    now := vpn.clock().Now()
+    if err != nil {
+        peer.extra.endpointExpires = now.Add(minEndpointTTL)
+        vpn.emitEvent(Event{Type: EventEndpointChanged, PublicKey: peer.PublicKey, Message: err.Error()})
+        return err
+    }
+    peer.extra.endpointExpires = now.Add(ttl)
+    if endpoint == current {
+        return nil
+    }
+    
+    cfg := wgtypes.Config{
+        Peers: []wgtypes.PeerConfig{{
+            PublicKey:  peer.PublicKey,
+            Endpoint:   endpoint,
+            UpdateOnly: true,
+        }},
+    }
+    // A relayed peer moves on its relay, the device keeps the loopback endpoint
+    if turn := peer.extra.turn; turn != nil {
+        if err := turn.SetPeer(endpoint); err != nil {
+            return err
+        }
+    } else if err := vpn.wgClient.ConfigureDevice(vpn.deviceName, cfg); err != nil {
+        return fmt.Errorf("failed to update endpoint: %w", err)
+    }
+    peer.Endpoint = endpoint
+    sink.Count("peer.endpoint_changed", 1, peer.metricTags()...)
+    vpn.emitEvent(Event{
+        Type:      EventEndpointChanged,
+        PublicKey: peer.PublicKey,
+        Message:   fmt.Sprintf("%s moved to %s", hostport, endpoint),
+    })
+    return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net"
+    "sync"
+    "testing"
+    "time"
+)
+
+// DNS answering host with the current addresses and ttl
+type fakeEndpointDNS struct {
+    mu      sync.Mutex
+    ips     []net.IP
+    ttl     time.Duration
+    err     error
+    lookups int
+}
+
+func installFakeEndpointDNS(t *testing.T, ttl time.Duration, ips ...string) *fakeEndpointDNS {
+    dns := &fakeEndpointDNS{ttl: ttl}
+    dns.set(ips...)
+    orig := lookupEndpointHost
+    lookupEndpointHost = func(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+        dns.mu.Lock()
+        defer dns.mu.Unlock()
+        dns.lookups++
+        return dns.ips, dns.ttl, dns.err
+    }
+    t.Cleanup(func() { lookupEndpointHost = orig })
+    return dns
+}
+
+func (d *fakeEndpointDNS) set(ips ...string) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.ips = nil
+    for _, ip := range ips {
+        d.ips = append(d.ips, net.ParseIP(ip))
+    }
+}
+
+func (d *fakeEndpointDNS) count() int {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    return d.lookups
+}
+
+func TestResolveEndpointHost(t *testing.T) {
+    dns := installFakeEndpointDNS(t, 5*time.Second, "203.0.113.1", "203.0.113.2")
+    
+    endpoint, ttl, err := resolveEndpointHost(context.Background(), "vpn.example:51820", nil)
+    if err != nil || endpoint.String() != "203.0.113.1:51820" || ttl != minEndpointTTL {
+        t.Fatalf("got %v %v %v", endpoint, ttl, err)
+    }
+    
+    // Round robin doesn't move a peer whose address is still listed
+    current := &net.UDPAddr{IP: net.ParseIP("203.0.113.2"), Port: 51820}
+    if endpoint, _, _ := resolveEndpointHost(context.Background(), "vpn.example:51820", current); endpoint != current {
+        t.Fatalf("moved to %v", endpoint)
+    }
+    
+    dns.ttl = 0
+    if _, ttl, _ := resolveEndpointHost(context.Background(), "vpn.example:51820", nil); ttl != defaultEndpointTTL {
+        t.Fatalf("unknown TTL gave %v", ttl)
+    }
+    dns.ttl = 48 * time.Hour
+    if _, ttl, _ := resolveEndpointHost(context.Background(), "vpn.example:51820", nil); ttl != maxEndpointTTL {
+        t.Fatalf("long TTL gave %v", ttl)
+    }
+    
+    lookups := dns.count()
+    if endpoint, ttl, err := resolveEndpointHost(context.Background(), "[2001:db8::1]:443", nil); err != nil || ttl != 0 || endpoint.Port != 443 || dns.count() != lookups {
+        t.Fatalf("literal gave %v %v %v", endpoint, ttl, err)
+    }
+    for _, bad := range []string{"vpn.example", "vpn.example:0", ":51820", "vpn.example:wg"} {
+        if _, _, err := resolveEndpointHost(context.Background(), bad, nil); err == nil {
+            t.Errorf("%q accepted", bad)
+        }
+    }
+}
+
+func TestEndpointHostFollowsDNS(t *testing.T) {
+    dns := installFakeEndpointDNS(t, time.Minute, "203.0.113.1")
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    clock := NewFakeClock(time.Now())
+    vpn.timeSource = clock
+    
+    key := mustKey(t).PublicKey()
+    if err := vpn.AddPeer(PeerConfig{PublicKey: key, EndpointHost: "vpn.example:51820", SkipProbe: true}); err != nil {
+        t.Fatal(err)
+    }
+    peer := vpn.peers.get(key)
+    if peer.Endpoint.String() != "203.0.113.1:51820" || peer.EndpointHost() != "vpn.example:51820" {
+        t.Fatalf("added with %v from %q", peer.Endpoint, peer.EndpointHost())
+    }
+    
+    // The record moves, but is only looked up again once its TTL is up
+    resolver := newEndpointResolver(vpn)
+    dns.set("198.51.100.7")
+    clock.Advance(30 * time.Second)
+    resolver.refresh()
+    if dns.count() != 1 {
+        t.Fatalf("%d lookups before the TTL expired", dns.count())
+    }
+    
+    go resolver.Start()
+    t.Cleanup(resolver.Stop)
+    
+    moved := func() bool {
+        vpn.mu.RLock()
+        defer vpn.mu.RUnlock()
+        return peer.Endpoint.String() == "198.51.100.7:51820"
+    }
+    advanceUntil(t, clock, endpointResolveTick, moved)
+    
+    wg.mu.Lock()
+    last := wg.configs[len(wg.configs)-1].Peers[0]
+    wg.mu.Unlock()
+    if !last.UpdateOnly || last.PublicKey != key || last.Endpoint.String() != "198.51.100.7:51820" || last.AllowedIPs != nil {
+        t.Fatalf("device updated with %+v", last)
+    }
+    ev := <-vpn.Events()
+    if ev.Type != EventEndpointChanged || ev.PublicKey != key {
+        t.Fatalf("event %+v", ev)
+    }
+}
+
+func TestEndpointHostKeptWhenDNSFails(t *testing.T) {
+    dns := installFakeEndpointDNS(t, time.Minute, "203.0.113.1")
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    clock := NewFakeClock(time.Now())
+    vpn.timeSource = clock
+    
+    key := mustKey(t).PublicKey()
+    if err := vpn.AddPeer(PeerConfig{PublicKey: key, EndpointHost: "vpn.example:51820", SkipProbe: true}); err != nil {
+        t.Fatal(err)
+    }
+    dns.err = errors.New("SERVFAIL")
+    clock.Advance(time.Minute)
+    peer := vpn.peers.get(key)
+    if err := vpn.refreshEndpoint(peer); err == nil {
+        t.Fatal("failed lookup not reported")
+    }
+    if peer.Endpoint.String() != "203.0.113.1:51820" || len(wg.configs) != 1 {
+        t.Fatalf("endpoint %v after a failed lookup", peer.Endpoint)
+    }
+    if due := peer.extra.endpointExpires.Sub(clock.Now()); due != minEndpointTTL {
+        t.Fatalf("retry in %v", due)
+    }
+    
+    // Nothing to add with a name that doesn't resolve
+    if err := vpn.AddPeer(PeerConfig{PublicKey: mustKey(t).PublicKey(), EndpointHost: "gone.example:51820", SkipProbe: true}); err == nil {
+        t.Fatal("peer added without an endpoint")
+    }
+}
+
+func TestWGQuickKeepsEndpointHost(t *testing.T) {
+    peer := PeerConfig{}
+    if err := parseWGQuickPeer(&peer, "endpoint", "vpn.example:51820", nil); err != nil || peer.EndpointHost != "vpn.example:51820" || peer.Endpoint != nil {
+        t.Fatalf("got %+v %v", peer, err)
+    }
+    peer = PeerConfig{}
+    if err := parseWGQuickPeer(&peer, "endpoint", "192.0.2.1:51820", nil); err != nil || peer.EndpointHost != "" || peer.Endpoint == nil {
+        t.Fatalf("got %+v %v", peer, err)
+    }
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "syscall"
+    "testing"
+    
+    "github.com/cilium/ebpf"
+)
+
+func TestPeerNotFoundIs(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    unknown := mustKey(t).PublicKey()
+    
+    calls := map[string]error{
+        "RemovePeer":           vpn.RemovePeer(unknown),
+        "SetPeerAnnotation":    vpn.SetPeerAnnotation(unknown, "customer", "acme"),
+        "RemovePeerAnnotation": vpn.RemovePeerAnnotation(unknown, "customer"),
+    }
+    for name, err := range calls {
+        if !errors.Is(err, ErrPeerNotFound) {
+            t.Errorf("%s gave %v", name, err)
+        }
+    }
+}
+
+func TestDeviceExistsIs(t *testing.T) {
+    wg, _, _ := preexistingDevice(t)
+    vpn := newTestVPN(t, wg)
+    
+    if err := vpn.createDevice(context.Background(), VPNConfig{}); !errors.Is(err, ErrDeviceExists) {
+        t.Fatalf("got %v", err)
+    }
+}
+
+func TestKeyInvalidIs(t *testing.T) {
+    if _, err := ParseSecret("not a key"); !errors.Is(err, ErrKeyInvalid) {
+        t.Errorf("ParseSecret gave %v", err)
+    }
+    vpn := newTestVPN(t, newFakeWGClient())
+    if err := vpn.setupKeys(VPNConfig{PrivateKey: NewSecret([]byte("short"))}); !errors.Is(err, ErrKeyInvalid) {
+        t.Errorf("setupKeys gave %v", err)
+    }
+    if err := vpn.AddPeer(PeerConfig{SkipProbe: true}); !errors.Is(err, ErrKeyInvalid) {
+        t.Errorf("AddPeer without a key gave %v", err)
+    }
+    psk := NewSecret([]byte("short"))
+    if err := vpn.AddPeer(PeerConfig{PublicKey: mustKey(t).PublicKey(), PresharedKey: psk, SkipProbe: true}); !errors.Is(err, ErrKeyInvalid) {
+        t.Errorf("AddPeer with a short preshared key gave %v", err)
+    }
+}
+
+func TestEBPFUnsupportedIs(t *testing.T) {
+    for _, cause := range []error{ebpf.ErrNotSupported, syscall.EPERM} {
+        err := ebpfUnsupported(fmt.Errorf("failed to attach XDP program: %w", cause))
+        if !errors.Is(err, ErrEBPFUnsupported) || !errors.Is(err, cause) {
+            t.Errorf("%v not wrapped: %v", cause, err)
+        }
+    }
+    if err := ebpfUnsupported(syscall.EINVAL); errors.Is(err, ErrEBPFUnsupported) {
+        t.Errorf("EINVAL reported as unsupported")
+    }
+}
+
+func TestKillSwitchFailedIs(t *testing.T) {
+    installFakeHost(t, "iptables -A OUTPUT -j DROP")
+    vpn := newStartVPN(t)
+    
+    err := vpn.Start(VPNConfig{ListenPort: 51820, KillSwitch: true})
+    var startErr *StartError
+    if !errors.Is(err, ErrKillSwitchFailed) || !errors.As(err, &startErr) {
+        t.Fatalf("got %v", err)
+    }
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Size of the buffered event channel; events are dropped when it is full
+const eventBufferSize = 256
+
+// EventType identifies what happened to the VPN or one of its peers
+type EventType int
+
+const (
+    EventCounterReset EventType = iota
+    EventAllowedIPReassigned // PublicKey is the peer that lost the prefix
+    EventPortHop
+    EventConfigReloaded
+    EventReloadFailed
+    EventExitChanged // PublicKey is the new exit
+    EventUAPIIgnored // a UAPI client set a field we don't support
+    EventPeerFailed    // debounced, Count says how often it failed
+    EventPeerRecovered // healthy for RecoveryChecks checks in a row
+    EventSupervisorState // published by Supervisor, see SupervisorStatus
+    EventWebhookFailed   // peer stats could not be delivered after retries
+    EventCaptivePortal   // detected, portal mode opened or ended, see CaptivePortalGuard
+    EventScheduler       // automatic connect, disconnect or suspend, or a network prompt, see Scheduler
+    EventPeerConnected   // first healthy check of the peer
+    EventConfigWarning   // Start found a setting with no effect, see VPNConfig.Validate
+    EventEndpointChanged // a peer's EndpointHost resolved to a new address, or failed to resolve
+    EventAnnotationChanged // Message says which annotation was set or removed, see SetPeerAnnotation
+    EventDeviceLost        // the device stayed missing for DeviceGoneAfter, see DevicePollStatus
+    EventPeerSync          // SyncPeers changed the peers or failed to, see PeerSyncStatus
+)
+
+func (t EventType) String() string {
+    switch t {
+    case EventCounterReset:
+        return "counter-reset"
+    case EventAllowedIPReassigned:
+        return "allowed-ip-reassigned"
+    case EventPortHop:
+        return "port-hop"
+    case EventConfigReloaded:
+        return "config-reloaded"
+    case EventReloadFailed:
+        return "reload-failed"
+    case EventExitChanged:
+        return "exit-changed"
+    case EventUAPIIgnored:
+        return "uapi-ignored"
+    case EventPeerFailed:
+        return "peer-failed"
+    case EventPeerRecovered:
+        return "peer-recovered"
+    case EventSupervisorState:
+        return "supervisor-state"
+    case EventWebhookFailed:
+        return "webhook-failed"
+    case EventCaptivePortal:
+        return "captive-portal"
+    case EventScheduler:
+        return "scheduler"
+    case EventPeerConnected:
+        return "peer-connected"
+    case EventConfigWarning:
+        return "config-warning"
+    case EventEndpointChanged:
+        return "endpoint-changed"
+    case EventAnnotationChanged:
+        return "annotation-changed"
+    case EventDeviceLost:
+        return "device-lost"
+    case EventPeerSync:
+        return "peer-sync"
+    default:
+        return "unknown"
+    }
+}
+
+// Event is delivered to consumers of UnderTheRadarVPN.Events()
+type Event struct {
+    Type      EventType
+    PublicKey wgtypes.Key
+    Time      time.Time
+    Message   string
+    Count     int // occurrences this event stands for, see Debouncer
+    
+    // EventPeerFailed: what the eBPF programs dropped most of the peer's
+    // packets for, see GetDropReasons
+    DegradationReason DropReason
+    
+    // EventPeerFailed: the peer still carries traffic, on an alternate
+    // endpoint
+    FailedOver bool
+}
+
+// Events returns the channel on which VPN events are published
+func (vpn *UnderTheRadarVPN) Events() <-chan Event {
+    return vpn.events
+}
+
+// Publish an event without ever blocking the caller
+func (vpn *UnderTheRadarVPN) emitEvent(ev Event) {
+    if vpn.events == nil {
+        return
+    }
+    if ev.Time.IsZero() {
+        ev.Time = vpn.clock().Now()
+    }
+    if ev.Count == 0 {
+        ev.Count = 1
+    }
+    vpn.streamEvent(ev)
+    
+    select {
+    case vpn.events <- ev:
+    default:
+        // Slow consumer, drop rather than stall the control plane
+    }
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+    "sync"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+const (
+    DefaultMaxStreamAge     = time.Hour
+    DefaultStreamBufferSize = 64 // events a subscriber may fall behind before it is dropped
+)
+
+// EventStreamServer serves VPNControl.StreamConnectionEvents, pushing peer
+// connection events to every subscriber as they are published. Register it
+// on a grpc.Server with RegisterVPNControlServer.
+type EventStreamServer struct {
+    UnimplementedVPNControlServer
+    
+    maxStreamAge time.Duration
+    bufferSize   int
+    
+    mu          sync.Mutex // orders sequence numbers with delivery
+    sequence    uint64
+    subscribers sync.Map // *eventSubscriber to struct{}
+}
+
+type eventSubscriber struct {
+    peers   map[wgtypes.Key]bool // nil for all
+    events  chan *PeerEvent
+    dropped chan struct{} // closed when it fell behind
+}
+
+// NewEventStreamServer streams the events vpn publishes from now on.
+// Streams end after maxStreamAge, DefaultMaxStreamAge when zero, so
+// clients reconnect through load balancers now and then. A VPN feeds one
+// server, a later one replaces it.
+func NewEventStreamServer(vpn *UnderTheRadarVPN, maxStreamAge time.Duration) *EventStreamServer {
+    if maxStreamAge <= 0 {
+        maxStreamAge = DefaultMaxStreamAge
+    }
+    s := &EventStreamServer{maxStreamAge: maxStreamAge, bufferSize: DefaultStreamBufferSize}
+    vpn.eventStream.Store(s)
+    return s
+}
+
+// StreamConnectionEvents sends peer events until the client goes away, the
+// stream reaches its maximum age or the client falls bufferSize events
+// behind
+func (s *EventStreamServer) StreamConnectionEvents(req *StreamRequest, stream VPNControl_StreamConnectionEventsServer) error {
+    sub := &eventSubscriber{
+        events:  make(chan *PeerEvent, s.bufferSize),
+        dropped: make(chan struct{}),
+    }
+    for _, encoded := range req.GetPublicKeys() {
+        key, err := wgtypes.ParseKey(encoded)
+        if err != nil {
+            return status.Errorf(codes.InvalidArgument, "invalid public key %q", encoded)
+        }
+        if sub.peers == nil {
+            sub.peers = make(map[wgtypes.Key]bool)
+        }
+        sub.peers[key] = true
+    }
+    
+    s.subscribers.Store(sub, struct{}{})
+    defer s.subscribers.Delete(sub)
+    
+    age := time.NewTimer(s.maxStreamAge)
+    defer age.Stop()
+    for {
+        select {
+        case ev := <-sub.events:
+            if err := stream.Send(ev); err != nil {
+                return err
+            }
+        case <-sub.dropped:
+            return status.Errorf(codes.ResourceExhausted, "subscriber fell %d events behind", s.bufferSize)
+        case <-age.C:
+            return status.Errorf(codes.DeadlineExceeded, "stream reached its maximum age of %s, reconnect", s.maxStreamAge)
+        case <-stream.Context().Done():
+            return stream.Context().Err()
+        }
+    }
+}
+
+// Subscribers returns how many streams are open
+func (s *EventStreamServer) Subscribers() int {
+    n := 0
+    s.subscribers.Range(func(any, any) bool {
+        n++
+        return true
+    })
+    return n
+}
+
+// Send a peer event to every subscriber without blocking, dropping those
+// whose buffer is full. Other events are not streamed.
+func (s *EventStreamServer) broadcast(ev Event) {
+    kind := peerEventKind(ev)
+    if kind == PeerEvent_KIND_UNSPECIFIED {
+        return
+    }
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    s.sequence++
+    msg := &PeerEvent{
+        Kind:         kind,
+        PublicKey:    ev.PublicKey.String(),
+        TimeUnixNano: ev.Time.UnixNano(),
+        Message:      ev.Message,
+        Count:        uint32(ev.Count),
+        Sequence:     s.sequence,
+    }
+    if ev.DegradationReason != 0 {
+        msg.DegradationReason = ev.DegradationReason.String()
+    }
+    
+    s.subscribers.Range(func(key, _ any) bool {
+        sub := key.(*eventSubscriber)
+        if sub.peers != nil && !sub.peers[ev.PublicKey] {
+            return true
+        }
+        select {
+        case sub.events <- msg:
+        default:
+            // Dropped rather than stall the control plane or hand the
+            // subscriber a stream with gaps
+            s.subscribers.Delete(sub)
+            close(sub.dropped)
+        }
+        return true
+    })
+}
+
+func peerEventKind(ev Event) PeerEvent_Kind {
+    switch ev.Type {
+    case EventPeerConnected:
+        return PeerEvent_ESTABLISHED
+    case EventPeerRecovered:
+        return PeerEvent_RECOVERED
+    case EventPeerFailed:
+        if ev.FailedOver {
+            return PeerEvent_DEGRADED
+        }
+        return PeerEvent_FAILED
+    default:
+        return PeerEvent_KIND_UNSPECIFIED
+    }
+}
+
+// Feed the event stream server, if any
+func (vpn *UnderTheRadarVPN) streamEvent(ev Event) {
+    if s := vpn.eventStream.Load(); s != nil {
+        s.broadcast(ev)
+    }
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+    "context"
+    "net"
+    "testing"
+    "time"
+    
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/credentials/insecure"
+    "google.golang.org/grpc/status"
+    "google.golang.org/grpc/test/bufconn"
+)
+
+// Event stream server on an in-memory listener and a client for it
+func startEventStream(t *testing.T, vpn *UnderTheRadarVPN, maxAge time.Duration) (*EventStreamServer, VPNControlClient) {
+    t.Helper()
+    
+    streams := NewEventStreamServer(vpn, maxAge)
+    ln := bufconn.Listen(1 << 20)
+    server := grpc.NewServer()
+    RegisterVPNControlServer(server, streams)
+    go server.Serve(ln)
+    t.Cleanup(server.Stop)
+    
+    conn, err := grpc.NewClient("passthrough:///bufconn",
+        grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+        grpc.WithTransportCredentials(insecure.NewCredentials()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    return streams, NewVPNControlClient(conn)
+}
+
+// Open a stream and wait until the server has it
+func subscribe(t *testing.T, streams *EventStreamServer, client VPNControlClient, req *StreamRequest) VPNControl_StreamConnectionEventsClient {
+    t.Helper()
+    
+    before := streams.Subscribers()
+    stream, err := client.StreamConnectionEvents(context.Background(), req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for deadline := time.Now().Add(5 * time.Second); streams.Subscribers() == before; {
+        if time.Now().After(deadline) {
+            t.Fatal("stream never subscribed")
+        }
+        time.Sleep(time.Millisecond)
+    }
+    return stream
+}
+
+func TestStreamConnectionEventsInOrder(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    streams, client := startEventStream(t, vpn, 0)
+    watched, other := mustKey(t).PublicKey(), mustKey(t).PublicKey()
+    
+    all := subscribe(t, streams, client, &StreamRequest{})
+    one := subscribe(t, streams, client, &StreamRequest{PublicKeys: []string{watched.String()}})
+    
+    vpn.emitEvent(Event{Type: EventPeerConnected, PublicKey: watched})
+    vpn.emitEvent(Event{Type: EventPortHop, PublicKey: watched}) // not a connection event
+    vpn.emitEvent(Event{Type: EventPeerFailed, PublicKey: other, FailedOver: true, DegradationReason: DropReplayWindow})
+    vpn.emitEvent(Event{Type: EventPeerFailed, PublicKey: watched})
+    vpn.emitEvent(Event{Type: EventPeerRecovered, PublicKey: watched})
+    
+    want := []PeerEvent_Kind{PeerEvent_ESTABLISHED, PeerEvent_DEGRADED, PeerEvent_FAILED, PeerEvent_RECOVERED}
+    var last uint64
+    for i, kind := range want {
+        ev, err := all.Recv()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if ev.Kind != kind || ev.Sequence <= last {
+            t.Fatalf("event %d = %v", i, ev)
+        }
+        last = ev.Sequence
+        if kind == PeerEvent_DEGRADED && (ev.PublicKey != other.String() || ev.DegradationReason != DropReplayWindow.String()) {
+            t.Fatalf("degraded event = %v", ev)
+        }
+    }
+    
+    for i, kind := range []PeerEvent_Kind{PeerEvent_ESTABLISHED, PeerEvent_FAILED, PeerEvent_RECOVERED} {
+        ev, err := one.Recv()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if ev.Kind != kind || ev.PublicKey != watched.String() {
+            t.Fatalf("filtered event %d = %v", i, ev)
+        }
+    }
+}
+
+func TestStreamConnectionEventsDropsSlowSubscriber(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    streams := NewEventStreamServer(vpn, 0)
+    
+    // A subscriber whose stream isn't draining its buffer
+    slow := &eventSubscriber{events: make(chan *PeerEvent, 2), dropped: make(chan struct{})}
+    streams.subscribers.Store(slow, struct{}{})
+    
+    for i := 0; i < 3; i++ {
+        vpn.emitEvent(Event{Type: EventPeerFailed, PublicKey: mustKey(t).PublicKey()})
+    }
+    select {
+    case <-slow.dropped:
+    default:
+        t.Fatal("slow subscriber not dropped")
+    }
+    if streams.Subscribers() != 0 || len(slow.events) != 2 {
+        t.Fatalf("%d subscribers, %d events buffered", streams.Subscribers(), len(slow.events))
+    }
+    
+    // Later events don't reach it and don't block
+    vpn.emitEvent(Event{Type: EventPeerFailed, PublicKey: mustKey(t).PublicKey()})
+}
+
+func TestStreamConnectionEventsMaxAgeAndBadKey(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    streams, client := startEventStream(t, vpn, 50*time.Millisecond)
+    stream := subscribe(t, streams, client, &StreamRequest{})
+    
+    if _, err := stream.Recv(); status.Code(err) != codes.DeadlineExceeded {
+        t.Fatalf("stale stream ended with %v", err)
+    }
+    
+    bad, err := client.StreamConnectionEvents(context.Background(), &StreamRequest{PublicKeys: []string{"not a key"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := bad.Recv(); status.Code(err) != codes.InvalidArgument {
+        t.Fatalf("invalid key gave %v", err)
+    }
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "sort"
+    "strings"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var ErrNoExitAvailable = errors.New("no live peer matches the exit criteria")
+
+// Default routes, owned by at most one peer at a time
+var defaultRoutes = []net.IPNet{
+    {IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+    {IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+}
+
+// PeerMetadata describes an exit for selection, see SelectExit
+type PeerMetadata struct {
+    CountryCode string   // ISO 3166-1 alpha-2, e.g. "DE"
+    City        string
+    Provider    string
+    Features    []string // e.g. "streaming", "p2p"
+}
+
+func (m PeerMetadata) empty() bool {
+    return m.CountryCode == "" && m.City == "" && m.Provider == "" && len(m.Features) == 0
+}
+
+func (m PeerMetadata) hasFeature(feature string) bool {
+    for _, f := range m.Features {
+        if strings.EqualFold(f, feature) {
+            return true
+        }
+    }
+    return false
+}
+
+// ExitCriteria filters exits by metadata. Empty fields match anything,
+// every listed feature is required.
+type ExitCriteria struct {
+    CountryCode string
+    City        string
+    Provider    string
+    Features    []string
+    
+    // Move the default routes to the chosen exit
+    SwitchDefault bool
+}
+
+func (c ExitCriteria) matches(m PeerMetadata) bool {
+    if c.CountryCode != "" && !strings.EqualFold(c.CountryCode, m.CountryCode) {
+        return false
+    }
+    if c.City != "" && !strings.EqualFold(c.City, m.City) {
+        return false
+    }
+    if c.Provider != "" && !strings.EqualFold(c.Provider, m.Provider) {
+        return false
+    }
+    for _, feature := range c.Features {
+        if !m.hasFeature(feature) {
+            return false
+        }
+    }
+    return true
+}
+
+// SelectExit picks the live peer matching criteria with the best health
+// data: lowest load score, then lowest latency. With SwitchDefault the
+// default routes move to it.
+func (vpn *UnderTheRadarVPN) SelectExit(criteria ExitCriteria) (PeerInfo, error) {
+    vpn.mu.Lock()
+    defer vpn.mu.Unlock()
+    
+    var candidates []*Peer
+    for _, peer := range vpn.peers.list {
+        if peer.IsAlive.Load() && criteria.matches(peer.Metadata()) {
+            candidates = append(candidates, peer)
+        }
+    }
+    if len(candidates) == 0 {
+        return PeerInfo{}, ErrNoExitAvailable
+    }
+    
+    sort.Slice(candidates, func(i, j int) bool {
+        a, b := candidates[i], candidates[j]
+        if sa, sb := a.LoadScore.Load(), b.LoadScore.Load(); sa != sb {
+            return sa < sb
+        }
+        if la, lb := a.CurrentLatency.Load(), b.CurrentLatency.Load(); la != lb {
+            return la < lb
+        }
+        return a.PublicKey.String() < b.PublicKey.String()
+    })
+    exit := candidates[0]
+    
+    if criteria.SwitchDefault {
+        if err := vpn.switchDefaultLocked(exit); err != nil {
+            return PeerInfo{}, err
+        }
+    }
+    return vpn.peerInfoLocked(exit), nil
+}
+
+// Move the default routes to exit. The kernel moves a prefix to the last
+// peer that claims it in one update, so traffic never lacks an owner inside
+// the device and the kill switch, which accepts anything leaving through
+// it, is never relaxed. Caller holds vpn.mu.
+func (vpn *UnderTheRadarVPN) switchDefaultLocked(exit *Peer) error {
+    // Move the families that have a default, both when none does yet
+    anyOwned := false
+    for _, route := range defaultRoutes {
+        anyOwned = anyOwned || vpn.prefixOwnerLocked(prefixKey(route)) != nil
+    }
+    
+    var previous *Peer
+    var missing []net.IPNet
+    for _, route := range defaultRoutes {
+        owner := vpn.prefixOwnerLocked(prefixKey(route))
+        owned := owner != nil
+        if owned && owner != exit {
+            previous = owner
+        }
+        if (owned || !anyOwned) && owner != exit {
+            missing = append(missing, route)
+        }
+    }
+    if len(missing) == 0 {
+        return nil
+    }
+    
+    allowedIPs := make([]net.IPNet, 0, len(exit.AllowedIPs)+len(missing))
+    allowedIPs = append(allowedIPs, exit.AllowedIPs...)
+    allowedIPs = append(allowedIPs, missing...)
+    
+    cfg := wgtypes.Config{
+        Peers: []wgtypes.PeerConfig{{
+            PublicKey:         exit.PublicKey,
+            UpdateOnly:        true,
+            ReplaceAllowedIPs: true,
+            AllowedIPs:        allowedIPs,
+        }},
+    }
+    if err := vpn.wgClient.ConfigureDevice(vpn.deviceName, cfg); err != nil {
+        return fmt.Errorf("failed to move default route: %w", err)
+    }
+    
+    // Mirror the kernel: the old owner loses the routes, the exit gains them
+    claims := vpn.allowedIPClaimsLocked(&Peer{PublicKey: exit.PublicKey, AllowedIPs: missing})
+    vpn.reassignAllowedIPsLocked(exit, claims)
+    exit.AllowedIPs = allowedIPs
+    for _, route := range missing {
+        vpn.indexPrefixLocked(route, exit)
+    }
+    vpn.countAllowedIPsLocked(exit, allowedIPs)
+    
+    message := fmt.Sprintf("default route moved to %s", exit.PublicKey)
+    if previous != nil {
+        message = fmt.Sprintf("default route moved from %s to %s", previous.PublicKey, exit.PublicKey)
+    }
+    if exit.Metadata().CountryCode != "" {
+        message += fmt.Sprintf(" (%s)", exit.Metadata().CountryCode)
+    }
+    vpn.emitEvent(Event{Type: EventExitChanged, PublicKey: exit.PublicKey, Message: message})
+    return nil
+}
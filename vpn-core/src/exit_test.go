@@ -0,0 +1,144 @@
+package main
+
+import (
+    "errors"
+    "net"
+    "testing"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type testExit struct {
+    country  string
+    features []string
+    score    uint64
+}
+
+// Live peers with metadata and health data, keyed by country and score
+func addExits(t *testing.T, vpn *UnderTheRadarVPN, exits []testExit) []wgtypes.Key {
+    t.Helper()
+    var keys []wgtypes.Key
+    for i, e := range exits {
+        pc := PeerConfig{
+            PublicKey:  mustKey(t).PublicKey(),
+            Endpoint:   &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i+1)), Port: 51820},
+            AllowedIPs: []net.IPNet{{IP: net.IPv4(10, byte(i), 0, 1).To4(), Mask: net.CIDRMask(32, 32)}},
+            Metadata:   PeerMetadata{CountryCode: e.country, Features: e.features},
+            SkipProbe:  true,
+        }
+        if err := vpn.AddPeer(pc); err != nil {
+            t.Fatal(err)
+        }
+        peer := vpn.peers.get(pc.PublicKey)
+        peer.IsAlive.Store(true)
+        peer.LoadScore.Store(e.score)
+        keys = append(keys, pc.PublicKey)
+    }
+    return keys
+}
+
+// Peers the fake kernel routes the IPv4 default to
+func defaultOwners(t *testing.T, wg *fakeWGClient, device string) []wgtypes.Key {
+    t.Helper()
+    dev, err := wg.Device(device)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var owners []wgtypes.Key
+    for _, peer := range dev.Peers {
+        for _, prefix := range peer.AllowedIPs {
+            if prefixKey(prefix) == "0.0.0.0/0" {
+                owners = append(owners, peer.PublicKey)
+            }
+        }
+    }
+    return owners
+}
+
+func TestSelectExitFiltersAndRanks(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    keys := addExits(t, vpn, []testExit{
+        {"DE", []string{"streaming"}, 500},
+        {"DE", []string{"streaming", "p2p"}, 200},
+        {"DE", nil, 100},
+        {"US", []string{"streaming"}, 50},
+    })
+    
+    exit, err := vpn.SelectExit(ExitCriteria{CountryCode: "de", Features: []string{"Streaming"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if exit.PublicKey != keys[1] || exit.Metadata.CountryCode != "DE" {
+        t.Fatalf("picked %+v, want the least loaded German streaming exit", exit)
+    }
+    
+    vpn.peers.get(keys[1]).IsAlive.Store(false)
+    if exit, _ := vpn.SelectExit(ExitCriteria{CountryCode: "DE", Features: []string{"streaming"}}); exit.PublicKey != keys[0] {
+        t.Fatal("a dead exit was selected")
+    }
+    if _, err := vpn.SelectExit(ExitCriteria{CountryCode: "JP"}); !errors.Is(err, ErrNoExitAvailable) {
+        t.Fatalf("err = %v, want ErrNoExitAvailable", err)
+    }
+    
+    peers := vpn.ListPeers()
+    if len(peers) != 4 {
+        t.Fatalf("ListPeers returned %d peers", len(peers))
+    }
+    for _, p := range peers {
+        if p.Metadata.CountryCode == "" {
+            t.Fatalf("metadata missing from %+v", p)
+        }
+    }
+}
+
+func TestSelectExitSwitchesDefaultRoute(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn, log := newSimulatedVPN(t, wg)
+    if err := vpn.Start(VPNConfig{ListenPort: 51820, KillSwitch: true}); err != nil {
+        t.Fatal(err)
+    }
+    defer vpn.Stop()
+    keys := addExits(t, vpn, []testExit{{"DE", nil, 10}, {"US", nil, 10}})
+    
+    if _, err := vpn.SelectExit(ExitCriteria{CountryCode: "DE", SwitchDefault: true}); err != nil {
+        t.Fatal(err)
+    }
+    if owners := defaultOwners(t, wg, "sim0"); len(owners) != 1 || owners[0] != keys[0] {
+        t.Fatalf("default owned by %v", owners)
+    }
+    
+    // The move is one device update and never touches the kill switch
+    configs, commands := len(wg.configs), len(log.commands)
+    if _, err := vpn.SelectExit(ExitCriteria{CountryCode: "US", SwitchDefault: true}); err != nil {
+        t.Fatal(err)
+    }
+    if len(wg.configs) != configs+1 || len(log.commands) != commands {
+        t.Fatalf("switch took %d device updates and ran %v", len(wg.configs)-configs, log.commands[commands:])
+    }
+    if owners := defaultOwners(t, wg, "sim0"); len(owners) != 1 || owners[0] != keys[1] {
+        t.Fatalf("default owned by %v", owners)
+    }
+    if owner := vpn.routePacket(net.IPv4(93, 184, 216, 34)); owner == nil || owner.PublicKey != keys[1] {
+        t.Fatal("routing still uses the old exit")
+    }
+    if old := vpn.peers.get(keys[0]); len(old.AllowedIPs) != 1 {
+        t.Fatalf("old exit kept %v", old.AllowedIPs)
+    }
+    
+    var changed int
+    for len(vpn.Events()) > 0 {
+        if ev := <-vpn.Events(); ev.Type == EventExitChanged {
+            changed++
+        }
+    }
+    if changed != 2 {
+        t.Fatalf("%d exit-changed events, want 2", changed)
+    }
+    
+    // Already the exit, nothing to do
+    configs = len(wg.configs)
+    vpn.SelectExit(ExitCriteria{CountryCode: "US", SwitchDefault: true})
+    if len(wg.configs) != configs {
+        t.Fatal("reselecting the current exit reconfigured the device")
+    }
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Keep tests away from the host's resolver configuration
+func TestMain(m *testing.M) {
+    dir, err := os.MkdirTemp("", "utr-resolver")
+    if err != nil {
+        panic(err)
+    }
+    resolvConfPath = filepath.Join(dir, "resolv.conf")
+    resolvedRuntimeDir = filepath.Join(dir, "systemd")
+    resolverStateDir = filepath.Join(dir, "state")
+    drainStateDir = filepath.Join(dir, "state")
+    lookPath = func(string) (string, error) { return "", exec.ErrNotFound }
+    resolvconfAdd = func(string, []byte) error { return errors.New("resolvconf not available in tests") }
+    
+    code := m.Run()
+    os.RemoveAll(dir)
+    os.Exit(code)
+}
+
+// fakeWGClient is an in-memory stand-in for wgctrl.Client
+type fakeWGClient struct {
+    mu      sync.Mutex
+    devices map[string]*wgtypes.Device
+    configs []wgtypes.Config
+    closed  bool
+}
+
+func newFakeWGClient() *fakeWGClient {
+    return &fakeWGClient{devices: make(map[string]*wgtypes.Device)}
+}
+
+func (f *fakeWGClient) Device(name string) (*wgtypes.Device, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    
+    dev, ok := f.devices[name]
+    if !ok {
+        return nil, fmt.Errorf("device %s: %w", name, os.ErrNotExist)
+    }
+    copied := *dev
+    copied.Peers = append([]wgtypes.Peer(nil), dev.Peers...)
+    return &copied, nil
+}
+
+// ConfigureDevice applies cfg to the in-memory device the way the kernel would
+func (f *fakeWGClient) ConfigureDevice(name string, cfg wgtypes.Config) error {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    
+    f.configs = append(f.configs, cfg)
+    
+    dev, ok := f.devices[name]
+    if !ok {
+        dev = &wgtypes.Device{Name: name}
+        f.devices[name] = dev
+    }
+    if cfg.PrivateKey != nil {
+        dev.PrivateKey = *cfg.PrivateKey
+        dev.PublicKey = cfg.PrivateKey.PublicKey()
+    }
+    if cfg.ListenPort != nil {
+        dev.ListenPort = *cfg.ListenPort
+    }
+    if cfg.FirewallMark != nil {
+        dev.FirewallMark = *cfg.FirewallMark
+    }
+    if cfg.ReplacePeers {
+        dev.Peers = nil
+    }
+    
+    for _, pc := range cfg.Peers {
+        idx := -1
+        for i := range dev.Peers {
+            if dev.Peers[i].PublicKey == pc.PublicKey {
+                idx = i
+                break
+            }
+        }
+        
+        if pc.Remove {
+            if idx >= 0 {
+                dev.Peers = append(dev.Peers[:idx], dev.Peers[idx+1:]...)
+            }
+            continue
+        }
+        if idx < 0 {
+            if pc.UpdateOnly {
+                continue
+            }
+            dev.Peers = append(dev.Peers, wgtypes.Peer{PublicKey: pc.PublicKey})
+            idx = len(dev.Peers) - 1
+        }
+        
+        peer := &dev.Peers[idx]
+        if pc.Endpoint != nil {
+            peer.Endpoint = pc.Endpoint
+        }
+        if pc.PresharedKey != nil {
+            peer.PresharedKey = *pc.PresharedKey
+        }
+        if pc.ReplaceAllowedIPs {
+            peer.AllowedIPs = nil
+        }
+        peer.AllowedIPs = append(peer.AllowedIPs, pc.AllowedIPs...)
+        
+        // A prefix belongs to one peer, the last to claim it
+        for j := range dev.Peers {
+            if j != idx {
+                dev.Peers[j].AllowedIPs = withoutPrefixes(dev.Peers[j].AllowedIPs, pc.AllowedIPs)
+            }
+        }
+    }
+    
+    return nil
+}
+
+func withoutPrefixes(list, remove []net.IPNet) []net.IPNet {
+    drop := make(map[string]bool, len(remove))
+    for _, prefix := range remove {
+        drop[prefixKey(prefix)] = true
+    }
+    
+    var kept []net.IPNet
+    for _, prefix := range list {
+        if !drop[prefixKey(prefix)] {
+            kept = append(kept, prefix)
+        }
+    }
+    return kept
+}
+
+// The peer the fake kernel routes prefix to
+func (f *fakeWGClient) allowedIPOwner(device, prefix string) (wgtypes.Key, bool) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    
+    if dev, ok := f.devices[device]; ok {
+        for _, p := range dev.Peers {
+            for _, allowed := range p.AllowedIPs {
+                if prefixKey(allowed) == prefix {
+                    return p.PublicKey, true
+                }
+            }
+        }
+    }
+    return wgtypes.Key{}, false
+}
+
+// Public keys of the peers currently on the fake device
+func (f *fakeWGClient) peerKeys(device string) map[wgtypes.Key]bool {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    
+    keys := make(map[wgtypes.Key]bool)
+    if dev, ok := f.devices[device]; ok {
+        for _, p := range dev.Peers {
+            keys[p.PublicKey] = true
+        }
+    }
+    return keys
+}
+
+func (f *fakeWGClient) Close() error {
+    f.closed = true
+    return nil
+}
+
+// Replace a peer's kernel-reported state on the fake device
+func (f *fakeWGClient) setPeer(device string, peer wgtypes.Peer) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    
+    dev, ok := f.devices[device]
+    if !ok {
+        dev = &wgtypes.Device{Name: device}
+        f.devices[device] = dev
+    }
+    for i := range dev.Peers {
+        if dev.Peers[i].PublicKey == peer.PublicKey {
+            dev.Peers[i] = peer
+            return
+        }
+    }
+    dev.Peers = append(dev.Peers, peer)
+}
+
+// Record system commands instead of executing them for the duration of a test
+func recordSystemCommands(t *testing.T) *[]string {
+    var mu sync.Mutex
+    var commands []string
+    
+    orig := runSystemCommand
+    runSystemCommand = func(cmdline string) error {
+        mu.Lock()
+        defer mu.Unlock()
+        commands = append(commands, cmdline)
+        return nil
+    }
+    t.Cleanup(func() { runSystemCommand = orig })
+    
+    return &commands
+}
+
+// fakeHost tracks the firewall rules and links that system commands would
+// leave behind, failing any command containing failOn
+type fakeHost struct {
+    mu      sync.Mutex
+    failOn  string
+    rules   map[string]int
+    chains  map[string]bool
+    links   map[string]bool
+    log     []string // every command run, in order
+}
+
+func newFakeHost(failOn string) *fakeHost {
+    return &fakeHost{
+        failOn: failOn,
+        rules:  make(map[string]int),
+        chains: make(map[string]bool),
+        links:  make(map[string]bool),
+    }
+}
+
+func installFakeHost(t *testing.T, failOn string) *fakeHost {
+    host := newFakeHost(failOn)
+    
+    orig := runSystemCommand
+    runSystemCommand = host.run
+    t.Cleanup(func() { runSystemCommand = orig })
+    
+    return host
+}
+
+func (h *fakeHost) run(cmdline string) error {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    
+    h.log = append(h.log, cmdline)
+    if h.failOn != "" && strings.Contains(cmdline, h.failOn) {
+        return fmt.Errorf("injected failure: %s", cmdline)
+    }
+    
+    fields := strings.Fields(cmdline)
+    switch {
+    case len(fields) > 2 && (fields[0] == "iptables" || fields[0] == "ip6tables"):
+        // Rules outside the filter table are keyed with the table name
+        table := ""
+        if fields[1] == "-t" && len(fields) > 4 {
+            table = fields[2] + " "
+            fields = append(fields[:1], fields[3:]...)
+        }
+        key := fields[0] + " " + table + strings.Join(fields[2:], " ")
+        switch fields[1] {
+        case "-A", "-I":
+            h.rules[key]++
+        case "-D":
+            if h.rules[key] == 0 {
+                return fmt.Errorf("no such rule: %s", cmdline)
+            }
+            if h.rules[key]--; h.rules[key] == 0 {
+                delete(h.rules, key)
+            }
+        case "-N":
+            if h.chains[key] {
+                return fmt.Errorf("chain already exists: %s", cmdline)
+            }
+            h.chains[key] = true
+        case "-X":
+            if !h.chains[key] {
+                return fmt.Errorf("no such chain: %s", cmdline)
+            }
+            delete(h.chains, key)
+        }
+    case len(fields) >= 5 && fields[0] == "ip" && fields[1] == "link" && fields[3] == "dev":
+        switch fields[2] {
+        case "add":
+            h.links[fields[4]] = true
+        case "del":
+            delete(h.links, fields[4])
+        }
+    }
+    return nil
+}
+
+// Build a VPN wired to fakes, skipping eBPF and wgctrl setup
+func newTestVPN(t *testing.T, wg *fakeWGClient) *UnderTheRadarVPN {
+    t.Helper()
+    
+    return &UnderTheRadarVPN{
+        wgClient:     wg,
+        deviceName:   "utr0",
+        keys:         newKeyStore(),
+        pinhole:      NewInputPinhole(),
+        mssClamp:     NewMSSClamp(),
+        hopRedirect:  NewPortHopRedirect(),
+        loadWeights:  DefaultLoadWeights,
+        priorityWeights: DefaultPriorityWeights,
+        peersByIP:    make(map[string]*prefixPeers),
+        events:       make(chan Event, eventBufferSize),
+        capabilities: defaultCapabilities(),
+    }
+}
+
+// Commands run so far, failed ones included
+func (h *fakeHost) commands() []string {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    
+    return append([]string(nil), h.log...)
+}
+
+// Build a VPN through its options constructor on wg and a fake host, as
+// NewUnderTheRadarVPN would but without eBPF
+func newHostTestVPN(t *testing.T, wg *fakeWGClient) (*UnderTheRadarVPN, *fakeHost) {
+    t.Helper()
+    
+    host := newFakeHost("")
+    vpn, err := NewUnderTheRadarVPNWithOptions(VPNOptions{
+        DeviceName: "utr0",
+        WGClient:   wg,
+        Commands:   host.run,
+        EBPF:       NoEBPF{},
+        LockDir:    t.TempDir(),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(vpn.healthCheck.Stop)
+    return vpn, host
+}
+
+// Move clock on by step until done holds, for code waiting on the clock in
+// another goroutine
+func advanceUntil(t *testing.T, clock *FakeClock, step time.Duration, done func() bool) {
+    t.Helper()
+    
+    deadline := time.Now().Add(5 * time.Second)
+    for !done() {
+        if time.Now().After(deadline) {
+            t.Fatal("condition not met advancing the clock")
+        }
+        clock.Advance(step)
+        time.Sleep(time.Millisecond)
+    }
+}
+
+func mustKey(t *testing.T) wgtypes.Key {
+    t.Helper()
+    
+    key, err := wgtypes.GeneratePrivateKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return key
+}
+
+func mustCIDR(t *testing.T, s string) net.IPNet {
+    t.Helper()
+    
+    _, ipnet, err := net.ParseCIDR(s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return *ipnet
+}
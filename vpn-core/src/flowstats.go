@@ -0,0 +1,117 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "sort"
+    "time"
+    
+    "github.com/cilium/ebpf"
+)
+
+// Flows idle this long are removed by FlushFlows
+const staleFlowAge = 60 * time.Second
+
+// FlowStats is the traffic of one IPv4 flow through the tunnel. Src is the
+// address on the far side of the tunnel, Dst the one on ours.
+type FlowStats struct {
+    Src      net.IP
+    Dst      net.IP
+    SrcPort  uint16
+    DstPort  uint16
+    Protocol uint8
+    RxBytes  uint64 // received from the tunnel
+    TxBytes  uint64 // sent into the tunnel
+    Packets  uint64
+    Idle     time.Duration // since the last packet
+}
+
+func (f FlowStats) Bytes() uint64 {
+    return f.RxBytes + f.TxBytes
+}
+
+// flowCounters mirrors struct flow_counters
+type flowCounters struct {
+    RxBytes    uint64
+    TxBytes    uint64
+    Packets    uint64
+    LastSeenNs uint64
+}
+
+// TopFlows returns the n flows that moved the most bytes through the
+// tunnel, most first. The programs keep the 65536 most recently active
+// flows. Nil without the eBPF programs.
+func (vpn *UnderTheRadarVPN) TopFlows(n int) []FlowStats {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    m, ok := vpn.ebpfMaps["flow_stats"]
+    if !ok {
+        return nil
+    }
+    
+    now := uint64(monotonicNow())
+    var flows []FlowStats
+    var key conntrackKey
+    var c flowCounters
+    for iter := m.Iterate(); iter.Next(&key, &c); {
+        flows = append(flows, FlowStats{
+            Src:      key.SrcIP,
+            Dst:      key.DstIP,
+            SrcPort:  key.SrcPort,
+            DstPort:  key.DstPort,
+            Protocol: key.Protocol,
+            RxBytes:  c.RxBytes,
+            TxBytes:  c.TxBytes,
+            Packets:  c.Packets,
+            Idle:     time.Duration(now - min(now, c.LastSeenNs)),
+        })
+    }
+    return topFlows(flows, n)
+}
+
+// Sort flows by bytes and keep the first n, ties by packets so the order
+// is stable
+func topFlows(flows []FlowStats, n int) []FlowStats {
+    sort.Slice(flows, func(i, j int) bool {
+        if flows[i].Bytes() != flows[j].Bytes() {
+            return flows[i].Bytes() > flows[j].Bytes()
+        }
+        return flows[i].Packets > flows[j].Packets
+    })
+    if n >= 0 && n < len(flows) {
+        flows = flows[:n]
+    }
+    return flows
+}
+
+// FlushFlows removes flows idle for a minute, returning how many. The map
+// evicts the least recently used flows once full, flushing keeps finished
+// ones out of TopFlows.
+func (vpn *UnderTheRadarVPN) FlushFlows() (int, error) {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    m, ok := vpn.ebpfMaps["flow_stats"]
+    if !ok {
+        return 0, nil
+    }
+    
+    now := monotonicNow()
+    var stale []conntrackKey
+    var key conntrackKey
+    var c flowCounters
+    for iter := m.Iterate(); iter.Next(&key, &c); {
+        if now-time.Duration(c.LastSeenNs) > staleFlowAge {
+            stale = append(stale, key)
+        }
+    }
+    for i, key := range stale {
+        // Unless evicted meanwhile
+        if err := m.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+            return i, fmt.Errorf("failed to remove flow: %w", err)
+        }
+    }
+    return len(stale), nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+    "net"
+    "os"
+    "testing"
+    "time"
+    
+    "github.com/cilium/ebpf"
+)
+
+func TestTopFlowsOrder(t *testing.T) {
+    flows := []FlowStats{
+        {DstPort: 22, RxBytes: 100, TxBytes: 100},
+        {DstPort: 443, RxBytes: 9000, TxBytes: 1000},
+        {DstPort: 53, TxBytes: 200, Packets: 4},
+        {DstPort: 80, RxBytes: 5000},
+    }
+    top := topFlows(flows, 3)
+    if len(top) != 3 || top[0].DstPort != 443 || top[1].DstPort != 80 || top[2].DstPort != 53 {
+        t.Fatalf("top = %+v", top)
+    }
+    if all := topFlows(top, 10); len(all) != 3 {
+        t.Fatalf("asking for more than there are returned %d", len(all))
+    }
+}
+
+func TestConntrackKeyRoundTrip(t *testing.T) {
+    key := conntrackKey{SrcIP: net.IPv4(10, 8, 0, 2), DstIP: net.IPv4(1, 1, 1, 1), SrcPort: 40000, DstPort: 443, Protocol: 6}
+    buf, err := key.MarshalBinary()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var back conntrackKey
+    if err := back.UnmarshalBinary(buf); err != nil {
+        t.Fatal(err)
+    }
+    if !back.SrcIP.Equal(key.SrcIP) || !back.DstIP.Equal(key.DstIP) || back.SrcPort != 40000 || back.DstPort != 443 || back.Protocol != 6 {
+        t.Fatalf("round trip gave %+v", back)
+    }
+}
+
+func TestTopFlowsFromMap(t *testing.T) {
+    if os.Geteuid() != 0 {
+        t.Skip("creating eBPF maps requires root")
+    }
+    
+    // Same layout as flow_stats in ebpf/xdp_accelerator.c
+    m, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.LRUHash, KeySize: 13, ValueSize: 32, MaxEntries: 16})
+    if err != nil {
+        t.Skipf("eBPF maps unavailable: %v", err)
+    }
+    defer m.Close()
+    
+    now := uint64(monotonicNow())
+    flows := []struct {
+        port     uint16
+        counters flowCounters
+    }{
+        {22, flowCounters{RxBytes: 4000, TxBytes: 4000, Packets: 80, LastSeenNs: now}},
+        {443, flowCounters{RxBytes: 90000, TxBytes: 3000, Packets: 70, LastSeenNs: now}},
+        {53, flowCounters{RxBytes: 300, TxBytes: 100, Packets: 4, LastSeenNs: now - uint64(2*time.Minute)}},
+    }
+    for _, f := range flows {
+        key := conntrackKey{SrcIP: net.IPv4(93, 184, 216, 34), DstIP: net.IPv4(10, 8, 0, 2), SrcPort: f.port, DstPort: 40000, Protocol: 6}
+        if err := m.Put(key, f.counters); err != nil {
+            t.Fatal(err)
+        }
+    }
+    
+    vpn := newTestVPN(t, newFakeWGClient())
+    vpn.ebpfMaps = map[string]*ebpf.Map{"flow_stats": m}
+    
+    top := vpn.TopFlows(2)
+    if len(top) != 2 || top[0].SrcPort != 443 || top[1].SrcPort != 22 {
+        t.Fatalf("TopFlows = %+v", top)
+    }
+    if !top[0].Src.Equal(net.IPv4(93, 184, 216, 34)) || top[0].Bytes() != 93000 {
+        t.Fatalf("top flow = %+v", top[0])
+    }
+    
+    if n, err := vpn.FlushFlows(); err != nil || n != 1 {
+        t.Fatalf("FlushFlows = %d, %v, want the idle DNS flow", n, err)
+    }
+    if all := vpn.TopFlows(10); len(all) != 2 {
+        t.Fatalf("%d flows left after flushing", len(all))
+    }
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    // Outer IPv6 and UDP headers, WireGuard's data header and its
+    // authentication tag. IPv4 needs 20 bytes less, like wg-quick we plan
+    // for the worst case.
+    wireGuardOverhead = 40 + 8 + 16 + 16
+    
+    ipv4HeaderMin  = 20
+    ipv4MaxPacket  = 65535
+    ipv4FlagDF     = 0x4000
+    ipv4FlagMF     = 0x2000
+    ipv4OffsetMask = 0x1fff
+    
+    DefaultReassemblyTimeout = 30 * time.Second // like the kernel's ipfrag_time
+    DefaultMaxReassemblies   = 256
+)
+
+var (
+    ErrCannotFragment       = errors.New("packet is not IPv4 and larger than the tunnel MTU")
+    ErrBadFragment          = errors.New("malformed IPv4 fragment")
+    ErrOverlappingFragments = errors.New("fragments overlap, packet dropped")
+)
+
+// Overhead is what obfuscation adds to every packet
+func (ob *Obfuscator) Overhead() int {
+    if !ob.enabled.Load() {
+        return 0
+    }
+    n := 0
+    if ob.shaper.Load() != nil {
+        n += shapingHeader
+    } else if ob.padder.Load() != nil {
+        n += paddingLengthPrefix
+    }
+    switch ob.mode {
+    case ObfuscationXOR:
+        n += 1 // key ID
+    case ObfuscationTLS:
+        n += tlsRecordHeaderSize
+    case ObfuscationHTTP:
+        n += len(fmt.Sprintf(httpObfuscationHeader, ipv4MaxPacket))
+    }
+    return n
+}
+
+// EffectiveMTU is the largest inner packet a link of linkMTU carries once
+// WireGuard and obfuscation have added their headers
+func EffectiveMTU(linkMTU int, ob *Obfuscator) int {
+    mtu := linkMTU - wireGuardOverhead
+    if ob != nil {
+        mtu -= ob.Overhead()
+    }
+    return mtu
+}
+
+// Fragmenter splits IPv4 packets larger than the tunnel MTU into
+// fragments that each fit one WireGuard packet. The far end puts them
+// back together with a Reassembler before the packet leaves the tunnel, so
+// fragments are made even when the packet asks not to be fragmented: it
+// is whole again before any router could see it.
+type Fragmenter struct {
+    mtu    int
+    nextID atomic.Uint32
+}
+
+func NewFragmenter(mtu int) *Fragmenter {
+    return &Fragmenter{mtu: mtu}
+}
+
+// Fragment returns packet split to the MTU, or packet alone when it fits.
+// All fragments share a freshly assigned identification.
+func (f *Fragmenter) Fragment(packet []byte) ([][]byte, error) {
+    if len(packet) <= f.mtu {
+        return [][]byte{packet}, nil
+    }
+    if len(packet) < ipv4HeaderMin || packet[0]>>4 != 4 {
+        return nil, ErrCannotFragment
+    }
+    headerLen := int(packet[0]&0x0f) * 4
+    total := int(binary.BigEndian.Uint16(packet[2:4]))
+    if headerLen < ipv4HeaderMin || total < headerLen || total > len(packet) {
+        return nil, ErrBadFragment
+    }
+    
+    // Fragment payloads are multiples of 8 bytes, except the last
+    chunk := (f.mtu - headerLen) &^ 7
+    if chunk <= 0 {
+        return nil, fmt.Errorf("tunnel MTU %d too small to fragment", f.mtu)
+    }
+    
+    // A packet that is itself a fragment keeps its place in the original,
+    // and the original's ID so its pieces reassemble with the rest
+    flags := binary.BigEndian.Uint16(packet[6:8])
+    baseOffset := int(flags&ipv4OffsetMask) * 8
+    id := binary.BigEndian.Uint16(packet[4:6])
+    if flags&(ipv4OffsetMask|ipv4FlagMF) == 0 {
+        id = uint16(f.nextID.Add(1))
+    }
+    
+    payload := packet[headerLen:total]
+    var fragments [][]byte
+    for start := 0; start < len(payload); start += chunk {
+        end := min(start+chunk, len(payload))
+        frag := make([]byte, headerLen+end-start)
+        copy(frag, packet[:headerLen])
+        copy(frag[headerLen:], payload[start:end])
+        
+        fragFlags := flags&ipv4FlagDF | uint16((baseOffset+start)/8)
+        if end < len(payload) || flags&ipv4FlagMF != 0 {
+            fragFlags |= ipv4FlagMF
+        }
+        binary.BigEndian.PutUint16(frag[2:4], uint16(len(frag)))
+        binary.BigEndian.PutUint16(frag[4:6], id)
+        binary.BigEndian.PutUint16(frag[6:8], fragFlags)
+        setIPv4Checksum(frag[:headerLen])
+        fragments = append(fragments, frag)
+    }
+    return fragments, nil
+}
+
+func setIPv4Checksum(header []byte) {
+    header[10], header[11] = 0, 0
+    var sum uint32
+    for i := 0; i+1 < len(header); i += 2 {
+        sum += uint32(binary.BigEndian.Uint16(header[i:]))
+    }
+    for sum > 0xffff {
+        sum = sum&0xffff + sum>>16
+    }
+    binary.BigEndian.PutUint16(header[10:], ^uint16(sum))
+}
+
+// ReassemblyStats counts what a Reassembler did
+type ReassemblyStats struct {
+    Pending     int    // packets waiting for fragments
+    Reassembled uint64
+    Evicted     uint64 // timed out or pushed out by newer packets
+    Dropped     uint64 // malformed or overlapping fragments
+}
+
+type fragmentKey struct {
+    src   [4]byte
+    id    uint16
+    proto uint8
+}
+
+type fragmentPart struct {
+    offset int
+    data   []byte
+}
+
+// One packet being put back together
+type reassembly struct {
+    started  time.Time
+    header   []byte // of the first fragment
+    parts    []fragmentPart
+    received int
+    total    int // payload length, -1 until the last fragment arrives
+}
+
+// Reassembler puts fragmented IPv4 packets back together. Fragments are
+// matched on source, identification and protocol; a packet still missing
+// fragments after the timeout is evicted, as is the oldest one when too
+// many are pending.
+type Reassembler struct {
+    timeout    time.Duration
+    maxPending int
+    clock      Clock
+    
+    mu      sync.Mutex
+    pending map[fragmentKey]*reassembly
+    stats   ReassemblyStats
+}
+
+// NewReassembler evicts incomplete packets after timeout,
+// DefaultReassemblyTimeout when zero
+func NewReassembler(timeout time.Duration) *Reassembler {
+    if timeout <= 0 {
+        timeout = DefaultReassemblyTimeout
+    }
+    return &Reassembler{
+        timeout:    timeout,
+        maxPending: DefaultMaxReassemblies,
+        clock:      RealClock{},
+        pending:    make(map[fragmentKey]*reassembly),
+    }
+}
+
+// Add takes a received packet. It returns the packet unchanged when it
+// isn't a fragment, the whole packet when this fragment completed it and
+// nil while fragments are missing.
+func (r *Reassembler) Add(packet []byte) ([]byte, error) {
+    if len(packet) < ipv4HeaderMin || packet[0]>>4 != 4 {
+        return packet, nil
+    }
+    flags := binary.BigEndian.Uint16(packet[6:8])
+    if flags&(ipv4FlagMF|ipv4OffsetMask) == 0 {
+        return packet, nil
+    }
+    
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    
+    headerLen := int(packet[0]&0x0f) * 4
+    length := int(binary.BigEndian.Uint16(packet[2:4]))
+    if headerLen < ipv4HeaderMin || length < headerLen || length > len(packet) {
+        r.stats.Dropped++
+        return nil, ErrBadFragment
+    }
+    offset := int(flags&ipv4OffsetMask) * 8
+    data := packet[headerLen:length]
+    more := flags&ipv4FlagMF != 0
+    if offset+len(data) > ipv4MaxPacket-headerLen || more && len(data)%8 != 0 {
+        r.stats.Dropped++
+        return nil, ErrBadFragment
+    }
+    
+    now := r.clock.Now()
+    r.evictLocked(now)
+    
+    key := fragmentKey{id: binary.BigEndian.Uint16(packet[4:6]), proto: packet[9]}
+    copy(key.src[:], packet[12:16])
+    ra, ok := r.pending[key]
+    if !ok {
+        if len(r.pending) >= r.maxPending {
+            r.evictOldestLocked()
+        }
+        ra = &reassembly{started: now, total: -1}
+        r.pending[key] = ra
+    }
+    
+    for _, part := range ra.parts {
+        if offset < part.offset+len(part.data) && part.offset < offset+len(data) {
+            delete(r.pending, key)
+            r.stats.Dropped++
+            return nil, ErrOverlappingFragments
+        }
+    }
+    if !more {
+        if ra.total >= 0 {
+            delete(r.pending, key)
+            r.stats.Dropped++
+            return nil, ErrOverlappingFragments
+        }
+        ra.total = offset + len(data)
+    }
+    if offset == 0 {
+        ra.header = append([]byte(nil), packet[:headerLen]...)
+    }
+    ra.parts = append(ra.parts, fragmentPart{offset: offset, data: append([]byte(nil), data...)})
+    ra.received += len(data)
+    
+    // Nothing may follow the last fragment
+    if ra.total >= 0 {
+        for _, part := range ra.parts {
+            if part.offset+len(part.data) > ra.total {
+                delete(r.pending, key)
+                r.stats.Dropped++
+                return nil, ErrBadFragment
+            }
+        }
+    }
+    if ra.header == nil || ra.total < 0 || ra.received < ra.total {
+        return nil, nil
+    }
+    delete(r.pending, key)
+    
+    hl := len(ra.header)
+    whole := make([]byte, hl+ra.total)
+    copy(whole, ra.header)
+    for _, part := range ra.parts {
+        copy(whole[hl+part.offset:], part.data)
+    }
+    binary.BigEndian.PutUint16(whole[2:4], uint16(len(whole)))
+    binary.BigEndian.PutUint16(whole[6:8], binary.BigEndian.Uint16(ra.header[6:8])&ipv4FlagDF)
+    setIPv4Checksum(whole[:hl])
+    r.stats.Reassembled++
+    return whole, nil
+}
+
+func (r *Reassembler) evictLocked(now time.Time) {
+    for key, ra := range r.pending {
+        if now.Sub(ra.started) >= r.timeout {
+            delete(r.pending, key)
+            r.stats.Evicted++
+        }
+    }
+}
+
+func (r *Reassembler) evictOldestLocked() {
+    var oldest fragmentKey
+    var started time.Time
+    for key, ra := range r.pending {
+        if started.IsZero() || ra.started.Before(started) {
+            oldest, started = key, ra.started
+        }
+    }
+    delete(r.pending, oldest)
+    r.stats.Evicted++
+}
+
+func (r *Reassembler) Stats() ReassemblyStats {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    
+    r.evictLocked(r.clock.Now())
+    stats := r.stats
+    stats.Pending = len(r.pending)
+    return stats
+}
+
+// FragmentConn carries packets of any size over a packet connection whose
+// writes must fit mtu. Each Write is one packet, sent as one or more
+// fragments with a write each; Read returns whole packets once all their
+// fragments arrived, so its buffer must hold the largest packet.
+func FragmentConn(conn net.Conn, mtu int, reassemblyTimeout time.Duration) net.Conn {
+    return &fragmentedConn{
+        Conn:        conn,
+        fragmenter:  NewFragmenter(mtu),
+        reassembler: NewReassembler(reassemblyTimeout),
+        buf:         make([]byte, ipv4MaxPacket),
+    }
+}
+
+type fragmentedConn struct {
+    net.Conn
+    fragmenter  *Fragmenter
+    reassembler *Reassembler
+    
+    readMu sync.Mutex
+    buf    []byte
+}
+
+func (c *fragmentedConn) Write(p []byte) (int, error) {
+    fragments, err := c.fragmenter.Fragment(p)
+    if err != nil {
+        return 0, err
+    }
+    for _, frag := range fragments {
+        if _, err := c.Conn.Write(frag); err != nil {
+            return 0, err
+        }
+    }
+    return len(p), nil
+}
+
+func (c *fragmentedConn) Read(p []byte) (int, error) {
+    c.readMu.Lock()
+    defer c.readMu.Unlock()
+    
+    for {
+        n, err := c.Conn.Read(c.buf)
+        if err != nil {
+            return 0, err
+        }
+        packet, err := c.reassembler.Add(c.buf[:n])
+        if err != nil || packet == nil {
+            continue // the sender's packet is lost, like on any lossy path
+        }
+        if len(packet) > len(p) {
+            return 0, fmt.Errorf("read buffer of %d bytes for a %d byte packet", len(p), len(packet))
+        }
+        return copy(p, packet), nil
+    }
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+    "bytes"
+    "crypto/rand"
+    "encoding/binary"
+    "errors"
+    "net"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// mtuPath is one direction of a link carrying WireGuard packets: each
+// write is a datagram, and one that wouldn't fit linkMTU once encapsulated
+// is silently dropped like on the real path
+type mtuPath struct {
+    net.Conn
+    linkMTU int
+    packets chan []byte
+    dropped atomic.Int64
+}
+
+func newMTUPath(linkMTU int) *mtuPath {
+    return &mtuPath{linkMTU: linkMTU, packets: make(chan []byte, 64)}
+}
+
+func (p *mtuPath) Write(b []byte) (int, error) {
+    if len(b)+wireGuardOverhead > p.linkMTU {
+        p.dropped.Add(1)
+        return len(b), nil
+    }
+    p.packets <- append([]byte(nil), b...)
+    return len(b), nil
+}
+
+func (p *mtuPath) Read(b []byte) (int, error) {
+    select {
+    case packet := <-p.packets:
+        return copy(b, packet), nil
+    case <-time.After(time.Second):
+        return 0, errors.New("nothing arrived")
+    }
+}
+
+func (p *mtuPath) Close() error { return nil }
+
+// IPv4 UDP packet of size bytes with a random payload
+func ipv4Packet(t *testing.T, size int, id uint16) []byte {
+    t.Helper()
+    packet := make([]byte, size)
+    if _, err := rand.Read(packet[ipv4HeaderMin:]); err != nil {
+        t.Fatal(err)
+    }
+    packet[0] = 0x45
+    binary.BigEndian.PutUint16(packet[2:4], uint16(size))
+    binary.BigEndian.PutUint16(packet[4:6], id)
+    binary.BigEndian.PutUint16(packet[6:8], ipv4FlagDF)
+    packet[8] = 64
+    packet[9] = 17
+    copy(packet[12:16], net.IPv4(10, 100, 0, 2).To4())
+    copy(packet[16:20], net.IPv4(10, 100, 0, 9).To4())
+    setIPv4Checksum(packet[:ipv4HeaderMin])
+    return packet
+}
+
+func TestJumboPacketCrossesSmallMTU(t *testing.T) {
+    for _, tt := range obfuscationModes {
+        t.Run(tt.name, func(t *testing.T) {
+            ob := testObfuscator(tt.mode)
+            path := newMTUPath(1280)
+            mtu := EffectiveMTU(1280, ob)
+            jumbo := ipv4Packet(t, 9000, 0)
+            
+            // Unfragmented the packet never arrives
+            direct := ob.Wrap(path)
+            if _, err := direct.Write(jumbo); err != nil {
+                t.Fatal(err)
+            }
+            if path.dropped.Load() != 1 {
+                t.Fatal("oversized packet should be dropped by the path")
+            }
+            
+            sender := FragmentConn(ob.Wrap(path), mtu, 0)
+            receiver := FragmentConn(ob.Wrap(path), mtu, 0)
+            if _, err := sender.Write(jumbo); err != nil {
+                t.Fatal(err)
+            }
+            if path.dropped.Load() != 1 || len(path.packets) < 9000/mtu {
+                t.Fatalf("%d fragments sent, %d dropped", len(path.packets), path.dropped.Load()-1)
+            }
+            
+            buf := make([]byte, 9000)
+            n, err := receiver.Read(buf)
+            if err != nil {
+                t.Fatal(err)
+            }
+            got := buf[:n]
+            
+            // Identification is the fragmenter's, the rest is as sent
+            if !bytes.Equal(got[ipv4HeaderMin:], jumbo[ipv4HeaderMin:]) ||
+                !bytes.Equal(got[:4], jumbo[:4]) || !bytes.Equal(got[6:10], jumbo[6:10]) || !bytes.Equal(got[12:20], jumbo[12:20]) {
+                t.Fatal("reassembled packet differs from the one sent")
+            }
+            check := append([]byte(nil), got[:ipv4HeaderMin]...)
+            setIPv4Checksum(check)
+            if !bytes.Equal(check, got[:ipv4HeaderMin]) {
+                t.Fatal("bad header checksum")
+            }
+        })
+    }
+}
+
+func TestReassemblerOrderAndEviction(t *testing.T) {
+    f := NewFragmenter(1200)
+    r := NewReassembler(10 * time.Second)
+    clock := NewFakeClock(time.Now())
+    r.clock = clock
+    
+    // Fragments may arrive in any order
+    packet := ipv4Packet(t, 4000, 7)
+    fragments, err := f.Fragment(packet)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(fragments) != 4 {
+        t.Fatalf("%d fragments", len(fragments))
+    }
+    for i := len(fragments) - 1; i >= 0; i-- {
+        whole, err := r.Add(fragments[i])
+        if err != nil {
+            t.Fatal(err)
+        }
+        if (whole != nil) != (i == 0) {
+            t.Fatalf("fragment %d: complete = %v", i, whole != nil)
+        }
+        if whole != nil && !bytes.Equal(whole[ipv4HeaderMin:], packet[ipv4HeaderMin:]) {
+            t.Fatal("reassembled payload differs")
+        }
+    }
+    
+    // Small packets pass through untouched
+    small := ipv4Packet(t, 100, 8)
+    if got, err := f.Fragment(small); err != nil || len(got) != 1 {
+        t.Fatalf("small packet fragmented: %d, %v", len(got), err)
+    }
+    if got, err := r.Add(small); err != nil || !bytes.Equal(got, small) {
+        t.Fatal("small packet changed on the way")
+    }
+    
+    // A packet missing a fragment is evicted after the timeout
+    fragments, _ = f.Fragment(ipv4Packet(t, 4000, 9))
+    for _, frag := range fragments[1:] {
+        if whole, err := r.Add(frag); whole != nil || err != nil {
+            t.Fatalf("incomplete packet: %v, %v", whole, err)
+        }
+    }
+    if stats := r.Stats(); stats.Pending != 1 {
+        t.Fatalf("stats %+v", stats)
+    }
+    clock.Advance(10 * time.Second)
+    if whole, _ := r.Add(fragments[0]); whole != nil {
+        t.Fatal("reassembled across the timeout")
+    }
+    
+    // Overlapping fragments drop the packet
+    if _, err := r.Add(fragments[0]); !errors.Is(err, ErrOverlappingFragments) {
+        t.Fatalf("duplicate fragment: %v", err)
+    }
+    
+    stats := r.Stats()
+    if stats.Reassembled != 1 || stats.Evicted != 1 || stats.Dropped != 1 || stats.Pending != 0 {
+        t.Fatalf("stats %+v", stats)
+    }
+    
+    if _, err := f.Fragment(make([]byte, 2000)); !errors.Is(err, ErrCannotFragment) {
+        t.Fatalf("non-IPv4 packet: %v", err)
+    }
+}
+
+func TestRefragmentedPacketReassembles(t *testing.T) {
+    // Fragmented again on a narrower hop further along
+    packet := ipv4Packet(t, 3020, 0)
+    first, err := NewFragmenter(2000).Fragment(packet)
+    if err != nil {
+        t.Fatal(err)
+    }
+    second := NewFragmenter(1000)
+    var fragments [][]byte
+    for _, frag := range first {
+        more, err := second.Fragment(frag)
+        if err != nil {
+            t.Fatal(err)
+        }
+        fragments = append(fragments, more...)
+    }
+    if len(fragments) <= len(first) {
+        t.Fatalf("%d fragments after %d", len(fragments), len(first))
+    }
+    
+    id := binary.BigEndian.Uint16(first[0][4:6])
+    r := NewReassembler(10 * time.Second)
+    var whole []byte
+    for i, frag := range fragments {
+        if got := binary.BigEndian.Uint16(frag[4:6]); got != id {
+            t.Fatalf("fragment %d: ID %d, want %d", i, got, id)
+        }
+        if whole, err = r.Add(frag); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if whole == nil || !bytes.Equal(whole[ipv4HeaderMin:], packet[ipv4HeaderMin:]) {
+        t.Fatal("refragmented packet not reassembled")
+    }
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "net"
+    "os/exec"
+    "regexp"
+    "strconv"
+    "sync"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+    DefaultHealthInterval = 10 * time.Second
+    DefaultProbeTimeout   = 2 * time.Second
+    DefaultMaxLatency     = 200 * time.Millisecond
+    DefaultMaxLoss        = 500 // 5%
+)
+
+// HealthStrategy decides whether a peer is alive. sample is the peer's
+// current state as reported by wgctrl.
+type HealthStrategy interface {
+    Healthy(peer *Peer, sample wgtypes.Peer) bool
+}
+
+// clockedStrategy is implemented by the strategies that judge handshake
+// age, so HealthChecker can have them judge it by the VPN's clock
+type clockedStrategy interface {
+    healthyAt(peer *Peer, sample wgtypes.Peer, now time.Time) bool
+}
+
+// ActiveHealth pings the peer's tunnel address and judges it by
+// reachability, latency and loss
+type ActiveHealth struct {
+    Timeout    time.Duration
+    MaxLatency time.Duration
+    MaxLoss    uint32 // percentage * 100
+}
+
+func NewActiveHealth() *ActiveHealth {
+    return &ActiveHealth{
+        Timeout:    DefaultProbeTimeout,
+        MaxLatency: DefaultMaxLatency,
+        MaxLoss:    DefaultMaxLoss,
+    }
+}
+
+func (a *ActiveHealth) Healthy(peer *Peer, sample wgtypes.Peer) bool {
+    return a.healthyAt(peer, sample, time.Now())
+}
+
+func (a *ActiveHealth) healthyAt(peer *Peer, sample wgtypes.Peer, now time.Time) bool {
+    target := probeTarget(peer)
+    if target == nil {
+        // Nothing we can ping, the handshake is all we have
+        return handshakeFresh(sample, now)
+    }
+    
+    rtt, err := probePeer(target, a.Timeout)
+    recordProbe(peer, rtt, err)
+    if err != nil {
+        return false
+    }
+    
+    return rtt <= a.MaxLatency && peer.PacketLoss.Load() <= a.MaxLoss
+}
+
+// PassiveHealth infers liveness from wgctrl data alone, for networks where
+// ICMP is blocked. A peer is alive if its rx counter advanced since the last
+// sample or its handshake is recent enough for its keepalive setting.
+type PassiveHealth struct {
+    mu     sync.Mutex
+    lastRx map[wgtypes.Key]int64
+}
+
+func NewPassiveHealth() *PassiveHealth {
+    return &PassiveHealth{
+        lastRx: make(map[wgtypes.Key]int64),
+    }
+}
+
+func (p *PassiveHealth) Healthy(peer *Peer, sample wgtypes.Peer) bool {
+    return p.healthyAt(peer, sample, time.Now())
+}
+
+func (p *PassiveHealth) healthyAt(peer *Peer, sample wgtypes.Peer, now time.Time) bool {
+    p.mu.Lock()
+    prev, seen := p.lastRx[sample.PublicKey]
+    p.lastRx[sample.PublicKey] = sample.ReceiveBytes
+    p.mu.Unlock()
+    
+    // Receiving anything proves the peer is there
+    if seen && sample.ReceiveBytes > prev {
+        return true
+    }
+    
+    return handshakeFresh(sample, now)
+}
+
+// HybridHealth runs both checks and lets passive evidence override a failed
+// probe, so a blocked ping never marks a working peer dead
+type HybridHealth struct {
+    Active  *ActiveHealth
+    Passive *PassiveHealth
+}
+
+func NewHybridHealth() *HybridHealth {
+    return &HybridHealth{
+        Active:  NewActiveHealth(),
+        Passive: NewPassiveHealth(),
+    }
+}
+
+func (h *HybridHealth) Healthy(peer *Peer, sample wgtypes.Peer) bool {
+    return h.healthyAt(peer, sample, time.Now())
+}
+
+func (h *HybridHealth) healthyAt(peer *Peer, sample wgtypes.Peer, now time.Time) bool {
+    // Always run both so the passive side keeps its rx history current
+    active := h.Active.healthyAt(peer, sample, now)
+    passive := h.Passive.healthyAt(peer, sample, now)
+    return active || passive
+}
+
+// A handshake is fresh if WireGuard would not yet have given up on it. With
+// a keepalive the peer re-handshakes every RekeyAfterTime, without one an
+// idle session is kept until RejectAfterTime.
+func handshakeFresh(sample wgtypes.Peer, now time.Time) bool {
+    if sample.LastHandshakeTime.IsZero() {
+        return false
+    }
+    
+    deadline := RejectAfterTime
+    if keepalive := sample.PersistentKeepaliveInterval; keepalive > 0 {
+        deadline = RekeyAfterTime + keepalive + HandshakeTimeout
+    }
+    return now.Sub(sample.LastHandshakeTime) <= deadline
+}
+
+// First host route among the peer's allowed IPs, i.e. its tunnel address
+func probeTarget(peer *Peer) net.IP {
+    for _, allowed := range peer.AllowedIPs {
+        ones, bits := allowed.Mask.Size()
+        if bits > 0 && ones == bits {
+            return allowed.IP
+        }
+    }
+    return nil
+}
+
+// Store probe latency and fold the result into the peer's loss average
+func recordProbe(peer *Peer, rtt time.Duration, err error) {
+    var sample uint32
+    if err != nil {
+        sample = 10000
+    } else {
+        peer.CurrentLatency.Store(uint32(rtt.Microseconds()))
+    }
+    
+    // Exponential moving average over roughly the last 8 probes
+    loss := peer.PacketLoss.Load()
+    peer.PacketLoss.Store((loss*7 + sample) / 8)
+}
+
+var pingTimeRe = regexp.MustCompile(`time=([0-9.]+) ms`)
+
+// probePeer sends a single ICMP echo and returns the round-trip time.
+// Tests replace it to avoid touching the network.
+var probePeer = func(ip net.IP, timeout time.Duration) (time.Duration, error) {
+    secs := int(math.Ceil(timeout.Seconds()))
+    if secs < 1 {
+        secs = 1
+    }
+    
+    out, err := exec.Command("ping", "-n", "-c", "1", "-W", strconv.Itoa(secs), ip.String()).Output()
+    if err != nil {
+        return 0, fmt.Errorf("ping %s: %w", ip, err)
+    }
+    
+    m := pingTimeRe.FindSubmatch(out)
+    if m == nil {
+        return 0, fmt.Errorf("ping %s: no reply time in output", ip)
+    }
+    ms, err := strconv.ParseFloat(string(m[1]), 64)
+    if err != nil {
+        return 0, fmt.Errorf("ping %s: %w", ip, err)
+    }
+    return time.Duration(ms * float64(time.Millisecond)), nil
+}
+
+// HealthChecker periodically evaluates every peer with the strategy of its
+// group and publishes the verdict for routing and failover
+type HealthChecker struct {
+    vpn      *UnderTheRadarVPN
+    interval time.Duration
+    
+    mu       sync.RWMutex
+    strategy HealthStrategy            // peers without a group strategy
+    groups   map[string]HealthStrategy // by Peer.Group
+    verdicts map[wgtypes.Key]bool
+    
+    stop     chan struct{}
+    stopOnce sync.Once
+}
+
+func NewHealthChecker(vpn *UnderTheRadarVPN) *HealthChecker {
+    return &HealthChecker{
+        vpn:      vpn,
+        interval: DefaultHealthInterval,
+        strategy: NewActiveHealth(),
+        groups:   make(map[string]HealthStrategy),
+        verdicts: make(map[wgtypes.Key]bool),
+        stop:     make(chan struct{}),
+    }
+}
+
+// SetStrategy selects the strategy for a peer group; the empty group sets
+// the default used by peers whose group has none
+func (hc *HealthChecker) SetStrategy(group string, strategy HealthStrategy) {
+    hc.mu.Lock()
+    defer hc.mu.Unlock()
+    
+    if group == "" {
+        hc.strategy = strategy
+        return
+    }
+    hc.groups[group] = strategy
+}
+
+func (hc *HealthChecker) strategyFor(group string) HealthStrategy {
+    hc.mu.RLock()
+    defer hc.mu.RUnlock()
+    
+    if strategy, ok := hc.groups[group]; ok {
+        return strategy
+    }
+    return hc.strategy
+}
+
+func (hc *HealthChecker) Start() {
+    ticker := hc.vpn.clock().NewTicker(hc.interval)
+    defer ticker.Stop()
+    
+    for {
+        select {
+        case <-ticker.C():
+            hc.checkAll()
+        case <-hc.stop:
+            return
+        }
+    }
+}
+
+func (hc *HealthChecker) Stop() {
+    hc.stopOnce.Do(func() { close(hc.stop) })
+}
+
+// Evaluate every peer against a single device snapshot
+func (hc *HealthChecker) checkAll() {
+    device, err := hc.vpn.wgClient.Device(hc.vpn.deviceName)
+    if err != nil {
+        return
+    }
+    
+    for _, wgPeer := range device.Peers {
+        hc.vpn.mu.RLock()
+        peer := hc.vpn.peers.get(wgPeer.PublicKey)
+        hc.vpn.mu.RUnlock()
+        if peer == nil {
+            continue
+        }
+        hc.evaluate(peer, wgPeer)
+    }
+}
+
+// CheckPeer evaluates one peer immediately with a fresh sample
+func (hc *HealthChecker) CheckPeer(peer *Peer) bool {
+    device, err := hc.vpn.wgClient.Device(hc.vpn.deviceName)
+    if err != nil {
+        return false
+    }
+    
+    for _, wgPeer := range device.Peers {
+        if wgPeer.PublicKey == peer.PublicKey {
+            return hc.evaluate(peer, wgPeer)
+        }
+    }
+    return false
+}
+
+func (hc *HealthChecker) evaluate(peer *Peer, sample wgtypes.Peer) bool {
+    now := hc.vpn.clock().Now()
+    strategy := hc.strategyFor(peer.Group)
+    var healthy bool
+    if clocked, ok := strategy.(clockedStrategy); ok {
+        healthy = clocked.healthyAt(peer, sample, now)
+    } else {
+        healthy = strategy.Healthy(peer, sample)
+    }
+    
+    hc.mu.Lock()
+    _, seen := hc.verdicts[peer.PublicKey]
+    hc.verdicts[peer.PublicKey] = healthy
+    hc.mu.Unlock()
+    
+    peer.setAlive(healthy, now)
+    peer.history.handshake(sample.LastHandshakeTime)
+    if healthy && !seen {
+        hc.vpn.emitEvent(Event{
+            Type:      EventPeerConnected,
+            PublicKey: peer.PublicKey,
+            Message:   "peer connected",
+        })
+    }
+    return healthy
+}
+
+// IsHealthy returns the latest verdict for a peer. Peers not evaluated yet
+// are given the benefit of the doubt.
+func (hc *HealthChecker) IsHealthy(peer *Peer) bool {
+    hc.mu.RLock()
+    defer hc.mu.RUnlock()
+    
+    healthy, ok := hc.verdicts[peer.PublicKey]
+    return !ok || healthy
+}
+
+// SetHealthStrategy selects how peers in group are judged alive
+func (vpn *UnderTheRadarVPN) SetHealthStrategy(group string, strategy HealthStrategy) {
+    vpn.healthCheck.SetStrategy(group, strategy)
+}
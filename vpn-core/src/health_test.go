@@ -0,0 +1,243 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net"
+    "testing"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Make every ping fail, as on a network that drops ICMP
+func blockPings(t *testing.T) {
+    orig := probePeer
+    probePeer = func(ip net.IP, timeout time.Duration) (time.Duration, error) {
+        return 0, errors.New("icmp blocked")
+    }
+    t.Cleanup(func() { probePeer = orig })
+}
+
+func TestPassiveHealthRxGrowth(t *testing.T) {
+    p := NewPassiveHealth()
+    peer := &Peer{PublicKey: mustKey(t).PublicKey()}
+    stale := time.Now().Add(-time.Hour)
+    
+    sample := wgtypes.Peer{PublicKey: peer.PublicKey, LastHandshakeTime: stale, ReceiveBytes: 1000}
+    if p.Healthy(peer, sample) {
+        t.Fatal("stale handshake without rx history should be unhealthy")
+    }
+    
+    sample.ReceiveBytes = 1500
+    if !p.Healthy(peer, sample) {
+        t.Fatal("advancing rx counter should prove liveness")
+    }
+    
+    if p.Healthy(peer, sample) {
+        t.Fatal("flat rx counter with stale handshake should be unhealthy")
+    }
+}
+
+func TestPassiveHealthHandshakeAge(t *testing.T) {
+    p := NewPassiveHealth()
+    peer := &Peer{PublicKey: mustKey(t).PublicKey()}
+    
+    tests := []struct {
+        age       time.Duration
+        keepalive time.Duration
+        healthy   bool
+    }{
+        {age: time.Minute, keepalive: KeepaliveInterval, healthy: true},
+        {age: 4 * time.Minute, keepalive: KeepaliveInterval, healthy: false},
+        {age: 150 * time.Second, healthy: true},
+        {age: 200 * time.Second, healthy: false},
+    }
+    
+    for _, tt := range tests {
+        sample := wgtypes.Peer{
+            PublicKey:                   peer.PublicKey,
+            LastHandshakeTime:           time.Now().Add(-tt.age),
+            PersistentKeepaliveInterval: tt.keepalive,
+        }
+        if got := p.Healthy(peer, sample); got != tt.healthy {
+            t.Errorf("age %v keepalive %v: healthy = %v, want %v", tt.age, tt.keepalive, got, tt.healthy)
+        }
+    }
+}
+
+func TestHybridHealthOverridesBlockedPing(t *testing.T) {
+    blockPings(t)
+    
+    peer := &Peer{
+        PublicKey:  mustKey(t).PublicKey(),
+        AllowedIPs: []net.IPNet{mustCIDR(t, "10.64.0.2/32")},
+    }
+    sample := wgtypes.Peer{PublicKey: peer.PublicKey, LastHandshakeTime: time.Now()}
+    
+    if NewActiveHealth().Healthy(peer, sample) {
+        t.Fatal("active check should fail when pings are blocked")
+    }
+    if !NewHybridHealth().Healthy(peer, sample) {
+        t.Fatal("hybrid check should trust the fresh handshake")
+    }
+    if peer.PacketLoss.Load() == 0 {
+        t.Error("failed probes should raise packet loss")
+    }
+}
+
+func TestHealthStrategyPerGroup(t *testing.T) {
+    blockPings(t)
+    
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    vpn.healthCheck = NewHealthChecker(vpn)
+    vpn.SetHealthStrategy("no-icmp", NewPassiveHealth())
+    
+    pinged := &Peer{
+        PublicKey:  mustKey(t).PublicKey(),
+        AllowedIPs: []net.IPNet{mustCIDR(t, "10.64.0.2/32")},
+    }
+    passive := &Peer{
+        PublicKey:  mustKey(t).PublicKey(),
+        AllowedIPs: []net.IPNet{mustCIDR(t, "10.64.0.3/32")},
+        Group:      "no-icmp",
+    }
+    for _, peer := range []*Peer{pinged, passive} {
+        vpn.peers.put(peer)
+        wg.setPeer("utr0", wgtypes.Peer{PublicKey: peer.PublicKey, LastHandshakeTime: time.Now()})
+    }
+    
+    vpn.healthCheck.checkAll()
+    
+    if vpn.healthCheck.IsHealthy(pinged) || pinged.IsAlive.Load() {
+        t.Error("default active strategy should mark the unpingable peer dead")
+    }
+    if !vpn.healthCheck.IsHealthy(passive) || !passive.IsAlive.Load() {
+        t.Error("passive group should keep the peer alive")
+    }
+}
+
+func TestHealthCheckerAgesHandshakesByClock(t *testing.T) {
+    clock := NewFakeClock(time.Unix(1700000000, 0))
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    vpn.timeSource = clock
+    vpn.healthCheck = NewHealthChecker(vpn)
+    vpn.healthCheck.SetStrategy("", NewPassiveHealth())
+    
+    peer := &Peer{PublicKey: mustKey(t).PublicKey()}
+    vpn.peers.put(peer)
+    wg.setPeer("utr0", wgtypes.Peer{PublicKey: peer.PublicKey, LastHandshakeTime: clock.Now()})
+    
+    // WireGuard gives up on an idle session RejectAfterTime after its
+    // handshake, and not a moment before
+    clock.Advance(RejectAfterTime)
+    if !vpn.healthCheck.CheckPeer(peer) {
+        t.Fatal("dead at RejectAfterTime")
+    }
+    clock.Advance(time.Second)
+    if vpn.healthCheck.CheckPeer(peer) || peer.IsAlive.Load() {
+        t.Fatal("alive past RejectAfterTime")
+    }
+    history := peer.history.list()
+    if last := history[len(history)-1]; last.Kind != PeerDown || !last.Time.Equal(clock.Now()) {
+        t.Fatalf("history %+v", history)
+    }
+}
+
+func TestFailoverUsesHealthVerdict(t *testing.T) {
+    blockPings(t)
+    
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    vpn.healthCheck = NewHealthChecker(vpn)
+    vpn.healthCheck.SetStrategy("", NewPassiveHealth())
+    fm := NewFailoverManager(vpn)
+    fm.settleTime = 0
+    
+    primary := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820}
+    peer := &Peer{PublicKey: mustKey(t).PublicKey(), Endpoint: primary}
+    peer.setExtras(PeerConfig{AlternateEndpoints: []net.UDPAddr{{IP: net.ParseIP("192.0.2.2"), Port: 51820}}})
+    vpn.peers.put(peer)
+    
+    // Stale handshake but traffic flowing: healthy, no failover
+    sample := wgtypes.Peer{PublicKey: peer.PublicKey, LastHandshakeTime: time.Now().Add(-time.Hour)}
+    for _, rx := range []int64{100, 200} {
+        sample.ReceiveBytes = rx
+        wg.setPeer("utr0", sample)
+        vpn.healthCheck.checkAll()
+    }
+    fm.checkPeers(context.Background())
+    if peer.Endpoint != primary {
+        t.Fatal("failed over a peer the health strategy considers alive")
+    }
+    
+    // Traffic stops: the verdict flips and failover tries the alternate
+    vpn.healthCheck.checkAll()
+    fm.checkPeers(context.Background())
+    if peer.Endpoint.String() != "192.0.2.2:51820" {
+        t.Fatalf("endpoint = %v, want alternate", peer.Endpoint)
+    }
+    if peer.IsAlive.Load() {
+        t.Error("peer should be dead after the alternate also failed")
+    }
+}
+
+func TestFailoverSweepStopsOnCancel(t *testing.T) {
+    clock := NewFakeClock(time.Unix(1700000000, 0))
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    vpn.timeSource = clock
+    vpn.healthCheck = NewHealthChecker(vpn)
+    vpn.healthCheck.SetStrategy("", &flappingHealth{})
+    fm := NewFailoverManager(vpn)
+    defer fm.events.Stop()
+    fm.settleTime = time.Hour
+    sink := &captureSink{}
+    vpn.SetMetricSink(sink)
+    
+    peer := &Peer{PublicKey: mustKey(t).PublicKey(), Endpoint: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820}}
+    peer.setExtras(PeerConfig{AlternateEndpoints: []net.UDPAddr{
+        {IP: net.ParseIP("192.0.2.2"), Port: 51820},
+        {IP: net.ParseIP("192.0.2.3"), Port: 51820},
+    }})
+    peer.IsAlive.Store(true)
+    vpn.peers.put(peer)
+    wg.setPeer("utr0", wgtypes.Peer{PublicKey: peer.PublicKey})
+    
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan struct{})
+    go func() {
+        fm.handlePeerFailure(ctx, peer)
+        close(done)
+    }()
+    
+    // Settling on the first alternate, an hour on the clock that never moves
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        clock.mu.Lock()
+        settling := len(clock.waiting) > 0
+        clock.mu.Unlock()
+        if settling {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("sweep never started settling")
+        }
+        time.Sleep(time.Millisecond)
+    }
+    
+    cancel()
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("sweep still running after cancel")
+    }
+    if peer.Endpoint.String() != "192.0.2.2:51820" {
+        t.Fatalf("endpoint = %v, the sweep went on past the first alternate", peer.Endpoint)
+    }
+    if !peer.IsAlive.Load() || len(sink.metrics) > 0 {
+        t.Fatalf("a cancelled sweep gave a verdict: alive %v, metrics %v", peer.IsAlive.Load(), sink.metrics)
+    }
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+    "sync"
+    "time"
+)
+
+const (
+    // Entries kept per peer, of handshakes and of state changes each
+    peerHistorySize = 64
+    
+    // Default VPNConfig.UptimeWindow
+    DefaultUptimeWindow = time.Hour
+)
+
+// PeerHistoryKind is what a PeerHistoryEntry records
+type PeerHistoryKind string
+
+const (
+    PeerHandshake PeerHistoryKind = "handshake"
+    PeerUp        PeerHistoryKind = "up"
+    PeerDown      PeerHistoryKind = "down"
+)
+
+type PeerHistoryEntry struct {
+    Time time.Time
+    Kind PeerHistoryKind
+}
+
+// Buffer of up to peerHistorySize entries overwriting its oldest. It grows
+// as entries come, so quiet peers don't hold a full one.
+type historyRing struct {
+    entries []PeerHistoryEntry
+    next    int
+    full    bool
+}
+
+func (r *historyRing) add(entry PeerHistoryEntry) {
+    if len(r.entries) < peerHistorySize {
+        r.entries = append(r.entries, entry)
+    } else {
+        r.entries[r.next] = entry
+    }
+    r.next = (r.next + 1) % peerHistorySize
+    r.full = r.full || r.next == 0
+}
+
+// Oldest first
+func (r *historyRing) list() []PeerHistoryEntry {
+    if !r.full {
+        return append([]PeerHistoryEntry(nil), r.entries[:r.next]...)
+    }
+    return append(append([]PeerHistoryEntry(nil), r.entries[r.next:]...), r.entries[:r.next]...)
+}
+
+// peerHistory records a peer's recent handshakes and alive/dead changes.
+// State changes are kept apart so a stream of handshakes can't push out
+// what uptime is computed from.
+type peerHistory struct {
+    mu            sync.Mutex
+    handshakes    historyRing
+    changes       historyRing
+    lastHandshake time.Time
+}
+
+// Record a handshake the kernel reported, once however often it's seen
+func (h *peerHistory) handshake(at time.Time) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    
+    if at.IsZero() || !at.After(h.lastHandshake) {
+        return
+    }
+    h.lastHandshake = at
+    h.handshakes.add(PeerHistoryEntry{Time: at, Kind: PeerHandshake})
+}
+
+// Handshakes recorded after since
+func (h *peerHistory) handshakesSince(since time.Time) int {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    
+    n := 0
+    for _, entry := range h.handshakes.list() {
+        if entry.Time.After(since) {
+            n++
+        }
+    }
+    return n
+}
+
+// Record the state if it differs from the last one, the first always
+func (h *peerHistory) state(alive bool, at time.Time) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    
+    kind := PeerDown
+    if alive {
+        kind = PeerUp
+    }
+    if changes := h.changes.list(); len(changes) > 0 && changes[len(changes)-1].Kind == kind {
+        return
+    }
+    h.changes.add(PeerHistoryEntry{Time: at, Kind: kind})
+}
+
+// Handshakes and state changes merged, oldest first
+func (h *peerHistory) list() []PeerHistoryEntry {
+    h.mu.Lock()
+    handshakes, changes := h.handshakes.list(), h.changes.list()
+    h.mu.Unlock()
+    
+    merged := make([]PeerHistoryEntry, 0, len(handshakes)+len(changes))
+    for len(handshakes) > 0 || len(changes) > 0 {
+        if len(changes) == 0 || (len(handshakes) > 0 && handshakes[0].Time.Before(changes[0].Time)) {
+            merged, handshakes = append(merged, handshakes[0]), handshakes[1:]
+        } else {
+            merged, changes = append(merged, changes[0]), changes[1:]
+        }
+    }
+    return merged
+}
+
+// Percentage of the window before now the peer was up. Time before the
+// oldest change kept doesn't count either way.
+func (h *peerHistory) uptime(now time.Time, window time.Duration) float64 {
+    h.mu.Lock()
+    changes := h.changes.list()
+    h.mu.Unlock()
+    
+    if len(changes) == 0 {
+        return 0
+    }
+    start := now.Add(-window)
+    if changes[0].Time.After(start) {
+        start = changes[0].Time
+    }
+    if !now.After(start) {
+        return 0
+    }
+    
+    // The state at start is that of the last change before it
+    var up bool
+    for len(changes) > 0 && !changes[0].Time.After(start) {
+        up = changes[0].Kind == PeerUp
+        changes = changes[1:]
+    }
+    
+    var upTime time.Duration
+    at := start
+    for _, change := range changes {
+        if change.Time.After(now) {
+            break
+        }
+        if up {
+            upTime += change.Time.Sub(at)
+        }
+        at, up = change.Time, change.Kind == PeerUp
+    }
+    if up {
+        upTime += now.Sub(at)
+    }
+    return 100 * float64(upTime) / float64(now.Sub(start))
+}
+
+// Set IsAlive, recording a change in the peer's history
+func (peer *Peer) setAlive(alive bool, now time.Time) {
+    peer.IsAlive.Store(alive)
+    peer.history.state(alive, now)
+}
+
+// Caller holds vpn.mu
+func (vpn *UnderTheRadarVPN) uptimeWindowLocked() time.Duration {
+    if vpn.config.UptimeWindow > 0 {
+        return vpn.config.UptimeWindow
+    }
+    return DefaultUptimeWindow
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+    "math"
+    "testing"
+    "time"
+)
+
+func TestPeerHistoryTransitionsAndUptime(t *testing.T) {
+    var h peerHistory
+    base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+    at := func(minutes int) time.Time { return base.Add(time.Duration(minutes) * time.Minute) }
+    
+    // Up for 30 minutes, a 10 minute outage, then up again
+    h.state(true, at(0))
+    h.handshake(at(1))
+    h.handshake(at(1)) // seen again by the next poll
+    h.state(true, at(5))
+    h.state(false, at(30))
+    h.state(false, at(35))
+    h.state(true, at(40))
+    h.handshake(at(41))
+    
+    want := []PeerHistoryEntry{
+        {at(0), PeerUp}, {at(1), PeerHandshake}, {at(30), PeerDown}, {at(40), PeerUp}, {at(41), PeerHandshake},
+    }
+    got := h.list()
+    if len(got) != len(want) {
+        t.Fatalf("history = %v, want %v", got, want)
+    }
+    for i := range want {
+        if !got[i].Time.Equal(want[i].Time) || got[i].Kind != want[i].Kind {
+            t.Fatalf("entry %d = %v, want %v", i, got[i], want[i])
+        }
+    }
+    
+    for _, tt := range []struct {
+        now    int
+        window time.Duration
+        want   float64
+    }{
+        {60, time.Hour, 50.0 / 60 * 100},
+        {60, 20 * time.Minute, 100},     // outage is before the window
+        {40, 20 * time.Minute, 50},      // window ends with the outage
+        {20, time.Hour, 100},            // nothing known before the first change
+        {70, 35 * time.Minute, 30.0 / 35 * 100}, // starts inside the outage
+    } {
+        if got := h.uptime(at(tt.now), tt.window); math.Abs(got-tt.want) > 0.001 {
+            t.Errorf("uptime at %d over %v = %.2f, want %.2f", tt.now, tt.window, got, tt.want)
+        }
+    }
+}
+
+func TestPeerHistoryBounded(t *testing.T) {
+    var h peerHistory
+    base := time.Now()
+    
+    // A flapping peer with a handshake on every reconnect
+    for i := 0; i < 3*peerHistorySize; i++ {
+        h.state(i%2 == 0, base.Add(time.Duration(i)*time.Minute))
+        h.handshake(base.Add(time.Duration(i)*time.Minute + time.Second))
+    }
+    entries := h.list()
+    if len(entries) != 2*peerHistorySize {
+        t.Fatalf("%d entries kept", len(entries))
+    }
+    last := base.Add(time.Duration(3*peerHistorySize-1)*time.Minute + time.Second)
+    if !entries[len(entries)-1].Time.Equal(last) {
+        t.Fatal("newest entry missing")
+    }
+    
+    // Uptime covers the changes still held
+    now := base.Add(time.Duration(3*peerHistorySize) * time.Minute)
+    if got := h.uptime(now, 24*time.Hour); math.Abs(got-50) > 1 {
+        t.Fatalf("uptime of a peer up every other minute = %.2f", got)
+    }
+}
+
+func TestListPeersReportsHistory(t *testing.T) {
+    clock := NewFakeClock(time.Unix(1700000000, 0))
+    vpn := newTestVPN(t, newFakeWGClient())
+    vpn.timeSource = clock
+    peer := &Peer{PublicKey: mustKey(t).PublicKey()}
+    vpn.storePeerLocked(peer)
+    
+    // Up a minute, down a minute, up two
+    for _, alive := range []bool{true, false, true} {
+        peer.setAlive(alive, clock.Now())
+        clock.Advance(time.Minute)
+    }
+    clock.Advance(time.Minute)
+    
+    infos := vpn.ListPeers()
+    if len(infos) != 1 || len(infos[0].History) != 3 || infos[0].History[1].Kind != PeerDown {
+        t.Fatalf("history = %+v", infos)
+    }
+    if infos[0].UptimePercent != 75 {
+        t.Fatalf("uptime = %v", infos[0].UptimePercent)
+    }
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+    "errors"
+    "net"
+    "path"
+    "sort"
+    "sync"
+)
+
+// interfaceLoader attaches the eBPF programs to interfaces besides the
+// uplink, see InterfaceWatcher. Loaders without it only serve the uplink.
+type interfaceLoader interface {
+    AttachInterface(vpn *UnderTheRadarVPN, name string) error
+    DetachInterface(vpn *UnderTheRadarVPN, name string)
+}
+
+// A change of one interface, from rtnetlink or a scan
+type linkEvent struct {
+    Index   int
+    Name    string
+    Up      bool
+    Deleted bool
+}
+
+// errLinkEventsLost is returned by linkEvents.read when the kernel dropped
+// events, the interfaces have to be scanned again
+var errLinkEventsLost = errors.New("interface events lost")
+
+// InterfaceWatcher runs the eBPF programs on interfaces matching
+// VPNConfig.EBPFInterfaces besides the uplink. They are attached as such
+// interfaces come up, a USB tether or a new NIC, and detached when they go
+// down or away, all without a restart.
+type InterfaceWatcher struct {
+    vpn      *UnderTheRadarVPN
+    loader   interfaceLoader
+    patterns []string
+    
+    mu       sync.Mutex
+    attached map[int]string // interface names by index
+    events   *linkEvents
+    done     chan struct{}
+}
+
+func NewInterfaceWatcher(vpn *UnderTheRadarVPN, loader interfaceLoader, patterns []string) *InterfaceWatcher {
+    return &InterfaceWatcher{
+        vpn:      vpn,
+        loader:   loader,
+        patterns: patterns,
+        attached: make(map[int]string),
+    }
+}
+
+// Start attaches to the matching interfaces that are up and follows their
+// changes until Stop
+func (w *InterfaceWatcher) Start() error {
+    events, err := openLinkEvents()
+    if err != nil {
+        return err
+    }
+    w.events, w.done = events, make(chan struct{})
+    
+    // Subscribed first, so an interface coming up meanwhile isn't missed
+    w.scan()
+    go w.run()
+    return nil
+}
+
+// Stop follows no more changes and detaches from every interface
+func (w *InterfaceWatcher) Stop() error {
+    if w.events == nil {
+        return nil
+    }
+    w.events.close()
+    <-w.done
+    w.events = nil
+    
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    for index, name := range w.attached {
+        w.loader.DetachInterface(w.vpn, name)
+        delete(w.attached, index)
+    }
+    return nil
+}
+
+// Attached returns the interfaces the programs run on, besides the uplink
+func (w *InterfaceWatcher) Attached() []string {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    
+    names := make([]string, 0, len(w.attached))
+    for _, name := range w.attached {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+func (w *InterfaceWatcher) run() {
+    defer close(w.done)
+    for {
+        events, err := w.events.read()
+        if errors.Is(err, errLinkEventsLost) {
+            w.scan()
+            continue
+        }
+        if err != nil {
+            return // closed
+        }
+        for _, ev := range events {
+            w.handle(ev)
+        }
+    }
+}
+
+// Bring every interface up to date, and forget those gone
+func (w *InterfaceWatcher) scan() {
+    ifaces, err := net.Interfaces()
+    if err != nil {
+        return
+    }
+    present := make(map[int]bool, len(ifaces))
+    for _, iface := range ifaces {
+        present[iface.Index] = true
+        w.handle(linkEvent{Index: iface.Index, Name: iface.Name, Up: iface.Flags&net.FlagUp != 0})
+    }
+    
+    var gone []linkEvent
+    w.mu.Lock()
+    for index, name := range w.attached {
+        if !present[index] {
+            gone = append(gone, linkEvent{Index: index, Name: name, Deleted: true})
+        }
+    }
+    w.mu.Unlock()
+    for _, ev := range gone {
+        w.handle(ev)
+    }
+}
+
+// Attach to an interface that came up and matches, detach from one that
+// went down, away or was renamed. A failed attach is retried on the
+// interface's next change.
+func (w *InterfaceWatcher) handle(ev linkEvent) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    
+    want := ev.Up && !ev.Deleted && w.matches(ev.Name)
+    name, attached := w.attached[ev.Index]
+    if attached && (!want || name != ev.Name) {
+        w.loader.DetachInterface(w.vpn, name)
+        delete(w.attached, ev.Index)
+        attached = false
+    }
+    if !want || attached {
+        return
+    }
+    if err := w.loader.AttachInterface(w.vpn, ev.Name); err != nil {
+        w.vpn.metricSink().Count("ebpf.attach_failed", 1, "interface:"+ev.Name)
+        return
+    }
+    w.attached[ev.Index] = ev.Name
+}
+
+// The tunnel device never matches, its programs are attached separately
+func (w *InterfaceWatcher) matches(name string) bool {
+    if name == w.vpn.deviceName {
+        return false
+    }
+    for _, pattern := range w.patterns {
+        if ok, _ := path.Match(pattern, name); ok {
+            return true
+        }
+    }
+    return false
+}
+
+// Follow the interfaces of config.EBPFInterfaces, if the loader can attach
+// to them
+func (vpn *UnderTheRadarVPN) watchInterfaces(config VPNConfig, undo *rollback) error {
+    if len(config.EBPFInterfaces) == 0 {
+        return nil
+    }
+    if vpn.planning != nil {
+        vpn.planning.note(ChangeDevice, "attach the eBPF programs to interfaces matching %v as they come up", config.EBPFInterfaces)
+        return nil
+    }
+    loader, ok := vpn.loader().(interfaceLoader)
+    if !ok {
+        return nil
+    }
+    
+    watcher := NewInterfaceWatcher(vpn, loader, config.EBPFInterfaces)
+    undo.push("interface watcher", watcher.Stop)
+    if err := watcher.Start(); err != nil {
+        return err
+    }
+    vpn.mu.Lock()
+    vpn.ifaceWatcher = watcher
+    vpn.mu.Unlock()
+    return nil
+}
+
+func (vpn *UnderTheRadarVPN) stopInterfaceWatcher() {
+    vpn.mu.Lock()
+    watcher := vpn.ifaceWatcher
+    vpn.ifaceWatcher = nil
+    vpn.mu.Unlock()
+    if watcher != nil {
+        watcher.Stop()
+    }
+}
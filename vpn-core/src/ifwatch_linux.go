@@ -0,0 +1,88 @@
+//go:build linux
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "strings"
+    "syscall"
+    "unsafe"
+    
+    "golang.org/x/sys/unix"
+)
+
+// linkEvents reads RTM_NEWLINK and RTM_DELLINK from rtnetlink's link
+// group, through the runtime poller so close ends a read
+type linkEvents struct {
+    file *os.File
+    raw  syscall.RawConn
+    buf  []byte
+}
+
+func openLinkEvents() (*linkEvents, error) {
+    fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_ROUTE)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open rtnetlink: %w", err)
+    }
+    if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: unix.RTMGRP_LINK}); err != nil {
+        unix.Close(fd)
+        return nil, fmt.Errorf("failed to subscribe to link events: %w", err)
+    }
+    e := &linkEvents{file: os.NewFile(uintptr(fd), "rtnetlink"), buf: make([]byte, 1<<16)}
+    if e.raw, err = e.file.SyscallConn(); err != nil {
+        e.file.Close()
+        return nil, err
+    }
+    return e, nil
+}
+
+func (e *linkEvents) read() ([]linkEvent, error) {
+    var n int
+    var errno error
+    err := e.raw.Read(func(fd uintptr) bool {
+        n, _, errno = unix.Recvfrom(int(fd), e.buf, 0)
+        return errno != unix.EAGAIN
+    })
+    if err != nil {
+        return nil, err
+    }
+    if errno == unix.ENOBUFS {
+        return nil, errLinkEventsLost
+    }
+    if errno != nil {
+        return nil, errno
+    }
+    
+    msgs, err := syscall.ParseNetlinkMessage(e.buf[:n])
+    if err != nil {
+        return nil, errLinkEventsLost
+    }
+    var events []linkEvent
+    for _, msg := range msgs {
+        if msg.Header.Type != syscall.RTM_NEWLINK && msg.Header.Type != syscall.RTM_DELLINK || len(msg.Data) < unix.SizeofIfInfomsg {
+            continue
+        }
+        info := (*syscall.IfInfomsg)(unsafe.Pointer(&msg.Data[0]))
+        ev := linkEvent{
+            Index:   int(info.Index),
+            Up:      info.Flags&syscall.IFF_UP != 0,
+            Deleted: msg.Header.Type == syscall.RTM_DELLINK,
+        }
+        attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+        if err != nil {
+            continue
+        }
+        for _, attr := range attrs {
+            if attr.Attr.Type == syscall.IFLA_IFNAME {
+                ev.Name = strings.TrimRight(string(attr.Value), "\x00")
+            }
+        }
+        events = append(events, ev)
+    }
+    return events, nil
+}
+
+func (e *linkEvents) close() error {
+    return e.file.Close()
+}
@@ -0,0 +1,74 @@
+//go:build linux
+
+package main
+
+import (
+    "os/exec"
+    "reflect"
+    "runtime"
+    "strings"
+    "testing"
+    "time"
+    
+    "github.com/vishvananda/netns"
+)
+
+func TestInterfaceWatcherAttachesVeth(t *testing.T) {
+    if _, err := exec.LookPath("ip"); err != nil {
+        t.Skip("needs ip(8)")
+    }
+    
+    // A namespace of our own, so only the veth pair comes and goes. The
+    // watcher's socket stays in it after the thread returns.
+    runtime.LockOSThread()
+    defer runtime.UnlockOSThread()
+    origin, err := netns.Get()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer origin.Close()
+    ns, err := netns.New()
+    if err != nil {
+        t.Skipf("can't create a network namespace: %v", err)
+    }
+    defer ns.Close()
+    defer netns.Set(origin)
+    
+    vpn := newTestVPN(t, newFakeWGClient())
+    loader := &recordingLoader{}
+    w := NewInterfaceWatcher(vpn, loader, []string{"utrveth*"})
+    if err := w.Start(); err != nil {
+        t.Fatal(err)
+    }
+    defer w.Stop()
+    
+    ip := func(args string) {
+        t.Helper()
+        if out, err := exec.Command("ip", strings.Fields(args)...).CombinedOutput(); err != nil {
+            t.Skipf("ip %s: %v: %s", args, err, out)
+        }
+    }
+    waitFor := func(want ...string) {
+        t.Helper()
+        deadline := time.Now().Add(5 * time.Second)
+        for !reflect.DeepEqual(loader.list(), want) {
+            if time.Now().After(deadline) {
+                t.Fatalf("got %v, want %v", loader.list(), want)
+            }
+            time.Sleep(10 * time.Millisecond)
+        }
+    }
+    
+    // Created down, then the peer end goes up and down and up again
+    ip("link add utrveth0 type veth peer name utrveth1")
+    ip("link set utrveth1 up")
+    waitFor("attach utrveth1")
+    ip("link set utrveth1 down")
+    waitFor("attach utrveth1", "detach utrveth1")
+    ip("link set utrveth1 up")
+    waitFor("attach utrveth1", "detach utrveth1", "attach utrveth1")
+    
+    // Deleting one end takes both away
+    ip("link del utrveth0")
+    waitFor("attach utrveth1", "detach utrveth1", "attach utrveth1", "detach utrveth1")
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// No rtnetlink, and no eBPF programs to attach either
+type linkEvents struct{}
+
+func openLinkEvents() (*linkEvents, error) {
+    return nil, fmt.Errorf("%w: interface events need rtnetlink", ErrEBPFUnsupported)
+}
+
+func (*linkEvents) read() ([]linkEvent, error) { return nil, ErrEBPFUnsupported }
+func (*linkEvents) close() error              { return nil }
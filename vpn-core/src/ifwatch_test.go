@@ -0,0 +1,80 @@
+package main
+
+import (
+    "errors"
+    "reflect"
+    "sync"
+    "testing"
+)
+
+// recordingLoader notes the interfaces it is asked to attach to, in order
+type recordingLoader struct {
+    NoEBPF
+    mu    sync.Mutex
+    calls []string
+    fail  map[string]bool
+}
+
+func (l *recordingLoader) AttachInterface(vpn *UnderTheRadarVPN, name string) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.fail[name] {
+        return errors.New("attach refused")
+    }
+    l.calls = append(l.calls, "attach "+name)
+    return nil
+}
+
+func (l *recordingLoader) DetachInterface(vpn *UnderTheRadarVPN, name string) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.calls = append(l.calls, "detach "+name)
+}
+
+func (l *recordingLoader) list() []string {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return append([]string(nil), l.calls...)
+}
+
+func TestInterfaceWatcherFollowsLinks(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    sink := &captureSink{}
+    vpn.SetMetricSink(sink)
+    loader := &recordingLoader{fail: map[string]bool{"eth9": true}}
+    w := NewInterfaceWatcher(vpn, loader, []string{"eth*", "usb?"})
+    
+    for _, ev := range []linkEvent{
+        {Index: 2, Name: "eth1"},           // down, left alone
+        {Index: 2, Name: "eth1", Up: true},
+        {Index: 2, Name: "eth1", Up: true}, // another flag change
+        {Index: 3, Name: "wlan0", Up: true},
+        {Index: 4, Name: "utr0", Up: true}, // the tunnel itself
+        {Index: 5, Name: "usb0", Up: true},
+        {Index: 2, Name: "eth1"},
+        {Index: 5, Name: "wan0", Up: true}, // renamed away from the pattern
+        {Index: 6, Name: "eth9", Up: true},
+        {Index: 2, Name: "eth1", Up: true},
+        {Index: 2, Name: "eth1", Deleted: true},
+    } {
+        w.handle(ev)
+    }
+    
+    want := []string{"attach eth1", "attach usb0", "detach eth1", "detach usb0", "attach eth1", "detach eth1"}
+    if got := loader.list(); !reflect.DeepEqual(got, want) {
+        t.Fatalf("got %v, want %v", got, want)
+    }
+    if len(w.Attached()) != 0 {
+        t.Fatalf("still attached to %v", w.Attached())
+    }
+    if !sink.has("c ebpf.attach_failed 1 interface:eth9") {
+        t.Fatalf("failed attach not counted: %v", sink.metrics)
+    }
+    
+    // Retried on the interface's next change
+    loader.fail = nil
+    w.handle(linkEvent{Index: 6, Name: "eth9", Up: true})
+    if got := w.Attached(); !reflect.DeepEqual(got, []string{"eth9"}) {
+        t.Fatalf("attached to %v", got)
+    }
+}
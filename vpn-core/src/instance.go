@@ -0,0 +1,113 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// Where instances lock the devices they manage, see VPNOptions.LockDir
+const defaultLockDir = "/run/undertheradar"
+
+var ErrAlreadyRunning = errors.New("another instance is already managing the device")
+
+// instanceLock is an exclusive lock on <dir>/<device>.lock holding the pid
+// of the owner. The kernel drops it when the process dies, so a crashed
+// instance never blocks the next one.
+type instanceLock struct {
+    file *os.File
+    path string
+}
+
+// Lock device for this process. With force a lock held by someone else is
+// taken over: the file is replaced, leaving the old owner locking an
+// unlinked one.
+func acquireInstanceLock(dir, device string, force bool) (*instanceLock, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, fmt.Errorf("failed to create lock directory: %w", err)
+    }
+    path := filepath.Join(dir, device+".lock")
+    
+    for {
+        file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+        if err != nil {
+            return nil, fmt.Errorf("failed to open lock file: %w", err)
+        }
+        if err := lockFile(file); err != nil {
+            owner := readLockOwner(file)
+            file.Close()
+            if !force {
+                return nil, fmt.Errorf("%w: %s is locked by pid %s (%s), set Force to take over", ErrAlreadyRunning, device, owner, path)
+            }
+            os.Remove(path)
+            force = false
+            continue
+        }
+        
+        // Someone forcing a takeover may have replaced the file meanwhile
+        if !sameFile(file, path) {
+            file.Close()
+            continue
+        }
+        
+        file.Truncate(0)
+        file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+        return &instanceLock{file: file, path: path}, nil
+    }
+}
+
+func readLockOwner(file *os.File) string {
+    buf := make([]byte, 32)
+    n, _ := file.ReadAt(buf, 0)
+    if owner := strings.TrimSpace(string(buf[:n])); owner != "" {
+        return owner
+    }
+    return "unknown"
+}
+
+func sameFile(file *os.File, path string) bool {
+    opened, err := file.Stat()
+    if err != nil {
+        return false
+    }
+    current, err := os.Stat(path)
+    return err == nil && os.SameFile(opened, current)
+}
+
+// Release removes the lock file unless another instance took it over
+func (l *instanceLock) Release() {
+    if l == nil || l.file == nil {
+        return
+    }
+    if sameFile(l.file, l.path) {
+        os.Remove(l.path)
+    }
+    l.file.Close()
+    l.file = nil
+}
+
+func (vpn *UnderTheRadarVPN) lockInstance(force bool) error {
+    if vpn.lockDir == "" {
+        return nil // assembled without a constructor
+    }
+    lock, err := acquireInstanceLock(vpn.lockDir, vpn.deviceName, force)
+    if err != nil {
+        return err
+    }
+    vpn.mu.Lock()
+    vpn.instance = lock
+    vpn.mu.Unlock()
+    return nil
+}
+
+func (vpn *UnderTheRadarVPN) unlockInstance() {
+    vpn.mu.Lock()
+    lock := vpn.instance
+    vpn.instance = nil
+    vpn.mu.Unlock()
+    
+    lock.Release()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// No flock, the lock file only records the owner
+func lockFile(file *os.File) error {
+    return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+func TestSecondInstanceIsRejected(t *testing.T) {
+    installFakeHost(t, "")
+    wg := newFakeWGClient()
+    lockDir := t.TempDir()
+    newInstance := func() *UnderTheRadarVPN {
+        vpn, err := NewUnderTheRadarVPNWithOptions(VPNOptions{
+            DeviceName: "utr0",
+            WGClient:   wg,
+            EBPF:       NoEBPF{},
+            LockDir:    lockDir,
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+        return vpn
+    }
+    
+    first := newInstance()
+    if err := first.Start(VPNConfig{ListenPort: 51820}); err != nil {
+        t.Fatal(err)
+    }
+    lockPath := filepath.Join(lockDir, "utr0.lock")
+    if owner, err := os.ReadFile(lockPath); err != nil || strings.TrimSpace(string(owner)) != strconv.Itoa(os.Getpid()) {
+        t.Fatalf("lock file %q, %v", owner, err)
+    }
+    
+    // Refused before it touches the device, even when told to adopt it
+    second := newInstance()
+    configs := len(wg.configs)
+    err := second.Start(VPNConfig{ListenPort: 51820, AdoptExisting: true})
+    if !errors.Is(err, ErrAlreadyRunning) {
+        t.Fatalf("second Start: %v, want ErrAlreadyRunning", err)
+    }
+    if len(wg.configs) != configs {
+        t.Fatal("second instance configured the device")
+    }
+    
+    // Stop lets the next instance in
+    if err := first.Stop(); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+        t.Fatalf("lock file left after Stop: %v", err)
+    }
+    third := newInstance()
+    if err := third.Start(VPNConfig{ListenPort: 51820, AdoptExisting: true}); err != nil {
+        t.Fatal(err)
+    }
+    third.Stop()
+}
+
+func TestForceTakesOverInstanceLock(t *testing.T) {
+    dir := t.TempDir()
+    held, err := acquireInstanceLock(dir, "utr0", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer held.Release()
+    
+    if _, err := acquireInstanceLock(dir, "utr0", false); !errors.Is(err, ErrAlreadyRunning) {
+        t.Fatalf("err = %v, want ErrAlreadyRunning", err)
+    }
+    taken, err := acquireInstanceLock(dir, "utr0", true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    // The displaced owner must not remove the new lock
+    held.Release()
+    if _, err := acquireInstanceLock(dir, "utr0", false); !errors.Is(err, ErrAlreadyRunning) {
+        t.Fatalf("lock lost after the old owner released: %v", err)
+    }
+    taken.Release()
+    
+    other, err := acquireInstanceLock(dir, "utr1", false)
+    if err != nil {
+        t.Fatalf("locks are per device: %v", err)
+    }
+    other.Release()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestKillSwitchAllowEstablishedOnlyWhenLenient(t *testing.T) {
+    for _, lenient := range []bool{false, true} {
+        commands := recordSystemCommands(t)
+        ks := NewKillSwitch("utr0")
+        ks.AllowEstablished = lenient
+        if err := ks.Enable(); err != nil {
+            t.Fatal(err)
+        }
+        
+        for _, ipt := range []string{"iptables", "ip6tables"} {
+            established := indexOf(*commands, ipt+" -A OUTPUT -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT")
+            if !lenient {
+                if established >= 0 {
+                    t.Fatalf("%s: strict kill switch accepts established connections", ipt)
+                }
+                continue
+            }
+            // After the tunnel device's accept, before everything is dropped
+            device := indexOf(*commands, ipt+" -A OUTPUT -o utr0 -j ACCEPT")
+            drop := indexOf(*commands, ipt+" -A OUTPUT -j DROP")
+            if device < 0 || established < device || established > drop {
+                t.Fatalf("%s: established accept out of place in %v", ipt, *commands)
+            }
+        }
+        
+        // Added for both families and removed again
+        ks.Disable()
+        conntrack := 0
+        for _, cmd := range *commands {
+            if strings.Contains(cmd, "--ctstate") {
+                conntrack++
+            }
+        }
+        if lenient && conntrack != 4 || !lenient && conntrack != 0 {
+            t.Fatalf("lenient=%v: %d conntrack commands", lenient, conntrack)
+        }
+    }
+}
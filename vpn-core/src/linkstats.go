@@ -0,0 +1,159 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+var ErrInterfaceStatsUnsupported = errors.New("interface statistics are not available on this platform")
+
+// InterfaceStats are the kernel's counters of the tunnel device, below
+// WireGuard's per-peer ones: what the device dropped or failed to send
+// never reaches a peer's counters. The kernel's totals, carried across
+// the device being recreated.
+type InterfaceStats struct {
+    Source string // "rtnetlink" or "sysfs", empty before the first poll
+    
+    RxPackets uint64
+    TxPackets uint64
+    RxBytes   uint64
+    TxBytes   uint64
+    RxErrors  uint64
+    TxErrors  uint64
+    RxDropped uint64
+    TxDropped uint64
+    
+    // FIFO overruns, as ifconfig counts them
+    RxOverruns uint64
+    TxOverruns uint64
+    
+    CarrierChanges uint64
+}
+
+// One reading of the kernel's counters, raw
+type linkCounters [11]uint64
+
+func (c linkCounters) stats(source string) InterfaceStats {
+    return InterfaceStats{
+        Source:         source,
+        RxPackets:      c[0],
+        TxPackets:      c[1],
+        RxBytes:        c[2],
+        TxBytes:        c[3],
+        RxErrors:       c[4],
+        TxErrors:       c[5],
+        RxDropped:      c[6],
+        TxDropped:      c[7],
+        RxOverruns:     c[8],
+        TxOverruns:     c[9],
+        CarrierChanges: c[10],
+    }
+}
+
+// Names the counters are reported to the MetricSink under, and their
+// files in /sys/class/net/<device>/statistics but carrier_changes
+var linkCounterNames = [len(linkCounters{})]string{
+    "rx_packets", "tx_packets", "rx_bytes", "tx_bytes",
+    "rx_errors", "tx_errors", "rx_dropped", "tx_dropped",
+    "rx_fifo_errors", "tx_fifo_errors", "carrier_changes",
+}
+
+// readLinkCounters reads the device's counters, over rtnetlink where there
+// is one and from sysfs otherwise. Tests replace it.
+var readLinkCounters = func(device string) (linkCounters, string, error) {
+    counters, err := rtnlLinkCounters(device)
+    if err == nil {
+        return counters, "rtnetlink", nil
+    }
+    if sysfs, sysErr := sysfsLinkCounters(device); sysErr == nil {
+        return sysfs, "sysfs", nil
+    }
+    return linkCounters{}, "", err
+}
+
+func sysfsLinkCounters(device string) (linkCounters, error) {
+    var counters linkCounters
+    dir := filepath.Join("/sys/class/net", device)
+    for i, name := range linkCounterNames {
+        path := filepath.Join(dir, "statistics", name)
+        if name == "carrier_changes" {
+            path = filepath.Join(dir, name)
+        }
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return counters, fmt.Errorf("failed to read %s: %w", path, err)
+        }
+        if counters[i], err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+            return counters, fmt.Errorf("invalid %s: %w", path, err)
+        }
+    }
+    return counters, nil
+}
+
+// linkStatsTracker keeps the device counters monotonic, see
+// counterTracker, and what each grew by at the last poll
+type linkStatsTracker struct {
+    mu       sync.Mutex
+    counters [len(linkCounters{})]counterTracker
+    totals   linkCounters
+    source   string
+    polled   bool
+}
+
+// Take a reading and return the growth of each counter since the last
+func (t *linkStatsTracker) update(raw linkCounters, source string) (deltas linkCounters) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    
+    for i := range raw {
+        total, _ := t.counters[i].update(raw[i])
+        if t.polled {
+            deltas[i] = total - t.totals[i]
+        }
+        t.totals[i] = total
+    }
+    t.source, t.polled = source, true
+    return deltas
+}
+
+func (t *linkStatsTracker) stats() InterfaceStats {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    
+    if !t.polled {
+        return InterfaceStats{}
+    }
+    return t.totals.stats(t.source)
+}
+
+// Poll the tunnel device's counters and report what they grew by to the
+// MetricSink as device.link.* counts. The first poll only sets the
+// baseline.
+func (vpn *UnderTheRadarVPN) collectLinkStats() error {
+    raw, source, err := readLinkCounters(vpn.deviceName)
+    if err != nil {
+        return err
+    }
+    deltas := vpn.linkStats.update(raw, source)
+    sink := vpn.metricSink()
+    for i, name := range linkCounterNames {
+        if deltas[i] > 0 {
+            sink.Count("device.link."+name, int64(deltas[i]))
+        }
+    }
+    return nil
+}
+
+// InterfaceStats polls the tunnel device's counters now.
+// ErrInterfaceStatsUnsupported without rtnetlink or sysfs.
+func (vpn *UnderTheRadarVPN) InterfaceStats() (InterfaceStats, error) {
+    if err := vpn.collectLinkStats(); err != nil {
+        return InterfaceStats{}, err
+    }
+    return vpn.linkStats.stats(), nil
+}
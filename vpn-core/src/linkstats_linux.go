@@ -0,0 +1,75 @@
+//go:build linux
+
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "net"
+    "syscall"
+    "unsafe"
+    
+    "golang.org/x/sys/unix"
+)
+
+// Offsets of our counters in struct rtnl_link_stats64, in uint64s, then
+// the carrier changes from their own attribute
+var rtnlStatsFields = [len(linkCounters{}) - 1]int{
+    0, 1, 2, 3, // rx/tx packets and bytes
+    4, 5, 6, 7, // rx/tx errors and dropped
+    14, 18, // rx_fifo_errors, tx_fifo_errors
+}
+
+// Dump the links over rtnetlink and read IFLA_STATS64 and
+// IFLA_CARRIER_CHANGES of device
+func rtnlLinkCounters(device string) (linkCounters, error) {
+    var counters linkCounters
+    iface, err := net.InterfaceByName(device)
+    if err != nil {
+        return counters, err
+    }
+    rib, err := syscall.NetlinkRIB(syscall.RTM_GETLINK, syscall.AF_UNSPEC)
+    if err != nil {
+        return counters, fmt.Errorf("failed to dump links: %w", err)
+    }
+    msgs, err := syscall.ParseNetlinkMessage(rib)
+    if err != nil {
+        return counters, fmt.Errorf("failed to parse links: %w", err)
+    }
+    
+    for _, msg := range msgs {
+        if msg.Header.Type != syscall.RTM_NEWLINK || len(msg.Data) < unix.SizeofIfInfomsg {
+            continue
+        }
+        info := (*syscall.IfInfomsg)(unsafe.Pointer(&msg.Data[0]))
+        if int(info.Index) != iface.Index {
+            continue
+        }
+        attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+        if err != nil {
+            return counters, fmt.Errorf("failed to parse %s: %w", device, err)
+        }
+        found := false
+        for _, attr := range attrs {
+            switch attr.Attr.Type {
+            case unix.IFLA_STATS64:
+                if len(attr.Value) < 8*(rtnlStatsFields[len(rtnlStatsFields)-1]+1) {
+                    return counters, fmt.Errorf("short link statistics of %s", device)
+                }
+                for i, field := range rtnlStatsFields {
+                    counters[i] = binary.NativeEndian.Uint64(attr.Value[8*field:])
+                }
+                found = true
+            case unix.IFLA_CARRIER_CHANGES:
+                if len(attr.Value) >= 4 {
+                    counters[len(counters)-1] = uint64(binary.NativeEndian.Uint32(attr.Value))
+                }
+            }
+        }
+        if !found {
+            return counters, fmt.Errorf("no link statistics for %s", device)
+        }
+        return counters, nil
+    }
+    return counters, fmt.Errorf("link %s not in the dump", device)
+}
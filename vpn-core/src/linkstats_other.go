@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// No rtnetlink; readLinkCounters tries sysfs, which is Linux's too
+func rtnlLinkCounters(device string) (linkCounters, error) {
+    return linkCounters{}, ErrInterfaceStatsUnsupported
+}
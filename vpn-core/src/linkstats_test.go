@@ -0,0 +1,88 @@
+package main
+
+import (
+    "errors"
+    "runtime"
+    "testing"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Serve readings from samples, one per poll
+func fakeLinkCounters(t *testing.T, samples ...linkCounters) {
+    orig := readLinkCounters
+    readLinkCounters = func(device string) (linkCounters, string, error) {
+        if len(samples) == 0 {
+            return linkCounters{}, "", ErrInterfaceStatsUnsupported
+        }
+        next := samples[0]
+        samples = samples[1:]
+        return next, "sysfs", nil
+    }
+    t.Cleanup(func() { readLinkCounters = orig })
+}
+
+func TestLinkStatsReportDeltas(t *testing.T) {
+    wg := newFakeWGClient()
+    wg.setPeer("utr0", wgtypes.Peer{PublicKey: mustKey(t).PublicKey()})
+    vpn := newTestVPN(t, wg)
+    sink := &captureSink{}
+    vpn.SetMetricSink(sink)
+    
+    // rx_errors and tx_dropped grow, then the device is recreated and
+    // its counters start over
+    fakeLinkCounters(t,
+        linkCounters{100, 50, 0, 0, 2, 0, 0, 1, 0, 0, 1},
+        linkCounters{160, 80, 0, 0, 5, 0, 0, 4, 0, 0, 1},
+        linkCounters{10, 5, 0, 0, 1, 0, 0, 0, 0, 0, 0},
+    )
+    
+    vpn.collectMetrics()
+    if len(sink.metrics) != 0 {
+        t.Fatalf("first poll reported %v", sink.metrics)
+    }
+    vpn.collectMetrics()
+    for _, metric := range []string{"c device.link.rx_packets 60 ", "c device.link.rx_errors 3 ", "c device.link.tx_dropped 3 "} {
+        if !sink.has(metric) {
+            t.Fatalf("missing %q in %v", metric, sink.metrics)
+        }
+    }
+    if sink.has("c device.link.carrier_changes 0 ") {
+        t.Fatal("unchanged counter reported")
+    }
+    
+    sink.metrics = nil
+    vpn.collectMetrics()
+    if !sink.has("c device.link.rx_packets 10 ") || !sink.has("c device.link.rx_errors 1 ") {
+        t.Fatalf("after reset %v", sink.metrics)
+    }
+    
+    got := vpn.GetStatus().Interface
+    if got.Source != "sysfs" || got.RxPackets != 170 || got.RxErrors != 6 || got.TxDropped != 4 || got.CarrierChanges != 1 {
+        t.Fatalf("status %+v", got)
+    }
+    if _, err := vpn.InterfaceStats(); !errors.Is(err, ErrInterfaceStatsUnsupported) {
+        t.Fatalf("no reading gave %v", err)
+    }
+}
+
+func TestLinkCountersOfLoopback(t *testing.T) {
+    if runtime.GOOS != "linux" {
+        if _, err := rtnlLinkCounters("lo"); !errors.Is(err, ErrInterfaceStatsUnsupported) {
+            t.Fatalf("got %v", err)
+        }
+        return
+    }
+    sysfs, err := sysfsLinkCounters("lo")
+    if err != nil {
+        t.Skip(err)
+    }
+    rtnl, err := rtnlLinkCounters("lo")
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Loopback carries some traffic between the two reads at most
+    if rtnl[0] < sysfs[0] || rtnl[4] != sysfs[4] {
+        t.Fatalf("rtnetlink %v, sysfs %v", rtnl, sysfs)
+    }
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "sort"
+)
+
+// Most extra listen ports, LISTEN_PORTS_MAX in the eBPF programs
+const maxListenPorts = 64
+
+var (
+    ErrListenPortsNeedPort = errors.New("ListenPorts needs a fixed ListenPort")
+    ErrHopPortsNeedPort    = errors.New("HopPorts needs a fixed ListenPort")
+)
+
+func validateListenPorts(config VPNConfig) error {
+    if len(config.HopPorts) > 0 && config.ListenPort == 0 {
+        return ErrHopPortsNeedPort
+    }
+    if len(config.ListenPorts) == 0 {
+        return nil
+    }
+    if config.ListenPort == 0 {
+        return ErrListenPortsNeedPort
+    }
+    if len(config.ListenPorts) > maxListenPorts {
+        return fmt.Errorf("%d ListenPorts, at most %d", len(config.ListenPorts), maxListenPorts)
+    }
+    seen := make(map[int]bool, len(config.ListenPorts))
+    for _, port := range config.ListenPorts {
+        if port <= 0 || port > 65535 {
+            return fmt.Errorf("invalid listen port %d", port)
+        }
+        if port == config.ListenPort || seen[port] {
+            return fmt.Errorf("listen port %d given twice", port)
+        }
+        seen[port] = true
+    }
+    return nil
+}
+
+// Ports redirected to ListenPort: the hop ports and the extra listen ports
+func redirectedPorts(config VPNConfig) []int {
+    seen := make(map[int]bool)
+    var ports []int
+    for _, port := range append(append([]int(nil), config.HopPorts...), config.ListenPorts...) {
+        if !seen[port] {
+            seen[port] = true
+            ports = append(ports, port)
+        }
+    }
+    sort.Ints(ports)
+    return ports
+}
+
+// listenPortKey is a port in network order, the key of listen_ports
+func listenPortKey(port int) [2]byte {
+    var key [2]byte
+    binary.BigEndian.PutUint16(key[:], uint16(port))
+    return key
+}
+
+// Steer the extra listen ports in XDP, replacing the previous set. The
+// DNAT rules also cover them, for IPv6 and without the eBPF programs.
+// Caller holds vpn.mu or has the VPN to itself.
+func (vpn *UnderTheRadarVPN) writeListenPorts() error {
+    m, ok := vpn.ebpfMaps["listen_ports"]
+    if !ok {
+        return nil
+    }
+    
+    want := make(map[[2]byte]bool, len(vpn.listenPorts))
+    for _, port := range vpn.listenPorts {
+        want[listenPortKey(port)] = true
+    }
+    
+    var key [2]byte
+    var value uint8
+    var stale [][2]byte
+    iter := m.Iterate()
+    for iter.Next(&key, &value) {
+        if !want[key] {
+            stale = append(stale, key)
+        }
+    }
+    if err := iter.Err(); err != nil {
+        return fmt.Errorf("failed to read listen ports: %w", err)
+    }
+    for _, key := range stale {
+        m.Delete(key)
+    }
+    for key := range want {
+        if err := m.Put(key, uint8(1)); err != nil {
+            return fmt.Errorf("failed to steer listen port %d: %w", binary.BigEndian.Uint16(key[:]), err)
+        }
+    }
+    return nil
+}
+
+// Take a new set of extra listen ports on a running VPN
+func (vpn *UnderTheRadarVPN) setListenPorts(ports []int) error {
+    vpn.mu.Lock()
+    defer vpn.mu.Unlock()
+    
+    vpn.listenPorts = ports
+    return vpn.writeListenPorts()
+}
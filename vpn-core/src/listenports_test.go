@@ -0,0 +1,90 @@
+package main
+
+import (
+    "errors"
+    "os"
+    "reflect"
+    "testing"
+    
+    "github.com/cilium/ebpf"
+)
+
+func TestValidateListenPorts(t *testing.T) {
+    for name, tc := range map[string]struct {
+        config VPNConfig
+        ok     bool
+    }{
+        "none":            {VPNConfig{}, true},
+        "extra ports":     {VPNConfig{ListenPort: 51820, ListenPorts: []int{51821, 51822}}, true},
+        "no fixed port":   {VPNConfig{ListenPorts: []int{51821}}, false},
+        "out of range":    {VPNConfig{ListenPort: 51820, ListenPorts: []int{70000}}, false},
+        "the listen port": {VPNConfig{ListenPort: 51820, ListenPorts: []int{51820}}, false},
+        "twice":           {VPNConfig{ListenPort: 51820, ListenPorts: []int{51821, 51821}}, false},
+        "too many":        {VPNConfig{ListenPort: 1000, ListenPorts: PortRange(2000, 2000+maxListenPorts)}, false},
+    } {
+        if err := validateListenPorts(tc.config); (err == nil) != tc.ok {
+            t.Errorf("%s: %v", name, err)
+        }
+    }
+    if err := validateListenPorts(VPNConfig{ListenPorts: []int{1}}); !errors.Is(err, ErrListenPortsNeedPort) {
+        t.Errorf("no fixed port: %v", err)
+    }
+}
+
+func TestListenPortsRedirectWithHopPorts(t *testing.T) {
+    fakeUplink(t, "eth0")
+    vpn, _, host := startForReload(t, VPNConfig{ListenPort: 51820, HopPorts: []int{443}, ListenPorts: []int{51821, 443}})
+    
+    for _, port := range []string{"443", "51821"} {
+        for _, bin := range []string{"iptables", "ip6tables"} {
+            rule := bin + " nat PREROUTING -i eth0 -p udp --dport " + port + " -j DNAT --to-destination :51820"
+            if host.rules[rule] != 1 {
+                t.Fatalf("missing %q in %v", rule, host.rules)
+            }
+        }
+    }
+    
+    if err := vpn.Reload(VPNConfig{ListenPort: 51820, HopPorts: []int{443}}); err != nil {
+        t.Fatal(err)
+    }
+    if host.rules["iptables nat PREROUTING -i eth0 -p udp --dport 51821 -j DNAT --to-destination :51820"] != 0 ||
+        host.rules["iptables nat PREROUTING -i eth0 -p udp --dport 443 -j DNAT --to-destination :51820"] != 1 {
+        t.Fatalf("rules after dropping the listen ports: %v", host.rules)
+    }
+}
+
+func TestWriteListenPorts(t *testing.T) {
+    if os.Geteuid() != 0 {
+        t.Skip("creating eBPF maps requires root")
+    }
+    
+    // Same layout as listen_ports in ebpf/xdp_accelerator.c
+    m, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Hash, KeySize: 2, ValueSize: 1, MaxEntries: maxListenPorts})
+    if err != nil {
+        t.Skipf("eBPF maps unavailable: %v", err)
+    }
+    defer m.Close()
+    
+    vpn := newTestVPN(t, newFakeWGClient())
+    vpn.ebpfMaps = map[string]*ebpf.Map{"listen_ports": m}
+    if err := vpn.setListenPorts([]int{51821, 51822}); err != nil {
+        t.Fatal(err)
+    }
+    if err := vpn.setListenPorts([]int{51822, 51823}); err != nil {
+        t.Fatal(err)
+    }
+    
+    got := make(map[[2]byte]bool)
+    var key [2]byte
+    var value uint8
+    for iter := m.Iterate(); iter.Next(&key, &value); {
+        got[key] = true
+    }
+    want := map[[2]byte]bool{listenPortKey(51822): true, listenPortKey(51823): true}
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("steered ports = %v, want %v", got, want)
+    }
+    if key := listenPortKey(51821); key != [2]byte{0xca, 0x6d} {
+        t.Fatalf("port not in network order: %x", key)
+    }
+}
@@ -0,0 +1,61 @@
+package main
+
+import "math"
+
+// LoadWeights tunes what "load" means when picking between peers. The score
+// of a peer is
+//
+//     Bandwidth*bytes + Latency*latency_us + Loss*loss
+//
+// where bytes is rx+tx, latency_us the last measured round trip in
+// microseconds and loss the packet loss in hundredths of a percent. Lower
+// scores win.
+type LoadWeights struct {
+    Bandwidth float64
+    Latency   float64
+    Loss      float64
+}
+
+// DefaultLoadWeights reproduce the original fixed formula
+var DefaultLoadWeights = LoadWeights{
+    Bandwidth: 1,
+    Latency:   1000,
+    Loss:      10000,
+}
+
+func (w LoadWeights) score(bytes uint64, latency, loss uint32) uint64 {
+    score := w.Bandwidth*float64(bytes) + w.Latency*float64(latency) + w.Loss*float64(loss)
+    if score <= 0 {
+        return 0
+    }
+    if score >= math.MaxUint64 {
+        return math.MaxUint64
+    }
+    return uint64(score)
+}
+
+// SetLoadWeights changes how collectMetrics scores peers for routing
+func (vpn *UnderTheRadarVPN) SetLoadWeights(w LoadWeights) {
+    vpn.mu.Lock()
+    vpn.loadWeights = w
+    vpn.mu.Unlock()
+}
+
+// counterTracker turns a raw kernel counter into a monotonic total.
+// WireGuard counters start from zero again when the device is recreated,
+// so a fresh value lower than the last one is treated as a reset and the
+// total is rebased instead of going backwards.
+type counterTracker struct {
+    base uint64 // sum of counter values seen before the last reset
+    last uint64 // raw value from the previous poll
+}
+
+func (ct *counterTracker) update(raw uint64) (total uint64, reset bool) {
+    if raw < ct.last {
+        ct.base += ct.last
+        reset = true
+    }
+    ct.last = raw
+    
+    return ct.base + raw, reset
+}
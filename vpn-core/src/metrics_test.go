@@ -0,0 +1,109 @@
+package main
+
+import (
+    "testing"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestCounterTrackerRebasesOnReset(t *testing.T) {
+    var ct counterTracker
+    
+    // Counter grows, device is recreated, then grows again
+    samples := []struct {
+        raw   uint64
+        total uint64
+        reset bool
+    }{
+        {raw: 100, total: 100},
+        {raw: 250, total: 250},
+        {raw: 40, total: 290, reset: true},
+        {raw: 90, total: 340},
+        {raw: 10, total: 350, reset: true},
+        {raw: 10, total: 350},
+    }
+    
+    for i, s := range samples {
+        total, reset := ct.update(s.raw)
+        if total != s.total || reset != s.reset {
+            t.Fatalf("sample %d: got (%d, %v), want (%d, %v)", i, total, reset, s.total, s.reset)
+        }
+    }
+}
+
+func TestCollectMetricsEmitsResetEvent(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    peer := &Peer{PublicKey: mustKey(t).PublicKey()}
+    vpn.peers.put(peer)
+    
+    // Decreasing receive counter across polls
+    for _, rx := range []int64{5000, 8000, 300} {
+        wg.setPeer("utr0", wgtypes.Peer{PublicKey: peer.PublicKey, ReceiveBytes: rx})
+        vpn.collectMetrics()
+    }
+    
+    if got := peer.RxBytes.Load(); got != 8300 {
+        t.Fatalf("RxBytes = %d, want 8300", got)
+    }
+    
+    select {
+    case ev := <-vpn.Events():
+        if ev.Type != EventCounterReset || ev.PublicKey != peer.PublicKey {
+            t.Fatalf("unexpected event %+v", ev)
+        }
+    default:
+        t.Fatal("expected a counter reset event")
+    }
+    
+    select {
+    case ev := <-vpn.Events():
+        t.Fatalf("unexpected extra event %+v", ev)
+    default:
+    }
+}
+
+func TestLoadWeightsScore(t *testing.T) {
+    tests := []struct {
+        weights LoadWeights
+        bytes   uint64
+        latency uint32
+        loss    uint32
+        want    uint64
+    }{
+        // Defaults match the original formula: bytes + latency*1000 + loss*10000
+        {DefaultLoadWeights, 5000, 20000, 150, 5000 + 20000*1000 + 150*10000},
+        {DefaultLoadWeights, 0, 0, 0, 0},
+        
+        // Latency-sensitive workload ignores bandwidth entirely
+        {LoadWeights{Latency: 1}, 1 << 40, 35000, 900, 35000},
+        {LoadWeights{Bandwidth: 0.5, Latency: 2, Loss: 100}, 1000, 300, 25, 500 + 600 + 2500},
+        
+        // Saturates instead of overflowing
+        {LoadWeights{Bandwidth: 1e9}, 1 << 62, 0, 0, ^uint64(0)},
+    }
+    
+    for i, tt := range tests {
+        if got := tt.weights.score(tt.bytes, tt.latency, tt.loss); got != tt.want {
+            t.Errorf("case %d: score = %d, want %d", i, got, tt.want)
+        }
+    }
+}
+
+func TestCollectMetricsUsesLoadWeights(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    vpn.SetLoadWeights(LoadWeights{Bandwidth: 0, Latency: 1, Loss: 10})
+    
+    peer := &Peer{PublicKey: mustKey(t).PublicKey()}
+    peer.CurrentLatency.Store(12000)
+    peer.PacketLoss.Store(50)
+    vpn.peers.put(peer)
+    
+    wg.setPeer("utr0", wgtypes.Peer{PublicKey: peer.PublicKey, ReceiveBytes: 1 << 30})
+    vpn.collectMetrics()
+    
+    if got := peer.LoadScore.Load(); got != 12500 {
+        t.Fatalf("LoadScore = %d, want 12500", got)
+    }
+}
@@ -0,0 +1,142 @@
+package main
+
+import "time"
+
+// MetricSink receives the VPN's metrics, decoupled from any one monitoring
+// backend. Tags are "key:value" strings. Sinks are called from several
+// goroutines and must not block for long.
+//
+// Emitted metrics, peer metrics tagged with peer and group:
+//
+//     peer.rx_bytes, peer.tx_bytes        count, bytes since the last poll
+//     peer.latency_ms                     gauge
+//     peer.packet_loss_percent            gauge
+//     peer.handshake_age_seconds          gauge, only after a handshake
+//     peer.load_score                     gauge
+//     peer.priority                       gauge, AutoPriority peers only
+//     peer.failover                       count, tagged result:alternate or result:dead
+//     peer.recovered                      count
+//     peer.drained                        count, tagged result:idle or result:forced, see DrainPeer
+//     peer.allowed_ip.packets/bytes       gauge, totals tagged prefix, with the fast path
+//     device.peers, device.peers_alive    gauge
+//     device.fastpath.packets/bytes       gauge, totals tagged direction, with the fast path
+//     device.datapath.enqueued/dequeued   gauge, packet totals of the stream transport
+//     device.datapath.dropped             gauge, tagged lane
+//     admission.queued/processed/shed     count, tagged class, see Admission
+//     handshake.rate_limited              count, unknown-key handshakes refused
+//     device.poll_failed                  count, metrics polls that could not read the device
+//     ebpf.attach_failed                  count, tagged interface, see InterfaceWatcher
+//     device.link.rx_errors, ...          count, growth of the device's kernel counters, see InterfaceStats
+//     peers.synced                        count, tagged result:ok or result:failed, see SyncPeers
+type MetricSink interface {
+    Gauge(name string, value float64, tags ...string)
+    Count(name string, delta int64, tags ...string)
+}
+
+// NopSink discards metrics, the default
+type NopSink struct{}
+
+func (NopSink) Gauge(string, float64, ...string) {}
+func (NopSink) Count(string, int64, ...string)   {}
+
+// SetMetricSink sends metrics to sink from now on, nil restores NopSink
+func (vpn *UnderTheRadarVPN) SetMetricSink(sink MetricSink) {
+    vpn.mu.Lock()
+    vpn.sink = sink
+    vpn.mu.Unlock()
+}
+
+func (vpn *UnderTheRadarVPN) metricSink() MetricSink {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    var sink MetricSink = NopSink{}
+    if vpn.sink != nil {
+        sink = vpn.sink
+    }
+    if vpn.remoteWrite != nil {
+        return teeSink{sink, vpn.remoteWrite}
+    }
+    return sink
+}
+
+func (peer *Peer) metricTags() []string {
+    tags := []string{"peer:" + peer.PublicKey.String()}
+    if peer.Group != "" {
+        tags = append(tags, "group:"+peer.Group)
+    }
+    return tags
+}
+
+// Per-peer metrics after a poll. rxDelta and txDelta are the bytes since
+// the previous one.
+func (vpn *UnderTheRadarVPN) reportPeerMetrics(sink MetricSink, peer *Peer, rxDelta, txDelta uint64, now time.Time) {
+    tags := peer.metricTags()
+    sink.Count("peer.rx_bytes", int64(rxDelta), tags...)
+    sink.Count("peer.tx_bytes", int64(txDelta), tags...)
+    sink.Gauge("peer.latency_ms", float64(peer.CurrentLatency.Load())/1000, tags...)
+    sink.Gauge("peer.packet_loss_percent", float64(peer.PacketLoss.Load())/100, tags...)
+    sink.Gauge("peer.load_score", float64(peer.LoadScore.Load()), tags...)
+    if !peer.LastHandshake.IsZero() {
+        sink.Gauge("peer.handshake_age_seconds", now.Sub(peer.LastHandshake).Seconds(), tags...)
+    }
+}
+
+// Device-wide metrics, once per poll
+func (vpn *UnderTheRadarVPN) reportDeviceMetrics() {
+    sink := vpn.metricSink()
+    
+    vpn.mu.RLock()
+    peers, alive := vpn.peers.len(), 0
+    type prefixTraffic struct {
+        AllowedIPTraffic
+        tags []string
+    }
+    var allowedIPs []prefixTraffic
+    for _, peer := range vpn.peers.list {
+        if peer.IsAlive.Load() {
+            alive++
+        }
+        traffic, _ := vpn.allowedIPStatsLocked(peer)
+        for _, t := range traffic {
+            allowedIPs = append(allowedIPs, prefixTraffic{t, append(peer.metricTags(), "prefix:"+t.Prefix.String())})
+        }
+    }
+    var datapath *QueueStats
+    var shaping ShapingStats
+    if vpn.obfuscator != nil {
+        stats := vpn.obfuscator.QueueStats()
+        datapath = &stats
+        shaping = vpn.shapingStatsLocked()
+    }
+    fastPath, err := vpn.FastPathStats()
+    vpn.mu.RUnlock()
+    
+    sink.Gauge("device.peers", float64(peers))
+    sink.Gauge("device.peers_alive", float64(alive))
+    if err == nil && fastPath.Enabled {
+        for direction, d := range map[string]FastPathDirection{
+            "tunnel_to_uplink": fastPath.TunnelToUplink,
+            "uplink_to_tunnel": fastPath.UplinkToTunnel,
+        } {
+            sink.Gauge("device.fastpath.packets", float64(d.Packets), "direction:"+direction)
+            sink.Gauge("device.fastpath.bytes", float64(d.Bytes), "direction:"+direction)
+        }
+    }
+    for _, t := range allowedIPs {
+        sink.Gauge("peer.allowed_ip.packets", float64(t.Packets), t.tags...)
+        sink.Gauge("peer.allowed_ip.bytes", float64(t.Bytes), t.tags...)
+    }
+    if datapath != nil {
+        sink.Gauge("device.datapath.enqueued", float64(datapath.Enqueued))
+        sink.Gauge("device.datapath.dequeued", float64(datapath.Dequeued))
+        sink.Gauge("device.datapath.dropped", float64(datapath.DroppedBulk), "lane:bulk")
+        sink.Gauge("device.datapath.dropped", float64(datapath.DroppedHandshake), "lane:handshake")
+    }
+    if shaping.Packets > 0 || shaping.CoverPackets > 0 {
+        sink.Gauge("device.shaping.overhead_percent", shaping.OverheadPercent())
+        sink.Gauge("device.shaping.padding_bytes", float64(shaping.PaddingBytes))
+        sink.Gauge("device.shaping.cover_bytes", float64(shaping.CoverBytes))
+        sink.Gauge("device.shaping.cover_packets", float64(shaping.CoverPackets))
+    }
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// captureSink records every metric as "kind name value tags"
+type captureSink struct {
+    mu      sync.Mutex
+    metrics []string
+}
+
+func (c *captureSink) Gauge(name string, value float64, tags ...string) {
+    c.record("g", name, strconv.FormatFloat(value, 'f', -1, 64), tags)
+}
+
+func (c *captureSink) Count(name string, delta int64, tags ...string) {
+    c.record("c", name, strconv.FormatInt(delta, 10), tags)
+}
+
+func (c *captureSink) record(kind, name, value string, tags []string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.metrics = append(c.metrics, strings.Join([]string{kind, name, value, strings.Join(tags, ",")}, " "))
+}
+
+func (c *captureSink) has(metric string) bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for _, m := range c.metrics {
+        if m == metric {
+            return true
+        }
+    }
+    return false
+}
+
+func TestPeerMetricsReachSink(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    sink := &captureSink{}
+    vpn.SetMetricSink(sink)
+    
+    peer := &Peer{PublicKey: mustKey(t).PublicKey(), Group: "eu"}
+    peer.CurrentLatency.Store(12500)
+    peer.PacketLoss.Store(150)
+    vpn.peers.put(peer)
+    tags := "peer:" + peer.PublicKey.String() + ",group:eu"
+    
+    sample := wgtypes.Peer{PublicKey: peer.PublicKey, ReceiveBytes: 1000, TransmitBytes: 400, LastHandshakeTime: time.Now().Add(-30 * time.Second)}
+    vpn.applyPeerStats([]wgtypes.Peer{sample}, 0)
+    sample.ReceiveBytes, sample.TransmitBytes = 1500, 500
+    vpn.applyPeerStats([]wgtypes.Peer{sample}, 0)
+    
+    // Byte counts are deltas between polls
+    for _, want := range []string{
+        "c peer.rx_bytes 1000 " + tags,
+        "c peer.rx_bytes 500 " + tags,
+        "c peer.tx_bytes 100 " + tags,
+        "g peer.latency_ms 12.5 " + tags,
+        "g peer.packet_loss_percent 1.5 " + tags,
+    } {
+        if !sink.has(want) {
+            t.Errorf("missing %q in %v", want, sink.metrics)
+        }
+    }
+    found := false
+    for _, m := range sink.metrics {
+        if strings.HasPrefix(m, "g peer.handshake_age_seconds 30") {
+            found = true
+        }
+    }
+    if !found {
+        t.Errorf("no handshake age in %v", sink.metrics)
+    }
+    
+    // Failover outcomes are counted
+    fm := NewFailoverManager(vpn)
+    defer fm.events.Stop()
+    fm.handlePeerFailure(context.Background(), peer)
+    if !sink.has("c peer.failover 1 " + tags + ",result:dead") {
+        t.Errorf("failover not counted: %v", sink.metrics)
+    }
+    for i := 0; i < DefaultRecoveryChecks; i++ {
+        fm.confirmRecovery(peer)
+    }
+    if !sink.has("c peer.recovered 1 " + tags) {
+        t.Errorf("recovery not counted: %v", sink.metrics)
+    }
+    
+    vpn.reportDeviceMetrics()
+    if !sink.has("g device.peers 1 ") || !sink.has("g device.peers_alive 0 ") {
+        t.Errorf("device metrics missing: %v", sink.metrics)
+    }
+}
+
+func TestStatsDSinkFormat(t *testing.T) {
+    conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    
+    sink, err := NewStatsDSink(conn.LocalAddr().String(), "utr.")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sink.Close()
+    
+    read := func() string {
+        t.Helper()
+        buf := make([]byte, 512)
+        conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+        n, _, err := conn.ReadFrom(buf)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return string(buf[:n])
+    }
+    
+    sink.Gauge("peer.latency_ms", 12.5, "peer:abc", "group:eu")
+    if got := read(); got != "utr.peer.latency_ms:12.5|g|#peer:abc,group:eu" {
+        t.Errorf("gauge = %q", got)
+    }
+    sink.Count("peer.rx_bytes", 1500)
+    if got := read(); got != "utr.peer.rx_bytes:1500|c" {
+        t.Errorf("count = %q", got)
+    }
+    sink.NoTags = true
+    sink.Count("peer.failover", 1, "result:dead")
+    if got := read(); got != "utr.peer.failover:1|c" {
+        t.Errorf("untagged count = %q", got)
+    }
+}
+
+func TestOTLPSinkExport(t *testing.T) {
+    var mu sync.Mutex
+    var bodies []otlpRequest
+    fail := false
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mu.Lock()
+        defer mu.Unlock()
+        if fail {
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+        if r.Header.Get("Authorization") != "Bearer t" || r.Header.Get("Content-Type") != "application/json" {
+            t.Errorf("headers: %v", r.Header)
+        }
+        raw, _ := io.ReadAll(r.Body)
+        if !strings.Contains(string(raw), `"asInt":"7"`) && !strings.Contains(string(raw), `"asInt":"3"`) {
+            t.Errorf("counter not encoded as an OTLP JSON int64: %s", raw)
+        }
+        var req otlpRequest
+        if err := json.Unmarshal(raw, &req); err != nil {
+            t.Error(err)
+        }
+        bodies = append(bodies, req)
+    }))
+    defer srv.Close()
+    
+    sink := NewOTLPSink(OTLPConfig{Endpoint: srv.URL, Headers: map[string]string{"Authorization": "Bearer t"}})
+    sink.Gauge("peer.latency_ms", 3, "peer:abc")
+    sink.Gauge("peer.latency_ms", 4.5, "peer:abc")
+    sink.Count("peer.rx_bytes", 5, "peer:abc")
+    sink.Count("peer.rx_bytes", 2, "peer:abc")
+    
+    // A failed export keeps the counts for the next one
+    fail = true
+    if err := sink.Flush(); err == nil {
+        t.Fatal("expected an error from a 503")
+    }
+    fail = false
+    if err := sink.Flush(); err != nil {
+        t.Fatal(err)
+    }
+    sink.Count("peer.rx_bytes", 3, "peer:abc")
+    if err := sink.Stop(); err != nil {
+        t.Fatal(err)
+    }
+    
+    if len(bodies) != 2 {
+        t.Fatalf("got %d exports, want 2", len(bodies))
+    }
+    rm := bodies[0].ResourceMetrics[0]
+    if attr := rm.Resource.Attributes[0]; attr.Key != "service.name" || attr.Value.StringValue != DefaultOTLPServiceName {
+        t.Errorf("resource = %+v", rm.Resource)
+    }
+    metrics := rm.ScopeMetrics[0].Metrics
+    if len(metrics) != 2 || metrics[0].Name != "peer.latency_ms" || metrics[1].Name != "peer.rx_bytes" {
+        t.Fatalf("metrics = %+v", metrics)
+    }
+    gauge := metrics[0].Gauge.DataPoints[0]
+    if *gauge.AsDouble != 4.5 || gauge.Attributes[0].Key != "peer" || gauge.Attributes[0].Value.StringValue != "abc" {
+        t.Errorf("gauge point = %+v", gauge)
+    }
+    sum := metrics[1].Sum
+    if sum.AggregationTemporality != 1 || !sum.IsMonotonic || *sum.DataPoints[0].AsInt != 7 {
+        t.Errorf("sum = %+v", sum)
+    }
+    
+    // The next export only has the delta since
+    for _, m := range bodies[1].ResourceMetrics[0].ScopeMetrics[0].Metrics {
+        if m.Sum != nil && *m.Sum.DataPoints[0].AsInt != 3 {
+            t.Errorf("second delta = %d, want 3", *m.Sum.DataPoints[0].AsInt)
+        }
+    }
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package main
+
+import (
+    "time"
+    
+    "golang.org/x/sys/unix"
+)
+
+// The clock of bpf_ktime_get_ns
+func monotonicNow() time.Duration {
+    var ts unix.Timespec
+    if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+        return 0
+    }
+    return time.Duration(ts.Nano())
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "time"
+
+// No eBPF timestamps to compare with
+func monotonicNow() time.Duration {
+    return 0
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "sync"
+)
+
+const (
+    ipv4TCPHeaders = 20 + 20
+    ipv6TCPHeaders = 40 + 20
+    minClampedMSS  = 536 // what a TCP stack assumes without the option
+)
+
+// interfaceMTU reads the MTU of a network interface. Tests replace it.
+var interfaceMTU = func(name string) (int, error) {
+    iface, err := net.InterfaceByName(name)
+    if err != nil {
+        return 0, err
+    }
+    return iface.MTU, nil
+}
+
+// ClampedMSS is the largest TCP segment an IPv4 and an IPv6 packet of mtu
+// carry
+func ClampedMSS(mtu int) (v4, v6 int) {
+    return max(mtu-ipv4TCPHeaders, minClampedMSS), max(mtu-ipv6TCPHeaders, minClampedMSS)
+}
+
+// MSSClamp rewrites the MSS option of TCP SYNs forwarded through the
+// tunnel, so connections never try segments the path can't carry. Lost
+// ICMP "fragmentation needed" otherwise hangs them after the handshake.
+// Off unless VPNConfig.ClampMSS is set.
+type MSSClamp struct {
+    mu    sync.Mutex
+    iface string
+    mss4  int
+    mss6  int
+    rules []string
+    
+    commands CommandRunner
+}
+
+// MSSClampStatus is reported in Status
+type MSSClampStatus struct {
+    Enabled   bool
+    Interface string
+    IPv4      int
+    IPv6      int
+}
+
+func NewMSSClamp() *MSSClamp {
+    return &MSSClamp{}
+}
+
+// Both directions, the SYN and the SYN-ACK each announce an MSS
+func mssClampRules(iface string, mss4, mss6 int) []string {
+    var rules []string
+    for _, family := range []struct {
+        ipt string
+        mss int
+    }{{"iptables", mss4}, {"ip6tables", mss6}} {
+        for _, dir := range []string{"-o", "-i"} {
+            rules = append(rules, fmt.Sprintf("%s -t mangle -A FORWARD %s %s -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss %d",
+                family.ipt, dir, iface, family.mss))
+        }
+    }
+    return rules
+}
+
+// Enable clamps TCP forwarded through iface, replacing a previous clamp
+func (c *MSSClamp) Enable(iface string, mss4, mss6 int) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    var added []string
+    for _, rule := range mssClampRules(iface, mss4, mss6) {
+        if err := c.commands.Run(rule); err != nil {
+            c.commands.removeIPTablesRules(added)
+            return fmt.Errorf("failed to add rule %s: %w", rule, err)
+        }
+        added = append(added, rule)
+    }
+    
+    old := c.rules
+    c.rules = added
+    c.iface, c.mss4, c.mss6 = iface, mss4, mss6
+    
+    if err := c.commands.removeIPTablesRules(old); err != nil {
+        return fmt.Errorf("failed to remove old MSS clamp: %w", err)
+    }
+    return nil
+}
+
+func (c *MSSClamp) Disable() error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    err := c.commands.removeIPTablesRules(c.rules)
+    c.rules = nil
+    c.iface, c.mss4, c.mss6 = "", 0, 0
+    return err
+}
+
+func (c *MSSClamp) Status() MSSClampStatus {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    return MSSClampStatus{
+        Enabled:   c.rules != nil,
+        Interface: c.iface,
+        IPv4:      c.mss4,
+        IPv6:      c.mss6,
+    }
+}
+
+// Clamp to config.MSS or, without one, to what the tunnel device's MTU
+// leaves for TCP
+func (vpn *UnderTheRadarVPN) clampMSS(config VPNConfig) error {
+    if config.MSS > 0 {
+        return vpn.mssClamp.Enable(vpn.deviceName, config.MSS, config.MSS)
+    }
+    
+    mtu, err := interfaceMTU(vpn.deviceName)
+    if err != nil {
+        return fmt.Errorf("failed to read MTU of %s: %w", vpn.deviceName, err)
+    }
+    mss4, mss6 := ClampedMSS(mtu)
+    return vpn.mssClamp.Enable(vpn.deviceName, mss4, mss6)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "testing"
+)
+
+func fakeInterfaceMTU(t *testing.T, mtu int) {
+    orig := interfaceMTU
+    interfaceMTU = func(string) (int, error) { return mtu, nil }
+    t.Cleanup(func() { interfaceMTU = orig })
+}
+
+func TestClampedMSS(t *testing.T) {
+    for _, tc := range []struct {
+        mtu, v4, v6 int
+    }{
+        {1420, 1380, 1360}, // WireGuard's default
+        {1280, 1240, 1220},
+        {500, 536, 536},
+    } {
+        if v4, v6 := ClampedMSS(tc.mtu); v4 != tc.v4 || v6 != tc.v6 {
+            t.Errorf("ClampedMSS(%d) = %d, %d, want %d, %d", tc.mtu, v4, v6, tc.v4, tc.v6)
+        }
+    }
+}
+
+func TestMSSClampRules(t *testing.T) {
+    rules := mssClampRules("utr0", 1380, 1360)
+    want := []string{
+        "iptables -t mangle -A FORWARD -o utr0 -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss 1380",
+        "iptables -t mangle -A FORWARD -i utr0 -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss 1380",
+        "ip6tables -t mangle -A FORWARD -o utr0 -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss 1360",
+        "ip6tables -t mangle -A FORWARD -i utr0 -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss 1360",
+    }
+    if len(rules) != len(want) {
+        t.Fatalf("rules = %v", rules)
+    }
+    for i := range want {
+        if rules[i] != want[i] {
+            t.Errorf("rule %d = %q, want %q", i, rules[i], want[i])
+        }
+    }
+}
+
+func TestMSSClampFollowsConfig(t *testing.T) {
+    fakeInterfaceMTU(t, 1420)
+    vpn, _, host := startForReload(t, VPNConfig{ListenPort: 51820, ClampMSS: true})
+    if host.rules["iptables mangle FORWARD -o utr0 -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss 1380"] != 1 || len(host.rules) != 4 {
+        t.Fatalf("rules = %v", host.rules)
+    }
+    if st := vpn.GetStatus().MSSClamp; !st.Enabled || st.IPv4 != 1380 || st.IPv6 != 1360 {
+        t.Fatalf("status = %+v", st)
+    }
+    
+    // The override replaces the derived value
+    if err := vpn.Reload(VPNConfig{ListenPort: 51820, ClampMSS: true, MSS: 1200}); err != nil {
+        t.Fatal(err)
+    }
+    if host.rules["ip6tables mangle FORWARD -i utr0 -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss 1200"] != 1 || len(host.rules) != 4 {
+        t.Fatalf("rules after override = %v", host.rules)
+    }
+    
+    if err := vpn.Stop(); err != nil {
+        t.Fatal(err)
+    }
+    if len(host.rules) != 0 {
+        t.Fatalf("rules left after Stop: %v", host.rules)
+    }
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strings"
+    
+    "golang.org/x/crypto/chacha20poly1305"
+    "golang.org/x/crypto/hkdf"
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Bytes each onion layer adds: its nonce and tag
+const hopLayerOverhead = chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+
+var ErrHopLayer = errors.New("hop layer failed to authenticate")
+
+// Direction a layer was sealed in, so a hop can't turn a layer it peeled
+// around as a reply
+const (
+    hopForward byte = 1
+    hopReverse byte = 2
+)
+
+// HopLayer is the WireGuard device configuration for one level of nesting
+type HopLayer struct {
+    Device string
+    Config wgtypes.Config `json:"-"` // holds raw keys for wgctrl, never serialized
+}
+
+// wgtypes.Key prints as base64, so layers describe themselves without keys
+func (l HopLayer) String() string {
+    var peers []string
+    for _, peer := range l.Config.Peers {
+        peers = append(peers, fmt.Sprintf("%s@%v", peer.PublicKey, peer.Endpoint))
+    }
+    return fmt.Sprintf("%s{%s}", l.Device, strings.Join(peers, ","))
+}
+
+func (l HopLayer) GoString() string {
+    return l.String()
+}
+
+func NewMultiHop() *MultiHop {
+    return &MultiHop{}
+}
+
+// Layers builds one device per hop, outermost first. Every layer except the
+// innermost only carries traffic for the next hop's endpoint, which is the
+// tunnel IP of the hop before it, so each hop is wrapped by all outer ones.
+// The configs hold copies of the hop keys; wipe them with wipeLayer.
+func (mh *MultiHop) Layers(baseName string) ([]HopLayer, error) {
+    mh.mu.RLock()
+    defer mh.mu.RUnlock()
+    
+    keepalive := KeepaliveInterval
+    layers := make([]HopLayer, 0, len(mh.hops))
+    
+    for i, hop := range mh.hops {
+        privateKey := hop.PrivateKey.Key()
+        var psk *wgtypes.Key
+        if hop.PresharedKey != nil {
+            key := hop.PresharedKey.Key()
+            psk = &key
+        }
+        
+        // Innermost layer carries the user's traffic
+        allowed := []net.IPNet{
+            {IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+            {IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+        }
+        if i < len(mh.hops)-1 {
+            allowed = []net.IPNet{hostRoute(hop.TunnelIP)}
+        }
+        
+        layers = append(layers, HopLayer{
+            Device: fmt.Sprintf("%s-h%d", baseName, i),
+            Config: wgtypes.Config{
+                PrivateKey:   &privateKey,
+                ReplacePeers: true,
+                Peers: []wgtypes.PeerConfig{{
+                    PublicKey:                   hop.PublicKey,
+                    PresharedKey:                psk,
+                    Endpoint:                    hop.Endpoint,
+                    AllowedIPs:                  allowed,
+                    ReplaceAllowedIPs:           true,
+                    PersistentKeepaliveInterval: &keepalive,
+                }},
+            },
+        })
+    }
+    
+    if err := validateLayers(mh.hops, layers); err != nil {
+        for _, layer := range layers {
+            wipeLayer(layer)
+        }
+        return nil, err
+    }
+    return layers, nil
+}
+
+func wipeLayer(layer HopLayer) {
+    if layer.Config.PrivateKey != nil {
+        wipe(layer.Config.PrivateKey[:])
+    }
+    for _, peer := range layer.Config.Peers {
+        if peer.PresharedKey != nil {
+            wipe(peer.PresharedKey[:])
+        }
+    }
+}
+
+func hostRoute(ip net.IP) net.IPNet {
+    if ip4 := ip.To4(); ip4 != nil {
+        return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+    }
+    return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// Each hop must be reachable only through the layer directly outside it,
+// and the first hop only over the physical network. Default routes are
+// ignored since encapsulated packets are kept off them by policy routing.
+func validateLayers(hops []*HopNode, layers []HopLayer) error {
+    for i, hop := range hops {
+        if hop.TunnelIP == nil && i < len(hops)-1 {
+            return fmt.Errorf("hop %d has no tunnel IP", i)
+        }
+        
+        layer, err := routeLayer(layers, hop.Endpoint.IP)
+        if err != nil {
+            return fmt.Errorf("hop %d: %w", i, err)
+        }
+        if layer != i-1 {
+            if i == 0 {
+                return fmt.Errorf("first hop endpoint %s would be routed into layer %d", hop.Endpoint.IP, layer)
+            }
+            return fmt.Errorf("hop %d endpoint %s is routed via layer %d instead of %d", i, hop.Endpoint.IP, layer, i-1)
+        }
+    }
+    return nil
+}
+
+// Layer whose allowed IPs hold the most specific match for ip, -1 for none
+func routeLayer(layers []HopLayer, ip net.IP) (int, error) {
+    best, bestOnes, ties := -1, -1, 0
+    
+    for i, layer := range layers {
+        for _, peer := range layer.Config.Peers {
+            for _, allowed := range peer.AllowedIPs {
+                ones, _ := allowed.Mask.Size()
+                if ones == 0 || !allowed.Contains(ip) {
+                    continue
+                }
+                switch {
+                case ones > bestOnes:
+                    best, bestOnes, ties = i, ones, 0
+                case ones == bestOnes && i != best:
+                    ties++
+                }
+            }
+        }
+    }
+    
+    if ties > 0 {
+        return -1, fmt.Errorf("%s is claimed by more than one layer", ip)
+    }
+    return best, nil
+}
+
+// ApplyMultiHop creates a WireGuard device per hop so every layer of
+// nesting is actually encrypted, not just routed
+func (vpn *UnderTheRadarVPN) ApplyMultiHop() error {
+    layers, err := vpn.multiHop.Layers(vpn.deviceName)
+    if err != nil {
+        return err
+    }
+    
+    defer func() {
+        for _, layer := range layers {
+            wipeLayer(layer)
+        }
+    }()
+    
+    for _, layer := range layers {
+        if err := vpn.applyHopLayer(layer); err != nil {
+            vpn.removeMultiHop()
+            return fmt.Errorf("failed to set up %s: %w", layer.Device, err)
+        }
+    }
+    return nil
+}
+
+func (vpn *UnderTheRadarVPN) applyHopLayer(layer HopLayer) error {
+    if err := vpn.commands.Run(fmt.Sprintf("ip link add dev %s type wireguard", layer.Device)); err != nil {
+        return err
+    }
+    
+    vpn.multiHop.mu.Lock()
+    vpn.multiHop.devices = append(vpn.multiHop.devices, layer.Device)
+    vpn.multiHop.mu.Unlock()
+    
+    if err := vpn.wgClient.ConfigureDevice(layer.Device, layer.Config); err != nil {
+        return err
+    }
+    if err := vpn.commands.Run(fmt.Sprintf("ip link set up dev %s", layer.Device)); err != nil {
+        return err
+    }
+    
+    // Host routes steer the next hop's handshakes into this layer
+    for _, peer := range layer.Config.Peers {
+        for _, allowed := range peer.AllowedIPs {
+            if ones, _ := allowed.Mask.Size(); ones == 0 {
+                continue
+            }
+            if err := vpn.commands.Run(fmt.Sprintf("ip route replace %s dev %s", allowed.String(), layer.Device)); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// Delete the layer devices, innermost first; their routes go with them
+func (vpn *UnderTheRadarVPN) removeMultiHop() {
+    vpn.multiHop.mu.Lock()
+    defer vpn.multiHop.mu.Unlock()
+    
+    for i := len(vpn.multiHop.devices) - 1; i >= 0; i-- {
+        vpn.commands.Run(fmt.Sprintf("ip link del dev %s", vpn.multiHop.devices[i]))
+    }
+    vpn.multiHop.devices = nil
+    vpn.multiHop.session.Zeroize()
+    vpn.multiHop.session = nil
+}
+
+// SetSessionKey sets the master key the hop keys derive from. Without one
+// the first Send, Receive or HopKey generates it.
+func (mh *MultiHop) SetSessionKey(master *Secret) error {
+    if len(master.Bytes()) != chacha20poly1305.KeySize {
+        return fmt.Errorf("%w: session key of %d bytes", ErrKeyInvalid, len(master.Bytes()))
+    }
+    mh.mu.Lock()
+    defer mh.mu.Unlock()
+    
+    mh.session.Zeroize()
+    mh.session = NewSecret(master.Bytes())
+    return nil
+}
+
+// Caller holds mh.mu for writing
+func (mh *MultiHop) sessionLocked() (*Secret, error) {
+    if mh.session == nil {
+        key, err := GenerateSecret()
+        if err != nil {
+            return nil, fmt.Errorf("failed to generate session key: %w", err)
+        }
+        mh.session = key
+    }
+    return mh.session, nil
+}
+
+// K_n = HKDF-SHA256(master, "hop" || n), n big endian and counted from 1
+// at the entry, so hop i of Layers has K_(i+1)
+func deriveHopKey(master *Secret, i int) *Secret {
+    info := binary.BigEndian.AppendUint32([]byte("hop"), uint32(i+1))
+    key := make([]byte, chacha20poly1305.KeySize)
+    io.ReadFull(hkdf.New(sha256.New, master.Bytes(), nil, info), key)
+    defer wipe(key)
+    return NewSecret(key)
+}
+
+// HopKey is the key of hop i, numbered from 0 as in Layers, which is K_(i+1)
+// of the path. Give each hop its own
+// key and never the session key, so a hop can peel its layer and no other.
+func (mh *MultiHop) HopKey(i int) (*Secret, error) {
+    mh.mu.Lock()
+    defer mh.mu.Unlock()
+    
+    if i < 0 || i >= len(mh.hops) {
+        return nil, fmt.Errorf("no hop %d of %d", i, len(mh.hops))
+    }
+    master, err := mh.sessionLocked()
+    if err != nil {
+        return nil, err
+    }
+    return deriveHopKey(master, i), nil
+}
+
+// Send onion-encrypts payload for the path: the innermost layer is for the
+// last hop, the outermost for the entry, and each hop peels its own with
+// PeelHopLayer before passing the rest on. Each layer is profiled under
+// its hop's pprof labels.
+func (mh *MultiHop) Send(payload []byte) ([]byte, error) {
+    mh.mu.Lock()
+    defer mh.mu.Unlock()
+    
+    if len(mh.hops) == 0 {
+        return nil, fmt.Errorf("no hops")
+    }
+    master, err := mh.sessionLocked()
+    if err != nil {
+        return nil, err
+    }
+    packet := payload
+    for i := len(mh.hops) - 1; i >= 0; i-- {
+        withPeerLabels(mh.hops[i].PublicKey, PhaseEncryption, func() {
+            key := deriveHopKey(master, i)
+            packet, err = sealHopLayer(key, i, hopForward, packet)
+            key.Zeroize()
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+    return packet, nil
+}
+
+// Receive peels a reply every hop wrapped with SealHopReply on its way
+// back, the entry's layer outermost
+func (mh *MultiHop) Receive(packet []byte) ([]byte, error) {
+    mh.mu.Lock()
+    defer mh.mu.Unlock()
+    
+    master, err := mh.sessionLocked()
+    if err != nil {
+        return nil, err
+    }
+    for i := range mh.hops {
+        withPeerLabels(mh.hops[i].PublicKey, PhaseEncryption, func() {
+            key := deriveHopKey(master, i)
+            packet, err = openHopLayer(key, i, hopReverse, packet)
+            key.Zeroize()
+        })
+        if err != nil {
+            return nil, fmt.Errorf("hop %d: %w", i, err)
+        }
+    }
+    return packet, nil
+}
+
+// PeelHopLayer removes the layer of hop i from a packet on its way out,
+// with that hop's key
+func PeelHopLayer(key *Secret, i int, packet []byte) ([]byte, error) {
+    return openHopLayer(key, i, hopForward, packet)
+}
+
+// SealHopReply wraps a reply passing hop i back towards the client in that
+// hop's layer
+func SealHopReply(key *Secret, i int, packet []byte) ([]byte, error) {
+    return sealHopLayer(key, i, hopReverse, packet)
+}
+
+// Random nonce, then XChaCha20-Poly1305 of the packet bound to the hop
+// and direction
+func sealHopLayer(key *Secret, i int, direction byte, packet []byte) ([]byte, error) {
+    aead, err := chacha20poly1305.NewX(key.Bytes())
+    if err != nil {
+        return nil, fmt.Errorf("%w: %w", ErrKeyInvalid, err)
+    }
+    out := make([]byte, chacha20poly1305.NonceSizeX, hopLayerOverhead+len(packet))
+    if _, err := rand.Read(out); err != nil {
+        return nil, fmt.Errorf("failed to generate nonce: %w", err)
+    }
+    return aead.Seal(out, out, packet, hopLayerAD(i, direction)), nil
+}
+
+func openHopLayer(key *Secret, i int, direction byte, packet []byte) ([]byte, error) {
+    aead, err := chacha20poly1305.NewX(key.Bytes())
+    if err != nil {
+        return nil, fmt.Errorf("%w: %w", ErrKeyInvalid, err)
+    }
+    if len(packet) < hopLayerOverhead {
+        return nil, ErrHopLayer
+    }
+    nonce := packet[:chacha20poly1305.NonceSizeX]
+    plain, err := aead.Open(nil, nonce, packet[chacha20poly1305.NonceSizeX:], hopLayerAD(i, direction))
+    if err != nil {
+        return nil, ErrHopLayer
+    }
+    return plain, nil
+}
+
+func hopLayerAD(i int, direction byte) []byte {
+    return binary.BigEndian.AppendUint32([]byte{direction}, uint32(i))
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+    "bytes"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "net"
+    "strings"
+    "testing"
+)
+
+// Three hops: entry over the internet, then two nested through it
+func threeHops(t *testing.T) (*MultiHop, []*HopNode) {
+    t.Helper()
+    
+    psk := SecretFromKey(mustKey(t))
+    hops := []*HopNode{
+        {
+            PublicKey: mustKey(t).PublicKey(),
+            Endpoint:  &net.UDPAddr{IP: net.ParseIP("203.0.113.10"), Port: 51820},
+            TunnelIP:  net.ParseIP("10.100.0.1"),
+        },
+        {
+            PublicKey:    mustKey(t).PublicKey(),
+            Endpoint:     &net.UDPAddr{IP: net.ParseIP("198.51.100.20"), Port: 51821},
+            TunnelIP:     net.ParseIP("10.100.1.1"),
+            PresharedKey: psk,
+        },
+        {
+            PublicKey: mustKey(t).PublicKey(),
+            Endpoint:  &net.UDPAddr{IP: net.ParseIP("192.0.2.30"), Port: 51822},
+            TunnelIP:  net.ParseIP("10.100.2.1"),
+        },
+    }
+    
+    mh := NewMultiHop()
+    for _, hop := range hops {
+        if err := mh.AddHop(hop); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return mh, hops
+}
+
+func TestMultiHopLayers(t *testing.T) {
+    mh, hops := threeHops(t)
+    
+    layers, err := mh.Layers("utr0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(layers) != 3 {
+        t.Fatalf("got %d layers, want 3", len(layers))
+    }
+    
+    wantAllowed := []string{"10.100.0.1/32", "10.100.1.1/32", "0.0.0.0/0"}
+    wantEndpoint := []string{"203.0.113.10:51820", "10.100.0.1:51821", "10.100.1.1:51822"}
+    
+    for i, layer := range layers {
+        if layer.Device != fmt.Sprintf("utr0-h%d", i) {
+            t.Errorf("layer %d device = %s", i, layer.Device)
+        }
+        if layer.Config.PrivateKey == nil || *layer.Config.PrivateKey != hops[i].PrivateKey.Key() {
+            t.Errorf("layer %d does not use the hop's private key", i)
+        }
+        
+        peer := layer.Config.Peers[0]
+        if peer.PublicKey != hops[i].PublicKey {
+            t.Errorf("layer %d peer key mismatch", i)
+        }
+        if peer.Endpoint.String() != wantEndpoint[i] {
+            t.Errorf("layer %d endpoint = %s, want %s", i, peer.Endpoint, wantEndpoint[i])
+        }
+        if peer.AllowedIPs[0].String() != wantAllowed[i] {
+            t.Errorf("layer %d allowed = %s, want %s", i, peer.AllowedIPs[0].String(), wantAllowed[i])
+        }
+    }
+    
+    if psk := layers[1].Config.Peers[0].PresharedKey; psk == nil || *psk != hops[1].PresharedKey.Key() {
+        t.Error("preshared key not carried into layer 1")
+    }
+    if layers[0].Config.Peers[0].PresharedKey != nil {
+        t.Error("layer 0 should have no preshared key")
+    }
+    
+    // Each layer has its own identity
+    if hops[0].PrivateKey.Equal(hops[1].PrivateKey) {
+        t.Error("hops share a generated private key")
+    }
+}
+
+func TestMultiHopRejectsLeakyLayering(t *testing.T) {
+    // Entry endpoint inside a later hop's tunnel would loop through itself
+    mh := NewMultiHop()
+    mh.AddHop(&HopNode{
+        PublicKey: mustKey(t).PublicKey(),
+        Endpoint:  &net.UDPAddr{IP: net.ParseIP("10.100.1.1"), Port: 51820},
+        TunnelIP:  net.ParseIP("10.100.0.1"),
+    })
+    mh.AddHop(&HopNode{
+        PublicKey: mustKey(t).PublicKey(),
+        Endpoint:  &net.UDPAddr{IP: net.ParseIP("198.51.100.20"), Port: 51821},
+        TunnelIP:  net.ParseIP("10.100.1.1"),
+    })
+    mh.AddHop(&HopNode{
+        PublicKey: mustKey(t).PublicKey(),
+        Endpoint:  &net.UDPAddr{IP: net.ParseIP("192.0.2.30"), Port: 51822},
+    })
+    if _, err := mh.Layers("utr0"); err == nil || !strings.Contains(err.Error(), "first hop") {
+        t.Fatalf("err = %v, want first hop routing error", err)
+    }
+    
+    // Two hops claiming the same tunnel IP make the next hop ambiguous
+    mh, hops := threeHops(t)
+    hops[1].TunnelIP = hops[0].TunnelIP
+    if _, err := mh.Layers("utr0"); err == nil {
+        t.Fatal("expected error for duplicate tunnel IPs")
+    }
+}
+
+func TestApplyMultiHop(t *testing.T) {
+    commands := recordSystemCommands(t)
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    vpn.multiHop, _ = threeHops(t)
+    
+    if err := vpn.ApplyMultiHop(); err != nil {
+        t.Fatal(err)
+    }
+    
+    for _, dev := range []string{"utr0-h0", "utr0-h1", "utr0-h2"} {
+        if len(wg.peerKeys(dev)) != 1 {
+            t.Errorf("%s not configured with its hop peer", dev)
+        }
+    }
+    
+    joined := strings.Join(*commands, "\n")
+    for _, want := range []string{
+        "ip route replace 10.100.0.1/32 dev utr0-h0",
+        "ip route replace 10.100.1.1/32 dev utr0-h1",
+    } {
+        if !strings.Contains(joined, want) {
+            t.Errorf("missing %q", want)
+        }
+    }
+    if strings.Contains(joined, "0.0.0.0/0") {
+        t.Error("default route must not be installed by multi-hop")
+    }
+}
+
+func TestApplyMultiHopRollsBack(t *testing.T) {
+    host := installFakeHost(t, "ip link set up dev utr0-h2")
+    vpn := newTestVPN(t, newFakeWGClient())
+    vpn.multiHop, _ = threeHops(t)
+    
+    if err := vpn.ApplyMultiHop(); err == nil {
+        t.Fatal("expected error")
+    }
+    if len(host.links) != 0 {
+        t.Errorf("layer devices left behind: %v", host.links)
+    }
+}
+
+func TestHopKeyKnownAnswer(t *testing.T) {
+    master := make([]byte, 32)
+    for i := range master {
+        master[i] = byte(i)
+    }
+    mh, _ := threeHops(t)
+    if err := mh.SetSessionKey(NewSecret(master)); err != nil {
+        t.Fatal(err)
+    }
+    
+    // K_1 = HKDF-SHA256(00 01 .. 1f, no salt, "hop" 00 00 00 01)
+    key, err := mh.HopKey(0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := hex.EncodeToString(key.Bytes()); got != "fca79f6dea90e544464cb147585b171b06ac392ad5381013151181ac058e4e5b" {
+        t.Fatalf("K_1 = %s", got)
+    }
+}
+
+func TestMultiHopOnionLayers(t *testing.T) {
+    mh, _ := threeHops(t)
+    keys := make([]*Secret, 3)
+    for i := range keys {
+        key, err := mh.HopKey(i)
+        if err != nil {
+            t.Fatal(err)
+        }
+        keys[i] = key
+    }
+    if keys[0].Equal(keys[1]) || keys[1].Equal(keys[2]) {
+        t.Fatal("hops share a key")
+    }
+    
+    payload := []byte("to the exit and no further")
+    packet, err := mh.Send(payload)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(packet) != len(payload)+3*hopLayerOverhead {
+        t.Fatalf("%d bytes for three layers", len(packet))
+    }
+    
+    // The entry peels its layer, and nothing more: the next one is the
+    // middle hop's, under a key it doesn't have
+    inner, err := PeelHopLayer(keys[0], 0, packet)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := PeelHopLayer(keys[0], 1, inner); !errors.Is(err, ErrHopLayer) {
+        t.Fatalf("entry peeled the middle layer: %v", err)
+    }
+    if _, err := PeelHopLayer(keys[1], 0, packet); !errors.Is(err, ErrHopLayer) {
+        t.Fatalf("middle hop peeled the entry layer: %v", err)
+    }
+    for i := 1; i < 3; i++ {
+        if inner, err = PeelHopLayer(keys[i], i, inner); err != nil {
+            t.Fatalf("hop %d: %v", i, err)
+        }
+    }
+    if !bytes.Equal(inner, payload) {
+        t.Fatalf("exit got %q", inner)
+    }
+    
+    // The reply gains a layer per hop on the way back
+    reply := []byte("from the exit")
+    for i := 2; i >= 0; i-- {
+        if reply, err = SealHopReply(keys[i], i, reply); err != nil {
+            t.Fatal(err)
+        }
+    }
+    got, err := mh.Receive(reply)
+    if err != nil || !bytes.Equal(got, []byte("from the exit")) {
+        t.Fatalf("reply %q: %v", got, err)
+    }
+    
+    // A forward layer can't be passed back as a reply
+    if _, err := mh.Receive(packet); !errors.Is(err, ErrHopLayer) {
+        t.Fatalf("forward packet received as a reply: %v", err)
+    }
+}
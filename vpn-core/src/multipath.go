@@ -0,0 +1,216 @@
+package main
+
+import (
+    "encoding/binary"
+    "hash/fnv"
+    "net"
+    "sort"
+    "sync"
+    "sync/atomic"
+)
+
+const (
+    // Flows hash into this many slots, each pinned to one endpoint, so
+    // rebalancing moves slots rather than individual flows
+    flowSlots = 256
+    
+    // Rebalance once one endpoint carries more than this share of bytes
+    flowImbalanceShare = 0.6
+)
+
+// Flow is the 5-tuple of a packet inside the tunnel
+type Flow struct {
+    SrcIP   net.IP
+    DstIP   net.IP
+    Proto   uint8
+    SrcPort uint16
+    DstPort uint16
+}
+
+func (f Flow) hash() uint32 {
+    h := fnv.New32a()
+    h.Write(f.SrcIP.To16())
+    h.Write(f.DstIP.To16())
+    var rest [5]byte
+    rest[0] = f.Proto
+    binary.BigEndian.PutUint16(rest[1:], f.SrcPort)
+    binary.BigEndian.PutUint16(rest[3:], f.DstPort)
+    h.Write(rest[:])
+    return h.Sum32()
+}
+
+// EndpointStats is the traffic one endpoint of a flow-splitting peer has
+// carried
+type EndpointStats struct {
+    Endpoint net.UDPAddr
+    RxBytes  uint64
+    TxBytes  uint64
+}
+
+// flowSplitter spreads a peer's flows over its primary and alternate
+// endpoints. A flow always hashes to the same slot, so its packets stay
+// on one path and in order until a rebalance moves the slot.
+type flowSplitter struct {
+    endpoints []net.UDPAddr
+    slots     [flowSlots]atomic.Uint32 // endpoint index per slot
+    slotBytes [flowSlots]atomic.Uint64 // since the last rebalance
+    rx, tx    []atomic.Uint64          // per endpoint, since the peer was added
+    
+    rebalanceMu sync.Mutex
+}
+
+// A splitter over the peer's distinct endpoints, nil when there is only one
+func newFlowSplitter(primary *net.UDPAddr, alternates []net.UDPAddr) *flowSplitter {
+    var endpoints []net.UDPAddr
+    seen := make(map[string]bool)
+    if primary != nil {
+        endpoints = append(endpoints, *primary)
+        seen[primary.String()] = true
+    }
+    for _, alt := range alternates {
+        if !seen[alt.String()] {
+            endpoints = append(endpoints, alt)
+            seen[alt.String()] = true
+        }
+    }
+    if len(endpoints) < 2 {
+        return nil
+    }
+    
+    fs := &flowSplitter{
+        endpoints: endpoints,
+        rx:        make([]atomic.Uint64, len(endpoints)),
+        tx:        make([]atomic.Uint64, len(endpoints)),
+    }
+    for i := range fs.slots {
+        fs.slots[i].Store(uint32(i % len(endpoints)))
+    }
+    return fs
+}
+
+func (fs *flowSplitter) endpointFor(flow Flow) (int, int) {
+    slot := int(flow.hash() % flowSlots)
+    return slot, int(fs.slots[slot].Load())
+}
+
+// Account bytes of flow to its current endpoint
+func (fs *flowSplitter) record(flow Flow, rx, tx uint64) {
+    slot, endpoint := fs.endpointFor(flow)
+    fs.slotBytes[slot].Add(rx + tx)
+    fs.rx[endpoint].Add(rx)
+    fs.tx[endpoint].Add(tx)
+}
+
+// Move slots off an endpoint carrying more than flowImbalanceShare of the
+// bytes seen since the last rebalance, heaviest slots that fit the gap
+// first. A single flow bigger than the gap stays put, moving it would only
+// shift the imbalance. Returns whether anything moved.
+func (fs *flowSplitter) rebalance() bool {
+    fs.rebalanceMu.Lock()
+    defer fs.rebalanceMu.Unlock()
+    
+    load := make([]uint64, len(fs.endpoints))
+    slotLoad := make([]uint64, flowSlots)
+    var total uint64
+    for i := range fs.slots {
+        slotLoad[i] = fs.slotBytes[i].Swap(0)
+        load[fs.slots[i].Load()] += slotLoad[i]
+        total += slotLoad[i]
+    }
+    if total == 0 {
+        return false
+    }
+    
+    moved := false
+    for {
+        heavy, light := 0, 0
+        for i := range load {
+            if load[i] > load[heavy] {
+                heavy = i
+            }
+            if load[i] < load[light] {
+                light = i
+            }
+        }
+        if float64(load[heavy]) <= flowImbalanceShare*float64(total) {
+            return moved
+        }
+        
+        // The busiest slot on the heavy endpoint that narrows the gap
+        gap := load[heavy] - load[light]
+        var candidates []int
+        for i := range fs.slots {
+            if int(fs.slots[i].Load()) == heavy && slotLoad[i] > 0 && slotLoad[i] < gap {
+                candidates = append(candidates, i)
+            }
+        }
+        if len(candidates) == 0 {
+            return moved
+        }
+        sort.Slice(candidates, func(a, b int) bool {
+            return slotLoad[candidates[a]] > slotLoad[candidates[b]]
+        })
+        slot := candidates[0]
+        for _, c := range candidates {
+            if slotLoad[c] <= gap/2 {
+                slot = c
+                break
+            }
+        }
+        
+        fs.slots[slot].Store(uint32(light))
+        load[heavy] -= slotLoad[slot]
+        load[light] += slotLoad[slot]
+        moved = true
+    }
+}
+
+func (fs *flowSplitter) stats() []EndpointStats {
+    stats := make([]EndpointStats, len(fs.endpoints))
+    for i, endpoint := range fs.endpoints {
+        stats[i] = EndpointStats{Endpoint: endpoint, RxBytes: fs.rx[i].Load(), TxBytes: fs.tx[i].Load()}
+    }
+    return stats
+}
+
+// routeFlow picks the peer for the flow's destination like routePacket,
+// and for a peer with FlowSplitting the endpoint this flow uses. Other
+// peers use their current endpoint. A flow stays on its first peer while
+// that one is healthy and routes the destination, so priority changes only
+// steer new flows.
+func (vpn *UnderTheRadarVPN) routeFlow(flow Flow) (*Peer, *net.UDPAddr) {
+    vpn.mu.RLock()
+    now := vpn.clock().Now()
+    peer := vpn.flowPins.lookup(vpn, flow, now)
+    if peer == nil {
+        if peer = vpn.routePacketLocked(flow.DstIP); peer != nil {
+            vpn.flowPins.pin(flow, peer, now)
+        }
+    }
+    vpn.mu.RUnlock()
+    
+    if peer == nil {
+        return nil, nil
+    }
+    if peer.flows == nil {
+        return peer, peer.Endpoint
+    }
+    _, i := peer.flows.endpointFor(flow)
+    endpoint := peer.flows.endpoints[i]
+    return peer, &endpoint
+}
+
+// RecordFlowBytes accounts traffic of flow to the endpoint carrying it
+func (peer *Peer) RecordFlowBytes(flow Flow, rx, tx uint64) {
+    if peer.flows != nil {
+        peer.flows.record(flow, rx, tx)
+    }
+}
+
+// EndpointStats is the traffic per endpoint of a flow-splitting peer
+func (peer *Peer) EndpointStats() []EndpointStats {
+    if peer.flows == nil {
+        return nil
+    }
+    return peer.flows.stats()
+}
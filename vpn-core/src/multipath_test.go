@@ -0,0 +1,147 @@
+package main
+
+import (
+    "net"
+    "testing"
+)
+
+func splittingPeer(t *testing.T, vpn *UnderTheRadarVPN) *Peer {
+    t.Helper()
+    pc := PeerConfig{
+        PublicKey:          mustKey(t).PublicKey(),
+        Endpoint:           &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820},
+        AlternateEndpoints: []net.UDPAddr{{IP: net.ParseIP("192.0.2.2"), Port: 51820}},
+        AllowedIPs:         []net.IPNet{mustCIDR(t, "0.0.0.0/0")},
+        FlowSplitting:      true,
+        SkipProbe:          true,
+    }
+    if err := vpn.AddPeer(pc); err != nil {
+        t.Fatal(err)
+    }
+    peer := vpn.peers.get(pc.PublicKey)
+    peer.IsAlive.Store(true)
+    return peer
+}
+
+// 1000 distinct client flows to a handful of servers
+func testFlows() []Flow {
+    var flows []Flow
+    for i := 0; i < 1000; i++ {
+        flows = append(flows, Flow{
+            SrcIP:   net.IPv4(10, 0, byte(i/250), byte(i%250+1)),
+            DstIP:   net.IPv4(93, 184, 216, byte(i%7)),
+            Proto:   6,
+            SrcPort: uint16(40000 + i),
+            DstPort: 443,
+        })
+    }
+    return flows
+}
+
+func TestFlowSplittingDistributesFlows(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    peer := splittingPeer(t, vpn)
+    
+    counts := make(map[string]int)
+    for _, flow := range testFlows() {
+        got, endpoint := vpn.routeFlow(flow)
+        if got != peer {
+            t.Fatal("flow routed to the wrong peer")
+        }
+        counts[endpoint.String()]++
+        
+        // Every packet of a flow takes the same path
+        if _, again := vpn.routeFlow(flow); again.String() != endpoint.String() {
+            t.Fatal("flow moved between endpoints without a rebalance")
+        }
+    }
+    if len(counts) != 2 {
+        t.Fatalf("flows used %v", counts)
+    }
+    for endpoint, n := range counts {
+        if n < 450 || n > 550 {
+            t.Errorf("%s carries %d of 1000 flows, want within 55/45", endpoint, n)
+        }
+    }
+}
+
+func TestFlowSplittingRebalancesHeavyEndpoint(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    peer := splittingPeer(t, vpn)
+    primary := peer.Endpoint.String()
+    
+    // The flows that start out on the primary happen to be the busy ones
+    flows := testFlows()
+    busy := make([]bool, len(flows))
+    for i, flow := range flows {
+        _, endpoint := vpn.routeFlow(flow)
+        busy[i] = endpoint.String() == primary
+    }
+    send := func() (primaryShare float64, busyMoved int) {
+        before := peer.EndpointStats()
+        for i, flow := range flows {
+            bytes := uint64(1000)
+            if busy[i] {
+                bytes = 4000
+                if _, endpoint := vpn.routeFlow(flow); endpoint.String() != primary {
+                    busyMoved++
+                }
+            }
+            peer.RecordFlowBytes(flow, bytes/2, bytes/2)
+        }
+        after := peer.EndpointStats()
+        onPrimary := after[0].RxBytes + after[0].TxBytes - before[0].RxBytes - before[0].TxBytes
+        return float64(onPrimary) / float64(endpointBytes(after)-endpointBytes(before)), busyMoved
+    }
+    
+    if share, _ := send(); share < 0.75 {
+        t.Fatalf("setup: primary share %.2f", share)
+    }
+    if !peer.flows.rebalance() {
+        t.Fatal("no rebalance with one endpoint carrying 80%")
+    }
+    
+    share, moved := send()
+    if share > flowImbalanceShare {
+        t.Fatalf("primary still carries %.2f after rebalancing", share)
+    }
+    if moved == 0 || moved == len(flows)/2 {
+        t.Fatalf("%d busy flows moved, want some but not all", moved)
+    }
+    if peer.flows.rebalance() {
+        t.Fatal("rebalanced an already balanced peer")
+    }
+    if info := peer.info(); len(info.Endpoints) != 2 {
+        t.Fatalf("PeerInfo endpoints: %+v", info.Endpoints)
+    }
+}
+
+func endpointBytes(stats []EndpointStats) uint64 {
+    var sum uint64
+    for _, s := range stats {
+        sum += s.RxBytes + s.TxBytes
+    }
+    return sum
+}
+
+func TestFlowSplittingNeedsTwoEndpoints(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    pc := PeerConfig{
+        PublicKey:          mustKey(t).PublicKey(),
+        Endpoint:           &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820},
+        AlternateEndpoints: []net.UDPAddr{{IP: net.ParseIP("192.0.2.1"), Port: 51820}},
+        AllowedIPs:         []net.IPNet{mustCIDR(t, "10.1.0.0/16")},
+        FlowSplitting:      true,
+        SkipProbe:          true,
+    }
+    if err := vpn.AddPeer(pc); err != nil {
+        t.Fatal(err)
+    }
+    peer := vpn.peers.get(pc.PublicKey)
+    peer.IsAlive.Store(true)
+    
+    _, endpoint := vpn.routeFlow(Flow{SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 1, 0, 1), Proto: 17})
+    if peer.flows != nil || endpoint != peer.Endpoint {
+        t.Fatal("a single distinct endpoint should route like a normal peer")
+    }
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io/fs"
+    "os"
+    "path/filepath"
+)
+
+// dockerNetnsDir holds a file per container network namespace, named by
+// the container's sandbox key. Tests point it elsewhere.
+var dockerNetnsDir = "/run/docker/netns"
+
+// Paths of the container namespaces to protect, none without Docker.
+// Exclusions are sandbox keys, the file names in dockerNetnsDir, as shown
+// by docker inspect -f '{{.NetworkSettings.SandboxKey}}'.
+func containerNamespaces(exclusions []string) ([]string, error) {
+    entries, err := os.ReadDir(dockerNetnsDir)
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to list container namespaces: %w", err)
+    }
+    
+    skip := make(map[string]bool, len(exclusions))
+    for _, name := range exclusions {
+        skip[filepath.Base(name)] = true
+    }
+    var paths []string
+    for _, entry := range entries {
+        if !entry.IsDir() && !skip[entry.Name()] {
+            paths = append(paths, filepath.Join(dockerNetnsDir, entry.Name()))
+        }
+    }
+    return paths, nil
+}
+
+// Kill switch rules inside a container. The container reaches the
+// network through the host, so only loopback and a tunnel device of its
+// own are let through, plus established connections when AllowEstablished,
+// and no exception is made for root, which is who most containers run as.
+func (ks *KillSwitch) namespaceRules() []string {
+    var rules []string
+    for _, ipt := range []string{"iptables", "ip6tables"} {
+        rules = append(rules,
+            fmt.Sprintf("%s -A OUTPUT -o %s -j ACCEPT", ipt, ks.deviceName),
+            fmt.Sprintf("%s -A OUTPUT -o lo -j ACCEPT", ipt))
+        if rule := ks.establishedRule(ipt, "OUTPUT"); rule != "" {
+            rules = append(rules, rule)
+        }
+        rules = append(rules, fmt.Sprintf("%s -A OUTPUT -j DROP", ipt))
+    }
+    for i, rule := range rules {
+        rules[i] = ks.tagRule(rule)
+    }
+    return rules
+}
+
+// Apply namespaceRules in every container namespace present now. Containers
+// started later are not covered until the kill switch is enabled again.
+func (ks *KillSwitch) protectNamespaces() error {
+    if !ks.ProtectNamespaces {
+        return nil
+    }
+    paths, err := containerNamespaces(ks.NamespaceExclusions)
+    if err != nil {
+        return err
+    }
+    
+    if ks.nsRules == nil {
+        ks.nsRules = make(map[string][]string)
+    }
+    for _, path := range paths {
+        if ks.plan != nil {
+            ks.plan.inNamespace(path, ks.namespaceRules())
+            continue
+        }
+        var applied []string
+        err := inNamespace(path, func() error {
+            for _, rule := range ks.namespaceRules() {
+                if err := ks.commands.Run(rule); err != nil {
+                    return fmt.Errorf("failed to add rule %s: %w", rule, err)
+                }
+                applied = append(applied, rule)
+            }
+            return nil
+        })
+        if len(applied) > 0 {
+            ks.nsRules[path] = applied
+        }
+        if err != nil {
+            return fmt.Errorf("failed to protect container namespace %s: %w", filepath.Base(path), err)
+        }
+    }
+    return nil
+}
+
+// Remove the rules from the namespaces. One whose container has exited
+// took its rules with it.
+func (ks *KillSwitch) unprotectNamespaces() error {
+    var firstErr error
+    for path, rules := range ks.nsRules {
+        if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+            continue
+        }
+        err := inNamespace(path, func() error {
+            return ks.commands.removeIPTablesRules(rules)
+        })
+        if err != nil && firstErr == nil {
+            firstErr = fmt.Errorf("container namespace %s: %w", filepath.Base(path), err)
+        }
+    }
+    ks.nsRules = nil
+    return firstErr
+}
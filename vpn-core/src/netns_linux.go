@@ -0,0 +1,42 @@
+//go:build linux
+
+package main
+
+import (
+    "fmt"
+    "runtime"
+    
+    "github.com/vishvananda/netns"
+    "golang.org/x/sys/unix"
+)
+
+// Run fn with the calling goroutine's thread in the network namespace at
+// path. Commands fn starts inherit the namespace.
+func inNamespace(path string, fn func() error) error {
+    runtime.LockOSThread()
+    defer runtime.UnlockOSThread()
+    
+    origin, err := netns.Get()
+    if err != nil {
+        return fmt.Errorf("failed to get the current network namespace: %w", err)
+    }
+    defer origin.Close()
+    
+    target, err := netns.GetFromPath(path)
+    if err != nil {
+        return fmt.Errorf("failed to open network namespace: %w", err)
+    }
+    defer target.Close()
+    
+    if err := unix.Setns(int(target), unix.CLONE_NEWNET); err != nil {
+        return fmt.Errorf("failed to enter network namespace: %w", err)
+    }
+    defer func() {
+        if err := unix.Setns(int(origin), unix.CLONE_NEWNET); err != nil {
+            // Keep the thread locked so it exits with the goroutine rather
+            // than run other goroutines in the container's namespace
+            runtime.LockOSThread()
+        }
+    }()
+    return fn()
+}
@@ -0,0 +1,147 @@
+//go:build linux
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "sync"
+    "testing"
+    
+    "github.com/vishvananda/netns"
+    "golang.org/x/sys/unix"
+)
+
+// Create a network namespace and bind it at dir/name the way Docker does
+// under /run/docker/netns
+func newTestNamespace(t *testing.T, dir, name string) string {
+    t.Helper()
+    
+    runtime.LockOSThread()
+    defer runtime.UnlockOSThread()
+    
+    origin, err := netns.Get()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer origin.Close()
+    ns, err := netns.New()
+    if err != nil {
+        t.Skipf("can't create a network namespace: %v", err)
+    }
+    defer ns.Close()
+    defer netns.Set(origin)
+    
+    path := filepath.Join(dir, name)
+    if err := os.WriteFile(path, nil, 0600); err != nil {
+        t.Fatal(err)
+    }
+    if err := unix.Mount(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()), path, "", unix.MS_BIND, ""); err != nil {
+        t.Skipf("can't bind the namespace: %v", err)
+    }
+    t.Cleanup(func() { unix.Unmount(path, unix.MNT_DETACH) })
+    return path
+}
+
+func namespaceID(t *testing.T, path string) string {
+    t.Helper()
+    
+    ns, err := netns.GetFromPath(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ns.Close()
+    return ns.UniqueId()
+}
+
+func TestKillSwitchProtectsContainerNamespaces(t *testing.T) {
+    dir := t.TempDir()
+    orig := dockerNetnsDir
+    dockerNetnsDir = dir
+    t.Cleanup(func() { dockerNetnsDir = orig })
+    
+    web := newTestNamespace(t, dir, "1f2e3d4c5b6a")
+    db := newTestNamespace(t, dir, "a6b5c4d3e2f1")
+    newTestNamespace(t, dir, "0123456789ab") // excluded
+    
+    // Record the namespace each command runs in
+    host := &fakeHost{rules: make(map[string]int), chains: make(map[string]bool), links: make(map[string]bool)}
+    var mu sync.Mutex
+    rulesIn := make(map[string][]string)
+    ks := NewKillSwitch("utr0")
+    ks.ProtectNamespaces = true
+    ks.NamespaceExclusions = []string{"/var/run/docker/netns/0123456789ab"}
+    ks.commands = func(cmdline string) error {
+        current, err := netns.Get()
+        if err != nil {
+            return err
+        }
+        defer current.Close()
+        
+        mu.Lock()
+        rulesIn[current.UniqueId()] = append(rulesIn[current.UniqueId()], cmdline)
+        mu.Unlock()
+        return host.run(cmdline)
+    }
+    
+    if err := ks.Enable(); err != nil {
+        t.Fatal(err)
+    }
+    
+    self, err := netns.Get()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer self.Close()
+    if len(rulesIn) != 3 || len(rulesIn[self.UniqueId()]) != 7 {
+        t.Fatalf("rules in %d namespaces, %d in ours", len(rulesIn), len(rulesIn[self.UniqueId()]))
+    }
+    for _, path := range []string{web, db} {
+        rules := rulesIn[namespaceID(t, path)]
+        if len(rules) != 6 || rules[len(rules)-1] != "ip6tables -A OUTPUT -j DROP" {
+            t.Fatalf("%s: %v", filepath.Base(path), rules)
+        }
+        for _, rule := range rules {
+            if strings.Contains(rule, "--uid-owner") {
+                t.Fatalf("%s: root let through: %s", filepath.Base(path), rule)
+            }
+        }
+    }
+    
+    // Our own namespace is back in place for the rest of the process
+    if after, _ := netns.Get(); !after.Equal(self) {
+        t.Fatal("left in a container namespace")
+    }
+    
+    // A container that exited is skipped on Disable
+    if err := unix.Unmount(db, unix.MNT_DETACH); err != nil {
+        t.Fatal(err)
+    }
+    os.Remove(db)
+    if err := ks.Disable(); err != nil {
+        t.Fatal(err)
+    }
+    if rules := rulesIn[namespaceID(t, web)]; len(rules) != 12 || !strings.Contains(rules[6], " -D ") {
+        t.Fatalf("rules not removed in the container: %v", rules)
+    }
+}
+
+func TestKillSwitchWithoutDocker(t *testing.T) {
+    orig := dockerNetnsDir
+    dockerNetnsDir = filepath.Join(t.TempDir(), "missing")
+    t.Cleanup(func() { dockerNetnsDir = orig })
+    
+    host := installFakeHost(t, "")
+    ks := NewKillSwitch("utr0")
+    ks.ProtectNamespaces = true
+    if err := ks.Enable(); err != nil {
+        t.Fatal(err)
+    }
+    ks.Disable()
+    if len(host.rules) != 0 {
+        t.Fatalf("residual rules %v", host.rules)
+    }
+}
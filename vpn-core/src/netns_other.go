@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// Network namespaces are Linux only
+func inNamespace(path string, fn func() error) error {
+    return errors.New("network namespaces are not supported on this platform")
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// FirewallBackend is how the kill switch, DNS protection and split tunnel
+// put their rules on the host
+type FirewallBackend int
+
+const (
+    FirewallIPTables FirewallBackend = iota // each feature adds iptables rules of its own
+    FirewallNFTables                        // one nftables table they share, see NFTPolicy
+)
+
+func (b FirewallBackend) String() string {
+    switch b {
+    case FirewallIPTables:
+        return "iptables"
+    case FirewallNFTables:
+        return "nftables"
+    default:
+        return fmt.Sprintf("FirewallBackend(%d)", int(b))
+    }
+}
+
+// Chains of the shared table. Each is a base chain at its own hook
+// priority, so features never depend on who added a rule first:
+//
+//   mark    route  output       mangle (-150)  split tunnel marks, set before
+//                                              the reroute check and the filter
+//   filter  filter output       filter (0)     DNS accepts and drops, then the
+//                                              kill switch accepts and drop
+//   nat     nat    postrouting  srcnat (100)   exit node masquerading
+const (
+    nftChainMark   = "mark"
+    nftChainFilter = "filter"
+    nftChainNAT    = "nat"
+)
+
+var nftChains = []struct {
+    name, kind, hook, priority string
+}{
+    {nftChainMark, "route", "output", "mangle"},
+    {nftChainFilter, "filter", "output", "filter"},
+    {nftChainNAT, "nat", "postrouting", "srcnat"},
+}
+
+// Stages of the filter chain, in the order packets meet them: DNS to the
+// configured servers is accepted before other DNS is dropped, and both
+// come before the kill switch lets anything out, so a LAN carve-out or
+// bypassed app can't leak queries
+const (
+    nftStageDNSAccept = iota
+    nftStageDNSDrop
+    nftStageAccept
+    nftStageDrop
+)
+
+// Features registering rules, rendered in this order within a stage
+const (
+    nftFeatureDNS        = "dns"
+    nftFeatureKillSwitch = "killswitch"
+    nftFeatureSplit      = "split"
+    nftFeatureExitNAT    = "exit"
+)
+
+// nftRule is one rule of the shared table
+type nftRule struct {
+    chain string
+    stage int // filter chain only
+    expr  string
+}
+
+// NFTPolicy is the nftables table the firewall features share with
+// VPNConfig.FirewallBackend FirewallNFTables. Features register their
+// rules with it instead of running commands, and every change replaces
+// the whole table in one nft transaction: the host never sees half a
+// policy, or two features' rules in an order neither chose.
+type NFTPolicy struct {
+    table    string
+    commands CommandRunner
+    plan     *changeRecorder // see PlanStart
+    
+    mu       sync.Mutex
+    features map[string][]nftRule
+    applied  bool // the table exists on the host
+}
+
+func NewNFTPolicy(deviceName string) *NFTPolicy {
+    return &NFTPolicy{
+        table:    "utr_" + nftIdentifier(deviceName),
+        features: make(map[string][]nftRule),
+    }
+}
+
+// Interface names may hold characters nft identifiers can't
+func nftIdentifier(name string) string {
+    return strings.Map(func(r rune) rune {
+        if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+            return r
+        }
+        return '_'
+    }, name)
+}
+
+// Address family keyword of ip in inet table rules
+func nftFamily(ip net.IP) string {
+    if ip.To4() != nil {
+        return "ip"
+    }
+    return "ip6"
+}
+
+// Render prints the table as nft -f reads it, chains without rules left out
+func (p *NFTPolicy) Render() string {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    
+    return p.renderLocked()
+}
+
+func (p *NFTPolicy) renderLocked() string {
+    names := make([]string, 0, len(p.features))
+    for name := range p.features {
+        names = append(names, name)
+    }
+    sort.Slice(names, func(i, j int) bool { return nftFeatureOrder(names[i]) < nftFeatureOrder(names[j]) })
+    
+    var b strings.Builder
+    fmt.Fprintf(&b, "table inet %s {\n", p.table)
+    for _, chain := range nftChains {
+        var rules []nftRule
+        for _, name := range names {
+            for _, rule := range p.features[name] {
+                if rule.chain == chain.name {
+                    rules = append(rules, rule)
+                }
+            }
+        }
+        if len(rules) == 0 {
+            continue
+        }
+        sort.SliceStable(rules, func(i, j int) bool { return rules[i].stage < rules[j].stage })
+        
+        fmt.Fprintf(&b, "    chain %s {\n", chain.name)
+        fmt.Fprintf(&b, "        type %s hook %s priority %s; policy accept;\n", chain.kind, chain.hook, chain.priority)
+        for _, rule := range rules {
+            fmt.Fprintf(&b, "        %s\n", rule.expr)
+        }
+        b.WriteString("    }\n")
+    }
+    b.WriteString("}\n")
+    return b.String()
+}
+
+func nftFeatureOrder(name string) int {
+    features := []string{nftFeatureDNS, nftFeatureKillSwitch, nftFeatureSplit, nftFeatureExitNAT}
+    for i, feature := range features {
+        if name == feature {
+            return i
+        }
+    }
+    return len(features)
+}
+
+// Replace the rules of feature, nil removes them, and apply the table. A
+// failed apply changes nothing on the host and keeps the old rules.
+func (p *NFTPolicy) set(feature string, rules []nftRule) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    
+    old, had := p.features[feature]
+    if len(rules) == 0 {
+        if !had {
+            return nil
+        }
+        delete(p.features, feature)
+    } else {
+        p.features[feature] = rules
+    }
+    
+    if err := p.applyLocked(); err != nil {
+        if had {
+            p.features[feature] = old
+        } else {
+            delete(p.features, feature)
+        }
+        return err
+    }
+    return nil
+}
+
+func (p *NFTPolicy) remove(feature string) error {
+    return p.set(feature, nil)
+}
+
+// Swap the table for the rendered one in a single transaction: creating
+// the table first makes the delete succeed when it doesn't exist yet.
+// Without rules the table goes.
+func (p *NFTPolicy) applyLocked() error {
+    if len(p.features) == 0 {
+        return p.deleteLocked()
+    }
+    
+    script := fmt.Sprintf("add table inet %s\ndelete table inet %s\n%s", p.table, p.table, p.renderLocked())
+    if p.plan != nil {
+        p.plan.add(PlannedChange{
+            Kind:        ChangeRule,
+            Command:     "nft -f -",
+            Description: fmt.Sprintf("replace table inet %s, %d lines", p.table, strings.Count(script, "\n")),
+        })
+        p.applied = true
+        return nil
+    }
+    
+    f, err := os.CreateTemp("", "utr-nft-*.conf")
+    if err != nil {
+        return fmt.Errorf("failed to write nftables ruleset: %w", err)
+    }
+    defer os.Remove(f.Name())
+    _, err = f.WriteString(script)
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return fmt.Errorf("failed to write nftables ruleset: %w", err)
+    }
+    if err := p.commands.Run("nft -f " + f.Name()); err != nil {
+        return fmt.Errorf("failed to apply nftables ruleset: %w", err)
+    }
+    p.applied = true
+    return nil
+}
+
+func (p *NFTPolicy) deleteLocked() error {
+    if !p.applied {
+        return nil
+    }
+    if err := p.commands.Run("nft delete table inet " + p.table); err != nil {
+        return fmt.Errorf("failed to delete nftables table: %w", err)
+    }
+    p.applied = false
+    return nil
+}
+
+// Close deletes the table and forgets every feature's rules
+func (p *NFTPolicy) Close() error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    
+    p.features = make(map[string][]nftRule)
+    return p.deleteLocked()
+}
+
+// Kill switch: out through the tunnel, loopback, root, the LAN carve-outs
+// and the tunnel's own packets, everything else dropped
+func (ks *KillSwitch) nftRules() []nftRule {
+    accepts := []string{
+        fmt.Sprintf("oifname %q accept", ks.deviceName),
+        `oifname "lo" accept`,
+        "meta nfproto ipv4 meta skuid 0 accept", // root, IPv4 only as with iptables
+    }
+    for _, lan := range ks.AllowLAN {
+        accepts = append(accepts, fmt.Sprintf("%s daddr %s accept", nftFamily(lan.IP), lan.String()))
+    }
+    switch {
+    case ks.EncapMark != 0 && ks.EncapInterface != "":
+        accepts = append(accepts, fmt.Sprintf("oifname %q meta mark 0x%x accept", ks.EncapInterface, ks.EncapMark))
+    case ks.EncapMark != 0:
+        accepts = append(accepts, fmt.Sprintf("meta mark 0x%x accept", ks.EncapMark))
+    case ks.EncapInterface != "":
+        accepts = append(accepts, fmt.Sprintf("oifname %q udp sport %d accept", ks.EncapInterface, ks.EncapPort))
+    }
+    if ks.AllowEstablished {
+        accepts = append(accepts, "ct state established,related accept")
+    }
+    
+    rules := make([]nftRule, 0, len(accepts)+1)
+    for _, expr := range accepts {
+        rules = append(rules, nftRule{chain: nftChainFilter, stage: nftStageAccept, expr: expr})
+    }
+    return append(rules, nftRule{chain: nftChainFilter, stage: nftStageDrop, expr: "drop"})
+}
+
+// DNS protection: the first server and the bootstrap addresses accepted,
+// other DNS dropped except to the local proxy
+func dnsNFTRules(servers []string, bootstrap []bootstrapTarget) []nftRule {
+    var rules []nftRule
+    if ip := net.ParseIP(servers[0]); ip != nil {
+        rules = append(rules, nftRule{
+            chain: nftChainFilter,
+            stage: nftStageDNSAccept,
+            expr:  fmt.Sprintf("%s daddr %s meta l4proto { tcp, udp } th dport 53 accept", nftFamily(ip), ip),
+        })
+    }
+    
+    // Only what the iptables backend lets through, see bootstrapAcceptRules
+    for _, target := range bootstrap {
+        rules = append(rules, nftRule{
+            chain: nftChainFilter,
+            stage: nftStageDNSAccept,
+            expr:  fmt.Sprintf("%s daddr %s tcp dport %d accept", nftFamily(target.ip), target.ip, target.port),
+        })
+    }
+    
+    return append(rules, nftRule{
+        chain: nftChainFilter,
+        stage: nftStageDNSDrop,
+        expr:  `oifname != "lo" meta l4proto { tcp, udp } th dport 53 drop`,
+    })
+}
+
+// Split tunnel: each app's mark, and bypassed traffic let past the kill
+// switch it would otherwise be dropped by
+func splitNFTRules(policies map[string]AppPolicy) []nftRule {
+    keys := make([]string, 0, len(policies))
+    for key := range policies {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    
+    var rules []nftRule
+    bypass := false
+    for _, key := range keys {
+        policy := policies[key]
+        match := fmt.Sprintf("meta skuid %d", policy.UID)
+        if policy.CIDR != nil {
+            match += fmt.Sprintf(" %s daddr %s", nftFamily(policy.CIDR.IP), policy.CIDR)
+        }
+        rules = append(rules, nftRule{
+            chain: nftChainMark,
+            expr:  fmt.Sprintf("%s meta mark set 0x%x comment %q", match, policy.mark(), "utr-split:"+policy.AppName),
+        })
+        bypass = bypass || policy.Via == ViaBypass
+    }
+    if bypass {
+        rules = append(rules, nftRule{chain: nftChainFilter, stage: nftStageAccept, expr: fmt.Sprintf("meta mark 0x%x accept", splitBypassMark)})
+    }
+    return rules
+}
+
+// Exit node: traffic clients send through the tunnel leaves with the
+// host's address
+func exitNATRules(deviceName string) []nftRule {
+    return []nftRule{{
+        chain: nftChainNAT,
+        expr:  fmt.Sprintf("iifname %q oifname != %q masquerade", deviceName, deviceName),
+    }}
+}
+
+// NFTRuleset returns the table the firewall features share with the
+// nftables backend, as nft would list it; empty without any rules
+func (vpn *UnderTheRadarVPN) NFTRuleset() string {
+    vpn.nft.mu.Lock()
+    defer vpn.nft.mu.Unlock()
+    
+    if len(vpn.nft.features) == 0 {
+        return ""
+    }
+    return vpn.nft.renderLocked()
+}
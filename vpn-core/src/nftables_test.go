@@ -0,0 +1,193 @@
+package main
+
+import (
+    "net"
+    "os"
+    "strings"
+    "testing"
+)
+
+// Every feature of the shared table, as Start registers them
+const composedRuleset = `table inet utr_utr0 {
+    chain mark {
+        type route hook output priority mangle; policy accept;
+        meta skuid 1001 meta mark set 0x5542 comment "utr-split:firefox"
+    }
+    chain filter {
+        type filter hook output priority filter; policy accept;
+        ip daddr 10.64.0.1 meta l4proto { tcp, udp } th dport 53 accept
+        oifname != "lo" meta l4proto { tcp, udp } th dport 53 drop
+        oifname "utr0" accept
+        oifname "lo" accept
+        meta nfproto ipv4 meta skuid 0 accept
+        ip daddr 192.168.1.0/24 accept
+        ip6 daddr fd00::/8 accept
+        ct state established,related accept
+        meta mark 0x5542 accept
+        drop
+    }
+    chain nat {
+        type nat hook postrouting priority srcnat; policy accept;
+        iifname "utr0" oifname != "utr0" masquerade
+    }
+}
+`
+
+// Record the scripts nft -f is given alongside the fake host
+func recordNFT(t *testing.T, host *fakeHost) (CommandRunner, *[]string) {
+    var scripts []string
+    return func(cmdline string) error {
+        if path, ok := strings.CutPrefix(cmdline, "nft -f "); ok {
+            script, err := os.ReadFile(path)
+            if err != nil {
+                t.Errorf("ruleset %s: %v", path, err)
+            }
+            scripts = append(scripts, string(script))
+        } else if strings.HasPrefix(cmdline, "nft ") {
+            scripts = append(scripts, cmdline)
+        }
+        return host.run(cmdline)
+    }, &scripts
+}
+
+func TestNFTablesBackendComposesOneTable(t *testing.T) {
+    orig := lookupUID
+    lookupUID = func(name string) (uint32, error) { return 1001, nil }
+    t.Cleanup(func() { lookupUID = orig })
+    
+    vpn, host := newHostTestVPN(t, newFakeWGClient())
+    run, scripts := recordNFT(t, host)
+    vpn.commands = run
+    vpn.killSwitch.commands = run
+    vpn.dnsProtector.commands = run
+    vpn.splitTunnel.commands = run
+    vpn.nft.commands = run
+    
+    config := VPNConfig{
+        ListenPort:                 51820,
+        FirewallBackend:            FirewallNFTables,
+        KillSwitch:                 true,
+        KillSwitchLAN:              []net.IPNet{mustCIDR(t, "192.168.1.0/24"), mustCIDR(t, "fd00::/8")},
+        KillSwitchAllowEstablished: true,
+        DNSProtection:              true,
+        DNSServers:                 []string{"10.64.0.1"},
+        DNSResolver:                ResolverUnmanaged,
+        SplitTunnelApps:            []string{"firefox"},
+        ExitNAT:                    true,
+    }
+    if err := vpn.Start(config); err != nil {
+        t.Fatal(err)
+    }
+    
+    if got := vpn.NFTRuleset(); got != composedRuleset {
+        t.Fatalf("ruleset\n%s\nwant\n%s", got, composedRuleset)
+    }
+    last := (*scripts)[len(*scripts)-1]
+    if want := "add table inet utr_utr0\ndelete table inet utr_utr0\n" + composedRuleset; last != want {
+        t.Fatalf("applied\n%s", last)
+    }
+    for rule := range host.rules {
+        if strings.Contains(rule, "OUTPUT") {
+            t.Errorf("iptables rule %s beside the table", rule)
+        }
+    }
+    
+    if err := vpn.Stop(); err != nil {
+        t.Fatal(err)
+    }
+    if last := (*scripts)[len(*scripts)-1]; last != "nft delete table inet utr_utr0" || vpn.NFTRuleset() != "" {
+        t.Fatalf("table left after Stop, last %q", last)
+    }
+}
+
+func TestNFTPolicyKeepsRulesOnFailedApply(t *testing.T) {
+    host := installFakeHost(t, "")
+    policy := NewNFTPolicy("utr0")
+    if err := policy.set(nftFeatureExitNAT, exitNATRules("utr0")); err != nil {
+        t.Fatal(err)
+    }
+    before := policy.Render()
+    
+    host.failOn = "nft"
+    ks := NewKillSwitch("utr0")
+    ks.nft = policy
+    if err := ks.Enable(); err == nil || ks.enabled.Load() {
+        t.Fatalf("kill switch enabled with a failed apply: %v", err)
+    }
+    if got := policy.Render(); got != before {
+        t.Fatalf("ruleset changed by failed apply\n%s", got)
+    }
+    if err := policy.remove(nftFeatureExitNAT); err == nil {
+        t.Fatal("table deleted despite the failure")
+    }
+    
+    host.failOn = ""
+    if err := policy.Close(); err != nil || policy.applied {
+        t.Fatalf("close: %v", err)
+    }
+}
+
+func TestExitNATNeedsNFTables(t *testing.T) {
+    if _, err := (&VPNConfig{ExitNAT: true}).Validate(); err == nil {
+        t.Fatal("ExitNAT accepted with iptables")
+    }
+    config := VPNConfig{FirewallBackend: FirewallNFTables, KillSwitch: true, KillSwitchVRF: "blue"}
+    if _, err := config.Validate(); err == nil {
+        t.Fatal("VRF kill switch accepted with nftables")
+    }
+    config = VPNConfig{FirewallBackend: FirewallNFTables, KillSwitch: true, CaptivePortal: CaptivePortalConfig{Enabled: true}}
+    if _, err := config.Validate(); err == nil {
+        t.Fatal("captive portal exemption accepted with nftables")
+    }
+}
+
+// Both backends let the DoH client reach the same bootstrap addresses and
+// ports, over TCP and nothing else
+func TestBootstrapRulesMatchAcrossBackends(t *testing.T) {
+    targets := bootstrapTargets(map[string]net.IP{
+        "dns.quad9.net":      net.ParseIP("9.9.9.9"),
+        "dns10.quad9.net":    net.ParseIP("9.9.9.9"),
+        "Cloudflare-DNS.com": net.ParseIP("2606:4700:4700::1111"),
+        "doh.example":        net.ParseIP("192.0.2.53"),
+    }, []string{
+        "https://dns.quad9.net/dns-query",
+        "https://cloudflare-dns.com:8443/dns-query",
+        "https://cloudflare-dns.com/dns-query",
+    })
+    
+    var fromIPTables []string
+    for _, rule := range bootstrapAcceptRules(targets) {
+        // iptables -I OUTPUT -p tcp -d IP --dport PORT -j ACCEPT
+        f := strings.Fields(rule)
+        if len(f) != 11 || f[3] != "-p" || f[5] != "-d" || f[7] != "--dport" || f[9] != "-j" || f[10] != "ACCEPT" {
+            t.Fatalf("unexpected iptables rule %q", rule)
+        }
+        fromIPTables = append(fromIPTables, f[4]+" "+f[6]+" "+f[8])
+    }
+    var fromNFT []string
+    for _, rule := range dnsNFTRules([]string{"10.64.0.1"}, targets) {
+        // ip daddr IP tcp dport PORT accept
+        f := strings.Fields(rule.expr)
+        if f[1] != "daddr" || f[0] == "oifname" || f[2] == "10.64.0.1" {
+            continue
+        }
+        if len(f) != 7 || f[4] != "dport" || f[6] != "accept" {
+            t.Fatalf("unexpected nft rule %q", rule.expr)
+        }
+        fromNFT = append(fromNFT, f[3]+" "+f[2]+" "+f[5])
+    }
+    
+    want := []string{
+        "tcp 2606:4700:4700::1111 8443",
+        "tcp 2606:4700:4700::1111 443",
+        "tcp 9.9.9.9 443",
+        "tcp 192.0.2.53 443",
+    }
+    if strings.Join(fromIPTables, ", ") != strings.Join(want, ", ") {
+        t.Fatalf("iptables accepts %v, want %v", fromIPTables, want)
+    }
+    if strings.Join(fromNFT, ", ") != strings.Join(fromIPTables, ", ") {
+        t.Fatalf("nftables accepts %v, iptables %v", fromNFT, fromIPTables)
+    }
+}
+
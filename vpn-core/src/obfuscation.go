@@ -0,0 +1,547 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/rand"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+    tlsRecordHeaderSize = 5
+    maxTLSRecordPayload = 16384 // TLS 1.3 plaintext limit, keeps records plausible
+    maxHTTPRecordBody   = 1 << 20
+    maxHTTPHeaderLines  = 32
+    
+    httpObfuscationHeader = "POST /api/v1/sync HTTP/1.1\r\n" +
+        "Host: cdn.undertheradar.net\r\n" +
+        "Content-Type: application/octet-stream\r\n" +
+        "Content-Length: %d\r\n\r\n"
+)
+
+var (
+    ErrBadObfuscatedRecord   = errors.New("malformed obfuscated record")
+    ErrUnknownObfuscationKey = errors.New("packet obfuscated with an unknown or expired key")
+)
+
+const (
+    // In-tunnel control message announcing a new XOR key, next to the
+    // capability messages: type, 3 reserved, key ID, key
+    keyRotationType   = 0xC3
+    keyRotationHeader = 5
+    xorKeySize        = 32
+    
+    // How long packets made with the previous key are still accepted
+    DefaultObfuscationKeyGrace = 30 * time.Second
+)
+
+func NewObfuscator() *Obfuscator {
+    key := make([]byte, xorKeySize)
+    rand.Read(key)
+    defer wipe(key)
+    
+    return &Obfuscator{
+        xorKey: NewSecret(key),
+        grace:  DefaultObfuscationKeyGrace,
+        clock:  RealClock{},
+    }
+}
+
+// Configure selects the obfuscation mode. A nil key keeps the current XOR
+// key, a new one restarts key IDs so both ends configured alike agree.
+func (ob *Obfuscator) Configure(mode ObfuscationMode, xorKey []byte) {
+    ob.mode = mode
+    if xorKey != nil {
+        ob.SetXORKey(xorKey)
+    }
+    ob.enabled.Store(mode != ObfuscationNone)
+}
+
+// SetXORKey replaces the XOR key in one step, restarting key IDs, e.g. with
+// one agreed in NegotiateCapabilities. Packets made with the old key no
+// longer decode.
+func (ob *Obfuscator) SetXORKey(xorKey []byte) {
+    ob.keyMu.Lock()
+    defer ob.keyMu.Unlock()
+    
+    ob.xorKey.Zeroize()
+    ob.xorKey = NewSecret(xorKey)
+    ob.keyID = 0
+    ob.dropPreviousLocked()
+}
+
+// forPeer makes an obfuscator for one peer's datagrams, in ob's mode and
+// padding with a copy of its current key, to take what is agreed with that
+// peer alone, see PeerObfuscator. Rotation runs on it separately.
+func (ob *Obfuscator) forPeer() *Obfuscator {
+    ob.keyMu.RLock()
+    peer := &Obfuscator{
+        mode:   ob.mode,
+        xorKey: NewSecret(ob.xorKey.Bytes()),
+        keyID:  ob.keyID,
+        grace:  ob.grace,
+        clock:  ob.clock,
+    }
+    ob.keyMu.RUnlock()
+    peer.padder.Store(ob.padder.Load())
+    peer.enabled.Store(ob.enabled.Load())
+    return peer
+}
+
+// Caller holds keyMu
+func (ob *Obfuscator) dropPreviousLocked() {
+    if ob.prevKey != nil {
+        ob.prevKey.Zeroize()
+        ob.prevKey = nil
+    }
+}
+
+// Make id/key current, keeping the outgoing key for the grace window.
+// Caller holds keyMu.
+func (ob *Obfuscator) installKeyLocked(id uint8, key *Secret) {
+    ob.dropPreviousLocked()
+    ob.prevKey, ob.prevKeyID = ob.xorKey, ob.keyID
+    ob.prevUntil = ob.clock.Now().Add(ob.grace)
+    ob.xorKey, ob.keyID = key, id
+}
+
+// RotateKey switches to a fresh XOR key and returns the control message
+// telling the peer about it. Send it through the tunnel, never in the
+// clear: it carries the key.
+func (ob *Obfuscator) RotateKey() []byte {
+    key := make([]byte, xorKeySize)
+    rand.Read(key)
+    defer wipe(key)
+    
+    ob.keyMu.Lock()
+    defer ob.keyMu.Unlock()
+    
+    id := ob.keyID + 1
+    ob.installKeyLocked(id, NewSecret(key))
+    
+    msg := make([]byte, keyRotationHeader, keyRotationHeader+xorKeySize)
+    msg[0] = keyRotationType
+    msg[4] = id
+    return append(msg, key...)
+}
+
+// HandleKeyRotation installs the key announced by the peer's RotateKey.
+// msg is wiped once read.
+func (ob *Obfuscator) HandleKeyRotation(msg []byte) error {
+    defer wipe(msg)
+    if len(msg) != keyRotationHeader+xorKeySize || msg[0] != keyRotationType {
+        return ErrBadObfuscatedRecord
+    }
+    
+    ob.keyMu.Lock()
+    defer ob.keyMu.Unlock()
+    
+    // A retransmitted announcement must not push the real previous key out
+    if msg[4] == ob.keyID {
+        return nil
+    }
+    ob.installKeyLocked(msg[4], NewSecret(msg[keyRotationHeader:]))
+    return nil
+}
+
+// The key a packet names, current or previous within the grace window
+func (ob *Obfuscator) keyFor(id uint8) ([]byte, error) {
+    ob.keyMu.RLock()
+    defer ob.keyMu.RUnlock()
+    
+    if id == ob.keyID {
+        return ob.xorKey.Bytes(), nil
+    }
+    if ob.prevKey != nil && id == ob.prevKeyID && ob.clock.Now().Before(ob.prevUntil) {
+        return ob.prevKey.Bytes(), nil
+    }
+    return nil, ErrUnknownObfuscationKey
+}
+
+func (ob *Obfuscator) xorDeobfuscate(data []byte) ([]byte, error) {
+    if len(data) == 0 {
+        return nil, ErrBadObfuscatedRecord
+    }
+    key, err := ob.keyFor(data[0])
+    if err != nil {
+        return nil, err
+    }
+    
+    result := make([]byte, len(data)-1)
+    for i := range result {
+        result[i] = data[1+i] ^ key[i%len(key)]
+    }
+    return result, nil
+}
+
+// StartRotation rotates the XOR key every interval, sending each
+// announcement to the peer over control, an in-tunnel connection like the
+// one used for capability negotiation. Packets made with the previous key
+// are accepted for grace afterwards, DefaultObfuscationKeyGrace when zero.
+func (ob *Obfuscator) StartRotation(interval, grace time.Duration, control io.Writer) error {
+    if interval <= 0 {
+        return fmt.Errorf("invalid key rotation interval %v", interval)
+    }
+    if grace <= 0 {
+        grace = DefaultObfuscationKeyGrace
+    }
+    
+    ob.keyMu.Lock()
+    if ob.rotation != nil {
+        ob.keyMu.Unlock()
+        return fmt.Errorf("key rotation already running")
+    }
+    ob.grace = grace
+    stop, done := make(chan struct{}), make(chan struct{})
+    ob.rotation, ob.rotationDone, ob.rotationTo = stop, done, control
+    ob.keyMu.Unlock()
+    
+    ticker := ob.clock.NewTicker(interval)
+    go withPhaseLabel(PhaseObfuscation, func() {
+        defer close(done)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C():
+                msg := ob.RotateKey()
+                control.Write(msg)
+                wipe(msg)
+            case <-stop:
+                return
+            }
+        }
+    })
+    return nil
+}
+
+// StopRotation ends scheduled rotation, the current key stays in use. It
+// waits for an announcement being sent, so the peer has every key we use.
+func (ob *Obfuscator) StopRotation() {
+    ob.keyMu.Lock()
+    stop, done := ob.rotation, ob.rotationDone
+    ob.rotation, ob.rotationDone, ob.rotationTo = nil, nil, nil
+    ob.keyMu.Unlock()
+    
+    if stop != nil {
+        close(stop)
+        <-done
+    }
+}
+
+// Restart scheduled rotation at a new interval, towards the same peer.
+// Nothing happens when rotation isn't running.
+func (ob *Obfuscator) reschedule(interval, grace time.Duration) error {
+    ob.keyMu.RLock()
+    control := ob.rotationTo
+    ob.keyMu.RUnlock()
+    
+    if control == nil {
+        return nil
+    }
+    ob.StopRotation()
+    if interval <= 0 {
+        return nil
+    }
+    return ob.StartRotation(interval, grace, control)
+}
+
+// StartObfuscationKeyRotation rotates the obfuscation XOR key on the
+// schedule in VPNConfig.ObfuscationKeyRotation, announcing each new key
+// over control. The peer passes what it reads there to HandleKeyRotation.
+func (vpn *UnderTheRadarVPN) StartObfuscationKeyRotation(control io.Writer) error {
+    vpn.mu.RLock()
+    interval, grace := vpn.config.ObfuscationKeyRotation, vpn.config.ObfuscationKeyGrace
+    vpn.mu.RUnlock()
+    
+    return vpn.obfuscator.StartRotation(interval, grace, control)
+}
+
+// PeerObfuscator is the obfuscator for the datagrams of the peer with
+// pubKey: its own once NegotiateCapabilities agreed a key or shaping with
+// it, the VPN's otherwise. Each end of a key exchange or shaped tunnel only
+// decodes the other's packets with it.
+func (vpn *UnderTheRadarVPN) PeerObfuscator(pubKey wgtypes.Key) (*Obfuscator, error) {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    peer := vpn.peers.get(pubKey)
+    if peer == nil {
+        return nil, fmt.Errorf("%w: %s", ErrPeerNotFound, pubKey)
+    }
+    if ob := peer.extras().obfuscator; ob != nil {
+        return ob, nil
+    }
+    return vpn.obfuscator, nil
+}
+
+// The peer's own obfuscator, nil until something was agreed with it
+func (vpn *UnderTheRadarVPN) negotiatedObfuscator(peer *Peer) *Obfuscator {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    return peer.extras().obfuscator
+}
+
+// The peer's own obfuscator, made from the VPN's on first use
+func (vpn *UnderTheRadarVPN) ownObfuscator(peer *Peer) *Obfuscator {
+    vpn.mu.Lock()
+    defer vpn.mu.Unlock()
+    
+    if peer.extra == nil {
+        peer.extra = &peerExtras{}
+    }
+    if peer.extra.obfuscator == nil {
+        peer.extra.obfuscator = vpn.obfuscator.forPeer()
+    }
+    return peer.extra.obfuscator
+}
+
+// Zeroize wipes every XOR key held
+func (ob *Obfuscator) Zeroize() {
+    ob.keyMu.Lock()
+    defer ob.keyMu.Unlock()
+    
+    ob.xorKey.Zeroize()
+    ob.dropPreviousLocked()
+}
+
+func (ob *Obfuscator) httpObfuscate(data []byte) []byte {
+    // Make packet look like an HTTP upload
+    header := fmt.Sprintf(httpObfuscationHeader, len(data))
+    return append([]byte(header), data...)
+}
+
+// DeobfuscatePacket reverses ObfuscatePacket for a single datagram. The
+// peer's cover packets give ErrCoverPacket.
+func (ob *Obfuscator) DeobfuscatePacket(data []byte) ([]byte, error) {
+    if !ob.enabled.Load() {
+        return data, nil
+    }
+    
+    var err error
+    switch ob.mode {
+    case ObfuscationXOR:
+        data, err = ob.xorDeobfuscate(data)
+    case ObfuscationTLS:
+        data, err = readTLSRecord(bufio.NewReader(bytes.NewReader(data)))
+    case ObfuscationHTTP:
+        data, err = readHTTPRecord(bufio.NewReader(bytes.NewReader(data)))
+    }
+    if err != nil {
+        return nil, err
+    }
+    if ob.shaper.Load() != nil {
+        return unshape(data)
+    }
+    if ob.padder.Load() != nil {
+        return Unpad(data)
+    }
+    return data, nil
+}
+
+// Wrap layers obfuscation over a stream connection. Writes are obfuscated
+// as records and reads reassemble complete records however the stream
+// splits them. A stream has nowhere to name its key, so it keeps the XOR
+// key current when it was wrapped across rotations.
+func (ob *Obfuscator) Wrap(conn net.Conn) net.Conn {
+    ob.keyMu.RLock()
+    key := NewSecret(ob.xorKey.Bytes())
+    ob.keyMu.RUnlock()
+    
+    return &obfuscatedConn{
+        Conn:   conn,
+        ob:     ob,
+        key:    key,
+        reader: bufio.NewReader(conn),
+    }
+}
+
+type obfuscatedConn struct {
+    net.Conn
+    ob  *Obfuscator
+    key *Secret // XOR stream key
+    
+    writeMu  sync.Mutex
+    writeOff int // XOR key position, the stream has no record boundaries
+    
+    readMu  sync.Mutex
+    reader  *bufio.Reader
+    pending []byte // rest of a record larger than the caller's buffer
+    readOff int
+}
+
+func (c *obfuscatedConn) Close() error {
+    c.key.Zeroize()
+    return c.Conn.Close()
+}
+
+func (c *obfuscatedConn) Write(p []byte) (int, error) {
+    c.writeMu.Lock()
+    defer c.writeMu.Unlock()
+    
+    if !c.ob.enabled.Load() {
+        return c.Conn.Write(p)
+    }
+    
+    switch c.ob.mode {
+    case ObfuscationXOR:
+        out := xorStream(c.key.Bytes(), p, c.writeOff)
+        n, err := c.Conn.Write(out)
+        c.writeOff += n
+        return n, err
+    case ObfuscationTLS:
+        // Split into records whose 16-bit length field can describe them
+        return c.writeRecords(p, maxTLSRecordPayload, c.ob.tlsObfuscate)
+    case ObfuscationHTTP:
+        // Split into bodies readHTTPRecord accepts
+        return c.writeRecords(p, maxHTTPRecordBody, c.ob.httpObfuscate)
+    default:
+        return c.Conn.Write(p)
+    }
+}
+
+// Write p as records of at most size bytes of it each, counting what went
+// out in whole records
+func (c *obfuscatedConn) writeRecords(p []byte, size int, frame func([]byte) []byte) (int, error) {
+    written := 0
+    for written < len(p) {
+        end := written + size
+        if end > len(p) {
+            end = len(p)
+        }
+        if err := c.writeRecord(frame(p[written:end])); err != nil {
+            return written, err
+        }
+        written = end
+    }
+    return written, nil
+}
+
+// A record is either written whole or the write fails
+func (c *obfuscatedConn) writeRecord(record []byte) error {
+    _, err := c.Conn.Write(record)
+    return err
+}
+
+func (c *obfuscatedConn) Read(p []byte) (int, error) {
+    c.readMu.Lock()
+    defer c.readMu.Unlock()
+    
+    if !c.ob.enabled.Load() {
+        return c.reader.Read(p)
+    }
+    
+    if c.ob.mode == ObfuscationXOR {
+        n, err := c.reader.Read(p)
+        copy(p, xorStream(c.key.Bytes(), p[:n], c.readOff))
+        c.readOff += n
+        return n, err
+    }
+    
+    for len(c.pending) == 0 {
+        var record []byte
+        var err error
+        
+        switch c.ob.mode {
+        case ObfuscationTLS:
+            record, err = readTLSRecord(c.reader)
+        case ObfuscationHTTP:
+            record, err = readHTTPRecord(c.reader)
+        default:
+            return c.reader.Read(p)
+        }
+        if err != nil {
+            return 0, err
+        }
+        c.pending = record
+    }
+    
+    n := copy(p, c.pending)
+    c.pending = c.pending[n:]
+    return n, nil
+}
+
+// XOR starting at an arbitrary offset into the key stream
+func xorStream(key, data []byte, offset int) []byte {
+    result := make([]byte, len(data))
+    for i := range data {
+        result[i] = data[i] ^ key[(offset+i)%len(key)]
+    }
+    return result
+}
+
+func readTLSRecord(r *bufio.Reader) ([]byte, error) {
+    var header [tlsRecordHeaderSize]byte
+    if _, err := io.ReadFull(r, header[:]); err != nil {
+        return nil, err
+    }
+    if header[0] != 0x16 || header[1] != 0x03 || header[2] != 0x03 {
+        return nil, ErrBadObfuscatedRecord
+    }
+    
+    length := int(header[3])<<8 | int(header[4])
+    payload := make([]byte, length)
+    if _, err := io.ReadFull(r, payload); err != nil {
+        return nil, unexpectedEOF(err)
+    }
+    return payload, nil
+}
+
+func readHTTPRecord(r *bufio.Reader) ([]byte, error) {
+    requestLine, err := r.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    if !strings.HasPrefix(requestLine, "POST ") {
+        return nil, ErrBadObfuscatedRecord
+    }
+    
+    length := -1
+    for i := 0; ; i++ {
+        if i == maxHTTPHeaderLines {
+            return nil, ErrBadObfuscatedRecord
+        }
+        line, err := r.ReadString('\n')
+        if err != nil {
+            return nil, unexpectedEOF(err)
+        }
+        line = strings.TrimRight(line, "\r\n")
+        if line == "" {
+            break
+        }
+        
+        name, value, ok := strings.Cut(line, ":")
+        if ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+            length, err = strconv.Atoi(strings.TrimSpace(value))
+            if err != nil {
+                return nil, ErrBadObfuscatedRecord
+            }
+        }
+    }
+    if length < 0 || length > maxHTTPRecordBody {
+        return nil, ErrBadObfuscatedRecord
+    }
+    
+    body := make([]byte, length)
+    if _, err := io.ReadFull(r, body); err != nil {
+        return nil, unexpectedEOF(err)
+    }
+    return body, nil
+}
+
+// EOF in the middle of a record is never a clean end of stream
+func unexpectedEOF(err error) error {
+    if err == io.EOF {
+        return io.ErrUnexpectedEOF
+    }
+    return err
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+    "bytes"
+    "io"
+    "net"
+    "testing"
+    "time"
+)
+
+var obfuscationModes = []struct {
+    name string
+    mode ObfuscationMode
+}{
+    {"none", ObfuscationNone},
+    {"xor", ObfuscationXOR},
+    {"tls", ObfuscationTLS},
+    {"http", ObfuscationHTTP},
+}
+
+func testObfuscator(mode ObfuscationMode) *Obfuscator {
+    ob := NewObfuscator()
+    ob.Configure(mode, []byte("0123456789abcdef"))
+    return ob
+}
+
+func TestObfuscatedConnRoundTrip(t *testing.T) {
+    messages := [][]byte{
+        []byte("handshake"),
+        bytes.Repeat([]byte{0xAB}, 1420),
+        bytes.Repeat([]byte("large"), 8000), // spans several TLS records
+        {0x01},
+    }
+    var want []byte
+    for _, m := range messages {
+        want = append(want, m...)
+    }
+    
+    for _, tt := range obfuscationModes {
+        t.Run(tt.name, func(t *testing.T) {
+            ob := testObfuscator(tt.mode)
+            client, server := net.Pipe()
+            defer server.Close()
+            
+            go func() {
+                w := ob.Wrap(client)
+                for _, m := range messages {
+                    if _, err := w.Write(m); err != nil {
+                        t.Error(err)
+                        return
+                    }
+                }
+                w.Close()
+            }()
+            
+            // Small reads force records to be handed out in pieces
+            r := ob.Wrap(server)
+            var got []byte
+            buf := make([]byte, 7)
+            for {
+                n, err := r.Read(buf)
+                got = append(got, buf[:n]...)
+                if err == io.EOF {
+                    break
+                }
+                if err != nil {
+                    t.Fatal(err)
+                }
+            }
+            
+            if !bytes.Equal(got, want) {
+                t.Fatalf("got %d bytes, want %d", len(got), len(want))
+            }
+        })
+    }
+}
+
+func TestObfuscatedConnSplitsLargeWrites(t *testing.T) {
+    // More than one record of either mode can carry
+    payload := bytes.Repeat([]byte("0123456789"), maxHTTPRecordBody/10+100)
+    
+    for _, tt := range obfuscationModes[2:] {
+        t.Run(tt.name, func(t *testing.T) {
+            ob := testObfuscator(tt.mode)
+            client, server := net.Pipe()
+            defer server.Close()
+            
+            go func() {
+                w := ob.Wrap(client)
+                if n, err := w.Write(payload); err != nil || n != len(payload) {
+                    t.Errorf("Write = %d, %v", n, err)
+                }
+                w.Close()
+            }()
+            
+            got, err := io.ReadAll(ob.Wrap(server))
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !bytes.Equal(got, payload) {
+                t.Fatalf("got %d bytes, want %d", len(got), len(payload))
+            }
+        })
+    }
+}
+
+func TestObfuscatedConnReassemblesSplitRecords(t *testing.T) {
+    for _, tt := range obfuscationModes[2:] {
+        t.Run(tt.name, func(t *testing.T) {
+            ob := testObfuscator(tt.mode)
+            payload := []byte("a datagram that arrives one byte at a time")
+            record := ob.ObfuscatePacket(payload)
+            
+            client, server := net.Pipe()
+            defer server.Close()
+            
+            // Deliver the raw record in single-byte segments
+            go func() {
+                for i := range record {
+                    if _, err := client.Write(record[i : i+1]); err != nil {
+                        return
+                    }
+                }
+                client.Close()
+            }()
+            
+            got := make([]byte, len(payload))
+            if _, err := io.ReadFull(ob.Wrap(server), got); err != nil {
+                t.Fatal(err)
+            }
+            if !bytes.Equal(got, payload) {
+                t.Fatalf("got %q, want %q", got, payload)
+            }
+        })
+    }
+}
+
+func TestObfuscatedConnTruncatedRecord(t *testing.T) {
+    ob := testObfuscator(ObfuscationTLS)
+    record := ob.ObfuscatePacket([]byte("truncated"))
+    
+    client, server := net.Pipe()
+    go func() {
+        client.Write(record[:len(record)-3])
+        client.Close()
+    }()
+    
+    _, err := ob.Wrap(server).Read(make([]byte, 64))
+    if err != io.ErrUnexpectedEOF {
+        t.Fatalf("err = %v, want io.ErrUnexpectedEOF", err)
+    }
+}
+
+func TestDeobfuscatePacket(t *testing.T) {
+    payload := []byte{0x04, 0x00, 0x00, 0x00, 0xde, 0xad, 0xbe, 0xef}
+    
+    for _, tt := range obfuscationModes {
+        ob := testObfuscator(tt.mode)
+        got, err := ob.DeobfuscatePacket(ob.ObfuscatePacket(payload))
+        if err != nil {
+            t.Fatalf("%s: %v", tt.name, err)
+        }
+        if !bytes.Equal(got, payload) {
+            t.Errorf("%s: got %x, want %x", tt.name, got, payload)
+        }
+    }
+    
+    ob := testObfuscator(ObfuscationTLS)
+    if _, err := ob.DeobfuscatePacket([]byte("GET / HTTP/1.1\r\n")); err != ErrBadObfuscatedRecord {
+        t.Errorf("err = %v, want ErrBadObfuscatedRecord", err)
+    }
+}
+
+func TestXORKeyRotationRoundTrip(t *testing.T) {
+    key := []byte("shared-obfuscation-key-012345678")
+    sender, receiver := testObfuscator(ObfuscationXOR), testObfuscator(ObfuscationXOR)
+    sender.Configure(ObfuscationXOR, key)
+    receiver.Configure(ObfuscationXOR, key)
+    
+    clock := NewFakeClock(time.Unix(1700000000, 0))
+    receiver.clock = clock
+    
+    before := []byte("sent before the rotation")
+    inFlight := sender.ObfuscatePacket(before)
+    
+    receiver.HandleKeyRotation(sender.RotateKey())
+    after := []byte("sent after the rotation")
+    rotated := sender.ObfuscatePacket(after)
+    if rotated[0] == inFlight[0] {
+        t.Fatalf("key ID %d unchanged by rotation", rotated[0])
+    }
+    
+    for _, tt := range []struct {
+        packet, want []byte
+    }{
+        {inFlight, before},
+        {rotated, after},
+    } {
+        got, err := receiver.DeobfuscatePacket(tt.packet)
+        if err != nil {
+            t.Fatalf("key %d: %v", tt.packet[0], err)
+        }
+        if !bytes.Equal(got, tt.want) {
+            t.Fatalf("key %d: got %q, want %q", tt.packet[0], got, tt.want)
+        }
+    }
+    
+    // Past the grace window only the new key works
+    clock.Advance(DefaultObfuscationKeyGrace)
+    if _, err := receiver.DeobfuscatePacket(inFlight); err != ErrUnknownObfuscationKey {
+        t.Fatalf("old key after grace: err = %v, want ErrUnknownObfuscationKey", err)
+    }
+    if _, err := receiver.DeobfuscatePacket(rotated); err != nil {
+        t.Fatalf("new key after grace: %v", err)
+    }
+}
+
+func TestXORKeyRotationIgnoresRepeatedAnnouncement(t *testing.T) {
+    sender, receiver := testObfuscator(ObfuscationXOR), testObfuscator(ObfuscationXOR)
+    key := []byte("shared-obfuscation-key-012345678")
+    sender.Configure(ObfuscationXOR, key)
+    receiver.Configure(ObfuscationXOR, key)
+    
+    inFlight := sender.ObfuscatePacket([]byte("ping"))
+    msg := sender.RotateKey()
+    receiver.HandleKeyRotation(append([]byte(nil), msg...))
+    receiver.HandleKeyRotation(msg)
+    
+    if _, err := receiver.DeobfuscatePacket(inFlight); err != nil {
+        t.Fatalf("retransmitted announcement dropped the previous key: %v", err)
+    }
+    if err := receiver.HandleKeyRotation(msg[:10]); err != ErrBadObfuscatedRecord {
+        t.Fatalf("truncated announcement: err = %v", err)
+    }
+}
+
+func TestScheduledXORKeyRotation(t *testing.T) {
+    sender, receiver := testObfuscator(ObfuscationXOR), testObfuscator(ObfuscationXOR)
+    key := []byte("shared-obfuscation-key-012345678")
+    sender.Configure(ObfuscationXOR, key)
+    receiver.Configure(ObfuscationXOR, key)
+    clock := NewFakeClock(time.Now())
+    sender.clock = clock
+    
+    // The control channel stands in for an in-tunnel connection
+    announced := make(chan struct{}, 1)
+    control := writerFunc(func(p []byte) (int, error) {
+        if err := receiver.HandleKeyRotation(append([]byte(nil), p...)); err != nil {
+            t.Error(err)
+        }
+        select {
+        case announced <- struct{}{}:
+        default:
+        }
+        return len(p), nil
+    })
+    if err := sender.StartRotation(time.Hour, time.Minute, control); err != nil {
+        t.Fatal(err)
+    }
+    clock.Advance(time.Hour)
+    select {
+    case <-announced:
+    case <-time.After(5 * time.Second):
+        t.Fatal("no key announced")
+    }
+    sender.StopRotation()
+    
+    payload := []byte("after the first scheduled rotation")
+    got, err := receiver.DeobfuscatePacket(sender.ObfuscatePacket(payload))
+    if err != nil || !bytes.Equal(got, payload) {
+        t.Fatalf("got %q, %v", got, err)
+    }
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+    return f(p)
+}
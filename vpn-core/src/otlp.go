@@ -0,0 +1,286 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    DefaultOTLPInterval    = 15 * time.Second
+    DefaultOTLPServiceName = "undertheradar-vpn"
+)
+
+// OTLPConfig exports metrics to an OpenTelemetry collector over OTLP/HTTP
+// with JSON encoding
+type OTLPConfig struct {
+    Endpoint    string            // e.g. http://localhost:4318/v1/metrics
+    ServiceName string            // service.name resource attribute, default DefaultOTLPServiceName
+    Interval    time.Duration     // default DefaultOTLPInterval
+    Headers     map[string]string // e.g. authentication for a hosted collector
+    Clock       Clock             // default RealClock
+}
+
+func (c OTLPConfig) withDefaults() OTLPConfig {
+    if c.ServiceName == "" {
+        c.ServiceName = DefaultOTLPServiceName
+    }
+    if c.Interval <= 0 {
+        c.Interval = DefaultOTLPInterval
+    }
+    c.Clock = orRealClock(c.Clock)
+    return c
+}
+
+// OTLPSink aggregates metrics between exports: the last value of each
+// gauge and the sum of each counter as a delta since the previous export.
+// Tags become attributes. Run Start in its own goroutine.
+type OTLPSink struct {
+    cfg    OTLPConfig
+    client *http.Client
+    
+    mu     sync.Mutex
+    gauges map[otlpSeries]float64
+    counts map[otlpSeries]int64
+    since  time.Time // start of the current delta window
+    
+    stop     chan struct{}
+    stopOnce sync.Once
+}
+
+// A metric name with its tags, sorted and joined
+type otlpSeries struct {
+    name string
+    tags string
+}
+
+func NewOTLPSink(cfg OTLPConfig) *OTLPSink {
+    cfg = cfg.withDefaults()
+    return &OTLPSink{
+        cfg:    cfg,
+        client: &http.Client{Timeout: 10 * time.Second},
+        gauges: make(map[otlpSeries]float64),
+        counts: make(map[otlpSeries]int64),
+        since:  cfg.Clock.Now(),
+        stop:   make(chan struct{}),
+    }
+}
+
+func newOTLPSeries(name string, tags []string) otlpSeries {
+    sorted := append([]string(nil), tags...)
+    sort.Strings(sorted)
+    return otlpSeries{name: name, tags: strings.Join(sorted, ",")}
+}
+
+func (s *OTLPSink) Gauge(name string, value float64, tags ...string) {
+    s.mu.Lock()
+    s.gauges[newOTLPSeries(name, tags)] = value
+    s.mu.Unlock()
+}
+
+func (s *OTLPSink) Count(name string, delta int64, tags ...string) {
+    s.mu.Lock()
+    s.counts[newOTLPSeries(name, tags)] += delta
+    s.mu.Unlock()
+}
+
+func (s *OTLPSink) Start() {
+    ticker := s.cfg.Clock.NewTicker(s.cfg.Interval)
+    defer ticker.Stop()
+    
+    for {
+        select {
+        case <-ticker.C():
+            s.Flush()
+        case <-s.stop:
+            return
+        }
+    }
+}
+
+// Stop ends periodic export, sending what has accumulated
+func (s *OTLPSink) Stop() error {
+    s.stopOnce.Do(func() { close(s.stop) })
+    return s.Flush()
+}
+
+// Flush exports now. Counters that fail to go out are kept for the next
+// attempt, gauges are resent anyway.
+func (s *OTLPSink) Flush() error {
+    now := s.cfg.Clock.Now()
+    s.mu.Lock()
+    gauges, counts, since := s.gauges, s.counts, s.since
+    s.counts = make(map[otlpSeries]int64)
+    s.since = now
+    s.mu.Unlock()
+    
+    if len(gauges) == 0 && len(counts) == 0 {
+        return nil
+    }
+    body, err := json.Marshal(s.request(gauges, counts, since, now))
+    if err != nil {
+        return fmt.Errorf("failed to encode OTLP metrics: %w", err)
+    }
+    if err := s.post(body); err != nil {
+        s.mu.Lock()
+        for series, delta := range counts {
+            s.counts[series] += delta
+        }
+        s.since = since
+        s.mu.Unlock()
+        return err
+    }
+    return nil
+}
+
+func (s *OTLPSink) post(body []byte) error {
+    req, err := http.NewRequest(http.MethodPost, s.cfg.Endpoint, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    for k, v := range s.cfg.Headers {
+        req.Header.Set(k, v)
+    }
+    
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return fmt.Errorf("failed to export metrics to %s: %w", s.cfg.Endpoint, err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return fmt.Errorf("failed to export metrics to %s: %s", s.cfg.Endpoint, resp.Status)
+    }
+    return nil
+}
+
+// ExportMetricsServiceRequest in the OTLP JSON encoding, only the parts we
+// send. 64-bit integers are strings there.
+type otlpRequest struct {
+    ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+    Resource     otlpResource       `json:"resource"`
+    ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+    Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+    Scope   otlpScope    `json:"scope"`
+    Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+    Name string `json:"name"`
+}
+
+type otlpMetric struct {
+    Name  string     `json:"name"`
+    Gauge *otlpGauge `json:"gauge,omitempty"`
+    Sum   *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpGauge struct {
+    DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+    DataPoints             []otlpDataPoint `json:"dataPoints"`
+    AggregationTemporality int             `json:"aggregationTemporality"` // 1 is delta
+    IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+    Attributes        []otlpAttribute `json:"attributes,omitempty"`
+    StartTimeUnixNano int64           `json:"startTimeUnixNano,string,omitempty"`
+    TimeUnixNano      int64           `json:"timeUnixNano,string"`
+    AsDouble          *float64        `json:"asDouble,omitempty"`
+    AsInt             *int64          `json:"asInt,string,omitempty"`
+}
+
+type otlpAttribute struct {
+    Key   string             `json:"key"`
+    Value otlpAttributeValue `json:"value"`
+}
+
+type otlpAttributeValue struct {
+    StringValue string `json:"stringValue"`
+}
+
+// Tags "key:value" as attributes, a tag without a colon becomes a key with
+// an empty value
+func otlpAttributes(tags string) []otlpAttribute {
+    if tags == "" {
+        return nil
+    }
+    var attrs []otlpAttribute
+    for _, tag := range strings.Split(tags, ",") {
+        key, value, _ := strings.Cut(tag, ":")
+        attrs = append(attrs, otlpAttribute{Key: key, Value: otlpAttributeValue{StringValue: value}})
+    }
+    return attrs
+}
+
+func (s *OTLPSink) request(gauges map[otlpSeries]float64, counts map[otlpSeries]int64, since, now time.Time) otlpRequest {
+    byName := make(map[string]*otlpMetric)
+    var names []string
+    metric := func(name string) *otlpMetric {
+        m, ok := byName[name]
+        if !ok {
+            m = &otlpMetric{Name: name}
+            byName[name] = m
+            names = append(names, name)
+        }
+        return m
+    }
+    
+    for series, value := range gauges {
+        m := metric(series.name)
+        if m.Gauge == nil {
+            m.Gauge = &otlpGauge{}
+        }
+        value := value
+        m.Gauge.DataPoints = append(m.Gauge.DataPoints, otlpDataPoint{
+            Attributes:   otlpAttributes(series.tags),
+            TimeUnixNano: now.UnixNano(),
+            AsDouble:     &value,
+        })
+    }
+    for series, delta := range counts {
+        m := metric(series.name)
+        if m.Sum == nil {
+            m.Sum = &otlpSum{AggregationTemporality: 1, IsMonotonic: true}
+        }
+        delta := delta
+        m.Sum.DataPoints = append(m.Sum.DataPoints, otlpDataPoint{
+            Attributes:        otlpAttributes(series.tags),
+            StartTimeUnixNano: since.UnixNano(),
+            TimeUnixNano:      now.UnixNano(),
+            AsInt:             &delta,
+        })
+    }
+    
+    sort.Strings(names)
+    metrics := make([]otlpMetric, len(names))
+    for i, name := range names {
+        metrics[i] = *byName[name]
+    }
+    return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+        Resource: otlpResource{Attributes: []otlpAttribute{
+            {Key: "service.name", Value: otlpAttributeValue{StringValue: s.cfg.ServiceName}},
+        }},
+        ScopeMetrics: []otlpScopeMetrics{{
+            Scope:   otlpScope{Name: "undertheradar-vpn"},
+            Metrics: metrics,
+        }},
+    }}}
+}
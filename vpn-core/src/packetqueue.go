@@ -0,0 +1,268 @@
+package main
+
+import (
+    "errors"
+    "net"
+    "sync"
+    "sync/atomic"
+)
+
+var ErrQueueClosed = errors.New("packet queue closed")
+
+// PacketPriority selects the lane a packet waits in
+type PacketPriority int
+
+const (
+    PriorityHandshake PacketPriority = iota // always dequeued first
+    PriorityBulk
+    numPriorities
+)
+
+const (
+    DefaultQueueDepth          = 1024
+    DefaultHandshakeQueueDepth = 64
+)
+
+// ClassifyPacket puts WireGuard handshake initiations, responses and
+// cookie replies in the handshake lane and everything else in bulk
+func ClassifyPacket(packet []byte) PacketPriority {
+    if len(packet) >= 4 && packet[0] >= 1 && packet[0] <= 3 && packet[1] == 0 && packet[2] == 0 && packet[3] == 0 {
+        return PriorityHandshake
+    }
+    return PriorityBulk
+}
+
+// QueueConfig sizes a PacketQueue, zero values use the defaults
+type QueueConfig struct {
+    Depth          int // bulk packets
+    HandshakeDepth int
+}
+
+// QueueStats are the counters of one or more packet queues
+type QueueStats struct {
+    Depth            int // bulk capacity
+    Queued           int // waiting right now, both lanes
+    HighWatermark    int
+    Enqueued         uint64
+    Dequeued         uint64
+    DroppedBulk      uint64
+    DroppedHandshake uint64
+}
+
+// Add folds the counters of another queue into s
+func (s *QueueStats) Add(o QueueStats) {
+    s.Depth += o.Depth
+    s.Queued += o.Queued
+    s.HighWatermark = max(s.HighWatermark, o.HighWatermark)
+    s.Enqueued += o.Enqueued
+    s.Dequeued += o.Dequeued
+    s.DroppedBulk += o.DroppedBulk
+    s.DroppedHandshake += o.DroppedHandshake
+}
+
+// PacketQueue is a bounded multi-producer, single-consumer queue between
+// the tunnel and a slower transport. Enqueue never blocks: when a lane is
+// full the packet is dropped and counted, like a congested link would.
+// Handshakes have a lane of their own, so bulk data can never crowd them
+// out, and are always dequeued first.
+type PacketQueue struct {
+    lanes  [numPriorities]chan []byte
+    closed chan struct{}
+    once   sync.Once
+    held   []byte // bulk packet passed over for a handshake, consumer only
+    
+    queued        atomic.Int64
+    highWatermark atomic.Int64
+    enqueued      atomic.Uint64
+    dequeued      atomic.Uint64
+    dropped       [numPriorities]atomic.Uint64
+}
+
+func NewPacketQueue(cfg QueueConfig) *PacketQueue {
+    if cfg.Depth <= 0 {
+        cfg.Depth = DefaultQueueDepth
+    }
+    if cfg.HandshakeDepth <= 0 {
+        cfg.HandshakeDepth = DefaultHandshakeQueueDepth
+    }
+    q := &PacketQueue{closed: make(chan struct{})}
+    q.lanes[PriorityHandshake] = make(chan []byte, cfg.HandshakeDepth)
+    q.lanes[PriorityBulk] = make(chan []byte, cfg.Depth)
+    return q
+}
+
+// Enqueue hands packet to the consumer, false if it was dropped. The queue
+// keeps packet, callers must not reuse it.
+func (q *PacketQueue) Enqueue(packet []byte, priority PacketPriority) bool {
+    select {
+    case <-q.closed:
+        return false
+    default:
+    }
+    
+    select {
+    case q.lanes[priority] <- packet:
+        q.enqueued.Add(1)
+        n := q.queued.Add(1)
+        for {
+            high := q.highWatermark.Load()
+            if n <= high || q.highWatermark.CompareAndSwap(high, n) {
+                break
+            }
+        }
+        return true
+    default:
+        q.dropped[priority].Add(1)
+        return false
+    }
+}
+
+// Dequeue waits for the next packet, handshakes first. Only one goroutine
+// may dequeue.
+func (q *PacketQueue) Dequeue() ([]byte, error) {
+    select {
+    case <-q.closed:
+        return nil, ErrQueueClosed
+    case packet := <-q.lanes[PriorityHandshake]:
+        return q.took(packet), nil
+    default:
+    }
+    if packet := q.held; packet != nil {
+        q.held = nil
+        return q.took(packet), nil
+    }
+    
+    select {
+    case packet := <-q.lanes[PriorityHandshake]:
+        return q.took(packet), nil
+    case packet := <-q.lanes[PriorityBulk]:
+        // A handshake that arrived meanwhile still goes first
+        select {
+        case hs := <-q.lanes[PriorityHandshake]:
+            q.held = packet
+            return q.took(hs), nil
+        default:
+        }
+        return q.took(packet), nil
+    case <-q.closed:
+        return nil, ErrQueueClosed
+    }
+}
+
+func (q *PacketQueue) took(packet []byte) []byte {
+    q.queued.Add(-1)
+    q.dequeued.Add(1)
+    return packet
+}
+
+// Close wakes the consumer, packets still queued are discarded
+func (q *PacketQueue) Close() {
+    q.once.Do(func() { close(q.closed) })
+}
+
+func (q *PacketQueue) Stats() QueueStats {
+    return QueueStats{
+        Depth:            cap(q.lanes[PriorityBulk]),
+        Queued:           int(q.queued.Load()),
+        HighWatermark:    int(q.highWatermark.Load()),
+        Enqueued:         q.enqueued.Load(),
+        Dequeued:         q.dequeued.Load(),
+        DroppedBulk:      q.dropped[PriorityBulk].Load(),
+        DroppedHandshake: q.dropped[PriorityHandshake].Load(),
+    }
+}
+
+// WrapQueued is Wrap with a PacketQueue in front of the writes, for
+// carrying tunnel packets over a stream. Each Write is one packet; when
+// the stream can't keep up packets are dropped before they are obfuscated,
+// so the record framing and XOR offsets stay intact, and handshakes still
+// get through. Write only fails once the stream has.
+func (ob *Obfuscator) WrapQueued(conn net.Conn, cfg QueueConfig) net.Conn {
+    qc := &queuedConn{
+        Conn:  ob.Wrap(conn),
+        ob:    ob,
+        queue: NewPacketQueue(cfg),
+        done:  make(chan struct{}),
+    }
+    ob.queueMu.Lock()
+    if ob.queues == nil {
+        ob.queues = make(map[*PacketQueue]struct{})
+    }
+    ob.queues[qc.queue] = struct{}{}
+    ob.queueMu.Unlock()
+    
+    go withPhaseLabel(PhaseObfuscation, qc.send)
+    return qc
+}
+
+type queuedConn struct {
+    net.Conn // the obfuscated stream
+    ob       *Obfuscator
+    queue    *PacketQueue
+    done     chan struct{}
+    err      atomic.Pointer[error] // first write error of the stream
+    once     sync.Once
+}
+
+func (c *queuedConn) Write(p []byte) (int, error) {
+    if err := c.err.Load(); err != nil {
+        return 0, *err
+    }
+    packet := append([]byte(nil), p...)
+    if !c.queue.Enqueue(packet, ClassifyPacket(packet)) {
+        select {
+        case <-c.queue.closed:
+            return 0, net.ErrClosed
+        default:
+        }
+    }
+    return len(p), nil
+}
+
+// The single consumer
+func (c *queuedConn) send() {
+    defer close(c.done)
+    for {
+        packet, err := c.queue.Dequeue()
+        if err != nil {
+            return
+        }
+        if _, err := c.Conn.Write(packet); err != nil {
+            c.err.Store(&err)
+            c.queue.Close()
+            return
+        }
+    }
+}
+
+func (c *queuedConn) Close() error {
+    var err error
+    c.once.Do(func() {
+        c.queue.Close()
+        err = c.Conn.Close()
+        <-c.done
+        c.ob.retireQueue(c.queue)
+    })
+    return err
+}
+
+// Keep the counters of closed queues in the totals
+func (ob *Obfuscator) retireQueue(q *PacketQueue) {
+    ob.queueMu.Lock()
+    defer ob.queueMu.Unlock()
+    delete(ob.queues, q)
+    stats := q.Stats()
+    stats.Depth, stats.Queued = 0, 0
+    ob.retiredQueues.Add(stats)
+}
+
+// QueueStats sums the queues of every WrapQueued connection
+func (ob *Obfuscator) QueueStats() QueueStats {
+    ob.queueMu.Lock()
+    defer ob.queueMu.Unlock()
+    total := ob.retiredQueues
+    for q := range ob.queues {
+        total.Add(q.Stats())
+    }
+    return total
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+    "encoding/binary"
+    "net"
+    "sync"
+    "testing"
+    "time"
+)
+
+// A WireGuard-shaped packet of the given message type
+func wgPacket(msgType byte, size int) []byte {
+    packet := make([]byte, size)
+    packet[0] = msgType
+    return packet
+}
+
+func TestClassifyPacket(t *testing.T) {
+    for _, tt := range []struct {
+        packet []byte
+        want   PacketPriority
+    }{
+        {wgPacket(1, 148), PriorityHandshake},
+        {wgPacket(2, 92), PriorityHandshake},
+        {wgPacket(3, 64), PriorityHandshake},
+        {wgPacket(4, 1420), PriorityBulk},
+        {[]byte{1, 0}, PriorityBulk},
+        {[]byte{1, 9, 9, 9, 0}, PriorityBulk},
+    } {
+        if got := ClassifyPacket(tt.packet); got != tt.want {
+            t.Errorf("ClassifyPacket(%x...) = %v, want %v", tt.packet[:2], got, tt.want)
+        }
+    }
+}
+
+func TestPacketQueueDropsBulkNotHandshakes(t *testing.T) {
+    q := NewPacketQueue(QueueConfig{Depth: 4, HandshakeDepth: 2})
+    
+    accepted := 0
+    for i := 0; i < 10; i++ {
+        if q.Enqueue(wgPacket(4, 32), PriorityBulk) {
+            accepted++
+        }
+    }
+    if accepted != 4 {
+        t.Fatalf("%d bulk packets accepted into a queue of 4", accepted)
+    }
+    if !q.Enqueue(wgPacket(1, 148), PriorityHandshake) {
+        t.Fatal("handshake dropped because bulk filled the queue")
+    }
+    
+    if packet, _ := q.Dequeue(); packet[0] != 1 {
+        t.Fatal("handshake was not dequeued first")
+    }
+    stats := q.Stats()
+    if stats.Enqueued != 5 || stats.Dequeued != 1 || stats.DroppedBulk != 6 || stats.DroppedHandshake != 0 ||
+        stats.Queued != 4 || stats.HighWatermark != 5 || stats.Depth != 4 {
+        t.Fatalf("stats = %+v", stats)
+    }
+    
+    q.Close()
+    if _, err := q.Dequeue(); err != ErrQueueClosed {
+        t.Fatalf("err = %v, want ErrQueueClosed", err)
+    }
+    if q.Enqueue(wgPacket(1, 148), PriorityHandshake) {
+        t.Fatal("closed queue accepted a packet")
+    }
+}
+
+func TestWrapQueuedDeliversHandshakesToSlowStream(t *testing.T) {
+    local, remote := net.Pipe()
+    sender, receiver := testObfuscator(ObfuscationTLS), testObfuscator(ObfuscationTLS)
+    conn := sender.WrapQueued(local, QueueConfig{Depth: 8})
+    peer := receiver.Wrap(remote)
+    defer peer.Close()
+    
+    // Nothing reads yet, so the stream stalls and the queue fills
+    for i := 0; i < 100; i++ {
+        if _, err := conn.Write(wgPacket(4, 512)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if _, err := conn.Write(wgPacket(1, 148)); err != nil {
+        t.Fatal(err)
+    }
+    
+    // Every record arrives whole and the handshake makes it through
+    peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+    buf := make([]byte, 2048)
+    for {
+        n, err := peer.Read(buf)
+        if err != nil {
+            t.Fatalf("handshake never arrived: %v", err)
+        }
+        if n != 512 && n != 148 {
+            t.Fatalf("read a %d byte packet", n)
+        }
+        if buf[0] == 1 {
+            break
+        }
+    }
+    
+    conn.Close()
+    stats := sender.QueueStats()
+    if stats.DroppedBulk == 0 || stats.DroppedHandshake != 0 || stats.Enqueued+stats.DroppedBulk != 101 {
+        t.Fatalf("stats = %+v", stats)
+    }
+    if _, err := conn.Write(wgPacket(4, 32)); err == nil {
+        t.Fatal("write to a closed connection succeeded")
+    }
+}
+
+// The stream path before queues: every packet waits its turn, however long
+// the backlog grows
+type unboundedQueue struct {
+    mu      sync.Mutex
+    cond    *sync.Cond
+    packets [][]byte
+    peak    int
+    closed  bool
+}
+
+func (q *unboundedQueue) Enqueue(packet []byte, _ PacketPriority) bool {
+    q.mu.Lock()
+    q.packets = append(q.packets, packet)
+    q.peak = max(q.peak, len(q.packets))
+    q.mu.Unlock()
+    q.cond.Signal()
+    return true
+}
+
+func (q *unboundedQueue) Dequeue() ([]byte, error) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    for len(q.packets) == 0 && !q.closed {
+        q.cond.Wait()
+    }
+    if len(q.packets) == 0 {
+        return nil, ErrQueueClosed
+    }
+    packet := q.packets[0]
+    q.packets = q.packets[1:]
+    return packet, nil
+}
+
+func (q *unboundedQueue) drain() {
+    q.mu.Lock()
+    for len(q.packets) > 0 {
+        q.mu.Unlock()
+        time.Sleep(time.Millisecond)
+        q.mu.Lock()
+    }
+    q.closed = true
+    q.mu.Unlock()
+    q.cond.Broadcast()
+}
+
+type benchQueue interface {
+    Enqueue([]byte, PacketPriority) bool
+    Dequeue() ([]byte, error)
+}
+
+// A producer bursting faster than the consumer drains, with a handshake
+// every 100 packets. Reports how long handshakes waited and how far the
+// backlog grew.
+func BenchmarkPacketQueueSlowConsumer(b *testing.B) {
+    run := func(b *testing.B, q benchQueue, drain func() int) {
+        var handshakes, waited, delivered int64
+        done := make(chan struct{})
+        go func() {
+            defer close(done)
+            for {
+                packet, err := q.Dequeue()
+                if err != nil {
+                    return
+                }
+                delivered++
+                if packet[0] == 1 {
+                    handshakes++
+                    waited += time.Now().UnixNano() - int64(binary.BigEndian.Uint64(packet[8:]))
+                }
+                if delivered%16 == 0 {
+                    time.Sleep(20 * time.Microsecond) // the slow stream
+                }
+            }
+        }()
+        
+        start := time.Now()
+        for i := 0; i < b.N; i++ {
+            packet := wgPacket(4, 64)
+            if i%100 == 0 {
+                packet[0] = 1
+            }
+            binary.BigEndian.PutUint64(packet[8:], uint64(time.Now().UnixNano()))
+            q.Enqueue(packet, ClassifyPacket(packet))
+        }
+        peak := drain()
+        <-done
+        elapsed := time.Since(start)
+        
+        if handshakes > 0 {
+            b.ReportMetric(float64(waited/handshakes)/1e3, "handshake-µs")
+        }
+        b.ReportMetric(float64(delivered)/elapsed.Seconds(), "delivered/s")
+        b.ReportMetric(float64(peak), "peak-queued")
+    }
+    
+    b.Run("bounded", func(b *testing.B) {
+        q := NewPacketQueue(QueueConfig{Depth: 256})
+        run(b, q, func() int {
+            for q.Stats().Queued > 0 {
+                time.Sleep(time.Millisecond)
+            }
+            q.Close()
+            return q.Stats().HighWatermark
+        })
+    })
+    b.Run("unbounded", func(b *testing.B) {
+        q := &unboundedQueue{}
+        q.cond = sync.NewCond(&q.mu)
+        run(b, q, func() int {
+            q.drain()
+            return q.peak
+        })
+    })
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/binary"
+    "math"
+    mrand "math/rand/v2"
+    "sync"
+)
+
+const (
+    paddingLengthPrefix = 2  // original length ahead of the payload
+    paddingStep         = 16 // padded sizes are multiples of this
+    maxPaddingSpread    = 16 // size classes a peak size is spread over
+    
+    DefaultPaddingWindow = 256
+    DefaultMaxPaddedSize = 1420 // WireGuard's default MTU
+    
+    // Entropy of the padded size distribution worth aiming for, in bits.
+    // 3.5 bits is roughly a dozen equally likely sizes.
+    TargetConfusionScore = 3.5
+)
+
+// AdaptivePadder pads datagrams so their sizes stop giving the traffic
+// away. Fixed blocks only round sizes up, which an observer who knows the
+// block size can undo; this watches recent sizes and spreads the most
+// frequent ones over many size classes, filling whichever classes have been
+// used least, so the padded sizes come out close to uniform. Rare sizes get
+// little padding as they already blend in.
+type AdaptivePadder struct {
+    mu      sync.Mutex
+    maxSize int
+    in      *sizeWindow // recent payload sizes
+    out     *sizeWindow // recent padded sizes
+}
+
+// NewAdaptivePadder looks at the last window packets and never pads beyond
+// maxSize, which should stay under the path MTU
+func NewAdaptivePadder(window, maxSize int) *AdaptivePadder {
+    if window <= 0 {
+        window = DefaultPaddingWindow
+    }
+    if maxSize <= 0 {
+        maxSize = DefaultMaxPaddedSize
+    }
+    return &AdaptivePadder{
+        maxSize: maxSize,
+        in:      newSizeWindow(window),
+        out:     newSizeWindow(window),
+    }
+}
+
+// Pad returns the length-prefixed payload followed by random bytes
+func (p *AdaptivePadder) Pad(data []byte) []byte {
+    size := p.paddedSize(len(data))
+    
+    result := make([]byte, size)
+    binary.BigEndian.PutUint16(result, uint16(len(data)))
+    copy(result[paddingLengthPrefix:], data)
+    rand.Read(result[paddingLengthPrefix+len(data):])
+    return result
+}
+
+func (p *AdaptivePadder) paddedSize(n int) int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    
+    p.in.add(n)
+    minimum := n + paddingLengthPrefix
+    lowest := (minimum + paddingStep - 1) / paddingStep * paddingStep
+    if lowest > p.maxSize {
+        p.out.add(minimum)
+        return minimum
+    }
+    
+    // Spread in proportion to how close this size is to the peak
+    spread := int(math.Ceil(float64(maxPaddingSpread*p.in.count(n)) / float64(p.in.peak())))
+    
+    best, ties := lowest, 0
+    for i := 0; i < spread; i++ {
+        size := lowest + i*paddingStep
+        if size > p.maxSize {
+            break
+        }
+        switch {
+        case i == 0 || p.out.count(size) < p.out.count(best):
+            best, ties = size, 1
+        case p.out.count(size) == p.out.count(best):
+            // Pick uniformly among the least used
+            ties++
+            if mrand.IntN(ties) == 0 {
+                best = size
+            }
+        }
+    }
+    p.out.add(best)
+    return best
+}
+
+// Unpad recovers the payload from a padded packet
+func Unpad(data []byte) ([]byte, error) {
+    if len(data) < paddingLengthPrefix {
+        return nil, ErrBadObfuscatedRecord
+    }
+    n := int(binary.BigEndian.Uint16(data))
+    if n > len(data)-paddingLengthPrefix {
+        return nil, ErrBadObfuscatedRecord
+    }
+    return data[paddingLengthPrefix : paddingLengthPrefix+n], nil
+}
+
+// ConfusionScore of the recently sent padded sizes
+func (p *AdaptivePadder) ConfusionScore() float64 {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.out.entropy()
+}
+
+// ComputeConfusionScore is the Shannon entropy, in bits, of the packet size
+// distribution. An observer learns less from sizes the higher it is, see
+// TargetConfusionScore.
+func (ob *Obfuscator) ComputeConfusionScore(packets []int) float64 {
+    w := newSizeWindow(len(packets))
+    for _, size := range packets {
+        w.add(size)
+    }
+    return w.entropy()
+}
+
+// ObfuscationProfile summarizes what an observer gets to see
+type ObfuscationProfile struct {
+    Mode           ObfuscationMode
+    KeyID          uint8
+    Padding        bool
+    ConfusionScore float64 // of recent padded sizes, 0 without padding
+}
+
+// SetPadding pads datagrams before obfuscating them, nil turns it off.
+// Both ends must agree. Streams from Wrap are not padded.
+func (ob *Obfuscator) SetPadding(padder *AdaptivePadder) {
+    ob.padder.Store(padder)
+}
+
+// Profile reports the current mode, key and how well padding hides sizes
+func (ob *Obfuscator) Profile() ObfuscationProfile {
+    ob.keyMu.RLock()
+    profile := ObfuscationProfile{Mode: ob.mode, KeyID: ob.keyID}
+    ob.keyMu.RUnlock()
+    
+    if padder := ob.padder.Load(); padder != nil {
+        profile.Padding = true
+        profile.ConfusionScore = padder.ConfusionScore()
+    }
+    return profile
+}
+
+// sizeWindow counts the last len(sizes) packet sizes
+type sizeWindow struct {
+    sizes  []int
+    next   int
+    filled int
+    counts map[int]int
+}
+
+func newSizeWindow(n int) *sizeWindow {
+    return &sizeWindow{sizes: make([]int, n), counts: make(map[int]int)}
+}
+
+func (w *sizeWindow) add(size int) {
+    if len(w.sizes) == 0 {
+        return
+    }
+    if w.filled == len(w.sizes) {
+        old := w.sizes[w.next]
+        if w.counts[old]--; w.counts[old] == 0 {
+            delete(w.counts, old)
+        }
+    } else {
+        w.filled++
+    }
+    w.sizes[w.next] = size
+    w.next = (w.next + 1) % len(w.sizes)
+    w.counts[size]++
+}
+
+func (w *sizeWindow) count(size int) int {
+    return w.counts[size]
+}
+
+// Count of the most frequent size
+func (w *sizeWindow) peak() int {
+    peak := 0
+    for _, c := range w.counts {
+        if c > peak {
+            peak = c
+        }
+    }
+    return peak
+}
+
+func (w *sizeWindow) entropy() float64 {
+    var h float64
+    for _, c := range w.counts {
+        p := float64(c) / float64(w.filled)
+        h -= p * math.Log2(p)
+    }
+    return h
+}
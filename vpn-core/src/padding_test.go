@@ -0,0 +1,103 @@
+package main
+
+import (
+    "bytes"
+    "testing"
+)
+
+func TestComputeConfusionScore(t *testing.T) {
+    ob := NewObfuscator()
+    for _, tt := range []struct {
+        sizes []int
+        want  float64
+    }{
+        {nil, 0},
+        {[]int{100, 100, 100}, 0},
+        {[]int{10, 100, 10, 100}, 1},
+        {[]int{16, 32, 48, 64, 80, 96, 112, 128}, 3},
+    } {
+        if got := ob.ComputeConfusionScore(tt.sizes); got != tt.want {
+            t.Errorf("ComputeConfusionScore(%v) = %v, want %v", tt.sizes, got, tt.want)
+        }
+    }
+}
+
+func TestAdaptivePaddingFlattensSizes(t *testing.T) {
+    ob := NewObfuscator()
+    padder := NewAdaptivePadder(0, 0)
+    
+    var raw, padded []int
+    for i := 0; i < 2000; i++ {
+        size := 10
+        if i%2 == 1 {
+            size = 100
+        }
+        out := padder.Pad(make([]byte, size))
+        raw = append(raw, size)
+        padded = append(padded, len(out))
+    }
+    
+    if score := ob.ComputeConfusionScore(raw); score != 1 {
+        t.Fatalf("unpadded score %v, want 1 bit", score)
+    }
+    score := ob.ComputeConfusionScore(padded)
+    if score < TargetConfusionScore {
+        t.Fatalf("padded score %.2f bits, want at least %v", score, TargetConfusionScore)
+    }
+    
+    // Uniform-looking: no size class stands out
+    counts := make(map[int]int)
+    for _, size := range padded {
+        counts[size]++
+    }
+    low, high := len(padded), 0
+    for _, c := range counts {
+        low, high = min(low, c), max(high, c)
+    }
+    if high > 2*low {
+        t.Fatalf("size classes range from %d to %d packets: %v", low, high, counts)
+    }
+    if got := padder.ConfusionScore(); got < TargetConfusionScore {
+        t.Fatalf("padder reports %.2f bits", got)
+    }
+}
+
+func TestAdaptivePaddingRespectsMaxSize(t *testing.T) {
+    padder := NewAdaptivePadder(16, 128)
+    for i := 0; i < 100; i++ {
+        if n := len(padder.Pad(make([]byte, 100))); n > 128 || n < 102 {
+            t.Fatalf("padded to %d bytes", n)
+        }
+    }
+    // Too large to pad at all, only the length prefix is added
+    if n := len(padder.Pad(make([]byte, 200))); n != 202 {
+        t.Fatalf("oversized packet padded to %d bytes", n)
+    }
+}
+
+func TestPaddedObfuscationRoundTrip(t *testing.T) {
+    payload := []byte{0x04, 0x00, 0x00, 0x00, 0xde, 0xad, 0xbe, 0xef}
+    
+    for _, tt := range obfuscationModes[1:] {
+        sender, receiver := testObfuscator(tt.mode), testObfuscator(tt.mode)
+        sender.SetPadding(NewAdaptivePadder(0, 0))
+        receiver.SetPadding(NewAdaptivePadder(0, 0))
+        
+        for i := 0; i < 20; i++ {
+            got, err := receiver.DeobfuscatePacket(sender.ObfuscatePacket(payload))
+            if err != nil {
+                t.Fatalf("%s: %v", tt.name, err)
+            }
+            if !bytes.Equal(got, payload) {
+                t.Fatalf("%s: got %x, want %x", tt.name, got, payload)
+            }
+        }
+        if profile := sender.Profile(); !profile.Padding || profile.Mode != tt.mode || profile.ConfusionScore == 0 {
+            t.Errorf("%s: profile %+v", tt.name, profile)
+        }
+    }
+    
+    if _, err := Unpad([]byte{0x00, 0x09, 0x01}); err != ErrBadObfuscatedRecord {
+        t.Fatalf("err = %v, want ErrBadObfuscatedRecord", err)
+    }
+}
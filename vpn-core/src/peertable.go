@@ -0,0 +1,162 @@
+package main
+
+import (
+    "net"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// peerTable holds a device's peers in a slice, so the background loops
+// walking all of them stay on contiguous memory, indexed by the raw public
+// key. The zero value is empty and ready to use. Removing a peer moves the
+// last one into its place, so the order is arbitrary like a map's.
+type peerTable struct {
+    list  []*Peer
+    index map[wgtypes.Key]int
+}
+
+// The peer with key, nil if there is none
+func (t *peerTable) get(key wgtypes.Key) *Peer {
+    i, ok := t.index[key]
+    if !ok {
+        return nil
+    }
+    return t.list[i]
+}
+
+// Add peer, replacing one with the same key
+func (t *peerTable) put(peer *Peer) {
+    if i, ok := t.index[peer.PublicKey]; ok {
+        t.list[i] = peer
+        return
+    }
+    if t.index == nil {
+        t.index = make(map[wgtypes.Key]int)
+    }
+    t.index[peer.PublicKey] = len(t.list)
+    t.list = append(t.list, peer)
+}
+
+func (t *peerTable) remove(key wgtypes.Key) {
+    i, ok := t.index[key]
+    if !ok {
+        return
+    }
+    last := len(t.list) - 1
+    if i != last {
+        t.list[i] = t.list[last]
+        t.index[t.list[i].PublicKey] = i
+    }
+    t.list[last] = nil
+    t.list = t.list[:last]
+    delete(t.index, key)
+}
+
+func (t *peerTable) len() int {
+    return len(t.list)
+}
+
+// peerExtras are the fields few peers set, allocated only for those that
+// do. Most peers of a large gateway have no alternates, metadata, webhook,
+// annotations or port hopping, and pay one nil pointer for them.
+type peerExtras struct {
+    alternateEndpoints []net.UDPAddr
+    metadata           PeerMetadata
+    portHopping        PortHopping
+    portHop            portHopState
+    statsWebhook       string
+    endpointHost       string
+    endpointExpires    time.Time // when endpointHost is due for a lookup
+    turnConfig         *TURNConfig
+    turn               *TURNTransport
+    annotations        map[string]string
+    obfuscator         *Obfuscator // agreed in NegotiateCapabilities, see PeerObfuscator
+}
+
+// Read by peers without extras
+var noPeerExtras peerExtras
+
+func (peer *Peer) extras() *peerExtras {
+    if peer.extra == nil {
+        return &noPeerExtras
+    }
+    return peer.extra
+}
+
+// Take the rarely set fields of cfg, allocating extras only if one is set
+func (peer *Peer) setExtras(cfg PeerConfig) {
+    extra := peerExtras{
+        alternateEndpoints: cfg.AlternateEndpoints,
+        metadata:           cfg.Metadata,
+        portHopping:        cfg.PortHopping,
+        statsWebhook:       cfg.StatsWebhook,
+        endpointHost:       cfg.EndpointHost,
+        turnConfig:         cfg.TURNConfig,
+        annotations:        copyAnnotations(cfg.Annotations),
+    }
+    hopping := cfg.PortHopping
+    if len(extra.alternateEndpoints) == 0 && extra.metadata.empty() && extra.statsWebhook == "" && extra.endpointHost == "" && extra.turnConfig == nil && extra.annotations == nil &&
+        len(hopping.Ports) == 0 && hopping.Interval == 0 && hopping.MinThroughput == 0 && hopping.MinDwell == 0 {
+        peer.extra = nil
+        return
+    }
+    peer.extra = &extra
+}
+
+// AlternateEndpoints are tried in order when the peer fails
+func (peer *Peer) AlternateEndpoints() []net.UDPAddr {
+    return peer.extras().alternateEndpoints
+}
+
+func (peer *Peer) Metadata() PeerMetadata {
+    return peer.extras().metadata
+}
+
+func (peer *Peer) PortHopping() PortHopping {
+    return peer.extras().portHopping
+}
+
+// TURNConfig is the relay the peer is reached through, nil for direct UDP
+func (peer *Peer) TURNConfig() *TURNConfig {
+    return peer.extras().turnConfig
+}
+
+// Close the peer's TURN relay once it is replaced or removed
+func (peer *Peer) closeTURN() {
+    if peer.extra != nil && peer.extra.turn != nil {
+        peer.extra.turn.Close()
+        peer.extra.turn = nil
+    }
+}
+
+// Stop the peer's own obfuscator and wipe its keys once the peer is
+// replaced or removed
+func (peer *Peer) closeObfuscator() {
+    if peer.extra != nil && peer.extra.obfuscator != nil {
+        ob := peer.extra.obfuscator
+        ob.StopRotation()
+        ob.StopCover()
+        ob.Zeroize()
+        peer.extra.obfuscator = nil
+    }
+}
+
+// StatsWebhook overrides WebhookConfig.URL for this peer's statistics
+func (peer *Peer) StatsWebhook() string {
+    return peer.extras().statsWebhook
+}
+
+// IPv4 and IPv6 masks of every length, shared by all allowed IPs
+var (
+    ipv4Masks = cidrMasks(32)
+    ipv6Masks = cidrMasks(128)
+)
+
+func cidrMasks(bits int) []net.IPMask {
+    masks := make([]net.IPMask, bits+1)
+    for ones := range masks {
+        masks[ones] = net.CIDRMask(ones, bits)
+    }
+    return masks
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// uplinkInterface names the interface WireGuard traffic arrives on.
+// Tests replace it.
+var uplinkInterface = defaultRouteInterface
+
+// InputPinhole keeps UDP to our listen port open on hosts with a
+// default-deny input policy. Off unless VPNConfig.ManageInputPinhole is set.
+type InputPinhole struct {
+    mu    sync.Mutex
+    iface string
+    port  int
+    rules []string
+    
+    commands CommandRunner
+}
+
+// PinholeStatus is reported in Status
+type PinholeStatus struct {
+    Open      bool
+    Interface string
+    Port      int
+}
+
+func NewInputPinhole() *InputPinhole {
+    return &InputPinhole{}
+}
+
+func pinholeRules(iface string, port int) []string {
+    return []string{
+        fmt.Sprintf("iptables -I INPUT -i %s -p udp --dport %d -j ACCEPT", iface, port),
+        fmt.Sprintf("ip6tables -I INPUT -i %s -p udp --dport %d -j ACCEPT", iface, port),
+    }
+}
+
+// Open accepts UDP to port on iface, replacing any previous pinhole
+func (ph *InputPinhole) Open(iface string, port int) error {
+    ph.mu.Lock()
+    defer ph.mu.Unlock()
+    
+    return ph.openLocked(iface, port)
+}
+
+// Add the new rules before removing the old ones so there is never a
+// moment where the port is closed
+func (ph *InputPinhole) openLocked(iface string, port int) error {
+    var added []string
+    for _, rule := range pinholeRules(iface, port) {
+        if err := ph.commands.Run(rule); err != nil {
+            ph.commands.removeIPTablesRules(added)
+            return fmt.Errorf("failed to add rule %s: %w", rule, err)
+        }
+        added = append(added, rule)
+    }
+    
+    old := ph.rules
+    ph.rules = added
+    ph.iface = iface
+    ph.port = port
+    
+    if err := ph.commands.removeIPTablesRules(old); err != nil {
+        return fmt.Errorf("failed to remove old pinhole: %w", err)
+    }
+    return nil
+}
+
+// Move reopens the pinhole on a new port, e.g. after the listen port rotated
+func (ph *InputPinhole) Move(port int) error {
+    ph.mu.Lock()
+    defer ph.mu.Unlock()
+    
+    if ph.rules == nil {
+        return nil // not managing a pinhole
+    }
+    if port == ph.port {
+        return nil
+    }
+    return ph.openLocked(ph.iface, port)
+}
+
+func (ph *InputPinhole) Close() error {
+    ph.mu.Lock()
+    defer ph.mu.Unlock()
+    
+    err := ph.commands.removeIPTablesRules(ph.rules)
+    ph.rules = nil
+    ph.iface = ""
+    ph.port = 0
+    return err
+}
+
+func (ph *InputPinhole) Status() PinholeStatus {
+    ph.mu.Lock()
+    defer ph.mu.Unlock()
+    
+    return PinholeStatus{
+        Open:      ph.rules != nil,
+        Interface: ph.iface,
+        Port:      ph.port,
+    }
+}
+
+// Open the pinhole for the port the device actually listens on
+func (vpn *UnderTheRadarVPN) openPinhole() error {
+    iface, err := uplinkInterface()
+    if err != nil {
+        return fmt.Errorf("failed to find uplink interface: %w", err)
+    }
+    
+    port := vpn.listenPort
+    if port == 0 && vpn.planning != nil {
+        defer vpn.planning.assume("port 0 stands for the listen port the kernel picks")()
+    }
+    if port == 0 {
+        // Kernel picked the port
+        device, err := vpn.wgClient.Device(vpn.deviceName)
+        if err != nil {
+            return err
+        }
+        port = device.ListenPort
+    }
+    
+    return vpn.pinhole.Open(iface, port)
+}
+
+// SetListenPort moves the device to a new UDP port, taking the input
+// pinhole with it
+func (vpn *UnderTheRadarVPN) SetListenPort(port int) error {
+    vpn.mu.Lock()
+    defer vpn.mu.Unlock()
+    
+    // Open the new port first so incoming handshakes are never dropped
+    if err := vpn.pinhole.Move(port); err != nil {
+        return err
+    }
+    
+    cfg := wgtypes.Config{ListenPort: &port}
+    if err := vpn.wgClient.ConfigureDevice(vpn.deviceName, cfg); err != nil {
+        vpn.pinhole.Move(vpn.listenPort)
+        return fmt.Errorf("failed to change listen port: %w", err)
+    }
+    vpn.listenPort = port
+    
+    // The eBPF programs admit and steer to the listen port
+    return vpn.writeConntrackConfig()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+    "testing"
+)
+
+func fakeUplink(t *testing.T, iface string) {
+    orig := uplinkInterface
+    uplinkInterface = func() (string, error) { return iface, nil }
+    t.Cleanup(func() { uplinkInterface = orig })
+}
+
+func startForPinhole(t *testing.T, config VPNConfig) *UnderTheRadarVPN {
+    t.Helper()
+    
+    vpn := newTestVPN(t, newFakeWGClient())
+    vpn.healthCheck = NewHealthChecker(vpn)
+    vpn.failoverMgr = NewFailoverManager(vpn)
+    vpn.metrics = NewMetricsCollector(vpn)
+    t.Cleanup(vpn.healthCheck.Stop)
+    t.Cleanup(vpn.metrics.Stop)
+    
+    if err := vpn.Start(config); err != nil {
+        t.Fatal(err)
+    }
+    return vpn
+}
+
+func TestPinholeDisabledByDefault(t *testing.T) {
+    host := installFakeHost(t, "")
+    fakeUplink(t, "eth0")
+    
+    vpn := startForPinhole(t, VPNConfig{ListenPort: 51820})
+    
+    if len(host.rules) != 0 {
+        t.Fatalf("unexpected firewall rules: %v", host.rules)
+    }
+    if vpn.GetStatus().Pinhole.Open {
+        t.Fatal("pinhole reported open")
+    }
+}
+
+func TestPinholeFollowsListenPort(t *testing.T) {
+    host := installFakeHost(t, "")
+    fakeUplink(t, "eth0")
+    
+    vpn := startForPinhole(t, VPNConfig{ListenPort: 51820, ManageInputPinhole: true})
+    
+    want := "iptables INPUT -i eth0 -p udp --dport 51820 -j ACCEPT"
+    if host.rules[want] != 1 || len(host.rules) != 2 {
+        t.Fatalf("rules = %v, want IPv4 and IPv6 accepts for 51820", host.rules)
+    }
+    if st := vpn.GetStatus().Pinhole; !st.Open || st.Port != 51820 || st.Interface != "eth0" {
+        t.Fatalf("status = %+v", st)
+    }
+    
+    if err := vpn.SetListenPort(40000); err != nil {
+        t.Fatal(err)
+    }
+    if host.rules["iptables INPUT -i eth0 -p udp --dport 40000 -j ACCEPT"] != 1 || len(host.rules) != 2 {
+        t.Fatalf("rules after move = %v", host.rules)
+    }
+    if st := vpn.GetStatus(); st.Pinhole.Port != 40000 || st.ListenPort != 40000 {
+        t.Fatalf("status after move = %+v", st)
+    }
+    
+    if err := vpn.pinhole.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if len(host.rules) != 0 {
+        t.Fatalf("rules left after close: %v", host.rules)
+    }
+}
+
+func TestPinholeMoveKeepsOldOnFailure(t *testing.T) {
+    host := installFakeHost(t, "--dport 40000")
+    
+    ph := NewInputPinhole()
+    if err := ph.Open("eth0", 51820); err != nil {
+        t.Fatal(err)
+    }
+    if err := ph.Move(40000); err == nil {
+        t.Fatal("expected error")
+    }
+    
+    if host.rules["iptables INPUT -i eth0 -p udp --dport 51820 -j ACCEPT"] != 1 || len(host.rules) != 2 {
+        t.Fatalf("old pinhole disturbed: %v", host.rules)
+    }
+    if ph.Status().Port != 51820 {
+        t.Fatal("status should still show the old port")
+    }
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "sync"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var ErrPlanOutdated = errors.New("host changed since the plan was made")
+
+// ChangeKind groups planned changes by what they touch
+type ChangeKind int
+
+const (
+    ChangeCommand  ChangeKind = iota // any other command line
+    ChangeRule                       // iptables, ip6tables or nft
+    ChangeRoute                      // ip route and ip rule
+    ChangeSysctl                     // sysctl writes
+    ChangeDevice                     // links, addresses, qdiscs, WireGuard and eBPF
+    ChangeResolver                   // system DNS configuration
+    ChangeService                    // local servers and sockets
+)
+
+func (k ChangeKind) String() string {
+    switch k {
+    case ChangeRule:
+        return "rule"
+    case ChangeRoute:
+        return "route"
+    case ChangeSysctl:
+        return "sysctl"
+    case ChangeDevice:
+        return "device"
+    case ChangeResolver:
+        return "resolver"
+    case ChangeService:
+        return "service"
+    default:
+        return "command"
+    }
+}
+
+// PlannedChange is one change Start would make to the host
+type PlannedChange struct {
+    Kind        ChangeKind
+    Command     string // the command line, empty for changes made in-process
+    Description string // what an in-process change does, or where a command runs
+    
+    // What the change depends on that only running the earlier steps
+    // would tell, empty when it is certain
+    Condition   string
+}
+
+func (c PlannedChange) String() string {
+    line := c.Command
+    if line == "" {
+        line = c.Description
+    } else if c.Description != "" {
+        line += "  # " + c.Description
+    }
+    if c.Condition != "" {
+        return fmt.Sprintf("? %-8s %s  # if %s", c.Kind, line, c.Condition)
+    }
+    return fmt.Sprintf("+ %-8s %s", c.Kind, line)
+}
+
+// ChangePlan lists in order what Start would change for a configuration,
+// see PlanStart. ApplyPlan runs it.
+type ChangePlan struct {
+    Changes []PlannedChange
+    config  VPNConfig
+}
+
+// String prints the plan as a diff against the current host, conditional
+// changes marked with ?
+func (p *ChangePlan) String() string {
+    var b strings.Builder
+    for _, c := range p.Changes {
+        b.WriteString(c.String())
+        b.WriteByte('\n')
+    }
+    return b.String()
+}
+
+// changeRecorder collects changes instead of making them. Its run method
+// is the CommandRunner of the VPN PlanStart plans on.
+type changeRecorder struct {
+    mu          sync.Mutex
+    changes     []PlannedChange
+    assumptions []string
+}
+
+func (r *changeRecorder) run(cmdline string) error {
+    r.add(PlannedChange{Kind: commandKind(cmdline), Command: cmdline})
+    return nil
+}
+
+func (r *changeRecorder) note(kind ChangeKind, format string, args ...any) {
+    r.add(PlannedChange{Kind: kind, Description: fmt.Sprintf(format, args...)})
+}
+
+// Changes recorded until the returned function runs are conditional on
+// reason
+func (r *changeRecorder) assume(reason string) func() {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    
+    r.assumptions = append(r.assumptions, reason)
+    n := len(r.assumptions)
+    return func() {
+        r.mu.Lock()
+        defer r.mu.Unlock()
+        r.assumptions = r.assumptions[:n-1]
+    }
+}
+
+func (r *changeRecorder) add(c PlannedChange) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    
+    if len(r.assumptions) > 0 && c.Condition == "" {
+        c.Condition = strings.Join(r.assumptions, " and ")
+    }
+    r.changes = append(r.changes, c)
+}
+
+// Rules the kill switch would add inside a container's namespace
+func (r *changeRecorder) inNamespace(path string, rules []string) {
+    for _, rule := range rules {
+        r.add(PlannedChange{
+            Kind:        commandKind(rule),
+            Command:     rule,
+            Description: "in network namespace " + filepath.Base(path),
+            Condition:   "the container still runs",
+        })
+    }
+}
+
+func commandKind(cmdline string) ChangeKind {
+    fields := strings.Fields(cmdline)
+    if len(fields) == 0 {
+        return ChangeCommand
+    }
+    switch fields[0] {
+    case "iptables", "ip6tables", "nft":
+        return ChangeRule
+    case "sysctl":
+        return ChangeSysctl
+    case "tc":
+        return ChangeDevice
+    case "resolvectl", "resolvconf":
+        return ChangeResolver
+    case "ip":
+        // The object follows the options, e.g. ip -6 route
+        for _, f := range fields[1:] {
+            if strings.HasPrefix(f, "-") {
+                continue
+            }
+            switch f {
+            case "route", "rule":
+                return ChangeRoute
+            case "link", "addr", "address":
+                return ChangeDevice
+            }
+            return ChangeCommand
+        }
+    }
+    return ChangeCommand
+}
+
+// plannedWG reads the real devices and records configuration instead of
+// applying it. A device it configured and that doesn't exist yet reads
+// back as configured, so later steps see the device Start would create.
+type plannedWG struct {
+    real    wgController
+    plan    *changeRecorder
+    planned map[string]*wgtypes.Device
+}
+
+func (w *plannedWG) Device(name string) (*wgtypes.Device, error) {
+    device, err := w.real.Device(name)
+    if err != nil {
+        if planned, ok := w.planned[name]; ok {
+            return planned, nil
+        }
+    }
+    return device, err
+}
+
+func (w *plannedWG) ConfigureDevice(name string, cfg wgtypes.Config) error {
+    w.plan.note(ChangeDevice, "%s", describeWGConfig(name, cfg))
+    
+    planned, ok := w.planned[name]
+    if !ok {
+        planned = &wgtypes.Device{Name: name, Type: wgtypes.LinuxKernel}
+        w.planned[name] = planned
+    }
+    if cfg.ListenPort != nil {
+        planned.ListenPort = *cfg.ListenPort
+    }
+    if cfg.FirewallMark != nil {
+        planned.FirewallMark = *cfg.FirewallMark
+    }
+    return nil
+}
+
+func (w *plannedWG) Close() error {
+    return nil
+}
+
+// The configuration in wg set syntax, keys other than public ones left out
+func describeWGConfig(name string, cfg wgtypes.Config) string {
+    parts := []string{"wg set", name}
+    if cfg.ListenPort != nil {
+        parts = append(parts, fmt.Sprintf("listen-port %d", *cfg.ListenPort))
+    }
+    if cfg.PrivateKey != nil {
+        parts = append(parts, "private-key (secret)")
+    }
+    if cfg.FirewallMark != nil {
+        parts = append(parts, fmt.Sprintf("fwmark 0x%x", *cfg.FirewallMark))
+    }
+    if cfg.ReplacePeers {
+        parts = append(parts, "(replacing all peers)")
+    }
+    for _, peer := range cfg.Peers {
+        parts = append(parts, "peer", peer.PublicKey.String())
+        if peer.Remove {
+            parts = append(parts, "remove")
+            continue
+        }
+        if peer.PresharedKey != nil {
+            parts = append(parts, "preshared-key (secret)")
+        }
+        if peer.Endpoint != nil {
+            parts = append(parts, "endpoint", peer.Endpoint.String())
+        }
+        if peer.PersistentKeepaliveInterval != nil {
+            parts = append(parts, fmt.Sprintf("persistent-keepalive %d", int(peer.PersistentKeepaliveInterval.Seconds())))
+        }
+        if len(peer.AllowedIPs) > 0 {
+            ips := make([]string, len(peer.AllowedIPs))
+            for i, ip := range peer.AllowedIPs {
+                ips[i] = ip.String()
+            }
+            parts = append(parts, "allowed-ips", strings.Join(ips, ","))
+        }
+    }
+    return strings.Join(parts, " ")
+}
+
+// plannedEBPF records the attachment the real loader would make
+type plannedEBPF struct {
+    real EBPFLoader
+    plan *changeRecorder
+}
+
+func (l plannedEBPF) Load(*UnderTheRadarVPN) error {
+    return nil
+}
+
+func (l plannedEBPF) Attach(vpn *UnderTheRadarVPN) error {
+    if _, off := l.real.(NoEBPF); !off {
+        l.plan.note(ChangeDevice, "attach the eBPF programs to %s and the uplink", vpn.deviceName)
+    }
+    return nil
+}
+
+func (plannedEBPF) Detach(*UnderTheRadarVPN) {}
+func (plannedEBPF) Close(*UnderTheRadarVPN)  {}
+
+// PlanStart returns what Start would change on the host for config without
+// changing anything: firewall rules, routes, device and WireGuard
+// configuration, DNS and the local servers, in order. It runs Start's own
+// steps on a copy of the VPN whose commands and device configuration are
+// recorded. Changes that depend on the outcome of an earlier step, such as
+// a handshake probe or the listen port the kernel picks, are kept with a
+// Condition. Start with VPNConfig.DryRun set does the same.
+func (vpn *UnderTheRadarVPN) PlanStart(config VPNConfig) (*ChangePlan, error) {
+    rec := &changeRecorder{}
+    shadow, err := NewUnderTheRadarVPNWithOptions(VPNOptions{
+        DeviceName: vpn.deviceName,
+        WGClient:   &plannedWG{real: vpn.wgClient, plan: rec, planned: make(map[string]*wgtypes.Device)},
+        Commands:   rec.run,
+        EBPF:       plannedEBPF{real: vpn.loader(), plan: rec},
+        LockDir:    vpn.lockDir,
+        Clock:      vpn.clock(),
+    })
+    if err != nil {
+        return nil, err
+    }
+    shadow.planning = rec
+    shadow.killSwitch.plan = rec
+    shadow.dnsProtector.plan = rec
+    shadow.nft.plan = rec
+    defer shadow.obfuscator.Zeroize()
+    if config.PrivateKey == nil {
+        // The rest of the keys are the caller's
+        defer shadow.keys.Remove(deviceKeyName)
+    }
+    
+    var undo rollback
+    err = shadow.setupHost(context.Background(), config, &undo)
+    
+    plan := &ChangePlan{Changes: rec.changes, config: config}
+    vpn.mu.Lock()
+    vpn.plan = plan
+    vpn.mu.Unlock()
+    return plan, err
+}
+
+// Plan returns the plan of the last PlanStart or dry run Start, nil before
+// one
+func (vpn *UnderTheRadarVPN) Plan() *ChangePlan {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    return vpn.plan
+}
+
+// ApplyPlan starts the VPN with the configuration plan was made for, once
+// confirmed. The plan is made again first and Start only runs if nothing
+// changed, otherwise ErrPlanOutdated is returned and the host left alone.
+func (vpn *UnderTheRadarVPN) ApplyPlan(plan *ChangePlan) error {
+    fresh, err := vpn.PlanStart(plan.config)
+    if err != nil {
+        return fmt.Errorf("failed to plan start: %w", err)
+    }
+    if !reflect.DeepEqual(fresh.Changes, plan.Changes) {
+        return fmt.Errorf("%w: %s", ErrPlanOutdated, firstPlanDifference(plan.Changes, fresh.Changes))
+    }
+    
+    config := plan.config
+    config.DryRun = false
+    return vpn.Start(config)
+}
+
+func firstPlanDifference(old, fresh []PlannedChange) string {
+    for i := 0; i < len(old) && i < len(fresh); i++ {
+        if old[i] != fresh[i] {
+            return fmt.Sprintf("planned %q, now %q", old[i], fresh[i])
+        }
+    }
+    if len(old) > len(fresh) {
+        return fmt.Sprintf("%q no longer needed", old[len(fresh)])
+    }
+    return fmt.Sprintf("%q needed as well", fresh[len(old)])
+}
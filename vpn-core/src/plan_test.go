@@ -0,0 +1,126 @@
+package main
+
+import (
+    "errors"
+    "net"
+    "strings"
+    "testing"
+)
+
+func planConfig(t *testing.T) VPNConfig {
+    return VPNConfig{
+        ListenPort:         51820,
+        Addresses:          []net.IPNet{mustCIDR(t, "10.8.0.2/24")},
+        ManageInputPinhole: true,
+        KillSwitch:         true,
+        DNSProtection:      true,
+        DNSServers:         []string{"1.1.1.1"},
+        DNSResolver:        ResolverUnmanaged,
+        Peers: []PeerConfig{{
+            PublicKey:  mustKey(t).PublicKey(),
+            Endpoint:   &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 51820},
+            AllowedIPs: []net.IPNet{mustCIDR(t, "0.0.0.0/0")},
+        }},
+    }
+}
+
+func TestDryRunLeavesHostAlone(t *testing.T) {
+    fakeUplink(t, "eth0")
+    wg := newFakeWGClient()
+    vpn, host := newHostTestVPN(t, wg)
+    
+    config := planConfig(t)
+    config.DryRun = true
+    if err := vpn.Start(config); err != nil {
+        t.Fatal(err)
+    }
+    if len(host.rules) != 0 || len(host.links) != 0 || len(wg.configs) != 0 {
+        t.Fatalf("dry run changed the host: rules %v, links %v, %d device configs", host.rules, host.links, len(wg.configs))
+    }
+    
+    plan := vpn.Plan()
+    find := func(substr string) PlannedChange {
+        t.Helper()
+        for _, c := range plan.Changes {
+            if strings.Contains(c.Command+c.Description, substr) {
+                return c
+            }
+        }
+        t.Fatalf("no change with %q in\n%s", substr, plan)
+        return PlannedChange{}
+    }
+    if c := find("ip link add dev utr0 type wireguard"); c.Kind != ChangeDevice || c.Condition != "" {
+        t.Errorf("device creation planned as %+v", c)
+    }
+    if c := find("iptables -I INPUT -i eth0 -p udp --dport 51820 -j ACCEPT"); c.Kind != ChangeRule {
+        t.Errorf("pinhole planned as %+v", c)
+    }
+    find("iptables -A OUTPUT -o utr0 -j ACCEPT")
+    find("iptables -A OUTPUT -p udp --dport 53 -j DROP")
+    find("start the DoH proxy")
+    
+    // Whether the peer goes in depends on its probe
+    peer := find("peer " + config.Peers[0].PublicKey.String())
+    if !strings.Contains(peer.Condition, "203.0.113.1:51820 answers the handshake probe") {
+        t.Errorf("peer planned as %+v", peer)
+    }
+    if !strings.Contains(plan.String(), "? device   wg set utr0 peer") {
+        t.Errorf("conditional change not marked:\n%s", plan)
+    }
+}
+
+func TestApplyPlanRefusesChangedHost(t *testing.T) {
+    fakeUplink(t, "eth0")
+    vpn, host := newHostTestVPN(t, newFakeWGClient())
+    
+    config := planConfig(t)
+    config.DNSProtection = false
+    config.Peers[0].SkipProbe = true
+    plan, err := vpn.PlanStart(config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    // The pinhole would now go on another interface
+    fakeUplink(t, "eth1")
+    if err := vpn.ApplyPlan(plan); !errors.Is(err, ErrPlanOutdated) {
+        t.Fatalf("ApplyPlan = %v, want ErrPlanOutdated", err)
+    }
+    if len(host.rules) != 0 {
+        t.Fatalf("outdated plan applied: %v", host.rules)
+    }
+    
+    fakeUplink(t, "eth0")
+    if err := vpn.ApplyPlan(plan); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { vpn.Stop() })
+    for _, c := range plan.Changes {
+        if c.Kind == ChangeRule && host.rules[fakeRuleKey(c.Command)] == 0 {
+            t.Errorf("planned rule %q not applied", c.Command)
+        }
+    }
+}
+
+// The key installFakeHost tracks an added rule under
+func fakeRuleKey(rule string) string {
+    fields := strings.Fields(rule)
+    return fields[0] + " " + strings.Join(fields[2:], " ")
+}
+
+func TestCommandKind(t *testing.T) {
+    for cmdline, want := range map[string]ChangeKind{
+        "iptables -A OUTPUT -j DROP":                      ChangeRule,
+        "ip -6 route replace default via fe80::1 table 51": ChangeRoute,
+        "ip rule add fwmark 0x1 lookup 51":                ChangeRoute,
+        "ip addr add 10.8.0.2/24 dev utr0":                ChangeDevice,
+        "sysctl -w net.ipv4.ip_forward=1":                 ChangeSysctl,
+        "tc qdisc add dev utr0 clsact":                    ChangeDevice,
+        "resolvectl dns utr0 1.1.1.1":                     ChangeResolver,
+        "ip netns exec c1 true":                           ChangeCommand,
+    } {
+        if got := commandKind(cmdline); got != want {
+            t.Errorf("commandKind(%q) = %s, want %s", cmdline, got, want)
+        }
+    }
+}
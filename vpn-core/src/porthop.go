@@ -0,0 +1,217 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "sync"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Never hop more often than this, whatever the throughput says
+const defaultPortHopDwell = 10 * time.Second
+
+// PortHopping moves a peer's endpoint between equivalent server ports, for
+// ISPs that throttle long-lived UDP flows on a fixed 5-tuple. The server
+// must accept every port, see VPNConfig.HopPorts.
+type PortHopping struct {
+    Ports         []int         // equivalent server ports, see PortRange
+    Interval      time.Duration // hop on this schedule, 0 disables
+    MinThroughput uint64        // bytes/s, hop when a busy flow drops below it, 0 disables
+    MinDwell      time.Duration // minimum time on a port, default 10s
+}
+
+// PortRange lists the ports first to last inclusive
+func PortRange(first, last int) []int {
+    var ports []int
+    for p := first; p <= last; p++ {
+        ports = append(ports, p)
+    }
+    return ports
+}
+
+func (h PortHopping) enabled() bool {
+    return len(h.Ports) > 1 && (h.Interval > 0 || h.MinThroughput > 0)
+}
+
+func (h PortHopping) validate() error {
+    for _, p := range h.Ports {
+        if p <= 0 || p > 65535 {
+            return fmt.Errorf("invalid hop port %d", p)
+        }
+    }
+    return nil
+}
+
+func (h PortHopping) dwell() time.Duration {
+    if h.MinDwell > 0 {
+        return h.MinDwell
+    }
+    return defaultPortHopDwell
+}
+
+// portHopState is the per-peer bookkeeping between metric polls
+type portHopState struct {
+    mu        sync.Mutex
+    index     int       // position of the current port in Ports
+    since     time.Time // when we moved to it
+    lastBytes uint64
+    lastPoll  time.Time
+}
+
+// Why the endpoint should move now, empty to stay. Caller holds
+// peer.portHop.mu.
+func (vpn *UnderTheRadarVPN) portHopReason(peer *Peer, now time.Time) string {
+    cfg, st := peer.PortHopping(), &peer.extras().portHop
+    
+    bytes := peer.RxBytes.Load() + peer.TxBytes.Load()
+    var throughput uint64
+    polled := !st.lastPoll.IsZero()
+    if polled {
+        if elapsed := now.Sub(st.lastPoll).Seconds(); elapsed > 0 {
+            throughput = uint64(float64(bytes-min(bytes, st.lastBytes)) / elapsed)
+        }
+    }
+    st.lastBytes, st.lastPoll = bytes, now
+    
+    onPort := now.Sub(st.since)
+    if onPort < cfg.dwell() {
+        return ""
+    }
+    
+    if cfg.Interval > 0 && onPort >= cfg.Interval {
+        return "scheduled"
+    }
+    // An idle peer isn't throttled, only hop flows that carry traffic
+    if cfg.MinThroughput > 0 && polled && throughput > 0 && throughput < cfg.MinThroughput {
+        return fmt.Sprintf("throughput %d B/s below %d B/s", throughput, cfg.MinThroughput)
+    }
+    return ""
+}
+
+// Move the peer to its next hop port if the schedule or throughput calls
+// for it. The session survives since only the endpoint is updated.
+func (vpn *UnderTheRadarVPN) hopPortIfDue(peer *Peer, now time.Time) error {
+    if !peer.PortHopping().enabled() || peer.Endpoint == nil {
+        return nil
+    }
+    
+    st := &peer.extras().portHop
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    
+    // First poll, start the rotation from wherever the endpoint points
+    if st.since.IsZero() {
+        st.since = now
+        for i, port := range peer.PortHopping().Ports {
+            if port == peer.Endpoint.Port {
+                st.index = i
+            }
+        }
+    }
+    
+    reason := vpn.portHopReason(peer, now)
+    if reason == "" {
+        return nil
+    }
+    
+    next := (st.index + 1) % len(peer.PortHopping().Ports)
+    endpoint := &net.UDPAddr{IP: peer.Endpoint.IP, Port: peer.PortHopping().Ports[next], Zone: peer.Endpoint.Zone}
+    cfg := wgtypes.Config{
+        Peers: []wgtypes.PeerConfig{{
+            PublicKey:  peer.PublicKey,
+            Endpoint:   endpoint,
+            UpdateOnly: true,
+        }},
+    }
+    if err := vpn.wgClient.ConfigureDevice(vpn.deviceName, cfg); err != nil {
+        return fmt.Errorf("failed to hop endpoint port: %w", err)
+    }
+    
+    previous := peer.Endpoint.Port
+    peer.Endpoint = endpoint
+    st.index = next
+    st.since = now
+    peer.PortHops.Add(1)
+    
+    vpn.emitEvent(Event{
+        Type:      EventPortHop,
+        PublicKey: peer.PublicKey,
+        Message:   fmt.Sprintf("endpoint port %d -> %d (%s)", previous, endpoint.Port, reason),
+    })
+    return nil
+}
+
+// PortHopRedirect is the server side of port hopping: DNAT rules sending
+// the extra ports to the real listen port. Input filtering sees the
+// translated port, so the input pinhole needs no extra rules.
+type PortHopRedirect struct {
+    mu    sync.Mutex
+    rules []string
+    
+    commands CommandRunner
+}
+
+func NewPortHopRedirect() *PortHopRedirect {
+    return &PortHopRedirect{}
+}
+
+func portHopRules(iface string, ports []int, listenPort int) []string {
+    var rules []string
+    for _, port := range ports {
+        if port == listenPort {
+            continue
+        }
+        for _, bin := range []string{"iptables", "ip6tables"} {
+            rules = append(rules, fmt.Sprintf("%s -t nat -A PREROUTING -i %s -p udp --dport %d -j DNAT --to-destination :%d",
+                bin, iface, port, listenPort))
+        }
+    }
+    return rules
+}
+
+// Open redirects UDP arriving on iface for ports to listenPort, replacing
+// any previous set
+func (r *PortHopRedirect) Open(iface string, ports []int, listenPort int) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    
+    var added []string
+    for _, rule := range portHopRules(iface, ports, listenPort) {
+        if err := r.commands.Run(rule); err != nil {
+            r.commands.removeIPTablesRules(added)
+            return fmt.Errorf("failed to add rule %s: %w", rule, err)
+        }
+        added = append(added, rule)
+    }
+    
+    old := r.rules
+    r.rules = added
+    if err := r.commands.removeIPTablesRules(old); err != nil {
+        return fmt.Errorf("failed to remove old hop ports: %w", err)
+    }
+    return nil
+}
+
+// Close removes the redirects
+func (r *PortHopRedirect) Close() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    
+    err := r.commands.removeIPTablesRules(r.rules)
+    r.rules = nil
+    return err
+}
+
+// Accept the configured hop ports on the uplink
+func (vpn *UnderTheRadarVPN) openHopPorts(ports []int) error {
+    if err := (PortHopping{Ports: ports}).validate(); err != nil {
+        return err
+    }
+    iface, err := uplinkInterface()
+    if err != nil {
+        return fmt.Errorf("failed to find uplink interface: %w", err)
+    }
+    return vpn.hopRedirect.Open(iface, ports, vpn.listenPort)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+    "errors"
+    "net"
+    "testing"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func hoppingPeer(t *testing.T, vpn *UnderTheRadarVPN, hopping PortHopping) *Peer {
+    t.Helper()
+    peer := &Peer{
+        PublicKey: mustKey(t).PublicKey(),
+        Endpoint:  &net.UDPAddr{IP: net.ParseIP("203.0.113.10"), Port: 51821},
+    }
+    peer.setExtras(PeerConfig{PortHopping: hopping})
+    vpn.peers.put(peer)
+    return peer
+}
+
+func expectHopEvent(t *testing.T, vpn *UnderTheRadarVPN, peer *Peer) {
+    t.Helper()
+    select {
+    case ev := <-vpn.Events():
+        if ev.Type != EventPortHop || ev.PublicKey != peer.PublicKey {
+            t.Fatalf("unexpected event %+v", ev)
+        }
+    default:
+        t.Fatal("expected a port hop event")
+    }
+}
+
+func TestPortHoppingOnSchedule(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    peer := hoppingPeer(t, vpn, PortHopping{Ports: PortRange(51820, 51822), Interval: time.Minute})
+    start := time.Now()
+    
+    // The rotation starts from the configured endpoint
+    for _, at := range []time.Duration{0, 30 * time.Second} {
+        if err := vpn.hopPortIfDue(peer, start.Add(at)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if peer.Endpoint.Port != 51821 || len(wg.configs) != 0 {
+        t.Fatalf("hopped before the interval, endpoint %s", peer.Endpoint)
+    }
+    
+    if err := vpn.hopPortIfDue(peer, start.Add(61*time.Second)); err != nil {
+        t.Fatal(err)
+    }
+    if peer.Endpoint.Port != 51822 || !peer.Endpoint.IP.Equal(net.ParseIP("203.0.113.10")) {
+        t.Fatalf("endpoint = %s, want 203.0.113.10:51822", peer.Endpoint)
+    }
+    cfg := wg.configs[len(wg.configs)-1].Peers[0]
+    if !cfg.UpdateOnly || cfg.Endpoint.Port != 51822 || cfg.ReplaceAllowedIPs {
+        t.Fatalf("device update %+v must only move the endpoint", cfg)
+    }
+    expectHopEvent(t, vpn, peer)
+    
+    // Wraps around to the first port
+    if err := vpn.hopPortIfDue(peer, start.Add(122*time.Second)); err != nil {
+        t.Fatal(err)
+    }
+    if peer.Endpoint.Port != 51820 || peer.PortHops.Load() != 2 {
+        t.Fatalf("endpoint %s after %d hops, want 51820 after 2", peer.Endpoint, peer.PortHops.Load())
+    }
+}
+
+func TestPortHoppingOnLowThroughput(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    peer := hoppingPeer(t, vpn, PortHopping{Ports: []int{51821, 443}, MinThroughput: 1000})
+    start := time.Now()
+    
+    vpn.hopPortIfDue(peer, start)
+    
+    // Idle is not throttled
+    vpn.hopPortIfDue(peer, start.Add(20*time.Second))
+    if peer.PortHops.Load() != 0 {
+        t.Fatal("idle peer hopped")
+    }
+    
+    // 500 B/s over the next 20s
+    peer.RxBytes.Store(10000)
+    if err := vpn.hopPortIfDue(peer, start.Add(40*time.Second)); err != nil {
+        t.Fatal(err)
+    }
+    if peer.Endpoint.Port != 443 || peer.PortHops.Load() != 1 {
+        t.Fatalf("endpoint %s, want a hop to 443", peer.Endpoint)
+    }
+    expectHopEvent(t, vpn, peer)
+    
+    // Slow again but still within the dwell time
+    peer.RxBytes.Store(10500)
+    vpn.hopPortIfDue(peer, start.Add(45*time.Second))
+    if peer.PortHops.Load() != 1 {
+        t.Fatal("hopped again before MinDwell")
+    }
+}
+
+func TestCollectMetricsHopsPorts(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    peer := hoppingPeer(t, vpn, PortHopping{Ports: []int{51821, 51822}, Interval: time.Nanosecond, MinDwell: time.Nanosecond})
+    wg.setPeer("utr0", wgtypes.Peer{PublicKey: peer.PublicKey})
+    
+    vpn.collectMetrics()
+    time.Sleep(time.Millisecond)
+    vpn.collectMetrics()
+    
+    if peer.PortHops.Load() != 1 {
+        t.Fatalf("%d hops after two polls, want 1", peer.PortHops.Load())
+    }
+    dev, _ := wg.Device("utr0")
+    if dev.Peers[0].Endpoint == nil || dev.Peers[0].Endpoint.Port != 51822 {
+        t.Fatalf("device endpoint = %v, want port 51822", dev.Peers[0].Endpoint)
+    }
+}
+
+func TestHopPortsRedirectToListenPort(t *testing.T) {
+    host := installFakeHost(t, "")
+    fakeUplink(t, "eth0")
+    
+    vpn := startForPinhole(t, VPNConfig{ListenPort: 51820, HopPorts: []int{51820, 443, 4500}})
+    
+    for _, port := range []string{"443", "4500"} {
+        for _, bin := range []string{"iptables", "ip6tables"} {
+            rule := bin + " nat PREROUTING -i eth0 -p udp --dport " + port + " -j DNAT --to-destination :51820"
+            if host.rules[rule] != 1 {
+                t.Fatalf("missing %q in %v", rule, host.rules)
+            }
+        }
+    }
+    if len(host.rules) != 4 {
+        t.Fatalf("rules = %v, the listen port itself needs no redirect", host.rules)
+    }
+    
+    vpn.hopRedirect.Close()
+    if len(host.rules) != 0 {
+        t.Fatalf("rules left after Close: %v", host.rules)
+    }
+}
+
+func TestHopPortsNeedListenPort(t *testing.T) {
+    host := installFakeHost(t, "")
+    fakeUplink(t, "eth0")
+    
+    // The kernel's pick isn't known when the redirects would be made
+    vpn := newTestVPN(t, newFakeWGClient())
+    if err := vpn.Start(VPNConfig{HopPorts: []int{5000}}); !errors.Is(err, ErrHopPortsNeedPort) {
+        t.Fatalf("err = %v, want ErrHopPortsNeedPort", err)
+    }
+    if len(host.rules) != 0 {
+        t.Fatalf("rules = %v", host.rules)
+    }
+}
+
+func TestStopRemovesHopPorts(t *testing.T) {
+    fakeUplink(t, "eth0")
+    vpn, log := newSimulatedVPN(t, newFakeWGClient())
+    
+    if err := vpn.Start(VPNConfig{ListenPort: 51820, HopPorts: []int{443}}); err != nil {
+        t.Fatal(err)
+    }
+    if err := vpn.Stop(); err != nil {
+        t.Fatal(err)
+    }
+    if !log.contains("iptables -t nat -D PREROUTING -i eth0 -p udp --dport 443") {
+        t.Fatalf("redirect not removed by Stop: %v", log.commands)
+    }
+}
+
+func TestHopPortsRollBackOnFailure(t *testing.T) {
+    host := installFakeHost(t, "--dport 4500")
+    fakeUplink(t, "eth0")
+    
+    vpn := newTestVPN(t, newFakeWGClient())
+    if err := vpn.Start(VPNConfig{ListenPort: 51820, HopPorts: []int{443, 4500}}); err == nil {
+        t.Fatal("Start succeeded with a failing redirect")
+    }
+    if len(host.rules) != 0 {
+        t.Fatalf("rules left after failed start: %v", host.rules)
+    }
+}
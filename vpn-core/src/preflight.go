@@ -0,0 +1,188 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    "os"
+    "os/exec"
+    "strconv"
+    "strings"
+    
+    "github.com/cilium/ebpf"
+    "github.com/cilium/ebpf/features"
+)
+
+const capNetAdmin = 12
+
+// Check is the outcome of a single host requirement probe
+type Check struct {
+    Name        string
+    OK          bool
+    Detail      string
+    Remediation string // what to do when OK is false
+}
+
+// Preflight reports whether this host can run the VPN on our device
+func (vpn *UnderTheRadarVPN) Preflight() []Check {
+    return RunPreflight(vpn.deviceName)
+}
+
+// RunPreflight probes the host without touching any system state, so it
+// can be used before NewUnderTheRadarVPN (which itself needs privileges)
+func RunPreflight(deviceName string) []Check {
+    return []Check{
+        checkPrivileges(),
+        checkWireGuard(),
+        checkEBPF(),
+        checkFirewall(),
+        checkIPForwarding(),
+        checkDeviceFree(deviceName),
+    }
+}
+
+func checkPrivileges() Check {
+    check := Check{
+        Name:        "privileges",
+        Remediation: "run as root or grant CAP_NET_ADMIN (setcap cap_net_admin+ep <binary>)",
+    }
+    
+    if os.Geteuid() == 0 {
+        check.OK = true
+        check.Detail = "running as root"
+        return check
+    }
+    
+    caps, err := effectiveCapabilities()
+    if err != nil {
+        check.Detail = fmt.Sprintf("failed to read capabilities: %v", err)
+        return check
+    }
+    check.OK = caps&(1<<capNetAdmin) != 0
+    check.Detail = fmt.Sprintf("CapEff=%016x", caps)
+    return check
+}
+
+// Read the effective capability set of this process
+func effectiveCapabilities() (uint64, error) {
+    f, err := os.Open("/proc/self/status")
+    if err != nil {
+        return 0, err
+    }
+    defer f.Close()
+    
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := scanner.Text()
+        if strings.HasPrefix(line, "CapEff:") {
+            return strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+        }
+    }
+    return 0, fmt.Errorf("CapEff not found")
+}
+
+func checkWireGuard() Check {
+    check := Check{
+        Name:        "wireguard",
+        Remediation: "load the kernel module (modprobe wireguard) or install wireguard-go",
+    }
+    
+    if _, err := os.Stat("/sys/module/wireguard"); err == nil {
+        check.OK = true
+        check.Detail = "kernel module loaded"
+        return check
+    }
+    if path, err := exec.LookPath("wireguard-go"); err == nil {
+        check.OK = true
+        check.Detail = "userspace implementation at " + path
+        return check
+    }
+    
+    check.Detail = "neither kernel module nor wireguard-go found"
+    return check
+}
+
+func checkEBPF() Check {
+    check := Check{
+        Name:        "ebpf",
+        Remediation: "use a kernel with BPF and XDP support (5.15+ recommended) and mount bpffs at /sys/fs/bpf",
+    }
+    
+    if err := features.HaveProgramType(ebpf.XDP); err != nil {
+        check.Detail = fmt.Sprintf("XDP unavailable: %v", err)
+        return check
+    }
+    if err := features.HaveProgramType(ebpf.SchedCLS); err != nil {
+        check.Detail = fmt.Sprintf("TC classifier unavailable: %v", err)
+        return check
+    }
+    
+    check.OK = true
+    check.Detail = "XDP and TC programs supported"
+    return check
+}
+
+func checkFirewall() Check {
+    check := Check{
+        Name:        "firewall",
+        Remediation: "install iptables (or the iptables-nft compatibility layer)",
+    }
+    
+    _, iptErr := exec.LookPath("iptables")
+    _, nftErr := exec.LookPath("nft")
+    
+    switch {
+    case iptErr == nil && nftErr == nil:
+        check.OK = true
+        check.Detail = "iptables and nftables available"
+    case iptErr == nil:
+        check.OK = true
+        check.Detail = "iptables available"
+    case nftErr == nil:
+        check.Detail = "only nftables found, set FirewallBackend to FirewallNFTables"
+    default:
+        check.Detail = "no iptables or nftables binary found"
+    }
+    
+    return check
+}
+
+func checkIPForwarding() Check {
+    check := Check{
+        Name:        "ip-forwarding",
+        Remediation: "run with write access to /proc/sys/net/ipv4/ip_forward (not a read-only /proc in containers)",
+    }
+    
+    f, err := os.OpenFile("/proc/sys/net/ipv4/ip_forward", os.O_WRONLY, 0)
+    if err != nil {
+        check.Detail = fmt.Sprintf("cannot modify ip_forward: %v", err)
+        return check
+    }
+    f.Close()
+    
+    check.OK = true
+    check.Detail = "ip_forward is writable"
+    return check
+}
+
+func checkDeviceFree(deviceName string) Check {
+    check := Check{
+        Name:        "device-name",
+        Remediation: fmt.Sprintf("remove the existing interface (ip link del %s) or choose another device name", deviceName),
+    }
+    
+    if deviceName == "" {
+        check.Detail = "no device name configured"
+        check.Remediation = "pass a device name such as utr0"
+        return check
+    }
+    
+    if _, err := net.InterfaceByName(deviceName); err == nil {
+        check.Detail = fmt.Sprintf("interface %s already exists", deviceName)
+        return check
+    }
+    
+    check.OK = true
+    check.Detail = fmt.Sprintf("%s is free", deviceName)
+    return check
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestPreflightReportsEveryCheck(t *testing.T) {
+    checks := RunPreflight("utr-preflight0")
+    
+    want := []string{"privileges", "wireguard", "ebpf", "firewall", "ip-forwarding", "device-name"}
+    if len(checks) != len(want) {
+        t.Fatalf("got %d checks, want %d", len(checks), len(want))
+    }
+    
+    for i, check := range checks {
+        if check.Name != want[i] {
+            t.Errorf("check %d is %q, want %q", i, check.Name, want[i])
+        }
+        if !check.OK && check.Remediation == "" {
+            t.Errorf("failed check %q has no remediation hint", check.Name)
+        }
+    }
+}
+
+func TestCheckDeviceFree(t *testing.T) {
+    if check := checkDeviceFree("lo"); check.OK {
+        t.Fatal("loopback should be reported as taken")
+    }
+    if check := checkDeviceFree("utr-preflight0"); !check.OK {
+        t.Fatalf("unused name reported as taken: %s", check.Detail)
+    }
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "net"
+    "sort"
+    "sync"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// A flow nobody routed for this long loses its pin
+const flowPinIdle = 2 * time.Minute
+
+// PeerUpdate changes settings of a running peer, nil fields are left alone
+type PeerUpdate struct {
+    Priority *int
+}
+
+// UpdatePeer changes a peer in place. Routing is re-evaluated for new flows
+// while established ones stay on the peer they started on, see routeFlow;
+// prefix ownership follows once they go idle.
+func (vpn *UnderTheRadarVPN) UpdatePeer(pubKey wgtypes.Key, update PeerUpdate) error {
+    vpn.mu.Lock()
+    defer vpn.mu.Unlock()
+    
+    peer := vpn.peers.get(pubKey)
+    if peer == nil {
+        return fmt.Errorf("%w: %s", ErrPeerNotFound, pubKey)
+    }
+    if update.Priority != nil {
+        peer.Priority = *update.Priority
+    }
+    return vpn.rebalanceAllowedIPsLocked()
+}
+
+// Whether a should carry traffic rather than b. A peer recovering from a
+// failure yields to any other, then the higher Priority and the lower load
+// win. The public key breaks ties so the choice is stable.
+func preferPeer(a, b *Peer) bool {
+    if af, bf := a.failing.Load(), b.failing.Load(); af != bf {
+        return bf
+    }
+    if a.Priority != b.Priority {
+        return a.Priority > b.Priority
+    }
+    if al, bl := a.LoadScore.Load(), b.LoadScore.Load(); al != bl {
+        return al < bl
+    }
+    return bytes.Compare(a.PublicKey[:], b.PublicKey[:]) < 0
+}
+
+// Whether a should take a prefix b owns under AllowedIPByPriority. Unlike
+// preferPeer load doesn't count and ties stay put, so prefixes only move
+// when the order really changes. A draining peer never takes one over.
+func outranks(a, b *Peer) bool {
+    if ad, bd := a.draining.Load(), b.draining.Load(); ad != bd {
+        return bd
+    }
+    if af, bf := a.failing.Load(), b.failing.Load(); af != bf {
+        return bf
+    }
+    return a.Priority > b.Priority
+}
+
+func (peer *Peer) routes(ip net.IP) bool {
+    for _, allowedIP := range peer.AllowedIPs {
+        if allowedIP.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// Prefixes the peer owns and those it waits for
+func (peer *Peer) claimedIPs() []net.IPNet {
+    if len(peer.standbyIPs) == 0 {
+        return peer.AllowedIPs
+    }
+    return append(append([]net.IPNet(nil), peer.AllowedIPs...), peer.standbyIPs...)
+}
+
+// Split prefixes into those nobody else owns and the contested ones
+func splitClaims(prefixes []net.IPNet, claims []allowedIPClaim) (owned, standby []net.IPNet) {
+    contested := make(map[string]bool, len(claims))
+    for _, claim := range claims {
+        contested[claim.prefix] = true
+    }
+    for _, prefix := range prefixes {
+        if contested[prefixKey(prefix)] {
+            standby = append(standby, prefix)
+        } else {
+            owned = append(owned, prefix)
+        }
+    }
+    return owned, standby
+}
+
+// Hand each contested prefix to the claimant that outranks its owner. A
+// prefix stays while flows pinned to a healthy owner still use it. Caller
+// holds vpn.mu.
+func (vpn *UnderTheRadarVPN) rebalanceAllowedIPsLocked() error {
+    var claimants []*Peer
+    for _, peer := range vpn.peers.list {
+        if len(peer.standbyIPs) > 0 {
+            claimants = append(claimants, peer)
+        }
+    }
+    if len(claimants) == 0 {
+        return nil
+    }
+    sort.Slice(claimants, func(i, j int) bool {
+        return claimants[i].PublicKey.String() < claimants[j].PublicKey.String()
+    })
+    
+    // Best claimant per prefix
+    best := make(map[string]*Peer)
+    var prefixes []net.IPNet
+    for _, peer := range claimants {
+        for _, prefix := range peer.standbyIPs {
+            pk := prefixKey(prefix)
+            current, ok := best[pk]
+            if !ok {
+                prefixes = append(prefixes, prefix)
+            }
+            if !ok || outranks(peer, current) {
+                best[pk] = peer
+            }
+        }
+    }
+    
+    now := vpn.clock().Now()
+    for _, prefix := range prefixes {
+        pk := prefixKey(prefix)
+        to := best[pk]
+        owner := vpn.prefixOwnerLocked(pk)
+        if owner != nil {
+            if !outranks(to, owner) {
+                continue
+            }
+            healthy := owner.IsAlive.Load() && !owner.failing.Load()
+            if healthy && vpn.flowPins.using(owner.PublicKey, prefix, now) {
+                continue
+            }
+        }
+        if err := vpn.moveAllowedIPLocked(prefix, owner, to); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Move prefix from its owner, nil if nobody has it, to a claimant on
+// standby. The kernel drops it from the owner itself. Caller holds vpn.mu.
+func (vpn *UnderTheRadarVPN) moveAllowedIPLocked(prefix net.IPNet, owner, to *Peer) error {
+    pk := prefixKey(prefix)
+    allowedIPs := append(append([]net.IPNet(nil), to.AllowedIPs...), prefix)
+    
+    cfg := wgtypes.Config{
+        Peers: []wgtypes.PeerConfig{{
+            PublicKey:         to.PublicKey,
+            UpdateOnly:        true,
+            ReplaceAllowedIPs: true,
+            AllowedIPs:        allowedIPs,
+        }},
+    }
+    if err := vpn.wgClient.ConfigureDevice(vpn.deviceName, cfg); err != nil {
+        return fmt.Errorf("failed to move %s to peer %s: %w", pk, to.PublicKey, err)
+    }
+    
+    if owner != nil {
+        vpn.reassignAllowedIPsLocked(to, []allowedIPClaim{{prefix: pk, owner: owner}})
+        owner.standbyIPs = append(append([]net.IPNet(nil), owner.standbyIPs...), prefix)
+        vpn.indexPrefixLocked(prefix, owner)
+    }
+    var standby []net.IPNet
+    for _, p := range to.standbyIPs {
+        if prefixKey(p) != pk {
+            standby = append(standby, p)
+        }
+    }
+    to.standbyIPs = standby
+    to.AllowedIPs = allowedIPs
+    vpn.indexPrefixLocked(prefix, to)
+    vpn.countAllowedIPsLocked(to, allowedIPs)
+    return nil
+}
+
+// flowPins keeps each flow on the peer it started on, see routeFlow
+type flowPins struct {
+    mu        sync.Mutex
+    pins      map[flowKey]*flowPin
+    lastSweep time.Time
+}
+
+type flowKey struct {
+    src, dst         [net.IPv6len]byte
+    proto            uint8
+    srcPort, dstPort uint16
+}
+
+type flowPin struct {
+    peer     wgtypes.Key // zero until the flow is routed
+    dst      net.IP
+    lastSeen time.Time
+    
+    decision Decision // of the classifiers, see steerFlow
+    decided  bool
+}
+
+func (f Flow) key() flowKey {
+    k := flowKey{proto: f.Proto, srcPort: f.SrcPort, dstPort: f.DstPort}
+    copy(k.src[:], f.SrcIP.To16())
+    copy(k.dst[:], f.DstIP.To16())
+    return k
+}
+
+// The flow's peer if it is still live and routes the destination
+func (fp *flowPins) lookup(vpn *UnderTheRadarVPN, flow Flow, now time.Time) *Peer {
+    fp.mu.Lock()
+    defer fp.mu.Unlock()
+    
+    pin, ok := fp.pins[flow.key()]
+    if !ok || now.Sub(pin.lastSeen) > flowPinIdle {
+        return nil
+    }
+    peer := vpn.peers.get(pin.peer)
+    if peer == nil || !peer.IsAlive.Load() || peer.failing.Load() || !peer.routes(flow.DstIP) {
+        return nil
+    }
+    pin.lastSeen = now
+    return peer
+}
+
+func (fp *flowPins) pin(flow Flow, peer *Peer, now time.Time) {
+    fp.mu.Lock()
+    defer fp.mu.Unlock()
+    
+    pin := fp.entryLocked(flow, now)
+    pin.peer = peer.PublicKey
+}
+
+// The classifiers' decision for the flow, if it is still live
+func (fp *flowPins) decision(flow Flow, now time.Time) (Decision, bool) {
+    fp.mu.Lock()
+    defer fp.mu.Unlock()
+    
+    pin, ok := fp.pins[flow.key()]
+    if !ok || !pin.decided || now.Sub(pin.lastSeen) > flowPinIdle {
+        return DecisionNone, false
+    }
+    pin.lastSeen = now
+    return pin.decision, true
+}
+
+func (fp *flowPins) decide(flow Flow, decision Decision, now time.Time) {
+    fp.mu.Lock()
+    defer fp.mu.Unlock()
+    
+    pin := fp.entryLocked(flow, now)
+    pin.decision, pin.decided = decision, true
+}
+
+// The flow's entry, fresh if there is none or it went idle
+func (fp *flowPins) entryLocked(flow Flow, now time.Time) *flowPin {
+    if fp.pins == nil {
+        fp.pins = make(map[flowKey]*flowPin)
+    }
+    if now.Sub(fp.lastSweep) > flowPinIdle {
+        for key, pin := range fp.pins {
+            if now.Sub(pin.lastSeen) > flowPinIdle {
+                delete(fp.pins, key)
+            }
+        }
+        fp.lastSweep = now
+    }
+    
+    key := flow.key()
+    pin, ok := fp.pins[key]
+    if !ok || now.Sub(pin.lastSeen) > flowPinIdle {
+        pin = &flowPin{}
+        fp.pins[key] = pin
+    }
+    pin.dst, pin.lastSeen = flow.DstIP, now
+    return pin
+}
+
+// How many active flows are pinned to peer
+func (fp *flowPins) active(peer wgtypes.Key, now time.Time) int {
+    fp.mu.Lock()
+    defer fp.mu.Unlock()
+    
+    n := 0
+    for _, pin := range fp.pins {
+        if pin.peer == peer && now.Sub(pin.lastSeen) <= flowPinIdle {
+            n++
+        }
+    }
+    return n
+}
+
+// Drop the pins of a removed peer, their flows route afresh
+func (fp *flowPins) forget(peer wgtypes.Key) {
+    fp.mu.Lock()
+    defer fp.mu.Unlock()
+    
+    for key, pin := range fp.pins {
+        if pin.peer == peer {
+            delete(fp.pins, key)
+        }
+    }
+}
+
+// Whether an active flow on peer goes to prefix
+func (fp *flowPins) using(peer wgtypes.Key, prefix net.IPNet, now time.Time) bool {
+    fp.mu.Lock()
+    defer fp.mu.Unlock()
+    
+    for _, pin := range fp.pins {
+        if pin.peer == peer && now.Sub(pin.lastSeen) <= flowPinIdle && prefix.Contains(pin.dst) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+    "context"
+    "net"
+    "testing"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestPriorityFailoverAndFailback(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    vpn.allowedIPConflicts = AllowedIPByPriority
+    vpn.healthCheck = NewHealthChecker(vpn)
+    fm := NewFailoverManager(vpn)
+    defer fm.events.Stop()
+    
+    // Three peers claiming the same prefix, each on its own link. The
+    // lowest priority is added first so the others have to win it.
+    prefix := mustCIDR(t, "10.8.0.0/24")
+    names := []string{"low", "mid", "high"}
+    keys := make(map[string]wgtypes.Key)
+    links := make(map[string]*flappingHealth)
+    for i, name := range names {
+        keys[name] = mustKey(t).PublicKey()
+        links[name] = &flappingHealth{}
+        links[name].healthy.Store(true)
+        vpn.healthCheck.SetStrategy(name, links[name])
+        pc := PeerConfig{PublicKey: keys[name], AllowedIPs: []net.IPNet{prefix}, Priority: 10 * (i + 1), Group: name}
+        if err := vpn.AddPeer(pc); err != nil {
+            t.Fatal(err)
+        }
+    }
+    
+    check := func() {
+        vpn.healthCheck.checkAll()
+        fm.checkPeers(context.Background())
+    }
+    expect := func(want string) {
+        t.Helper()
+        if owner, ok := wg.allowedIPOwner("utr0", "10.8.0.0/24"); !ok || owner != keys[want] {
+            t.Fatalf("kernel routes the prefix to %v, want %s", owner, want)
+        }
+        if got := vpn.routePacket(net.ParseIP("10.8.0.9")); got == nil || got.PublicKey != keys[want] {
+            t.Fatalf("routePacket chose %v, want %s", got, want)
+        }
+    }
+    
+    check()
+    expect("high")
+    
+    // Failures walk down the priorities
+    links["high"].healthy.Store(false)
+    check()
+    expect("mid")
+    links["mid"].healthy.Store(false)
+    check()
+    expect("low")
+    
+    // A recovered peer only takes over after RecoveryChecks healthy checks
+    links["mid"].healthy.Store(true)
+    for i := 0; i < DefaultRecoveryChecks-1; i++ {
+        check()
+        expect("low")
+    }
+    check()
+    expect("mid")
+    
+    links["high"].healthy.Store(true)
+    for i := 0; i < DefaultRecoveryChecks; i++ {
+        check()
+    }
+    expect("high")
+    
+    // The lowest priority peer fails and recovers without moving anything
+    links["low"].healthy.Store(false)
+    check()
+    expect("high")
+    links["low"].healthy.Store(true)
+    for i := 0; i < DefaultRecoveryChecks; i++ {
+        check()
+    }
+    expect("high")
+    
+    // Every peer keeps its claim
+    for _, name := range names {
+        if claimed := vpn.peers.get(keys[name]).claimedIPs(); len(claimed) != 1 || prefixKey(claimed[0]) != "10.8.0.0/24" {
+            t.Errorf("%s claims %v", name, claimed)
+        }
+    }
+}
+
+func TestRoutePacketPrefersPriority(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    
+    add := func(cidr string, priority int, load uint64) *Peer {
+        peer := &Peer{PublicKey: mustKey(t).PublicKey(), AllowedIPs: []net.IPNet{mustCIDR(t, cidr)}, Priority: priority}
+        peer.IsAlive.Store(true)
+        peer.LoadScore.Store(load)
+        vpn.storePeerLocked(peer)
+        return peer
+    }
+    primary := add("0.0.0.0/0", 20, 900)
+    backup := add("10.0.0.0/8", 10, 5)
+    dst := net.ParseIP("10.1.2.3")
+    
+    if got := vpn.routePacket(dst); got != primary {
+        t.Fatal("priority should win over load")
+    }
+    
+    // A failing peer ranks below every healthy one, whatever its priority
+    primary.failing.Store(true)
+    if got := vpn.routePacket(dst); got != backup {
+        t.Fatal("expected the healthy backup")
+    }
+    primary.failing.Store(false)
+    
+    // Load still decides between equal priorities
+    backup.Priority = 20
+    if got := vpn.routePacket(dst); got != backup {
+        t.Fatal("expected the less loaded of equal priorities")
+    }
+}
+
+func TestUpdatePeerPriorityKeepsFlows(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    vpn.allowedIPConflicts = AllowedIPByPriority
+    clock := NewFakeClock(time.Now())
+    vpn.timeSource = clock
+    
+    // Overlapping prefixes: a full tunnel and a peer for one subnet, plus a
+    // prefix both claim
+    shared := mustCIDR(t, "10.9.0.0/24")
+    wide := PeerConfig{PublicKey: mustKey(t).PublicKey(), AllowedIPs: []net.IPNet{mustCIDR(t, "0.0.0.0/0"), shared}, Priority: 20}
+    narrow := PeerConfig{PublicKey: mustKey(t).PublicKey(), AllowedIPs: []net.IPNet{mustCIDR(t, "10.0.0.0/8"), shared}, Priority: 10}
+    for _, pc := range []PeerConfig{wide, narrow} {
+        if err := vpn.AddPeer(pc); err != nil {
+            t.Fatal(err)
+        }
+        vpn.peers.get(pc.PublicKey).IsAlive.Store(true)
+    }
+    
+    flow := Flow{SrcIP: net.IPv4(10, 100, 0, 2), DstIP: net.IPv4(10, 1, 0, 1), Proto: 6, SrcPort: 40000, DstPort: 443}
+    sharedFlow := Flow{SrcIP: net.IPv4(10, 100, 0, 2), DstIP: net.IPv4(10, 9, 0, 1), Proto: 6, SrcPort: 40001, DstPort: 443}
+    for _, f := range []Flow{flow, sharedFlow} {
+        if peer, _ := vpn.routeFlow(f); peer == nil || peer.PublicKey != wide.PublicKey {
+            t.Fatalf("flow to %s should start on the higher priority peer", f.DstIP)
+        }
+    }
+    
+    raised := 30
+    if err := vpn.UpdatePeer(narrow.PublicKey, PeerUpdate{Priority: &raised}); err != nil {
+        t.Fatal(err)
+    }
+    
+    // Established flows stay put, new ones follow the new priority
+    for _, f := range []Flow{flow, sharedFlow} {
+        if peer, _ := vpn.routeFlow(f); peer == nil || peer.PublicKey != wide.PublicKey {
+            t.Fatalf("flow to %s moved after the priority change", f.DstIP)
+        }
+    }
+    fresh := flow
+    fresh.SrcPort = 40002
+    if peer, _ := vpn.routeFlow(fresh); peer == nil || peer.PublicKey != narrow.PublicKey {
+        t.Fatal("new flow should use the raised peer")
+    }
+    
+    // The shared prefix waits for its flow to go idle
+    if owner, _ := wg.allowedIPOwner("utr0", "10.9.0.0/24"); owner != wide.PublicKey {
+        t.Fatal("prefix moved under an active flow")
+    }
+    clock.Advance(2 * flowPinIdle)
+    if err := vpn.UpdatePeer(narrow.PublicKey, PeerUpdate{}); err != nil {
+        t.Fatal(err)
+    }
+    if owner, _ := wg.allowedIPOwner("utr0", "10.9.0.0/24"); owner != narrow.PublicKey {
+        t.Fatal("prefix should follow priority once idle")
+    }
+    if peer, _ := vpn.routeFlow(sharedFlow); peer == nil || peer.PublicKey != narrow.PublicKey {
+        t.Fatal("idle flow should be routed afresh")
+    }
+    
+    if err := vpn.UpdatePeer(mustKey(t).PublicKey(), PeerUpdate{Priority: &raised}); err == nil {
+        t.Fatal("expected an error for an unknown peer")
+    }
+}
+
+func TestAutoPriorityDemotesSlowPeer(t *testing.T) {
+    vpn := newTestVPN(t, newFakeWGClient())
+    clock := NewFakeClock(time.Now())
+    vpn.timeSource = clock
+    
+    add := func(cidr string, priority int, auto bool) *Peer {
+        peer := &Peer{PublicKey: mustKey(t).PublicKey(), AllowedIPs: []net.IPNet{mustCIDR(t, cidr)}, Priority: priority, AutoPriority: auto}
+        peer.IsAlive.Store(true)
+        vpn.storePeerLocked(peer)
+        return peer
+    }
+    fast := add("0.0.0.0/0", 90, true)
+    backup := add("10.0.0.0/8", 60, false)
+    dst := net.ParseIP("10.1.2.3")
+    adjuster := newPriorityAdjuster(vpn)
+    
+    // The explicit priority holds until the first measured interval
+    fast.CurrentLatency.Store(20000)
+    adjuster.adjust()
+    if fast.Priority != 90 {
+        t.Fatalf("initial priority replaced with %d", fast.Priority)
+    }
+    clock.Advance(autoPriorityInterval)
+    adjuster.adjust()
+    if fast.Priority != 96 || vpn.routePacket(dst) != fast {
+        t.Fatalf("healthy peer at %d", fast.Priority)
+    }
+    
+    // Latency climbs to 300ms and the EWMA follows over a few rounds
+    fast.CurrentLatency.Store(300000)
+    last := fast.Priority
+    for i := 0; i < 10; i++ {
+        clock.Advance(autoPriorityInterval)
+        adjuster.adjust()
+        if fast.Priority > last {
+            t.Fatalf("priority rose to %d while latency stayed high", fast.Priority)
+        }
+        last = fast.Priority
+    }
+    if fast.Priority >= backup.Priority || backup.Priority != 60 {
+        t.Fatalf("slow peer at %d, backup at %d", fast.Priority, backup.Priority)
+    }
+    if vpn.routePacket(dst) != backup {
+        t.Fatal("traffic should move to the previously lower priority peer")
+    }
+}
+
+func TestAutoPrioritySparesThroughput(t *testing.T) {
+    w := DefaultPriorityWeights
+    if idle, busy := w.priority(10, 0, 1), w.priority(10, 0, 0.25); idle <= busy {
+        t.Fatalf("idle %d, busy %d", idle, busy)
+    }
+    if got := w.priority(0, 4, 0); got != 80 {
+        t.Fatalf("4%% loss gives %d", got)
+    }
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash"
+    "net"
+    "time"
+    
+    "golang.org/x/crypto/blake2s"
+    "golang.org/x/crypto/chacha20poly1305"
+    "golang.org/x/crypto/curve25519"
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var ErrEndpointUnreachable = errors.New("endpoint did not answer a handshake")
+
+// WireGuard message layout, see the protocol paper section 5.4
+const (
+    wgInitiationType  = 1
+    wgResponseType    = 2
+    wgCookieReplyType = 3
+    
+    wgInitiationSize  = 148
+    wgResponseSize    = 92
+    wgCookieReplySize = 64
+    wgMACOffset       = 116 // mac1 covers everything before it
+    
+    noiseConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+    wgIdentifier      = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+    wgLabelMAC1       = "mac1----"
+    
+    tai64Base = 0x400000000000000a
+)
+
+func blakeHash(parts ...[]byte) [blake2s.Size]byte {
+    h, _ := blake2s.New256(nil)
+    for _, p := range parts {
+        h.Write(p)
+    }
+    var sum [blake2s.Size]byte
+    h.Sum(sum[:0])
+    return sum
+}
+
+func blakeHMAC(key []byte, parts ...[]byte) [blake2s.Size]byte {
+    mac := hmac.New(func() hash.Hash {
+        h, _ := blake2s.New256(nil)
+        return h
+    }, key)
+    for _, p := range parts {
+        mac.Write(p)
+    }
+    var sum [blake2s.Size]byte
+    mac.Sum(sum[:0])
+    return sum
+}
+
+// HKDF with BLAKE2s, returning the chaining key and one derived key
+func noiseKDF2(chainKey, input []byte) (next, key [blake2s.Size]byte) {
+    prk := blakeHMAC(chainKey, input)
+    defer wipe(prk[:])
+    next = blakeHMAC(prk[:], []byte{0x1})
+    key = blakeHMAC(prk[:], next[:], []byte{0x2})
+    return next, key
+}
+
+func noiseSeal(key [blake2s.Size]byte, plaintext, hash []byte) []byte {
+    aead, _ := chacha20poly1305.New(key[:])
+    var nonce [chacha20poly1305.NonceSize]byte
+    return aead.Seal(nil, nonce[:], plaintext, hash)
+}
+
+// Build a handshake initiation from our static key to the responder's
+// public key. Returns the message and the sender index a reply echoes.
+func handshakeInitiation(static *Secret, responder wgtypes.Key) ([]byte, uint32, error) {
+    ephemeral, err := wgtypes.GeneratePrivateKey()
+    if err != nil {
+        return nil, 0, err
+    }
+    defer wipe(ephemeral[:])
+    ephemeralPub := ephemeral.PublicKey()
+    
+    var index [4]byte
+    if _, err := rand.Read(index[:]); err != nil {
+        return nil, 0, err
+    }
+    
+    chainKey := blakeHash([]byte(noiseConstruction))
+    h := blakeHash(chainKey[:], []byte(wgIdentifier))
+    h = blakeHash(h[:], responder[:])
+    
+    msg := make([]byte, wgInitiationSize)
+    msg[0] = wgInitiationType
+    copy(msg[4:8], index[:])
+    copy(msg[8:40], ephemeralPub[:])
+    
+    prk := blakeHMAC(chainKey[:], ephemeralPub[:])
+    chainKey = blakeHMAC(prk[:], []byte{0x1})
+    h = blakeHash(h[:], ephemeralPub[:])
+    
+    // es: encrypt our static public key
+    es, err := curve25519.X25519(ephemeral[:], responder[:])
+    if err != nil {
+        return nil, 0, err
+    }
+    defer wipe(es)
+    var key [blake2s.Size]byte
+    chainKey, key = noiseKDF2(chainKey[:], es)
+    staticPub := static.PublicKey()
+    sealed := noiseSeal(key, staticPub[:], h[:])
+    copy(msg[40:88], sealed)
+    h = blakeHash(h[:], sealed)
+    
+    // ss: encrypt the timestamp the responder uses against replays
+    staticKey := static.Key()
+    defer wipe(staticKey[:])
+    ss, err := curve25519.X25519(staticKey[:], responder[:])
+    if err != nil {
+        return nil, 0, err
+    }
+    defer wipe(ss)
+    chainKey, key = noiseKDF2(chainKey[:], ss)
+    defer wipe(chainKey[:])
+    defer wipe(key[:])
+    copy(msg[88:116], noiseSeal(key, tai64n(time.Now()), h[:]))
+    
+    // mac1 lets the responder drop garbage cheaply, mac2 stays zero
+    // unless it sent us a cookie
+    macKey := blakeHash([]byte(wgLabelMAC1), responder[:])
+    mac, _ := blake2s.New128(macKey[:])
+    mac.Write(msg[:wgMACOffset])
+    mac.Sum(msg[wgMACOffset:wgMACOffset])
+    
+    return msg, binary.LittleEndian.Uint32(index[:]), nil
+}
+
+func tai64n(t time.Time) []byte {
+    var stamp [12]byte
+    binary.BigEndian.PutUint64(stamp[:8], tai64Base+uint64(t.Unix()))
+    binary.BigEndian.PutUint32(stamp[8:], uint32(t.Nanosecond()))
+    return stamp[:]
+}
+
+// A response or, from a responder under load, a cookie reply, addressed
+// to our sender index
+func isHandshakeReply(reply []byte, index uint32) bool {
+    switch {
+    case len(reply) == wgResponseSize && reply[0] == wgResponseType:
+        return binary.LittleEndian.Uint32(reply[8:12]) == index
+    case len(reply) == wgCookieReplySize && reply[0] == wgCookieReplyType:
+        return binary.LittleEndian.Uint32(reply[4:8]) == index
+    }
+    return false
+}
+
+func (vpn *UnderTheRadarVPN) handshakeProbeTimeout() time.Duration {
+    if vpn.probeTimeout > 0 {
+        return vpn.probeTimeout
+    }
+    return HandshakeTimeout
+}
+
+// ProbeEndpoint sends a WireGuard handshake initiation to endpoint as the
+// device, for the peer with pubKey, and waits up to timeout for it to
+// answer. The peer only answers if it knows our public key. The probe runs
+// from its own socket, so the device's sessions are not touched.
+func (vpn *UnderTheRadarVPN) ProbeEndpoint(endpoint *net.UDPAddr, pubKey wgtypes.Key, timeout time.Duration) error {
+    return vpn.ProbeEndpointContext(context.Background(), endpoint, pubKey, timeout)
+}
+
+// ProbeEndpointContext is ProbeEndpoint giving up once ctx is done,
+// returning ctx's error
+func (vpn *UnderTheRadarVPN) ProbeEndpointContext(ctx context.Context, endpoint *net.UDPAddr, pubKey wgtypes.Key, timeout time.Duration) error {
+    static := vpn.privateKey()
+    if static == nil {
+        return fmt.Errorf("no device key to probe with")
+    }
+    msg, index, err := handshakeInitiation(static, pubKey)
+    if err != nil {
+        return fmt.Errorf("failed to build handshake: %w", err)
+    }
+    
+    dialer := net.Dialer{Control: vpn.socketControl()}
+    conn, err := dialer.DialContext(ctx, "udp", endpoint.String())
+    if err != nil {
+        return fmt.Errorf("%w: %s: %v", ErrEndpointUnreachable, endpoint, err)
+    }
+    defer conn.Close()
+    
+    conn.SetDeadline(time.Now().Add(timeout))
+    // Cut the read short, ctx's error is what the caller sees
+    stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+    defer stop()
+    if _, err := conn.Write(msg); err != nil {
+        return fmt.Errorf("%w: %s: %v", ErrEndpointUnreachable, endpoint, err)
+    }
+    
+    buf := make([]byte, 1500)
+    for {
+        n, err := conn.Read(buf)
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+        if err != nil {
+            return fmt.Errorf("%w: %s: %v", ErrEndpointUnreachable, endpoint, err)
+        }
+        if isHandshakeReply(buf[:n], index) {
+            return nil
+        }
+    }
+}
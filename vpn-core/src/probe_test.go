@@ -0,0 +1,166 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "net"
+    "testing"
+    "time"
+    
+    "golang.org/x/crypto/blake2s"
+    "golang.org/x/crypto/chacha20poly1305"
+    "golang.org/x/crypto/curve25519"
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Check an initiation the way a WireGuard responder does: mac1, then
+// decrypt the initiator's static key
+func openInitiation(responder wgtypes.Key, msg []byte) (wgtypes.Key, error) {
+    var initiator wgtypes.Key
+    if len(msg) != wgInitiationSize || msg[0] != wgInitiationType {
+        return initiator, fmt.Errorf("not an initiation: %d bytes, type %d", len(msg), msg[0])
+    }
+    public := responder.PublicKey()
+    
+    macKey := blakeHash([]byte(wgLabelMAC1), public[:])
+    mac, _ := blake2s.New128(macKey[:])
+    mac.Write(msg[:wgMACOffset])
+    if !bytes.Equal(mac.Sum(nil), msg[wgMACOffset:wgMACOffset+16]) {
+        return initiator, fmt.Errorf("mac1 does not verify")
+    }
+    
+    chainKey := blakeHash([]byte(noiseConstruction))
+    h := blakeHash(chainKey[:], []byte(wgIdentifier))
+    h = blakeHash(h[:], public[:])
+    ephemeral := msg[8:40]
+    prk := blakeHMAC(chainKey[:], ephemeral)
+    chainKey = blakeHMAC(prk[:], []byte{0x1})
+    h = blakeHash(h[:], ephemeral)
+    
+    es, err := curve25519.X25519(responder[:], ephemeral)
+    if err != nil {
+        return initiator, err
+    }
+    _, key := noiseKDF2(chainKey[:], es)
+    aead, _ := chacha20poly1305.New(key[:])
+    var nonce [chacha20poly1305.NonceSize]byte
+    static, err := aead.Open(nil, nonce[:], msg[40:88], h[:])
+    if err != nil {
+        return initiator, fmt.Errorf("static key does not decrypt: %w", err)
+    }
+    copy(initiator[:], static)
+    return initiator, nil
+}
+
+// UDP server standing in for a peer. A responding one checks each
+// initiation and answers with a handshake response.
+func fakePeerEndpoint(t *testing.T, responder wgtypes.Key, respond bool) (*net.UDPAddr, <-chan wgtypes.Key) {
+    t.Helper()
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    
+    initiators := make(chan wgtypes.Key, 4)
+    go func() {
+        buf := make([]byte, 1500)
+        for {
+            n, from, err := conn.ReadFromUDP(buf)
+            if err != nil {
+                return
+            }
+            initiator, err := openInitiation(responder, buf[:n])
+            if err != nil {
+                t.Error(err)
+                continue
+            }
+            initiators <- initiator
+            if !respond {
+                continue
+            }
+            reply := make([]byte, wgResponseSize)
+            reply[0] = wgResponseType
+            binary.LittleEndian.PutUint32(reply[4:8], 7)
+            copy(reply[8:12], buf[4:8]) // the initiator's sender index
+            conn.WriteToUDP(reply, from)
+        }
+    }()
+    return conn.LocalAddr().(*net.UDPAddr), initiators
+}
+
+func probingVPN(t *testing.T) (*UnderTheRadarVPN, *fakeWGClient, wgtypes.Key) {
+    t.Helper()
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    device := mustKey(t)
+    vpn.keys.Put(deviceKeyName, SecretFromKey(device))
+    vpn.probeTimeout = 200 * time.Millisecond
+    return vpn, wg, device
+}
+
+func TestProbeEndpointHandshake(t *testing.T) {
+    vpn, _, device := probingVPN(t)
+    peerKey := mustKey(t)
+    endpoint, initiators := fakePeerEndpoint(t, peerKey, true)
+    
+    if err := vpn.ProbeEndpoint(endpoint, peerKey.PublicKey(), time.Second); err != nil {
+        t.Fatal(err)
+    }
+    if got := <-initiators; got != device.PublicKey() {
+        t.Fatalf("initiation from %s, want the device key %s", got, device.PublicKey())
+    }
+}
+
+func TestAddPeerProbesEndpoint(t *testing.T) {
+    vpn, wg, _ := probingVPN(t)
+    
+    peerKey := mustKey(t)
+    endpoint, _ := fakePeerEndpoint(t, peerKey, true)
+    if err := vpn.AddPeer(PeerConfig{PublicKey: peerKey.PublicKey(), Endpoint: endpoint}); err != nil {
+        t.Fatal(err)
+    }
+    
+    silent := mustKey(t)
+    endpoint, initiators := fakePeerEndpoint(t, silent, false)
+    err := vpn.AddPeer(PeerConfig{PublicKey: silent.PublicKey(), Endpoint: endpoint})
+    if !errors.Is(err, ErrEndpointUnreachable) {
+        t.Fatalf("err = %v, want ErrEndpointUnreachable", err)
+    }
+    <-initiators
+    if exists := vpn.peers.get(silent.PublicKey()) != nil; exists || len(wg.configs) != 1 {
+        t.Fatal("unreachable peer was added to the device")
+    }
+    
+    // Roaming peers can opt out
+    if err := vpn.AddPeer(PeerConfig{PublicKey: silent.PublicKey(), Endpoint: endpoint, SkipProbe: true}); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestAddPeerContextCancelsProbe(t *testing.T) {
+    vpn, wg, _ := probingVPN(t)
+    vpn.probeTimeout = time.Minute
+    
+    silent := mustKey(t)
+    endpoint, initiators := fakePeerEndpoint(t, silent, false)
+    ctx, cancel := context.WithCancel(context.Background())
+    go func() {
+        <-initiators
+        cancel()
+    }()
+    start := time.Now()
+    err := vpn.AddPeerContext(ctx, PeerConfig{PublicKey: silent.PublicKey(), Endpoint: endpoint})
+    if !errors.Is(err, context.Canceled) {
+        t.Fatalf("err = %v, want context.Canceled", err)
+    }
+    if elapsed := time.Since(start); elapsed > 5*time.Second {
+        t.Fatalf("probe ran %v past the cancel", elapsed)
+    }
+    if len(wg.configs) != 0 {
+        t.Fatal("cancelled peer was added to the device")
+    }
+}
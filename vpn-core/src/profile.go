@@ -0,0 +1,37 @@
+package main
+
+import (
+    "context"
+    "runtime/pprof"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// What a goroutine does for the datapath, its "phase" pprof label
+const (
+    PhaseRouting     = "routing"     // moving a peer's packets, e.g. a TURN relay
+    PhaseEncryption  = "encryption"
+    PhaseObfuscation = "obfuscation" // the stream transport, its rotation and cover traffic
+)
+
+// ShortKey is the start of a public key, enough to tell peers apart in a
+// profile
+func ShortKey(key wgtypes.Key) string {
+    return key.String()[:8]
+}
+
+// Run f labelled with the peer and phase, so CPU profiles attribute its
+// samples: `go tool pprof -tagfocus peer=...`. Goroutines f starts carry
+// the labels too.
+func withPeerLabels(key wgtypes.Key, phase string, f func()) {
+    pprof.Do(context.Background(), pprof.Labels("peer", ShortKey(key), "phase", phase), func(context.Context) {
+        f()
+    })
+}
+
+// withPeerLabels for goroutines that serve every peer
+func withPhaseLabel(phase string, f func()) {
+    pprof.Do(context.Background(), pprof.Labels("phase", phase), func(context.Context) {
+        f()
+    })
+}
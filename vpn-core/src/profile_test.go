@@ -0,0 +1,32 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "runtime/pprof"
+    "strings"
+    "testing"
+)
+
+func TestPeerLabelsReachGoroutines(t *testing.T) {
+    key := mustKey(t).PublicKey()
+    started, release := make(chan struct{}), make(chan struct{})
+    defer close(release)
+    withPeerLabels(key, PhaseRouting, func() {
+        go func() {
+            close(started)
+            <-release
+        }()
+    })
+    <-started
+    
+    var dump bytes.Buffer
+    if err := pprof.Lookup("goroutine").WriteTo(&dump, 1); err != nil {
+        t.Fatal(err)
+    }
+    for _, want := range []string{fmt.Sprintf(`"peer":"%s"`, ShortKey(key)), `"phase":"routing"`} {
+        if !strings.Contains(dump.String(), want) {
+            t.Fatalf("no goroutine labelled %s", want)
+        }
+    }
+}
@@ -0,0 +1,716 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    socksVersion     = 0x05
+    socksAuthNone    = 0x00
+    socksAuthUserPwd = 0x02
+    socksAuthNoMatch = 0xff
+    
+    socksCmdConnect   = 0x01
+    socksCmdAssociate = 0x03
+    
+    socksAddrIPv4   = 0x01
+    socksAddrDomain = 0x03
+    socksAddrIPv6   = 0x04
+    
+    socksSucceeded        = 0x00
+    socksGeneralFailure   = 0x01
+    socksHostUnreachable  = 0x04
+    socksCmdNotSupported  = 0x07
+    socksAddrNotSupported = 0x08
+    
+    proxyHandshakeTimeout = 10 * time.Second
+    proxyDialTimeout      = 15 * time.Second
+    maxUDPDatagram        = 65535
+)
+
+var errSocksAuth = errors.New("SOCKS5 authentication failed")
+
+// ProxyConfig enables local proxies forwarding connections into the tunnel,
+// for apps that can't be routed through it or for sharing it with the LAN.
+// Empty listen addresses leave the proxy off.
+type ProxyConfig struct {
+    SOCKSAddr string  // e.g. 127.0.0.1:1080, UDP ASSOCIATE relays listen on the same IP
+    HTTPAddr  string  // HTTP CONNECT, e.g. 127.0.0.1:8080
+    Username  string
+    Password  *Secret // both set to require authentication
+    SourceIP  net.IP  // tunnel address to originate from, optional
+}
+
+func (c ProxyConfig) enabled() bool {
+    return c.SOCKSAddr != "" || c.HTTPAddr != ""
+}
+
+func (c ProxyConfig) requireAuth() bool {
+    return c.Username != "" && c.Password != nil
+}
+
+// Constant time so the password can't be guessed byte by byte
+func (c ProxyConfig) checkCredentials(user, password string) bool {
+    if !c.requireAuth() {
+        return true
+    }
+    userOK := subtle.ConstantTimeCompare([]byte(user), []byte(c.Username))
+    pwdOK := subtle.ConstantTimeCompare([]byte(password), c.Password.Bytes())
+    return userOK&pwdOK == 1
+}
+
+// ProxyDialer opens the outbound side of proxied connections
+type ProxyDialer interface {
+    DialContext(ctx context.Context, network, address string) (net.Conn, error)
+    ListenPacket(ctx context.Context) (net.PacketConn, error)
+}
+
+// tunnelDialer originates connections from the tunnel device, so they take
+// the tunnel whatever the routing table says
+type tunnelDialer struct {
+    device string
+    source net.IP
+}
+
+func (d tunnelDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+    dialer := net.Dialer{Control: bindToDevice(d.device)}
+    if d.source != nil {
+        if strings.HasPrefix(network, "udp") {
+            dialer.LocalAddr = &net.UDPAddr{IP: d.source}
+        } else {
+            dialer.LocalAddr = &net.TCPAddr{IP: d.source}
+        }
+    }
+    return dialer.DialContext(ctx, network, address)
+}
+
+func (d tunnelDialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+    lc := net.ListenConfig{Control: bindToDevice(d.device)}
+    addr := ":0"
+    if d.source != nil {
+        addr = net.JoinHostPort(d.source.String(), "0")
+    }
+    return lc.ListenPacket(ctx, "udp", addr)
+}
+
+// ProxyStats are the traffic counters of one proxy listener
+type ProxyStats struct {
+    Kind        string // "socks5" or "http"
+    Addr        string
+    Connections uint64 // accepted since start
+    Active      int64
+    RxBytes     uint64 // from the tunnel to clients
+    TxBytes     uint64 // from clients into the tunnel
+}
+
+type proxyCounters struct {
+    connections atomic.Uint64
+    active      atomic.Int64
+    rx          atomic.Uint64
+    tx          atomic.Uint64
+}
+
+// countingWriter adds everything written through it to a counter
+type countingWriter struct {
+    w io.Writer
+    n *atomic.Uint64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+    n, err := cw.w.Write(p)
+    cw.n.Add(uint64(n))
+    return n, err
+}
+
+// ProxyServer runs the SOCKS5 and HTTP CONNECT proxies
+type ProxyServer struct {
+    cfg    ProxyConfig
+    dialer ProxyDialer
+    
+    mu        sync.Mutex
+    listeners map[string]net.Listener // by kind
+    conns     map[io.Closer]struct{}
+    closed    bool
+    wg        sync.WaitGroup
+    
+    counters map[string]*proxyCounters
+}
+
+func NewProxyServer(cfg ProxyConfig, dialer ProxyDialer) *ProxyServer {
+    return &ProxyServer{
+        cfg:       cfg,
+        dialer:    dialer,
+        listeners: make(map[string]net.Listener),
+        conns:     make(map[io.Closer]struct{}),
+        counters: map[string]*proxyCounters{
+            "socks5": {},
+            "http":   {},
+        },
+    }
+}
+
+// Start listens on the configured addresses and serves until Close
+func (ps *ProxyServer) Start() error {
+    servers := []struct {
+        kind   string
+        addr   string
+        handle func(net.Conn, *proxyCounters)
+    }{
+        {"socks5", ps.cfg.SOCKSAddr, ps.serveSOCKS},
+        {"http", ps.cfg.HTTPAddr, ps.serveHTTP},
+    }
+    
+    for _, srv := range servers {
+        if srv.addr == "" {
+            continue
+        }
+        ln, err := net.Listen("tcp", srv.addr)
+        if err != nil {
+            ps.Close()
+            return fmt.Errorf("failed to listen for %s proxy on %s: %w", srv.kind, srv.addr, err)
+        }
+        
+        ps.mu.Lock()
+        ps.listeners[srv.kind] = ln
+        ps.mu.Unlock()
+        
+        ps.wg.Add(1)
+        go ps.acceptLoop(ln, ps.counters[srv.kind], srv.handle)
+    }
+    return nil
+}
+
+// Addr returns the address a proxy kind listens on, nil when not running
+func (ps *ProxyServer) Addr(kind string) net.Addr {
+    ps.mu.Lock()
+    defer ps.mu.Unlock()
+    
+    if ln, ok := ps.listeners[kind]; ok {
+        return ln.Addr()
+    }
+    return nil
+}
+
+func (ps *ProxyServer) acceptLoop(ln net.Listener, counters *proxyCounters, handle func(net.Conn, *proxyCounters)) {
+    defer ps.wg.Done()
+    
+    for {
+        conn, err := ln.Accept()
+        if err != nil {
+            return // closed by Close
+        }
+        if !ps.track(conn) {
+            conn.Close()
+            return
+        }
+        
+        counters.connections.Add(1)
+        counters.active.Add(1)
+        ps.wg.Add(1)
+        go func() {
+            defer ps.wg.Done()
+            defer counters.active.Add(-1)
+            defer ps.untrack(conn)
+            handle(conn, counters)
+        }()
+    }
+}
+
+// Register a connection so Close can interrupt it, false once closed
+func (ps *ProxyServer) track(c io.Closer) bool {
+    ps.mu.Lock()
+    defer ps.mu.Unlock()
+    
+    if ps.closed {
+        return false
+    }
+    ps.conns[c] = struct{}{}
+    return true
+}
+
+func (ps *ProxyServer) untrack(c io.Closer) {
+    ps.mu.Lock()
+    delete(ps.conns, c)
+    ps.mu.Unlock()
+    c.Close()
+}
+
+// Close stops the listeners, drops every proxied connection and waits for
+// their goroutines to finish
+func (ps *ProxyServer) Close() error {
+    ps.mu.Lock()
+    ps.closed = true
+    for _, ln := range ps.listeners {
+        ln.Close()
+    }
+    for c := range ps.conns {
+        c.Close()
+    }
+    ps.mu.Unlock()
+    
+    ps.wg.Wait()
+    return nil
+}
+
+// Stats returns the counters of every running proxy
+func (ps *ProxyServer) Stats() []ProxyStats {
+    ps.mu.Lock()
+    defer ps.mu.Unlock()
+    
+    var stats []ProxyStats
+    for _, kind := range []string{"socks5", "http"} {
+        ln, ok := ps.listeners[kind]
+        if !ok {
+            continue
+        }
+        c := ps.counters[kind]
+        stats = append(stats, ProxyStats{
+            Kind:        kind,
+            Addr:        ln.Addr().String(),
+            Connections: c.connections.Load(),
+            Active:      c.active.Load(),
+            RxBytes:     c.rx.Load(),
+            TxBytes:     c.tx.Load(),
+        })
+    }
+    return stats
+}
+
+// Copy both directions until either side closes
+func relay(client, remote net.Conn, counters *proxyCounters) {
+    done := make(chan struct{}, 2)
+    go func() {
+        io.Copy(countingWriter{remote, &counters.tx}, client)
+        closeWrite(remote)
+        done <- struct{}{}
+    }()
+    go func() {
+        io.Copy(countingWriter{client, &counters.rx}, remote)
+        closeWrite(client)
+        done <- struct{}{}
+    }()
+    <-done
+    <-done
+}
+
+// Half-close so the other direction can still drain
+func closeWrite(c net.Conn) {
+    if tc, ok := c.(interface{ CloseWrite() error }); ok {
+        tc.CloseWrite()
+        return
+    }
+    c.Close()
+}
+
+func (ps *ProxyServer) dial(address string) (net.Conn, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), proxyDialTimeout)
+    defer cancel()
+    return ps.dialer.DialContext(ctx, "tcp", address)
+}
+
+// SOCKS5 (RFC 1928) with username/password authentication (RFC 1929)
+func (ps *ProxyServer) serveSOCKS(conn net.Conn, counters *proxyCounters) {
+    conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+    r := bufio.NewReader(conn)
+    
+    if err := ps.socksNegotiate(r, conn); err != nil {
+        return
+    }
+    
+    var header [3]byte
+    if _, err := io.ReadFull(r, header[:]); err != nil || header[0] != socksVersion {
+        return
+    }
+    target, err := readSocksAddr(r)
+    if err != nil {
+        writeSocksReply(conn, socksAddrNotSupported, nil)
+        return
+    }
+    
+    switch header[1] {
+    case socksCmdConnect:
+        remote, err := ps.dial(target)
+        if err != nil {
+            writeSocksReply(conn, socksHostUnreachable, nil)
+            return
+        }
+        defer remote.Close()
+        if !ps.track(remote) {
+            return
+        }
+        defer ps.untrack(remote)
+        
+        if err := writeSocksReply(conn, socksSucceeded, remote.LocalAddr()); err != nil {
+            return
+        }
+        conn.SetDeadline(time.Time{})
+        relay(&bufferedConn{Conn: conn, r: r}, remote, counters)
+    case socksCmdAssociate:
+        ps.socksAssociate(conn, counters)
+    default:
+        writeSocksReply(conn, socksCmdNotSupported, nil)
+    }
+}
+
+// Method selection and, when configured, the username/password exchange
+func (ps *ProxyServer) socksNegotiate(r *bufio.Reader, conn net.Conn) error {
+    var greeting [2]byte
+    if _, err := io.ReadFull(r, greeting[:]); err != nil {
+        return err
+    }
+    if greeting[0] != socksVersion {
+        return fmt.Errorf("unsupported SOCKS version %d", greeting[0])
+    }
+    methods := make([]byte, greeting[1])
+    if _, err := io.ReadFull(r, methods); err != nil {
+        return err
+    }
+    
+    want := byte(socksAuthNone)
+    if ps.cfg.requireAuth() {
+        want = socksAuthUserPwd
+    }
+    offered := false
+    for _, m := range methods {
+        offered = offered || m == want
+    }
+    if !offered {
+        conn.Write([]byte{socksVersion, socksAuthNoMatch})
+        return errSocksAuth
+    }
+    if _, err := conn.Write([]byte{socksVersion, want}); err != nil {
+        return err
+    }
+    if want == socksAuthNone {
+        return nil
+    }
+    
+    // RFC 1929: VER ULEN UNAME PLEN PASSWD
+    var ver [1]byte
+    if _, err := io.ReadFull(r, ver[:]); err != nil {
+        return err
+    }
+    user, err := readLengthPrefixed(r)
+    if err != nil {
+        return err
+    }
+    password, err := readLengthPrefixed(r)
+    if err != nil {
+        return err
+    }
+    
+    if !ps.cfg.checkCredentials(user, password) {
+        conn.Write([]byte{0x01, 0x01})
+        return errSocksAuth
+    }
+    _, err = conn.Write([]byte{0x01, 0x00})
+    return err
+}
+
+func readLengthPrefixed(r *bufio.Reader) (string, error) {
+    n, err := r.ReadByte()
+    if err != nil {
+        return "", err
+    }
+    buf := make([]byte, n)
+    if _, err := io.ReadFull(r, buf); err != nil {
+        return "", err
+    }
+    return string(buf), nil
+}
+
+// ATYP DST.ADDR DST.PORT as host:port
+func readSocksAddr(r io.Reader) (string, error) {
+    var atyp [1]byte
+    if _, err := io.ReadFull(r, atyp[:]); err != nil {
+        return "", err
+    }
+    
+    var host string
+    switch atyp[0] {
+    case socksAddrIPv4, socksAddrIPv6:
+        ip := make(net.IP, 4)
+        if atyp[0] == socksAddrIPv6 {
+            ip = make(net.IP, 16)
+        }
+        if _, err := io.ReadFull(r, ip); err != nil {
+            return "", err
+        }
+        host = ip.String()
+    case socksAddrDomain:
+        var n [1]byte
+        if _, err := io.ReadFull(r, n[:]); err != nil {
+            return "", err
+        }
+        name := make([]byte, n[0])
+        if _, err := io.ReadFull(r, name); err != nil {
+            return "", err
+        }
+        host = string(name)
+    default:
+        return "", fmt.Errorf("unsupported address type %d", atyp[0])
+    }
+    
+    var port [2]byte
+    if _, err := io.ReadFull(r, port[:]); err != nil {
+        return "", err
+    }
+    return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// ATYP ADDR PORT for an IP address, the unspecified IPv4 address for nil
+func socksAddrBytes(addr net.Addr) []byte {
+    ip, port := net.IPv4zero, 0
+    switch a := addr.(type) {
+    case *net.TCPAddr:
+        ip, port = a.IP, a.Port
+    case *net.UDPAddr:
+        ip, port = a.IP, a.Port
+    }
+    
+    var b []byte
+    if ip4 := ip.To4(); ip4 != nil {
+        b = append([]byte{socksAddrIPv4}, ip4...)
+    } else {
+        b = append([]byte{socksAddrIPv6}, ip.To16()...)
+    }
+    return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+func writeSocksReply(conn net.Conn, status byte, bound net.Addr) error {
+    reply := append([]byte{socksVersion, status, 0x00}, socksAddrBytes(bound)...)
+    _, err := conn.Write(reply)
+    return err
+}
+
+// UDP ASSOCIATE: relay datagrams between the client and the tunnel for as
+// long as the control connection stays open
+func (ps *ProxyServer) socksAssociate(conn net.Conn, counters *proxyCounters) {
+    clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+    localIP := conn.LocalAddr().(*net.TCPAddr).IP
+    
+    local, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+    if err != nil {
+        writeSocksReply(conn, socksGeneralFailure, nil)
+        return
+    }
+    remote, err := ps.dialer.ListenPacket(context.Background())
+    if err != nil {
+        local.Close()
+        writeSocksReply(conn, socksGeneralFailure, nil)
+        return
+    }
+    if !ps.track(local) || !ps.track(remote) {
+        local.Close()
+        remote.Close()
+        return
+    }
+    defer ps.untrack(local)
+    defer ps.untrack(remote)
+    
+    if err := writeSocksReply(conn, socksSucceeded, local.LocalAddr()); err != nil {
+        return
+    }
+    conn.SetDeadline(time.Time{})
+    
+    var clientAddr atomic.Pointer[net.UDPAddr]
+    var wg sync.WaitGroup
+    wg.Add(2)
+    
+    // Client to tunnel
+    go func() {
+        defer wg.Done()
+        buf := make([]byte, maxUDPDatagram)
+        for {
+            n, from, err := local.ReadFromUDP(buf)
+            if err != nil {
+                return
+            }
+            // Only the client that asked for the association may use it
+            if !from.IP.Equal(clientIP) {
+                continue
+            }
+            target, payload, err := parseSocksDatagram(buf[:n])
+            if err != nil {
+                continue
+            }
+            dst, err := net.ResolveUDPAddr("udp", target)
+            if err != nil {
+                continue
+            }
+            clientAddr.Store(from)
+            if sent, err := remote.WriteTo(payload, dst); err == nil {
+                counters.tx.Add(uint64(sent))
+            }
+        }
+    }()
+    
+    // Tunnel to client
+    go func() {
+        defer wg.Done()
+        buf := make([]byte, maxUDPDatagram)
+        for {
+            n, from, err := remote.ReadFrom(buf)
+            if err != nil {
+                return
+            }
+            client := clientAddr.Load()
+            if client == nil {
+                continue
+            }
+            packet := append([]byte{0, 0, 0}, socksAddrBytes(from)...)
+            packet = append(packet, buf[:n]...)
+            if _, err := local.WriteToUDP(packet, client); err == nil {
+                counters.rx.Add(uint64(n))
+            }
+        }
+    }()
+    
+    // The association ends with the TCP connection
+    io.Copy(io.Discard, conn)
+    local.Close()
+    remote.Close()
+    wg.Wait()
+}
+
+// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA. Fragments are not supported.
+func parseSocksDatagram(packet []byte) (string, []byte, error) {
+    if len(packet) < 4 || packet[2] != 0 {
+        return "", nil, fmt.Errorf("unsupported SOCKS datagram")
+    }
+    r := bytes.NewReader(packet[3:])
+    target, err := readSocksAddr(r)
+    if err != nil {
+        return "", nil, err
+    }
+    return target, packet[len(packet)-r.Len():], nil
+}
+
+// bufferedConn reads through the reader that consumed the handshake, so
+// bytes the client sent early are not lost
+type bufferedConn struct {
+    net.Conn
+    r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+    return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+    closeWrite(c.Conn)
+    return nil
+}
+
+// HTTP CONNECT, other methods are refused
+func (ps *ProxyServer) serveHTTP(conn net.Conn, counters *proxyCounters) {
+    conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+    r := bufio.NewReader(conn)
+    
+    req, err := http.ReadRequest(r)
+    if err != nil {
+        return
+    }
+    if req.Method != http.MethodConnect {
+        writeHTTPStatus(conn, http.StatusMethodNotAllowed, "")
+        return
+    }
+    if !ps.httpAuthorized(req) {
+        writeHTTPStatus(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"undertheradar\"\r\n")
+        return
+    }
+    
+    remote, err := ps.dial(req.Host)
+    if err != nil {
+        writeHTTPStatus(conn, http.StatusBadGateway, "")
+        return
+    }
+    defer remote.Close()
+    if !ps.track(remote) {
+        return
+    }
+    defer ps.untrack(remote)
+    
+    if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+        return
+    }
+    conn.SetDeadline(time.Time{})
+    relay(&bufferedConn{Conn: conn, r: r}, remote, counters)
+}
+
+func (ps *ProxyServer) httpAuthorized(req *http.Request) bool {
+    if !ps.cfg.requireAuth() {
+        return true
+    }
+    
+    scheme, encoded, ok := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+    if !ok || !strings.EqualFold(scheme, "Basic") {
+        return false
+    }
+    decoded, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil {
+        return false
+    }
+    user, password, ok := strings.Cut(string(decoded), ":")
+    return ok && ps.cfg.checkCredentials(user, password)
+}
+
+func writeHTTPStatus(conn net.Conn, code int, headers string) {
+    fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\n\r\n", code, http.StatusText(code), headers)
+}
+
+// Start the proxies configured in cfg, dialing out through the tunnel
+func (vpn *UnderTheRadarVPN) startProxy(cfg ProxyConfig) error {
+    if vpn.planning != nil {
+        vpn.planning.note(ChangeService, "start the proxy, SOCKS5 on %q and HTTP CONNECT on %q", cfg.SOCKSAddr, cfg.HTTPAddr)
+        return nil
+    }
+    proxy := NewProxyServer(cfg, tunnelDialer{device: vpn.deviceName, source: cfg.SourceIP})
+    if err := proxy.Start(); err != nil {
+        return err
+    }
+    
+    vpn.mu.Lock()
+    vpn.proxy = proxy
+    vpn.mu.Unlock()
+    return nil
+}
+
+func (vpn *UnderTheRadarVPN) stopProxy() error {
+    vpn.mu.Lock()
+    proxy := vpn.proxy
+    vpn.proxy = nil
+    vpn.mu.Unlock()
+    
+    if proxy == nil {
+        return nil
+    }
+    return proxy.Close()
+}
+
+// ProxyStats returns the counters of the running proxies
+func (vpn *UnderTheRadarVPN) ProxyStats() []ProxyStats {
+    vpn.mu.RLock()
+    proxy := vpn.proxy
+    vpn.mu.RUnlock()
+    
+    if proxy == nil {
+        return nil
+    }
+    return proxy.Stats()
+}
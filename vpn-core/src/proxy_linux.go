@@ -0,0 +1,19 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// Bind outbound proxy sockets to the tunnel device (SO_BINDTODEVICE)
+func bindToDevice(device string) func(network, address string, c syscall.RawConn) error {
+    return func(network, address string, c syscall.RawConn) error {
+        var bindErr error
+        err := c.Control(func(fd uintptr) {
+            bindErr = syscall.BindToDevice(int(fd), device)
+        })
+        if err != nil {
+            return err
+        }
+        return bindErr
+    }
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// No SO_BINDTODEVICE, ProxyConfig.SourceIP selects the tunnel instead
+func bindToDevice(device string) func(network, address string, c syscall.RawConn) error {
+    return nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/base64"
+    "encoding/binary"
+    "io"
+    "net"
+    "net/http"
+    "testing"
+    "time"
+)
+
+// directDialer stands in for the tunnel, dialing over loopback
+type directDialer struct{}
+
+func (directDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+    var d net.Dialer
+    return d.DialContext(ctx, network, address)
+}
+
+func (directDialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+    return net.ListenPacket("udp", "127.0.0.1:0")
+}
+
+func startTestProxy(t *testing.T, cfg ProxyConfig) *ProxyServer {
+    t.Helper()
+    proxy := NewProxyServer(cfg, directDialer{})
+    if err := proxy.Start(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { proxy.Close() })
+    return proxy
+}
+
+func authConfig() ProxyConfig {
+    return ProxyConfig{
+        SOCKSAddr: "127.0.0.1:0",
+        HTTPAddr:  "127.0.0.1:0",
+        Username:  "alice",
+        Password:  NewSecret([]byte("hunter2")),
+    }
+}
+
+// TCP echo server, closed with the test
+func echoServer(t *testing.T) net.Listener {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { ln.Close() })
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                io.Copy(conn, conn)
+            }()
+        }
+    }()
+    return ln
+}
+
+// Greeting, RFC 1929 login and request; returns the reply status
+func socksRequest(t *testing.T, conn net.Conn, user, password string, cmd byte, target *net.TCPAddr) (byte, []byte) {
+    t.Helper()
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    
+    conn.Write([]byte{socksVersion, 1, socksAuthUserPwd})
+    var method [2]byte
+    if _, err := io.ReadFull(conn, method[:]); err != nil {
+        t.Fatal(err)
+    }
+    if method[1] != socksAuthUserPwd {
+        t.Fatalf("server chose method %#x", method[1])
+    }
+    
+    login := []byte{0x01, byte(len(user))}
+    login = append(login, user...)
+    login = append(login, byte(len(password)))
+    login = append(login, password...)
+    conn.Write(login)
+    var status [2]byte
+    if _, err := io.ReadFull(conn, status[:]); err != nil {
+        t.Fatal(err)
+    }
+    if status[1] != 0 {
+        return 0xff, nil
+    }
+    
+    req := append([]byte{socksVersion, cmd, 0}, socksAddrBytes(target)...)
+    conn.Write(req)
+    reply := make([]byte, 10) // IPv4 bound address
+    if _, err := io.ReadFull(conn, reply); err != nil {
+        t.Fatal(err)
+    }
+    return reply[1], reply[3:]
+}
+
+// Poll the first proxy's stats until ready accepts them
+func waitForProxyStats(t *testing.T, proxy *ProxyServer, ready func(ProxyStats) bool) ProxyStats {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        stats := proxy.Stats()[0]
+        if ready(stats) {
+            return stats
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("stats never settled: %+v", stats)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func TestSOCKSConnectRelaysAndCounts(t *testing.T) {
+    proxy := startTestProxy(t, authConfig())
+    echo := echoServer(t)
+    
+    conn, err := net.Dial("tcp", proxy.Addr("socks5").String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    
+    status, _ := socksRequest(t, conn, "alice", "hunter2", socksCmdConnect, echo.Addr().(*net.TCPAddr))
+    if status != socksSucceeded {
+        t.Fatalf("CONNECT status %#x", status)
+    }
+    
+    msg := []byte("through the tunnel")
+    conn.Write(msg)
+    got := make([]byte, len(msg))
+    if _, err := io.ReadFull(conn, got); err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(got, msg) {
+        t.Fatalf("echo = %q", got)
+    }
+    
+    // The relay counts after the write returns, give it a moment
+    want := uint64(len(msg))
+    stats := waitForProxyStats(t, proxy, func(s ProxyStats) bool { return s.RxBytes == want })
+    if stats.Kind != "socks5" || stats.Connections != 1 || stats.Active != 1 {
+        t.Fatalf("stats = %+v", stats)
+    }
+    if stats.TxBytes != want {
+        t.Fatalf("counted tx %d, want %d", stats.TxBytes, want)
+    }
+}
+
+func TestSOCKSRejectsWrongPassword(t *testing.T) {
+    proxy := startTestProxy(t, authConfig())
+    echo := echoServer(t)
+    
+    conn, err := net.Dial("tcp", proxy.Addr("socks5").String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    
+    if status, _ := socksRequest(t, conn, "alice", "hunter3", socksCmdConnect, echo.Addr().(*net.TCPAddr)); status != 0xff {
+        t.Fatal("login with the wrong password succeeded")
+    }
+}
+
+func TestSOCKSUDPAssociate(t *testing.T) {
+    proxy := startTestProxy(t, authConfig())
+    
+    echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer echo.Close()
+    go func() {
+        buf := make([]byte, 1500)
+        for {
+            n, from, err := echo.ReadFromUDP(buf)
+            if err != nil {
+                return
+            }
+            echo.WriteToUDP(buf[:n], from)
+        }
+    }()
+    
+    control, err := net.Dial("tcp", proxy.Addr("socks5").String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer control.Close()
+    
+    status, bound := socksRequest(t, control, "alice", "hunter2", socksCmdAssociate, &net.TCPAddr{IP: net.IPv4zero})
+    if status != socksSucceeded {
+        t.Fatalf("UDP ASSOCIATE status %#x", status)
+    }
+    relayAddr := &net.UDPAddr{IP: net.IP(bound[1:5]), Port: int(binary.BigEndian.Uint16(bound[5:7]))}
+    
+    client, err := net.DialUDP("udp", nil, relayAddr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+    client.SetDeadline(time.Now().Add(5 * time.Second))
+    
+    packet := append([]byte{0, 0, 0}, socksAddrBytes(echo.LocalAddr())...)
+    packet = append(packet, "ping"...)
+    if _, err := client.Write(packet); err != nil {
+        t.Fatal(err)
+    }
+    
+    buf := make([]byte, 1500)
+    n, err := client.Read(buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    from, payload, err := parseSocksDatagram(buf[:n])
+    if err != nil {
+        t.Fatal(err)
+    }
+    if from != echo.LocalAddr().String() || string(payload) != "ping" {
+        t.Fatalf("reply from %s: %q", from, payload)
+    }
+    
+    // Closing the control connection ends the association
+    control.Close()
+    waitForProxyStats(t, proxy, func(s ProxyStats) bool { return s.Active == 0 })
+}
+
+func TestHTTPConnectRequiresAuth(t *testing.T) {
+    proxy := startTestProxy(t, authConfig())
+    echo := echoServer(t)
+    
+    connect := func(auth string) (net.Conn, *bufio.Reader, int) {
+        conn, err := net.Dial("tcp", proxy.Addr("http").String())
+        if err != nil {
+            t.Fatal(err)
+        }
+        conn.SetDeadline(time.Now().Add(5 * time.Second))
+        io.WriteString(conn, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nHost: "+echo.Addr().String()+"\r\n")
+        if auth != "" {
+            io.WriteString(conn, "Proxy-Authorization: Basic "+base64.StdEncoding.EncodeToString([]byte(auth))+"\r\n")
+        }
+        io.WriteString(conn, "\r\n")
+        
+        r := bufio.NewReader(conn)
+        resp, err := http.ReadResponse(r, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return conn, r, resp.StatusCode
+    }
+    
+    conn, _, code := connect("")
+    conn.Close()
+    if code != http.StatusProxyAuthRequired {
+        t.Fatalf("no credentials: status %d", code)
+    }
+    conn, _, code = connect("alice:wrong")
+    conn.Close()
+    if code != http.StatusProxyAuthRequired {
+        t.Fatalf("wrong password: status %d", code)
+    }
+    
+    conn, r, code := connect("alice:hunter2")
+    defer conn.Close()
+    if code != http.StatusOK {
+        t.Fatalf("valid credentials: status %d", code)
+    }
+    io.WriteString(conn, "hello")
+    got := make([]byte, 5)
+    if _, err := io.ReadFull(r, got); err != nil || string(got) != "hello" {
+        t.Fatalf("echo = %q, %v", got, err)
+    }
+}
+
+func TestHTTPProxyRefusesPlainRequests(t *testing.T) {
+    proxy := startTestProxy(t, ProxyConfig{HTTPAddr: "127.0.0.1:0"})
+    
+    conn, err := net.Dial("tcp", proxy.Addr("http").String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+    
+    resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if resp.StatusCode != http.StatusMethodNotAllowed {
+        t.Fatalf("status %d", resp.StatusCode)
+    }
+}
+
+func TestProxyCloseDropsConnections(t *testing.T) {
+    proxy := NewProxyServer(authConfig(), directDialer{})
+    if err := proxy.Start(); err != nil {
+        t.Fatal(err)
+    }
+    echo := echoServer(t)
+    
+    conn, err := net.Dial("tcp", proxy.Addr("socks5").String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    if status, _ := socksRequest(t, conn, "alice", "hunter2", socksCmdConnect, echo.Addr().(*net.TCPAddr)); status != socksSucceeded {
+        t.Fatalf("CONNECT status %#x", status)
+    }
+    
+    done := make(chan struct{})
+    go func() {
+        proxy.Close()
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("Close hung on an active connection")
+    }
+    
+    if _, err := conn.Read(make([]byte, 1)); err == nil {
+        t.Fatal("client connection still open after Close")
+    }
+    if active := proxy.Stats()[0].Active; active != 0 {
+        t.Fatalf("%d connections still counted as active", active)
+    }
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "image"
+    _ "image/gif"
+    _ "image/jpeg"
+    "image/png"
+    "strings"
+    
+    "github.com/makiuchi-d/gozxing"
+    "github.com/makiuchi-d/gozxing/qrcode"
+)
+
+// Side of the PNG GenerateQRCode writes, large enough for phone cameras
+const qrCodeSize = 512
+
+var ErrNoQRCode = errors.New("no QR code found")
+
+// ParseQRCode reads a WireGuard config from a QR code such as wg genqr or
+// qrencode make, given as a PNG, JPEG or GIF image. The text a scanner
+// app already decoded is accepted as well. The config is read like
+// ImportWGQuickConfig except that keys must be inline: a code from
+// elsewhere can't refer to local environment variables or files.
+func ParseQRCode(qrData []byte) (*VPNConfig, error) {
+    text, err := decodeQRCode(qrData)
+    if err != nil {
+        return nil, err
+    }
+    
+    config, _, err := importWGQuick(strings.NewReader(text), inlineSecret)
+    if err != nil {
+        return nil, err
+    }
+    return &config, nil
+}
+
+func decodeQRCode(qrData []byte) (string, error) {
+    img, _, err := image.Decode(bytes.NewReader(qrData))
+    if errors.Is(err, image.ErrFormat) && bytes.Contains(qrData, []byte("[Interface]")) {
+        return string(qrData), nil
+    }
+    if err != nil {
+        return "", fmt.Errorf("failed to decode QR code image: %w", err)
+    }
+    
+    bitmap, err := gozxing.NewBinaryBitmapFromImage(img)
+    if err != nil {
+        return "", fmt.Errorf("failed to decode QR code image: %w", err)
+    }
+    result, err := qrcode.NewQRCodeReader().Decode(bitmap, map[gozxing.DecodeHintType]interface{}{
+        gozxing.DecodeHintType_TRY_HARDER: true,
+    })
+    if err != nil {
+        return "", fmt.Errorf("%w: %v", ErrNoQRCode, err)
+    }
+    return result.GetText(), nil
+}
+
+// Inline keys only, references are rejected without being looked up
+func inlineSecret(value string) (*Secret, error) {
+    if strings.HasPrefix(value, "env:") || strings.HasPrefix(value, "file:") {
+        return nil, fmt.Errorf("key references are not allowed here")
+    }
+    return ResolveSecret(value)
+}
+
+// GenerateQRCode returns config as a wg-quick .conf in a PNG QR code that
+// the WireGuard mobile apps import. The code holds the private key, so
+// treat it like the key itself.
+func GenerateQRCode(config *VPNConfig) ([]byte, error) {
+    var text bytes.Buffer
+    defer func() { wipe(text.Bytes()) }()
+    writeWGQuickConfig(&text, config, true)
+    
+    matrix, err := qrcode.NewQRCodeWriter().Encode(text.String(), gozxing.BarcodeFormat_QR_CODE, qrCodeSize, qrCodeSize, nil)
+    if err != nil {
+        return nil, fmt.Errorf("failed to encode QR code: %w", err)
+    }
+    var out bytes.Buffer
+    if err := png.Encode(&out, matrix); err != nil {
+        return nil, fmt.Errorf("failed to write QR code: %w", err)
+    }
+    return out.Bytes(), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+    "bytes"
+    "image/png"
+    "net"
+    "testing"
+    "time"
+)
+
+func TestQRCodeRoundTrip(t *testing.T) {
+    private, psk := mustKey(t), mustKey(t)
+    peer := PeerConfig{
+        PublicKey:           mustKey(t).PublicKey(),
+        PresharedKey:        SecretFromKey(psk),
+        Endpoint:            &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51820},
+        AllowedIPs:          []net.IPNet{mustCIDR(t, "0.0.0.0/0"), mustCIDR(t, "::/0")},
+        PersistentKeepalive: 25 * time.Second,
+    }
+    config := &VPNConfig{
+        PrivateKey: SecretFromKey(private),
+        Addresses:  []net.IPNet{{IP: net.IPv4(10, 8, 0, 2).To4(), Mask: net.CIDRMask(24, 32)}},
+        DNSServers: []string{"10.8.0.1"},
+        Peers:      []PeerConfig{peer},
+    }
+    
+    code, err := GenerateQRCode(config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := png.Decode(bytes.NewReader(code)); err != nil {
+        t.Fatalf("not a PNG: %v", err)
+    }
+    
+    parsed, err := ParseQRCode(code)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if parsed.PrivateKey.Key() != private || parsed.ListenPort != 0 || parsed.Addresses[0].String() != "10.8.0.2/24" {
+        t.Fatalf("interface = %+v", parsed)
+    }
+    if !parsed.DNSProtection || len(parsed.DNSServers) != 1 || parsed.DNSServers[0] != "10.8.0.1" {
+        t.Fatalf("DNS = %v", parsed.DNSServers)
+    }
+    if len(parsed.Peers) != 1 {
+        t.Fatalf("got %d peers", len(parsed.Peers))
+    }
+    got := parsed.Peers[0]
+    if got.PublicKey != peer.PublicKey || got.PresharedKey.Key() != psk || got.Endpoint.String() != "203.0.113.7:51820" ||
+        len(got.AllowedIPs) != 2 || got.AllowedIPs[1].String() != "::/0" || got.PersistentKeepalive != 25*time.Second {
+        t.Fatalf("peer = %+v", got)
+    }
+}
+
+func TestParseQRCodeText(t *testing.T) {
+    var conf bytes.Buffer
+    writeWGQuickConfig(&conf, &VPNConfig{PrivateKey: SecretFromKey(mustKey(t))}, true)
+    if _, err := ParseQRCode(conf.Bytes()); err != nil {
+        t.Fatalf("scanned text: %v", err)
+    }
+    
+    // A code can't pull in the scanning host's keys
+    t.Setenv("UTR_QR_KEY", mustKey(t).String())
+    if _, err := ParseQRCode([]byte("[Interface]\nPrivateKey = env:UTR_QR_KEY\n")); err == nil {
+        t.Fatal("key reference accepted")
+    }
+    
+    if _, err := ParseQRCode([]byte("not an image")); err == nil {
+        t.Fatal("garbage accepted")
+    }
+}
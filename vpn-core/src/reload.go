@@ -0,0 +1,389 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "os/signal"
+    "reflect"
+    "syscall"
+)
+
+var ErrRestartRequired = errors.New("configuration change requires a restart")
+
+// ConfigLoader reads a VPNConfig from a file, see WatchSIGHUP
+type ConfigLoader func(path string) (VPNConfig, error)
+
+// Settings Reload can't apply to a running device
+func restartOnlyChanges(current, next VPNConfig) []string {
+    var changed []string
+    if !next.PrivateKey.Equal(current.PrivateKey) {
+        changed = append(changed, "PrivateKey")
+    }
+    if !reflect.DeepEqual(current.Peers, next.Peers) {
+        changed = append(changed, "Peers") // use AddPeer
+    }
+    if current.AdoptExisting != next.AdoptExisting || current.AdoptConflicts != next.AdoptConflicts {
+        changed = append(changed, "AdoptExisting")
+    }
+    if !reflect.DeepEqual(current.Addresses, next.Addresses) {
+        changed = append(changed, "Addresses")
+    }
+    if current.BindInterface != next.BindInterface || current.FirewallMark != next.FirewallMark || current.UDPSocket != next.UDPSocket {
+        changed = append(changed, "BindInterface")
+    }
+    if current.UAPI != next.UAPI {
+        changed = append(changed, "UAPI")
+    }
+    if current.FastPathEnabled != next.FastPathEnabled {
+        changed = append(changed, "FastPathEnabled")
+    }
+    if !reflect.DeepEqual(current.EBPFInterfaces, next.EBPFInterfaces) {
+        changed = append(changed, "EBPFInterfaces")
+    }
+    if current.Admission != next.Admission {
+        changed = append(changed, "Admission")
+    }
+    if current.FirewallBackend != next.FirewallBackend {
+        changed = append(changed, "FirewallBackend")
+    }
+    return changed
+}
+
+// Reload applies a new configuration to the running VPN without a
+// Stop/Start cycle, so the device and its sessions stay up. Only changed
+// settings are touched. Settings that need a new device are refused with
+// ErrRestartRequired before anything is applied, as is a config Start
+// would refuse, with a *ConfigError. If a step fails, the steps
+// before it stay applied and the next Reload picks up from there.
+func (vpn *UnderTheRadarVPN) Reload(next VPNConfig) error {
+    vpn.reloadMu.Lock()
+    defer vpn.reloadMu.Unlock()
+    
+    vpn.mu.RLock()
+    current := vpn.config
+    vpn.mu.RUnlock()
+    
+    // Checked and normalized as Start does, so canonical forms compare equal
+    if err := next.check().err(); err != nil {
+        return err
+    }
+    if changed := restartOnlyChanges(current, next); len(changed) > 0 {
+        return fmt.Errorf("%w: %v", ErrRestartRequired, changed)
+    }
+    
+    // Record each setting as it takes effect
+    applied := current
+    defer func() {
+        vpn.mu.Lock()
+        vpn.config = applied
+        vpn.mu.Unlock()
+    }()
+    
+    vpn.mu.Lock()
+    vpn.allowedIPConflicts = next.AllowedIPConflicts
+    vpn.mu.Unlock()
+    applied.AllowedIPConflicts = next.AllowedIPConflicts
+    
+    if next.ListenPort != current.ListenPort {
+        if err := vpn.SetListenPort(next.ListenPort); err != nil {
+            return err
+        }
+        applied.ListenPort = next.ListenPort
+    }
+    
+    if next.ManageInputPinhole != current.ManageInputPinhole {
+        if next.ManageInputPinhole {
+            if err := vpn.openPinhole(); err != nil {
+                return fmt.Errorf("failed to open input pinhole: %w", err)
+            }
+        } else if err := vpn.pinhole.Close(); err != nil {
+            return fmt.Errorf("failed to close input pinhole: %w", err)
+        }
+        applied.ManageInputPinhole = next.ManageInputPinhole
+    }
+    
+    if next.ClampMSS != current.ClampMSS || next.MSS != current.MSS {
+        if next.ClampMSS {
+            if err := vpn.clampMSS(next); err != nil {
+                return fmt.Errorf("failed to clamp MSS: %w", err)
+            }
+        } else if err := vpn.mssClamp.Disable(); err != nil {
+            return fmt.Errorf("failed to remove MSS clamp: %w", err)
+        }
+        applied.ClampMSS, applied.MSS = next.ClampMSS, next.MSS
+    }
+    
+    // The redirects point at the listen port, so they follow it
+    if !reflect.DeepEqual(redirectedPorts(next), redirectedPorts(current)) || next.ListenPort != current.ListenPort {
+        if err := validateListenPorts(next); err != nil {
+            return err
+        }
+        if ports := redirectedPorts(next); len(ports) > 0 {
+            if err := vpn.openHopPorts(ports); err != nil {
+                return fmt.Errorf("failed to open hop ports: %w", err)
+            }
+        } else if err := vpn.hopRedirect.Close(); err != nil {
+            return fmt.Errorf("failed to close hop ports: %w", err)
+        }
+        applied.HopPorts = next.HopPorts
+    }
+    if !reflect.DeepEqual(next.ListenPorts, current.ListenPorts) {
+        if err := vpn.setListenPorts(next.ListenPorts); err != nil {
+            return err
+        }
+        applied.ListenPorts = next.ListenPorts
+    }
+    
+    // Ahead of the kill switch, which only accepts the bypass mark while the
+    // LSM program keeps other processes from setting it
+    if next.KillSwitch != current.KillSwitch || !reflect.DeepEqual(next.BypassProcesses, current.BypassProcesses) {
+        if err := vpn.reloadProcessBypass(current, next); err != nil {
+            return fmt.Errorf("failed to enable process bypass: %w", err)
+        }
+        applied.BypassProcesses = next.BypassProcesses
+    }
+    
+    if err := vpn.reloadKillSwitch(current, next); err != nil {
+        return err
+    }
+    applied.KillSwitch, applied.KillSwitchVRF = next.KillSwitch, next.KillSwitchVRF
+    applied.KillSwitchContainers, applied.ContainerExclusions = next.KillSwitchContainers, next.ContainerExclusions
+    applied.KillSwitchAllowEstablished = next.KillSwitchAllowEstablished
+    applied.KillSwitchLAN = next.KillSwitchLAN
+    applied.KillSwitchFailClosed = next.KillSwitchFailClosed // only read by Start
+    
+    if err := vpn.reloadDNS(current, next); err != nil {
+        return err
+    }
+    applied.DNSProtection, applied.DNSServers = next.DNSProtection, next.DNSServers
+    applied.DoHProviders, applied.DNSQueryTimeout = next.DoHProviders, next.DNSQueryTimeout
+    applied.DNSProxyOnly, applied.DNSListenAddr = next.DNSProxyOnly, next.DNSListenAddr
+    applied.DNSSearchDomains, applied.DNSSplit, applied.DNSResolver = next.DNSSearchDomains, next.DNSSplit, next.DNSResolver
+    
+    if !reflect.DeepEqual(next.SplitTunnelApps, current.SplitTunnelApps) {
+        if err := vpn.splitTunnel.Configure(next.SplitTunnelApps); err != nil {
+            return fmt.Errorf("failed to configure split tunnel: %w", err)
+        }
+        applied.SplitTunnelApps = next.SplitTunnelApps
+    }
+    
+    if next.ExitNAT != current.ExitNAT {
+        var rules []nftRule
+        if next.ExitNAT {
+            rules = exitNATRules(vpn.deviceName)
+        }
+        if err := vpn.nft.set(nftFeatureExitNAT, rules); err != nil {
+            return fmt.Errorf("failed to change exit NAT: %w", err)
+        }
+        applied.ExitNAT = next.ExitNAT
+    }
+    
+    if !reflect.DeepEqual(next.Proxy, current.Proxy) {
+        vpn.stopProxy()
+        applied.Proxy = ProxyConfig{}
+        if next.Proxy.enabled() {
+            if err := vpn.startProxy(next.Proxy); err != nil {
+                return fmt.Errorf("failed to start proxy: %w", err)
+            }
+        }
+        applied.Proxy = next.Proxy
+    }
+    
+    if !reflect.DeepEqual(next.ServerStatus, current.ServerStatus) {
+        vpn.stopServerStatus()
+        applied.ServerStatus = ServerStatusConfig{}
+        if next.ServerStatus.ListenAddr != "" {
+            if err := vpn.startServerStatus(next.ServerStatus); err != nil {
+                return fmt.Errorf("failed to publish server status: %w", err)
+            }
+        }
+        applied.ServerStatus = next.ServerStatus
+    }
+    
+    if !reflect.DeepEqual(next.CaptivePortal, current.CaptivePortal) {
+        vpn.stopCaptivePortal()
+        if next.CaptivePortal.Enabled {
+            vpn.startCaptivePortal(next.CaptivePortal)
+        }
+        applied.CaptivePortal = next.CaptivePortal
+    }
+    
+    if !next.Webhook.equal(current.Webhook) {
+        vpn.stopWebhook()
+        if next.Webhook.enabled() {
+            vpn.startWebhook(next.Webhook)
+        }
+        applied.Webhook = next.Webhook
+    }
+    
+    if next.ObfuscationKeyRotation != current.ObfuscationKeyRotation || next.ObfuscationKeyGrace != current.ObfuscationKeyGrace {
+        if err := vpn.obfuscator.reschedule(next.ObfuscationKeyRotation, next.ObfuscationKeyGrace); err != nil {
+            return fmt.Errorf("failed to reschedule key rotation: %w", err)
+        }
+        applied.ObfuscationKeyRotation, applied.ObfuscationKeyGrace = next.ObfuscationKeyRotation, next.ObfuscationKeyGrace
+    }
+    // The last push of the old writer goes out before the new one starts
+    if !next.RemoteWrite.equal(current.RemoteWrite) {
+        vpn.stopRemoteWrite(context.Background())
+        if next.RemoteWrite.enabled() {
+            vpn.startRemoteWrite(next.RemoteWrite)
+        }
+        applied.RemoteWrite = next.RemoteWrite
+    }
+    
+    // SyncPeers reads it at each sync
+    if !next.Coordination.equal(current.Coordination) {
+        applied.Coordination = next.Coordination
+    }
+    
+    // The collector reads it at each poll
+    if next.Metrics != current.Metrics {
+        vpn.metrics.configure(next.Metrics)
+        applied.Metrics = next.Metrics
+    }
+    
+    // Takes effect at the next capability exchange
+    applied.ObfuscationKeyExchange = next.ObfuscationKeyExchange
+    applied.TrafficShaping = next.TrafficShaping
+    applied.UptimeWindow = next.UptimeWindow
+    
+    vpn.emitEvent(Event{Type: EventConfigReloaded, Message: "configuration reloaded"})
+    return nil
+}
+
+func (vpn *UnderTheRadarVPN) reloadKillSwitch(current, next VPNConfig) error {
+    ks := vpn.killSwitch
+    if next.KillSwitch == current.KillSwitch && next.KillSwitchVRF == current.KillSwitchVRF &&
+        next.KillSwitchContainers == current.KillSwitchContainers && reflect.DeepEqual(next.ContainerExclusions, current.ContainerExclusions) &&
+        next.KillSwitchAllowEstablished == current.KillSwitchAllowEstablished && reflect.DeepEqual(next.KillSwitchLAN, current.KillSwitchLAN) &&
+        ks.AllowBypassProcesses == (len(next.BypassProcesses) > 0) {
+        return nil
+    }
+    
+    configure := func(ks *KillSwitch) {
+        ks.VRFName = next.KillSwitchVRF
+        ks.ProtectNamespaces = next.KillSwitchContainers
+        ks.NamespaceExclusions = next.ContainerExclusions
+        ks.AllowEstablished = next.KillSwitchAllowEstablished
+        ks.AllowLAN = next.KillSwitchLAN
+        ks.AllowBypassProcesses = len(next.BypassProcesses) > 0
+        ks.setEncap(next, vpn.listenPort)
+    }
+    switch {
+    case next.KillSwitch && ks.enabled.Load():
+        // A different VRF, set of containers or mode needs a different rule
+        // set, in place before the old one goes
+        if err := ks.Reconfigure(configure); err != nil {
+            return fmt.Errorf("%w: %w", ErrKillSwitchFailed, err)
+        }
+    case next.KillSwitch:
+        configure(ks)
+        if err := ks.Enable(); err != nil {
+            return fmt.Errorf("%w: %w", ErrKillSwitchFailed, err)
+        }
+    case ks.enabled.Load():
+        if err := ks.Disable(); err != nil {
+            return fmt.Errorf("failed to disable kill switch: %w", err)
+        }
+    }
+    return nil
+}
+
+func (vpn *UnderTheRadarVPN) reloadDNS(current, next VPNConfig) error {
+    dp := vpn.dnsProtector
+    
+    if !reflect.DeepEqual(next.DoHProviders, current.DoHProviders) || next.DNSQueryTimeout != current.DNSQueryTimeout {
+        if len(next.DoHProviders) > 0 {
+            dp.SetProviders(next.DoHProviders, next.DNSQueryTimeout)
+        } else {
+            dp.dohClient.SetTimeout(next.DNSQueryTimeout)
+            dp.dohClient.mu.Lock()
+            dp.dohClient.providers = nil
+            dp.dohClient.deriveProvidersLocked(next.DNSServers)
+            dp.dohClient.mu.Unlock()
+        }
+    }
+    
+    // A different mode, address or set of bootstrap addresses restarts the
+    // proxy, as do providers at bootstrap addresses, whose ports the
+    // firewall accepts
+    if next.DNSProxyOnly != current.DNSProxyOnly || next.DNSListenAddr != current.DNSListenAddr ||
+        !reflect.DeepEqual(next.BootstrapIPs, current.BootstrapIPs) ||
+        len(next.BootstrapIPs) > 0 && !reflect.DeepEqual(next.DoHProviders, current.DoHProviders) {
+        if dp.enabled.Load() {
+            if err := dp.Disable(); err != nil {
+                return fmt.Errorf("failed to disable DNS protection: %w", err)
+            }
+        }
+        dp.ProxyOnly, dp.ListenAddr, dp.BootstrapIPs = next.DNSProxyOnly, next.DNSListenAddr, next.BootstrapIPs
+    }
+    
+    // A different mechanism starts over from the system's own configuration
+    if next.DNSResolver != current.DNSResolver {
+        if err := dp.restoreResolver(); err != nil {
+            return err
+        }
+    }
+    resolverChanged := next.DNSResolver != current.DNSResolver || next.DNSSplit != current.DNSSplit ||
+        !reflect.DeepEqual(next.DNSSearchDomains, current.DNSSearchDomains)
+    dp.Interface = vpn.deviceName
+    dp.Resolver, dp.SearchDomains, dp.SplitDNS = next.DNSResolver, next.DNSSearchDomains, next.DNSSplit
+    
+    switch {
+    case next.DNSProtection && !dp.enabled.Load():
+        if err := dp.Enable(next.DNSServers); err != nil {
+            return fmt.Errorf("failed to enable DNS protection: %w", err)
+        }
+    case !next.DNSProtection && dp.enabled.Load():
+        if err := dp.Disable(); err != nil {
+            return fmt.Errorf("failed to disable DNS protection: %w", err)
+        }
+    case next.DNSProtection && !reflect.DeepEqual(next.DNSServers, current.DNSServers):
+        if err := dp.SetServers(next.DNSServers); err != nil {
+            return fmt.Errorf("failed to change DNS servers: %w", err)
+        }
+    case next.DNSProtection && !dp.ProxyOnly && resolverChanged:
+        if err := dp.applyResolver(dp.dnsServers); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// WatchSIGHUP reloads the configuration from path whenever the process
+// receives SIGHUP. Outcomes are reported as events. Call the returned
+// function to stop watching.
+func (vpn *UnderTheRadarVPN) WatchSIGHUP(path string, load ConfigLoader) (stop func()) {
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGHUP)
+    done := make(chan struct{})
+    
+    go func() {
+        for {
+            select {
+            case <-signals:
+                vpn.reloadFromFile(path, load)
+            case <-done:
+                return
+            }
+        }
+    }()
+    
+    return func() {
+        signal.Stop(signals)
+        close(done)
+    }
+}
+
+func (vpn *UnderTheRadarVPN) reloadFromFile(path string, load ConfigLoader) error {
+    config, err := load(path)
+    if err == nil {
+        err = vpn.Reload(config)
+    }
+    if err != nil {
+        vpn.emitEvent(Event{Type: EventReloadFailed, Message: fmt.Sprintf("%s: %v", path, err)})
+    }
+    return err
+}
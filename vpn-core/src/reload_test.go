@@ -0,0 +1,516 @@
+package main
+
+import (
+    "errors"
+    "net"
+    "os"
+    "reflect"
+    "strings"
+    "syscall"
+    "testing"
+    "time"
+)
+
+// Start a VPN on fakes whose firewall state can be inspected
+func startForReload(t *testing.T, config VPNConfig) (*UnderTheRadarVPN, *fakeWGClient, *fakeHost) {
+    t.Helper()
+    
+    wg := newFakeWGClient()
+    vpn, host := newHostTestVPN(t, wg)
+    // No DoH proxy on port 53 during tests
+    vpn.dnsProtector.dohClient.listenAddr = "127.0.0.1:0"
+    t.Cleanup(func() { vpn.dnsProtector.dohClient.Stop() })
+    
+    if err := vpn.Start(config); err != nil {
+        t.Fatal(err)
+    }
+    return vpn, wg, host
+}
+
+func TestReloadDNSServersKeepsSessions(t *testing.T) {
+    peer := PeerConfig{
+        PublicKey:  mustKey(t).PublicKey(),
+        Endpoint:   &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 51820},
+        AllowedIPs: []net.IPNet{mustCIDR(t, "10.8.0.0/24")},
+        SkipProbe:  true,
+    }
+    config := VPNConfig{
+        ListenPort:    51820,
+        Peers:         []PeerConfig{peer},
+        DNSProtection: true,
+        DNSServers:    []string{"1.1.1.1"},
+    }
+    vpn, wg, host := startForReload(t, config)
+    configsBefore := len(wg.configs)
+    
+    config.DNSServers = []string{"9.9.9.9"}
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    
+    // Resolver switched, other resolvers still blocked
+    for _, proto := range []string{"udp", "tcp"} {
+        if host.rules["iptables OUTPUT -p "+proto+" --dport 53 -d 9.9.9.9 -j ACCEPT"] != 1 {
+            t.Fatalf("no %s accept for the new server: %v", proto, host.rules)
+        }
+        if host.rules["iptables OUTPUT -p "+proto+" --dport 53 -d 1.1.1.1 -j ACCEPT"] != 0 {
+            t.Fatalf("%s accept for the old server left behind", proto)
+        }
+        if host.rules["iptables OUTPUT -p "+proto+" --dport 53 -j DROP"] != 1 {
+            t.Fatalf("%s DNS block lifted during reload", proto)
+        }
+    }
+    if got := vpn.dnsProtector.PrimaryProvider(); got != "https://9.9.9.9/dns-query" {
+        t.Fatalf("DoH provider = %s, want the new server's", got)
+    }
+    
+    // Device and peers untouched
+    if len(wg.configs) != configsBefore {
+        t.Fatalf("reload reconfigured the device: %+v", wg.configs[configsBefore:])
+    }
+    if !host.links["utr0"] {
+        t.Fatal("device was deleted")
+    }
+    if keys := wg.peerKeys("utr0"); !keys[peer.PublicKey] {
+        t.Fatal("peer session lost")
+    }
+    
+    select {
+    case ev := <-vpn.Events():
+        if ev.Type != EventConfigReloaded {
+            t.Fatalf("unexpected event %+v", ev)
+        }
+    default:
+        t.Fatal("expected a config reloaded event")
+    }
+}
+
+func TestReloadTogglesKillSwitch(t *testing.T) {
+    config := VPNConfig{ListenPort: 51820}
+    vpn, _, host := startForReload(t, config)
+    
+    config.KillSwitch = true
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    if host.rules["iptables OUTPUT -j DROP"] != 1 || !vpn.GetStatus().KillSwitch {
+        t.Fatalf("kill switch not enabled: %v", host.rules)
+    }
+    
+    // Unchanged settings are left alone
+    rules := len(host.rules)
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    if len(host.rules) != rules {
+        t.Fatal("reloading an identical config changed the firewall")
+    }
+    
+    config.KillSwitch = false
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    if len(host.rules) != 0 || vpn.GetStatus().KillSwitch {
+        t.Fatalf("rules left after disabling: %v", host.rules)
+    }
+}
+
+func TestReloadKillSwitchAddsNewRulesFirst(t *testing.T) {
+    config := VPNConfig{ListenPort: 51820, KillSwitch: true}
+    vpn, _, host := startForReload(t, config)
+    logged := len(host.commands())
+    
+    config.KillSwitchLAN = []net.IPNet{mustCIDR(t, "192.168.1.0/24")}
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    
+    // The old drop rule only goes once the new one is in place
+    commands := host.commands()[logged:]
+    added := indexOf(commands, "iptables -A OUTPUT -m comment --comment utr-killswitch -j DROP")
+    removed := indexOf(commands, "iptables -D OUTPUT -j DROP")
+    if added < 0 || removed < 0 || added > removed {
+        t.Fatalf("old rules removed before the new ones were added: %v", commands)
+    }
+    if host.rules["iptables OUTPUT -d 192.168.1.0/24 -m comment --comment utr-killswitch -j ACCEPT"] != 1 {
+        t.Fatalf("LAN rule missing: %v", host.rules)
+    }
+    for rule := range host.rules {
+        if !strings.Contains(rule, "utr-killswitch") {
+            t.Fatalf("old rule left behind: %s", rule)
+        }
+    }
+    
+    // The next change goes back to untagged rules
+    config.KillSwitchLAN = nil
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    if host.rules["iptables OUTPUT -j DROP"] != 1 || len(host.rules) == 0 {
+        t.Fatalf("kill switch not moved back: %v", host.rules)
+    }
+    for rule := range host.rules {
+        if strings.Contains(rule, "utr-killswitch") {
+            t.Fatalf("old rule left behind: %s", rule)
+        }
+    }
+}
+
+func TestReloadKillSwitchFailureKeepsOldRules(t *testing.T) {
+    config := VPNConfig{ListenPort: 51820, KillSwitch: true}
+    vpn, _, host := startForReload(t, config)
+    host.mu.Lock()
+    before := make(map[string]int)
+    for rule, n := range host.rules {
+        before[rule] = n
+    }
+    host.mu.Unlock()
+    
+    host.mu.Lock()
+    host.failOn = "192.168.1.0/24"
+    host.mu.Unlock()
+    changed := config
+    changed.KillSwitchLAN = []net.IPNet{mustCIDR(t, "192.168.1.0/24")}
+    if err := vpn.Reload(changed); !errors.Is(err, ErrKillSwitchFailed) {
+        t.Fatalf("err = %v, want ErrKillSwitchFailed", err)
+    }
+    if !reflect.DeepEqual(host.rules, before) {
+        t.Fatalf("rules changed by a failed reload:\n got %v\nwant %v", host.rules, before)
+    }
+    if !vpn.GetStatus().KillSwitch {
+        t.Fatal("kill switch off after a failed reload")
+    }
+    vpn.mu.RLock()
+    lan := vpn.config.KillSwitchLAN
+    vpn.mu.RUnlock()
+    if lan != nil {
+        t.Fatalf("failed config recorded: %v", lan)
+    }
+}
+
+func TestReloadRestartsWebhook(t *testing.T) {
+    config := VPNConfig{ListenPort: 51820}
+    vpn, _, _ := startForReload(t, config)
+    reporter := func() *WebhookReporter {
+        vpn.mu.RLock()
+        defer vpn.mu.RUnlock()
+        return vpn.webhook
+    }
+    
+    config.Webhook = WebhookConfig{Secret: NewSecret([]byte("k")), Interval: time.Hour}
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    first := reporter()
+    if first == nil || first.cfg.Interval != time.Hour {
+        t.Fatalf("webhook not started: %+v", first)
+    }
+    
+    // An equal secret in a new Secret is no change
+    config.Webhook.Secret = NewSecret([]byte("k"))
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    if reporter() != first {
+        t.Fatal("unchanged webhook restarted")
+    }
+    
+    config.Webhook.Interval = time.Minute
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    second := reporter()
+    if second == first || second.cfg.Interval != time.Minute {
+        t.Fatalf("webhook not reconfigured: %+v", second)
+    }
+    select {
+    case <-first.stop:
+    default:
+        t.Fatal("replaced webhook still running")
+    }
+    
+    config.Webhook = WebhookConfig{}
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    if reporter() != nil {
+        t.Fatal("webhook still running after removing its secret")
+    }
+}
+
+func TestReloadRestartsCaptivePortal(t *testing.T) {
+    config := VPNConfig{ListenPort: 51820}
+    vpn, _, _ := startForReload(t, config)
+    guard := func() *CaptivePortalGuard {
+        vpn.mu.RLock()
+        defer vpn.mu.RUnlock()
+        return vpn.captivePortal
+    }
+    
+    config.CaptivePortal = CaptivePortalConfig{Enabled: true, CheckInterval: time.Hour}
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    first := guard()
+    if first == nil || first.cfg.CheckInterval != time.Hour {
+        t.Fatalf("captive portal guard not started: %+v", first)
+    }
+    
+    config.CaptivePortal.DNSServers = []string{"192.168.1.1"}
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    second := guard()
+    if second == first || len(second.cfg.DNSServers) != 1 {
+        t.Fatalf("captive portal guard not reconfigured: %+v", second)
+    }
+    select {
+    case <-first.done:
+    default:
+        t.Fatal("replaced guard still running")
+    }
+    
+    config.CaptivePortal.Enabled = false
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    if guard() != nil {
+        t.Fatal("captive portal guard still running after disabling it")
+    }
+}
+
+func TestReloadRefusesCaptivePortalWithNFTables(t *testing.T) {
+    config := VPNConfig{ListenPort: 51820, FirewallBackend: FirewallNFTables, KillSwitch: true}
+    vpn, _, _ := startForReload(t, config)
+    
+    changed := config
+    changed.CaptivePortal = CaptivePortalConfig{Enabled: true}
+    var cfgErr *ConfigError
+    if err := vpn.Reload(changed); !errors.As(err, &cfgErr) {
+        t.Fatalf("err = %v, want a *ConfigError", err)
+    }
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    if vpn.captivePortal != nil || vpn.config.CaptivePortal.Enabled {
+        t.Fatal("refused captive portal was started")
+    }
+}
+
+func TestReloadReconfiguresMetrics(t *testing.T) {
+    config := VPNConfig{ListenPort: 51820}
+    vpn, _, _ := startForReload(t, config)
+    
+    config.Metrics = MetricsCollection{Interval: time.Minute, FullSyncEvery: 3}
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    vpn.metrics.mu.Lock()
+    cfg := vpn.metrics.cfg
+    vpn.metrics.mu.Unlock()
+    if cfg.Interval != time.Minute || cfg.FullSyncEvery != 3 || cfg.ActiveWindow != DefaultActiveWindow {
+        t.Fatalf("metrics collection not reconfigured: %+v", cfg)
+    }
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    if vpn.config.Metrics != config.Metrics {
+        t.Fatalf("applied config has %+v", vpn.config.Metrics)
+    }
+}
+
+func TestReloadUpdatesBypassProcesses(t *testing.T) {
+    config := VPNConfig{ListenPort: 51820, KillSwitch: true}
+    vpn, _, host := startForReload(t, config)
+    markAccepts := func() int {
+        host.mu.Lock()
+        defer host.mu.Unlock()
+        n := 0
+        for rule := range host.rules {
+            if strings.Contains(rule, "--mark 0x5550 ") {
+                n++
+            }
+        }
+        return n
+    }
+    
+    // Enabling it loads the LSM program, which tests can't
+    changed := config
+    changed.BypassProcesses = []string{"restic"}
+    if err := vpn.Reload(changed); err == nil {
+        t.Fatal("expected loading the LSM program to fail")
+    }
+    if n := markAccepts(); n != 0 {
+        t.Fatalf("kill switch accepts the bypass mark without the LSM program: %v", host.rules)
+    }
+    vpn.mu.Lock()
+    if vpn.config.BypassProcesses != nil {
+        t.Fatalf("failed bypass recorded: %v", vpn.config.BypassProcesses)
+    }
+    
+    // Pretend it loaded
+    entries := fakeBypassMap{commKey("restic"): 1}
+    pb := &ProcessBypass{processes: entries}
+    vpn.bypass = pb
+    vpn.config.BypassProcesses = changed.BypassProcesses
+    vpn.mu.Unlock()
+    
+    changed.BypassProcesses = []string{"borg", "node_exporter"}
+    if err := vpn.Reload(changed); err != nil {
+        t.Fatal(err)
+    }
+    if len(entries) != 2 || entries[commKey("borg")] != 1 || entries[commKey("node_exporter")] != 1 {
+        t.Fatalf("map entries %v", entries)
+    }
+    if n := markAccepts(); n != 2 {
+        t.Fatalf("bypass mark accepted by %d rules: %v", n, host.rules)
+    }
+    vpn.mu.RLock()
+    if vpn.bypass != pb {
+        t.Fatal("program reloaded instead of updated")
+    }
+    vpn.mu.RUnlock()
+    
+    changed.KillSwitch = false
+    if err := vpn.Reload(changed); err != nil {
+        t.Fatal(err)
+    }
+    if n := markAccepts(); n != 0 {
+        t.Fatalf("bypass mark still accepted: %v", host.rules)
+    }
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    if vpn.bypass != nil {
+        t.Fatal("bypass still loaded without the kill switch")
+    }
+}
+
+func TestReloadRestartsRemoteWrite(t *testing.T) {
+    config := VPNConfig{ListenPort: 51820}
+    vpn, _, _ := startForReload(t, config)
+    writer := func() *RemoteWriter {
+        vpn.mu.RLock()
+        defer vpn.mu.RUnlock()
+        return vpn.remoteWrite
+    }
+    
+    config.RemoteWrite = RemoteWriteConfig{URL: "http://127.0.0.1:1/v1/metrics", Interval: time.Hour, Labels: map[string]string{"region": "eu"}}
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    first := writer()
+    if first == nil || first.cfg.Interval != time.Hour {
+        t.Fatalf("remote write not started: %+v", first)
+    }
+    
+    // Equal labels in a new map are no change
+    config.RemoteWrite.Labels = map[string]string{"region": "eu"}
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    if writer() != first {
+        t.Fatal("unchanged remote write restarted")
+    }
+    
+    config.RemoteWrite.Labels["region"] = "us"
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    second := writer()
+    if second == first || second.cfg.Labels["region"] != "us" {
+        t.Fatalf("remote write not reconfigured: %+v", second)
+    }
+    select {
+    case <-first.stop:
+    default:
+        t.Fatal("replaced remote writer still running")
+    }
+    
+    config.RemoteWrite = RemoteWriteConfig{}
+    if err := vpn.Reload(config); err != nil {
+        t.Fatal(err)
+    }
+    if writer() != nil {
+        t.Fatal("remote write still running after removing its URL")
+    }
+}
+
+func TestReloadChecksConfig(t *testing.T) {
+    config := VPNConfig{ListenPort: 51820, KillSwitch: true, KillSwitchLAN: []net.IPNet{mustCIDR(t, "192.168.1.0/24")}}
+    vpn, _, host := startForReload(t, config)
+    commands := len(host.commands())
+    
+    changed := config
+    changed.DNSProtection = true
+    var cfgErr *ConfigError
+    if err := vpn.Reload(changed); !errors.As(err, &cfgErr) {
+        t.Fatalf("DNS protection without servers: %v, want a *ConfigError", err)
+    }
+    if vpn.GetStatus().DNSProtection {
+        t.Fatal("refused DNS protection enabled")
+    }
+    
+    // The same LAN with its address in 16 bytes is no change once normalized
+    lan := mustCIDR(t, "192.168.1.0/24")
+    lan.IP = net.ParseIP("192.168.1.0")
+    changed = config
+    changed.KillSwitchLAN = []net.IPNet{lan}
+    if err := vpn.Reload(changed); err != nil {
+        t.Fatal(err)
+    }
+    if got := host.commands()[commands:]; len(got) != 0 {
+        t.Fatalf("host changed: %v", got)
+    }
+}
+
+func TestReloadRefusesRestartOnlyChanges(t *testing.T) {
+    config := VPNConfig{ListenPort: 51820, DNSProtection: true, DNSServers: []string{"1.1.1.1"}}
+    vpn, _, host := startForReload(t, config)
+    
+    changed := config
+    changed.DNSServers = []string{"9.9.9.9"}
+    changed.Peers = []PeerConfig{{PublicKey: mustKey(t).PublicKey()}}
+    err := vpn.Reload(changed)
+    if !errors.Is(err, ErrRestartRequired) {
+        t.Fatalf("err = %v, want ErrRestartRequired", err)
+    }
+    if host.rules["iptables OUTPUT -p udp --dport 53 -d 1.1.1.1 -j ACCEPT"] != 1 {
+        t.Fatal("refused reload was partly applied")
+    }
+}
+
+func TestSIGHUPReloadsFromFile(t *testing.T) {
+    config := VPNConfig{ListenPort: 51820}
+    vpn, _, host := startForReload(t, config)
+    
+    loaded := make(chan string, 1)
+    stop := vpn.WatchSIGHUP("/etc/utr.conf", func(path string) (VPNConfig, error) {
+        loaded <- path
+        next := config
+        next.KillSwitch = true
+        return next, nil
+    })
+    defer stop()
+    
+    if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case path := <-loaded:
+        if path != "/etc/utr.conf" {
+            t.Fatalf("loaded %s", path)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("SIGHUP did not trigger a reload")
+    }
+    
+    select {
+    case ev := <-vpn.Events():
+        if ev.Type != EventConfigReloaded {
+            t.Fatalf("unexpected event %+v", ev)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("reload did not finish")
+    }
+    if host.rules["iptables OUTPUT -j DROP"] != 1 {
+        t.Fatal("reloaded config not applied")
+    }
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+    "bytes"
+    "compress/gzip"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+    "google.golang.org/protobuf/encoding/protojson"
+    "google.golang.org/protobuf/proto"
+)
+
+const (
+    DefaultRemoteWriteInterval   = 30 * time.Second
+    DefaultRemoteWriteBuffer     = 100000  // samples
+    DefaultRemoteWriteMaxPush    = 1 << 20 // bytes, gzipped
+    DefaultRemoteWriteMinBackoff = time.Second
+    DefaultRemoteWriteMaxBackoff = 5 * time.Minute
+)
+
+// RemoteWriteFormat is the encoding of a MetricsPush, see metricspush.proto
+type RemoteWriteFormat int
+
+const (
+    RemoteWriteJSON     RemoteWriteFormat = iota // proto3 JSON mapping
+    RemoteWriteProtobuf
+)
+
+// RemoteWriteConfig pushes the metrics the MetricSink gets to a collector,
+// for fleets too large to scrape. Pushes are gzipped MetricsPush messages
+// identified by the device public key fingerprint and Labels.
+type RemoteWriteConfig struct {
+    URL           string            // off when empty
+    Format        RemoteWriteFormat // default RemoteWriteJSON
+    Authorization *Secret           // Authorization header, e.g. "Bearer <token>"
+    Labels        map[string]string // sent with every push, e.g. region
+    Interval      time.Duration     // default DefaultRemoteWriteInterval
+    
+    // Samples kept while the collector is unreachable, default
+    // DefaultRemoteWriteBuffer. The oldest are dropped beyond it.
+    MaxBuffered   int
+    MaxPushBytes  int           // gzipped body size per request, default DefaultRemoteWriteMaxPush
+    MinBackoff    time.Duration // first wait after a failed push, doubled each failure
+    MaxBackoff    time.Duration
+}
+
+func (c RemoteWriteConfig) enabled() bool {
+    return c.URL != ""
+}
+
+func (c RemoteWriteConfig) equal(other RemoteWriteConfig) bool {
+    if len(c.Labels) != len(other.Labels) {
+        return false
+    }
+    for name, value := range c.Labels {
+        if v, ok := other.Labels[name]; !ok || v != value {
+            return false
+        }
+    }
+    return c.URL == other.URL && c.Format == other.Format && c.Authorization.Equal(other.Authorization) &&
+        c.Interval == other.Interval && c.MaxBuffered == other.MaxBuffered && c.MaxPushBytes == other.MaxPushBytes &&
+        c.MinBackoff == other.MinBackoff && c.MaxBackoff == other.MaxBackoff
+}
+
+func (c RemoteWriteConfig) withDefaults() RemoteWriteConfig {
+    if c.Interval <= 0 {
+        c.Interval = DefaultRemoteWriteInterval
+    }
+    if c.MaxBuffered <= 0 {
+        c.MaxBuffered = DefaultRemoteWriteBuffer
+    }
+    if c.MaxPushBytes <= 0 {
+        c.MaxPushBytes = DefaultRemoteWriteMaxPush
+    }
+    if c.MinBackoff <= 0 {
+        c.MinBackoff = DefaultRemoteWriteMinBackoff
+    }
+    if c.MaxBackoff < c.MinBackoff {
+        c.MaxBackoff = max(DefaultRemoteWriteMaxBackoff, c.MinBackoff)
+    }
+    return c
+}
+
+// RemoteWriteStats tells how pushing is going
+type RemoteWriteStats struct {
+    Pushed    uint64 // samples the collector accepted
+    Dropped   uint64 // samples lost to a full buffer, a rejected push or the size limit
+    Buffered  int    // samples waiting to be pushed
+    Failures  uint64 // failed pushes
+    LastError string
+}
+
+// RemoteWriter is a MetricSink that aggregates like OTLPSink, the last
+// value of each gauge and the sum of each counter, and every Interval
+// queues the aggregates as samples and pushes what is queued. Gauge and
+// Count only touch memory, so the metrics loop never waits for the
+// collector. Run Start in its own goroutine.
+type RemoteWriter struct {
+    cfg    RemoteWriteConfig
+    nodeID string
+    labels []*Label
+    clock  Clock
+    client *http.Client
+    
+    mu       sync.Mutex
+    gauges   map[otlpSeries]float64
+    counts   map[otlpSeries]int64
+    buffer   []*Sample // oldest first
+    stats    RemoteWriteStats
+    backoff  time.Duration
+    retryAt  time.Time
+    
+    pushMu   sync.Mutex // one push at a time
+    stop     chan struct{}
+    stopOnce sync.Once
+}
+
+func NewRemoteWriter(cfg RemoteWriteConfig, nodeID string, clock Clock) *RemoteWriter {
+    cfg = cfg.withDefaults()
+    w := &RemoteWriter{
+        cfg:    cfg,
+        nodeID: nodeID,
+        clock:  orRealClock(clock),
+        client: &http.Client{Timeout: 10 * time.Second},
+        gauges: make(map[otlpSeries]float64),
+        counts: make(map[otlpSeries]int64),
+        stop:   make(chan struct{}),
+    }
+    for name, value := range cfg.Labels {
+        w.labels = append(w.labels, &Label{Name: name, Value: value})
+    }
+    sort.Slice(w.labels, func(i, j int) bool { return w.labels[i].Name < w.labels[j].Name })
+    return w
+}
+
+// Node ID of a device, the start of the SHA-256 of its public key
+func publicKeyFingerprint(key wgtypes.Key) string {
+    sum := sha256.Sum256(key[:])
+    return hex.EncodeToString(sum[:8])
+}
+
+func (w *RemoteWriter) Gauge(name string, value float64, tags ...string) {
+    w.mu.Lock()
+    w.gauges[newOTLPSeries(name, tags)] = value
+    w.mu.Unlock()
+}
+
+func (w *RemoteWriter) Count(name string, delta int64, tags ...string) {
+    w.mu.Lock()
+    w.counts[newOTLPSeries(name, tags)] += delta
+    w.mu.Unlock()
+}
+
+func (w *RemoteWriter) Start() {
+    ticker := w.clock.NewTicker(w.cfg.Interval)
+    defer ticker.Stop()
+    
+    for {
+        select {
+        case <-ticker.C():
+            w.Flush()
+        case <-w.stop:
+            return
+        }
+    }
+}
+
+// Stop ends periodic pushing after one last attempt
+func (w *RemoteWriter) Stop() error {
+    return w.StopContext(context.Background())
+}
+
+// StopContext is Stop with the last attempt given up once ctx is done
+func (w *RemoteWriter) StopContext(ctx context.Context) error {
+    w.stopOnce.Do(func() { close(w.stop) })
+    return w.FlushContext(ctx)
+}
+
+// Stats returns the counters since NewRemoteWriter
+func (w *RemoteWriter) Stats() RemoteWriteStats {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    
+    stats := w.stats
+    stats.Buffered = len(w.buffer)
+    return stats
+}
+
+// Flush queues what has been aggregated and pushes the queue, unless a
+// failed push is still backing off
+func (w *RemoteWriter) Flush() error {
+    return w.FlushContext(context.Background())
+}
+
+// FlushContext is Flush with the push cancelled once ctx is done; the
+// samples stay buffered for the next one
+func (w *RemoteWriter) FlushContext(ctx context.Context) error {
+    w.queue()
+    return w.push(ctx)
+}
+
+// Turn the aggregates into samples at the end of the buffer
+func (w *RemoteWriter) queue() {
+    now := w.clock.Now().UnixMilli()
+    
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    
+    var samples []*Sample
+    for series, value := range w.gauges {
+        samples = append(samples, &Sample{Name: series.name, Labels: tagLabels(series.tags), Value: value, Kind: Sample_GAUGE, TimestampMs: now})
+    }
+    for series, delta := range w.counts {
+        samples = append(samples, &Sample{Name: series.name, Labels: tagLabels(series.tags), Value: float64(delta), Kind: Sample_COUNTER, TimestampMs: now})
+    }
+    sort.Slice(samples, func(i, j int) bool {
+        if samples[i].Name != samples[j].Name {
+            return samples[i].Name < samples[j].Name
+        }
+        return labelString(samples[i].Labels) < labelString(samples[j].Labels)
+    })
+    w.gauges = make(map[otlpSeries]float64)
+    w.counts = make(map[otlpSeries]int64)
+    w.enqueueLocked(samples, false)
+}
+
+// Add samples to the buffer, in front when they are older than what it
+// holds, and drop the oldest beyond MaxBuffered. Caller holds w.mu.
+func (w *RemoteWriter) enqueueLocked(samples []*Sample, front bool) {
+    if front {
+        w.buffer = append(append([]*Sample(nil), samples...), w.buffer...)
+    } else {
+        w.buffer = append(w.buffer, samples...)
+    }
+    if over := len(w.buffer) - w.cfg.MaxBuffered; over > 0 {
+        w.buffer = append([]*Sample(nil), w.buffer[over:]...)
+        w.stats.Dropped += uint64(over)
+    }
+}
+
+func (w *RemoteWriter) push(ctx context.Context) error {
+    w.pushMu.Lock()
+    defer w.pushMu.Unlock()
+    
+    w.mu.Lock()
+    if w.clock.Now().Before(w.retryAt) {
+        w.mu.Unlock()
+        return nil
+    }
+    pending := w.buffer
+    w.buffer = nil
+    w.mu.Unlock()
+    
+    for len(pending) > 0 {
+        n, body, err := w.encodeFitting(pending)
+        if err != nil {
+            w.fail(pending, 0, err)
+            return err
+        }
+        if n == 0 {
+            // One sample over the limit on its own
+            w.fail(pending, 1, nil)
+            pending = pending[1:]
+            continue
+        }
+        if retry, err := w.post(ctx, body); err != nil {
+            err = fmt.Errorf("failed to push metrics to %s: %w", w.cfg.URL, err)
+            if retry {
+                w.fail(pending, 0, err)
+            } else {
+                w.fail(pending, n, err)
+            }
+            return err
+        }
+        
+        w.mu.Lock()
+        w.stats.Pushed += uint64(n)
+        w.backoff = 0
+        w.mu.Unlock()
+        pending = pending[n:]
+    }
+    return nil
+}
+
+// Put pending back into the buffer less the first dropped samples and,
+// for a failed push, back off
+func (w *RemoteWriter) fail(pending []*Sample, dropped int, err error) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    
+    w.stats.Dropped += uint64(dropped)
+    w.enqueueLocked(pending[dropped:], true)
+    if err == nil {
+        return
+    }
+    w.stats.Failures++
+    w.stats.LastError = err.Error()
+    if w.backoff == 0 {
+        w.backoff = w.cfg.MinBackoff
+    } else {
+        w.backoff = min(2*w.backoff, w.cfg.MaxBackoff)
+    }
+    w.retryAt = w.clock.Now().Add(w.backoff)
+}
+
+// Encode as many of the first samples as fit in MaxPushBytes, zero when not
+// even one does
+func (w *RemoteWriter) encodeFitting(samples []*Sample) (int, []byte, error) {
+    n := len(samples)
+    for {
+        body, err := w.encode(samples[:n])
+        if err != nil {
+            return 0, nil, err
+        }
+        if len(body) <= w.cfg.MaxPushBytes {
+            return n, body, nil
+        }
+        if n == 1 {
+            return 0, nil, nil
+        }
+        // Compression isn't linear, so shrink by at least half as often as
+        // it takes
+        n = min(n/2, n*w.cfg.MaxPushBytes/len(body))
+        n = max(n, 1)
+    }
+}
+
+func (w *RemoteWriter) encode(samples []*Sample) ([]byte, error) {
+    w.mu.Lock()
+    msg := &MetricsPush{NodeId: w.nodeID, Labels: w.labels, Samples: samples, Dropped: w.stats.Dropped}
+    w.mu.Unlock()
+    
+    var raw []byte
+    var err error
+    if w.cfg.Format == RemoteWriteProtobuf {
+        raw, err = proto.Marshal(msg)
+    } else {
+        raw, err = protojson.Marshal(msg)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to encode metrics: %w", err)
+    }
+    
+    var b bytes.Buffer
+    zw := gzip.NewWriter(&b)
+    zw.Write(raw)
+    if err := zw.Close(); err != nil {
+        return nil, fmt.Errorf("failed to compress metrics: %w", err)
+    }
+    return b.Bytes(), nil
+}
+
+// retry reports whether the failure may be temporary
+func (w *RemoteWriter) post(ctx context.Context, body []byte) (retry bool, err error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+    if err != nil {
+        return false, err
+    }
+    if w.cfg.Format == RemoteWriteProtobuf {
+        req.Header.Set("Content-Type", "application/x-protobuf")
+    } else {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    req.Header.Set("Content-Encoding", "gzip")
+    if w.cfg.Authorization != nil {
+        req.Header.Set("Authorization", string(w.cfg.Authorization.Bytes()))
+    }
+    
+    resp, err := w.client.Do(req)
+    if err != nil {
+        return true, err
+    }
+    resp.Body.Close()
+    
+    switch {
+    case resp.StatusCode >= 200 && resp.StatusCode < 300:
+        return false, nil
+    case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+        return true, fmt.Errorf("server error: %s", resp.Status)
+    default:
+        return false, fmt.Errorf("unexpected status: %s", resp.Status)
+    }
+}
+
+// Tags "key:value" as labels, a tag without a colon is a name with an
+// empty value
+func tagLabels(tags string) []*Label {
+    if tags == "" {
+        return nil
+    }
+    var labels []*Label
+    for _, tag := range strings.Split(tags, ",") {
+        name, value, _ := strings.Cut(tag, ":")
+        labels = append(labels, &Label{Name: name, Value: value})
+    }
+    return labels
+}
+
+func labelString(labels []*Label) string {
+    var b strings.Builder
+    for _, l := range labels {
+        b.WriteString(l.Name)
+        b.WriteByte(':')
+        b.WriteString(l.Value)
+        b.WriteByte(',')
+    }
+    return b.String()
+}
+
+// Tee metrics to the remote writer, if any, besides the configured sink
+type teeSink []MetricSink
+
+func (t teeSink) Gauge(name string, value float64, tags ...string) {
+    for _, sink := range t {
+        sink.Gauge(name, value, tags...)
+    }
+}
+
+func (t teeSink) Count(name string, delta int64, tags ...string) {
+    for _, sink := range t {
+        sink.Count(name, delta, tags...)
+    }
+}
+
+// RemoteWriteStats reports on pushing to VPNConfig.RemoteWrite, zero when
+// it is off
+func (vpn *UnderTheRadarVPN) RemoteWriteStats() RemoteWriteStats {
+    vpn.mu.RLock()
+    w := vpn.remoteWrite
+    vpn.mu.RUnlock()
+    
+    if w == nil {
+        return RemoteWriteStats{}
+    }
+    return w.Stats()
+}
+
+// Start pushing metrics, called by Start when a URL is configured
+func (vpn *UnderTheRadarVPN) startRemoteWrite(cfg RemoteWriteConfig) {
+    key := vpn.privateKey().Key()
+    nodeID := publicKeyFingerprint(key.PublicKey())
+    wipe(key[:])
+    
+    w := NewRemoteWriter(cfg, nodeID, vpn.clock())
+    vpn.mu.Lock()
+    vpn.remoteWrite = w
+    vpn.mu.Unlock()
+    go w.Start()
+}
+
+// The last push is given up once ctx is done
+func (vpn *UnderTheRadarVPN) stopRemoteWrite(ctx context.Context) {
+    vpn.mu.Lock()
+    w := vpn.remoteWrite
+    vpn.remoteWrite = nil
+    vpn.mu.Unlock()
+    
+    if w != nil {
+        w.StopContext(ctx)
+    }
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+    "compress/gzip"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+    "time"
+    
+    "google.golang.org/protobuf/encoding/protojson"
+    "google.golang.org/protobuf/proto"
+)
+
+// Collector decoding pushes, answering with status while it is not 200
+type fakeCollector struct {
+    t      *testing.T
+    format RemoteWriteFormat
+    
+    mu     sync.Mutex
+    status int
+    pushes []*MetricsPush
+}
+
+func startFakeCollector(t *testing.T, format RemoteWriteFormat) (*fakeCollector, string) {
+    c := &fakeCollector{t: t, format: format, status: http.StatusOK}
+    srv := httptest.NewServer(c)
+    t.Cleanup(srv.Close)
+    return c, srv.URL
+}
+
+func (c *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.status != http.StatusOK {
+        w.WriteHeader(c.status)
+        return
+    }
+    
+    if r.Header.Get("Content-Encoding") != "gzip" || r.Header.Get("Authorization") != "Bearer t" {
+        c.t.Errorf("headers: %v", r.Header)
+    }
+    zr, err := gzip.NewReader(r.Body)
+    if err != nil {
+        c.t.Error(err)
+        return
+    }
+    raw, _ := io.ReadAll(zr)
+    push := &MetricsPush{}
+    if c.format == RemoteWriteProtobuf {
+        err = proto.Unmarshal(raw, push)
+    } else {
+        err = protojson.Unmarshal(raw, push)
+    }
+    if err != nil {
+        c.t.Errorf("undecodable push %q: %v", raw, err)
+    }
+    c.pushes = append(c.pushes, push)
+}
+
+func (c *fakeCollector) setStatus(status int) {
+    c.mu.Lock()
+    c.status = status
+    c.mu.Unlock()
+}
+
+func (c *fakeCollector) samples() []*Sample {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    var samples []*Sample
+    for _, push := range c.pushes {
+        samples = append(samples, push.Samples...)
+    }
+    return samples
+}
+
+func testAuth(t *testing.T) *Secret {
+    s := NewSecret([]byte("Bearer t"))
+    t.Cleanup(s.Zeroize)
+    return s
+}
+
+func TestRemoteWriterPushes(t *testing.T) {
+    for _, format := range []RemoteWriteFormat{RemoteWriteJSON, RemoteWriteProtobuf} {
+        collector, url := startFakeCollector(t, format)
+        w := NewRemoteWriter(RemoteWriteConfig{
+            URL:           url,
+            Format:        format,
+            Authorization: testAuth(t),
+            Labels:        map[string]string{"region": "eu", "dc": "fra1"},
+        }, "00112233", NewFakeClock(time.Unix(1000, 0)))
+        
+        w.Gauge("peer.latency_ms", 3, "peer:abc")
+        w.Gauge("peer.latency_ms", 4.5, "peer:abc")
+        w.Count("peer.rx_bytes", 5, "peer:abc", "group:eu")
+        w.Count("peer.rx_bytes", 2, "group:eu", "peer:abc")
+        if err := w.Flush(); err != nil {
+            t.Fatal(err)
+        }
+        
+        push := collector.pushes[0]
+        if push.NodeId != "00112233" || len(push.Labels) != 2 || push.Labels[0].Name != "dc" {
+            t.Fatalf("identity %v %v", push.NodeId, push.Labels)
+        }
+        samples := collector.samples()
+        if len(samples) != 2 {
+            t.Fatalf("samples %v", samples)
+        }
+        if s := samples[0]; s.Name != "peer.latency_ms" || s.Kind != Sample_GAUGE || s.Value != 4.5 || s.TimestampMs != 1000000 {
+            t.Fatalf("gauge %v", s)
+        }
+        if s := samples[1]; s.Kind != Sample_COUNTER || s.Value != 7 || len(s.Labels) != 2 || s.Labels[0].Name != "group" {
+            t.Fatalf("counter %v", s)
+        }
+        
+        // Nothing new, nothing sent
+        if err := w.Flush(); err != nil || len(collector.pushes) != 1 {
+            t.Fatalf("empty flush: %v, %d pushes", err, len(collector.pushes))
+        }
+    }
+}
+
+func TestRemoteWriterBuffersThroughOutage(t *testing.T) {
+    collector, url := startFakeCollector(t, RemoteWriteJSON)
+    clock := NewFakeClock(time.Unix(1000, 0))
+    w := NewRemoteWriter(RemoteWriteConfig{URL: url, Authorization: testAuth(t), MaxBuffered: 3, MinBackoff: time.Minute}, "n", clock)
+    
+    collector.setStatus(http.StatusServiceUnavailable)
+    w.Count("a", 1)
+    if err := w.Flush(); err == nil {
+        t.Fatal("expected an error from a 503")
+    }
+    
+    // Backing off: queued but not sent, the oldest dropped past MaxBuffered
+    for _, name := range []string{"b", "c", "d"} {
+        clock.Advance(10 * time.Second)
+        w.Count(name, 1)
+        if err := w.Flush(); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if stats := w.Stats(); stats.Failures != 1 || stats.Dropped != 1 || stats.Buffered != 3 || stats.LastError == "" {
+        t.Fatalf("stats during outage %+v", stats)
+    }
+    
+    collector.setStatus(http.StatusOK)
+    clock.Advance(time.Minute)
+    if err := w.Flush(); err != nil {
+        t.Fatal(err)
+    }
+    samples := collector.samples()
+    if len(samples) != 3 || samples[0].Name != "b" || samples[2].Name != "d" {
+        t.Fatalf("pushed %v", samples)
+    }
+    if push := collector.pushes[0]; push.Dropped != 1 {
+        t.Fatalf("push reports %d dropped", push.Dropped)
+    }
+    if stats := w.Stats(); stats.Pushed != 3 || stats.Buffered != 0 {
+        t.Fatalf("stats after outage %+v", stats)
+    }
+}
+
+func TestRemoteWriterSplitsLargePushes(t *testing.T) {
+    collector, url := startFakeCollector(t, RemoteWriteProtobuf)
+    w := NewRemoteWriter(RemoteWriteConfig{URL: url, Format: RemoteWriteProtobuf, Authorization: testAuth(t), MaxPushBytes: 2048}, "n", nil)
+    
+    for i := 0; i < 500; i++ {
+        w.Gauge("peer.load_score", float64(i), "peer:"+mustKey(t).PublicKey().String())
+    }
+    if err := w.Flush(); err != nil {
+        t.Fatal(err)
+    }
+    if len(collector.pushes) < 2 || len(collector.samples()) != 500 {
+        t.Fatalf("%d pushes with %d samples", len(collector.pushes), len(collector.samples()))
+    }
+}
+
+func TestRemoteWriteFollowsConfig(t *testing.T) {
+    vpn, _, _ := startForReload(t, VPNConfig{ListenPort: 51820})
+    if _, tee := vpn.metricSink().(teeSink); tee {
+        t.Fatal("metrics pushed without a URL")
+    }
+    vpn.Stop()
+    
+    _, url := startFakeCollector(t, RemoteWriteJSON)
+    vpn, _, _ = startForReload(t, VPNConfig{ListenPort: 51820, RemoteWrite: RemoteWriteConfig{URL: url}})
+    if _, tee := vpn.metricSink().(teeSink); !tee {
+        t.Fatal("metrics not teed to the remote writer")
+    }
+    if vpn.remoteWrite.nodeID != publicKeyFingerprint(vpn.privateKey().Key().PublicKey()) {
+        t.Fatalf("node ID %s", vpn.remoteWrite.nodeID)
+    }
+}
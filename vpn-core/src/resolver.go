@@ -0,0 +1,365 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/fs"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+)
+
+// ResolverMode selects how the system is pointed at the tunnel's DNS servers
+type ResolverMode string
+
+const (
+    ResolverAuto       ResolverMode = ""                 // detect, see detectResolver
+    ResolverSystemd    ResolverMode = "systemd-resolved" // per-link through resolvectl, split DNS capable
+    ResolverResolvconf ResolverMode = "resolvconf"
+    ResolverFile       ResolverMode = "resolv.conf" // rewrite it, keeping the original next to it
+    ResolverUnmanaged  ResolverMode = "unmanaged"   // leave system DNS alone, firewall only
+)
+
+// First line of a resolv.conf we wrote, followed by the interface
+const resolvConfMarker = "# Generated by undertheradar-vpn for "
+
+// Tests replace these
+var (
+    resolvConfPath     = "/etc/resolv.conf"
+    resolvedRuntimeDir = "/run/systemd/resolve"
+    resolverStateDir   = defaultLockDir
+    lookPath           = exec.LookPath
+    resolvconfAdd      = func(record string, content []byte) error {
+        cmd := exec.Command("resolvconf", "-a", record, "-m", "0", "-x")
+        cmd.Stdin = bytes.NewReader(content)
+        if out, err := cmd.CombinedOutput(); err != nil {
+            return fmt.Errorf("resolvconf: %w: %s", err, strings.TrimSpace(string(out)))
+        }
+        return nil
+    }
+)
+
+// ResolverStatus is the DNS configuration applied to the system, see
+// Status.DNS
+type ResolverStatus struct {
+    Mechanism ResolverMode // empty while nothing is applied
+    Interface string
+    Servers   []string
+    Domains   []string
+    SplitDNS  bool // only queries for Domains go to Servers
+}
+
+// systemd-resolved when resolv.conf is its stub, else resolvconf when
+// installed, else the file itself
+func detectResolver() ResolverMode {
+    if target, err := filepath.EvalSymlinks(resolvConfPath); err == nil && strings.HasPrefix(target, resolvedRuntimeDir+"/") {
+        if _, err := lookPath("resolvectl"); err == nil {
+            return ResolverSystemd
+        }
+    }
+    if _, err := lookPath("resolvconf"); err == nil {
+        return ResolverResolvconf
+    }
+    return ResolverFile
+}
+
+// What applyResolver would do, for PlanStart
+func (dp *DNSProtector) planResolver(servers []string) {
+    if dp.Resolver == ResolverUnmanaged || dp.Interface == "" {
+        return
+    }
+    mode := dp.Resolver
+    if mode == ResolverAuto {
+        mode = detectResolver()
+        defer dp.plan.assume(fmt.Sprintf("%s is still the system resolver", mode))()
+    }
+    dp.plan.note(ChangeResolver, "point %s at %s for %s", mode, strings.Join(servers, ", "), dp.Interface)
+}
+
+// Point the system at servers through the configured mechanism. The first
+// call cleans up after a previous run that died without restoring.
+func (dp *DNSProtector) applyResolver(servers []string) error {
+    if dp.Resolver == ResolverUnmanaged || dp.Interface == "" {
+        return nil
+    }
+    
+    dp.mu.Lock()
+    mode := dp.resolver.Mechanism
+    dp.mu.Unlock()
+    fresh := mode == ""
+    if fresh {
+        if err := cleanStaleResolver(dp.Interface, dp.commands); err != nil {
+            return fmt.Errorf("failed to clean up stale DNS configuration: %w", err)
+        }
+        if mode = dp.Resolver; mode == ResolverAuto {
+            mode = detectResolver()
+        }
+    }
+    
+    status := ResolverStatus{
+        Mechanism: mode,
+        Interface: dp.Interface,
+        Servers:   servers,
+        Domains:   dp.SearchDomains,
+        SplitDNS:  dp.SplitDNS && mode == ResolverSystemd,
+    }
+    // Recorded first, so a crash halfway is cleaned up too
+    if err := saveResolverState(status); err != nil {
+        return err
+    }
+    
+    var err error
+    switch mode {
+    case ResolverSystemd:
+        err = applyResolved(dp.commands, status)
+    case ResolverResolvconf:
+        err = resolvconfAdd("tun."+status.Interface, resolvConfContent(status))
+    case ResolverFile:
+        err = writeResolvConf(status)
+    default:
+        err = fmt.Errorf("unknown resolver %q", mode)
+    }
+    if err != nil {
+        if fresh {
+            revertResolver(status, dp.commands)
+            os.Remove(resolverStatePath(status.Interface))
+        }
+        return fmt.Errorf("failed to configure DNS through %s: %w", mode, err)
+    }
+    
+    dp.mu.Lock()
+    dp.resolver = status
+    dp.mu.Unlock()
+    return nil
+}
+
+// Put back the system's DNS configuration as it was before applyResolver
+func (dp *DNSProtector) restoreResolver() error {
+    dp.mu.Lock()
+    status := dp.resolver
+    dp.resolver = ResolverStatus{}
+    dp.mu.Unlock()
+    
+    if status.Mechanism == "" {
+        return nil
+    }
+    if err := revertResolver(status, dp.commands); err != nil {
+        return fmt.Errorf("failed to restore DNS configuration: %w", err)
+    }
+    os.Remove(resolverStatePath(status.Interface))
+    return nil
+}
+
+// ResolverStatus is the DNS configuration currently applied to the system
+func (dp *DNSProtector) ResolverStatus() ResolverStatus {
+    dp.mu.Lock()
+    defer dp.mu.Unlock()
+    return dp.resolver
+}
+
+func applyResolved(commands CommandRunner, status ResolverStatus) error {
+    iface := status.Interface
+    
+    // ~. routes every query without a more specific domain to the link
+    domains := append([]string(nil), status.Domains...)
+    if !status.SplitDNS {
+        domains = append(domains, "~.")
+    }
+    cmds := []string{
+        fmt.Sprintf("resolvectl dns %s %s", iface, strings.Join(status.Servers, " ")),
+        fmt.Sprintf("resolvectl domain %s %s", iface, strings.Join(domains, " ")),
+        fmt.Sprintf("resolvectl default-route %s %t", iface, !status.SplitDNS),
+    }
+    for _, cmd := range cmds {
+        if err := commands.Run(cmd); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func revertResolver(status ResolverStatus, commands CommandRunner) error {
+    switch status.Mechanism {
+    case ResolverSystemd:
+        return commands.Run("resolvectl revert " + status.Interface)
+    case ResolverResolvconf:
+        return commands.Run(fmt.Sprintf("resolvconf -d tun.%s -f", status.Interface))
+    case ResolverFile:
+        return restoreResolvConf(status.Interface)
+    }
+    return nil
+}
+
+// Undo what a previous run recorded, and a resolv.conf of ours even when
+// the record is gone, e.g. /run was cleared by a reboot
+func cleanStaleResolver(iface string, commands CommandRunner) error {
+    data, err := os.ReadFile(resolverStatePath(iface))
+    switch {
+    case err == nil:
+        var stale ResolverStatus
+        if err := json.Unmarshal(data, &stale); err != nil {
+            return fmt.Errorf("invalid resolver state %s: %w", resolverStatePath(iface), err)
+        }
+        if err := revertResolver(stale, commands); err != nil {
+            return err
+        }
+        os.Remove(resolverStatePath(iface))
+    case !errors.Is(err, fs.ErrNotExist):
+        return err
+    }
+    return restoreResolvConf(iface)
+}
+
+func resolverStatePath(iface string) string {
+    return filepath.Join(resolverStateDir, iface+".dns")
+}
+
+func saveResolverState(status ResolverStatus) error {
+    data, err := json.Marshal(status)
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(resolverStateDir, 0o755); err != nil {
+        return fmt.Errorf("failed to create %s: %w", resolverStateDir, err)
+    }
+    if err := os.WriteFile(resolverStatePath(status.Interface), data, 0o600); err != nil {
+        return fmt.Errorf("failed to save resolver state: %w", err)
+    }
+    return nil
+}
+
+func resolvConfContent(status ResolverStatus) []byte {
+    var b strings.Builder
+    for _, server := range status.Servers {
+        fmt.Fprintf(&b, "nameserver %s\n", server)
+    }
+    if len(status.Domains) > 0 {
+        fmt.Fprintf(&b, "search %s\n", strings.Join(status.Domains, " "))
+    }
+    return []byte(b.String())
+}
+
+// The original resolv.conf, a symlink or a file, kept on disk rather than
+// in /run so it survives a reboot with ours still in place
+type resolvConfBackup struct {
+    Link    string      `json:"link,omitempty"`
+    Content []byte      `json:"content,omitempty"`
+    Mode    fs.FileMode `json:"mode,omitempty"`
+}
+
+func resolvConfBackupPath() string {
+    return resolvConfPath + ".undertheradar"
+}
+
+// Interface of the instance that wrote resolv.conf, empty if not ours
+func resolvConfOwner() string {
+    data, err := os.ReadFile(resolvConfPath)
+    if err != nil {
+        return ""
+    }
+    first, _, _ := strings.Cut(string(data), "\n")
+    owner, ok := strings.CutPrefix(first, resolvConfMarker)
+    if !ok {
+        return ""
+    }
+    return owner
+}
+
+func ownsResolvConf(iface string) bool {
+    return resolvConfOwner() == iface
+}
+
+// Replace resolv.conf, backing up the original unless it is already ours.
+// There is one backup, so only one tunnel can manage the file.
+func writeResolvConf(status ResolverStatus) error {
+    switch owner := resolvConfOwner(); owner {
+    case status.Interface:
+    case "":
+        var backup resolvConfBackup
+        info, err := os.Lstat(resolvConfPath)
+        switch {
+        case err == nil && info.Mode()&fs.ModeSymlink != 0:
+            if backup.Link, err = os.Readlink(resolvConfPath); err != nil {
+                return err
+            }
+        case err == nil:
+            if backup.Content, err = os.ReadFile(resolvConfPath); err != nil {
+                return err
+            }
+            backup.Mode = info.Mode().Perm()
+        case !errors.Is(err, fs.ErrNotExist):
+            return err
+        }
+        data, err := json.Marshal(backup)
+        if err != nil {
+            return err
+        }
+        if err := os.WriteFile(resolvConfBackupPath(), data, 0o600); err != nil {
+            return fmt.Errorf("failed to back up %s: %w", resolvConfPath, err)
+        }
+    default:
+        return fmt.Errorf("%s is managed for %s", resolvConfPath, owner)
+    }
+    
+    content := append([]byte(resolvConfMarker+status.Interface+"\n"), resolvConfContent(status)...)
+    return replaceFile(resolvConfPath, content, 0o644)
+}
+
+// Put the backed up resolv.conf back if ours is still in place. One that
+// was replaced since is left alone, its owner knows better.
+func restoreResolvConf(iface string) error {
+    data, err := os.ReadFile(resolvConfBackupPath())
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    var backup resolvConfBackup
+    if err := json.Unmarshal(data, &backup); err != nil {
+        return fmt.Errorf("invalid backup %s: %w", resolvConfBackupPath(), err)
+    }
+    
+    if ownsResolvConf(iface) {
+        switch {
+        case backup.Link != "":
+            if err := os.Remove(resolvConfPath); err != nil {
+                return err
+            }
+            if err := os.Symlink(backup.Link, resolvConfPath); err != nil {
+                return fmt.Errorf("failed to restore %s: %w", resolvConfPath, err)
+            }
+        case backup.Mode != 0:
+            if err := replaceFile(resolvConfPath, backup.Content, backup.Mode); err != nil {
+                return err
+            }
+        default:
+            // There was none
+            if err := os.Remove(resolvConfPath); err != nil {
+                return err
+            }
+        }
+    }
+    return os.Remove(resolvConfBackupPath())
+}
+
+// Write through a temporary file so readers never see half a file, and a
+// symlink is replaced rather than written through
+func replaceFile(path string, content []byte, mode fs.FileMode) error {
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, content, mode); err != nil {
+        return fmt.Errorf("failed to write %s: %w", path, err)
+    }
+    if err := os.Chmod(tmp, mode); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        os.Remove(tmp)
+        return fmt.Errorf("failed to replace %s: %w", path, err)
+    }
+    return nil
+}
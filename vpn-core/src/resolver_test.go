@@ -0,0 +1,205 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// Start each test from a plain resolv.conf and no saved state
+func resetResolverFiles(t *testing.T, original string) {
+    t.Helper()
+    
+    for _, path := range []string{resolvConfPath, resolvConfBackupPath(), resolverStatePath("utr0")} {
+        os.Remove(path)
+    }
+    if original != "" {
+        if err := os.WriteFile(resolvConfPath, []byte(original), 0o640); err != nil {
+            t.Fatal(err)
+        }
+    }
+    t.Cleanup(func() {
+        for _, path := range []string{resolvConfPath, resolvConfBackupPath(), resolverStatePath("utr0")} {
+            os.Remove(path)
+        }
+    })
+}
+
+func newResolverProtector(mode ResolverMode) *DNSProtector {
+    dp := NewDNSProtector()
+    dp.ListenAddr = "127.0.0.1:0"
+    dp.Interface = "utr0"
+    dp.Resolver = mode
+    dp.SearchDomains = []string{"corp.example"}
+    return dp
+}
+
+func TestResolverFileRestoresOriginal(t *testing.T) {
+    installFakeHost(t, "")
+    original := "# from DHCP\nnameserver 192.168.1.1\n"
+    resetResolverFiles(t, original)
+    
+    dp := newResolverProtector(ResolverAuto)
+    if err := dp.Enable([]string{"10.8.0.1", "10.8.0.2"}); err != nil {
+        t.Fatal(err)
+    }
+    
+    data, _ := os.ReadFile(resolvConfPath)
+    want := resolvConfMarker + "utr0\nnameserver 10.8.0.1\nnameserver 10.8.0.2\nsearch corp.example\n"
+    if string(data) != want {
+        t.Fatalf("resolv.conf = %q, want %q", data, want)
+    }
+    status := dp.ResolverStatus()
+    if status.Mechanism != ResolverFile || status.SplitDNS || !reflect.DeepEqual(status.Domains, []string{"corp.example"}) {
+        t.Errorf("status = %+v", status)
+    }
+    
+    // The captive portal still finds the network's own resolver
+    if servers, err := resolvConfServers(); err != nil || !reflect.DeepEqual(servers, []string{"192.168.1.1"}) {
+        t.Errorf("local resolvers = %v, %v", servers, err)
+    }
+    
+    // New servers rewrite ours without touching the backup
+    if err := dp.SetServers([]string{"10.8.0.3"}); err != nil {
+        t.Fatal(err)
+    }
+    if data, _ := os.ReadFile(resolvConfPath); !strings.Contains(string(data), "nameserver 10.8.0.3\n") {
+        t.Fatalf("resolv.conf after SetServers = %q", data)
+    }
+    
+    if err := dp.Disable(); err != nil {
+        t.Fatal(err)
+    }
+    data, _ = os.ReadFile(resolvConfPath)
+    info, _ := os.Stat(resolvConfPath)
+    if string(data) != original || info.Mode().Perm() != 0o640 {
+        t.Fatalf("restored %q with mode %v", data, info.Mode().Perm())
+    }
+    for _, path := range []string{resolvConfBackupPath(), resolverStatePath("utr0")} {
+        if _, err := os.Stat(path); !os.IsNotExist(err) {
+            t.Errorf("%s left behind", path)
+        }
+    }
+    if status := dp.ResolverStatus(); status.Mechanism != "" {
+        t.Errorf("status after Disable = %+v", status)
+    }
+}
+
+func TestResolverFileRestoresSymlink(t *testing.T) {
+    installFakeHost(t, "")
+    resetResolverFiles(t, "")
+    target := filepath.Join(filepath.Dir(resolvConfPath), "nm-resolv.conf")
+    os.WriteFile(target, []byte("nameserver 192.168.1.1\n"), 0o644)
+    defer os.Remove(target)
+    if err := os.Symlink(target, resolvConfPath); err != nil {
+        t.Fatal(err)
+    }
+    
+    dp := newResolverProtector(ResolverFile)
+    if err := dp.Enable([]string{"10.8.0.1"}); err != nil {
+        t.Fatal(err)
+    }
+    // Replaced, not written through
+    if data, _ := os.ReadFile(target); string(data) != "nameserver 192.168.1.1\n" {
+        t.Fatalf("symlink target modified: %q", data)
+    }
+    if err := dp.Disable(); err != nil {
+        t.Fatal(err)
+    }
+    if link, err := os.Readlink(resolvConfPath); err != nil || link != target {
+        t.Fatalf("resolv.conf not restored as a symlink: %q, %v", link, err)
+    }
+}
+
+func TestResolverSystemdSplitDNS(t *testing.T) {
+    commands := recordSystemCommands(t)
+    resetResolverFiles(t, "")
+    os.MkdirAll(resolvedRuntimeDir, 0o755)
+    stub := filepath.Join(resolvedRuntimeDir, "stub-resolv.conf")
+    os.WriteFile(stub, []byte("nameserver 127.0.0.53\n"), 0o644)
+    if err := os.Symlink(stub, resolvConfPath); err != nil {
+        t.Fatal(err)
+    }
+    orig := lookPath
+    lookPath = func(file string) (string, error) { return "/usr/bin/" + file, nil }
+    defer func() { lookPath = orig }()
+    
+    dp := newResolverProtector(ResolverAuto)
+    dp.SplitDNS = true
+    if err := dp.Enable([]string{"10.8.0.1"}); err != nil {
+        t.Fatal(err)
+    }
+    if status := dp.ResolverStatus(); status.Mechanism != ResolverSystemd || !status.SplitDNS {
+        t.Fatalf("status = %+v", status)
+    }
+    for _, want := range []string{
+        "resolvectl dns utr0 10.8.0.1",
+        "resolvectl domain utr0 corp.example",
+        "resolvectl default-route utr0 false",
+    } {
+        if !containsCommand(*commands, want) {
+            t.Errorf("missing %q in %v", want, *commands)
+        }
+    }
+    if link, _ := os.Readlink(resolvConfPath); link != stub {
+        t.Error("resolv.conf touched with systemd-resolved")
+    }
+    
+    if err := dp.Disable(); err != nil {
+        t.Fatal(err)
+    }
+    if !containsCommand(*commands, "resolvectl revert utr0") {
+        t.Errorf("link not reverted: %v", *commands)
+    }
+}
+
+func TestResolverCleansUpAfterCrash(t *testing.T) {
+    installFakeHost(t, "")
+    original := "nameserver 192.168.1.1\n"
+    resetResolverFiles(t, original)
+    
+    // A run that died with its configuration in place
+    crashed := newResolverProtector(ResolverFile)
+    if err := crashed.applyResolver([]string{"10.8.0.1"}); err != nil {
+        t.Fatal(err)
+    }
+    
+    dp := newResolverProtector(ResolverFile)
+    if err := dp.Enable([]string{"10.9.0.1"}); err != nil {
+        t.Fatal(err)
+    }
+    if data, _ := os.ReadFile(resolvConfPath); !strings.Contains(string(data), "nameserver 10.9.0.1\n") || strings.Contains(string(data), "10.8.0.1") {
+        t.Fatalf("resolv.conf = %q", data)
+    }
+    if err := dp.Disable(); err != nil {
+        t.Fatal(err)
+    }
+    if data, _ := os.ReadFile(resolvConfPath); string(data) != original {
+        t.Fatalf("original not restored after crash: %q", data)
+    }
+    
+    // A stale systemd-resolved link is reverted before anything else
+    commands := recordSystemCommands(t)
+    if err := saveResolverState(ResolverStatus{Mechanism: ResolverSystemd, Interface: "utr0"}); err != nil {
+        t.Fatal(err)
+    }
+    dp = newResolverProtector(ResolverFile)
+    if err := dp.applyResolver([]string{"10.9.0.1"}); err != nil {
+        t.Fatal(err)
+    }
+    if len(*commands) == 0 || (*commands)[0] != "resolvectl revert utr0" {
+        t.Fatalf("stale link not reverted first: %v", *commands)
+    }
+    dp.restoreResolver()
+}
+
+func containsCommand(commands []string, want string) bool {
+    for _, cmd := range commands {
+        if cmd == want {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+)
+
+// StartError is returned by Start when a step failed after others had
+// changed the host. Err is the failure; Rollback lists the completed
+// steps that couldn't be undone, whose changes are still in place.
+type StartError struct {
+    Err      error
+    Rollback []error
+}
+
+func (e *StartError) Error() string {
+    if len(e.Rollback) == 0 {
+        return e.Err.Error()
+    }
+    var b strings.Builder
+    fmt.Fprintf(&b, "%v; %d step(s) not undone:", e.Err, len(e.Rollback))
+    for _, err := range e.Rollback {
+        b.WriteString("\n  ")
+        b.WriteString(err.Error())
+    }
+    return b.String()
+}
+
+func (e *StartError) Unwrap() []error {
+    return append([]error{e.Err}, e.Rollback...)
+}
+
+// rollback undoes the completed steps of Start, last first, when a later
+// one fails. Each undo is pushed before its step runs since the steps can
+// fail halfway through, so undos must cope with a step that never ran.
+type rollback struct {
+    steps []rollbackStep
+}
+
+type rollbackStep struct {
+    name string
+    undo func() error
+}
+
+func (r *rollback) push(name string, undo func() error) {
+    r.steps = append(r.steps, rollbackStep{name: name, undo: undo})
+}
+
+// Like push, for undos that can't fail
+func (r *rollback) pushQuiet(name string, undo func()) {
+    r.push(name, func() error {
+        undo()
+        return nil
+    })
+}
+
+// Run every undo and wrap cause with those that failed. A failed undo
+// doesn't stop the others.
+func (r *rollback) unwind(cause error) *StartError {
+    var failed []error
+    for i := len(r.steps) - 1; i >= 0; i-- {
+        step := r.steps[i]
+        if err := step.undo(); err != nil {
+            failed = append(failed, fmt.Errorf("failed to undo %s: %w", step.name, err))
+        }
+    }
+    r.steps = nil
+    return &StartError{Err: cause, Rollback: failed}
+}
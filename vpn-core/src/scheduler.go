@@ -0,0 +1,372 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "sync"
+    "time"
+)
+
+const (
+    DefaultSchedulerCheck = DefaultMetricsInterval
+    DefaultIdleRate       = 512 // bytes/s
+)
+
+// IdleAction is what the Scheduler does with a tunnel idle for IdleTimeout
+type IdleAction int
+
+const (
+    IdleDisconnect IdleAction = iota // end the supervisor, as Disconnect
+    IdleSuspend                      // Supervisor.Suspend until something reconnects
+)
+
+// ScheduleAction is what a ScheduleWindow does as it opens. The opposite
+// is done as it closes.
+type ScheduleAction int
+
+const (
+    ScheduleConnect ScheduleAction = iota
+    ScheduleDisconnect
+)
+
+// ScheduleWindow opens at every minute matching Cron, a five field crontab
+// expression in the clock's local time, and stays open for Duration
+type ScheduleWindow struct {
+    Cron     string
+    Duration time.Duration
+    Action   ScheduleAction
+}
+
+// NetworkPolicy says what to do on joining a network
+type NetworkPolicy int
+
+const (
+    NetworkAsk      NetworkPolicy = iota // publish a prompt, answered with Connect or Disconnect
+    NetworkAlwaysOn
+    NetworkNever
+)
+
+func (p NetworkPolicy) String() string {
+    switch p {
+    case NetworkAsk:
+        return "ask"
+    case NetworkAlwaysOn:
+        return "always-on"
+    case NetworkNever:
+        return "never"
+    default:
+        return "unknown"
+    }
+}
+
+// NetworkContext is what the platform layer knows about the network the
+// host joined
+type NetworkContext struct {
+    SSID      string
+    Interface string
+}
+
+// NetworkRule applies Policy on networks matching all its non-empty fields
+type NetworkRule struct {
+    SSID      string
+    Interface string
+    Policy    NetworkPolicy
+}
+
+func (r NetworkRule) matches(network NetworkContext) bool {
+    return (r.SSID == "" || r.SSID == network.SSID) && (r.Interface == "" || r.Interface == network.Interface)
+}
+
+// SchedulerConfig says when a Scheduler connects and disconnects
+type SchedulerConfig struct {
+    // Traffic below IdleRate (default DefaultIdleRate) for IdleTimeout
+    // triggers IdleAction; zero IdleTimeout never goes idle. Suspending
+    // keeps the kill switch engaged with SuspendKillSwitch.
+    IdleTimeout       time.Duration
+    IdleRate          uint64 // bytes/s of rx+tx over all peers
+    IdleAction        IdleAction
+    SuspendKillSwitch bool
+    
+    Windows       []ScheduleWindow
+    Networks      []NetworkRule // first match wins
+    DefaultPolicy NetworkPolicy // networks no rule matches
+    CheckInterval time.Duration // default DefaultSchedulerCheck
+    
+    // Every automatic action is written here as a JSON AuditEntry line
+    AuditLog io.Writer
+}
+
+// AuditEntry records one action of a Scheduler
+type AuditEntry struct {
+    Time      time.Time `json:"time"`
+    Action    string    `json:"action"` // connect, disconnect, suspend, ask or stopped
+    Trigger   string    `json:"trigger"`
+    SSID      string    `json:"ssid,omitempty"`
+    Interface string    `json:"interface,omitempty"`
+}
+
+type scheduledWindow struct {
+    ScheduleWindow
+    cron cronSpec
+}
+
+// Open if a start within the last Duration matches
+func (w scheduledWindow) openAt(t time.Time) bool {
+    t = t.Truncate(time.Minute)
+    for start := t; t.Sub(start) < w.Duration; start = start.Add(-time.Minute) {
+        if w.cron.matches(start) {
+            return true
+        }
+    }
+    return false
+}
+
+// Scheduler connects and disconnects a Supervisor on idle traffic, time
+// windows and network changes. Transitions go through the supervisor, so
+// reconnects while connected follow its backoff, and each one is published
+// as EventScheduler on the supervisor's Events and written to the audit
+// log. The tunnel starts disconnected until something connects it.
+type Scheduler struct {
+    sup     *Supervisor
+    config  VPNConfig
+    cfg     SchedulerConfig
+    windows []scheduledWindow
+    
+    mu        sync.Mutex
+    cancel    context.CancelFunc // of the RunSupervised in progress
+    done      chan error
+    suspended bool
+    network   NetworkContext
+    open      []bool // windows open at the last check
+    
+    // Idle detection, from the counters the metrics loop keeps
+    lastBytes  uint64
+    lastSample time.Time
+    idleSince  time.Time
+}
+
+func NewScheduler(sup *Supervisor, config VPNConfig, cfg SchedulerConfig) (*Scheduler, error) {
+    if cfg.IdleRate == 0 {
+        cfg.IdleRate = DefaultIdleRate
+    }
+    if cfg.CheckInterval <= 0 {
+        cfg.CheckInterval = DefaultSchedulerCheck
+    }
+    
+    sc := &Scheduler{sup: sup, config: config, cfg: cfg, open: make([]bool, len(cfg.Windows))}
+    for _, w := range cfg.Windows {
+        spec, err := parseCron(w.Cron)
+        if err != nil {
+            return nil, err
+        }
+        if w.Duration <= 0 {
+            return nil, fmt.Errorf("schedule window %q has no duration", w.Cron)
+        }
+        sc.windows = append(sc.windows, scheduledWindow{w, spec})
+    }
+    return sc, nil
+}
+
+// Run checks windows and idle traffic until ctx is done, then disconnects
+func (sc *Scheduler) Run(ctx context.Context) error {
+    ticker := sc.sup.clock().NewTicker(sc.cfg.CheckInterval)
+    defer ticker.Stop()
+    defer sc.Disconnect()
+    
+    sc.check(sc.sup.clock().Now())
+    for {
+        select {
+        case now := <-ticker.C():
+            sc.check(now)
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+}
+
+// Trigger is called by the platform layer on joining a network, and
+// applies the policy of the first NetworkRule matching it
+func (sc *Scheduler) Trigger(network NetworkContext) {
+    policy := sc.cfg.DefaultPolicy
+    for _, rule := range sc.cfg.Networks {
+        if rule.matches(network) {
+            policy = rule.Policy
+            break
+        }
+    }
+    
+    sc.mu.Lock()
+    defer sc.mu.Unlock()
+    
+    sc.network = network
+    trigger := fmt.Sprintf("network %s/%s, %s", network.SSID, network.Interface, policy)
+    switch policy {
+    case NetworkAlwaysOn:
+        sc.connectLocked(trigger)
+    case NetworkNever:
+        sc.disconnectLocked(trigger)
+    default:
+        sc.record("ask", trigger)
+    }
+}
+
+// Connect brings the tunnel up, e.g. answering a NetworkAsk prompt
+func (sc *Scheduler) Connect() {
+    sc.mu.Lock()
+    defer sc.mu.Unlock()
+    sc.connectLocked("user")
+}
+
+// Disconnect takes the tunnel down and ends the supervisor
+func (sc *Scheduler) Disconnect() {
+    sc.mu.Lock()
+    defer sc.mu.Unlock()
+    sc.disconnectLocked("user")
+}
+
+// Apply windows that opened or closed and the idle timeout
+func (sc *Scheduler) check(now time.Time) {
+    sc.mu.Lock()
+    defer sc.mu.Unlock()
+    
+    for i, w := range sc.windows {
+        open := w.openAt(now)
+        if open == sc.open[i] {
+            continue
+        }
+        sc.open[i] = open
+        
+        connect := w.Action == ScheduleConnect
+        trigger := fmt.Sprintf("window %q opened", w.Cron)
+        if !open {
+            connect = !connect
+            trigger = fmt.Sprintf("window %q closed", w.Cron)
+        }
+        if connect {
+            sc.connectLocked(trigger)
+        } else {
+            sc.disconnectLocked(trigger)
+        }
+    }
+    sc.checkIdleLocked(now)
+}
+
+// Idle once the tunnel's rx+tx rate stayed below IdleRate for IdleTimeout.
+// A reconnect starts the counters over, and so the measurement.
+func (sc *Scheduler) checkIdleLocked(now time.Time) {
+    vpn := sc.sup.VPN()
+    if sc.cfg.IdleTimeout <= 0 || !sc.runningLocked() || sc.suspended || vpn == nil {
+        sc.lastSample, sc.idleSince = time.Time{}, time.Time{}
+        return
+    }
+    
+    total := tunnelBytes(vpn)
+    last, lastAt := sc.lastBytes, sc.lastSample
+    sc.lastBytes, sc.lastSample = total, now
+    elapsed := now.Sub(lastAt).Seconds()
+    if lastAt.IsZero() || total < last || elapsed <= 0 {
+        sc.idleSince = time.Time{}
+        return
+    }
+    if float64(total-last)/elapsed >= float64(sc.cfg.IdleRate) {
+        sc.idleSince = time.Time{}
+        return
+    }
+    
+    if sc.idleSince.IsZero() {
+        sc.idleSince = lastAt
+    }
+    idle := now.Sub(sc.idleSince)
+    if idle < sc.cfg.IdleTimeout {
+        return
+    }
+    trigger := fmt.Sprintf("idle for %v", idle.Round(time.Second))
+    if sc.cfg.IdleAction == IdleSuspend {
+        sc.suspendLocked(trigger)
+    } else {
+        sc.disconnectLocked(trigger)
+    }
+}
+
+// Bytes sent and received by all peers as of the metrics loop's last poll
+func tunnelBytes(vpn *UnderTheRadarVPN) uint64 {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    var total uint64
+    for _, peer := range vpn.peers.list {
+        total += peer.RxBytes.Load() + peer.TxBytes.Load()
+    }
+    return total
+}
+
+// Whether RunSupervised is still going. One that ended on its own, e.g.
+// because the kill switch failed, is recorded.
+func (sc *Scheduler) runningLocked() bool {
+    if sc.done == nil {
+        return false
+    }
+    select {
+    case err := <-sc.done:
+        sc.cancel, sc.done = nil, nil
+        sc.record("stopped", err.Error())
+        return false
+    default:
+        return true
+    }
+}
+
+func (sc *Scheduler) connectLocked(trigger string) {
+    switch {
+    case !sc.runningLocked():
+        sc.sup.Resume()
+        ctx, cancel := context.WithCancel(context.Background())
+        done := make(chan error, 1)
+        go func() { done <- sc.sup.RunSupervised(ctx, sc.config) }()
+        sc.cancel, sc.done = cancel, done
+    case sc.suspended:
+        sc.sup.Resume()
+    default:
+        return
+    }
+    sc.suspended = false
+    sc.record("connect", trigger)
+}
+
+func (sc *Scheduler) disconnectLocked(trigger string) {
+    if !sc.runningLocked() {
+        return
+    }
+    sc.cancel()
+    <-sc.done
+    sc.cancel, sc.done = nil, nil
+    sc.suspended = false
+    sc.record("disconnect", trigger)
+}
+
+func (sc *Scheduler) suspendLocked(trigger string) {
+    if !sc.runningLocked() || sc.suspended {
+        return
+    }
+    sc.sup.Suspend(sc.cfg.SuspendKillSwitch)
+    sc.suspended = true
+    sc.record("suspend", trigger)
+}
+
+// Publish an action and write it to the audit log
+func (sc *Scheduler) record(action, trigger string) {
+    sc.lastSample, sc.idleSince = time.Time{}, time.Time{}
+    entry := AuditEntry{
+        Time:      sc.sup.clock().Now(),
+        Action:    action,
+        Trigger:   trigger,
+        SSID:      sc.network.SSID,
+        Interface: sc.network.Interface,
+    }
+    sc.sup.emit(Event{Type: EventScheduler, Time: entry.Time, Message: action + ": " + trigger})
+    if sc.cfg.AuditLog != nil {
+        json.NewEncoder(sc.cfg.AuditLog).Encode(entry)
+    }
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "testing"
+    "time"
+)
+
+// A Scheduler over a supervisor on fakes; the test drives check itself
+func newTestScheduler(t *testing.T, cfg SchedulerConfig) (*Scheduler, *supervisedHost, *bytes.Buffer) {
+    t.Helper()
+    
+    wg := newFakeWGClient()
+    host := &supervisedHost{fakeHost: installFakeHost(t, ""), wg: wg}
+    sup := NewSupervisor(VPNOptions{
+        DeviceName: "sim0",
+        WGClient:   wg,
+        Commands:   host.run,
+        EBPF:       NoEBPF{},
+        LockDir:    t.TempDir(),
+        Clock:      NewFakeClock(time.Now()),
+    }, SupervisorConfig{CheckInterval: time.Hour})
+    
+    var audit bytes.Buffer
+    cfg.AuditLog = &audit
+    sc, err := NewScheduler(sup, VPNConfig{ListenPort: 51820, KillSwitch: true}, cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(sc.Disconnect)
+    return sc, host, &audit
+}
+
+func auditEntries(t *testing.T, audit *bytes.Buffer) []AuditEntry {
+    t.Helper()
+    
+    var entries []AuditEntry
+    lines := bufio.NewScanner(bytes.NewReader(audit.Bytes()))
+    for lines.Scan() {
+        var entry AuditEntry
+        if err := json.Unmarshal(lines.Bytes(), &entry); err != nil {
+            t.Fatal(err)
+        }
+        entries = append(entries, entry)
+    }
+    return entries
+}
+
+func TestSchedulerSuspendsIdleTunnel(t *testing.T) {
+    sc, host, audit := newTestScheduler(t, SchedulerConfig{
+        IdleTimeout:       30 * time.Minute,
+        IdleAction:        IdleSuspend,
+        SuspendKillSwitch: true,
+        Networks:          []NetworkRule{{SSID: "CoffeeShop", Policy: NetworkAlwaysOn}},
+    })
+    
+    sc.Trigger(NetworkContext{SSID: "CoffeeShop", Interface: "wlan0"})
+    waitForState(t, sc.sup, SupervisorConnected)
+    vpn := sc.sup.VPN()
+    peer := &Peer{PublicKey: mustKey(t).PublicKey()}
+    vpn.mu.Lock()
+    vpn.peers.put(peer)
+    vpn.mu.Unlock()
+    
+    // Busy for the first ten minutes, then only keepalives
+    start := time.Date(2026, 10, 16, 14, 0, 0, 0, time.UTC)
+    sc.check(start)
+    peer.RxBytes.Add(1 << 20)
+    sc.check(start.Add(10 * time.Minute))
+    peer.TxBytes.Add(32)
+    sc.check(start.Add(39 * time.Minute))
+    if sc.sup.GetStatus().Supervisor.State != SupervisorConnected {
+        t.Fatal("suspended before 30 idle minutes")
+    }
+    sc.check(start.Add(40 * time.Minute))
+    
+    waitForState(t, sc.sup, SupervisorSuspended)
+    if sc.sup.VPN() != nil {
+        t.Fatal("tunnel still up while suspended")
+    }
+    host.mu.Lock()
+    drops := host.drops
+    host.mu.Unlock()
+    if drops != 1 {
+        t.Fatalf("%d kill switch DROP rules while suspended, want the supervisor's", drops)
+    }
+    
+    // Rejoining the network brings the tunnel back
+    sc.Trigger(NetworkContext{SSID: "CoffeeShop", Interface: "wlan0"})
+    waitForState(t, sc.sup, SupervisorConnected)
+    if sc.sup.VPN() == nil || sc.sup.VPN() == vpn {
+        t.Fatal("not reconnected with a fresh VPN")
+    }
+    
+    entries := auditEntries(t, audit)
+    if len(entries) != 3 || entries[1].Action != "suspend" || entries[1].Trigger != "idle for 30m0s" || entries[1].SSID != "CoffeeShop" {
+        t.Fatalf("audit log %+v", entries)
+    }
+    if entries[0].Action != "connect" || entries[2].Action != "connect" {
+        t.Fatalf("audit log %+v", entries)
+    }
+    
+    var announced bool
+    for len(sc.sup.Events()) > 0 {
+        if ev := <-sc.sup.Events(); ev.Type == EventScheduler && ev.Message == "suspend: idle for 30m0s" {
+            announced = true
+        }
+    }
+    if !announced {
+        t.Fatal("no scheduler event for the suspension")
+    }
+}
+
+func TestSchedulerWindowsAndNetworkPolicies(t *testing.T) {
+    sc, host, audit := newTestScheduler(t, SchedulerConfig{
+        Windows:  []ScheduleWindow{{Cron: "0 9 * * 1-5", Duration: 8 * time.Hour, Action: ScheduleConnect}},
+        Networks: []NetworkRule{{SSID: "Home", Policy: NetworkNever}},
+    })
+    
+    friday := time.Date(2026, 10, 16, 8, 59, 0, 0, time.UTC)
+    sc.check(friday)
+    if sc.sup.GetStatus().Supervisor.State != SupervisorStopped {
+        t.Fatal("connected before the window opened")
+    }
+    sc.check(friday.Add(time.Minute))
+    waitForState(t, sc.sup, SupervisorConnected)
+    sc.check(friday.Add(4 * time.Hour))
+    
+    // An unknown network asks instead of acting
+    sc.Trigger(NetworkContext{SSID: "Airport", Interface: "wlan0"})
+    if sc.sup.VPN() == nil {
+        t.Fatal("asking disconnected the tunnel")
+    }
+    
+    // Never on the home network, and the window closing later is a no-op
+    sc.Trigger(NetworkContext{SSID: "Home", Interface: "wlan0"})
+    if sc.sup.VPN() != nil || sc.sup.GetStatus().Supervisor.State != SupervisorStopped {
+        t.Fatal("still connected on a never network")
+    }
+    sc.check(friday.Add(8*time.Hour + time.Minute))
+    
+    host.mu.Lock()
+    rules := len(host.rules)
+    host.mu.Unlock()
+    if rules != 0 {
+        t.Fatalf("rules left after disconnecting: %v", host.rules)
+    }
+    
+    var actions []string
+    for _, entry := range auditEntries(t, audit) {
+        actions = append(actions, entry.Action+": "+entry.Trigger)
+    }
+    want := []string{
+        `connect: window "0 9 * * 1-5" opened`,
+        "ask: network Airport/wlan0, ask",
+        "disconnect: network Home/wlan0, never",
+    }
+    if len(actions) != len(want) {
+        t.Fatalf("audit log %q", actions)
+    }
+    for i := range want {
+        if actions[i] != want[i] {
+            t.Fatalf("audit log %q, want %q", actions, want)
+        }
+    }
+}
+
+func TestSchedulerRunDisconnectsOnExit(t *testing.T) {
+    sc, _, _ := newTestScheduler(t, SchedulerConfig{CheckInterval: time.Minute})
+    ctx, cancel := context.WithCancel(context.Background())
+    result := make(chan error, 1)
+    go func() { result <- sc.Run(ctx) }()
+    
+    sc.Connect()
+    waitForState(t, sc.sup, SupervisorConnected)
+    cancel()
+    if err := <-result; !errors.Is(err, context.Canceled) {
+        t.Fatalf("Run returned %v", err)
+    }
+    if sc.sup.GetStatus().Supervisor.State != SupervisorStopped {
+        t.Fatal("supervisor left running")
+    }
+    
+    // The supervisor can run again
+    sc.Connect()
+    waitForState(t, sc.sup, SupervisorConnected)
+}
+
+func TestNewSchedulerValidatesWindows(t *testing.T) {
+    sup := NewSupervisor(VPNOptions{}, SupervisorConfig{})
+    for _, w := range []ScheduleWindow{{Cron: "0 9 * *", Duration: time.Hour}, {Cron: "0 9 * * *"}} {
+        if _, err := NewScheduler(sup, VPNConfig{}, SchedulerConfig{Windows: []ScheduleWindow{w}}); err == nil {
+            t.Errorf("%+v accepted", w)
+        }
+    }
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io/fs"
+    "os"
+    "strings"
+    "sync"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Secret holds key material. It never prints or marshals its bytes, only a
+// short fingerprint, and can be wiped with Zeroize. The buffer is locked
+// into memory where the platform allows so it is not swapped out.
+type Secret struct {
+    mu  sync.RWMutex
+    buf []byte
+}
+
+func NewSecret(b []byte) *Secret {
+    s := &Secret{buf: make([]byte, len(b))}
+    copy(s.buf, b)
+    lockMemory(s.buf)
+    return s
+}
+
+func SecretFromKey(key wgtypes.Key) *Secret {
+    s := NewSecret(key[:])
+    wipe(key[:])
+    return s
+}
+
+// ParseSecret decodes a base64 key such as those in WireGuard configs
+func ParseSecret(encoded string) (*Secret, error) {
+    key, err := wgtypes.ParseKey(encoded)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %w", ErrKeyInvalid, err)
+    }
+    return SecretFromKey(key), nil
+}
+
+var ErrSecretNotFound = errors.New("referenced secret not found")
+
+// ErrKeyInvalid is wrapped when a key isn't a 32 byte WireGuard key
+var ErrKeyInvalid = errors.New("invalid key")
+
+// ResolveSecret reads a key given inline in base64, or by reference as
+// env:NAME from the environment or file:PATH from a file such as a mounted
+// secret. Errors name the reference, never the value.
+func ResolveSecret(value string) (*Secret, error) {
+    source, encoded := "inline key", value
+    switch {
+    case strings.HasPrefix(value, "env:"):
+        name := strings.TrimPrefix(value, "env:")
+        v, ok := os.LookupEnv(name)
+        if !ok || v == "" {
+            return nil, fmt.Errorf("%w: environment variable %s is not set", ErrSecretNotFound, name)
+        }
+        source, encoded = "environment variable "+name, strings.TrimSpace(v)
+    case strings.HasPrefix(value, "file:"):
+        path := strings.TrimPrefix(value, "file:")
+        data, err := os.ReadFile(path)
+        if errors.Is(err, fs.ErrNotExist) {
+            return nil, fmt.Errorf("%w: %s does not exist", ErrSecretNotFound, path)
+        }
+        if err != nil {
+            return nil, fmt.Errorf("failed to read secret file: %w", err)
+        }
+        defer wipe(data)
+        source, encoded = path, strings.TrimSpace(string(data))
+    }
+    
+    key, err := wgtypes.ParseKey(encoded)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %s is not a WireGuard key", ErrKeyInvalid, source)
+    }
+    return SecretFromKey(key), nil
+}
+
+// GenerateSecret returns a fresh WireGuard private key
+func GenerateSecret() (*Secret, error) {
+    key, err := wgtypes.GeneratePrivateKey()
+    if err != nil {
+        return nil, err
+    }
+    return SecretFromKey(key), nil
+}
+
+// Bytes returns the raw secret. Callers must not keep the slice.
+func (s *Secret) Bytes() []byte {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return s.buf
+}
+
+// Key copies the secret into a wgtypes.Key for handing to wgctrl. The copy
+// is outside our control, wipe it once the call returns.
+func (s *Secret) Key() wgtypes.Key {
+    var key wgtypes.Key
+    copy(key[:], s.Bytes())
+    return key
+}
+
+// PublicKey derives the public half of a private key secret
+func (s *Secret) PublicKey() wgtypes.Key {
+    key := s.Key()
+    defer wipe(key[:])
+    return key.PublicKey()
+}
+
+// Equal compares in constant time. Secrets of different lengths never match.
+func (s *Secret) Equal(other *Secret) bool {
+    if s == nil || other == nil {
+        return s == other
+    }
+    return subtle.ConstantTimeCompare(s.Bytes(), other.Bytes()) == 1
+}
+
+// Zeroize overwrites the secret and releases the memory lock
+func (s *Secret) Zeroize() {
+    if s == nil {
+        return
+    }
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    wipe(s.buf)
+    unlockMemory(s.buf)
+}
+
+// Fingerprint identifies a secret without revealing it
+func (s *Secret) Fingerprint() string {
+    if s == nil {
+        return "none"
+    }
+    sum := sha256.Sum256(s.Bytes())
+    return hex.EncodeToString(sum[:4])
+}
+
+func (s *Secret) String() string {
+    return "secret:" + s.Fingerprint()
+}
+
+func (s *Secret) GoString() string {
+    return s.String()
+}
+
+func (s *Secret) MarshalJSON() ([]byte, error) {
+    return []byte(fmt.Sprintf("%q", s.String())), nil
+}
+
+func (s *Secret) MarshalText() ([]byte, error) {
+    return []byte(s.String()), nil
+}
+
+func wipe(b []byte) {
+    for i := range b {
+        b[i] = 0
+    }
+}
+
+const deviceKeyName = "device"
+
+// Keystore name of a peer's preshared key
+func pskName(peer wgtypes.Key) string {
+    return "psk/" + peer.String()
+}
+
+// keyStore owns every secret the VPN holds so they can be wiped together
+type keyStore struct {
+    mu      sync.Mutex
+    secrets map[string]*Secret
+}
+
+func newKeyStore() *keyStore {
+    return &keyStore{secrets: make(map[string]*Secret)}
+}
+
+// Put stores a secret under name, wiping any secret it replaces
+func (ks *keyStore) Put(name string, s *Secret) {
+    ks.mu.Lock()
+    defer ks.mu.Unlock()
+    
+    if old, ok := ks.secrets[name]; ok && old != s {
+        old.Zeroize()
+    }
+    ks.secrets[name] = s
+}
+
+func (ks *keyStore) Get(name string) *Secret {
+    ks.mu.Lock()
+    defer ks.mu.Unlock()
+    return ks.secrets[name]
+}
+
+// Remove wipes and forgets a secret
+func (ks *keyStore) Remove(name string) {
+    ks.mu.Lock()
+    defer ks.mu.Unlock()
+    
+    if s, ok := ks.secrets[name]; ok {
+        s.Zeroize()
+        delete(ks.secrets, name)
+    }
+}
+
+// Zeroize wipes every stored secret
+func (ks *keyStore) Zeroize() {
+    ks.mu.Lock()
+    defer ks.mu.Unlock()
+    
+    for name, s := range ks.secrets {
+        s.Zeroize()
+        delete(ks.secrets, name)
+    }
+}
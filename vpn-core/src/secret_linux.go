@@ -0,0 +1,18 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// Keep secrets out of swap. Failure (e.g. RLIMIT_MEMLOCK) is not fatal.
+func lockMemory(b []byte) {
+    if len(b) > 0 {
+        syscall.Mlock(b)
+    }
+}
+
+func unlockMemory(b []byte) {
+    if len(b) > 0 {
+        syscall.Munlock(b)
+    }
+}
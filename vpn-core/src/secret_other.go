@@ -0,0 +1,6 @@
+//go:build !linux
+
+package main
+
+func lockMemory(b []byte)   {}
+func unlockMemory(b []byte) {}
@@ -0,0 +1,191 @@
+package main
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestSecretNeverRevealsBytes(t *testing.T) {
+    key := mustKey(t)
+    encoded := key.String()
+    s := SecretFromKey(key)
+    
+    outputs := []string{
+        s.String(),
+        fmt.Sprintf("%v %s %+v %#v %x", s, s, s, s, s),
+    }
+    data, err := json.Marshal(s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    outputs = append(outputs, string(data))
+    
+    for _, out := range outputs {
+        if strings.Contains(out, encoded) || strings.Contains(out, hex.EncodeToString(key[:])) {
+            t.Fatalf("secret leaked in %q", out)
+        }
+        if !strings.Contains(out, s.Fingerprint()) {
+            t.Errorf("fingerprint missing from %q", out)
+        }
+    }
+    
+    if s.Key() != key {
+        t.Fatal("Key() does not round-trip")
+    }
+}
+
+func TestSecretZeroize(t *testing.T) {
+    s := SecretFromKey(mustKey(t))
+    s.Zeroize()
+    
+    if !bytes.Equal(s.Bytes(), make([]byte, 32)) {
+        t.Fatal("bytes not wiped")
+    }
+    
+    var nilSecret *Secret
+    nilSecret.Zeroize() // must not panic
+}
+
+func TestSecretEqual(t *testing.T) {
+    key := mustKey(t)
+    s := SecretFromKey(key)
+    if !s.Equal(SecretFromKey(key)) {
+        t.Fatal("equal keys compare unequal")
+    }
+    if s.Equal(SecretFromKey(mustKey(t))) || s.Equal(nil) {
+        t.Fatal("different keys compare equal")
+    }
+    
+    // Truncated or zero padded to a key's 32 bytes, these would all match
+    zero := NewSecret(make([]byte, 32))
+    short := NewSecret(make([]byte, 16))
+    long := NewSecret(append(key[:], 1))
+    if zero.Equal(short) || short.Equal(zero) || s.Equal(long) || long.Equal(s) {
+        t.Fatal("secrets of different lengths compare equal")
+    }
+    if !NewSecret(nil).Equal(NewSecret([]byte{})) {
+        t.Fatal("empty secrets compare unequal")
+    }
+}
+
+func TestKeyStoreWipesReplacedAndAll(t *testing.T) {
+    ks := newKeyStore()
+    first := SecretFromKey(mustKey(t))
+    second := SecretFromKey(mustKey(t))
+    
+    ks.Put(deviceKeyName, first)
+    ks.Put(deviceKeyName, second)
+    if !bytes.Equal(first.Bytes(), make([]byte, 32)) {
+        t.Error("replaced secret not wiped")
+    }
+    
+    ks.Zeroize()
+    if !bytes.Equal(second.Bytes(), make([]byte, 32)) || ks.Get(deviceKeyName) != nil {
+        t.Error("keystore not wiped")
+    }
+}
+
+// Every exported struct that can hold key material must serialize without it
+func TestExportedStructsDoNotLeakKeys(t *testing.T) {
+    privKey, pskKey, hopKey := mustKey(t), mustKey(t), mustKey(t)
+    xorKey := []byte("obfuscation-key-material-0123456")
+    
+    forbidden := []string{
+        base64.StdEncoding.EncodeToString(xorKey),
+        hex.EncodeToString(xorKey),
+    }
+    for _, k := range [][32]byte{privKey, pskKey, hopKey} {
+        forbidden = append(forbidden, base64.StdEncoding.EncodeToString(k[:]), hex.EncodeToString(k[:]))
+    }
+    
+    psk := SecretFromKey(pskKey)
+    endpoint := &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 51820}
+    peerConfig := PeerConfig{
+        PublicKey:    mustKey(t).PublicKey(),
+        PresharedKey: psk,
+        Endpoint:     endpoint,
+    }
+    peer := &Peer{PublicKey: peerConfig.PublicKey, PresharedKey: psk, Endpoint: endpoint}
+    hop := &HopNode{
+        PublicKey:    mustKey(t).PublicKey(),
+        Endpoint:     endpoint,
+        TunnelIP:     net.ParseIP("10.100.0.1"),
+        PrivateKey:   SecretFromKey(hopKey),
+        PresharedKey: psk,
+    }
+    mh := NewMultiHop()
+    mh.AddHop(hop)
+    layers, err := mh.Layers("utr0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    ob := NewObfuscator()
+    ob.Configure(ObfuscationXOR, xorKey)
+    
+    values := []interface{}{
+        VPNConfig{PrivateKey: SecretFromKey(privKey), Peers: []PeerConfig{peerConfig}},
+        peerConfig,
+        peer,
+        hop,
+        layers[0],
+        ob,
+        Event{Type: EventCounterReset, PublicKey: peer.PublicKey},
+    }
+    
+    for _, v := range values {
+        data, err := json.Marshal(v)
+        if err != nil {
+            t.Fatalf("%T: %v", v, err)
+        }
+        dump := string(data) + fmt.Sprintf("%v %+v %#v", v, v, v)
+        for _, f := range forbidden {
+            if strings.Contains(dump, f) {
+                t.Errorf("%T leaks key material", v)
+            }
+        }
+    }
+}
+
+func TestResolveSecret(t *testing.T) {
+    key := mustKey(t)
+    path := filepath.Join(t.TempDir(), "wg_key")
+    if err := os.WriteFile(path, []byte(key.String()+"\n"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("UTR_TEST_KEY", key.String())
+    
+    for _, ref := range []string{key.String(), "env:UTR_TEST_KEY", "file:" + path} {
+        s, err := ResolveSecret(ref)
+        if err != nil {
+            t.Fatalf("%s: %v", ref, err)
+        }
+        if s.Key() != key {
+            t.Fatalf("%s resolved to another key", ref)
+        }
+    }
+    
+    t.Setenv("UTR_TEST_EMPTY", "")
+    for _, ref := range []string{"env:UTR_TEST_UNSET", "env:UTR_TEST_EMPTY", "file:" + path + ".missing"} {
+        if _, err := ResolveSecret(ref); !errors.Is(err, ErrSecretNotFound) {
+            t.Errorf("%s: err = %v", ref, err)
+        }
+    }
+    
+    // A value that isn't a key is rejected without being echoed
+    t.Setenv("UTR_TEST_BAD", "hunter2")
+    for _, ref := range []string{"hunter2", "env:UTR_TEST_BAD"} {
+        _, err := ResolveSecret(ref)
+        if err == nil || errors.Is(err, ErrSecretNotFound) || strings.Contains(err.Error(), "hunter2") {
+            t.Errorf("%s: err = %v", ref, err)
+        }
+    }
+}
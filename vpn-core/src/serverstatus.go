@@ -0,0 +1,506 @@
+package main
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "net"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+)
+
+const (
+    ServerStatusPath = "/v1/status"
+    
+    // Base64 Ed25519 signature of the body by the key StatusSigningKey
+    // returns, on signed documents
+    ServerStatusSignatureHeader = "X-UTR-Status-Signature"
+    
+    DefaultServerStatusInterval = 30 * time.Second
+    DefaultServerStatusRate     = 1.0 // requests per second per client address
+    DefaultServerStatusBurst    = 5
+    DefaultServerStatusMaxAge   = 5 * time.Minute
+    
+    statusKeyLabel    = "undertheradar server status key v1"
+    maxStatusSources  = 4096
+    maxStatusBodySize = 64 << 10
+)
+
+var (
+    ErrStatusSignature   = errors.New("server status signature invalid")
+    ErrNoServerAvailable = errors.New("no server status matches")
+)
+
+// StatusFields name the parts of a ServerStatus an operator may keep
+// private, see ServerStatusConfig.Hide
+type StatusFields uint
+
+const (
+    StatusPeerCount StatusFields = 1 << iota
+    StatusCapacity
+    StatusHandshakeRate
+    StatusPorts
+)
+
+// ServerStatusConfig publishes a ServerStatus document clients pick
+// servers by, see ServerSelector. Off without a ListenAddr; Handler serves
+// it on a listener of the embedding application instead.
+type ServerStatusConfig struct {
+    ListenAddr string        // serves ServerStatusPath
+    Interval   time.Duration // refresh, default DefaultServerStatusInterval
+    Regions    []string      // tags clients filter on, e.g. "eu-central"
+    
+    // What the server carries, for AvailablePercent: bytes per second in
+    // and out together, and peers. Either may be 0 for no limit.
+    CapacityBytes uint64
+    MaxPeers      int
+    
+    // Sign with an Ed25519 key derived from the device key
+    Sign bool
+    Hide StatusFields
+    
+    // Per client address, beyond which requests get 429
+    Rate  float64 // per second, default DefaultServerStatusRate
+    Burst int     // default DefaultServerStatusBurst
+}
+
+func (c ServerStatusConfig) withDefaults() ServerStatusConfig {
+    if c.Interval <= 0 {
+        c.Interval = DefaultServerStatusInterval
+    }
+    if c.Rate <= 0 {
+        c.Rate = DefaultServerStatusRate
+    }
+    if c.Burst <= 0 {
+        c.Burst = DefaultServerStatusBurst
+    }
+    return c
+}
+
+// ServerStatus is the published document. Hidden fields are left out.
+type ServerStatus struct {
+    PublicKey        string    `json:"public_key"`
+    SigningKey       string    `json:"signing_key,omitempty"` // base64 Ed25519, on signed documents
+    GeneratedAt      time.Time `json:"generated_at"`
+    Regions          []string  `json:"regions,omitempty"`
+    Protocols        []string  `json:"protocols"`
+    Ports            []int     `json:"ports,omitempty"`
+    ObfuscationModes []string  `json:"obfuscation_modes,omitempty"`
+    
+    Peers               *int     `json:"peers,omitempty"`
+    AvailablePercent    *float64 `json:"available_percent,omitempty"`
+    HandshakesPerMinute *int     `json:"handshakes_per_minute,omitempty"`
+}
+
+func (s ServerStatus) inRegion(region string) bool {
+    if region == "" {
+        return true
+    }
+    for _, r := range s.Regions {
+        if r == region {
+            return true
+        }
+    }
+    return false
+}
+
+func obfuscationModeName(mode ObfuscationMode) string {
+    switch mode {
+    case ObfuscationXOR:
+        return "xor"
+    case ObfuscationTLS:
+        return "tls"
+    case ObfuscationHTTP:
+        return "http"
+    default:
+        return "none"
+    }
+}
+
+// statusSigner derives the Ed25519 key from the device's private key. A
+// WireGuard key can only agree on secrets, not sign, so clients are given
+// this key along with the server's public key.
+func statusSigner(private *Secret) ed25519.PrivateKey {
+    seed := blakeHMAC(private.Bytes(), []byte(statusKeyLabel))
+    return ed25519.NewKeyFromSeed(seed[:])
+}
+
+// StatusSigningKey is the key signed server status documents verify with,
+// see StatusSource
+func (vpn *UnderTheRadarVPN) StatusSigningKey() (ed25519.PublicKey, error) {
+    private := vpn.privateKey()
+    if private == nil {
+        return nil, fmt.Errorf("no device key yet")
+    }
+    return statusSigner(private).Public().(ed25519.PublicKey), nil
+}
+
+// ServerStatusPublisher refreshes the document every Interval and serves
+// the last one
+type ServerStatusPublisher struct {
+    vpn    *UnderTheRadarVPN
+    cfg    ServerStatusConfig
+    signer ed25519.PrivateKey // nil unsigned
+    
+    mu        sync.Mutex
+    body      []byte
+    signature string
+    lastBytes uint64
+    lastAt    time.Time
+    
+    sourcesMu sync.Mutex
+    sources   map[string]*tokenBucket
+    lastSweep time.Time
+    
+    server   *http.Server
+    stop     chan struct{}
+    stopOnce sync.Once
+}
+
+func NewServerStatusPublisher(vpn *UnderTheRadarVPN, cfg ServerStatusConfig) (*ServerStatusPublisher, error) {
+    p := &ServerStatusPublisher{
+        vpn:     vpn,
+        cfg:     cfg.withDefaults(),
+        sources: make(map[string]*tokenBucket),
+        stop:    make(chan struct{}),
+    }
+    if cfg.Sign {
+        private := vpn.privateKey()
+        if private == nil {
+            return nil, fmt.Errorf("no device key to sign server status with")
+        }
+        p.signer = statusSigner(private)
+    }
+    return p, p.Refresh()
+}
+
+// Refresh builds the document from the current peers now
+func (p *ServerStatusPublisher) Refresh() error {
+    now := p.vpn.clock().Now()
+    status, total := p.collect(now)
+    
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    
+    // Throughput since the last refresh, from the counters the metrics loop
+    // keeps
+    if p.cfg.Hide&StatusCapacity == 0 && (p.cfg.CapacityBytes > 0 || p.cfg.MaxPeers > 0) {
+        available := 1.0
+        if elapsed := now.Sub(p.lastAt).Seconds(); p.cfg.CapacityBytes > 0 && !p.lastAt.IsZero() && elapsed > 0 && total >= p.lastBytes {
+            rate := float64(total-p.lastBytes) / elapsed
+            available = math.Min(available, 1-rate/float64(p.cfg.CapacityBytes))
+        }
+        if p.cfg.MaxPeers > 0 {
+            available = math.Min(available, 1-float64(p.vpn.peerCount())/float64(p.cfg.MaxPeers))
+        }
+        percent := math.Round(math.Max(0, available)*1000) / 10
+        status.AvailablePercent = &percent
+    }
+    p.lastBytes, p.lastAt = total, now
+    
+    if p.signer != nil {
+        status.SigningKey = base64.StdEncoding.EncodeToString(p.signer.Public().(ed25519.PublicKey))
+    }
+    body, err := json.Marshal(status)
+    if err != nil {
+        return fmt.Errorf("failed to encode server status: %w", err)
+    }
+    p.body = body
+    p.signature = ""
+    if p.signer != nil {
+        p.signature = base64.StdEncoding.EncodeToString(ed25519.Sign(p.signer, body))
+    }
+    return nil
+}
+
+// The document but for the capacity estimate, and the bytes carried so far
+func (p *ServerStatusPublisher) collect(now time.Time) (ServerStatus, uint64) {
+    vpn := p.vpn
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    status := ServerStatus{
+        GeneratedAt: now.UTC(),
+        Regions:     p.cfg.Regions,
+        Protocols:   []string{"wireguard"},
+    }
+    if private := vpn.privateKey(); private != nil {
+        status.PublicKey = private.Key().PublicKey().String()
+    }
+    for _, mode := range vpn.capabilities.ObfuscationModes {
+        status.ObfuscationModes = append(status.ObfuscationModes, obfuscationModeName(mode))
+    }
+    if p.cfg.Hide&StatusPorts == 0 {
+        seen := make(map[int]bool)
+        for _, port := range append(append([]int{vpn.listenPort}, vpn.config.ListenPorts...), vpn.config.HopPorts...) {
+            if port > 0 && !seen[port] {
+                seen[port] = true
+                status.Ports = append(status.Ports, port)
+            }
+        }
+        sort.Ints(status.Ports)
+    }
+    
+    var total uint64
+    handshakes := 0
+    for _, peer := range vpn.peers.list {
+        total += peer.RxBytes.Load() + peer.TxBytes.Load()
+        handshakes += peer.history.handshakesSince(now.Add(-time.Minute))
+    }
+    if p.cfg.Hide&StatusPeerCount == 0 {
+        peers := vpn.peers.len()
+        status.Peers = &peers
+    }
+    if p.cfg.Hide&StatusHandshakeRate == 0 {
+        status.HandshakesPerMinute = &handshakes
+    }
+    return status, total
+}
+
+func (vpn *UnderTheRadarVPN) peerCount() int {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    return vpn.peers.len()
+}
+
+// Start refreshes the document every Interval until Stop
+func (p *ServerStatusPublisher) Start() {
+    ticker := p.vpn.clock().NewTicker(p.cfg.Interval)
+    defer ticker.Stop()
+    
+    for {
+        select {
+        case <-ticker.C():
+            p.Refresh()
+        case <-p.stop:
+            return
+        }
+    }
+}
+
+// Handler serves the last document on ServerStatusPath, rate limited per
+// client address
+func (p *ServerStatusPublisher) Handler() http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc(ServerStatusPath, func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        host, _, err := net.SplitHostPort(r.RemoteAddr)
+        if err != nil {
+            host = r.RemoteAddr
+        }
+        if !p.allow(host, p.vpn.clock().Now()) {
+            w.Header().Set("Retry-After", "1")
+            http.Error(w, "too many requests", http.StatusTooManyRequests)
+            return
+        }
+        
+        p.mu.Lock()
+        body, signature := p.body, p.signature
+        p.mu.Unlock()
+        
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(p.cfg.Interval.Seconds())))
+        if signature != "" {
+            w.Header().Set(ServerStatusSignatureHeader, signature)
+        }
+        w.Write(body)
+    })
+    return mux
+}
+
+// One token of the client's bucket; clients beyond maxStatusSources are
+// refused until idle ones are forgotten
+func (p *ServerStatusPublisher) allow(client string, now time.Time) bool {
+    p.sourcesMu.Lock()
+    defer p.sourcesMu.Unlock()
+    
+    if now.Sub(p.lastSweep) > handshakeSourceIdle {
+        p.lastSweep = now
+        for key, bucket := range p.sources {
+            if now.Sub(bucket.last) > handshakeSourceIdle {
+                delete(p.sources, key)
+            }
+        }
+    }
+    bucket, ok := p.sources[client]
+    if !ok {
+        if len(p.sources) >= maxStatusSources {
+            return false
+        }
+        bucket = &tokenBucket{tokens: float64(p.cfg.Burst), last: now}
+        p.sources[client] = bucket
+    }
+    return bucket.take(now, p.cfg.Rate, float64(p.cfg.Burst))
+}
+
+// Serve listens on ListenAddr and serves Handler until Stop
+func (p *ServerStatusPublisher) Serve() error {
+    listener, err := net.Listen("tcp", p.cfg.ListenAddr)
+    if err != nil {
+        return fmt.Errorf("failed to listen for server status on %s: %w", p.cfg.ListenAddr, err)
+    }
+    p.server = &http.Server{Handler: p.Handler(), ReadHeaderTimeout: 5 * time.Second}
+    go p.server.Serve(listener)
+    return nil
+}
+
+// Stop ends refreshing and closes the listener
+func (p *ServerStatusPublisher) Stop() error {
+    p.stopOnce.Do(func() { close(p.stop) })
+    if p.server != nil {
+        return p.server.Close()
+    }
+    return nil
+}
+
+func (vpn *UnderTheRadarVPN) startServerStatus(cfg ServerStatusConfig) error {
+    if vpn.planning != nil {
+        vpn.planning.note(ChangeService, "serve the server status on %s", cfg.ListenAddr)
+        return nil
+    }
+    publisher, err := NewServerStatusPublisher(vpn, cfg)
+    if err != nil {
+        return err
+    }
+    if err := publisher.Serve(); err != nil {
+        return err
+    }
+    go publisher.Start()
+    
+    vpn.mu.Lock()
+    vpn.serverStatus = publisher
+    vpn.mu.Unlock()
+    return nil
+}
+
+func (vpn *UnderTheRadarVPN) stopServerStatus() error {
+    vpn.mu.Lock()
+    publisher := vpn.serverStatus
+    vpn.serverStatus = nil
+    vpn.mu.Unlock()
+    
+    if publisher == nil {
+        return nil
+    }
+    return publisher.Stop()
+}
+
+// StatusSource is where ServerSelector fetches one server's document. With
+// a SigningKey, from the server's StatusSigningKey, only documents it
+// signed are accepted.
+type StatusSource struct {
+    URL        string
+    SigningKey ed25519.PublicKey
+}
+
+// ServerSelector picks a server by the status documents the servers
+// publish, see ServerStatusConfig
+type ServerSelector struct {
+    Sources []StatusSource
+    MaxAge  time.Duration // older documents are refused, default DefaultServerStatusMaxAge
+    
+    client *http.Client
+    clock  Clock
+}
+
+func NewServerSelector(sources []StatusSource) *ServerSelector {
+    return &ServerSelector{
+        Sources: sources,
+        MaxAge:  DefaultServerStatusMaxAge,
+        client:  &http.Client{Timeout: 10 * time.Second},
+        clock:   RealClock{},
+    }
+}
+
+// Fetch gets and verifies the document of src
+func (s *ServerSelector) Fetch(src StatusSource) (ServerStatus, error) {
+    resp, err := s.client.Get(src.URL)
+    if err != nil {
+        return ServerStatus{}, fmt.Errorf("failed to fetch server status from %s: %w", src.URL, err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return ServerStatus{}, fmt.Errorf("failed to fetch server status from %s: %s", src.URL, resp.Status)
+    }
+    body, err := io.ReadAll(io.LimitReader(resp.Body, maxStatusBodySize))
+    if err != nil {
+        return ServerStatus{}, fmt.Errorf("failed to read server status from %s: %w", src.URL, err)
+    }
+    return s.verify(src, body, resp.Header.Get(ServerStatusSignatureHeader))
+}
+
+func (s *ServerSelector) verify(src StatusSource, body []byte, signature string) (ServerStatus, error) {
+    if src.SigningKey != nil {
+        sig, err := base64.StdEncoding.DecodeString(signature)
+        if err != nil || !ed25519.Verify(src.SigningKey, body, sig) {
+            return ServerStatus{}, fmt.Errorf("%w: %s", ErrStatusSignature, src.URL)
+        }
+    }
+    
+    var status ServerStatus
+    decoder := json.NewDecoder(bytes.NewReader(body))
+    if err := decoder.Decode(&status); err != nil {
+        return ServerStatus{}, fmt.Errorf("failed to decode server status from %s: %w", src.URL, err)
+    }
+    if src.SigningKey != nil && status.SigningKey != base64.StdEncoding.EncodeToString(src.SigningKey) {
+        return ServerStatus{}, fmt.Errorf("%w: %s names another key", ErrStatusSignature, src.URL)
+    }
+    // A replayed document of an idle server would draw every client to it
+    if age := orRealClock(s.clock).Now().Sub(status.GeneratedAt); s.MaxAge > 0 && age > s.MaxAge {
+        return ServerStatus{}, fmt.Errorf("server status from %s is %s old", src.URL, age.Round(time.Second))
+    }
+    return status, nil
+}
+
+// Select fetches every source and returns the server in region, any when
+// empty, with the most capacity left, then the fewest peers. Servers
+// hiding both rank last. Sources that fail are skipped and reported along
+// with ErrNoServerAvailable when none is left.
+func (s *ServerSelector) Select(region string) (ServerStatus, error) {
+    var candidates []ServerStatus
+    var errs []error
+    for _, src := range s.Sources {
+        status, err := s.Fetch(src)
+        if err != nil {
+            errs = append(errs, err)
+            continue
+        }
+        if status.inRegion(region) {
+            candidates = append(candidates, status)
+        }
+    }
+    if len(candidates) == 0 {
+        return ServerStatus{}, errors.Join(append([]error{ErrNoServerAvailable}, errs...)...)
+    }
+    
+    available := func(s ServerStatus) float64 {
+        if s.AvailablePercent == nil {
+            return -1
+        }
+        return *s.AvailablePercent
+    }
+    peers := func(s ServerStatus) int {
+        if s.Peers == nil {
+            return math.MaxInt
+        }
+        return *s.Peers
+    }
+    sort.SliceStable(candidates, func(i, j int) bool {
+        a, b := candidates[i], candidates[j]
+        if available(a) != available(b) {
+            return available(a) > available(b)
+        }
+        return peers(a) < peers(b)
+    })
+    return candidates[0], nil
+}
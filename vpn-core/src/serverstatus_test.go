@@ -0,0 +1,150 @@
+package main
+
+import (
+    "crypto/ed25519"
+    "errors"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+// A gateway with a device key and peers publishing its status
+func newStatusVPN(t *testing.T, clock *FakeClock, peers int) *UnderTheRadarVPN {
+    t.Helper()
+    vpn := newTestVPN(t, newFakeWGClient())
+    vpn.timeSource = clock
+    vpn.listenPort = 51820
+    vpn.keys.Put(deviceKeyName, SecretFromKey(mustKey(t)))
+    for i := 0; i < peers; i++ {
+        addStatsPeer(t, vpn, "", 0)
+    }
+    return vpn
+}
+
+func serveStatus(t *testing.T, vpn *UnderTheRadarVPN, cfg ServerStatusConfig) (*ServerStatusPublisher, string) {
+    t.Helper()
+    publisher, err := NewServerStatusPublisher(vpn, cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    server := httptest.NewServer(publisher.Handler())
+    t.Cleanup(server.Close)
+    return publisher, server.URL + ServerStatusPath
+}
+
+func TestServerStatusIsSignedAndVerified(t *testing.T) {
+    clock := NewFakeClock(time.Unix(1700000000, 0))
+    vpn := newStatusVPN(t, clock, 2)
+    vpn.config.HopPorts = []int{443, 51820}
+    peer := vpn.peers.list[0]
+    peer.history.handshake(clock.Now().Add(-2 * time.Minute))
+    peer.history.handshake(clock.Now().Add(-10 * time.Second))
+    
+    publisher, url := serveStatus(t, vpn, ServerStatusConfig{
+        Regions:       []string{"eu-central"},
+        CapacityBytes: 1000,
+        MaxPeers:      10,
+        Sign:          true,
+    })
+    
+    // 500 bytes per second of 1000, while 8 of 10 peer slots are free
+    clock.Advance(10 * time.Second)
+    peer.RxBytes.Add(5000)
+    if err := publisher.Refresh(); err != nil {
+        t.Fatal(err)
+    }
+    
+    key, err := vpn.StatusSigningKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    selector := NewServerSelector([]StatusSource{{URL: url, SigningKey: key}})
+    selector.clock = clock
+    status, err := selector.Select("eu-central")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if status.PublicKey != vpn.privateKey().Key().PublicKey().String() {
+        t.Errorf("public key %s", status.PublicKey)
+    }
+    if *status.AvailablePercent != 50 || *status.Peers != 2 || *status.HandshakesPerMinute != 1 {
+        t.Errorf("available %v, peers %d, handshakes %d", *status.AvailablePercent, *status.Peers, *status.HandshakesPerMinute)
+    }
+    if len(status.Ports) != 2 || status.Ports[0] != 443 || status.Ports[1] != 51820 || len(status.ObfuscationModes) != 3 {
+        t.Errorf("ports %v, obfuscation %v", status.Ports, status.ObfuscationModes)
+    }
+    
+    // Another server's key, or a document gone stale
+    other := NewServerSelector([]StatusSource{{URL: url, SigningKey: statusSigner(SecretFromKey(mustKey(t))).Public().(ed25519.PublicKey)}})
+    other.clock = clock
+    if _, err := other.Select(""); !errors.Is(err, ErrStatusSignature) || !errors.Is(err, ErrNoServerAvailable) {
+        t.Fatalf("foreign key gave %v", err)
+    }
+    clock.Advance(DefaultServerStatusMaxAge + time.Second)
+    if _, err := selector.Select(""); err == nil || !strings.Contains(err.Error(), "old") {
+        t.Fatalf("stale document gave %v", err)
+    }
+}
+
+func TestServerStatusHidesFieldsAndLimitsRate(t *testing.T) {
+    clock := NewFakeClock(time.Unix(1700000000, 0))
+    vpn := newStatusVPN(t, clock, 3)
+    _, url := serveStatus(t, vpn, ServerStatusConfig{
+        Hide:  StatusPeerCount | StatusPorts | StatusHandshakeRate,
+        Burst: 2,
+    })
+    
+    get := func() (int, string) {
+        t.Helper()
+        resp, err := http.Get(url)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer resp.Body.Close()
+        body, _ := io.ReadAll(resp.Body)
+        return resp.StatusCode, string(body)
+    }
+    for i := 0; i < 2; i++ {
+        code, body := get()
+        if code != http.StatusOK {
+            t.Fatalf("request %d: %d", i, code)
+        }
+        for _, field := range []string{`"peers"`, `"ports"`, `"handshakes_per_minute"`, `"available_percent"`, `"signing_key"`} {
+            if strings.Contains(body, field) {
+                t.Fatalf("%s published in %s", field, body)
+            }
+        }
+    }
+    if code, _ := get(); code != http.StatusTooManyRequests {
+        t.Fatalf("burst exceeded, got %d", code)
+    }
+    clock.Advance(time.Second)
+    if code, _ := get(); code != http.StatusOK {
+        t.Fatalf("after refill, got %d", code)
+    }
+}
+
+func TestServerSelectorPicksMostAvailable(t *testing.T) {
+    clock := NewFakeClock(time.Unix(1700000000, 0))
+    _, busy := serveStatus(t, newStatusVPN(t, clock, 6), ServerStatusConfig{Regions: []string{"eu"}, MaxPeers: 10})
+    _, idle := serveStatus(t, newStatusVPN(t, clock, 1), ServerStatusConfig{Regions: []string{"us"}, MaxPeers: 10})
+    _, quiet := serveStatus(t, newStatusVPN(t, clock, 0), ServerStatusConfig{Regions: []string{"eu"}, Hide: StatusCapacity})
+    
+    selector := NewServerSelector([]StatusSource{{URL: busy}, {URL: idle}, {URL: quiet}, {URL: busy + "/missing"}})
+    selector.clock = clock
+    for region, want := range map[string]float64{"": 90, "eu": 40} {
+        status, err := selector.Select(region)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if status.AvailablePercent == nil || *status.AvailablePercent != want {
+            t.Errorf("region %q: picked %+v", region, status)
+        }
+    }
+    if _, err := selector.Select("ap"); !errors.Is(err, ErrNoServerAvailable) {
+        t.Fatalf("unknown region gave %v", err)
+    }
+}
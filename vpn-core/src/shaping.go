@@ -0,0 +1,315 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    mrand "math/rand/v2"
+    "sort"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    shapingHeader     = 3 // frame type, then the payload length
+    shapingFrameData  = 0x00
+    shapingFrameCover = 0x01
+    
+    // Transport packets this small are taken to be interactive, ACKs,
+    // keystrokes or DNS, and never delayed
+    shapingInteractiveSize = 160
+)
+
+// Size buckets packets are padded up to when TrafficShaping names none
+var DefaultPadBuckets = []int{256, 512, 1024, 1420}
+
+var (
+    // ErrCoverPacket is returned by DeobfuscatePacket for the peer's cover
+    // traffic, which carries nothing and is to be dropped
+    ErrCoverPacket = errors.New("cover packet")
+    
+    errCoverRunning = errors.New("cover traffic already running")
+)
+
+// TrafficShaping hides the sizes and timing that give WireGuard away even
+// under obfuscation: 148 byte initiations, 32 byte keepalives, silence
+// when idle. It works inside the obfuscation layer, so both ends must have
+// it on; NegotiateCapabilities only turns it on when the peer supports it.
+type TrafficShaping struct {
+    // Every packet is padded to the smallest bucket it fits, default
+    // DefaultPadBuckets. Buckets above MaxPaddedSize are not used.
+    PadBuckets    []int
+    MaxPaddedSize int // default DefaultMaxPaddedSize, keep it under the path MTU
+    
+    // Send a cover packet of a random bucket size after idling for about
+    // this long, randomized by half either way, once StartCover runs
+    CoverInterval time.Duration
+    
+    // Senders hold bulk packets up to this long, see ShapingDelay.
+    // Handshakes and small packets are never delayed.
+    MaxDelay time.Duration
+}
+
+func (s TrafficShaping) validate() error {
+    if s.CoverInterval < 0 || s.MaxDelay < 0 || s.MaxPaddedSize < 0 {
+        return fmt.Errorf("negative traffic shaping setting")
+    }
+    for i, size := range s.PadBuckets {
+        if size <= shapingHeader || i > 0 && size <= s.PadBuckets[i-1] {
+            return fmt.Errorf("pad buckets %v not ascending sizes above %d", s.PadBuckets, shapingHeader)
+        }
+    }
+    return nil
+}
+
+// ShapingStats count what traffic shaping cost since it was set
+type ShapingStats struct {
+    Packets        uint64
+    PayloadBytes   uint64 // before shaping
+    PaddingBytes   uint64 // frame headers and padding of real packets
+    CoverPackets   uint64
+    CoverBytes     uint64
+    DelayedPackets uint64
+    Delay          time.Duration // summed over the delayed packets
+}
+
+// OverheadPercent is the bandwidth shaping adds on top of the payload
+func (s ShapingStats) OverheadPercent() float64 {
+    if s.PayloadBytes == 0 {
+        return 0
+    }
+    return float64(s.PaddingBytes+s.CoverBytes) / float64(s.PayloadBytes) * 100
+}
+
+func (s ShapingStats) add(other ShapingStats) ShapingStats {
+    s.Packets += other.Packets
+    s.PayloadBytes += other.PayloadBytes
+    s.PaddingBytes += other.PaddingBytes
+    s.CoverPackets += other.CoverPackets
+    s.CoverBytes += other.CoverBytes
+    s.DelayedPackets += other.DelayedPackets
+    s.Delay += other.Delay
+    return s
+}
+
+// Shaping of the VPN's obfuscator and of every peer's own, summed. Caller
+// holds vpn.mu.
+func (vpn *UnderTheRadarVPN) shapingStatsLocked() ShapingStats {
+    stats := vpn.obfuscator.ShapingStats()
+    for _, peer := range vpn.peers.list {
+        if ob := peer.extras().obfuscator; ob != nil {
+            stats = stats.add(ob.ShapingStats())
+        }
+    }
+    return stats
+}
+
+type trafficShaper struct {
+    cfg     TrafficShaping
+    maxSize atomic.Int64
+    clock   Clock
+    
+    lastSent atomic.Int64 // unix nanoseconds of the clock
+    
+    packets        atomic.Uint64
+    payloadBytes   atomic.Uint64
+    paddingBytes   atomic.Uint64
+    coverPackets   atomic.Uint64
+    coverBytes     atomic.Uint64
+    delayedPackets atomic.Uint64
+    delay          atomic.Int64
+}
+
+func newTrafficShaper(cfg TrafficShaping, clock Clock) *trafficShaper {
+    if len(cfg.PadBuckets) == 0 {
+        cfg.PadBuckets = DefaultPadBuckets
+    }
+    cfg.PadBuckets = append([]int(nil), cfg.PadBuckets...)
+    if cfg.MaxPaddedSize == 0 {
+        cfg.MaxPaddedSize = DefaultMaxPaddedSize
+    }
+    s := &trafficShaper{cfg: cfg, clock: clock}
+    s.maxSize.Store(int64(cfg.MaxPaddedSize))
+    s.lastSent.Store(clock.Now().UnixNano())
+    return s
+}
+
+// Smallest usable bucket for n bytes, n itself if none fits
+func (s *trafficShaper) bucket(n int) int {
+    limit := int(s.maxSize.Load())
+    i := sort.SearchInts(s.cfg.PadBuckets, n)
+    if i == len(s.cfg.PadBuckets) || s.cfg.PadBuckets[i] > limit {
+        return n
+    }
+    return s.cfg.PadBuckets[i]
+}
+
+// Type, length and payload, padded with random bytes to a bucket
+func (s *trafficShaper) frame(frameType byte, data []byte, size int) []byte {
+    result := make([]byte, size)
+    result[0] = frameType
+    binary.BigEndian.PutUint16(result[1:], uint16(len(data)))
+    copy(result[shapingHeader:], data)
+    rand.Read(result[shapingHeader+len(data):])
+    return result
+}
+
+func (s *trafficShaper) shape(data []byte) []byte {
+    size := s.bucket(shapingHeader + len(data))
+    s.packets.Add(1)
+    s.payloadBytes.Add(uint64(len(data)))
+    s.paddingBytes.Add(uint64(size - len(data)))
+    s.lastSent.Store(s.clock.Now().UnixNano())
+    return s.frame(shapingFrameData, data, size)
+}
+
+// A cover packet of a random usable bucket size
+func (s *trafficShaper) cover() []byte {
+    usable := 0
+    for _, size := range s.cfg.PadBuckets {
+        if size <= int(s.maxSize.Load()) {
+            usable++
+        }
+    }
+    size := shapingHeader
+    if usable > 0 {
+        size = s.cfg.PadBuckets[mrand.IntN(usable)]
+    }
+    s.coverPackets.Add(1)
+    s.coverBytes.Add(uint64(size))
+    return s.frame(shapingFrameCover, nil, size)
+}
+
+func unshape(data []byte) ([]byte, error) {
+    if len(data) < shapingHeader {
+        return nil, ErrBadObfuscatedRecord
+    }
+    n := int(binary.BigEndian.Uint16(data[1:]))
+    switch {
+    case data[0] == shapingFrameCover:
+        return nil, ErrCoverPacket
+    case data[0] != shapingFrameData || n > len(data)-shapingHeader:
+        return nil, ErrBadObfuscatedRecord
+    }
+    return data[shapingHeader : shapingHeader+n], nil
+}
+
+func (s *trafficShaper) stats() ShapingStats {
+    return ShapingStats{
+        Packets:        s.packets.Load(),
+        PayloadBytes:   s.payloadBytes.Load(),
+        PaddingBytes:   s.paddingBytes.Load(),
+        CoverPackets:   s.coverPackets.Load(),
+        CoverBytes:     s.coverBytes.Load(),
+        DelayedPackets: s.delayedPackets.Load(),
+        Delay:          time.Duration(s.delay.Load()),
+    }
+}
+
+// SetShaping shapes datagrams before obfuscating them, nil turns it off.
+// It replaces SetPadding's padding while on. Both ends must agree, see
+// NegotiateCapabilities.
+func (ob *Obfuscator) SetShaping(cfg *TrafficShaping) error {
+    if cfg == nil {
+        ob.StopCover()
+        ob.shaper.Store(nil)
+        return nil
+    }
+    if err := cfg.validate(); err != nil {
+        return err
+    }
+    ob.shaper.Store(newTrafficShaper(*cfg, ob.clock))
+    return nil
+}
+
+// SetShapingMaxSize lowers or raises the largest size packets are padded
+// to, as the path MTU changes. Packets larger than every usable bucket are
+// sent unpadded.
+func (ob *Obfuscator) SetShapingMaxSize(n int) {
+    if shaper := ob.shaper.Load(); shaper != nil && n > 0 {
+        shaper.maxSize.Store(int64(n))
+    }
+}
+
+// ShapingStats reports the bandwidth and delay shaping has added, zero
+// while it is off
+func (ob *Obfuscator) ShapingStats() ShapingStats {
+    if shaper := ob.shaper.Load(); shaper != nil {
+        return shaper.stats()
+    }
+    return ShapingStats{}
+}
+
+// ShapingDelay is how long the sender should hold packet before sending
+// it: a random time up to TrafficShaping.MaxDelay for bulk packets, none
+// for handshakes and packets small enough to be interactive
+func (ob *Obfuscator) ShapingDelay(packet []byte) time.Duration {
+    shaper := ob.shaper.Load()
+    if shaper == nil || shaper.cfg.MaxDelay <= 0 || !ob.enabled.Load() {
+        return 0
+    }
+    if ClassifyPacket(packet) == PriorityHandshake || len(packet) <= shapingInteractiveSize {
+        return 0
+    }
+    delay := mrand.N(shaper.cfg.MaxDelay + 1)
+    shaper.delayedPackets.Add(1)
+    shaper.delay.Add(int64(delay))
+    return delay
+}
+
+// StartCover sends cover packets to the peer over to, the datagram
+// connection real packets go out on, whenever the tunnel has been idle for
+// the randomized TrafficShaping.CoverInterval
+func (ob *Obfuscator) StartCover(to io.Writer) error {
+    shaper := ob.shaper.Load()
+    if shaper == nil || shaper.cfg.CoverInterval <= 0 {
+        return fmt.Errorf("cover traffic needs traffic shaping with a CoverInterval")
+    }
+    
+    ob.keyMu.Lock()
+    if ob.cover != nil {
+        ob.keyMu.Unlock()
+        return errCoverRunning
+    }
+    stop, done := make(chan struct{}), make(chan struct{})
+    ob.cover, ob.coverDone = stop, done
+    ob.keyMu.Unlock()
+    
+    go withPhaseLabel(PhaseObfuscation, func() {
+        defer close(done)
+        for {
+            interval := shaper.cfg.CoverInterval
+            wait := interval/2 + mrand.N(interval+1)
+            select {
+            case <-ob.clock.After(wait):
+            case <-stop:
+                return
+            }
+            // SetShaping may have replaced it meanwhile
+            if shaper = ob.shaper.Load(); shaper == nil || shaper.cfg.CoverInterval <= 0 {
+                return
+            }
+            idle := ob.clock.Now().Sub(time.Unix(0, shaper.lastSent.Load()))
+            if idle < wait || !ob.enabled.Load() {
+                continue
+            }
+            to.Write(ob.encode(shaper.cover()))
+        }
+    })
+    return nil
+}
+
+// StopCover ends cover traffic, waiting for a packet being sent
+func (ob *Obfuscator) StopCover() {
+    ob.keyMu.Lock()
+    stop, done := ob.cover, ob.coverDone
+    ob.cover, ob.coverDone = nil, nil
+    ob.keyMu.Unlock()
+    
+    if stop != nil {
+        close(stop)
+        <-done
+    }
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "net"
+    "sync"
+    "testing"
+    "time"
+)
+
+// Two obfuscators sharing an XOR key, the sender shaping
+func shapedPair(t *testing.T, cfg TrafficShaping) (send, recv *Obfuscator) {
+    t.Helper()
+    
+    key := bytes.Repeat([]byte{0x5a}, xorKeySize)
+    send, recv = NewObfuscator(), NewObfuscator()
+    for _, ob := range []*Obfuscator{send, recv} {
+        ob.Configure(ObfuscationXOR, key)
+        if err := ob.SetShaping(&cfg); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return send, recv
+}
+
+func TestShapingPadsToBuckets(t *testing.T) {
+    send, recv := shapedPair(t, TrafficShaping{})
+    
+    for _, tt := range []struct {
+        size, wire int
+    }{
+        {32, 256},   // keepalive
+        {148, 256},  // handshake initiation
+        {253, 256},  // exactly fills with the header
+        {254, 512},
+        {1100, 1420},
+        {1500, 1503}, // beyond every bucket, framed only
+    } {
+        packet := bytes.Repeat([]byte{byte(tt.size)}, tt.size)
+        out := send.ObfuscatePacket(packet)
+        if len(out) != tt.wire+1 { // XOR key ID
+            t.Errorf("%d bytes went out as %d, want %d", tt.size, len(out)-1, tt.wire)
+        }
+        if got, err := recv.DeobfuscatePacket(out); err != nil || !bytes.Equal(got, packet) {
+            t.Errorf("%d bytes came back as %d, %v", tt.size, len(got), err)
+        }
+    }
+    
+    stats := send.ShapingStats()
+    if stats.Packets != 6 || stats.PayloadBytes != 32+148+253+254+1100+1500 {
+        t.Fatalf("stats %+v", stats)
+    }
+    if padding := uint64(3*256+512+1420+1503) - stats.PayloadBytes; stats.PaddingBytes != padding {
+        t.Fatalf("padding %d bytes, want %d", stats.PaddingBytes, padding)
+    }
+    if stats.OverheadPercent() <= 0 {
+        t.Fatal("no overhead reported")
+    }
+}
+
+func TestShapingRespectsMaxSize(t *testing.T) {
+    send, _ := shapedPair(t, TrafficShaping{MaxPaddedSize: 1200})
+    if n := len(send.ObfuscatePacket(make([]byte, 1100))) - 1; n != 1103 {
+        t.Fatalf("padded to %d past the 1200 limit", n)
+    }
+    
+    // As a smaller path MTU is found
+    send.SetShapingMaxSize(600)
+    if n := len(send.ObfuscatePacket(make([]byte, 520))) - 1; n != 523 {
+        t.Fatalf("padded to %d past the 600 limit", n)
+    }
+    for i := 0; i < 50; i++ {
+        if n := len(send.shaper.Load().cover()); n > 600 {
+            t.Fatalf("cover packet of %d bytes", n)
+        }
+    }
+    if got, want := EffectiveMTU(1500, send), 1500-wireGuardOverhead-shapingHeader-1; got != want {
+        t.Fatalf("EffectiveMTU %d, want %d", got, want)
+    }
+}
+
+func TestShapingDelayOnlyBulk(t *testing.T) {
+    send, _ := shapedPair(t, TrafficShaping{MaxDelay: 20 * time.Millisecond})
+    
+    initiation := make([]byte, 148)
+    initiation[0] = 1
+    if d := send.ShapingDelay(initiation); d != 0 {
+        t.Fatalf("handshake delayed %v", d)
+    }
+    keepalive := make([]byte, 32)
+    keepalive[0] = 4
+    if d := send.ShapingDelay(keepalive); d != 0 {
+        t.Fatalf("small packet delayed %v", d)
+    }
+    
+    bulk := make([]byte, 1200)
+    bulk[0] = 4
+    var total time.Duration
+    for i := 0; i < 100; i++ {
+        d := send.ShapingDelay(bulk)
+        if d < 0 || d > 20*time.Millisecond {
+            t.Fatalf("delay %v out of bounds", d)
+        }
+        total += d
+    }
+    if stats := send.ShapingStats(); stats.DelayedPackets != 100 || stats.Delay != total || total == 0 {
+        t.Fatalf("stats %+v, delayed %v in total", stats, total)
+    }
+}
+
+// Records what the cover loop writes
+type coverSink struct {
+    mu      sync.Mutex
+    packets [][]byte
+}
+
+func (s *coverSink) Write(p []byte) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.packets = append(s.packets, append([]byte(nil), p...))
+    return len(p), nil
+}
+
+func (s *coverSink) count() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return len(s.packets)
+}
+
+func TestCoverTrafficOnlyWhenIdle(t *testing.T) {
+    clock := NewFakeClock(time.Now())
+    send, recv := NewObfuscator(), NewObfuscator()
+    send.clock = clock
+    key := bytes.Repeat([]byte{0x5a}, xorKeySize)
+    for _, ob := range []*Obfuscator{send, recv} {
+        ob.Configure(ObfuscationXOR, key)
+        ob.SetShaping(&TrafficShaping{CoverInterval: 10 * time.Second})
+    }
+    sink := &coverSink{}
+    if err := send.StartCover(sink); err != nil {
+        t.Fatal(err)
+    }
+    defer send.StopCover()
+    if err := send.StartCover(sink); !errors.Is(err, errCoverRunning) {
+        t.Fatalf("second StartCover gave %v", err)
+    }
+    
+    // Busy: a packet every second keeps it quiet
+    for i := 0; i < 60; i++ {
+        send.ObfuscatePacket([]byte("data"))
+        clock.Advance(time.Second)
+        time.Sleep(time.Millisecond)
+    }
+    if n := sink.count(); n != 0 {
+        t.Fatalf("%d cover packets while busy", n)
+    }
+    
+    advanceUntil(t, clock, time.Second, func() bool { return sink.count() >= 2 })
+    sink.mu.Lock()
+    packet := sink.packets[0]
+    sink.mu.Unlock()
+    if _, err := recv.DeobfuscatePacket(packet); !errors.Is(err, ErrCoverPacket) {
+        t.Fatalf("cover packet decoded to %v", err)
+    }
+    if stats := send.ShapingStats(); stats.CoverPackets < 2 || stats.CoverBytes < 2*256 {
+        t.Fatalf("stats %+v", stats)
+    }
+    
+    // Turning shaping off stops it
+    send.SetShaping(nil)
+    if err := send.StartCover(sink); err == nil {
+        t.Fatal("cover started without shaping")
+    }
+}
+
+func TestShapingValidate(t *testing.T) {
+    for _, cfg := range []TrafficShaping{
+        {PadBuckets: []int{512, 256}},
+        {PadBuckets: []int{2}},
+        {MaxDelay: -time.Second},
+    } {
+        if err := NewObfuscator().SetShaping(&cfg); err == nil {
+            t.Errorf("%+v accepted", cfg)
+        }
+    }
+}
+
+func TestNegotiateCapabilitiesAgreesOnShaping(t *testing.T) {
+    for _, peerShapes := range []bool{true, false} {
+        a, b, aPeer, bPeer := keyExchangePair(t, false)
+        a.config.TrafficShaping = &TrafficShaping{}
+        if peerShapes {
+            b.config.TrafficShaping = &TrafficShaping{}
+        }
+        
+        local, other := net.Pipe()
+        go b.NegotiateCapabilities(bPeer, other, false)
+        if err := a.NegotiateCapabilities(aPeer, local, true); err != nil {
+            t.Fatal(err)
+        }
+        local.Close()
+        other.Close()
+        
+        if on := peerObfuscator(t, a, aPeer).shaper.Load() != nil; on != peerShapes {
+            t.Errorf("peer shaping %v, ours on %v", peerShapes, on)
+        }
+        if got := a.peers.get(aPeer).ActiveCapabilities.SupportsShaping; got != peerShapes {
+            t.Errorf("agreed on shaping %v with a peer that %v", got, peerShapes)
+        }
+        if a.obfuscator.shaper.Load() != nil {
+            t.Error("shaping turned on for every peer")
+        }
+    }
+}
+
+func TestShapingPerPeer(t *testing.T) {
+    hub, b, hubPeerB, bPeer := keyExchangePair(t, false)
+    c, hubPeerC, cPeer := addSpoke(t, hub, false)
+    hub.config.TrafficShaping = &TrafficShaping{}
+    b.config.TrafficShaping = &TrafficShaping{}
+    
+    // c, negotiating last, doesn't turn b's shaping off
+    negotiatePair(t, hub, b, hubPeerB, bPeer)
+    negotiatePair(t, hub, c, hubPeerC, cPeer)
+    toB, toC := peerObfuscator(t, hub, hubPeerB), peerObfuscator(t, hub, hubPeerC)
+    if toB.shaper.Load() == nil {
+        t.Fatal("shaping with b turned off")
+    }
+    if toC.shaper.Load() != nil {
+        t.Fatal("shaping with c, which doesn't support it")
+    }
+    
+    packet := make([]byte, 100)
+    fromB, fromC := peerObfuscator(t, b, bPeer), peerObfuscator(t, c, cPeer)
+    for _, ob := range []*Obfuscator{toB, toC, fromB, fromC} {
+        ob.Configure(ObfuscationTLS, nil)
+    }
+    if shaped := toB.ObfuscatePacket(packet); len(shaped) <= tlsRecordHeaderSize+len(packet) {
+        t.Fatalf("packet to b not padded: %d bytes", len(shaped))
+    } else if got, err := fromB.DeobfuscatePacket(shaped); err != nil || !bytes.Equal(got, packet) {
+        t.Fatalf("b got %d bytes, %v", len(got), err)
+    }
+    if plain := toC.ObfuscatePacket(packet); len(plain) != tlsRecordHeaderSize+len(packet) {
+        t.Fatalf("packet to c shaped: %d bytes", len(plain))
+    } else if got, err := fromC.DeobfuscatePacket(plain); err != nil || !bytes.Equal(got, packet) {
+        t.Fatalf("c got %d bytes, %v", len(got), err)
+    }
+    
+    // Status sums what shaping cost across peers
+    if stats := hub.GetStatus().Shaping; stats.Packets != 1 || stats.PaddingBytes == 0 {
+        t.Fatalf("shaping stats %+v", stats)
+    }
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+    "context"
+    "net"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// commandLog is a per-instance CommandRunner that only records
+type commandLog struct {
+    mu       sync.Mutex
+    commands []string
+}
+
+func (c *commandLog) run(cmdline string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.commands = append(c.commands, cmdline)
+    return nil
+}
+
+func (c *commandLog) contains(substr string) bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for _, cmd := range c.commands {
+        if strings.Contains(cmd, substr) {
+            return true
+        }
+    }
+    return false
+}
+
+// Build a VPN entirely on fakes; anything reaching the host fails the test
+func newSimulatedVPN(t *testing.T, wg wgController) (*UnderTheRadarVPN, *commandLog) {
+    t.Helper()
+    
+    orig := runSystemCommand
+    runSystemCommand = func(cmdline string) error {
+        t.Errorf("command escaped to the host: %s", cmdline)
+        return nil
+    }
+    t.Cleanup(func() { runSystemCommand = orig })
+    
+    log := &commandLog{}
+    vpn, err := NewUnderTheRadarVPNWithOptions(VPNOptions{
+        DeviceName: "sim0",
+        WGClient:   wg,
+        Commands:   log.run,
+        EBPF:       NoEBPF{},
+        LockDir:    t.TempDir(),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return vpn, log
+}
+
+func TestSimulatedStartUsesInjectedRunner(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn, log := newSimulatedVPN(t, wg)
+    
+    if err := vpn.Start(VPNConfig{ListenPort: 51820, KillSwitch: true}); err != nil {
+        t.Fatal(err)
+    }
+    if !log.contains("ip link add dev sim0") || !log.contains("iptables -A OUTPUT -j DROP") {
+        t.Fatalf("commands = %v", log.commands)
+    }
+    if _, err := wg.Device("sim0"); err != nil {
+        t.Fatal("device was not configured on the fake client")
+    }
+    
+    if err := vpn.Stop(); err != nil {
+        t.Fatal(err)
+    }
+    if !log.contains("iptables -D OUTPUT -j DROP") {
+        t.Fatalf("teardown missing from %v", log.commands)
+    }
+    if !wg.closed {
+        t.Fatal("injected WireGuard client was not closed")
+    }
+}
+
+func TestSimulatedDualStackStart(t *testing.T) {
+    vpn, log := newSimulatedVPN(t, newFakeWGClient())
+    
+    peer := PeerConfig{
+        PublicKey:  mustKey(t).PublicKey(),
+        Endpoint:   &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51820},
+        AllowedIPs: []net.IPNet{mustCIDR(t, "0.0.0.0/0"), mustCIDR(t, "::/0")},
+        SkipProbe:  true,
+    }
+    err := vpn.Start(VPNConfig{
+        ListenPort: 51820,
+        Addresses: []net.IPNet{
+            {IP: net.IPv4(10, 8, 0, 2).To4(), Mask: net.CIDRMask(24, 32)},
+            {IP: net.ParseIP("fd00:8::2"), Mask: net.CIDRMask(64, 128)},
+        },
+        Peers: []PeerConfig{peer},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer vpn.Stop()
+    
+    if !log.contains("ip addr add 10.8.0.2/24 dev sim0") || !log.contains("ip addr add fd00:8::2/64 dev sim0") {
+        t.Fatalf("dual-stack addresses not assigned: %v", log.commands)
+    }
+    
+    vpn.peers.get(peer.PublicKey).IsAlive.Store(true)
+    for _, dst := range []string{"192.0.2.1", "2001:db8:ffff::1"} {
+        if got := vpn.routePacket(net.ParseIP(dst)); got == nil || got.PublicKey != peer.PublicKey {
+            t.Errorf("%s not routed through the dual-stack peer", dst)
+        }
+    }
+}
+
+func TestSimulatedRoutePacket(t *testing.T) {
+    vpn, _ := newSimulatedVPN(t, newFakeWGClient())
+    
+    // Overlapping prefixes: both peers can carry 10.0.1.0/24
+    wide := PeerConfig{PublicKey: mustKey(t).PublicKey(), AllowedIPs: []net.IPNet{mustCIDR(t, "10.0.0.0/16")}}
+    narrow := PeerConfig{PublicKey: mustKey(t).PublicKey(), AllowedIPs: []net.IPNet{mustCIDR(t, "10.0.1.0/24")}}
+    for _, pc := range []PeerConfig{wide, narrow} {
+        if err := vpn.AddPeer(pc); err != nil {
+            t.Fatal(err)
+        }
+    }
+    widePeer := vpn.peers.get(wide.PublicKey)
+    narrowPeer := vpn.peers.get(narrow.PublicKey)
+    widePeer.IsAlive.Store(true)
+    narrowPeer.IsAlive.Store(true)
+    
+    dst := net.ParseIP("10.0.1.5")
+    
+    // Least loaded candidate wins
+    widePeer.LoadScore.Store(10)
+    narrowPeer.LoadScore.Store(500)
+    if got := vpn.routePacket(dst); got != widePeer {
+        t.Fatal("expected the least loaded peer")
+    }
+    
+    // Dead peers are skipped whatever their score
+    widePeer.IsAlive.Store(false)
+    if got := vpn.routePacket(dst); got != narrowPeer {
+        t.Fatal("expected the only live peer")
+    }
+    
+    if got := vpn.routePacket(net.ParseIP("10.0.2.5")); got != nil {
+        t.Fatal("only the wide peer covers 10.0.2.5 and it is dead")
+    }
+    if got := vpn.routePacket(net.ParseIP("192.0.2.1")); got != nil {
+        t.Fatal("no peer covers 192.0.2.1")
+    }
+}
+
+// recoveringWG delivers traffic only for peers using the good endpoint
+type recoveringWG struct {
+    *fakeWGClient
+    good string
+    rx   int64
+}
+
+func (r *recoveringWG) Device(name string) (*wgtypes.Device, error) {
+    dev, err := r.fakeWGClient.Device(name)
+    if err != nil {
+        return nil, err
+    }
+    r.rx += 100
+    for i := range dev.Peers {
+        dev.Peers[i].LastHandshakeTime = time.Now().Add(-time.Hour)
+        if dev.Peers[i].Endpoint != nil && dev.Peers[i].Endpoint.String() == r.good {
+            dev.Peers[i].ReceiveBytes = r.rx
+        }
+    }
+    return dev, nil
+}
+
+func TestSimulatedFailoverToAlternateEndpoint(t *testing.T) {
+    wg := &recoveringWG{fakeWGClient: newFakeWGClient(), good: "192.0.2.2:51820"}
+    vpn, _ := newSimulatedVPN(t, wg)
+    vpn.SetHealthStrategy("", NewPassiveHealth())
+    vpn.failoverMgr.settleTime = 0
+    
+    pc := PeerConfig{
+        PublicKey:          mustKey(t).PublicKey(),
+        Endpoint:           &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820},
+        AllowedIPs:         []net.IPNet{mustCIDR(t, "10.9.0.0/24")},
+        AlternateEndpoints: []net.UDPAddr{{IP: net.ParseIP("192.0.2.2"), Port: 51820}},
+        SkipProbe:          true,
+    }
+    if err := vpn.AddPeer(pc); err != nil {
+        t.Fatal(err)
+    }
+    peer := vpn.peers.get(pc.PublicKey)
+    
+    // The primary endpoint never delivers traffic
+    vpn.healthCheck.checkAll()
+    vpn.healthCheck.checkAll()
+    if vpn.healthCheck.IsHealthy(peer) {
+        t.Fatal("peer on a silent endpoint should be unhealthy")
+    }
+    
+    vpn.failoverMgr.checkPeers(context.Background())
+    if peer.Endpoint.String() != wg.good {
+        t.Fatalf("endpoint = %v, want alternate", peer.Endpoint)
+    }
+    if !peer.IsAlive.Load() {
+        t.Fatal("peer should be alive again on the alternate endpoint")
+    }
+    if got := vpn.routePacket(net.ParseIP("10.9.0.1")); got != peer {
+        t.Fatal("recovered peer should carry traffic again")
+    }
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "syscall"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+    // Policy routing for the device's own packets with BindInterface,
+    // ahead of the split tunnel rules
+    encapTable        = 51823
+    encapRulePriority = 9000
+)
+
+var (
+    ErrSocketNeedsUserspace     = errors.New("UDPSocket needs a userspace WireGuard device, the kernel device opens its own socket")
+    ErrBindNeedsMark            = errors.New("BindInterface needs a FirewallMark to route the kernel device's packets")
+    ErrMarkConflict             = errors.New("FirewallMark collides with the split tunnel marks")
+    ErrSocketOptionsUnsupported = errors.New("binding sockets to an interface or mark is not supported on this platform")
+)
+
+// Check the socket settings before the device is touched. A pre-created
+// socket carries the interface binding itself, the kernel device only
+// reaches BindInterface through policy routing on its mark.
+func validateSocketConfig(config VPNConfig) error {
+    if config.BindInterface != "" && config.FirewallMark == 0 && config.UDPSocket == nil {
+        return ErrBindNeedsMark
+    }
+    if config.FirewallMark&0xff00 == splitTunnelMark&0xff00 {
+        return fmt.Errorf("%w: 0x%x", ErrMarkConflict, config.FirewallMark)
+    }
+    return nil
+}
+
+// Apply BindInterface, FirewallMark and UDPSocket to a device that exists.
+// Caller rolls back with removeSocketRouting.
+func (vpn *UnderTheRadarVPN) setupSocket(config VPNConfig, device *wgtypes.Device) error {
+    if config.UDPSocket != nil {
+        if device == nil || device.Type != wgtypes.Userspace {
+            return fmt.Errorf("%w: %s", ErrSocketNeedsUserspace, vpn.deviceName)
+        }
+        if vpn.planning != nil {
+            vpn.planning.note(ChangeService, "bind UDPSocket to %s with mark 0x%x", config.BindInterface, config.FirewallMark)
+        } else if err := vpn.setupUDPSocket(config); err != nil {
+            return err
+        }
+    }
+    
+    if config.FirewallMark != 0 {
+        mark := int(config.FirewallMark)
+        if err := vpn.wgClient.ConfigureDevice(vpn.deviceName, wgtypes.Config{FirewallMark: &mark}); err != nil {
+            return fmt.Errorf("failed to set firewall mark: %w", err)
+        }
+    }
+    
+    vpn.mu.Lock()
+    vpn.bindInterface = config.BindInterface
+    vpn.firewallMark = config.FirewallMark
+    vpn.mu.Unlock()
+    
+    if config.BindInterface != "" && config.FirewallMark != 0 {
+        return vpn.setupSocketRouting(config.BindInterface, config.FirewallMark)
+    }
+    return nil
+}
+
+// Set the options on the embedding application's socket. It stays theirs,
+// we only use a duplicate of the descriptor and close that.
+func (vpn *UnderTheRadarVPN) setupUDPSocket(config VPNConfig) error {
+    pc, err := net.FilePacketConn(config.UDPSocket)
+    if err != nil {
+        return fmt.Errorf("invalid UDPSocket: %w", err)
+    }
+    defer pc.Close()
+    
+    conn, ok := pc.(*net.UDPConn)
+    if !ok {
+        return fmt.Errorf("invalid UDPSocket: %s socket, not UDP", pc.LocalAddr().Network())
+    }
+    if port := conn.LocalAddr().(*net.UDPAddr).Port; port != vpn.listenPort {
+        return fmt.Errorf("UDPSocket is bound to port %d, the device listens on %d", port, vpn.listenPort)
+    }
+    
+    raw, err := conn.SyscallConn()
+    if err != nil {
+        return fmt.Errorf("invalid UDPSocket: %w", err)
+    }
+    if err := setSocketOptions(config.BindInterface, config.FirewallMark)("udp", "", raw); err != nil {
+        return fmt.Errorf("failed to set UDPSocket options: %w", err)
+    }
+    return nil
+}
+
+// Route the device's marked packets out of iface through its own table,
+// so they take the chosen interface whatever the main table says, also
+// once the tunnel holds the default route
+func (vpn *UnderTheRadarVPN) setupSocketRouting(iface string, mark uint32) error {
+    v4, v6, err := interfaceDefaultRoutes(iface)
+    if err != nil {
+        return err
+    }
+    
+    var commands []string
+    if v4 != "" {
+        commands = append(commands,
+            fmt.Sprintf("ip route replace default %s table %d", v4, encapTable),
+            fmt.Sprintf("ip rule add fwmark 0x%x lookup %d priority %d", mark, encapTable, encapRulePriority))
+    }
+    if v6 != "" {
+        commands = append(commands,
+            fmt.Sprintf("ip -6 route replace default %s table %d", v6, encapTable),
+            fmt.Sprintf("ip -6 rule add fwmark 0x%x lookup %d priority %d", mark, encapTable, encapRulePriority))
+    }
+    
+    var done []string
+    for _, cmd := range commands {
+        if err := vpn.commands.Run(cmd); err != nil {
+            vpn.commands.removeRoutes(done)
+            return fmt.Errorf("failed to route the device through %s: %w", iface, err)
+        }
+        done = append(done, cmd)
+    }
+    
+    vpn.mu.Lock()
+    vpn.socketRouting = done
+    vpn.mu.Unlock()
+    return nil
+}
+
+func (vpn *UnderTheRadarVPN) removeSocketRouting() error {
+    vpn.mu.Lock()
+    routing := vpn.socketRouting
+    vpn.socketRouting = nil
+    vpn.mu.Unlock()
+    
+    return vpn.commands.removeRoutes(routing)
+}
+
+// Control function for our own sockets to the peers, such as the handshake
+// probe, so they leave the way the device's packets do
+func (vpn *UnderTheRadarVPN) socketControl() func(network, address string, c syscall.RawConn) error {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    if vpn.bindInterface == "" && vpn.firewallMark == 0 {
+        return nil
+    }
+    return setSocketOptions(vpn.bindInterface, vpn.firewallMark)
+}
+
+// interfaceDefaultRoutes returns the IPv4 and IPv6 default routes through
+// iface as "via <gateway> dev <iface>", or "dev <iface>" when on-link;
+// empty for a family without one. Tests replace it.
+var interfaceDefaultRoutes = func(iface string) (string, string, error) {
+    var v4, v6 string
+    if data, err := os.ReadFile("/proc/net/route"); err == nil {
+        for _, line := range strings.Split(string(data), "\n")[1:] {
+            fields := strings.Fields(line)
+            if len(fields) < 3 || fields[0] != iface || fields[1] != "00000000" {
+                continue
+            }
+            gw, err := strconv.ParseUint(fields[2], 16, 32)
+            if err != nil {
+                return "", "", fmt.Errorf("invalid gateway %s: %w", fields[2], err)
+            }
+            v4 = "dev " + iface
+            if gw != 0 {
+                ip := net.IPv4(byte(gw), byte(gw>>8), byte(gw>>16), byte(gw>>24))
+                v4 = fmt.Sprintf("via %s dev %s", ip, iface)
+            }
+            break
+        }
+    }
+    
+    // destination, prefix length, source, its length, next hop, ..., device
+    if data, err := os.ReadFile("/proc/net/ipv6_route"); err == nil {
+        zero := strings.Repeat("0", 32)
+        for _, line := range strings.Split(string(data), "\n") {
+            fields := strings.Fields(line)
+            if len(fields) < 10 || fields[9] != iface || fields[0] != zero || fields[1] != "00" {
+                continue
+            }
+            v6 = "dev " + iface
+            if fields[4] != zero {
+                gw, err := hex.DecodeString(fields[4])
+                if err != nil {
+                    return "", "", fmt.Errorf("invalid gateway %s: %w", fields[4], err)
+                }
+                v6 = fmt.Sprintf("via %s dev %s", net.IP(gw), iface)
+            }
+            break
+        }
+    }
+    
+    if v4 == "" && v6 == "" {
+        return "", "", fmt.Errorf("no default route through %s", iface)
+    }
+    return v4, v6, nil
+}
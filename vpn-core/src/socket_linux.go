@@ -0,0 +1,27 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// Bind a socket to device (SO_BINDTODEVICE) and mark its packets (SO_MARK),
+// skipping what is unset
+func setSocketOptions(device string, mark uint32) func(network, address string, c syscall.RawConn) error {
+    return func(network, address string, c syscall.RawConn) error {
+        var optErr error
+        err := c.Control(func(fd uintptr) {
+            if device != "" {
+                if optErr = syscall.BindToDevice(int(fd), device); optErr != nil {
+                    return
+                }
+            }
+            if mark != 0 {
+                optErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark))
+            }
+        })
+        if err != nil {
+            return err
+        }
+        return optErr
+    }
+}
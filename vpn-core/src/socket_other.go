@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// No SO_BINDTODEVICE or SO_MARK
+func setSocketOptions(device string, mark uint32) func(network, address string, c syscall.RawConn) error {
+    return func(network, address string, c syscall.RawConn) error {
+        if device == "" && mark == 0 {
+            return nil
+        }
+        return ErrSocketOptionsUnsupported
+    }
+}
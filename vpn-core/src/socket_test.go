@@ -0,0 +1,165 @@
+package main
+
+import (
+    "errors"
+    "net"
+    "runtime"
+    "strconv"
+    "strings"
+    "testing"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func indexOf(list []string, s string) int {
+    for i, v := range list {
+        if v == s {
+            return i
+        }
+    }
+    return -1
+}
+
+func TestBindInterfaceRoutesMarkedDevice(t *testing.T) {
+    orig := interfaceDefaultRoutes
+    interfaceDefaultRoutes = func(iface string) (string, string, error) {
+        return "via 192.0.2.1 dev " + iface, "via fe80::1 dev " + iface, nil
+    }
+    t.Cleanup(func() { interfaceDefaultRoutes = orig })
+    
+    wg := newFakeWGClient()
+    vpn, host := newHostTestVPN(t, wg)
+    err := vpn.Start(VPNConfig{
+        ListenPort:    51820,
+        KillSwitch:    true,
+        BindInterface: "eth1",
+        FirewallMark:  0x1234,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    if dev, _ := wg.Device("utr0"); dev.FirewallMark != 0x1234 {
+        t.Fatalf("device mark 0x%x", dev.FirewallMark)
+    }
+    log := host.commands()
+    for _, cmd := range []string{
+        "ip route replace default via 192.0.2.1 dev eth1 table 51823",
+        "ip rule add fwmark 0x1234 lookup 51823 priority 9000",
+        "ip -6 route replace default via fe80::1 dev eth1 table 51823",
+        "ip -6 rule add fwmark 0x1234 lookup 51823 priority 9000",
+    } {
+        if indexOf(log, cmd) < 0 {
+            t.Errorf("missing %q", cmd)
+        }
+    }
+    
+    // The tunnel's packets pass the kill switch before everything is dropped
+    for _, ipt := range []string{"iptables", "ip6tables"} {
+        accept := indexOf(log, ipt+" -A OUTPUT -o eth1 -m mark --mark 0x1234 -j ACCEPT")
+        if accept < 0 || accept > indexOf(log, ipt+" -A OUTPUT -j DROP") {
+            t.Fatalf("%s: no accept rule for the device's packets ahead of DROP", ipt)
+        }
+    }
+    
+    if err := vpn.Reload(VPNConfig{ListenPort: 51820, KillSwitch: true, BindInterface: "eth2", FirewallMark: 0x1234}); !errors.Is(err, ErrRestartRequired) {
+        t.Fatalf("Reload to another interface: %v", err)
+    }
+    
+    vpn.Stop()
+    log = host.commands()
+    if indexOf(log, "ip rule del fwmark 0x1234 lookup 51823 priority 9000") < 0 || indexOf(log, "ip -6 route del default via fe80::1 dev eth1 table 51823") < 0 {
+        t.Fatalf("routing left behind: %v", log)
+    }
+    if len(host.rules) != 0 {
+        t.Fatalf("residual firewall rules: %v", host.rules)
+    }
+}
+
+func TestSocketConfigRejectsUnsupported(t *testing.T) {
+    for _, tt := range []struct {
+        name   string
+        config VPNConfig
+        want   error
+    }{
+        {"interface without mark", VPNConfig{BindInterface: "eth1"}, ErrBindNeedsMark},
+        {"split tunnel mark", VPNConfig{FirewallMark: splitBypassMark}, ErrMarkConflict},
+    } {
+        if err := validateSocketConfig(tt.config); !errors.Is(err, tt.want) {
+            t.Errorf("%s: %v", tt.name, err)
+        }
+    }
+    
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    socket, err := conn.File()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer socket.Close()
+    
+    // A socket can't be handed to a device we create in the kernel
+    vpn, host := newHostTestVPN(t, newFakeWGClient())
+    err = vpn.Start(VPNConfig{ListenPort: 51820, UDPSocket: socket})
+    if !errors.Is(err, ErrSocketNeedsUserspace) || len(host.links) != 0 {
+        t.Fatalf("kernel device with a socket: %v, links %v", err, host.links)
+    }
+    
+    // Nor to an adopted kernel device
+    wg := newFakeWGClient()
+    wg.devices["utr0"] = &wgtypes.Device{Name: "utr0", Type: wgtypes.LinuxKernel, ListenPort: 51820}
+    vpn, _ = newHostTestVPN(t, wg)
+    err = vpn.Start(VPNConfig{AdoptExisting: true, UDPSocket: socket})
+    if !errors.Is(err, ErrSocketNeedsUserspace) {
+        t.Fatalf("adopted kernel device with a socket: %v", err)
+    }
+    
+    // A userspace device must listen on the socket's port
+    wg = newFakeWGClient()
+    wg.devices["utr0"] = &wgtypes.Device{Name: "utr0", Type: wgtypes.Userspace, ListenPort: 51820}
+    vpn, _ = newHostTestVPN(t, wg)
+    err = vpn.Start(VPNConfig{AdoptExisting: true, UDPSocket: socket})
+    if err == nil || !strings.Contains(err.Error(), "bound to port") {
+        t.Fatalf("socket on another port: %v", err)
+    }
+}
+
+func TestUDPSocketOnUserspaceDevice(t *testing.T) {
+    if runtime.GOOS != "linux" {
+        t.Skip("needs SO_BINDTODEVICE")
+    }
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    socket, err := conn.File()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer socket.Close()
+    port := conn.LocalAddr().(*net.UDPAddr).Port
+    
+    wg := newFakeWGClient()
+    wg.devices["utr0"] = &wgtypes.Device{Name: "utr0", Type: wgtypes.Userspace, ListenPort: port}
+    vpn, host := newHostTestVPN(t, wg)
+    err = vpn.Start(VPNConfig{AdoptExisting: true, KillSwitch: true, BindInterface: "lo", UDPSocket: socket})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer vpn.Stop()
+    
+    // Without a mark the kill switch knows the socket by its port
+    rule := "iptables OUTPUT -o lo -p udp --sport " + strconv.Itoa(port) + " -j ACCEPT"
+    if host.rules[rule] != 1 {
+        t.Fatalf("no kill switch rule for the socket: %v", host.rules)
+    }
+    
+    // The application's socket stays open and usable
+    if _, err := conn.WriteToUDP([]byte("ping"), conn.LocalAddr().(*net.UDPAddr)); err != nil {
+        t.Fatal(err)
+    }
+}
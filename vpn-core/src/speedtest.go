@@ -0,0 +1,524 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "net"
+    "os"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    DefaultSpeedTestDuration = 15 * time.Second
+    DefaultSpeedTestDataCap  = 200 << 20 // bytes, both directions together
+    DefaultSpeedTestStreams  = 8
+    DefaultSpeedTestCooldown = time.Minute
+    
+    speedTestChunk    = 64 << 10
+    speedTestRequest  = 1 << 20  // bytes per download or upload request, the cap is reserved in these
+    maxReflectRequest = 64 << 20 // largest request ServeReflector answers
+    speedTestPings    = 10
+    speedTestRamps    = 10 // throughput samples per phase, streams are added after each
+)
+
+// Reflector commands, a byte followed by a big endian uint64
+const (
+    reflectPing     = 'P' // echoed back with the argument
+    reflectDownload = 'D' // the reflector sends that many bytes
+    reflectUpload   = 'U' // that many bytes follow, acknowledged with reflectAck
+    reflectAck      = 'K'
+)
+
+var (
+    ErrSpeedTestRunning  = errors.New("a speed test is already running")
+    ErrSpeedTestCooldown = errors.New("speed test ran too recently")
+    errSpeedTestCap      = errors.New("speed test data cap reached")
+)
+
+// speedTestDialer reaches the reflector through the tunnel. Tests replace it.
+var speedTestDialer = func(device string) ProxyDialer {
+    return tunnelDialer{device: device}
+}
+
+// SpeedTestOptions configures SpeedTest. Zero fields take the defaults.
+type SpeedTestOptions struct {
+    Server   string        // host:port of a reflector, see ServeReflector
+    Duration time.Duration // whole test, a tenth for latency and the rest split between download and upload
+    Streams  int           // most parallel streams per direction
+    
+    // Most bytes moved in both directions together, half for each, for
+    // metered connections. Negative for no cap.
+    DataCap  int64
+    
+    // Least time between the end of one test and the start of the next,
+    // so tests don't crowd out each other or the traffic accounting
+    Cooldown time.Duration
+    
+    Progress    func(SpeedTestProgress) // called about ten times a phase
+    HistoryPath string                  // append the result here as a JSON line, see ReadSpeedTestHistory
+}
+
+// SpeedTestProgress is reported while a speed test runs
+type SpeedTestProgress struct {
+    Phase   string // "latency", "download" or "upload"
+    Elapsed time.Duration
+    Mbps    float64 // over the last sample
+    Streams int
+    Bytes   int64 // moved in this phase
+}
+
+// SpeedTestResult is what SpeedTest measured through the tunnel
+type SpeedTestResult struct {
+    Time         time.Time `json:"time"`
+    Server       string    `json:"server"`
+    DownloadMbps float64   `json:"download_mbps"`
+    UploadMbps   float64   `json:"upload_mbps"`
+    LatencyMs    float64   `json:"latency_ms"`
+    JitterMs     float64   `json:"jitter_ms"`
+    Streams      int       `json:"streams"` // most used in either direction
+    Bytes        int64     `json:"bytes"`
+    CapReached   bool      `json:"cap_reached,omitempty"`
+}
+
+// speedTestGate admits one speed test at a time with a cooldown between.
+// The zero value is ready to use.
+type speedTestGate struct {
+    mu       sync.Mutex
+    running  bool
+    finished time.Time
+}
+
+func (g *speedTestGate) enter(now time.Time, cooldown time.Duration) error {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    
+    if g.running {
+        return ErrSpeedTestRunning
+    }
+    if !g.finished.IsZero() && now.Sub(g.finished) < cooldown {
+        return fmt.Errorf("%w, wait %s", ErrSpeedTestCooldown, (cooldown - now.Sub(g.finished)).Round(time.Second))
+    }
+    g.running = true
+    return nil
+}
+
+func (g *speedTestGate) leave(now time.Time) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    
+    g.running = false
+    g.finished = now
+}
+
+// SpeedTest measures latency, jitter, download and upload through the
+// tunnel against a reflector. Streams are added while they still raise
+// throughput, so the ceiling is found without root or tuning; the best
+// sample of each direction is reported. Cancelling ctx ends the test with
+// its error.
+func (vpn *UnderTheRadarVPN) SpeedTest(ctx context.Context, opts SpeedTestOptions) (SpeedTestResult, error) {
+    if opts.Server == "" {
+        return SpeedTestResult{}, fmt.Errorf("no speed test server")
+    }
+    if opts.Duration <= 0 {
+        opts.Duration = DefaultSpeedTestDuration
+    }
+    if opts.Streams <= 0 {
+        opts.Streams = DefaultSpeedTestStreams
+    }
+    if opts.DataCap == 0 {
+        opts.DataCap = DefaultSpeedTestDataCap
+    }
+    if opts.Cooldown <= 0 {
+        opts.Cooldown = DefaultSpeedTestCooldown
+    }
+    
+    clock := vpn.clock()
+    if err := vpn.speedTests.enter(clock.Now(), opts.Cooldown); err != nil {
+        return SpeedTestResult{}, err
+    }
+    defer func() { vpn.speedTests.leave(clock.Now()) }()
+    
+    st := &speedTest{opts: opts, dialer: speedTestDialer(vpn.deviceName), start: time.Now()}
+    result := SpeedTestResult{Time: clock.Now(), Server: opts.Server}
+    
+    var err error
+    if result.LatencyMs, result.JitterMs, err = st.latency(ctx, opts.Duration/10); err != nil {
+        return result, err
+    }
+    
+    phase := opts.Duration * 9 / 20
+    for _, dir := range []struct {
+        name string
+        mbps *float64
+        run  func(context.Context, net.Conn, *speedBudget, *atomic.Int64) error
+    }{
+        {"download", &result.DownloadMbps, downloadStream},
+        {"upload", &result.UploadMbps, uploadStream},
+    } {
+        budget := newSpeedBudget(-1)
+        if opts.DataCap > 0 {
+            budget = newSpeedBudget(opts.DataCap / 2)
+        }
+        mbps, streams, moved, err := st.throughput(ctx, dir.name, phase, budget, dir.run)
+        result.Bytes += moved
+        if err != nil {
+            return result, err
+        }
+        *dir.mbps = mbps
+        result.Streams = max(result.Streams, streams)
+        result.CapReached = result.CapReached || budget.exhausted()
+    }
+    
+    if opts.HistoryPath != "" {
+        if err := appendSpeedTestHistory(opts.HistoryPath, result); err != nil {
+            return result, err
+        }
+    }
+    return result, nil
+}
+
+type speedTest struct {
+    opts   SpeedTestOptions
+    dialer ProxyDialer
+    start  time.Time
+}
+
+func (st *speedTest) progress(p SpeedTestProgress) {
+    if st.opts.Progress != nil {
+        p.Elapsed = time.Since(st.start)
+        st.opts.Progress(p)
+    }
+}
+
+// Connect to the reflector, closing the connection when ctx ends so
+// blocked reads and writes return
+func (st *speedTest) dial(ctx context.Context) (net.Conn, func(), error) {
+    conn, err := st.dialer.DialContext(ctx, "tcp", st.opts.Server)
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to reach speed test server %s: %w", st.opts.Server, err)
+    }
+    stop := context.AfterFunc(ctx, func() { conn.Close() })
+    return conn, func() {
+        stop()
+        conn.Close()
+    }, nil
+}
+
+// Average round trip and jitter, the mean difference between consecutive
+// round trips, over speedTestPings pings spread across d
+func (st *speedTest) latency(ctx context.Context, d time.Duration) (avgMs, jitterMs float64, err error) {
+    conn, done, err := st.dial(ctx)
+    if err != nil {
+        return 0, 0, err
+    }
+    defer done()
+    
+    var rtts []float64
+    interval := d / speedTestPings
+    for i := 0; i < speedTestPings; i++ {
+        sent := time.Now()
+        if err := reflectRequest(conn, reflectPing, uint64(sent.UnixNano())); err != nil {
+            return 0, 0, speedTestError(ctx, err)
+        }
+        var reply [9]byte
+        if _, err := io.ReadFull(conn, reply[:]); err != nil {
+            return 0, 0, speedTestError(ctx, err)
+        }
+        rtt := time.Since(sent)
+        rtts = append(rtts, float64(rtt)/float64(time.Millisecond))
+        st.progress(SpeedTestProgress{Phase: "latency", Streams: 1})
+        
+        select {
+        case <-ctx.Done():
+            return 0, 0, ctx.Err()
+        case <-time.After(interval - rtt):
+        }
+    }
+    
+    for i, rtt := range rtts {
+        avgMs += rtt / float64(len(rtts))
+        if i > 0 {
+            jitterMs += math.Abs(rtt-rtts[i-1]) / float64(len(rtts)-1)
+        }
+    }
+    return avgMs, jitterMs, nil
+}
+
+// Run streams in one direction for d, starting with one and doubling after
+// each sample that was more than a tenth faster than the one before.
+// Returns the best sample in Mbps, the streams used and the bytes moved.
+func (st *speedTest) throughput(ctx context.Context, phase string, d time.Duration, budget *speedBudget,
+    run func(context.Context, net.Conn, *speedBudget, *atomic.Int64) error) (float64, int, int64, error) {
+    phaseCtx, cancel := context.WithTimeout(ctx, d)
+    defer cancel()
+    
+    var moved atomic.Int64
+    var wg sync.WaitGroup
+    var errMu sync.Mutex
+    var streamErr error
+    addStream := func() error {
+        conn, done, err := st.dial(phaseCtx)
+        if err != nil {
+            return err
+        }
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            defer done()
+            err := run(phaseCtx, conn, budget, &moved)
+            if errors.Is(err, errSpeedTestCap) {
+                // Nothing left to request, don't wait for the next sample
+                cancel()
+            } else if err != nil && phaseCtx.Err() == nil {
+                errMu.Lock()
+                streamErr = err
+                errMu.Unlock()
+            }
+        }()
+        return nil
+    }
+    
+    if err := addStream(); err != nil {
+        return 0, 0, 0, err
+    }
+    streams := 1
+    
+    interval := d / speedTestRamps
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    var best, last float64
+    var counted int64
+    sampled := time.Now()
+    for phaseCtx.Err() == nil && !budget.exhausted() {
+        select {
+        case <-phaseCtx.Done():
+        case <-ticker.C:
+            now := time.Now()
+            n := moved.Load()
+            mbps := float64(n-counted) * 8 / now.Sub(sampled).Seconds() / 1e6
+            counted, sampled = n, now
+            best = max(best, mbps)
+            st.progress(SpeedTestProgress{Phase: phase, Mbps: mbps, Streams: streams, Bytes: n})
+            
+            if mbps > last*1.1 {
+                for add := streams; add > 0 && streams < st.opts.Streams; add-- {
+                    if addStream() != nil {
+                        break
+                    }
+                    streams++
+                }
+            }
+            last = mbps
+        }
+    }
+    cancel()
+    wg.Wait()
+    
+    // A phase that ended before the first sample still has its average
+    if best == 0 && moved.Load() > 0 {
+        best = float64(moved.Load()) * 8 / time.Since(sampled).Seconds() / 1e6
+    }
+    if err := ctx.Err(); err != nil {
+        return best, streams, moved.Load(), err
+    }
+    if moved.Load() == 0 && streamErr != nil {
+        return 0, streams, 0, fmt.Errorf("speed test %s failed: %w", phase, streamErr)
+    }
+    return best, streams, moved.Load(), nil
+}
+
+// Request budget bytes at a time from the reflector until the phase ends
+func downloadStream(ctx context.Context, conn net.Conn, budget *speedBudget, moved *atomic.Int64) error {
+    buf := make([]byte, speedTestChunk)
+    for ctx.Err() == nil {
+        n := budget.take(speedTestRequest)
+        if n == 0 {
+            return errSpeedTestCap
+        }
+        if err := reflectRequest(conn, reflectDownload, uint64(n)); err != nil {
+            return err
+        }
+        for left := n; left > 0; {
+            read, err := conn.Read(buf[:min(left, int64(len(buf)))])
+            moved.Add(int64(read))
+            left -= int64(read)
+            if err != nil {
+                return err
+            }
+        }
+    }
+    return ctx.Err()
+}
+
+func uploadStream(ctx context.Context, conn net.Conn, budget *speedBudget, moved *atomic.Int64) error {
+    buf := make([]byte, speedTestChunk)
+    for ctx.Err() == nil {
+        n := budget.take(speedTestRequest)
+        if n == 0 {
+            return errSpeedTestCap
+        }
+        if err := reflectRequest(conn, reflectUpload, uint64(n)); err != nil {
+            return err
+        }
+        for left := n; left > 0; {
+            written, err := conn.Write(buf[:min(left, int64(len(buf)))])
+            moved.Add(int64(written))
+            left -= int64(written)
+            if err != nil {
+                return err
+            }
+        }
+        var ack [1]byte
+        if _, err := io.ReadFull(conn, ack[:]); err != nil {
+            return err
+        }
+    }
+    return ctx.Err()
+}
+
+// speedBudget hands out the bytes a phase may move, unlimited when
+// created with a negative cap
+type speedBudget struct {
+    left      atomic.Int64
+    unlimited bool
+}
+
+func newSpeedBudget(limit int64) *speedBudget {
+    b := &speedBudget{unlimited: limit < 0}
+    b.left.Store(limit)
+    return b
+}
+
+// Reserve up to n bytes, returning how many were granted
+func (b *speedBudget) take(n int64) int64 {
+    if b.unlimited {
+        return n
+    }
+    for {
+        left := b.left.Load()
+        if left <= 0 {
+            return 0
+        }
+        granted := min(n, left)
+        if b.left.CompareAndSwap(left, left-granted) {
+            return granted
+        }
+    }
+}
+
+func (b *speedBudget) exhausted() bool {
+    return !b.unlimited && b.left.Load() <= 0
+}
+
+// Cancellation closes the connections, report it rather than the failed
+// read or write
+func speedTestError(ctx context.Context, err error) error {
+    if ctx.Err() != nil {
+        return ctx.Err()
+    }
+    return fmt.Errorf("speed test failed: %w", err)
+}
+
+func reflectRequest(w io.Writer, cmd byte, arg uint64) error {
+    var req [9]byte
+    req[0] = cmd
+    binary.BigEndian.PutUint64(req[1:], arg)
+    _, err := w.Write(req[:])
+    return err
+}
+
+// ServeReflector answers speed tests on ln until it is closed, run on the
+// test server SpeedTestOptions.Server names
+func ServeReflector(ln net.Listener) error {
+    for {
+        conn, err := ln.Accept()
+        if err != nil {
+            return err
+        }
+        go answerReflect(conn)
+    }
+}
+
+func answerReflect(conn net.Conn) {
+    defer conn.Close()
+    
+    r := bufio.NewReader(conn)
+    buf := make([]byte, speedTestChunk)
+    var req [9]byte
+    for {
+        if _, err := io.ReadFull(r, req[:]); err != nil {
+            return
+        }
+        n := binary.BigEndian.Uint64(req[1:])
+        if n > maxReflectRequest && req[0] != reflectPing {
+            return
+        }
+        
+        var err error
+        switch req[0] {
+        case reflectPing:
+            _, err = conn.Write(req[:])
+        case reflectDownload:
+            for left := int64(n); left > 0 && err == nil; {
+                var written int
+                written, err = conn.Write(buf[:min(left, int64(len(buf)))])
+                left -= int64(written)
+            }
+        case reflectUpload:
+            if _, err = io.CopyN(io.Discard, r, int64(n)); err == nil {
+                _, err = conn.Write([]byte{reflectAck})
+            }
+        default:
+            return
+        }
+        if err != nil {
+            return
+        }
+    }
+}
+
+func appendSpeedTestHistory(path string, result SpeedTestResult) error {
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+    if err != nil {
+        return fmt.Errorf("failed to open speed test history: %w", err)
+    }
+    defer f.Close()
+    
+    if err := json.NewEncoder(f).Encode(result); err != nil {
+        return fmt.Errorf("failed to write speed test history: %w", err)
+    }
+    return nil
+}
+
+// ReadSpeedTestHistory returns the results SpeedTest appended to path,
+// oldest first. A missing file is an empty history.
+func ReadSpeedTestHistory(path string) ([]SpeedTestResult, error) {
+    f, err := os.Open(path)
+    if errors.Is(err, os.ErrNotExist) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to open speed test history: %w", err)
+    }
+    defer f.Close()
+    
+    var results []SpeedTestResult
+    dec := json.NewDecoder(f)
+    for {
+        var result SpeedTestResult
+        if err := dec.Decode(&result); err == io.EOF {
+            return results, nil
+        } else if err != nil {
+            return results, fmt.Errorf("failed to read speed test history: %w", err)
+        }
+        results = append(results, result)
+    }
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// Reflector on loopback, reached without the tunnel
+func startReflector(t *testing.T) string {
+    t.Helper()
+    
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { ln.Close() })
+    go ServeReflector(ln)
+    
+    orig := speedTestDialer
+    speedTestDialer = func(string) ProxyDialer { return directDialer{} }
+    t.Cleanup(func() { speedTestDialer = orig })
+    return ln.Addr().String()
+}
+
+func TestSpeedTestMeasuresBothDirections(t *testing.T) {
+    server := startReflector(t)
+    vpn := newTestVPN(t, newFakeWGClient())
+    history := filepath.Join(t.TempDir(), "speedtest.jsonl")
+    
+    phases := make(map[string]int)
+    result, err := vpn.SpeedTest(context.Background(), SpeedTestOptions{
+        Server:      server,
+        Duration:    time.Second,
+        DataCap:     -1,
+        Progress:    func(p SpeedTestProgress) { phases[p.Phase]++ },
+        HistoryPath: history,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result.DownloadMbps <= 0 || result.UploadMbps <= 0 || result.LatencyMs <= 0 || result.Bytes == 0 {
+        t.Fatalf("result = %+v", result)
+    }
+    if result.Streams < 2 {
+        t.Errorf("streams never ramped up: %+v", result)
+    }
+    if phases["latency"] != speedTestPings || phases["download"] == 0 || phases["upload"] == 0 {
+        t.Errorf("progress = %v", phases)
+    }
+    
+    saved, err := ReadSpeedTestHistory(history)
+    if err != nil || len(saved) != 1 || saved[0].DownloadMbps != result.DownloadMbps {
+        t.Fatalf("history = %+v, %v", saved, err)
+    }
+}
+
+func TestSpeedTestStopsAtDataCap(t *testing.T) {
+    server := startReflector(t)
+    vpn := newTestVPN(t, newFakeWGClient())
+    
+    result, err := vpn.SpeedTest(context.Background(), SpeedTestOptions{
+        Server:   server,
+        Duration: 10 * time.Second,
+        DataCap:  4 * speedTestRequest,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !result.CapReached || result.Bytes > 4*speedTestRequest {
+        t.Fatalf("moved %d bytes with a cap of %d, cap reached %v", result.Bytes, 4*speedTestRequest, result.CapReached)
+    }
+}
+
+func TestSpeedTestCooldownAndCancel(t *testing.T) {
+    server := startReflector(t)
+    vpn := newTestVPN(t, newFakeWGClient())
+    
+    ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+    defer cancel()
+    _, err := vpn.SpeedTest(ctx, SpeedTestOptions{Server: server, Duration: 10 * time.Second, DataCap: -1})
+    if !errors.Is(err, context.DeadlineExceeded) {
+        t.Fatalf("cancelled test returned %v", err)
+    }
+    
+    _, err = vpn.SpeedTest(context.Background(), SpeedTestOptions{Server: server, Duration: time.Second})
+    if !errors.Is(err, ErrSpeedTestCooldown) {
+        t.Fatalf("back-to-back test returned %v", err)
+    }
+}
+
+func TestSpeedTestResultJSON(t *testing.T) {
+    data, err := json.Marshal(SpeedTestResult{DownloadMbps: 95.5, JitterMs: 1.2})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, field := range []string{`"download_mbps":95.5`, `"jitter_ms":1.2`} {
+        if !strings.Contains(string(data), field) {
+            t.Errorf("%s missing from %s", field, data)
+        }
+    }
+    if strings.Contains(string(data), "cap_reached") {
+        t.Errorf("cap_reached set in %s", data)
+    }
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "os/user"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// Marks and table split tunnel rules route with. The tunnel table holds a
+// default route into the device, bypassed traffic keeps to main. Both
+// marks have 0x55 in the second byte, which tells them from others.
+const (
+    splitTunnelMark   = 0x5554
+    splitBypassMark   = 0x5542
+    splitTunnelTable  = 51822
+    splitRulePriority = 10000
+)
+
+// lookupUID resolves an app's user for SplitTunnel.Configure. Tests replace it.
+var lookupUID = func(name string) (uint32, error) {
+    u, err := user.Lookup(name)
+    if err != nil {
+        return 0, err
+    }
+    uid, err := strconv.ParseUint(u.Uid, 10, 32)
+    return uint32(uid), err
+}
+
+// SplitVia is where an app's traffic goes
+type SplitVia int
+
+const (
+    ViaTunnel SplitVia = iota
+    ViaBypass
+)
+
+// AppPolicy routes the traffic of an app, identified by the user it runs
+// as, through the tunnel or around it. A nil CIDR matches every
+// destination.
+type AppPolicy struct {
+    AppName string // labels the rules, see iptables -L -t mangle
+    UID     uint32
+    CIDR    *net.IPNet
+    Via     SplitVia
+}
+
+func (p AppPolicy) mark() int {
+    if p.Via == ViaBypass {
+        return splitBypassMark
+    }
+    return splitTunnelMark
+}
+
+// Mangle rules marking the app's packets, one per address family the
+// policy covers
+func (p AppPolicy) rules() []string {
+    match := fmt.Sprintf("-m owner --uid-owner %d", p.UID)
+    if p.CIDR != nil {
+        match += " -d " + p.CIDR.String()
+    }
+    target := fmt.Sprintf("-m comment --comment utr-split:%s -j MARK --set-mark 0x%x", p.AppName, p.mark())
+    
+    var rules []string
+    for _, cmd := range []string{"iptables", "ip6tables"} {
+        if p.CIDR != nil && (p.CIDR.IP.To4() != nil) != (cmd == "iptables") {
+            continue
+        }
+        rules = append(rules, fmt.Sprintf("%s -t mangle -A OUTPUT %s %s", cmd, match, target))
+    }
+    return rules
+}
+
+func (p AppPolicy) key() string {
+    return strings.Join(p.rules(), "\n")
+}
+
+// SplitTunnel marks traffic per app so it is routed through or around the
+// tunnel. Policies change in place with UpdatePolicy, apps whose policy is
+// unchanged keep their rules throughout.
+type SplitTunnel struct {
+    deviceName string
+    commands   CommandRunner
+    nft        *NFTPolicy // marks registered there instead of mangle rules, see FirewallNFTables
+    
+    mu       sync.Mutex
+    policies map[string]AppPolicy // by key
+    routing  []string             // ip rules and routes, once a policy exists
+    classify []string             // rules running the kernel classifiers
+}
+
+func NewSplitTunnel(deviceName string) *SplitTunnel {
+    return &SplitTunnel{
+        deviceName: deviceName,
+        policies:   make(map[string]AppPolicy),
+    }
+}
+
+// Configure routes the named apps around the tunnel and nothing else,
+// replacing every policy. Apps are named by the user they run as, or a
+// numeric UID.
+func (st *SplitTunnel) Configure(apps []string) error {
+    want := make(map[string]AppPolicy)
+    for _, app := range apps {
+        uid, err := strconv.ParseUint(app, 10, 32)
+        if err != nil {
+            lookedUp, lookupErr := lookupUID(app)
+            if lookupErr != nil {
+                return fmt.Errorf("failed to find the user of app %s: %w", app, lookupErr)
+            }
+            uid = uint64(lookedUp)
+        }
+        policy := AppPolicy{AppName: app, UID: uint32(uid), Via: ViaBypass}
+        want[policy.key()] = policy
+    }
+    
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    
+    var add, remove []AppPolicy
+    for key, policy := range want {
+        if _, ok := st.policies[key]; !ok {
+            add = append(add, policy)
+        }
+    }
+    for key, policy := range st.policies {
+        if _, ok := want[key]; !ok {
+            remove = append(remove, policy)
+        }
+    }
+    return st.updateLocked(add, remove)
+}
+
+// UpdatePolicy adds and removes app policies without touching the others.
+// Every add is applied before any removal, so traffic moving from one
+// policy to another is always matched by one of them. If an add fails the
+// adds made so far are undone and nothing is removed.
+func (st *SplitTunnel) UpdatePolicy(add []AppPolicy, remove []AppPolicy) error {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    
+    return st.updateLocked(add, remove)
+}
+
+func (st *SplitTunnel) updateLocked(add []AppPolicy, remove []AppPolicy) error {
+    if len(add) > 0 && st.routing == nil {
+        if err := st.setupRoutingLocked(); err != nil {
+            return err
+        }
+    }
+    if st.nft != nil {
+        return st.updateNFTLocked(add, remove)
+    }
+    
+    var added []string
+    var addedKeys []string
+    for _, policy := range add {
+        key := policy.key()
+        if _, exists := st.policies[key]; exists {
+            continue
+        }
+        for _, rule := range policy.rules() {
+            if err := st.commands.Run(rule); err != nil {
+                st.commands.removeIPTablesRules(added)
+                for _, key := range addedKeys {
+                    delete(st.policies, key)
+                }
+                return fmt.Errorf("failed to add rule %s: %w", rule, err)
+            }
+            added = append(added, rule)
+        }
+        st.policies[key] = policy
+        addedKeys = append(addedKeys, key)
+    }
+    
+    var firstErr error
+    for _, policy := range remove {
+        key := policy.key()
+        if _, exists := st.policies[key]; !exists {
+            continue
+        }
+        delete(st.policies, key)
+        if err := st.commands.removeIPTablesRules(policy.rules()); err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    return firstErr
+}
+
+// The marks of every policy go into the shared table at once, so adds and
+// removals land in the same transaction
+func (st *SplitTunnel) updateNFTLocked(add []AppPolicy, remove []AppPolicy) error {
+    policies := make(map[string]AppPolicy, len(st.policies)+len(add))
+    for key, policy := range st.policies {
+        policies[key] = policy
+    }
+    for _, policy := range add {
+        policies[policy.key()] = policy
+    }
+    for _, policy := range remove {
+        delete(policies, policy.key())
+    }
+    
+    if err := st.nft.set(nftFeatureSplit, splitNFTRules(policies)); err != nil {
+        return fmt.Errorf("failed to mark split tunnel traffic: %w", err)
+    }
+    st.policies = policies
+    return nil
+}
+
+// Route marked traffic: the tunnel mark into the device, the bypass mark
+// to the main table ahead of anything sending traffic to the tunnel
+func (st *SplitTunnel) setupRoutingLocked() error {
+    commands := []string{
+        fmt.Sprintf("ip route replace default dev %s table %d", st.deviceName, splitTunnelTable),
+        fmt.Sprintf("ip rule add fwmark 0x%x lookup %d priority %d", splitTunnelMark, splitTunnelTable, splitRulePriority),
+        fmt.Sprintf("ip rule add fwmark 0x%x lookup main priority %d", splitBypassMark, splitRulePriority+1),
+    }
+    var done []string
+    for _, cmd := range commands {
+        if err := st.commands.Run(cmd); err != nil {
+            st.commands.removeRoutes(done)
+            return fmt.Errorf("failed to route split tunnel traffic: %w", err)
+        }
+        done = append(done, cmd)
+    }
+    st.routing = done
+    return nil
+}
+
+// Run the split programs pinned at bypassPin and tunnelPin on the first
+// packet of each connection and keep the mark they choose with it. The
+// rules go ahead of the app policies, which therefore take precedence.
+func (st *SplitTunnel) attachClassifier(bypassPin, tunnelPin string) error {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    
+    if st.routing == nil {
+        if err := st.setupRoutingLocked(); err != nil {
+            return err
+        }
+    }
+    
+    // Inserted in reverse, so the mark is chosen before it is restored
+    var rules []string
+    for _, cmd := range []string{"iptables", "ip6tables"} {
+        rules = append(rules,
+            fmt.Sprintf("%s -t mangle -I OUTPUT -m connmark --mark 0x5500/0xff00 -j CONNMARK --restore-mark", cmd),
+            fmt.Sprintf("%s -t mangle -I OUTPUT -m conntrack --ctstate NEW -m bpf --object-pinned %s -j CONNMARK --set-mark 0x%x", cmd, tunnelPin, splitTunnelMark),
+            fmt.Sprintf("%s -t mangle -I OUTPUT -m conntrack --ctstate NEW -m bpf --object-pinned %s -j CONNMARK --set-mark 0x%x", cmd, bypassPin, splitBypassMark),
+        )
+    }
+    var added []string
+    for _, rule := range rules {
+        if err := st.commands.Run(rule); err != nil {
+            st.commands.removeIPTablesRules(added)
+            return fmt.Errorf("failed to add classifier rule %s: %w", rule, err)
+        }
+        added = append(added, rule)
+    }
+    st.classify = added
+    return nil
+}
+
+func (st *SplitTunnel) classifying() bool {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    return st.classify != nil
+}
+
+func (st *SplitTunnel) detachClassifier() {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    
+    st.commands.removeIPTablesRules(st.classify)
+    st.classify = nil
+}
+
+// Policies returns the policies in place
+func (st *SplitTunnel) Policies() []AppPolicy {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    
+    policies := make([]AppPolicy, 0, len(st.policies))
+    for _, policy := range st.policies {
+        policies = append(policies, policy)
+    }
+    return policies
+}
+
+// Disable removes every policy and the routing for them
+func (st *SplitTunnel) Disable() error {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    
+    var firstErr error
+    if st.nft != nil {
+        firstErr = st.nft.remove(nftFeatureSplit)
+        st.policies = make(map[string]AppPolicy)
+    }
+    for key, policy := range st.policies {
+        if err := st.commands.removeIPTablesRules(policy.rules()); err != nil && firstErr == nil {
+            firstErr = err
+        }
+        delete(st.policies, key)
+    }
+    st.commands.removeIPTablesRules(st.classify)
+    st.classify = nil
+    st.commands.removeRoutes(st.routing)
+    st.routing = nil
+    return firstErr
+}
+
+// UpdateSplitTunnel changes app policies while the tunnel is up, see
+// SplitTunnel.UpdatePolicy
+func (vpn *UnderTheRadarVPN) UpdateSplitTunnel(add []AppPolicy, remove []AppPolicy) error {
+    return vpn.splitTunnel.UpdatePolicy(add, remove)
+}
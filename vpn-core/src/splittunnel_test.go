@@ -0,0 +1,139 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+// Rules on the host marking the app's traffic
+func splitRules(host *fakeHost, app string) int {
+    host.mu.Lock()
+    defer host.mu.Unlock()
+    
+    n := 0
+    for rule, count := range host.rules {
+        if strings.Contains(rule, "utr-split:"+app+" ") {
+            n += count
+        }
+    }
+    return n
+}
+
+func TestUpdatePolicyKeepsUnchangedApps(t *testing.T) {
+    host := installFakeHost(t, "")
+    st := NewSplitTunnel("utr0")
+    
+    // Watch the unchanged app after every command of the update
+    var commands []string
+    watching := false
+    st.commands = func(cmdline string) error {
+        err := host.run(cmdline)
+        commands = append(commands, cmdline)
+        if watching && splitRules(host, "firefox") != 2 {
+            t.Errorf("firefox lost its rules after %s", cmdline)
+        }
+        return err
+    }
+    
+    firefox := AppPolicy{AppName: "firefox", UID: 1001, Via: ViaTunnel}
+    steam := AppPolicy{AppName: "steam", UID: 1002, Via: ViaTunnel}
+    if err := st.UpdatePolicy([]AppPolicy{firefox, steam}, nil); err != nil {
+        t.Fatal(err)
+    }
+    if splitRules(host, "firefox") != 2 || splitRules(host, "steam") != 2 {
+        t.Fatalf("rules %v", host.rules)
+    }
+    
+    // Move steam around the tunnel for one network only
+    commands = nil
+    watching = true
+    lan := mustCIDR(t, "192.168.0.0/16")
+    steamLAN := AppPolicy{AppName: "steam", UID: 1002, CIDR: &lan, Via: ViaBypass}
+    if err := st.UpdatePolicy([]AppPolicy{steamLAN, firefox}, []AppPolicy{steam}); err != nil {
+        t.Fatal(err)
+    }
+    
+    lastAdd, firstDelete := -1, len(commands)
+    for i, cmd := range commands {
+        if strings.Contains(cmd, "utr-split:firefox ") {
+            t.Errorf("firefox rule touched: %s", cmd)
+        }
+        if strings.Contains(cmd, " -A ") {
+            lastAdd = i
+        }
+        if strings.Contains(cmd, " -D ") && i < firstDelete {
+            firstDelete = i
+        }
+        if strings.Contains(cmd, "-F") || strings.HasPrefix(cmd, "ip ") {
+            t.Errorf("unexpected command %s", cmd)
+        }
+    }
+    if lastAdd < 0 || lastAdd > firstDelete {
+        t.Fatalf("adds should come before removals: %v", commands)
+    }
+    if splitRules(host, "steam") != 1 || len(st.Policies()) != 2 {
+        t.Fatalf("rules %v", host.rules)
+    }
+    
+    // Removing what isn't there changes nothing
+    commands = nil
+    if err := st.UpdatePolicy(nil, []AppPolicy{steam}); err != nil || len(commands) != 0 {
+        t.Fatalf("removing a missing policy: %v, ran %v", err, commands)
+    }
+    
+    watching = false
+    if err := st.Disable(); err != nil {
+        t.Fatal(err)
+    }
+    if len(host.rules) != 0 {
+        t.Fatalf("rules left after Disable: %v", host.rules)
+    }
+}
+
+func TestUpdatePolicyRollsBackFailedAdds(t *testing.T) {
+    host := installFakeHost(t, "--uid-owner 1003")
+    st := NewSplitTunnel("utr0")
+    
+    kept := AppPolicy{AppName: "firefox", UID: 1001, Via: ViaTunnel}
+    if err := st.UpdatePolicy([]AppPolicy{kept}, nil); err != nil {
+        t.Fatal(err)
+    }
+    
+    added := AppPolicy{AppName: "steam", UID: 1002, Via: ViaBypass}
+    failing := AppPolicy{AppName: "discord", UID: 1003, Via: ViaBypass}
+    if err := st.UpdatePolicy([]AppPolicy{added, failing}, []AppPolicy{kept}); err == nil {
+        t.Fatal("expected the failing add to fail the update")
+    }
+    
+    // The earlier add is undone and the removal never happens
+    if splitRules(host, "steam") != 0 || splitRules(host, "firefox") != 2 {
+        t.Fatalf("rules %v", host.rules)
+    }
+    if policies := st.Policies(); len(policies) != 1 || policies[0].AppName != "firefox" {
+        t.Fatalf("policies %v", policies)
+    }
+}
+
+func TestSplitTunnelConfigureIsIncremental(t *testing.T) {
+    commands := recordSystemCommands(t)
+    orig := lookupUID
+    lookupUID = func(name string) (uint32, error) { return map[string]uint32{"firefox": 1001, "steam": 1002}[name], nil }
+    t.Cleanup(func() { lookupUID = orig })
+    st := NewSplitTunnel("utr0")
+    
+    if err := st.Configure([]string{"firefox", "1500"}); err != nil {
+        t.Fatal(err)
+    }
+    *commands = nil
+    if err := st.Configure([]string{"firefox", "steam"}); err != nil {
+        t.Fatal(err)
+    }
+    for _, cmd := range *commands {
+        if strings.Contains(cmd, "utr-split:firefox ") || strings.HasPrefix(cmd, "ip ") {
+            t.Errorf("reload ran %s", cmd)
+        }
+    }
+    if len(*commands) != 4 {
+        t.Fatalf("expected steam added and 1500 removed, ran %v", *commands)
+    }
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+    "errors"
+    "net"
+    "strings"
+    "testing"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Config with every step of setupHost that the fake host can fail
+func fullStartConfig(proxyAddr string) VPNConfig {
+    return VPNConfig{
+        ListenPort:         51820,
+        ListenPorts:        []int{443},
+        ManageInputPinhole: true,
+        ClampMSS:           true,
+        MSS:                1380,
+        KillSwitch:         true,
+        DNSProtection:      true,
+        DNSServers:         []string{"10.64.0.1"},
+        Proxy:              ProxyConfig{SOCKSAddr: proxyAddr},
+    }
+}
+
+func newStartVPN(t *testing.T) *UnderTheRadarVPN {
+    vpn := newTestVPN(t, newFakeWGClient())
+    vpn.killSwitch = NewKillSwitch(vpn.deviceName)
+    vpn.dnsProtector = NewDNSProtector()
+    return vpn
+}
+
+// Nothing Start did is left on the host
+func assertCleanHost(t *testing.T, host *fakeHost, vpn *UnderTheRadarVPN) {
+    t.Helper()
+    
+    if len(host.rules) != 0 {
+        t.Errorf("residual firewall rules: %v", host.rules)
+    }
+    if len(host.chains) != 0 {
+        t.Errorf("residual chains: %v", host.chains)
+    }
+    if len(host.links) != 0 {
+        t.Errorf("residual links: %v", host.links)
+    }
+    if vpn.killSwitch.enabled.Load() || vpn.dnsProtector.enabled.Load() {
+        t.Error("feature still marked enabled after rollback")
+    }
+    if vpn.proxy != nil || vpn.socketRouting != nil {
+        t.Error("local servers or routes left after rollback")
+    }
+}
+
+func TestStartRollsBackOnFailure(t *testing.T) {
+    busy, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer busy.Close()
+    
+    stages := []struct {
+        name      string
+        failOn    string
+        proxyAddr string
+    }{
+        {"device", "ip link add", ""},
+        {"device up", "ip link set up", ""},
+        {"pinhole", "-I INPUT", ""},
+        {"mss clamp ipv6", "ip6tables -t mangle -A FORWARD", ""},
+        {"hop ports", "DNAT", ""},
+        {"kill switch ipv4", "iptables -A OUTPUT -j DROP", ""},
+        {"kill switch ipv6", "ip6tables -A OUTPUT -j DROP", ""},
+        {"dns block", "--dport 53 -j DROP", ""},
+        {"dns allow", "--dport 53 -d 10.64.0.1", ""},
+        {"proxy", "", busy.Addr().String()},
+    }
+    
+    for _, stage := range stages {
+        t.Run(stage.name, func(t *testing.T) {
+            host := installFakeHost(t, stage.failOn)
+            fakeUplink(t, "eth0")
+            vpn := newStartVPN(t)
+            
+            err := vpn.Start(fullStartConfig(stage.proxyAddr))
+            var startErr *StartError
+            if !errors.As(err, &startErr) {
+                t.Fatalf("Start returned %v despite injected failure", err)
+            }
+            if len(startErr.Rollback) != 0 {
+                t.Errorf("rollback failed: %v", startErr.Rollback)
+            }
+            assertCleanHost(t, host, vpn)
+        })
+    }
+}
+
+func TestStartReportsFailedUndo(t *testing.T) {
+    host := installFakeHost(t, "--dport 53 -d 10.64.0.1")
+    fakeUplink(t, "eth0")
+    fakeRun := runSystemCommand
+    runSystemCommand = func(cmdline string) error {
+        if strings.HasPrefix(cmdline, "ip link del") {
+            return errors.New("device busy")
+        }
+        return fakeRun(cmdline)
+    }
+    vpn := newStartVPN(t)
+    
+    err := vpn.Start(fullStartConfig("127.0.0.1:0"))
+    var startErr *StartError
+    if !errors.As(err, &startErr) || len(startErr.Rollback) != 1 {
+        t.Fatalf("got %v", err)
+    }
+    if !strings.Contains(startErr.Err.Error(), "DNS protection") || !strings.Contains(err.Error(), "device busy") {
+        t.Errorf("error doesn't name both failures: %v", err)
+    }
+    // The rest is still undone
+    if !host.links["utr0"] || len(host.rules) != 0 {
+        t.Errorf("links %v, rules %v", host.links, host.rules)
+    }
+}
+
+func TestStartFailClosedKeepsKillSwitch(t *testing.T) {
+    host := installFakeHost(t, "--dport 53 -d 10.64.0.1")
+    fakeUplink(t, "eth0")
+    vpn := newStartVPN(t)
+    
+    config := fullStartConfig("127.0.0.1:0")
+    config.KillSwitchFailClosed = true
+    if err := vpn.Start(config); err == nil {
+        t.Fatal("Start succeeded despite injected failure")
+    }
+    if !vpn.killSwitch.enabled.Load() || host.rules["iptables OUTPUT -j DROP"] != 1 {
+        t.Fatalf("kill switch released, rules %v", host.rules)
+    }
+    if len(host.links) != 0 || vpn.dnsProtector.enabled.Load() {
+        t.Error("steps after the kill switch weren't undone")
+    }
+    
+    // Which leaves only the kill switch
+    if err := vpn.killSwitch.Disable(); err != nil {
+        t.Fatal(err)
+    }
+    assertCleanHost(t, host, vpn)
+}
+
+func TestStartFailClosedUndoesBrokenKillSwitch(t *testing.T) {
+    host := installFakeHost(t, "ip6tables -A OUTPUT -j DROP")
+    fakeUplink(t, "eth0")
+    vpn := newStartVPN(t)
+    
+    config := fullStartConfig("127.0.0.1:0")
+    config.KillSwitchFailClosed = true
+    if err := vpn.Start(config); err == nil {
+        t.Fatal("Start succeeded despite injected failure")
+    }
+    assertCleanHost(t, host, vpn)
+}
+
+func TestStartKeepsAdoptedDeviceOnFailure(t *testing.T) {
+    host := installFakeHost(t, "iptables -A OUTPUT -j DROP")
+    
+    wg := newFakeWGClient()
+    wg.setPeer("utr0", wgtypes.Peer{PublicKey: mustKey(t).PublicKey()})
+    host.links["utr0"] = true
+    
+    vpn := newTestVPN(t, wg)
+    vpn.killSwitch = NewKillSwitch(vpn.deviceName)
+    
+    err := vpn.Start(VPNConfig{
+        KillSwitch:    true,
+        AdoptExisting: true,
+    })
+    if err == nil {
+        t.Fatal("Start succeeded despite injected failure")
+    }
+    
+    if !host.links["utr0"] {
+        t.Error("adopted device was deleted during rollback")
+    }
+    if len(host.rules) != 0 {
+        t.Errorf("residual firewall rules: %v", host.rules)
+    }
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+)
+
+// StatsDSink sends each metric as one UDP datagram in the StatsD line
+// format. Tags use the DogStatsD extension "|#key:value,...", which plain
+// StatsD servers ignore or reject, so set NoTags for those.
+type StatsDSink struct {
+    Prefix string // prepended to every name, e.g. "utr."
+    NoTags bool
+    
+    conn net.Conn
+}
+
+func NewStatsDSink(addr, prefix string) (*StatsDSink, error) {
+    conn, err := net.Dial("udp", addr)
+    if err != nil {
+        return nil, fmt.Errorf("failed to connect to statsd at %s: %w", addr, err)
+    }
+    return &StatsDSink{Prefix: prefix, conn: conn}, nil
+}
+
+func (s *StatsDSink) Gauge(name string, value float64, tags ...string) {
+    s.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", tags)
+}
+
+func (s *StatsDSink) Count(name string, delta int64, tags ...string) {
+    s.send(name, strconv.FormatInt(delta, 10), "c", tags)
+}
+
+// Lost datagrams are lost metrics, as usual with StatsD
+func (s *StatsDSink) send(name, value, kind string, tags []string) {
+    line := s.Prefix + name + ":" + value + "|" + kind
+    if len(tags) > 0 && !s.NoTags {
+        line += "|#" + strings.Join(tags, ",")
+    }
+    s.conn.Write([]byte(line))
+}
+
+func (s *StatsDSink) Close() error {
+    return s.conn.Close()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+    "net"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Status is a point-in-time summary of the VPN
+type Status struct {
+    Device        string
+    ListenPort    int
+    Peers         int
+    AlivePeers    int
+    KillSwitch    bool
+    DNSProtection bool
+    DNS           ResolverStatus // system resolver configuration we applied
+    Pinhole       PinholeStatus
+    MSSClamp      MSSClampStatus
+    CaptivePortal CaptivePortalStatus
+    Proxies       []ProxyStats
+    Datapath      QueueStats // packet queues of the obfuscated stream transport
+    Shaping       ShapingStats // bandwidth and delay added by traffic shaping
+    Collection    CollectionStats // cost of polling peer counters
+    Admission     AdmissionStats  // zero before Start
+    Supervisor    SupervisorStatus // only from Supervisor.GetStatus
+    Interface     InterfaceStats   // kernel counters of the device as of the last poll
+    DevicePoll    DevicePollStatus // failing metrics polls, zero while they succeed
+    EBPFInterfaces []string        // attached besides the uplink, see VPNConfig.EBPFInterfaces
+    PeerSync      PeerSyncStatus   // zero unless SyncPeers ran
+}
+
+// PeerSnapshot is a copy of a peer's configuration and counters in plain
+// values. Unlike Peer it can be copied and compared freely.
+type PeerSnapshot struct {
+    PublicKey           wgtypes.Key
+    Endpoint            *net.UDPAddr
+    EndpointHost        string // Endpoint is resolved from it
+    Annotations         map[string]string
+    AllowedIPs          []net.IPNet
+    PersistentKeepalive time.Duration
+    LastHandshake       time.Time
+    RxBytes             uint64
+    TxBytes             uint64
+    Latency             time.Duration
+    PacketLoss          float64 // percent
+    Priority            int
+    LoadScore           uint64
+    Group               string
+    PortHops            uint64
+    FlowSplitting       bool
+    Capabilities        PeerCapabilities // agreed with the peer
+    HandshakeRetries    uint32
+    Alive               bool
+}
+
+// Snapshot reads the peer's counters one by one, each atomically, and
+// copies the endpoint, allowed IPs and capabilities. Caller holds vpn.mu for the rest.
+func (peer *Peer) Snapshot() PeerSnapshot {
+    snap := PeerSnapshot{
+        PublicKey:           peer.PublicKey,
+        EndpointHost:        peer.EndpointHost(),
+        Annotations:         copyAnnotations(peer.Annotations()),
+        PersistentKeepalive: peer.PersistentKeepalive,
+        LastHandshake:       peer.LastHandshake,
+        RxBytes:             peer.RxBytes.Load(),
+        TxBytes:             peer.TxBytes.Load(),
+        Latency:             time.Duration(peer.CurrentLatency.Load()) * time.Microsecond,
+        PacketLoss:          float64(peer.PacketLoss.Load()) / 100,
+        Priority:            peer.Priority,
+        LoadScore:           peer.LoadScore.Load(),
+        Group:               peer.Group,
+        PortHops:            peer.PortHops.Load(),
+        FlowSplitting:       peer.FlowSplitting,
+        HandshakeRetries:    peer.HandshakeRetries.Load(),
+        Alive:               peer.IsAlive.Load(),
+    }
+    if peer.Endpoint != nil {
+        endpoint := *peer.Endpoint
+        endpoint.IP = append(net.IP(nil), endpoint.IP...)
+        snap.Endpoint = &endpoint
+    }
+    snap.Capabilities = peer.ActiveCapabilities
+    snap.Capabilities.ObfuscationModes = append([]ObfuscationMode(nil), peer.ActiveCapabilities.ObfuscationModes...)
+    if peer.AllowedIPs != nil {
+        snap.AllowedIPs = make([]net.IPNet, len(peer.AllowedIPs))
+        for i, prefix := range peer.AllowedIPs {
+            snap.AllowedIPs[i] = net.IPNet{
+                IP:   append(net.IP(nil), prefix.IP...),
+                Mask: append(net.IPMask(nil), prefix.Mask...),
+            }
+        }
+    }
+    return snap
+}
+
+// PeerInfo is a point-in-time view of one peer
+type PeerInfo struct {
+    PeerSnapshot
+    Metadata   PeerMetadata
+    Endpoints  []EndpointStats // per endpoint, only with FlowSplitting
+    
+    // Recent handshakes and alive/dead changes, oldest first, and the share
+    // of VPNConfig.UptimeWindow the peer was alive
+    History       []PeerHistoryEntry
+    UptimePercent float64
+    
+    // Taking no new flows and removed by DrainDeadline, see DrainPeer
+    Draining      bool
+    DrainDeadline time.Time
+}
+
+// Caller holds vpn.mu
+func (vpn *UnderTheRadarVPN) peerInfoLocked(peer *Peer) PeerInfo {
+    info := peer.info()
+    info.History = peer.history.list()
+    info.UptimePercent = peer.history.uptime(vpn.clock().Now(), vpn.uptimeWindowLocked())
+    return info
+}
+
+// Caller holds vpn.mu
+func (peer *Peer) info() PeerInfo {
+    return PeerInfo{
+        PeerSnapshot: peer.Snapshot(),
+        Metadata:     peer.Metadata(),
+        Endpoints:    peer.EndpointStats(),
+        Draining:     peer.draining.Load(),
+        DrainDeadline: peer.drainDeadline,
+    }
+}
+
+// ListPeers returns every peer, ordered by public key
+func (vpn *UnderTheRadarVPN) ListPeers() []PeerInfo {
+    return vpn.ListPeersMatching(nil)
+}
+
+func (vpn *UnderTheRadarVPN) GetStatus() Status {
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    status := Status{
+        Device:     vpn.deviceName,
+        ListenPort: vpn.listenPort,
+        Peers:      vpn.peers.len(),
+        Pinhole:    vpn.pinhole.Status(),
+    }
+    if vpn.mssClamp != nil {
+        status.MSSClamp = vpn.mssClamp.Status()
+    }
+    for _, peer := range vpn.peers.list {
+        if peer.IsAlive.Load() {
+            status.AlivePeers++
+        }
+    }
+    if vpn.killSwitch != nil {
+        status.KillSwitch = vpn.killSwitch.enabled.Load()
+    }
+    if vpn.dnsProtector != nil {
+        status.DNSProtection = vpn.dnsProtector.enabled.Load()
+        status.DNS = vpn.dnsProtector.ResolverStatus()
+    }
+    if vpn.proxy != nil {
+        status.Proxies = vpn.proxy.Stats()
+    }
+    if vpn.obfuscator != nil {
+        status.Datapath = vpn.obfuscator.QueueStats()
+        status.Shaping = vpn.shapingStatsLocked()
+    }
+    if vpn.metrics != nil {
+        status.Collection = vpn.metrics.Stats()
+    }
+    if vpn.captivePortal != nil {
+        status.CaptivePortal = vpn.captivePortal.Status()
+    }
+    if vpn.admission != nil {
+        status.Admission = vpn.admission.Stats()
+    }
+    status.Interface = vpn.linkStats.stats()
+    status.DevicePoll = vpn.devicePollStatus()
+    status.PeerSync = vpn.peerSyncStatus()
+    if vpn.ifaceWatcher != nil {
+        status.EBPFInterfaces = vpn.ifaceWatcher.Attached()
+    }
+    return status
+}
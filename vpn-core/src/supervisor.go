@@ -0,0 +1,450 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    mrand "math/rand/v2"
+    "os"
+    "sync"
+    "time"
+)
+
+const (
+    DefaultMinBackoff       = time.Second
+    DefaultMaxBackoff       = 5 * time.Minute
+    DefaultPeersDeadTimeout = 2 * time.Minute
+    DefaultSupervisorCheck  = 5 * time.Second
+)
+
+// SupervisorState is where a Supervisor is in its connect loop
+type SupervisorState int
+
+const (
+    SupervisorStopped SupervisorState = iota
+    SupervisorConnecting
+    SupervisorConnected
+    SupervisorBackingOff
+    SupervisorSuspended
+)
+
+func (s SupervisorState) String() string {
+    switch s {
+    case SupervisorStopped:
+        return "stopped"
+    case SupervisorConnecting:
+        return "connecting"
+    case SupervisorConnected:
+        return "connected"
+    case SupervisorBackingOff:
+        return "backing-off"
+    case SupervisorSuspended:
+        return "suspended"
+    default:
+        return "unknown"
+    }
+}
+
+// SupervisorStatus is reported in Status.Supervisor by Supervisor.GetStatus
+type SupervisorStatus struct {
+    State     SupervisorState
+    Failures  int       // attempts failed in a row
+    NextRetry time.Time // while backing off
+    LastError string
+}
+
+// SupervisorConfig tunes retries and what counts as a dead tunnel
+type SupervisorConfig struct {
+    MinBackoff       time.Duration // first retry delay, doubled per failure
+    MaxBackoff       time.Duration
+    PeersDeadTimeout time.Duration // every peer unhealthy this long restarts the tunnel
+    CheckInterval    time.Duration // how often the tunnel is checked
+}
+
+func (c SupervisorConfig) withDefaults() SupervisorConfig {
+    if c.MinBackoff <= 0 {
+        c.MinBackoff = DefaultMinBackoff
+    }
+    if c.MaxBackoff <= 0 {
+        c.MaxBackoff = DefaultMaxBackoff
+    }
+    if c.MaxBackoff < c.MinBackoff {
+        c.MaxBackoff = c.MinBackoff
+    }
+    if c.PeersDeadTimeout <= 0 {
+        c.PeersDeadTimeout = DefaultPeersDeadTimeout
+    }
+    if c.CheckInterval <= 0 {
+        c.CheckInterval = DefaultSupervisorCheck
+    }
+    return c
+}
+
+// Supervisor keeps a VPN up: it retries a failed Start and rebuilds the
+// tunnel when the device is deleted or every peer stays dead, backing off
+// exponentially with jitter. A stopped VPN can't be started again, so every
+// attempt gets a fresh one; peers added to it with AddPeer are lost on
+// reconnect, list them in VPNConfig.Peers instead.
+//
+// The Supervisor consumes the VPN's events and republishes them on its own
+// Events channel together with EventSupervisorState.
+//
+// Suspend takes the tunnel down without ending RunSupervised, Resume
+// brings it back. A Supervisor can run again once RunSupervised returned.
+type Supervisor struct {
+    cfg    SupervisorConfig
+    opts   VPNOptions
+    newVPN func() (*UnderTheRadarVPN, error)
+    events chan Event
+    wake   chan struct{} // Suspend or Resume was called
+    
+    mu     sync.Mutex
+    vpn    *UnderTheRadarVPN // nil between attempts
+    status SupervisorStatus
+    cancel context.CancelFunc
+    done   chan struct{}
+    
+    suspended      bool
+    keepKillSwitch bool // while suspended
+}
+
+var errSuspended = errors.New("suspended")
+
+func NewSupervisor(opts VPNOptions, cfg SupervisorConfig) *Supervisor {
+    return &Supervisor{
+        cfg:    cfg.withDefaults(),
+        opts:   opts,
+        newVPN: func() (*UnderTheRadarVPN, error) { return NewUnderTheRadarVPNWithOptions(opts) },
+        events: make(chan Event, eventBufferSize),
+        wake:   make(chan struct{}, 1),
+    }
+}
+
+// RunSupervised connects with config and keeps reconnecting until ctx is
+// done or Stop is called. With config.KillSwitch the kill switch stays
+// engaged between attempts, so nothing leaks while the tunnel is down.
+func (s *Supervisor) RunSupervised(ctx context.Context, config VPNConfig) error {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    
+    s.mu.Lock()
+    if s.cancel != nil {
+        s.mu.Unlock()
+        return errors.New("supervisor already running")
+    }
+    s.cancel = cancel
+    s.done = make(chan struct{})
+    done := s.done
+    s.mu.Unlock()
+    defer close(done)
+    defer func() {
+        s.mu.Lock()
+        s.cancel = nil
+        s.mu.Unlock()
+    }()
+    defer s.setStatus(SupervisorStatus{State: SupervisorStopped})
+    
+    // Every attempt must come up with the same key. Each VPN wipes its copy
+    // on Stop.
+    key := config.PrivateKey
+    if key == nil {
+        var err error
+        if key, err = GenerateSecret(); err != nil {
+            return fmt.Errorf("failed to generate private key: %w", err)
+        }
+        defer key.Zeroize()
+    }
+    
+    // The VPN drops its own kill switch on Stop; this one stays until the
+    // supervisor ends
+    var guard *KillSwitch
+    if config.KillSwitch {
+        guard = NewKillSwitch(s.opts.DeviceName)
+        guard.commands = s.opts.Commands
+        guard.VRFName = config.KillSwitchVRF
+        guard.AllowEstablished = config.KillSwitchAllowEstablished
+        if err := guard.Enable(); err != nil {
+            return fmt.Errorf("%w: %w", ErrKillSwitchFailed, err)
+        }
+        defer guard.Disable()
+    }
+    
+    failures := 0
+    for {
+        if err := s.waitSuspended(ctx, guard); err != nil {
+            return err
+        }
+        s.setStatus(SupervisorStatus{State: SupervisorConnecting, Failures: failures})
+        
+        attempt := config
+        attempt.PrivateKey = NewSecret(key.Bytes())
+        connected, err := s.run(ctx, attempt)
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+        if errors.Is(err, errSuspended) {
+            failures = 0
+            continue
+        }
+        if connected {
+            failures = 0
+        }
+        failures++
+        
+        delay := s.backoff(failures)
+        s.setStatus(SupervisorStatus{
+            State:     SupervisorBackingOff,
+            Failures:  failures,
+            NextRetry: s.clock().Now().Add(delay),
+            LastError: err.Error(),
+        })
+        
+        select {
+        case <-s.clock().After(delay):
+        case <-s.wake: // suspended, or resumed to retry now
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+}
+
+// Block while suspended. The kill switch is lifted for the suspension
+// unless it was asked to stay, and put back before reconnecting.
+func (s *Supervisor) waitSuspended(ctx context.Context, guard *KillSwitch) error {
+    announced := false
+    for {
+        s.mu.Lock()
+        suspended, keep := s.suspended, s.keepKillSwitch
+        s.mu.Unlock()
+        
+        if guard != nil {
+            engaged := guard.enabled.Load()
+            if (!suspended || keep) && !engaged {
+                if err := guard.Enable(); err != nil {
+                    return fmt.Errorf("%w: %w", ErrKillSwitchFailed, err)
+                }
+            } else if suspended && !keep && engaged {
+                guard.Disable()
+            }
+        }
+        if !suspended {
+            return nil
+        }
+        if !announced {
+            s.setStatus(SupervisorStatus{State: SupervisorSuspended})
+            announced = true
+        }
+        
+        select {
+        case <-s.wake:
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+}
+
+// Suspend tears the tunnel down and keeps it down until Resume, without
+// ending RunSupervised. With keepKillSwitch and VPNConfig.KillSwitch
+// nothing gets out meanwhile. Suspending before RunSupervised starts it
+// suspended.
+func (s *Supervisor) Suspend(keepKillSwitch bool) {
+    s.mu.Lock()
+    s.suspended, s.keepKillSwitch = true, keepKillSwitch
+    s.mu.Unlock()
+    s.poke()
+}
+
+// Resume reconnects a suspended supervisor. While backing off it retries
+// right away.
+func (s *Supervisor) Resume() {
+    s.mu.Lock()
+    s.suspended = false
+    s.mu.Unlock()
+    s.poke()
+}
+
+func (s *Supervisor) poke() {
+    select {
+    case s.wake <- struct{}{}:
+    default:
+    }
+}
+
+func (s *Supervisor) isSuspended() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.suspended
+}
+
+// Start one VPN and watch it until it fails or ctx is done. connected
+// reports whether it came up at all.
+func (s *Supervisor) run(ctx context.Context, config VPNConfig) (connected bool, err error) {
+    vpn, err := s.newVPN()
+    if err != nil {
+        return false, err
+    }
+    defer s.teardown(vpn)
+    
+    if err := vpn.StartContext(ctx, config); err != nil {
+        return false, err
+    }
+    
+    s.mu.Lock()
+    s.vpn = vpn
+    s.mu.Unlock()
+    s.setStatus(SupervisorStatus{State: SupervisorConnected})
+    
+    ticker := s.clock().NewTicker(s.cfg.CheckInterval)
+    defer ticker.Stop()
+    
+    var deadSince time.Time
+    for {
+        select {
+        case ev := <-vpn.Events():
+            s.emit(ev)
+        case now := <-ticker.C():
+            if err := s.check(vpn, now, &deadSince); err != nil {
+                return true, err
+            }
+        case <-s.wake:
+            if s.isSuspended() {
+                return true, errSuspended
+            }
+        case <-ctx.Done():
+            return true, nil
+        }
+    }
+}
+
+// Fatal conditions: the device went away or no peer has been healthy for
+// PeersDeadTimeout
+func (s *Supervisor) check(vpn *UnderTheRadarVPN, now time.Time, deadSince *time.Time) error {
+    if _, err := vpn.wgClient.Device(vpn.deviceName); errors.Is(err, os.ErrNotExist) {
+        return fmt.Errorf("device %s was deleted", vpn.deviceName)
+    }
+    
+    vpn.mu.RLock()
+    peers, alive := vpn.peers.len(), 0
+    for _, peer := range vpn.peers.list {
+        if vpn.healthCheck.IsHealthy(peer) {
+            alive++
+        }
+    }
+    vpn.mu.RUnlock()
+    
+    if peers == 0 || alive > 0 {
+        *deadSince = time.Time{}
+        return nil
+    }
+    if deadSince.IsZero() {
+        *deadSince = now
+    }
+    if dead := now.Sub(*deadSince); dead >= s.cfg.PeersDeadTimeout {
+        return fmt.Errorf("all %d peers dead for %v", peers, dead.Round(time.Second))
+    }
+    return nil
+}
+
+// Stop the VPN and delete its device so the next attempt starts clean
+func (s *Supervisor) teardown(vpn *UnderTheRadarVPN) {
+    s.mu.Lock()
+    s.vpn = nil
+    s.mu.Unlock()
+    
+    vpn.Stop()
+    vpn.removeDevice()
+    
+    // Pass on whatever was still queued
+    for {
+        select {
+        case ev := <-vpn.Events():
+            s.emit(ev)
+        default:
+            return
+        }
+    }
+}
+
+// Exponential from MinBackoff, capped at MaxBackoff, with the upper half
+// jittered so clients that failed together don't retry together
+func (s *Supervisor) backoff(failures int) time.Duration {
+    delay := s.cfg.MaxBackoff
+    if failures < 32 {
+        if d := s.cfg.MinBackoff << (failures - 1); d > 0 && d < delay {
+            delay = d
+        }
+    }
+    return delay/2 + mrand.N(delay/2+1)
+}
+
+// The VPNs' clock, see VPNOptions.Clock
+func (s *Supervisor) clock() Clock {
+    return orRealClock(s.opts.Clock)
+}
+
+func (s *Supervisor) setStatus(status SupervisorStatus) {
+    s.mu.Lock()
+    s.status = status
+    s.mu.Unlock()
+    
+    message := status.State.String()
+    switch status.State {
+    case SupervisorConnecting:
+        message = fmt.Sprintf("connecting, %d failed attempts", status.Failures)
+    case SupervisorBackingOff:
+        message = fmt.Sprintf("retrying at %s: %s", status.NextRetry.Format(time.TimeOnly), status.LastError)
+    }
+    s.emit(Event{Type: EventSupervisorState, Message: message})
+}
+
+func (s *Supervisor) emit(ev Event) {
+    if ev.Time.IsZero() {
+        ev.Time = s.clock().Now()
+    }
+    if ev.Count == 0 {
+        ev.Count = 1
+    }
+    select {
+    case s.events <- ev:
+    default:
+    }
+}
+
+// Events of the current VPN and the supervisor's own state changes
+func (s *Supervisor) Events() <-chan Event {
+    return s.events
+}
+
+// VPN is the running VPN, nil while connecting or backing off
+func (s *Supervisor) VPN() *UnderTheRadarVPN {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.vpn
+}
+
+// GetStatus is the current VPN's status with the supervisor state added
+func (s *Supervisor) GetStatus() Status {
+    s.mu.Lock()
+    vpn, supervisor := s.vpn, s.status
+    s.mu.Unlock()
+    
+    var status Status
+    if vpn != nil {
+        status = vpn.GetStatus()
+    }
+    status.Supervisor = supervisor
+    return status
+}
+
+// Stop cancels any retry in progress and waits for the VPN to come down
+func (s *Supervisor) Stop() {
+    s.mu.Lock()
+    cancel, done := s.cancel, s.done
+    s.mu.Unlock()
+    
+    if cancel == nil {
+        return
+    }
+    cancel()
+    <-done
+}
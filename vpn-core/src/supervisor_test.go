@@ -0,0 +1,225 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// supervisedHost runs commands against a fakeHost, deleting the fake
+// WireGuard device on ip link del and failing the first failLinkAdds
+// device creations
+type supervisedHost struct {
+    *fakeHost
+    wg           *fakeWGClient
+    failLinkAdds int32
+    linkAdds     atomic.Int32
+    
+    mu       sync.Mutex
+    drops    int // kill switch DROP rules in place
+    leaked   bool
+}
+
+func (h *supervisedHost) run(cmdline string) error {
+    if strings.HasPrefix(cmdline, "ip link add") {
+        if h.linkAdds.Add(1) <= h.failLinkAdds {
+            return errors.New("injected failure: " + cmdline)
+        }
+    }
+    if strings.HasPrefix(cmdline, "ip link del dev ") {
+        h.wg.deleteDevice(strings.TrimPrefix(cmdline, "ip link del dev "))
+    }
+    
+    h.mu.Lock()
+    switch cmdline {
+    case "iptables -A OUTPUT -j DROP":
+        h.drops++
+    case "iptables -D OUTPUT -j DROP":
+        h.drops--
+        if h.drops == 0 {
+            h.leaked = true // fine only once the supervisor is done
+        }
+    }
+    h.mu.Unlock()
+    return h.fakeHost.run(cmdline)
+}
+
+func (f *fakeWGClient) deleteDevice(name string) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    delete(f.devices, name)
+}
+
+func startSupervisor(t *testing.T, failLinkAdds int32, cfg SupervisorConfig) (*Supervisor, *supervisedHost, *FakeClock, chan error) {
+    t.Helper()
+    
+    clock := NewFakeClock(time.Now())
+    wg := newFakeWGClient()
+    host := &supervisedHost{fakeHost: installFakeHost(t, ""), wg: wg, failLinkAdds: failLinkAdds}
+    s := NewSupervisor(VPNOptions{
+        DeviceName: "sim0",
+        WGClient:   wg,
+        Commands:   host.run,
+        EBPF:       NoEBPF{},
+        LockDir:    t.TempDir(),
+        Clock:      clock,
+    }, cfg)
+    
+    result := make(chan error, 1)
+    go func() {
+        result <- s.RunSupervised(context.Background(), VPNConfig{ListenPort: 51820, KillSwitch: true})
+    }()
+    t.Cleanup(s.Stop)
+    return s, host, clock, result
+}
+
+func waitForState(t *testing.T, s *Supervisor, want SupervisorState) SupervisorStatus {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        if status := s.GetStatus().Supervisor; status.State == want {
+            return status
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+    t.Fatalf("supervisor never reached %s, last %+v", want, s.GetStatus().Supervisor)
+    return SupervisorStatus{}
+}
+
+func TestSupervisorRetriesFailedStart(t *testing.T) {
+    s, host, clock, result := startSupervisor(t, 2, SupervisorConfig{
+        MinBackoff: time.Minute,
+        MaxBackoff: 4 * time.Minute,
+    })
+    
+    // Through both backoffs without waiting for them
+    advanceUntil(t, clock, time.Minute, func() bool {
+        return s.GetStatus().Supervisor.State == SupervisorConnected
+    })
+    if n := host.linkAdds.Load(); n != 3 {
+        t.Fatalf("%d device creations, want 2 failures and a success", n)
+    }
+    if s.VPN() == nil || s.GetStatus().Device != "sim0" {
+        t.Fatalf("status %+v", s.GetStatus())
+    }
+    
+    var backoffs int
+    for len(s.Events()) > 0 {
+        if ev := <-s.Events(); ev.Type == EventSupervisorState && strings.HasPrefix(ev.Message, "retrying at") {
+            backoffs++
+        }
+    }
+    if backoffs != 2 {
+        t.Fatalf("%d backoff events, want 2", backoffs)
+    }
+    
+    start := time.Now()
+    s.Stop()
+    if err := <-result; !errors.Is(err, context.Canceled) {
+        t.Fatalf("RunSupervised returned %v", err)
+    }
+    if took := time.Since(start); took > time.Second {
+        t.Fatalf("Stop took %v", took)
+    }
+    
+    host.mu.Lock()
+    defer host.mu.Unlock()
+    if host.drops != 0 || len(host.rules) != 0 {
+        t.Fatalf("rules left behind: %v", host.rules)
+    }
+    if s.GetStatus().Supervisor.State != SupervisorStopped {
+        t.Fatalf("state %v after Stop", s.GetStatus().Supervisor.State)
+    }
+}
+
+func TestSupervisorKeepsKillSwitchBetweenAttempts(t *testing.T) {
+    s, host, clock, _ := startSupervisor(t, 0, SupervisorConfig{
+        MinBackoff:    time.Minute,
+        CheckInterval: 5 * time.Second,
+    })
+    waitForState(t, s, SupervisorConnected)
+    first := s.VPN()
+    
+    // Deleted from outside, the next check notices and the supervisor
+    // rebuilds the tunnel after backing off
+    host.wg.deleteDevice("sim0")
+    advanceUntil(t, clock, 5*time.Second, func() bool {
+        return s.VPN() != nil && s.VPN() != first
+    })
+    if n := host.linkAdds.Load(); n != 2 {
+        t.Fatalf("%d device creations, want 2", n)
+    }
+    
+    host.mu.Lock()
+    leaked := host.leaked
+    host.mu.Unlock()
+    if leaked {
+        t.Fatal("kill switch lifted between attempts")
+    }
+}
+
+func TestSupervisorStopCancelsBackoff(t *testing.T) {
+    s, _, clock, result := startSupervisor(t, 1000, SupervisorConfig{MinBackoff: time.Hour})
+    
+    status := waitForState(t, s, SupervisorBackingOff)
+    if status.Failures != 1 || status.NextRetry.Sub(clock.Now()) < 30*time.Minute || status.LastError == "" {
+        t.Fatalf("status %+v", status)
+    }
+    
+    start := time.Now()
+    s.Stop()
+    <-result
+    if took := time.Since(start); took > time.Second {
+        t.Fatalf("Stop took %v during backoff", took)
+    }
+}
+
+func TestSupervisorBackoffGrowsWithJitter(t *testing.T) {
+    s := NewSupervisor(VPNOptions{}, SupervisorConfig{MinBackoff: time.Second, MaxBackoff: 8 * time.Second})
+    for failures, want := range map[int]time.Duration{1: time.Second, 3: 4 * time.Second, 4: 8 * time.Second, 40: 8 * time.Second} {
+        for i := 0; i < 50; i++ {
+            if got := s.backoff(failures); got < want/2 || got > want {
+                t.Fatalf("backoff(%d) = %v, want within [%v, %v]", failures, got, want/2, want)
+            }
+        }
+    }
+}
+
+func TestSupervisorCheckDeadPeers(t *testing.T) {
+    wg := newFakeWGClient()
+    wg.setPeer("utr0", wgtypes.Peer{}) // the device exists
+    vpn := newTestVPN(t, wg)
+    vpn.healthCheck = NewHealthChecker(vpn)
+    peer := &Peer{PublicKey: mustKey(t).PublicKey()}
+    vpn.peers.put(peer)
+    s := NewSupervisor(VPNOptions{}, SupervisorConfig{PeersDeadTimeout: time.Minute})
+    
+    var deadSince time.Time
+    now := time.Now()
+    if err := s.check(vpn, now, &deadSince); err != nil || !deadSince.IsZero() {
+        t.Fatalf("unchecked peer counted as dead: %v", err)
+    }
+    
+    vpn.healthCheck.verdicts[peer.PublicKey] = false
+    if err := s.check(vpn, now, &deadSince); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.check(vpn, now.Add(59*time.Second), &deadSince); err != nil {
+        t.Fatalf("dead for less than the timeout: %v", err)
+    }
+    if err := s.check(vpn, now.Add(time.Minute), &deadSince); err == nil {
+        t.Fatal("all peers dead past the timeout not reported")
+    }
+    
+    // One peer coming back resets the clock
+    vpn.healthCheck.verdicts[peer.PublicKey] = true
+    if err := s.check(vpn, now.Add(2*time.Minute), &deadSince); err != nil || !deadSince.IsZero() {
+        t.Fatalf("recovered peer: %v, dead since %v", err, deadSince)
+    }
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "os/exec"
+    "strconv"
+    "strings"
+)
+
+// runSystemCommand executes a command line such as an iptables rule.
+// Tests replace it to record commands instead of touching the host.
+var runSystemCommand = func(cmdline string) error {
+    fields := strings.Fields(cmdline)
+    if len(fields) == 0 {
+        return fmt.Errorf("empty command")
+    }
+    
+    out, err := exec.Command(fields[0], fields[1:]...).CombinedOutput()
+    if err != nil {
+        return fmt.Errorf("%s: %w: %s", fields[0], err, strings.TrimSpace(string(out)))
+    }
+    return nil
+}
+
+// CommandRunner executes a command line on behalf of one VPN instance,
+// see VPNOptions. The nil runner uses runSystemCommand.
+type CommandRunner func(cmdline string) error
+
+func (run CommandRunner) Run(cmdline string) error {
+    if run == nil {
+        return runSystemCommand(cmdline)
+    }
+    return run(cmdline)
+}
+
+// Turn an append/insert rule into the matching delete rule, and a chain
+// creation into the chain deletion
+func deleteRule(rule string) string {
+    fields := strings.Fields(rule)
+    for i, f := range fields {
+        if f == "-A" || f == "-I" {
+            fields[i] = "-D"
+            break
+        }
+        if f == "-N" {
+            fields[i] = "-X"
+            break
+        }
+    }
+    return strings.Join(fields, " ")
+}
+
+// Remove previously added rules in reverse order, returning the first error
+func (run CommandRunner) removeIPTablesRules(rules []string) error {
+    var firstErr error
+    for i := len(rules) - 1; i >= 0; i-- {
+        if err := run.Run(deleteRule(rules[i])); err != nil && firstErr == nil {
+            firstErr = fmt.Errorf("failed to remove rule %s: %w", rules[i], err)
+        }
+    }
+    return firstErr
+}
+
+// Undo ip rule add and ip route replace commands in reverse, either
+// family. Returns the first failure, the rest are still tried.
+func (run CommandRunner) removeRoutes(commands []string) error {
+    var firstErr error
+    for i := len(commands) - 1; i >= 0; i-- {
+        cmd := commands[i]
+        var undo string
+        switch {
+        case strings.Contains(cmd, " rule add "):
+            undo = strings.Replace(cmd, " rule add ", " rule del ", 1)
+        case strings.Contains(cmd, " route replace "):
+            undo = strings.Replace(cmd, " route replace ", " route del ", 1)
+        default:
+            continue
+        }
+        if err := run.Run(undo); err != nil && firstErr == nil {
+            firstErr = fmt.Errorf("failed to remove route %s: %w", cmd, err)
+        }
+    }
+    return firstErr
+}
+
+// Name of the interface holding the IPv4 default route
+func defaultRouteInterface() (string, error) {
+    data, err := os.ReadFile("/proc/net/route")
+    if err != nil {
+        return "", err
+    }
+    
+    for _, line := range strings.Split(string(data), "\n")[1:] {
+        fields := strings.Fields(line)
+        if len(fields) >= 2 && fields[1] == "00000000" {
+            return fields[0], nil
+        }
+    }
+    return "", fmt.Errorf("no default route")
+}
+
+// Default route as "<interface> via <gateway>", identifying the network we
+// are attached to
+func defaultRouteNetwork() (string, error) {
+    data, err := os.ReadFile("/proc/net/route")
+    if err != nil {
+        return "", err
+    }
+    
+    for _, line := range strings.Split(string(data), "\n")[1:] {
+        fields := strings.Fields(line)
+        if len(fields) < 3 || fields[1] != "00000000" {
+            continue
+        }
+        gw, err := strconv.ParseUint(fields[2], 16, 32)
+        if err != nil {
+            return "", fmt.Errorf("invalid gateway %s: %w", fields[2], err)
+        }
+        // Stored in host order, little-endian on every platform we run on
+        ip := net.IPv4(byte(gw), byte(gw>>8), byte(gw>>16), byte(gw>>24))
+        return fmt.Sprintf("%s via %s", fields[0], ip), nil
+    }
+    return "", fmt.Errorf("no default route")
+}
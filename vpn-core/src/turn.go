@@ -0,0 +1,537 @@
+package main
+
+import (
+    "context"
+    "crypto/md5"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "net"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
+    
+    "github.com/pion/stun"
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+    DefaultTURNLifetime = 10 * time.Minute // requested allocation lifetime
+    
+    // Permissions last 5 minutes and channel bindings 10, a ChannelBind
+    // refreshes both
+    turnBindingRefresh = 4 * time.Minute
+    turnRequestTimeout = 5 * time.Second
+    turnRetransmit     = 500 * time.Millisecond
+    turnFirstChannel   = 0x4000
+    turnLastChannel    = 0x7fff
+    turnChannelHeader  = 4
+    turnProtocolUDP    = 17
+)
+
+var (
+    ErrTURNAuth   = errors.New("TURN server refused the credentials")
+    errTURNClosed = errors.New("TURN client closed")
+)
+
+// TURNConfig is a TURN server (RFC 5766) relaying a peer's WireGuard
+// traffic, for peers direct UDP can't reach such as those behind a
+// symmetric NAT. Only UDP to the server is supported.
+type TURNConfig struct {
+    Server   string  // host:port
+    Username string
+    Password *Secret
+    Realm    string        // empty takes the one the server names
+    Lifetime time.Duration // requested allocation lifetime, default DefaultTURNLifetime
+}
+
+// TURNClient holds an allocation on a TURN server. It authenticates with
+// the long-term credential mechanism, binds a channel to each peer and
+// keeps the allocation and the bindings alive until Close. Channel data
+// from the peers is handed to deliver, whose buffer is only valid during
+// the call.
+type TURNClient struct {
+    conn    net.PacketConn
+    server  net.Addr
+    cfg     TURNConfig
+    clock   Clock
+    deliver func(from *net.UDPAddr, p []byte)
+    
+    mu          sync.Mutex
+    realm       string
+    nonce       string
+    key         stun.MessageIntegrity // for realm, nil before the first challenge
+    relayed     *net.UDPAddr
+    channels    map[string]uint16 // by peer address
+    peers       map[uint16]*net.UDPAddr
+    nextChannel uint16
+    pending     map[[stun.TransactionIDSize]byte]chan *stun.Message
+    
+    stop     chan struct{}
+    stopOnce sync.Once
+}
+
+func NewTURNClient(conn net.PacketConn, server net.Addr, cfg TURNConfig, clock Clock, deliver func(from *net.UDPAddr, p []byte)) *TURNClient {
+    if cfg.Lifetime <= 0 {
+        cfg.Lifetime = DefaultTURNLifetime
+    }
+    return &TURNClient{
+        conn:        conn,
+        server:      server,
+        cfg:         cfg,
+        clock:       orRealClock(clock),
+        deliver:     deliver,
+        realm:       cfg.Realm,
+        channels:    make(map[string]uint16),
+        peers:       make(map[uint16]*net.UDPAddr),
+        nextChannel: turnFirstChannel,
+        pending:     make(map[[stun.TransactionIDSize]byte]chan *stun.Message),
+        stop:        make(chan struct{}),
+    }
+}
+
+// Allocate a relayed address on the server and start reading from it and
+// refreshing it
+func (c *TURNClient) Allocate() (*net.UDPAddr, error) {
+    go c.readLoop()
+    
+    resp, err := c.request(stun.MethodAllocate,
+        stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{turnProtocolUDP, 0, 0, 0}},
+        turnLifetime(c.cfg.Lifetime))
+    if err != nil {
+        return nil, fmt.Errorf("failed to allocate TURN relay: %w", err)
+    }
+    var relayed stun.XORMappedAddress
+    if err := relayed.GetFromAs(resp, stun.AttrXORRelayedAddress); err != nil {
+        return nil, fmt.Errorf("failed to allocate TURN relay: %w", err)
+    }
+    
+    c.mu.Lock()
+    c.relayed = &net.UDPAddr{IP: relayed.IP, Port: relayed.Port}
+    c.mu.Unlock()
+    go c.keepalive()
+    return c.RelayedAddr(), nil
+}
+
+// RelayedAddr is where the peers see our traffic come from
+func (c *TURNClient) RelayedAddr() *net.UDPAddr {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.relayed
+}
+
+// ChannelBind binds a channel to peer, which also permits its traffic
+// through the relay. Binding a bound peer again refreshes its channel.
+func (c *TURNClient) ChannelBind(peer *net.UDPAddr) (uint16, error) {
+    c.mu.Lock()
+    channel, ok := c.channels[peer.String()]
+    if !ok {
+        if c.nextChannel > turnLastChannel {
+            c.mu.Unlock()
+            return 0, fmt.Errorf("no TURN channels left for %s", peer)
+        }
+        channel = c.nextChannel
+        c.nextChannel++
+    }
+    c.mu.Unlock()
+    
+    if _, err := c.request(stun.MethodChannelBind, turnChannel(channel), turnPeerAddress{peer}); err != nil {
+        return 0, fmt.Errorf("failed to bind TURN channel to %s: %w", peer, err)
+    }
+    
+    c.mu.Lock()
+    c.channels[peer.String()] = channel
+    c.peers[channel] = peer
+    c.mu.Unlock()
+    return channel, nil
+}
+
+// WriteTo sends p to a bound peer as channel data
+func (c *TURNClient) WriteTo(p []byte, peer *net.UDPAddr) error {
+    c.mu.Lock()
+    channel, ok := c.channels[peer.String()]
+    c.mu.Unlock()
+    if !ok {
+        return fmt.Errorf("no TURN channel bound to %s", peer)
+    }
+    
+    frame := make([]byte, turnChannelHeader+len(p))
+    binary.BigEndian.PutUint16(frame[0:], channel)
+    binary.BigEndian.PutUint16(frame[2:], uint16(len(p)))
+    copy(frame[turnChannelHeader:], p)
+    _, err := c.conn.WriteTo(frame, c.server)
+    return err
+}
+
+// Close gives the allocation back, without waiting for the server to
+// confirm, and closes the connection
+func (c *TURNClient) Close() error {
+    if c.RelayedAddr() != nil {
+        if req, err := c.build(stun.MethodRefresh, turnLifetime(0)); err == nil {
+            c.conn.WriteTo(req.Raw, c.server)
+        }
+    }
+    c.stopOnce.Do(func() { close(c.stop) })
+    err := c.conn.Close()
+    
+    c.mu.Lock()
+    wipe(c.key)
+    c.mu.Unlock()
+    return err
+}
+
+// Refresh the allocation and every channel binding before they expire
+func (c *TURNClient) keepalive() {
+    interval := c.cfg.Lifetime / 2
+    if interval > turnBindingRefresh {
+        interval = turnBindingRefresh
+    }
+    ticker := c.clock.NewTicker(interval)
+    defer ticker.Stop()
+    
+    for {
+        select {
+        case <-ticker.C():
+            c.refresh()
+        case <-c.stop:
+            return
+        }
+    }
+}
+
+func (c *TURNClient) refresh() error {
+    if _, err := c.request(stun.MethodRefresh, turnLifetime(c.cfg.Lifetime)); err != nil {
+        return fmt.Errorf("failed to refresh TURN allocation: %w", err)
+    }
+    c.mu.Lock()
+    peers := make([]*net.UDPAddr, 0, len(c.peers))
+    for _, peer := range c.peers {
+        peers = append(peers, peer)
+    }
+    c.mu.Unlock()
+    
+    for _, peer := range peers {
+        if _, err := c.ChannelBind(peer); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// A request, with credentials once the server has challenged us
+func (c *TURNClient) build(method stun.Method, setters ...stun.Setter) (*stun.Message, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    msg := append([]stun.Setter{stun.TransactionID, stun.NewType(method, stun.ClassRequest)}, setters...)
+    if c.key != nil {
+        msg = append(msg, stun.NewUsername(c.cfg.Username), stun.NewRealm(c.realm), stun.NewNonce(c.nonce), c.key)
+    }
+    return stun.Build(append(msg, stun.Fingerprint)...)
+}
+
+// Send a request, authenticating when the server challenges it or its
+// nonce went stale
+func (c *TURNClient) request(method stun.Method, setters ...stun.Setter) (*stun.Message, error) {
+    for attempt := 0; ; attempt++ {
+        c.mu.Lock()
+        key := c.key
+        c.mu.Unlock()
+        req, err := c.build(method, setters...)
+        if err != nil {
+            return nil, err
+        }
+        resp, err := c.roundTrip(req)
+        if err != nil {
+            return nil, err
+        }
+        
+        if resp.Type.Class == stun.ClassSuccessResponse {
+            if key != nil && resp.Contains(stun.AttrMessageIntegrity) {
+                if err := key.Check(resp); err != nil {
+                    return nil, fmt.Errorf("TURN %s response: %w", method, err)
+                }
+            }
+            return resp, nil
+        }
+        
+        var code stun.ErrorCodeAttribute
+        if err := code.GetFrom(resp); err != nil {
+            return nil, fmt.Errorf("TURN %s failed without an error code", method)
+        }
+        switch {
+        case key != nil && code.Code == stun.CodeUnauthorized,
+            key != nil && code.Code == stun.CodeBadRequest && attempt > 0:
+            // Our credentials, not the lack of them; some servers, pion's
+            // among them, answer a bad user or integrity with 400
+            return nil, ErrTURNAuth
+        case code.Code != stun.CodeUnauthorized && code.Code != stun.CodeStaleNonce || attempt >= 2:
+            return nil, fmt.Errorf("TURN %s failed: %s", method, code)
+        }
+        if err := c.challenge(resp); err != nil {
+            return nil, err
+        }
+    }
+}
+
+// Take the realm and nonce of a 401 or 438 answer
+func (c *TURNClient) challenge(resp *stun.Message) error {
+    var nonce stun.Nonce
+    if err := nonce.GetFrom(resp); err != nil {
+        return fmt.Errorf("TURN challenge without a nonce: %w", err)
+    }
+    var realm stun.Realm
+    realm.GetFrom(resp)
+    
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.nonce = nonce.String()
+    if c.key == nil {
+        if c.cfg.Realm == "" {
+            c.realm = realm.String()
+        }
+        c.key = turnKey(c.cfg.Username, c.realm, c.cfg.Password)
+    }
+    return nil
+}
+
+// The long-term credential key, MD5(username ":" realm ":" password)
+func turnKey(username, realm string, password *Secret) stun.MessageIntegrity {
+    h := md5.New()
+    h.Write([]byte(username + ":" + realm + ":"))
+    if password != nil {
+        h.Write(password.Bytes())
+    }
+    return stun.MessageIntegrity(h.Sum(nil))
+}
+
+// Send req until its response arrives, retransmitting as UDP may lose either
+func (c *TURNClient) roundTrip(req *stun.Message) (*stun.Message, error) {
+    done := make(chan *stun.Message, 1)
+    c.mu.Lock()
+    c.pending[req.TransactionID] = done
+    c.mu.Unlock()
+    defer func() {
+        c.mu.Lock()
+        delete(c.pending, req.TransactionID)
+        c.mu.Unlock()
+    }()
+    
+    timeout := time.After(turnRequestTimeout)
+    retransmit := time.NewTicker(turnRetransmit)
+    defer retransmit.Stop()
+    for {
+        if _, err := c.conn.WriteTo(req.Raw, c.server); err != nil {
+            return nil, err
+        }
+        select {
+        case resp := <-done:
+            return resp, nil
+        case <-retransmit.C:
+        case <-timeout:
+            return nil, fmt.Errorf("no answer from TURN server %s", c.server)
+        case <-c.stop:
+            return nil, errTURNClosed
+        }
+    }
+}
+
+// Hand responses to their requests and channel data to deliver
+func (c *TURNClient) readLoop() {
+    buf := make([]byte, 65536)
+    for {
+        n, from, err := c.conn.ReadFrom(buf)
+        if err != nil {
+            return
+        }
+        if from.String() != c.server.String() {
+            continue
+        }
+        packet := buf[:n]
+        
+        if stun.IsMessage(packet) {
+            resp := &stun.Message{Raw: append([]byte(nil), packet...)}
+            if resp.Decode() != nil {
+                continue
+            }
+            c.mu.Lock()
+            done := c.pending[resp.TransactionID]
+            c.mu.Unlock()
+            if done != nil {
+                select {
+                case done <- resp:
+                default: // answer to a retransmission
+                }
+            }
+            continue
+        }
+        
+        if n < turnChannelHeader {
+            continue
+        }
+        channel := binary.BigEndian.Uint16(packet)
+        length := int(binary.BigEndian.Uint16(packet[2:]))
+        if channel < turnFirstChannel || channel > turnLastChannel || turnChannelHeader+length > n {
+            continue
+        }
+        c.mu.Lock()
+        peer := c.peers[channel]
+        c.mu.Unlock()
+        if peer != nil && c.deliver != nil {
+            c.deliver(peer, packet[turnChannelHeader:turnChannelHeader+length])
+        }
+    }
+}
+
+// LIFETIME in seconds
+type turnLifetime time.Duration
+
+func (l turnLifetime) AddTo(m *stun.Message) error {
+    v := make([]byte, 4)
+    binary.BigEndian.PutUint32(v, uint32(time.Duration(l)/time.Second))
+    m.Add(stun.AttrLifetime, v)
+    return nil
+}
+
+// CHANNEL-NUMBER, followed by 16 reserved bits
+type turnChannel uint16
+
+func (ch turnChannel) AddTo(m *stun.Message) error {
+    v := make([]byte, 4)
+    binary.BigEndian.PutUint16(v, uint16(ch))
+    m.Add(stun.AttrChannelNumber, v)
+    return nil
+}
+
+type turnPeerAddress struct {
+    addr *net.UDPAddr
+}
+
+func (p turnPeerAddress) AddTo(m *stun.Message) error {
+    return stun.XORMappedAddress{IP: p.addr.IP, Port: p.addr.Port}.AddToAs(m, stun.AttrXORPeerAddress)
+}
+
+// TURNTransport carries one peer's WireGuard traffic through a TURN relay.
+// The device is pointed at a loopback socket: what the device sends there
+// goes to the peer as channel data, and what the relay delivers is handed
+// to the device from the same socket, so the device never sees the relay.
+type TURNTransport struct {
+    client *TURNClient
+    local  *net.UDPConn
+    device *net.UDPAddr // where the device listens, on loopback
+    peer   atomic.Pointer[net.UDPAddr]
+}
+
+// Allocate a relay for peer on the server of cfg and start forwarding
+// between it and the device listening at device. Once ctx is done the
+// allocation is abandoned.
+func newTURNTransport(ctx context.Context, cfg TURNConfig, peer, device *net.UDPAddr, control func(network, address string, c syscall.RawConn) error, clock Clock) (*TURNTransport, error) {
+    server, err := net.ResolveUDPAddr("udp", cfg.Server)
+    if err != nil {
+        return nil, fmt.Errorf("invalid TURN server %q: %w", cfg.Server, err)
+    }
+    local, err := net.ListenUDP("udp", &net.UDPAddr{IP: device.IP})
+    if err != nil {
+        return nil, fmt.Errorf("failed to open TURN forwarding socket: %w", err)
+    }
+    lc := net.ListenConfig{Control: control}
+    conn, err := lc.ListenPacket(ctx, "udp", ":0")
+    if err != nil {
+        local.Close()
+        return nil, fmt.Errorf("failed to open TURN socket: %w", err)
+    }
+    
+    t := &TURNTransport{local: local, device: device}
+    t.peer.Store(peer)
+    t.client = NewTURNClient(conn, server, cfg, clock, func(from *net.UDPAddr, p []byte) {
+        if from.String() == t.peer.Load().String() {
+            t.local.WriteToUDP(p, t.device)
+        }
+    })
+    
+    // Closing the client ends the request waiting for an answer
+    stop := context.AfterFunc(ctx, func() { t.client.Close() })
+    defer stop()
+    if _, err := t.client.Allocate(); err != nil {
+        t.Close()
+        return nil, turnError(ctx, err)
+    }
+    if _, err := t.client.ChannelBind(peer); err != nil {
+        t.Close()
+        return nil, turnError(ctx, err)
+    }
+    if !stop() {
+        t.Close()
+        return nil, ctx.Err()
+    }
+    go t.forward()
+    return t, nil
+}
+
+// ctx's error when it cut the request short
+func turnError(ctx context.Context, err error) error {
+    if ctx.Err() != nil {
+        return ctx.Err()
+    }
+    return err
+}
+
+// LocalAddr is the endpoint the device is given for the peer
+func (t *TURNTransport) LocalAddr() *net.UDPAddr {
+    return t.local.LocalAddr().(*net.UDPAddr)
+}
+
+// RelayedAddr is the address the peer sees our traffic from
+func (t *TURNTransport) RelayedAddr() *net.UDPAddr {
+    return t.client.RelayedAddr()
+}
+
+// SetPeer moves the relayed traffic to the peer's new address
+func (t *TURNTransport) SetPeer(peer *net.UDPAddr) error {
+    if _, err := t.client.ChannelBind(peer); err != nil {
+        return err
+    }
+    t.peer.Store(peer)
+    return nil
+}
+
+func (t *TURNTransport) Close() error {
+    err := t.client.Close()
+    t.local.Close()
+    return err
+}
+
+// Relay what the device sends for the peer, a few datagrams per syscall:
+// one peer's traffic doesn't need the full batch's buffers
+func (t *TURNTransport) forward() {
+    receiver := NewBatchReceiver(t.local, 8, func(from *net.UDPAddr, packet []byte) {
+        if from.Port == t.device.Port {
+            t.client.WriteTo(packet, t.peer.Load())
+        }
+    })
+    receiver.Run()
+}
+
+// Relay for peer through the server of cfg, forwarding to the device's
+// listen port on loopback. The relay's socket leaves the way the device's
+// packets do. Its goroutines carry the peer's pprof labels.
+func (vpn *UnderTheRadarVPN) dialTURN(ctx context.Context, key wgtypes.Key, cfg TURNConfig, peer *net.UDPAddr) (transport *TURNTransport, err error) {
+    vpn.mu.RLock()
+    port := vpn.listenPort
+    vpn.mu.RUnlock()
+    if port == 0 {
+        if device, err := vpn.wgClient.Device(vpn.deviceName); err == nil {
+            port = device.ListenPort
+        }
+    }
+    if port == 0 {
+        return nil, fmt.Errorf("TURN relay for %s needs the device's listen port", peer)
+    }
+    
+    device := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+    withPeerLabels(key, PhaseRouting, func() {
+        transport, err = newTURNTransport(ctx, cfg, peer, device, vpn.socketControl(), vpn.clock())
+    })
+    return transport, err
+}
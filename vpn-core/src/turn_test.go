@@ -0,0 +1,156 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net"
+    "testing"
+    "time"
+    
+    "github.com/pion/turn/v2"
+)
+
+const testTURNRealm = "utr.test"
+
+// TURN server on loopback relaying from loopback, accepting user:pass
+func startTURNServer(t *testing.T) string {
+    conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    key := turn.GenerateAuthKey("user", testTURNRealm, "pass")
+    server, err := turn.NewServer(turn.ServerConfig{
+        Realm: testTURNRealm,
+        AuthHandler: func(username, realm string, src net.Addr) ([]byte, bool) {
+            return key, username == "user"
+        },
+        PacketConnConfigs: []turn.PacketConnConfig{{
+            PacketConn: conn,
+            RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+                RelayAddress: net.ParseIP("127.0.0.1"),
+                Address:      "127.0.0.1",
+            },
+        }},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { server.Close() })
+    return conn.LocalAddr().String()
+}
+
+func testTURNConfig(t *testing.T, server, password string) TURNConfig {
+    secret := NewSecret([]byte(password))
+    t.Cleanup(secret.Zeroize)
+    return TURNConfig{Server: server, Username: "user", Password: secret}
+}
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+    conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    return conn
+}
+
+func TestTURNTransportRelaysRoundTrip(t *testing.T) {
+    server := startTURNServer(t)
+    device := listenLoopback(t) // stands in for the WireGuard device
+    peer := listenLoopback(t)
+    
+    transport, err := newTURNTransport(context.Background(), testTURNConfig(t, server, "pass"), peer.LocalAddr().(*net.UDPAddr), device.LocalAddr().(*net.UDPAddr), nil, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer transport.Close()
+    
+    // Device to peer, arriving from the relayed address
+    if _, err := device.WriteToUDP([]byte("handshake initiation"), transport.LocalAddr()); err != nil {
+        t.Fatal(err)
+    }
+    buf := make([]byte, 1500)
+    n, from, err := peer.ReadFromUDP(buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(buf[:n]) != "handshake initiation" || from.String() != transport.RelayedAddr().String() {
+        t.Fatalf("peer got %q from %s, relay is %s", buf[:n], from, transport.RelayedAddr())
+    }
+    
+    // And back, handed to the device from the endpoint it was given
+    if _, err := peer.WriteToUDP([]byte("handshake response"), from); err != nil {
+        t.Fatal(err)
+    }
+    n, from, err = device.ReadFromUDP(buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(buf[:n]) != "handshake response" || from.String() != transport.LocalAddr().String() {
+        t.Fatalf("device got %q from %s", buf[:n], from)
+    }
+}
+
+func TestTURNClientRefreshesAllocation(t *testing.T) {
+    server := startTURNServer(t)
+    conn := listenLoopback(t)
+    serverAddr, _ := net.ResolveUDPAddr("udp", server)
+    peer := listenLoopback(t)
+    
+    client := NewTURNClient(conn, serverAddr, testTURNConfig(t, server, "pass"), nil, nil)
+    defer client.Close()
+    if _, err := client.Allocate(); err != nil {
+        t.Fatal(err)
+    }
+    first, err := client.ChannelBind(peer.LocalAddr().(*net.UDPAddr))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := client.refresh(); err != nil {
+        t.Fatal(err)
+    }
+    if again, _ := client.ChannelBind(peer.LocalAddr().(*net.UDPAddr)); again != first {
+        t.Fatalf("peer rebound from channel %#x to %#x", first, again)
+    }
+}
+
+func TestTURNClientRejectedCredentials(t *testing.T) {
+    server := startTURNServer(t)
+    peer := listenLoopback(t)
+    
+    _, err := newTURNTransport(context.Background(), testTURNConfig(t, server, "wrong"), peer.LocalAddr().(*net.UDPAddr), peer.LocalAddr().(*net.UDPAddr), nil, nil)
+    if !errors.Is(err, ErrTURNAuth) {
+        t.Fatalf("got %v", err)
+    }
+}
+
+func TestAddPeerThroughTURN(t *testing.T) {
+    server := startTURNServer(t)
+    remote := listenLoopback(t)
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    vpn.listenPort = 51820
+    
+    key := mustKey(t).PublicKey()
+    endpoint := remote.LocalAddr().(*net.UDPAddr)
+    cfg := testTURNConfig(t, server, "pass")
+    if err := vpn.AddPeer(PeerConfig{PublicKey: key, Endpoint: endpoint, TURNConfig: &cfg}); err != nil {
+        t.Fatal(err)
+    }
+    peer := vpn.peers.get(key)
+    relay := peer.extra.turn
+    if relay == nil || peer.Endpoint != endpoint {
+        t.Fatalf("peer %v relayed by %v", peer.Endpoint, relay)
+    }
+    if got := wg.configs[0].Peers[0].Endpoint; got.String() != relay.LocalAddr().String() {
+        t.Fatalf("device sends to %v, not the relay", got)
+    }
+    
+    if err := vpn.RemovePeer(key); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := relay.local.WriteToUDP([]byte("x"), endpoint); err == nil {
+        t.Fatal("relay still open after RemovePeer")
+    }
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Where wg and wireguard-go look for userspace devices
+const uapiSocketDir = "/var/run/wireguard"
+
+// uapiError carries the errno reported back to the client
+type uapiError struct {
+    errno syscall.Errno
+    err   error
+}
+
+func (e *uapiError) Error() string {
+    return e.err.Error()
+}
+
+func uapiInvalid(format string, args ...any) error {
+    return &uapiError{syscall.EINVAL, fmt.Errorf(format, args...)}
+}
+
+// UAPIServer speaks the WireGuard userspace API (get=1 and set=1) on a unix
+// socket, so wg show and other tooling work against our device. Set
+// operations go through AddPeer and RemovePeer with their usual checks.
+type UAPIServer struct {
+    vpn  *UnderTheRadarVPN
+    path string
+    
+    mu       sync.Mutex // serializes set transactions
+    listener net.Listener
+    wg       sync.WaitGroup
+    
+    connMu sync.Mutex
+    conns  map[net.Conn]struct{}
+}
+
+// NewUAPIServer serves vpn on path, see UAPISocketPath for the default
+func NewUAPIServer(vpn *UnderTheRadarVPN, path string) *UAPIServer {
+    return &UAPIServer{vpn: vpn, path: path, conns: make(map[net.Conn]struct{})}
+}
+
+// UAPISocketPath is where wg expects the socket of device
+func UAPISocketPath(device string) string {
+    return filepath.Join(uapiSocketDir, device+".sock")
+}
+
+// Start listens on the socket, replacing a stale one left by a crash
+func (s *UAPIServer) Start() error {
+    if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+        return fmt.Errorf("failed to create %s: %w", filepath.Dir(s.path), err)
+    }
+    os.Remove(s.path)
+    
+    ln, err := net.Listen("unix", s.path)
+    if err != nil {
+        return fmt.Errorf("failed to listen on %s: %w", s.path, err)
+    }
+    // get=1 returns the private key, root only like wireguard-go
+    if err := os.Chmod(s.path, 0600); err != nil {
+        ln.Close()
+        return fmt.Errorf("failed to restrict %s: %w", s.path, err)
+    }
+    s.listener = ln
+    
+    s.wg.Add(1)
+    go func() {
+        defer s.wg.Done()
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return // closed by Close
+            }
+            s.connMu.Lock()
+            s.conns[conn] = struct{}{}
+            s.connMu.Unlock()
+            
+            s.wg.Add(1)
+            go func() {
+                defer s.wg.Done()
+                defer func() {
+                    s.connMu.Lock()
+                    delete(s.conns, conn)
+                    s.connMu.Unlock()
+                    conn.Close()
+                }()
+                s.serve(conn)
+            }()
+        }
+    }()
+    return nil
+}
+
+// Close stops listening, which removes the socket, and drops clients
+func (s *UAPIServer) Close() error {
+    if s.listener == nil {
+        return nil
+    }
+    err := s.listener.Close()
+    s.connMu.Lock()
+    for conn := range s.conns {
+        conn.Close()
+    }
+    s.connMu.Unlock()
+    s.wg.Wait()
+    s.listener = nil
+    return err
+}
+
+// One connection can carry several operations, each answered with errno
+func (s *UAPIServer) serve(conn net.Conn) {
+    r := bufio.NewReader(conn)
+    for {
+        conn.SetDeadline(time.Now().Add(uapiIdleTimeout))
+        op, err := r.ReadString('\n')
+        if err != nil {
+            return
+        }
+        
+        var opErr error
+        switch strings.TrimSuffix(op, "\n") {
+        case "get=1":
+            if line, err := r.ReadString('\n'); err != nil || line != "\n" {
+                return
+            }
+            opErr = s.get(conn)
+        case "set=1":
+            opErr = s.set(r)
+        default:
+            return
+        }
+        
+        errno := 0
+        if opErr != nil {
+            var ue *uapiError
+            if !errors.As(opErr, &ue) {
+                ue = &uapiError{syscall.EIO, opErr}
+            }
+            errno = int(ue.errno)
+        }
+        if _, err := fmt.Fprintf(conn, "errno=%d\n\n", errno); err != nil {
+            return
+        }
+    }
+}
+
+const uapiIdleTimeout = time.Minute
+
+// Dump the device the way wireguard-go does
+func (s *UAPIServer) get(w io.Writer) error {
+    // The dump holds key material, keep it out of immutable strings
+    var b bytes.Buffer
+    defer func() { wipe(b.Bytes()) }()
+    s.dump(&b)
+    
+    _, err := w.Write(b.Bytes())
+    return err
+}
+
+func (s *UAPIServer) dump(b *bytes.Buffer) {
+    vpn := s.vpn
+    vpn.mu.RLock()
+    defer vpn.mu.RUnlock()
+    
+    if key := vpn.privateKey(); key != nil {
+        k := key.Key()
+        fmt.Fprintf(b, "private_key=%s\n", hex.EncodeToString(k[:]))
+        wipe(k[:])
+    }
+    fmt.Fprintf(b, "listen_port=%d\n", vpn.listenPort)
+    
+    peers := make([]*Peer, 0, vpn.peers.len())
+    for _, peer := range vpn.peers.list {
+        peers = append(peers, peer)
+    }
+    sort.Slice(peers, func(i, j int) bool {
+        return peers[i].PublicKey.String() < peers[j].PublicKey.String()
+    })
+    
+    for _, peer := range peers {
+        fmt.Fprintf(b, "public_key=%s\n", hex.EncodeToString(peer.PublicKey[:]))
+        if peer.PresharedKey != nil {
+            psk := peer.PresharedKey.Key()
+            fmt.Fprintf(b, "preshared_key=%s\n", hex.EncodeToString(psk[:]))
+            wipe(psk[:])
+        }
+        b.WriteString("protocol_version=1\n")
+        if peer.Endpoint != nil {
+            fmt.Fprintf(b, "endpoint=%s\n", peer.Endpoint.String())
+        }
+        var sec, nsec int64
+        if !peer.LastHandshake.IsZero() {
+            sec, nsec = peer.LastHandshake.Unix(), int64(peer.LastHandshake.Nanosecond())
+        }
+        fmt.Fprintf(b, "last_handshake_time_sec=%d\nlast_handshake_time_nsec=%d\n", sec, nsec)
+        fmt.Fprintf(b, "tx_bytes=%d\nrx_bytes=%d\n", peer.TxBytes.Load(), peer.RxBytes.Load())
+        fmt.Fprintf(b, "persistent_keepalive_interval=%d\n", int(peer.PersistentKeepalive/time.Second))
+        for _, allowedIP := range peer.AllowedIPs {
+            fmt.Fprintf(b, "allowed_ip=%s\n", allowedIP.String())
+        }
+    }
+}
+
+// uapiPeerOp collects the lines following one public_key in a set
+type uapiPeerOp struct {
+    key               wgtypes.Key
+    remove            bool
+    updateOnly        bool
+    replaceAllowedIPs bool
+    presharedKey      *Secret
+    endpoint          *net.UDPAddr
+    keepalive         *time.Duration
+    allowedIPs        []net.IPNet
+}
+
+type uapiSet struct {
+    listenPort   *int
+    replacePeers bool
+    peers        []*uapiPeerOp
+    ignored      []string
+}
+
+// Read a set transaction up to the blank line, then apply it. Nothing is
+// applied when a line is invalid.
+func (s *UAPIServer) set(r *bufio.Reader) error {
+    var tx uapiSet
+    var peer *uapiPeerOp
+    var parseErr error
+    
+    for {
+        line, err := r.ReadString('\n')
+        if err != nil {
+            return &uapiError{syscall.EIO, err}
+        }
+        line = strings.TrimSuffix(line, "\n")
+        if line == "" {
+            break
+        }
+        if parseErr != nil {
+            continue // drain the transaction before answering
+        }
+        
+        key, value, ok := strings.Cut(line, "=")
+        if !ok {
+            parseErr = &uapiError{syscall.EPROTO, fmt.Errorf("invalid line %q", line)}
+            continue
+        }
+        if key == "public_key" {
+            k, err := parseHexKey(value)
+            if err != nil {
+                parseErr = err
+                continue
+            }
+            peer = &uapiPeerOp{key: k}
+            tx.peers = append(tx.peers, peer)
+            continue
+        }
+        if peer == nil {
+            parseErr = tx.deviceKey(key, value)
+        } else {
+            parseErr = tx.peerKey(peer, key, value)
+        }
+    }
+    if parseErr != nil {
+        return parseErr
+    }
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.apply(&tx)
+}
+
+func (tx *uapiSet) deviceKey(key, value string) error {
+    switch key {
+    case "listen_port":
+        port, err := strconv.ParseUint(value, 10, 16)
+        if err != nil {
+            return uapiInvalid("invalid listen_port %q", value)
+        }
+        p := int(port)
+        tx.listenPort = &p
+    case "replace_peers":
+        if value != "true" {
+            return uapiInvalid("invalid replace_peers %q", value)
+        }
+        tx.replacePeers = true
+    default:
+        // private_key, fwmark: the device key only changes on restart
+        tx.ignored = append(tx.ignored, key)
+    }
+    return nil
+}
+
+func (tx *uapiSet) peerKey(peer *uapiPeerOp, key, value string) error {
+    switch key {
+    case "remove":
+        peer.remove = value == "true"
+    case "update_only":
+        peer.updateOnly = value == "true"
+    case "replace_allowed_ips":
+        peer.replaceAllowedIPs = value == "true"
+    case "preshared_key":
+        k, err := parseHexKey(value)
+        if err != nil {
+            return err
+        }
+        peer.presharedKey = SecretFromKey(k)
+        wipe(k[:])
+    case "endpoint":
+        endpoint, err := net.ResolveUDPAddr("udp", value)
+        if err != nil {
+            return uapiInvalid("invalid endpoint %q", value)
+        }
+        peer.endpoint = endpoint
+    case "persistent_keepalive_interval":
+        seconds, err := strconv.ParseUint(value, 10, 16)
+        if err != nil {
+            return uapiInvalid("invalid persistent_keepalive_interval %q", value)
+        }
+        interval := time.Duration(seconds) * time.Second
+        peer.keepalive = &interval
+    case "allowed_ip":
+        _, prefix, err := net.ParseCIDR(value)
+        if err != nil {
+            return uapiInvalid("invalid allowed_ip %q", value)
+        }
+        peer.allowedIPs = append(peer.allowedIPs, *prefix)
+    case "protocol_version":
+        if value != "1" {
+            return uapiInvalid("unsupported protocol_version %q", value)
+        }
+    default:
+        tx.ignored = append(tx.ignored, key)
+    }
+    return nil
+}
+
+func parseHexKey(value string) (wgtypes.Key, error) {
+    var key wgtypes.Key
+    b, err := hex.DecodeString(value)
+    if err != nil || len(b) != wgtypes.KeyLen {
+        return key, uapiInvalid("invalid key")
+    }
+    copy(key[:], b)
+    wipe(b)
+    return key, nil
+}
+
+func (s *UAPIServer) apply(tx *uapiSet) error {
+    vpn := s.vpn
+    for _, key := range tx.ignored {
+        vpn.emitEvent(Event{Type: EventUAPIIgnored, Message: fmt.Sprintf("unsupported UAPI field %s ignored", key)})
+    }
+    
+    if tx.listenPort != nil && *tx.listenPort != vpn.listenPort {
+        if err := vpn.SetListenPort(*tx.listenPort); err != nil {
+            return &uapiError{syscall.EADDRINUSE, err}
+        }
+    }
+    
+    if tx.replacePeers {
+        keep := make(map[wgtypes.Key]bool, len(tx.peers))
+        for _, op := range tx.peers {
+            keep[op.key] = !op.remove
+        }
+        for _, info := range vpn.ListPeers() {
+            if !keep[info.PublicKey] {
+                if err := vpn.RemovePeer(info.PublicKey); err != nil {
+                    return err
+                }
+            }
+        }
+    }
+    
+    for _, op := range tx.peers {
+        if err := s.applyPeer(op); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (s *UAPIServer) applyPeer(op *uapiPeerOp) error {
+    vpn := s.vpn
+    
+    vpn.mu.RLock()
+    current := vpn.peers.get(op.key)
+    exists := current != nil
+    var pc PeerConfig
+    if exists {
+        pc = current.config()
+    }
+    vpn.mu.RUnlock()
+    
+    switch {
+    case op.remove:
+        if !exists {
+            return nil
+        }
+        return vpn.RemovePeer(op.key)
+    case op.updateOnly && !exists:
+        return nil
+    }
+    
+    pc.PublicKey = op.key
+    if op.presharedKey != nil {
+        pc.PresharedKey = op.presharedKey
+    }
+    // Only probe when the endpoint changes, not for every allowed IP edit
+    pc.SkipProbe = exists
+    if op.endpoint != nil && (pc.Endpoint == nil || pc.Endpoint.String() != op.endpoint.String()) {
+        pc.Endpoint = op.endpoint
+        pc.EndpointHost = ""
+        pc.SkipProbe = false
+    }
+    if op.keepalive != nil {
+        pc.PersistentKeepalive = *op.keepalive
+    }
+    if op.replaceAllowedIPs {
+        pc.AllowedIPs = nil
+    }
+    pc.AllowedIPs = append(append([]net.IPNet(nil), pc.AllowedIPs...), op.allowedIPs...)
+    
+    if err := vpn.AddPeer(pc); err != nil {
+        var ue *uapiError
+        if errors.As(err, &ue) {
+            return err
+        }
+        return &uapiError{syscall.EINVAL, err}
+    }
+    return nil
+}
+
+// The configuration that would recreate peer. Caller holds vpn.mu.
+func (peer *Peer) config() PeerConfig {
+    return PeerConfig{
+        PublicKey:           peer.PublicKey,
+        PresharedKey:        peer.PresharedKey,
+        Endpoint:            peer.Endpoint,
+        EndpointHost:        peer.EndpointHost(),
+        AllowedIPs:          peer.claimedIPs(),
+        Priority:            peer.Priority,
+        AlternateEndpoints:  peer.AlternateEndpoints(),
+        Group:               peer.Group,
+        PortHopping:         peer.PortHopping(),
+        FlowSplitting:       peer.FlowSplitting,
+        StatsWebhook:        peer.StatsWebhook(),
+        TURNConfig:          peer.TURNConfig(),
+        PersistentKeepalive: peer.PersistentKeepalive,
+        Metadata:            peer.Metadata(),
+        Annotations:         peer.Annotations(),
+    }
+}
+
+// Serve the UAPI for our device at the standard path
+func (vpn *UnderTheRadarVPN) startUAPI() error {
+    if vpn.planning != nil {
+        vpn.planning.note(ChangeService, "serve the UAPI on %s", UAPISocketPath(vpn.deviceName))
+        return nil
+    }
+    server := NewUAPIServer(vpn, UAPISocketPath(vpn.deviceName))
+    if err := server.Start(); err != nil {
+        return err
+    }
+    
+    vpn.mu.Lock()
+    vpn.uapi = server
+    vpn.mu.Unlock()
+    return nil
+}
+
+func (vpn *UnderTheRadarVPN) stopUAPI() error {
+    vpn.mu.Lock()
+    server := vpn.uapi
+    vpn.uapi = nil
+    vpn.mu.Unlock()
+    
+    if server == nil {
+        return nil
+    }
+    return server.Close()
+}
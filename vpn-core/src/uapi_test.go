@@ -0,0 +1,167 @@
+package main
+
+import (
+    "bufio"
+    "encoding/hex"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func startTestUAPI(t *testing.T) (*UnderTheRadarVPN, *fakeWGClient, *UAPIServer) {
+    t.Helper()
+    wg := newFakeWGClient()
+    vpn := newTestVPN(t, wg)
+    vpn.keys.Put(deviceKeyName, SecretFromKey(mustKey(t)))
+    vpn.listenPort = 51820
+    
+    server := NewUAPIServer(vpn, filepath.Join(t.TempDir(), "utr0.sock"))
+    if err := server.Start(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { server.Close() })
+    return vpn, wg, server
+}
+
+// Send one UAPI request and return the response lines up to the blank line
+func uapiRequest(t *testing.T, path, request string) []string {
+    t.Helper()
+    conn, err := net.Dial("unix", path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    
+    if _, err := conn.Write([]byte(request)); err != nil {
+        t.Fatal(err)
+    }
+    var lines []string
+    r := bufio.NewReader(conn)
+    for {
+        line, err := r.ReadString('\n')
+        if err != nil {
+            t.Fatalf("reading response: %v after %q", err, lines)
+        }
+        if line == "\n" {
+            return lines
+        }
+        lines = append(lines, strings.TrimSuffix(line, "\n"))
+    }
+}
+
+func hasLine(lines []string, want string) bool {
+    for _, line := range lines {
+        if line == want {
+            return true
+        }
+    }
+    return false
+}
+
+func TestUAPIGetDumpsDevice(t *testing.T) {
+    vpn, _, server := startTestUAPI(t)
+    peer := PeerConfig{
+        PublicKey:           mustKey(t).PublicKey(),
+        Endpoint:            &net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 51820},
+        AllowedIPs:          []net.IPNet{mustCIDR(t, "10.7.0.0/24")},
+        PersistentKeepalive: 25 * time.Second,
+        SkipProbe:           true,
+    }
+    if err := vpn.AddPeer(peer); err != nil {
+        t.Fatal(err)
+    }
+    
+    lines := uapiRequest(t, server.path, "get=1\n\n")
+    private := vpn.privateKey().Key()
+    for _, want := range []string{
+        "private_key=" + hex.EncodeToString(private[:]),
+        "listen_port=51820",
+        "public_key=" + hex.EncodeToString(peer.PublicKey[:]),
+        "endpoint=203.0.113.5:51820",
+        "persistent_keepalive_interval=25",
+        "allowed_ip=10.7.0.0/24",
+        "errno=0",
+    } {
+        if !hasLine(lines, want) {
+            t.Errorf("missing %q in %q", want, lines)
+        }
+    }
+    if info, err := os.Stat(server.path); err != nil || info.Mode().Perm() != 0600 {
+        t.Fatalf("socket mode %v, %v", info.Mode(), err)
+    }
+}
+
+func TestUAPISetManagesPeers(t *testing.T) {
+    vpn, wg, server := startTestUAPI(t)
+    key := mustKey(t).PublicKey()
+    hexKey := hex.EncodeToString(key[:])
+    
+    lines := uapiRequest(t, server.path, "set=1\nfwmark=51820\npublic_key="+hexKey+
+        "\nallowed_ip=10.9.0.0/24\npersistent_keepalive_interval=15\nprotocol_version=1\n\n")
+    if !hasLine(lines, "errno=0") {
+        t.Fatalf("add: %q", lines)
+    }
+    peer := vpn.peers.get(key)
+    if peer == nil || len(peer.AllowedIPs) != 1 || peer.PersistentKeepalive != 15*time.Second || !wg.peerKeys("utr0")[key] {
+        t.Fatalf("peer not added through AddPeer: %+v", peer)
+    }
+    if ev := <-vpn.Events(); ev.Type != EventUAPIIgnored || !strings.Contains(ev.Message, "fwmark") {
+        t.Fatalf("event = %+v", ev)
+    }
+    
+    // Without replace_allowed_ips the prefixes add up
+    uapiRequest(t, server.path, "set=1\npublic_key="+hexKey+"\nallowed_ip=10.10.0.0/24\n\n")
+    if n := len(vpn.peers.get(key).AllowedIPs); n != 2 {
+        t.Fatalf("%d allowed IPs after update, want 2", n)
+    }
+    uapiRequest(t, server.path, "set=1\npublic_key="+hexKey+"\nreplace_allowed_ips=true\nallowed_ip=10.11.0.0/24\n\n")
+    if ips := vpn.peers.get(key).AllowedIPs; len(ips) != 1 || ips[0].String() != "10.11.0.0/24" {
+        t.Fatalf("allowed IPs after replace: %v", ips)
+    }
+    
+    lines = uapiRequest(t, server.path, "set=1\npublic_key="+hexKey+"\nremove=true\n\n")
+    if !hasLine(lines, "errno=0") || vpn.peers.len() != 0 || wg.peerKeys("utr0")[key] {
+        t.Fatalf("remove: %q, %d peers left", lines, vpn.peers.len())
+    }
+}
+
+func TestUAPISetRejectsInvalidTransaction(t *testing.T) {
+    vpn, wg, server := startTestUAPI(t)
+    key := mustKey(t).PublicKey()
+    
+    lines := uapiRequest(t, server.path, "set=1\npublic_key="+hex.EncodeToString(key[:])+
+        "\nallowed_ip=10.9.0.0/24\nallowed_ip=not-a-prefix\n\n")
+    if !hasLine(lines, "errno=22") {
+        t.Fatalf("response %q, want EINVAL", lines)
+    }
+    if vpn.peers.len() != 0 || len(wg.configs) != 0 {
+        t.Fatal("part of an invalid transaction was applied")
+    }
+    
+    // The connection protocol survives a failed set
+    if lines := uapiRequest(t, server.path, "get=1\n\n"); !hasLine(lines, "errno=0") {
+        t.Fatalf("get after failed set: %q", lines)
+    }
+}
+
+func TestUAPICloseRemovesSocket(t *testing.T) {
+    _, _, server := startTestUAPI(t)
+    
+    // An idle client must not hold up Close
+    conn, err := net.Dial("unix", server.path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    
+    if err := server.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := os.Stat(server.path); !os.IsNotExist(err) {
+        t.Fatalf("socket still present: %v", err)
+    }
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+    "crypto/ed25519"
+    "errors"
+    "fmt"
+    "net"
+    "net/url"
+    "path"
+    "strconv"
+    "strings"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Port assumed for peer endpoints given without one, as wg-quick does
+const defaultWireGuardPort = 51820
+
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// ConfigError lists every problem Validate found in a VPNConfig. It matches
+// ErrInvalidConfig and each of the problems with errors.Is.
+type ConfigError struct {
+    Problems []error
+}
+
+func (e *ConfigError) Error() string {
+    var b strings.Builder
+    fmt.Fprintf(&b, "%d problem(s) in configuration:", len(e.Problems))
+    for _, problem := range e.Problems {
+        b.WriteString("\n  ")
+        b.WriteString(problem.Error())
+    }
+    return b.String()
+}
+
+func (e *ConfigError) Unwrap() []error {
+    return append([]error{ErrInvalidConfig}, e.Problems...)
+}
+
+// configCheck collects what is wrong with a config instead of stopping at
+// the first problem
+type configCheck struct {
+    warnings []string
+    problems []error
+}
+
+func (c *configCheck) warn(format string, args ...any) {
+    c.warnings = append(c.warnings, fmt.Sprintf(format, args...))
+}
+
+func (c *configCheck) fail(err error) {
+    if err != nil {
+        c.problems = append(c.problems, err)
+    }
+}
+
+func (c *configCheck) failf(format string, args ...any) {
+    c.fail(fmt.Errorf(format, args...))
+}
+
+func (c *configCheck) err() error {
+    if len(c.problems) == 0 {
+        return nil
+    }
+    return &ConfigError{Problems: c.problems}
+}
+
+// Validate checks the whole config and normalizes it in place: country
+// codes are upper cased, DNS servers and prefixes put in canonical form and
+// endpoints without a port get 51820. Problems Start would fail on, or
+// trip over later, come back together in a *ConfigError; settings that
+// have no effect are returned as warnings.
+func (c *VPNConfig) Validate() ([]string, error) {
+    check := c.check()
+    return check.warnings, check.err()
+}
+
+func (c *VPNConfig) check() *configCheck {
+    check := &configCheck{}
+    c.copySlices()
+    
+    if c.ListenPort < 0 || c.ListenPort > 65535 {
+        check.failf("listen port %d out of range", c.ListenPort)
+    }
+    for _, port := range c.HopPorts {
+        if port <= 0 || port > 65535 {
+            check.failf("invalid hop port %d", port)
+        }
+    }
+    check.fail(validateListenPorts(*c))
+    check.fail(validateSocketConfig(*c))
+    
+    for i := range c.Addresses {
+        canonicalIPNet(&c.Addresses[i], false)
+    }
+    for i := range c.KillSwitchLAN {
+        canonicalIPNet(&c.KillSwitchLAN[i], false)
+    }
+    c.checkPeers(check)
+    c.checkKillSwitch(check)
+    c.checkFirewallBackend(check)
+    c.checkDNS(check)
+    
+    for _, app := range c.SplitTunnelApps {
+        if strings.TrimSpace(app) == "" {
+            check.failf("empty split tunnel app")
+            continue
+        }
+        if _, err := strconv.ParseUint(app, 10, 32); err == nil {
+            continue
+        }
+        if _, err := lookupUID(app); err != nil {
+            check.failf("split tunnel app %s: %w", app, err)
+        }
+    }
+    
+    if c.ObfuscationKeyRotation < 0 || c.ObfuscationKeyGrace < 0 {
+        check.failf("negative obfuscation key rotation or grace")
+    }
+    if c.ObfuscationKeyGrace > 0 && c.ObfuscationKeyRotation == 0 {
+        check.warn("ObfuscationKeyGrace has no effect without ObfuscationKeyRotation")
+    }
+    if c.TrafficShaping != nil {
+        check.fail(c.TrafficShaping.validate())
+    }
+    
+    for _, pattern := range c.EBPFInterfaces {
+        if _, err := path.Match(pattern, ""); err != nil {
+            check.failf("EBPFInterfaces pattern %q: %w", pattern, err)
+        }
+    }
+    
+    if c.ClampMSS && c.MSS != 0 && (c.MSS < minClampedMSS || c.MSS > 65535) {
+        check.failf("MSS %d out of range, at least %d", c.MSS, minClampedMSS)
+    }
+    if !c.ClampMSS && c.MSS != 0 {
+        check.warn("MSS has no effect without ClampMSS")
+    }
+    
+    for _, addr := range []string{c.Proxy.SOCKSAddr, c.Proxy.HTTPAddr} {
+        if addr == "" {
+            continue
+        }
+        if _, _, err := net.SplitHostPort(addr); err != nil {
+            check.failf("proxy address %q: %w", addr, err)
+        }
+    }
+    if (c.Proxy.Username != "") != (c.Proxy.Password != nil) {
+        check.warn("proxy authentication needs both Username and Password, it is off")
+    }
+    
+    if c.Webhook.URL != "" && !c.Webhook.enabled() {
+        check.warn("webhook URL set without a Secret, statistics are not posted")
+    }
+    if key := c.Coordination.SigningKey; key != nil && len(key) != ed25519.PublicKeySize {
+        check.failf("coordination signing key of %d bytes: %w", len(key), ErrKeyInvalid)
+    }
+    if addr := c.ServerStatus.ListenAddr; addr != "" {
+        if _, _, err := net.SplitHostPort(addr); err != nil {
+            check.failf("server status address %s: %w", addr, err)
+        }
+    }
+    return check
+}
+
+// Normalizing must not write through to slices the caller still holds
+func (c *VPNConfig) copySlices() {
+    c.Addresses = append([]net.IPNet(nil), c.Addresses...)
+    c.DNSServers = append([]string(nil), c.DNSServers...)
+    c.KillSwitchLAN = append([]net.IPNet(nil), c.KillSwitchLAN...)
+    c.Peers = append([]PeerConfig(nil), c.Peers...)
+    for i := range c.Peers {
+        peer := &c.Peers[i]
+        if peer.Endpoint != nil {
+            endpoint := *peer.Endpoint
+            peer.Endpoint = &endpoint
+        }
+        peer.AlternateEndpoints = append([]net.UDPAddr(nil), peer.AlternateEndpoints...)
+        peer.AllowedIPs = append([]net.IPNet(nil), peer.AllowedIPs...)
+    }
+}
+
+func (c *VPNConfig) checkPeers(check *configCheck) {
+    seen := make(map[wgtypes.Key]bool, len(c.Peers))
+    for i := range c.Peers {
+        peer := &c.Peers[i]
+        name := peer.PublicKey.String()
+        if peer.PublicKey == (wgtypes.Key{}) {
+            check.failf("peer %d has no public key", i+1)
+            name = strconv.Itoa(i + 1)
+        } else if seen[peer.PublicKey] {
+            check.failf("peer %s listed twice", name)
+        }
+        seen[peer.PublicKey] = true
+        
+        if peer.EndpointHost != "" {
+            if _, _, err := splitEndpointHost(peer.EndpointHost); err != nil {
+                check.failf("peer %s: %w", name, err)
+            }
+        }
+        if turn := peer.TURNConfig; turn != nil {
+            if peer.Endpoint == nil && peer.EndpointHost == "" {
+                check.failf("peer %s: TURN needs an endpoint to relay to", name)
+            }
+            if _, _, err := net.SplitHostPort(turn.Server); err != nil {
+                check.failf("peer %s: TURN server %q: %w", name, turn.Server, err)
+            }
+            if turn.Username == "" || turn.Password == nil {
+                check.failf("peer %s: TURN needs a username and password", name)
+            }
+        }
+        if peer.Endpoint != nil && peer.Endpoint.Port == 0 {
+            peer.Endpoint.Port = defaultWireGuardPort
+        }
+        for j := range peer.AlternateEndpoints {
+            if peer.AlternateEndpoints[j].Port == 0 {
+                peer.AlternateEndpoints[j].Port = defaultWireGuardPort
+            }
+        }
+        for j := range peer.AllowedIPs {
+            if canonicalIPNet(&peer.AllowedIPs[j], true) {
+                check.warn("peer %s: allowed IP has host bits set, using %s", name, peer.AllowedIPs[j].String())
+            }
+        }
+        if err := peer.PortHopping.validate(); err != nil {
+            check.failf("peer %s: %w", name, err)
+        }
+        if peer.PersistentKeepalive < 0 {
+            check.failf("peer %s: negative persistent keepalive", name)
+        }
+        if err := validateAnnotations(peer.Annotations); err != nil {
+            check.failf("peer %s: %w", name, err)
+        }
+        peer.Metadata.CountryCode = strings.ToUpper(strings.TrimSpace(peer.Metadata.CountryCode))
+        if code := peer.Metadata.CountryCode; code != "" && (len(code) != 2 || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "") {
+            check.failf("peer %s: country code %q is not ISO 3166-1 alpha-2", name, code)
+        }
+    }
+}
+
+func (c *VPNConfig) checkKillSwitch(check *configCheck) {
+    if c.KillSwitch {
+        return
+    }
+    if c.KillSwitchVRF != "" || c.KillSwitchContainers || len(c.ContainerExclusions) > 0 || c.KillSwitchAllowEstablished || c.KillSwitchFailClosed || len(c.KillSwitchLAN) > 0 {
+        check.warn("kill switch options set without KillSwitch")
+    }
+    if len(c.BypassProcesses) > 0 {
+        check.warn("BypassProcesses has no effect without KillSwitch")
+    }
+}
+
+// The nftables table has no VRF or container rules, and iptables no exit
+// NAT. Process bypass and captive portal rules would sit in iptables,
+// where they can't override a drop in the shared table.
+func (c *VPNConfig) checkFirewallBackend(check *configCheck) {
+    switch c.FirewallBackend {
+    case FirewallIPTables:
+        if c.ExitNAT {
+            check.failf("ExitNAT needs the nftables firewall backend")
+        }
+    case FirewallNFTables:
+        if c.KillSwitch && (c.KillSwitchVRF != "" || c.KillSwitchContainers || len(c.BypassProcesses) > 0) {
+            check.failf("KillSwitchVRF, KillSwitchContainers and BypassProcesses need the iptables firewall backend")
+        }
+        if c.KillSwitch && c.CaptivePortal.Enabled {
+            check.failf("CaptivePortal needs the iptables firewall backend")
+        }
+    default:
+        check.failf("unknown firewall backend %s", c.FirewallBackend)
+    }
+}
+
+func (c *VPNConfig) checkDNS(check *configCheck) {
+    for i, server := range c.DNSServers {
+        ip := net.ParseIP(strings.TrimSpace(server))
+        if ip == nil {
+            check.failf("DNS server %q is not an IP address", server)
+            continue
+        }
+        c.DNSServers[i] = ip.String()
+    }
+    for _, provider := range c.DoHProviders {
+        if u, err := url.Parse(provider); err != nil || u.Scheme != "https" || u.Host == "" {
+            check.failf("DoH provider %q is not an https URL", provider)
+        }
+    }
+    for host, ip := range c.BootstrapIPs {
+        if ip == nil {
+            check.failf("bootstrap address of %s missing", host)
+        }
+    }
+    if c.DNSListenAddr != "" {
+        if _, _, err := net.SplitHostPort(c.DNSListenAddr); err != nil {
+            check.failf("DNS listen address %q: %w", c.DNSListenAddr, err)
+        }
+    }
+    
+    if !c.DNSProtection {
+        if len(c.DNSSearchDomains) > 0 || c.DNSSplit {
+            check.warn("DNS settings have no effect without DNSProtection")
+        }
+        return
+    }
+    if len(c.DNSServers) == 0 {
+        check.failf("DNSProtection needs DNSServers")
+    }
+    if c.DNSSplit && len(c.DNSSearchDomains) == 0 {
+        check.warn("DNSSplit without DNSSearchDomains resolves nothing through the tunnel")
+    }
+}
+
+// Put n in canonical form: IPv4 in 4 bytes and, for a prefix, without host
+// bits. Reports whether host bits were cleared.
+func canonicalIPNet(n *net.IPNet, prefix bool) bool {
+    if ip4 := n.IP.To4(); ip4 != nil && len(n.Mask) == net.IPv4len {
+        n.IP = ip4
+    }
+    if !prefix || n.IP.Equal(n.IP.Mask(n.Mask)) {
+        return false
+    }
+    n.IP = n.IP.Mask(n.Mask)
+    return true
+}
+
+// ValidateConfigFile loads a wg-quick config as LoadConfig does and
+// validates it, for utrctl config validate
+func ValidateConfigFile(path string) ([]string, error) {
+    config, err := LoadConfig(path)
+    if err != nil {
+        return nil, err
+    }
+    return config.Validate()
+}
+
+// Validate config for Start, also against the VPN itself, and publish the
+// warnings as EventConfigWarning
+func (vpn *UnderTheRadarVPN) validateConfig(config *VPNConfig) error {
+    check := config.check()
+    if config.KillSwitch && vpn.deviceName == "" {
+        check.failf("KillSwitch needs a device name")
+    }
+    for _, warning := range check.warnings {
+        vpn.emitEvent(Event{Type: EventConfigWarning, Message: warning})
+    }
+    return check.err()
+}
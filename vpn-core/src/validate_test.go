@@ -0,0 +1,108 @@
+package main
+
+import (
+    "errors"
+    "net"
+    "strings"
+    "testing"
+)
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+    orig := lookupUID
+    lookupUID = func(name string) (uint32, error) { return 0, errors.New("unknown user") }
+    t.Cleanup(func() { lookupUID = orig })
+    
+    config := VPNConfig{
+        ListenPort:      70000,
+        DNSProtection:   true,
+        DNSServers:      []string{"1.1.1.1", "dns.example"},
+        SplitTunnelApps: []string{"nobody-here"},
+        EBPFInterfaces:  []string{"eth["},
+        Peers:           []PeerConfig{{}},
+    }
+    _, err := config.Validate()
+    
+    var configErr *ConfigError
+    if !errors.As(err, &configErr) || !errors.Is(err, ErrInvalidConfig) {
+        t.Fatalf("got %v", err)
+    }
+    if len(configErr.Problems) != 5 {
+        t.Fatalf("%d problems: %v", len(configErr.Problems), err)
+    }
+    for _, want := range []string{"listen port 70000", "dns.example", "nobody-here", "eth[", "no public key"} {
+        if !strings.Contains(err.Error(), want) {
+            t.Errorf("%q not reported in %v", want, err)
+        }
+    }
+    
+    if _, err := (&VPNConfig{DNSProtection: true}).Validate(); err == nil {
+        t.Fatal("DNS protection without servers accepted")
+    }
+}
+
+func TestValidateNormalizes(t *testing.T) {
+    key := mustKey(t).PublicKey()
+    endpoint := &net.UDPAddr{IP: net.ParseIP("203.0.113.1")}
+    servers := []string{" 2001:DB8::53 "}
+    config := VPNConfig{
+        DNSProtection: true,
+        DNSServers:    servers,
+        Peers: []PeerConfig{{
+            PublicKey:  key,
+            Endpoint:   endpoint,
+            AllowedIPs: []net.IPNet{mustCIDR(t, "10.0.0.0/24"), {IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(16, 32)}},
+            Metadata:   PeerMetadata{CountryCode: "de "},
+        }},
+        MSS: 1200,
+    }
+    
+    warnings, err := config.Validate()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(warnings) != 2 {
+        t.Fatalf("warnings %q", warnings)
+    }
+    
+    peer := config.Peers[0]
+    if peer.Metadata.CountryCode != "DE" || peer.Endpoint.Port != defaultWireGuardPort {
+        t.Fatalf("peer not normalized: %+v", peer)
+    }
+    if got := peer.AllowedIPs[1].String(); got != "10.1.0.0/16" || len(peer.AllowedIPs[1].IP) != net.IPv4len {
+        t.Fatalf("allowed IP %s", got)
+    }
+    if config.DNSServers[0] != "2001:db8::53" {
+        t.Fatalf("DNS server %q", config.DNSServers[0])
+    }
+    
+    // The caller's slices and endpoints are left alone
+    if endpoint.Port != 0 || servers[0] != " 2001:DB8::53 " {
+        t.Fatal("Validate wrote through to the caller's values")
+    }
+}
+
+func TestStartRefusesInvalidConfig(t *testing.T) {
+    host := installFakeHost(t, "")
+    vpn := newTestVPN(t, newFakeWGClient())
+    vpn.deviceName = ""
+    
+    err := vpn.Start(VPNConfig{ListenPort: -1, DNSProtection: true, KillSwitch: true})
+    var configErr *ConfigError
+    if !errors.As(err, &configErr) || len(configErr.Problems) != 3 {
+        t.Fatalf("Start gave %v", err)
+    }
+    if len(host.rules) != 0 || len(host.links) != 0 {
+        t.Fatalf("host changed: %v %v", host.rules, host.links)
+    }
+}
+
+func TestStartPublishesConfigWarnings(t *testing.T) {
+    vpn, _, _ := startForReload(t, VPNConfig{BypassProcesses: []string{"sshd"}})
+    
+    for len(vpn.Events()) > 0 {
+        if ev := <-vpn.Events(); ev.Type == EventConfigWarning && strings.Contains(ev.Message, "BypassProcesses") {
+            return
+        }
+    }
+    t.Fatal("no config warning published")
+}
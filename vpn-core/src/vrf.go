@@ -0,0 +1,88 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+const maxChainName = 28 // iptables limit
+
+// vrfMembers lists the interfaces enslaved to a VRF device.
+// Tests replace it to simulate VRFs.
+var vrfMembers = func(vrf string) ([]string, error) {
+    if _, err := os.Stat(filepath.Join("/sys/class/net", vrf)); err != nil {
+        return nil, fmt.Errorf("VRF %s not found: %w", vrf, err)
+    }
+    
+    lowers, err := filepath.Glob(filepath.Join("/sys/class/net", vrf, "lower_*"))
+    if err != nil {
+        return nil, err
+    }
+    
+    members := make([]string, 0, len(lowers))
+    for _, lower := range lowers {
+        members = append(members, strings.TrimPrefix(filepath.Base(lower), "lower_"))
+    }
+    return members, nil
+}
+
+// Chain holding the kill switch verdicts for one VRF
+func vrfChain(vrf string) string {
+    name := "UTR-KS-" + vrf
+    if len(name) > maxChainName {
+        name = name[:maxChainName]
+    }
+    return name
+}
+
+// Kill switch rules scoped to a VRF. Packets sent from a VRF leave through
+// one of its enslaved interfaces, so only those jump to our chain and the
+// other VRFs never hit a rule. The tunnel device must be a member so the
+// VRF's routing table can still reach it.
+func (ks *KillSwitch) vrfRules() ([]string, error) {
+    members, err := vrfMembers(ks.VRFName)
+    if err != nil {
+        return nil, err
+    }
+    
+    enslaved := false
+    for _, dev := range members {
+        if dev == ks.deviceName {
+            enslaved = true
+        }
+    }
+    if !enslaved {
+        return nil, fmt.Errorf("device %s is not enslaved to VRF %s", ks.deviceName, ks.VRFName)
+    }
+    
+    chain := vrfChain(ks.VRFName)
+    var rules []string
+    for _, ipt := range []string{"iptables", "ip6tables"} {
+        rules = append(rules, fmt.Sprintf("%s -N %s", ipt, chain))
+        if ipt == "iptables" {
+            rules = append(rules, fmt.Sprintf("iptables -A %s -m owner --uid-owner 0 -j ACCEPT", chain)) // Allow root
+        }
+        if rule := ks.encapRule(ipt, chain); rule != "" {
+            rules = append(rules, rule)
+        }
+        if rule := ks.bypassRule(ipt, chain); rule != "" {
+            rules = append(rules, rule)
+        }
+        if rule := ks.establishedRule(ipt, chain); rule != "" {
+            rules = append(rules, rule)
+        }
+        rules = append(rules, fmt.Sprintf("%s -A %s -j DROP", ipt, chain))
+    }
+    
+    for _, ipt := range []string{"iptables", "ip6tables"} {
+        for _, dev := range members {
+            if dev == ks.deviceName {
+                continue
+            }
+            rules = append(rules, fmt.Sprintf("%s -A OUTPUT -o %s -j %s", ipt, dev, chain))
+        }
+    }
+    return rules, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+)
+
+// Two tenants: blue routes through utr0, red through its own tunnel utr1
+func fakeVRFs(t *testing.T) {
+    vrfs := map[string][]string{
+        "blue": {"eth1", "utr0"},
+        "red":  {"eth2", "utr1"},
+    }
+    
+    orig := vrfMembers
+    vrfMembers = func(vrf string) ([]string, error) {
+        members, ok := vrfs[vrf]
+        if !ok {
+            return nil, fmt.Errorf("VRF %s not found", vrf)
+        }
+        return members, nil
+    }
+    t.Cleanup(func() { vrfMembers = orig })
+}
+
+// Whether traffic leaving through dev hits a kill switch chain
+func (h *fakeHost) blocks(dev string) bool {
+    for rule := range h.rules {
+        if strings.Contains(rule, "OUTPUT -o "+dev+" ") || rule == "iptables OUTPUT -j DROP" {
+            return true
+        }
+    }
+    return false
+}
+
+func TestKillSwitchVRFIsolation(t *testing.T) {
+    host := installFakeHost(t, "")
+    fakeVRFs(t)
+    
+    blue := NewKillSwitch("utr0")
+    blue.VRFName = "blue"
+    if err := blue.Enable(); err != nil {
+        t.Fatal(err)
+    }
+    
+    if !host.blocks("eth1") {
+        t.Error("blue kill switch should block eth1")
+    }
+    if host.blocks("utr0") || host.blocks("eth2") || host.blocks("utr1") {
+        t.Error("blue kill switch leaked outside its VRF")
+    }
+    for rule := range host.rules {
+        if strings.Contains(rule, "red") || strings.Contains(rule, "eth2") {
+            t.Errorf("unexpected rule for red VRF: %s", rule)
+        }
+    }
+    
+    red := NewKillSwitch("utr1")
+    red.VRFName = "red"
+    if err := red.Enable(); err != nil {
+        t.Fatal(err)
+    }
+    if !host.blocks("eth2") {
+        t.Error("red kill switch should block eth2")
+    }
+    
+    // Turning blue off must leave red fully in place
+    redRules := len(red.rules) - 2 // chain creations are tracked separately
+    if err := blue.Disable(); err != nil {
+        t.Fatal(err)
+    }
+    if host.blocks("eth1") {
+        t.Error("blue rules left behind after Disable")
+    }
+    if !host.blocks("eth2") || len(host.rules) != redRules {
+        t.Errorf("red rules disturbed: %v", host.rules)
+    }
+    if host.chains["iptables UTR-KS-blue"] || !host.chains["iptables UTR-KS-red"] {
+        t.Errorf("unexpected chains: %v", host.chains)
+    }
+}
+
+func TestKillSwitchVRFRequiresEnslavedDevice(t *testing.T) {
+    host := installFakeHost(t, "")
+    fakeVRFs(t)
+    
+    ks := NewKillSwitch("utr0")
+    ks.VRFName = "red"
+    if err := ks.Enable(); err == nil {
+        t.Fatal("expected error for device outside the VRF")
+    }
+    if len(host.rules) != 0 || len(host.chains) != 0 {
+        t.Errorf("rules applied despite error: %v %v", host.rules, host.chains)
+    }
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+)
+
+const (
+    DefaultWebhookInterval   = time.Minute
+    DefaultWebhookBatchSize  = 100
+    DefaultWebhookMaxRetries = 5
+    DefaultWebhookBackoff    = time.Second
+    
+    // Hex HMAC-SHA256 of the body keyed with WebhookConfig.Secret
+    WebhookSignatureHeader = "X-UTR-Signature"
+)
+
+var errWebhookStopped = errors.New("webhook reporter stopped")
+
+// WebhookConfig posts peer statistics as JSON to monitoring. Peers are
+// grouped by their PeerConfig.StatsWebhook, falling back to URL, and sent
+// BatchSize at a time. Every request carries the HMAC-SHA256 of its body in
+// X-UTR-Signature as "sha256=<hex>" so the receiver can authenticate it.
+type WebhookConfig struct {
+    URL        string        // for peers without their own, empty skips them
+    Secret     *Secret       // HMAC key, reporting is off without one
+    Interval   time.Duration // default DefaultWebhookInterval
+    BatchSize  int           // peers per request, default DefaultWebhookBatchSize
+    MaxRetries int           // per request, after network errors, 429 and 5xx
+    MinBackoff time.Duration // first retry delay, doubled each retry
+}
+
+func (c WebhookConfig) enabled() bool {
+    return c.Secret != nil
+}
+
+func (c WebhookConfig) equal(other WebhookConfig) bool {
+    secret := c.Secret.Equal(other.Secret)
+    c.Secret, other.Secret = nil, nil
+    return secret && c == other
+}
+
+func (c WebhookConfig) withDefaults() WebhookConfig {
+    if c.Interval <= 0 {
+        c.Interval = DefaultWebhookInterval
+    }
+    if c.BatchSize <= 0 {
+        c.BatchSize = DefaultWebhookBatchSize
+    }
+    if c.MaxRetries <= 0 {
+        c.MaxRetries = DefaultWebhookMaxRetries
+    }
+    if c.MinBackoff <= 0 {
+        c.MinBackoff = DefaultWebhookBackoff
+    }
+    return c
+}
+
+// WebhookReport is the JSON body of one request
+type WebhookReport struct {
+    Device  string              `json:"device"`
+    SentAt  time.Time           `json:"sent_at"`
+    Batch   int                 `json:"batch"` // 1-based, of Batches for this URL
+    Batches int                 `json:"batches"`
+    Peers   []WebhookPeerStats  `json:"peers"`
+}
+
+// WebhookPeerStats is one peer in a WebhookReport
+type WebhookPeerStats struct {
+    PublicKey   string  `json:"public_key"`
+    Endpoint    string  `json:"endpoint,omitempty"`
+    Group       string  `json:"group,omitempty"`
+    Alive       bool    `json:"alive"`
+    LatencyMs   float64 `json:"latency_ms"`
+    PacketLoss  float64 `json:"packet_loss_percent"`
+    LoadScore   uint64  `json:"load_score"`
+    RxBytes     uint64  `json:"rx_bytes"`
+    TxBytes     uint64  `json:"tx_bytes"`
+    Annotations map[string]string `json:"annotations,omitempty"` // for billing to join on a customer ID
+}
+
+// WebhookReporter posts peer statistics every Interval until Stop
+type WebhookReporter struct {
+    vpn    *UnderTheRadarVPN
+    cfg    WebhookConfig
+    client *http.Client
+    
+    stop     chan struct{}
+    stopOnce sync.Once
+}
+
+func NewWebhookReporter(vpn *UnderTheRadarVPN, cfg WebhookConfig) *WebhookReporter {
+    return &WebhookReporter{
+        vpn:    vpn,
+        cfg:    cfg.withDefaults(),
+        client: &http.Client{Timeout: 10 * time.Second},
+        stop:   make(chan struct{}),
+    }
+}
+
+func (r *WebhookReporter) Start() {
+    ticker := r.vpn.clock().NewTicker(r.cfg.Interval)
+    defer ticker.Stop()
+    
+    // Stop cancels the request in flight too
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go func() {
+        select {
+        case <-r.stop:
+            cancel()
+        case <-ctx.Done():
+        }
+    }()
+    
+    for {
+        select {
+        case <-ticker.C():
+            if err := r.ReportContext(ctx); err != nil && !errors.Is(err, errWebhookStopped) && ctx.Err() == nil {
+                r.vpn.emitEvent(Event{Type: EventWebhookFailed, Message: err.Error()})
+            }
+        case <-r.stop:
+            return
+        }
+    }
+}
+
+// Stop ends reporting, abandoning retries in progress
+func (r *WebhookReporter) Stop() {
+    r.stopOnce.Do(func() { close(r.stop) })
+}
+
+func (vpn *UnderTheRadarVPN) startWebhook(cfg WebhookConfig) {
+    r := NewWebhookReporter(vpn, cfg)
+    vpn.mu.Lock()
+    vpn.webhook = r
+    vpn.mu.Unlock()
+    go r.Start()
+}
+
+func (vpn *UnderTheRadarVPN) stopWebhook() {
+    vpn.mu.Lock()
+    r := vpn.webhook
+    vpn.webhook = nil
+    vpn.mu.Unlock()
+    
+    if r != nil {
+        r.Stop()
+    }
+}
+
+// Report sends every peer's statistics once
+func (r *WebhookReporter) Report() error {
+    return r.ReportContext(context.Background())
+}
+
+// ReportContext is Report giving up once ctx is done, retries included
+func (r *WebhookReporter) ReportContext(ctx context.Context) error {
+    var errs []error
+    for url, peers := range r.collect() {
+        batches := (len(peers) + r.cfg.BatchSize - 1) / r.cfg.BatchSize
+        for i := 0; i < batches; i++ {
+            if ctx.Err() != nil {
+                return errors.Join(append(errs, ctx.Err())...)
+            }
+            end := (i + 1) * r.cfg.BatchSize
+            if end > len(peers) {
+                end = len(peers)
+            }
+            report := WebhookReport{
+                Device:  r.vpn.deviceName,
+                SentAt:  r.vpn.clock().Now().UTC(),
+                Batch:   i + 1,
+                Batches: batches,
+                Peers:   peers[i*r.cfg.BatchSize : end],
+            }
+            if err := r.send(ctx, url, report); err != nil {
+                errs = append(errs, err)
+            }
+        }
+    }
+    return errors.Join(errs...)
+}
+
+// Peer statistics by the URL they go to, ordered by public key
+func (r *WebhookReporter) collect() map[string][]WebhookPeerStats {
+    r.vpn.mu.RLock()
+    defer r.vpn.mu.RUnlock()
+    
+    byURL := make(map[string][]WebhookPeerStats)
+    for _, peer := range r.vpn.peers.list {
+        url := peer.StatsWebhook()
+        if url == "" {
+            url = r.cfg.URL
+        }
+        if url == "" {
+            continue
+        }
+        
+        stats := WebhookPeerStats{
+            PublicKey:   peer.PublicKey.String(),
+            Group:       peer.Group,
+            Alive:       peer.IsAlive.Load(),
+            LatencyMs:   float64(peer.CurrentLatency.Load()) / 1000,
+            PacketLoss:  float64(peer.PacketLoss.Load()) / 100,
+            LoadScore:   peer.LoadScore.Load(),
+            RxBytes:     peer.RxBytes.Load(),
+            TxBytes:     peer.TxBytes.Load(),
+            Annotations: peer.Annotations(),
+        }
+        if peer.Endpoint != nil {
+            stats.Endpoint = peer.Endpoint.String()
+        }
+        byURL[url] = append(byURL[url], stats)
+    }
+    for _, peers := range byURL {
+        sort.Slice(peers, func(i, j int) bool { return peers[i].PublicKey < peers[j].PublicKey })
+    }
+    return byURL
+}
+
+// POST one report, retrying with exponential backoff
+func (r *WebhookReporter) send(ctx context.Context, url string, report WebhookReport) error {
+    body, err := json.Marshal(report)
+    if err != nil {
+        return fmt.Errorf("failed to encode webhook report: %w", err)
+    }
+    signature := "sha256=" + signWebhook(r.cfg.Secret, body)
+    
+    backoff := r.cfg.MinBackoff
+    for attempt := 0; ; attempt++ {
+        retry, err := r.post(ctx, url, body, signature)
+        if err == nil {
+            return nil
+        }
+        if !retry || attempt == r.cfg.MaxRetries {
+            return fmt.Errorf("failed to post peer stats to %s: %w", url, err)
+        }
+        
+        select {
+        case <-r.vpn.clock().After(backoff):
+            backoff *= 2
+        case <-r.stop:
+            return errWebhookStopped
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+}
+
+// retry reports whether the failure may be temporary
+func (r *WebhookReporter) post(ctx context.Context, url string, body []byte, signature string) (retry bool, err error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+    if err != nil {
+        return false, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set(WebhookSignatureHeader, signature)
+    
+    resp, err := r.client.Do(req)
+    if err != nil {
+        return true, err
+    }
+    resp.Body.Close()
+    
+    switch {
+    case resp.StatusCode >= 200 && resp.StatusCode < 300:
+        return false, nil
+    case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+        return true, fmt.Errorf("server error: %s", resp.Status)
+    default:
+        return false, fmt.Errorf("unexpected status: %s", resp.Status)
+    }
+}
+
+// Hex HMAC-SHA256 of body, as sent in X-UTR-Signature
+func signWebhook(secret *Secret, body []byte) string {
+    mac := hmac.New(sha256.New, secret.Bytes())
+    mac.Write(body)
+    return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// webhookReceiver verifies signatures like a monitoring endpoint would
+type webhookReceiver struct {
+    secret  []byte
+    mu      sync.Mutex
+    reports []WebhookReport
+    bad     int
+}
+
+func (w *webhookReceiver) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+    body, _ := io.ReadAll(r.Body)
+    mac := hmac.New(sha256.New, w.secret)
+    mac.Write(body)
+    want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+    
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if !hmac.Equal([]byte(r.Header.Get(WebhookSignatureHeader)), []byte(want)) || r.Header.Get("Content-Type") != "application/json" {
+        w.bad++
+        rw.WriteHeader(http.StatusUnauthorized)
+        return
+    }
+    var report WebhookReport
+    if err := json.Unmarshal(body, &report); err != nil {
+        w.bad++
+        rw.WriteHeader(http.StatusBadRequest)
+        return
+    }
+    w.reports = append(w.reports, report)
+}
+
+func addStatsPeer(t *testing.T, vpn *UnderTheRadarVPN, webhook string, rx uint64) *Peer {
+    t.Helper()
+    peer := &Peer{PublicKey: mustKey(t).PublicKey()}
+    peer.setExtras(PeerConfig{StatsWebhook: webhook})
+    peer.RxBytes.Store(rx)
+    peer.CurrentLatency.Store(12500)
+    peer.IsAlive.Store(true)
+    vpn.peers.put(peer)
+    return peer
+}
+
+func TestWebhookReporterSignsAndBatches(t *testing.T) {
+    secret := []byte("shared-secret")
+    shared := &webhookReceiver{secret: secret}
+    own := &webhookReceiver{secret: secret}
+    sharedServer := httptest.NewServer(shared)
+    defer sharedServer.Close()
+    ownServer := httptest.NewServer(own)
+    defer ownServer.Close()
+    
+    vpn := newTestVPN(t, newFakeWGClient())
+    for i := 0; i < 5; i++ {
+        addStatsPeer(t, vpn, "", uint64(i))
+    }
+    special := addStatsPeer(t, vpn, ownServer.URL, 4096)
+    
+    r := NewWebhookReporter(vpn, WebhookConfig{URL: sharedServer.URL, Secret: NewSecret(secret), BatchSize: 2})
+    if err := r.Report(); err != nil {
+        t.Fatal(err)
+    }
+    
+    // Five peers in batches of two
+    if shared.bad != 0 || len(shared.reports) != 3 {
+        t.Fatalf("shared endpoint got %d reports, %d rejected", len(shared.reports), shared.bad)
+    }
+    seen := make(map[string]bool)
+    for _, report := range shared.reports {
+        if report.Device != "utr0" || report.Batches != 3 || len(report.Peers) > 2 || report.SentAt.IsZero() {
+            t.Fatalf("report %+v", report)
+        }
+        for _, p := range report.Peers {
+            seen[p.PublicKey] = true
+        }
+    }
+    if len(seen) != 5 || seen[special.PublicKey.String()] {
+        t.Fatalf("shared endpoint saw %d peers", len(seen))
+    }
+    
+    // The peer with its own webhook goes there, alone
+    if own.bad != 0 || len(own.reports) != 1 || len(own.reports[0].Peers) != 1 {
+        t.Fatalf("peer webhook got %+v", own.reports)
+    }
+    got := own.reports[0].Peers[0]
+    if got.PublicKey != special.PublicKey.String() || got.RxBytes != 4096 || got.LatencyMs != 12.5 || !got.Alive {
+        t.Fatalf("peer stats %+v", got)
+    }
+}
+
+func TestWebhookReporterRetriesWithBackoff(t *testing.T) {
+    clock := NewFakeClock(time.Now())
+    var attempts atomic.Int32
+    var times []time.Time
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        times = append(times, clock.Now())
+        if attempts.Add(1) < 3 {
+            w.WriteHeader(http.StatusServiceUnavailable)
+        }
+    }))
+    defer server.Close()
+    
+    vpn := newTestVPN(t, newFakeWGClient())
+    vpn.timeSource = clock
+    addStatsPeer(t, vpn, server.URL, 1)
+    r := NewWebhookReporter(vpn, WebhookConfig{Secret: NewSecret([]byte("k")), MinBackoff: time.Minute})
+    
+    result := make(chan error, 1)
+    go func() { result <- r.Report() }()
+    var err error
+    advanceUntil(t, clock, time.Minute, func() bool {
+        select {
+        case err = <-result:
+            return true
+        default:
+            return false
+        }
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if attempts.Load() != 3 {
+        t.Fatalf("%d attempts, want 3", attempts.Load())
+    }
+    if first, second := times[1].Sub(times[0]), times[2].Sub(times[1]); first < time.Minute || second < 2*time.Minute {
+        t.Fatalf("retry delays %v, %v, want doubling from a minute", first, second)
+    }
+}
+
+func TestWebhookReporterGivesUp(t *testing.T) {
+    var attempts atomic.Int32
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        attempts.Add(1)
+        w.WriteHeader(http.StatusForbidden)
+    }))
+    defer server.Close()
+    
+    vpn := newTestVPN(t, newFakeWGClient())
+    addStatsPeer(t, vpn, server.URL, 1)
+    r := NewWebhookReporter(vpn, WebhookConfig{Secret: NewSecret([]byte("k")), MinBackoff: time.Millisecond})
+    
+    // A rejected request is not retried
+    err := r.Report()
+    if err == nil || !strings.Contains(err.Error(), "403") || attempts.Load() != 1 {
+        t.Fatalf("err %v after %d attempts", err, attempts.Load())
+    }
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var ErrBadWGQuickConfig = errors.New("malformed wg-quick config")
+
+// wg-quick settings that only its own scripts act on, skipped on import
+var wgQuickOnlyKeys = map[string]bool{
+    "mtu": true, "table": true, "saveconfig": true, "fwmark": true,
+    "preup": true, "postup": true, "predown": true, "postdown": true,
+}
+
+// ExportWGQuickConfig writes the interface and every peer in wg-quick .conf
+// format, for debugging with wg and wg-quick. The private key is left out,
+// see ExportWGQuickConfigWithPrivateKey.
+func (vpn *UnderTheRadarVPN) ExportWGQuickConfig(w io.Writer) error {
+    return vpn.exportWGQuick(w, false)
+}
+
+// ExportWGQuickConfigWithPrivateKey is ExportWGQuickConfig including the
+// private key, giving a config wg-quick can bring up. Protect the output
+// like the key itself.
+func (vpn *UnderTheRadarVPN) ExportWGQuickConfigWithPrivateKey(w io.Writer) error {
+    return vpn.exportWGQuick(w, true)
+}
+
+func (vpn *UnderTheRadarVPN) exportWGQuick(w io.Writer, withPrivateKey bool) error {
+    vpn.mu.RLock()
+    config := VPNConfig{
+        PrivateKey: vpn.privateKey(),
+        ListenPort: vpn.listenPort,
+        Addresses:  vpn.config.Addresses,
+    }
+    if vpn.config.DNSProtection {
+        config.DNSServers = vpn.config.DNSServers
+    }
+    for _, peer := range vpn.peers.list {
+        config.Peers = append(config.Peers, PeerConfig{
+            PublicKey:           peer.PublicKey,
+            PresharedKey:        peer.PresharedKey,
+            Endpoint:            peer.Endpoint,
+            EndpointHost:        peer.EndpointHost(),
+            AllowedIPs:          peer.AllowedIPs,
+            PersistentKeepalive: peer.PersistentKeepalive,
+        })
+    }
+    vpn.mu.RUnlock()
+    
+    // A buffer rather than a string so the key can be wiped afterwards
+    var b bytes.Buffer
+    defer func() { wipe(b.Bytes()) }()
+    writeWGQuickConfig(&b, &config, withPrivateKey)
+    if _, err := w.Write(b.Bytes()); err != nil {
+        return fmt.Errorf("failed to write config: %w", err)
+    }
+    return nil
+}
+
+// Format config as a wg-quick .conf, peers sorted by public key so the
+// output can be diffed. ListenPort is left out when zero.
+func writeWGQuickConfig(b *bytes.Buffer, config *VPNConfig, withPrivateKey bool) {
+    peers := append([]PeerConfig(nil), config.Peers...)
+    sort.Slice(peers, func(i, j int) bool {
+        return peers[i].PublicKey.String() < peers[j].PublicKey.String()
+    })
+    
+    b.WriteString("[Interface]\n")
+    if key := config.PrivateKey; key == nil {
+        b.WriteString("# PrivateKey = (none)\n")
+    } else if withPrivateKey {
+        fmt.Fprintf(b, "PrivateKey = %s\n", key.Key().String())
+    } else {
+        fmt.Fprintf(b, "# PrivateKey = (redacted, public key %s)\n", key.PublicKey().String())
+    }
+    if len(config.Addresses) > 0 {
+        fmt.Fprintf(b, "Address = %s\n", joinPrefixes(config.Addresses))
+    }
+    if config.ListenPort > 0 {
+        fmt.Fprintf(b, "ListenPort = %d\n", config.ListenPort)
+    }
+    if len(config.DNSServers) > 0 {
+        fmt.Fprintf(b, "DNS = %s\n", strings.Join(config.DNSServers, ", "))
+    }
+    
+    for _, peer := range peers {
+        b.WriteString("\n[Peer]\n")
+        fmt.Fprintf(b, "PublicKey = %s\n", peer.PublicKey.String())
+        if peer.PresharedKey != nil {
+            fmt.Fprintf(b, "PresharedKey = %s\n", peer.PresharedKey.Key().String())
+        }
+        if peer.EndpointHost != "" {
+            fmt.Fprintf(b, "Endpoint = %s\n", peer.EndpointHost)
+        } else if peer.Endpoint != nil {
+            fmt.Fprintf(b, "Endpoint = %s\n", peer.Endpoint.String())
+        }
+        if len(peer.AllowedIPs) > 0 {
+            fmt.Fprintf(b, "AllowedIPs = %s\n", joinPrefixes(peer.AllowedIPs))
+        }
+        if peer.PersistentKeepalive > 0 {
+            fmt.Fprintf(b, "PersistentKeepalive = %d\n", int(peer.PersistentKeepalive/time.Second))
+        }
+    }
+}
+
+func joinPrefixes(prefixes []net.IPNet) string {
+    parts := make([]string, len(prefixes))
+    for i, prefix := range prefixes {
+        parts[i] = prefix.String()
+    }
+    return strings.Join(parts, ", ")
+}
+
+// LoadConfig reads the wg-quick .conf at path, see ImportWGQuickConfig
+func LoadConfig(path string) (VPNConfig, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return VPNConfig{}, fmt.Errorf("failed to open config: %w", err)
+    }
+    defer f.Close()
+    
+    config, _, err := ImportWGQuickConfig(f)
+    return config, err
+}
+
+// ImportWGQuickConfig reads a wg-quick .conf into a VPNConfig. The peers are
+// set in VPNConfig.Peers and also returned on their own, for AddPeer on a
+// running VPN. wg-quick's hooks and routing settings are ignored.
+//
+// PrivateKey and PresharedKey may be references instead of inline keys,
+// env:NAME or file:PATH, resolved as the config is read; see ResolveSecret.
+func ImportWGQuickConfig(r io.Reader) (VPNConfig, []PeerConfig, error) {
+    return importWGQuick(r, ResolveSecret)
+}
+
+// Keys are read with resolve, which decides whether references are allowed
+func importWGQuick(r io.Reader, resolve func(string) (*Secret, error)) (VPNConfig, []PeerConfig, error) {
+    var config VPNConfig
+    var peers []PeerConfig
+    var peer *PeerConfig
+    section := ""
+    
+    scanner := bufio.NewScanner(r)
+    for lineNo := 1; scanner.Scan(); lineNo++ {
+        line := scanner.Text()
+        if i := strings.IndexByte(line, '#'); i >= 0 {
+            line = line[:i]
+        }
+        line = strings.TrimSpace(line)
+        if line == "" {
+            continue
+        }
+        
+        if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+            section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+            switch section {
+            case "interface":
+            case "peer":
+                peers = append(peers, PeerConfig{})
+                peer = &peers[len(peers)-1]
+            default:
+                return VPNConfig{}, nil, fmt.Errorf("%w: line %d: unknown section %s", ErrBadWGQuickConfig, lineNo, line)
+            }
+            continue
+        }
+        
+        key, value, ok := strings.Cut(line, "=")
+        if !ok {
+            return VPNConfig{}, nil, fmt.Errorf("%w: line %d: expected key = value", ErrBadWGQuickConfig, lineNo)
+        }
+        key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+        
+        var err error
+        switch section {
+        case "interface":
+            err = parseWGQuickInterface(&config, key, value, resolve)
+        case "peer":
+            err = parseWGQuickPeer(peer, key, value, resolve)
+        default:
+            err = fmt.Errorf("%s outside a section", key)
+        }
+        if err != nil {
+            return VPNConfig{}, nil, fmt.Errorf("%w: line %d: %w", ErrBadWGQuickConfig, lineNo, err)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return VPNConfig{}, nil, fmt.Errorf("failed to read config: %w", err)
+    }
+    
+    var zero wgtypes.Key
+    for i, p := range peers {
+        if p.PublicKey == zero {
+            return VPNConfig{}, nil, fmt.Errorf("%w: peer %d has no PublicKey", ErrBadWGQuickConfig, i+1)
+        }
+    }
+    
+    config.Peers = peers
+    return config, peers, nil
+}
+
+func parseWGQuickInterface(config *VPNConfig, key, value string, resolve func(string) (*Secret, error)) error {
+    switch key {
+    case "privatekey":
+        secret, err := resolve(value)
+        if err != nil {
+            return fmt.Errorf("PrivateKey: %w", err)
+        }
+        config.PrivateKey = secret
+    case "address":
+        prefixes, err := parsePrefixList(value)
+        if err != nil {
+            return err
+        }
+        config.Addresses = append(config.Addresses, prefixes...)
+    case "listenport":
+        port, err := strconv.Atoi(value)
+        if err != nil || port < 0 || port > 65535 {
+            return fmt.Errorf("invalid ListenPort %q", value)
+        }
+        config.ListenPort = port
+    case "dns":
+        for _, server := range strings.Split(value, ",") {
+            if server = strings.TrimSpace(server); server != "" {
+                config.DNSServers = append(config.DNSServers, server)
+            }
+        }
+        config.DNSProtection = len(config.DNSServers) > 0
+    default:
+        if !wgQuickOnlyKeys[key] {
+            return fmt.Errorf("unknown Interface key %s", key)
+        }
+    }
+    return nil
+}
+
+func parseWGQuickPeer(peer *PeerConfig, key, value string, resolve func(string) (*Secret, error)) error {
+    switch key {
+    case "publickey":
+        k, err := wgtypes.ParseKey(value)
+        if err != nil {
+            return fmt.Errorf("%w: PublicKey", ErrKeyInvalid)
+        }
+        peer.PublicKey = k
+    case "presharedkey":
+        secret, err := resolve(value)
+        if err != nil {
+            return fmt.Errorf("PresharedKey: %w", err)
+        }
+        peer.PresharedKey = secret
+    case "endpoint":
+        // Hostnames are resolved by AddPeer and followed as they move
+        if host, _, err := splitEndpointHost(value); err == nil && net.ParseIP(host) == nil {
+            peer.EndpointHost = value
+            return nil
+        }
+        endpoint, err := net.ResolveUDPAddr("udp", value)
+        if err != nil {
+            return fmt.Errorf("invalid Endpoint %q: %v", value, err)
+        }
+        peer.Endpoint = endpoint
+    case "allowedips":
+        prefixes, err := parsePrefixList(value)
+        if err != nil {
+            return err
+        }
+        for _, prefix := range prefixes {
+            prefix.IP = prefix.IP.Mask(prefix.Mask)
+            peer.AllowedIPs = append(peer.AllowedIPs, prefix)
+        }
+    case "persistentkeepalive":
+        if strings.EqualFold(value, "off") {
+            peer.PersistentKeepalive = 0
+            return nil
+        }
+        seconds, err := strconv.Atoi(value)
+        if err != nil || seconds < 0 || seconds > 65535 {
+            return fmt.Errorf("invalid PersistentKeepalive %q", value)
+        }
+        peer.PersistentKeepalive = time.Duration(seconds) * time.Second
+    default:
+        return fmt.Errorf("unknown Peer key %s", key)
+    }
+    return nil
+}
+
+// Comma separated CIDRs, a bare address is a host prefix
+func parsePrefixList(value string) ([]net.IPNet, error) {
+    var prefixes []net.IPNet
+    for _, field := range strings.Split(value, ",") {
+        field = strings.TrimSpace(field)
+        if field == "" {
+            continue
+        }
+        if !strings.Contains(field, "/") {
+            ip := net.ParseIP(field)
+            if ip == nil {
+                return nil, fmt.Errorf("invalid address %q", field)
+            }
+            bits := 128
+            if ip.To4() != nil {
+                ip, bits = ip.To4(), 32
+            }
+            prefixes = append(prefixes, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+            continue
+        }
+        ip, prefix, err := net.ParseCIDR(field)
+        if err != nil {
+            return nil, fmt.Errorf("invalid prefix %q", field)
+        }
+        // Interface addresses keep their host part, 10.0.0.2/24
+        prefix.IP = ip
+        if ip4 := ip.To4(); ip4 != nil {
+            prefix.IP = ip4
+        }
+        prefixes = append(prefixes, *prefix)
+    }
+    return prefixes, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestImportWGQuickConfig(t *testing.T) {
+    private, peerKey, psk := mustKey(t), mustKey(t).PublicKey(), mustKey(t)
+    conf := fmt.Sprintf(`# exported by wg-quick
+[Interface]
+PrivateKey = %s
+Address = 10.8.0.2/24, fd00::2/64
+ListenPort = 51820
+DNS = 10.8.0.1
+PostUp = iptables -A FORWARD -i %%i -j ACCEPT
+
+[Peer]
+PublicKey = %s
+PresharedKey = %s
+Endpoint = 203.0.113.7:51820
+AllowedIPs = 0.0.0.0/0, ::/0
+PersistentKeepalive = 25
+`, private, peerKey, psk)
+    
+    config, peers, err := ImportWGQuickConfig(strings.NewReader(conf))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if config.PrivateKey.Key() != private || config.ListenPort != 51820 {
+        t.Fatalf("interface = %+v", config)
+    }
+    if len(config.Addresses) != 2 || config.Addresses[0].String() != "10.8.0.2/24" || config.Addresses[1].String() != "fd00::2/64" {
+        t.Fatalf("addresses = %v", config.Addresses)
+    }
+    if !config.DNSProtection || len(config.DNSServers) != 1 || config.DNSServers[0] != "10.8.0.1" {
+        t.Fatalf("DNS = %v", config.DNSServers)
+    }
+    
+    if len(peers) != 1 || len(config.Peers) != 1 {
+        t.Fatalf("got %d peers", len(peers))
+    }
+    p := peers[0]
+    if p.PublicKey != peerKey || p.PresharedKey.Key() != psk || p.Endpoint.String() != "203.0.113.7:51820" {
+        t.Fatalf("peer = %+v", p)
+    }
+    if len(p.AllowedIPs) != 2 || p.AllowedIPs[0].String() != "0.0.0.0/0" || p.PersistentKeepalive != 25*time.Second {
+        t.Fatalf("peer = %+v", p)
+    }
+}
+
+func TestLoadConfigResolvesSecretReferences(t *testing.T) {
+    private, psk := mustKey(t), mustKey(t)
+    dir := t.TempDir()
+    pskFile := filepath.Join(dir, "psk")
+    if err := os.WriteFile(pskFile, []byte(psk.String()), 0600); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("WG_PRIVATE_KEY", private.String())
+    
+    write := func(conf string) string {
+        path := filepath.Join(dir, "wg0.conf")
+        if err := os.WriteFile(path, []byte(conf), 0600); err != nil {
+            t.Fatal(err)
+        }
+        return path
+    }
+    peer := "[Peer]\nPublicKey = " + mustKey(t).PublicKey().String() + "\nPresharedKey = file:" + pskFile + "\n"
+    
+    config, err := LoadConfig(write("[Interface]\nPrivateKey = env:WG_PRIVATE_KEY\n" + peer))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if config.PrivateKey.Key() != private || len(config.Peers) != 1 || config.Peers[0].PresharedKey.Key() != psk {
+        t.Fatal("references resolved to the wrong keys")
+    }
+    
+    _, err = LoadConfig(write("[Interface]\nPrivateKey = env:WG_MISSING_KEY\n" + peer))
+    if !errors.Is(err, ErrSecretNotFound) || !errors.Is(err, ErrBadWGQuickConfig) || !strings.Contains(err.Error(), "WG_MISSING_KEY") {
+        t.Fatalf("missing secret: %v", err)
+    }
+    
+    // A file that holds something else than a key
+    if err := os.WriteFile(pskFile, []byte("not a key"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := LoadConfig(write("[Interface]\nPrivateKey = env:WG_PRIVATE_KEY\n" + peer)); !errors.Is(err, ErrBadWGQuickConfig) {
+        t.Fatalf("invalid secret file: %v", err)
+    }
+}
+
+func TestImportWGQuickConfigRejectsMalformed(t *testing.T) {
+    for name, conf := range map[string]string{
+        "unknown section": "[Tunnel]\n",
+        "no section":      "ListenPort = 1\n",
+        "bad port":        "[Interface]\nListenPort = 70000\n",
+        "unknown key":     "[Peer]\nPublicKey = " + mustKey(t).PublicKey().String() + "\nWeight = 3\n",
+        "no public key":   "[Peer]\nAllowedIPs = 10.0.0.0/8\n",
+    } {
+        if _, _, err := ImportWGQuickConfig(strings.NewReader(conf)); !errors.Is(err, ErrBadWGQuickConfig) {
+            t.Errorf("%s: err = %v", name, err)
+        }
+    }
+}
+
+func TestWGQuickExportRoundTrip(t *testing.T) {
+    wg := newFakeWGClient()
+    vpn, log := newSimulatedVPN(t, wg)
+    
+    private := mustKey(t)
+    peer := PeerConfig{
+        PublicKey:           mustKey(t).PublicKey(),
+        PresharedKey:        SecretFromKey(mustKey(t)),
+        Endpoint:            &net.UDPAddr{IP: net.IPv4(198, 51, 100, 4), Port: 51820},
+        AllowedIPs:          []net.IPNet{mustCIDR(t, "10.8.0.0/24")},
+        PersistentKeepalive: 25 * time.Second,
+        SkipProbe:           true,
+    }
+    config := VPNConfig{
+        PrivateKey: SecretFromKey(private),
+        ListenPort: 51820,
+        Addresses:  []net.IPNet{{IP: net.IPv4(10, 8, 0, 2).To4(), Mask: net.CIDRMask(24, 32)}},
+        Peers:      []PeerConfig{peer},
+    }
+    if err := vpn.Start(config); err != nil {
+        t.Fatal(err)
+    }
+    defer vpn.Stop()
+    
+    if !log.contains("ip addr add 10.8.0.2/24 dev sim0") {
+        t.Fatalf("address not assigned: %v", log.commands)
+    }
+    
+    var redacted bytes.Buffer
+    if err := vpn.ExportWGQuickConfig(&redacted); err != nil {
+        t.Fatal(err)
+    }
+    if strings.Contains(redacted.String(), private.String()) {
+        t.Fatal("redacted export contains the private key")
+    }
+    
+    var full bytes.Buffer
+    if err := vpn.ExportWGQuickConfigWithPrivateKey(&full); err != nil {
+        t.Fatal(err)
+    }
+    imported, peers, err := ImportWGQuickConfig(&full)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if imported.PrivateKey.Key() != private || imported.ListenPort != 51820 || imported.Addresses[0].String() != "10.8.0.2/24" {
+        t.Fatalf("interface = %+v", imported)
+    }
+    
+    got := peers[0]
+    if got.PublicKey != peer.PublicKey || !got.PresharedKey.Equal(peer.PresharedKey) ||
+        got.Endpoint.String() != peer.Endpoint.String() || got.AllowedIPs[0].String() != "10.8.0.0/24" ||
+        got.PersistentKeepalive != peer.PersistentKeepalive {
+        t.Fatalf("peer = %+v", got)
+    }
+}